@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// certReloader serves the certificate (and mTLS client CA pool) read from
+// TLS_CERT_FILE / TLS_KEY_FILE / TLS_CLIENT_CA_FILE, re-reading them on
+// SIGHUP. Established connections keep the config they handshook with, so
+// in-flight builds are unaffected.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// tlsFromEnv returns nil when TLS_CERT_FILE and TLS_KEY_FILE are unset.
+func tlsFromEnv() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	go cr.watchSIGHUP()
+
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cr.mu.RLock()
+			defer cr.mu.RUnlock()
+			cfg := base.Clone()
+			cfg.Certificates = []tls.Certificate{*cr.cert}
+			if cr.clientCAs != nil {
+				cfg.ClientCAs = cr.clientCAs
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}, nil
+}
+
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if cr.caFile != "" {
+		pem, err := os.ReadFile(cr.caFile)
+		if err != nil {
+			return fmt.Errorf("loading client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", cr.caFile)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.cert, cr.clientCAs = &cert, pool
+	cr.mu.Unlock()
+	return nil
+}
+
+// watchSIGHUP reloads on each SIGHUP. A failed reload keeps serving the
+// previous certificate.
+func (cr *certReloader) watchSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := cr.load(); err != nil {
+			log.Printf("TLS reload failed, keeping current certificate: %v", err)
+			continue
+		}
+		log.Printf("TLS certificates reloaded")
+	}
+}
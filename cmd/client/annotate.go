@@ -0,0 +1,144 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// githubAnnotations turns compiler diagnostics into GitHub Actions
+// workflow commands, so they annotate the pull request, and adds the build
+// to the job summary. It's on in --ci mode under Actions, or with
+// --annotations github.
+var githubAnnotations bool
+
+// annotationsEnabled resolves --annotations: "github" and "none" are
+// explicit, "" follows --ci and the detected CI.
+func annotationsEnabled(mode string, flavor ciFlavor) (bool, error) {
+	switch mode {
+	case "":
+		return flavor == ciGitHub, nil
+	case "github":
+		return true, nil
+	case "none":
+		return false, nil
+	}
+	return false, fmt.Errorf("--annotations must be github or none, got %q", mode)
+}
+
+// githubAnnotation is the ::error workflow command for d. Paths are
+// relative to the repository root, as in the checkout Actions annotates.
+func githubAnnotation(d Diagnostic) string {
+	props := []string{"file=" + escapeProperty(strings.TrimPrefix(d.File, "./"))}
+	if d.Line > 0 {
+		props = append(props, fmt.Sprintf("line=%d", d.Line))
+	}
+	if d.Column > 0 {
+		props = append(props, fmt.Sprintf("col=%d", d.Column))
+	}
+	if d.Target != "" {
+		props = append(props, "title="+escapeProperty("build "+d.Target))
+	}
+	return "::error " + strings.Join(props, ",") + "::" + escapeData(d.Message)
+}
+
+// escapeData escapes a workflow command's message.
+func escapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeProperty escapes a workflow command's property value.
+func escapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// stepTiming is how long one pipeline step took.
+type stepTiming struct {
+	Name    string
+	Elapsed time.Duration
+	Failed  bool
+}
+
+// stepSummary is what the job summary reports about a build.
+type stepSummary struct {
+	OK          bool
+	Summary     BuildSummary
+	Matrix      *MatrixSummary
+	Artifact    string
+	Bytes       int64
+	SHA256      string
+	Diagnostics int
+	Category    string // why the build failed, per the server
+	Steps       []stepTiming
+	Total       time.Duration
+}
+
+// markdown renders s as a job summary fragment.
+func (s stepSummary) markdown() string {
+	var b strings.Builder
+	result := "✅ Build succeeded"
+	if !s.OK {
+		result = "❌ Build failed"
+	}
+	fmt.Fprintf(&b, "### billder: %s\n\n", result)
+	if s.Summary.Repo != "" {
+		fmt.Fprintf(&b, "`%s` at `%s`", s.Summary.Repo, cmp.Or(s.Summary.Describe, s.Summary.Commit))
+		if s.Summary.Target != "" {
+			fmt.Fprintf(&b, " for `%s`", s.Summary.Target)
+		}
+		b.WriteString("\n\n")
+	}
+	b.WriteString("| | |\n|---|---|\n")
+	if s.Artifact != "" {
+		fmt.Fprintf(&b, "| Artifact | `%s` |\n", s.Artifact)
+		fmt.Fprintf(&b, "| Size | %.2f MB (%d bytes) |\n", float64(s.Bytes)/1024/1024, s.Bytes)
+	}
+	if s.SHA256 != "" {
+		fmt.Fprintf(&b, "| sha256 | `%s` |\n", s.SHA256)
+	}
+	if s.Matrix != nil {
+		fmt.Fprintf(&b, "| Targets | %d succeeded, %d failed |\n", s.Matrix.Succeeded, s.Matrix.Failed)
+	}
+	if s.Diagnostics > 0 {
+		fmt.Fprintf(&b, "| Diagnostics | %d |\n", s.Diagnostics)
+	}
+	if s.Summary.Error != "" {
+		fmt.Fprintf(&b, "| Error | %s |\n", strings.ReplaceAll(s.Summary.Error, "|", `\|`))
+	}
+	if s.Category != "" {
+		fmt.Fprintf(&b, "| Error category | `%s` |\n", s.Category)
+	}
+	fmt.Fprintf(&b, "| Total time | %s |\n", s.Total.Round(100*time.Millisecond))
+	if len(s.Steps) > 0 {
+		b.WriteString("\n| Step | Time |\n|---|---|\n")
+		for _, st := range s.Steps {
+			mark := ""
+			if st.Failed {
+				mark = " ❌"
+			}
+			fmt.Fprintf(&b, "| %s%s | %s |\n", st.Name, mark, st.Elapsed.Round(100*time.Millisecond))
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// writeStepSummary appends s to $GITHUB_STEP_SUMMARY, if Actions set it.
+func writeStepSummary(s stepSummary) {
+	path := os.Getenv("GITHUB_STEP_SUMMARY")
+	if path == "" || !githubAnnotations {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err == nil {
+		_, err = f.WriteString(s.markdown())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		printf("Warning: could not write GITHUB_STEP_SUMMARY: %v\n", err)
+	}
+}
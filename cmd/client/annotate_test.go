@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useAnnotations turns GitHub annotations on or off for the length of the
+// test.
+func useAnnotations(t *testing.T, on bool) {
+	t.Helper()
+	prev := githubAnnotations
+	githubAnnotations = on
+	t.Cleanup(func() { githubAnnotations = prev })
+}
+
+// annotate replays a captured stream and returns the workflow commands
+// the client printed.
+func annotate(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := captureOutput(t)
+	r := newRenderer(false, false, ciGitHub)
+	readEvents(bufio.NewReader(bytes.NewReader(data)), r, false)
+	r.Close()
+	var cmds strings.Builder
+	for line := range strings.Lines(out.String()) {
+		if strings.HasPrefix(line, "::error") {
+			cmds.WriteString(line)
+		}
+	}
+	return cmds.String()
+}
+
+// The testdata captures are streams of a real server building a module
+// whose util package has two type errors, for one target and for two,
+// and one whose main.go declares unused variables.
+func TestGitHubAnnotationsFromCapturedStreams(t *testing.T) {
+	streams, _ := filepath.Glob(filepath.Join("testdata", "annotations", "*.sse"))
+	if len(streams) == 0 {
+		t.Fatal("no captured streams")
+	}
+	for _, path := range streams {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			useAnnotations(t, true)
+			got := annotate(t, path)
+			golden := strings.TrimSuffix(path, ".sse") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("annotations\n%s\nwant\n%s", got, want)
+			}
+
+			// Outside Actions the output has no workflow commands
+			useAnnotations(t, false)
+			if got := annotate(t, path); got != "" {
+				t.Errorf("annotated without --annotations:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestGitHubAnnotation(t *testing.T) {
+	for _, tc := range []struct {
+		d    Diagnostic
+		want string
+	}{
+		{Diagnostic{File: "./main.go", Line: 6, Column: 2, Message: "declared and not used: x"}, "::error file=main.go,line=6,col=2::declared and not used: x"},
+		{Diagnostic{File: "util/util.go", Line: 4, Message: "too many return values"}, "::error file=util/util.go,line=4::too many return values"},
+		{Diagnostic{File: "go.mod", Message: "bad"}, "::error file=go.mod::bad"},
+		{Diagnostic{Target: "windows/amd64", File: "a.go", Line: 1, Column: 1, Message: "m"}, "::error file=a.go,line=1,col=1,title=build windows/amd64::m"},
+		{Diagnostic{File: "a,b:c%.go", Line: 1, Message: "100% done\r\nnext: line, more"}, "::error file=a%2Cb%3Ac%25.go,line=1::100%25 done%0D%0Anext: line, more"},
+		{Diagnostic{File: "a.go", Line: 1, Message: "::warning::forged"}, "::error file=a.go,line=1::::warning::forged"},
+	} {
+		if got := githubAnnotation(tc.d); got != tc.want {
+			t.Errorf("githubAnnotation(%+v) = %q, want %q", tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestAnnotationsEnabled(t *testing.T) {
+	for _, tc := range []struct {
+		mode   string
+		flavor ciFlavor
+		want   bool
+		err    bool
+	}{
+		{"", ciGitHub, true, false},
+		{"", ciBuildkite, false, false},
+		{"", ciGeneric, false, false},
+		{"", "", false, false},
+		{"github", "", true, false},
+		{"none", ciGitHub, false, false},
+		{"gitlab", ciGitHub, false, true},
+	} {
+		got, err := annotationsEnabled(tc.mode, tc.flavor)
+		if got != tc.want || (err != nil) != tc.err {
+			t.Errorf("annotationsEnabled(%q, %q) = %v, %v", tc.mode, tc.flavor, got, err)
+		}
+	}
+}
+
+func TestWriteStepSummary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "summary.md")
+	t.Setenv("GITHUB_STEP_SUMMARY", path)
+	s := stepSummary{
+		OK:       true,
+		Summary:  BuildSummary{Repo: "github.com/acme/app", Commit: "3281ff0", Describe: "v1.2.0", Target: "windows/amd64"},
+		Artifact: "app.exe",
+		Bytes:    3 << 20,
+		SHA256:   "00ff",
+		Steps:    []stepTiming{{Name: "Cloning repository", Elapsed: 1240 * time.Millisecond}, {Name: "Compiling", Elapsed: 8 * time.Second}},
+		Total:    9260 * time.Millisecond,
+	}
+	want := "### billder: ✅ Build succeeded\n\n" +
+		"`github.com/acme/app` at `v1.2.0` for `windows/amd64`\n\n" +
+		"| | |\n|---|---|\n" +
+		"| Artifact | `app.exe` |\n" +
+		"| Size | 3.00 MB (3145728 bytes) |\n" +
+		"| sha256 | `00ff` |\n" +
+		"| Total time | 9.3s |\n" +
+		"\n| Step | Time |\n|---|---|\n" +
+		"| Cloning repository | 1.2s |\n" +
+		"| Compiling | 8s |\n\n"
+
+	useAnnotations(t, false)
+	writeStepSummary(s)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("summary written outside Actions")
+	}
+
+	useAnnotations(t, true)
+	writeStepSummary(s)
+	failed := stepSummary{
+		Summary:     BuildSummary{Repo: "github.com/acme/app", Commit: "3281ff0", Error: "compile | failed"},
+		Diagnostics: 2,
+		Category:    "compile_failed",
+		Steps:       []stepTiming{{Name: "Compiling", Elapsed: time.Second, Failed: true}},
+		Total:       time.Second,
+	}
+	writeStepSummary(failed)
+	data, _ := os.ReadFile(path)
+	wantFailed := "### billder: ❌ Build failed\n\n" +
+		"`github.com/acme/app` at `3281ff0`\n\n" +
+		"| | |\n|---|---|\n" +
+		"| Diagnostics | 2 |\n" +
+		"| Error | compile \\| failed |\n" +
+		"| Error category | `compile_failed` |\n" +
+		"| Total time | 1s |\n" +
+		"\n| Step | Time |\n|---|---|\n" +
+		"| Compiling ❌ | 1s |\n\n"
+	if got := string(data); got != want+wantFailed {
+		t.Errorf("$GITHUB_STEP_SUMMARY holds\n%s\nwant\n%s", got, want+wantFailed)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// apiPrefix is the server API version the client speaks.
+const apiPrefix = "/v1"
+
+// send issues a request for path under /v1, retrying the legacy unversioned
+// path when an older server answers 404.
+func send(httpClient *http.Client, auth *authOptions, method, base, path, contentType string, body []byte) (*http.Response, error) {
+	return sendHeader(httpClient, auth, method, base, path, contentType, nil, body)
+}
+
+// sendHeader is send with extra request headers.
+func sendHeader(httpClient *http.Client, auth *authOptions, method, base, path, contentType string, header http.Header, body []byte) (*http.Response, error) {
+	do := func(fullPath string) (*http.Response, error) {
+		req, err := http.NewRequest(method, base+fullPath, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if traceparent != "" {
+			req.Header.Set("traceparent", traceparent)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		auth.Apply(req, body)
+		return httpClient.Do(req)
+	}
+
+	resp, err := do(apiPrefix + path)
+	if err == nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return do(path)
+	}
+	return resp, err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+)
+
+// runAttach implements `client attach <build-id>` (alias `status`),
+// replaying the buffered progress of a running or recently finished build
+// and following it live.
+// The artifact is only delivered to the client that started the build.
+func runAttach(args []string) {
+	fs := flag.NewFlagSet("attach", flag.ExitOnError)
+	url := fs.String("url", "", "Billder Service URL")
+	auth := addAuthFlags(fs)
+	tlsOpts := addTLSFlags(fs)
+	verbose := fs.Bool("verbose", false, "Show all server log lines on a TTY")
+	lastEventID := fs.String("last-event-id", "", "Resume after this event id instead of replaying from the start")
+	fs.Parse(args)
+
+	if *url == "" || fs.NArg() != 1 {
+		printLine("❌ Error: usage: client attach --url URL [--last-event-id N] <build-id>")
+		exit(exitUsage)
+	}
+	id := fs.Arg(0)
+
+	header := http.Header{}
+	if *lastEventID != "" {
+		header.Set("Last-Event-ID", *lastEventID)
+	}
+	resp, err := sendHeader(tlsOpts.Client(), auth, "GET", serviceBase(*url), "/builds/"+id+"/events", "", header, nil)
+	if err != nil {
+		printf("❌ Connection failed: %v\n", err)
+		exit(exitConnection)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		serverError(resp)
+	}
+	printf("🔗 Attached to build %s\n\n", id)
+
+	res := renderEvents(resp.Body, *verbose)
+	if res.lastEventID != "" {
+		printf("\n📍 Last event id: %s\n", res.lastEventID)
+	}
+	exitWith(res)
+}
+
+// renderEvents renders a build's event stream like a live build's.
+func renderEvents(body io.Reader, verbose bool) streamResult {
+	color := isTTY(os.Stdout)
+	out := newRenderer(color, verbose, "")
+	res := readEvents(bufio.NewReader(body), out, color)
+	out.Close()
+	return res
+}
+
+// exitWith exits with the outcome of a followed build.
+func exitWith(res streamResult) {
+	if len(res.failed) > 0 || res.category != "" || res.end != nil && !res.end.OK {
+		if hint := endHint(res.reason(), res.category); hint != "" {
+			printf("%s\n", hint)
+		}
+		exit(res.exitCode())
+	}
+	exit(exitOK)
+}
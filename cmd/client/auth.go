@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/rexlx/bilder/pkg/client"
+)
+
+// authOptions holds --token, --key-id and --google-auth. With --key-id the
+// token is used as an HMAC key and never sent; otherwise it goes in
+// X-Billder-Token. --google-auth adds a Google ID token for the service URL.
+type authOptions struct {
+	token      *string
+	keyID      *string
+	googleAuth *bool
+	idToken    string
+}
+
+func addAuthFlags(fs *flag.FlagSet) *authOptions {
+	return &authOptions{
+		token:      fs.String("token", "", "Auth Token (optional)"),
+		keyID:      fs.String("key-id", "", "Sign requests with --token as an HMAC key under this key ID"),
+		googleAuth: fs.Bool("google-auth", false, "Send a Google ID token (metadata server or gcloud) for the service URL"),
+	}
+}
+
+// Apply authenticates req, whose body is body.
+func (o *authOptions) Apply(req *http.Request, body []byte) {
+	if *o.googleAuth {
+		if o.idToken == "" {
+			audience := req.URL.Scheme + "://" + req.URL.Host
+			token, err := googleIDToken(audience)
+			if err != nil {
+				printf("❌ Google auth failed: %v\n", err)
+				exit(exitConnection)
+			}
+			o.idToken = token
+		}
+		req.Header.Set("Authorization", "Bearer "+o.idToken)
+	}
+	switch {
+	case *o.token == "":
+	case *o.keyID != "":
+		client.Sign(req, *o.keyID, *o.token, body)
+	default:
+		req.Header.Set("X-Billder-Token", *o.token)
+	}
+}
+
+// describeStatus adds the server's auth reason code, if any, to the status.
+func describeStatus(resp *http.Response) string {
+	if reason := resp.Header.Get("X-Billder-Auth-Error"); reason != "" {
+		return resp.Status + " (" + reason + ")"
+	}
+	if retry := resp.Header.Get("Retry-After"); retry != "" {
+		return resp.Status + " (retry after " + retry + "s)"
+	}
+	return resp.Status
+}
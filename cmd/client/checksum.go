@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checksumPath is the sidecar file holding the sha256 of artifact.
+func checksumPath(artifact string) string {
+	return artifact + ".sha256"
+}
+
+// errChecksumMismatch means the saved artifact isn't what the server sent.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checkArtifact hashes a downloaded artifact, compares it with the server's
+// digest when there is one, and writes the sha256sum-compatible sidecar
+// unless sidecar is false. A mismatch leaves no sidecar behind.
+func checkArtifact(path, serverSum string, sidecar bool) (string, error) {
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	if serverSum != "" && !strings.EqualFold(serverSum, sum) {
+		return sum, fmt.Errorf("%w: the server sent sha256 %s, the saved file is %s", errChecksumMismatch, serverSum, sum)
+	}
+	if sidecar {
+		line := sum + "  " + filepath.Base(path) + "\n"
+		if err := os.WriteFile(checksumPath(path), []byte(line), 0o644); err != nil {
+			return sum, err
+		}
+	}
+	return sum, nil
+}
+
+// runVerify implements `client verify <file>`: it recomputes the file's
+// sha256 and compares it with --sha256 or the file's .sha256 sidecar, or
+// with --provenance checks the file's signed provenance instead.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	want := fs.String("sha256", "", "Expected hex digest (default: read <file>.sha256)")
+	provenance := fs.Bool("provenance", false, "Check the signed provenance in <file>.provenance.json instead")
+	provenanceFile := fs.String("provenance-file", "", "Provenance to check (implies --provenance)")
+	publicKey := fs.String("public-key", "", "PEM public key the provenance must be signed with")
+	url := fs.String("url", "", "Billder Service URL to fetch the signing key from, without --public-key")
+	auth := addAuthFlags(fs)
+	tlsOpts := addTLSFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: client verify [--sha256 <hex>] <file>")
+		fmt.Fprintln(fs.Output(), "       client verify --provenance [--public-key <pem> | --url URL] <file>")
+		fs.PrintDefaults()
+	}
+	// Accept the flag after the file too
+	var files []string
+	for len(args) > 0 {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) > 0 {
+			files, args = append(files, args[0]), args[1:]
+		}
+	}
+	if len(files) != 1 {
+		fs.Usage()
+		exit(exitUsage)
+	}
+	file := files[0]
+	if *provenance || *provenanceFile != "" {
+		runVerifyProvenance(file, *provenanceFile, *publicKey, *url, auth, tlsOpts)
+	}
+
+	expected, source := strings.TrimSpace(*want), "--sha256"
+	if expected == "" {
+		data, err := os.ReadFile(checksumPath(file))
+		if errors.Is(err, os.ErrNotExist) {
+			printf("❌ No checksum to verify against: %s is missing; pass --sha256\n", checksumPath(file))
+			exit(exitUsage)
+		} else if err != nil {
+			printf("❌ Could not read %s: %v\n", checksumPath(file), err)
+			exit(exitUsage)
+		}
+		// "<hex>  <name>", or "<hex> *<name>" for binary mode
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 {
+			printf("❌ %s is empty\n", checksumPath(file))
+			exit(exitUsage)
+		}
+		expected, source = fields[0], checksumPath(file)
+	}
+
+	sum, err := fileSHA256(file)
+	if err != nil {
+		printf("❌ Could not read %s: %v\n", file, err)
+		exit(exitUsage)
+	}
+	if !strings.EqualFold(sum, expected) {
+		printf("❌ %s: FAILED\n   expected %s (from %s)\n   got      %s\n", file, expected, source, sum)
+		exit(exitChecksum)
+	}
+	printf("✅ %s: OK (%s)\n", file, sum)
+	exit(exitOK)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ciFlavor selects how log groups are marked in --ci mode.
+type ciFlavor string
+
+const (
+	ciGeneric   ciFlavor = "generic"
+	ciGitHub    ciFlavor = "github"
+	ciBuildkite ciFlavor = "buildkite"
+)
+
+// detectCI picks the CI flavor from an environment map.
+func detectCI(env map[string]string) ciFlavor {
+	switch {
+	case env["GITHUB_ACTIONS"] == "true":
+		return ciGitHub
+	case env["BUILDKITE"] == "true":
+		return ciBuildkite
+	}
+	return ciGeneric
+}
+
+// environMap returns the process environment as a map.
+func environMap() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// startGroup returns the marker opening a collapsible log section.
+func (c ciFlavor) startGroup(name string) string {
+	switch c {
+	case ciGitHub:
+		return "::group::" + name
+	case ciBuildkite:
+		return "--- " + name
+	}
+	return "== " + name
+}
+
+// endGroup returns the marker closing a section, or "" if the flavor has none.
+func (c ciFlavor) endGroup() string {
+	if c == ciGitHub {
+		return "::endgroup::"
+	}
+	return ""
+}
+
+// fileSHA256 returns the hex sha256 of a file.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeGitHubOutput appends key=value lines to the $GITHUB_OUTPUT file.
+func writeGitHubOutput(path string, kv ...string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for i := 0; i+1 < len(kv); i += 2 {
+		if _, err := fmt.Fprintf(f, "%s=%s\n", kv[i], kv[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectCI(t *testing.T) {
+	for _, tc := range []struct {
+		env  map[string]string
+		want ciFlavor
+	}{
+		{nil, ciGeneric},
+		{map[string]string{"CI": "true"}, ciGeneric},
+		{map[string]string{"GITHUB_ACTIONS": "true", "CI": "true"}, ciGitHub},
+		{map[string]string{"BUILDKITE": "true", "CI": "true"}, ciBuildkite},
+		{map[string]string{"GITHUB_ACTIONS": "false"}, ciGeneric},
+		{map[string]string{"GITHUB_ACTIONS": "1"}, ciGeneric},
+		{map[string]string{"BUILDKITE": ""}, ciGeneric},
+		{map[string]string{"GITHUB_ACTIONS": "true", "BUILDKITE": "true"}, ciGitHub},
+	} {
+		if got := detectCI(tc.env); got != tc.want {
+			t.Errorf("detectCI(%v) = %s, want %s", tc.env, got, tc.want)
+		}
+	}
+}
+
+// Each flavor wraps every step in its own log group markers.
+func TestCIStepGroups(t *testing.T) {
+	for _, tc := range []struct {
+		flavor ciFlavor
+		want   []string
+	}{
+		{ciGitHub, []string{"::group::Step 1/2: Cloning", "Step 1/2: Cloning done", "::endgroup::", "::group::Step 2/2: Compiling", "Step 2/2: Compiling failed", "::endgroup::"}},
+		{ciBuildkite, []string{"--- Step 1/2: Cloning", "Step 1/2: Cloning done", "--- Step 2/2: Compiling", "Step 2/2: Compiling failed"}},
+		{ciGeneric, []string{"== Step 1/2: Cloning", "Step 1/2: Cloning done", "== Step 2/2: Compiling", "Step 2/2: Compiling failed"}},
+	} {
+		t.Run(string(tc.flavor), func(t *testing.T) {
+			out := captureOutput(t)
+			r := newRenderer(false, false, tc.flavor)
+			r.Step(Step{Index: 1, Total: 2, Name: "Cloning"})
+			r.Step(Step{Index: 2, Total: 2, Name: "Compiling"})
+			r.Message("Error: compile failed")
+			r.Close()
+
+			var got []string
+			for line := range strings.Lines(out.String()) {
+				line = strings.TrimSpace(line)
+				if strings.HasPrefix(line, "::") || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "== ") || strings.HasPrefix(line, "Step ") {
+					// Timings vary; keep what comes before them
+					line, _, _ = strings.Cut(line, " (")
+					got = append(got, line)
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("printed\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestPlainOutputAndLogFile(t *testing.T) {
+	out := captureOutput(t)
+	var log bytes.Buffer
+	prevPlain, prevLog := plainOutput, logFile
+	plainOutput, logFile = true, &log
+	t.Cleanup(func() { plainOutput, logFile = prevPlain, prevLog })
+
+	printf("✅ Step 1/3: Cloning\n")
+	printf("\r\033[K\033[31m❌ failed\033[0m\n")
+	if got, want := out.String(), "Step 1/3: Cloning\n\r\033[K\033[31mfailed\033[0m\n"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+	if got, want := log.String(), "Step 1/3: Cloning\nfailed\n"; got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestWriteGitHubOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output")
+	os.WriteFile(path, []byte("earlier=step\n"), 0o644)
+	if err := writeGitHubOutput(path, "artifact", "dist/app", "sha256", "00ff", "odd"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if got, want := string(data), "earlier=step\nartifact=dist/app\nsha256=00ff\n"; got != want {
+		t.Errorf("$GITHUB_OUTPUT holds %q, want %q", got, want)
+	}
+}
+
+func TestFailureExit(t *testing.T) {
+	for category, want := range map[string]int{
+		"compile_failed":    exitBuildFailed,
+		"deps_failed":       exitBuildFailed,
+		"invalid_request":   exitBuildFailed,
+		"timeout":           exitTimeout,
+		"internal":          exitServerFault,
+		"oom":               exitServerFault,
+		"toolchain_missing": exitServerFault,
+		"":                  exitBuildFailed,
+		"from_the_future":   exitBuildFailed,
+	} {
+		if got := failureExit(category); got != want {
+			t.Errorf("failureExit(%q) = %d, want %d", category, got, want)
+		}
+	}
+	for reason, want := range map[string]int{"canceled_by_user": exitCanceled, "shutdown": exitShutdown, "timeout": exitTimeout, "error": exitServerFault} {
+		res := streamResult{end: &StreamEnd{Reason: reason}, category: "internal"}
+		if got := res.exitCode(); got != want {
+			t.Errorf("exit code for an end with reason %s: %d, want %d", reason, got, want)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// completionShells are the shells `client completion` writes scripts for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// flagValues are the fixed choices of flags that take one of a few words.
+var flagValues = map[string][]string{
+	"annotations":   {"github", "none"},
+	"av-mode":       {"advisory", "enforce"},
+	"cmd-failure":   {"best_effort", "fail_fast"},
+	"color":         {"keep", "strip"},
+	"deliver":       {"primary", "both"},
+	"on-interrupt":  {"finish", "cancel"},
+	"packager":      {"go", "fyne"},
+	"priority":      {"low", "normal", "high"},
+	"resume-policy": {"restart"},
+	"source":        {"github", "server"},
+}
+
+// completer answers tab completion for the client's command line. It only
+// reads what is already on disk, never the server, so it stays instant.
+type completer struct {
+	commands map[string]*flag.FlagSet // by subcommand; "" is the default build
+	targets  []string                 // os/arch pairs
+	last     lastRun
+}
+
+// newCompleter describes this client: the build flags come from
+// flag.CommandLine, which must already be defined, and the targets from
+// the last interactive run and the cached server list.
+func newCompleter() completer {
+	attach := flag.NewFlagSet("attach", flag.ContinueOnError)
+	attach.String("url", "", "")
+	addAuthFlags(attach)
+	addTLSFlags(attach)
+	attach.Bool("verbose", false, "")
+	attach.String("last-event-id", "", "")
+
+	tail := flag.NewFlagSet("tail", flag.ContinueOnError)
+	tail.String("url", "", "")
+	addAuthFlags(tail)
+	addTLSFlags(tail)
+	tail.Bool("verbose", false, "")
+
+	watch := flag.NewFlagSet("watch", flag.ContinueOnError)
+	watch.String("url", "", "")
+	addAuthFlags(watch)
+	addTLSFlags(watch)
+	watch.String("repo", "", "")
+	watch.String("ref", "", "")
+	watch.String("target", "", "")
+	watch.Duration("interval", 0, "")
+	watch.Int("keep", 0, "")
+	watch.String("dir", "", "")
+	watch.String("on-interrupt", "", "")
+	watch.Bool("verbose", false, "")
+
+	targets := flag.NewFlagSet("targets", flag.ContinueOnError)
+	targets.String("url", "", "")
+	addAuthFlags(targets)
+	targets.Bool("cgo", false, "")
+	targets.String("target", "", "")
+	addTLSFlags(targets)
+
+	verify := flag.NewFlagSet("verify", flag.ContinueOnError)
+	verify.String("sha256", "", "")
+	verify.Bool("provenance", false, "")
+	verify.String("provenance-file", "", "")
+	verify.String("public-key", "", "")
+	verify.String("url", "", "")
+	addAuthFlags(verify)
+	addTLSFlags(verify)
+
+	lookup := flag.NewFlagSet("lookup", flag.ContinueOnError)
+	lookup.String("url", "", "")
+	addAuthFlags(lookup)
+	addTLSFlags(lookup)
+	lookup.Bool("json", false, "")
+
+	stats := flag.NewFlagSet("stats", flag.ContinueOnError)
+	stats.String("url", "", "")
+	stats.String("repo", "", "")
+	stats.Int("days", 0, "")
+	addAuthFlags(stats)
+	addTLSFlags(stats)
+	stats.Bool("json", false, "")
+
+	update := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	update.String("source", "", "")
+	update.String("github-repo", "", "")
+	update.String("url", "", "")
+	addAuthFlags(update)
+	addTLSFlags(update)
+	update.Bool("check", false, "")
+	update.Bool("force", false, "")
+
+	c := completer{
+		commands: map[string]*flag.FlagSet{
+			"":            flag.CommandLine,
+			"build":       flag.CommandLine,
+			"attach":      attach,
+			"status":      attach,
+			"tail":        tail,
+			"targets":     targets,
+			"verify":      verify,
+			"lookup":      lookup,
+			"stats":       stats,
+			"watch":       watch,
+			"self-update": update,
+			"version":     flag.NewFlagSet("version", flag.ContinueOnError),
+			"completion":  flag.NewFlagSet("completion", flag.ContinueOnError),
+		},
+		last: loadLastRun(),
+	}
+	if c.last.Target != "" {
+		c.targets = append(c.targets, c.last.Target)
+	}
+	known := cachedTargets()
+	if len(known) == 0 {
+		known = builtinTargets
+	}
+	for _, t := range known {
+		if !slices.Contains(c.targets, t) {
+			c.targets = append(c.targets, t)
+		}
+	}
+	return c
+}
+
+// complete returns the candidates for the last of words, the arguments
+// typed so far after the program name; the last one may be empty. No
+// candidates means the shell should fall back to completing file names.
+func (c completer) complete(words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur, before := words[len(words)-1], words[:len(words)-1]
+
+	cmd := ""
+	if len(before) > 0 {
+		if _, ok := c.commands[before[0]]; ok {
+			cmd, before = before[0], before[1:]
+		}
+	} else if !strings.HasPrefix(cur, "-") {
+		var names []string
+		for name := range c.commands {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+		return matching(names, cur)
+	}
+	fs := c.commands[cmd]
+
+	// The value of "--flag value"
+	if len(before) > 0 {
+		prev := before[len(before)-1]
+		if f := lookupFlag(fs, prev); f != nil && !strings.Contains(prev, "=") && !isBoolFlag(f) {
+			return matching(c.values(f.Name, cur, before), cur)
+		}
+	}
+
+	if strings.HasPrefix(cur, "-") {
+		dashes := "--"
+		if !strings.HasPrefix(cur, "--") {
+			dashes = "-"
+		}
+		// The value of "--flag=value"
+		if name, value, ok := strings.Cut(strings.TrimLeft(cur, "-"), "="); ok {
+			if f := fs.Lookup(name); f == nil || isBoolFlag(f) {
+				return nil
+			}
+			var out []string
+			for _, v := range matching(c.values(name, value, before), value) {
+				out = append(out, dashes+name+"="+v)
+			}
+			return out
+		}
+		var names []string
+		fs.VisitAll(func(f *flag.Flag) { names = append(names, dashes+f.Name) })
+		return matching(names, cur)
+	}
+
+	switch cmd {
+	case "completion":
+		return matching(completionShells, cur)
+	case "attach", "status", "tail", "verify", "lookup":
+		return nil // a build ID or a file
+	}
+	// the others take no arguments, only flags
+	if cur == "" {
+		var names []string
+		fs.VisitAll(func(f *flag.Flag) { names = append(names, "--"+f.Name) })
+		return names
+	}
+	return nil
+}
+
+// values are the candidates for the value of flag name; before is the rest
+// of the command line, where an --os narrows --arch.
+func (c completer) values(name, cur string, before []string) []string {
+	switch name {
+	case "os":
+		var oses []string
+		for _, t := range c.targets {
+			if goos, _, _ := strings.Cut(t, "/"); !slices.Contains(oses, goos) {
+				oses = append(oses, goos)
+			}
+		}
+		return oses
+	case "arch":
+		goos := flagValue(before, "os")
+		var arches []string
+		for _, t := range c.targets {
+			o, arch, _ := strings.Cut(t, "/")
+			if (goos == "" || o == goos) && !slices.Contains(arches, arch) {
+				arches = append(arches, arch)
+			}
+		}
+		return arches
+	case "target":
+		return c.targets
+	case "targets":
+		// A comma-separated list: complete its last entry
+		i := strings.LastIndex(cur, ",")
+		chosen := strings.Split(cur[:i+1], ",")
+		var out []string
+		for _, t := range c.targets {
+			if !slices.Contains(chosen, t) {
+				out = append(out, cur[:i+1]+t)
+			}
+		}
+		return out
+	case "url":
+		if c.last.URL != "" {
+			return []string{c.last.URL}
+		}
+	case "repo":
+		if c.last.Repo != "" {
+			return []string{c.last.Repo}
+		}
+	}
+	return flagValues[name]
+}
+
+// lookupFlag returns the flag that word names ("-os", "--os=x"), or nil.
+func lookupFlag(fs *flag.FlagSet, word string) *flag.Flag {
+	if !strings.HasPrefix(word, "-") || word == "-" || word == "--" {
+		return nil
+	}
+	name, _, _ := strings.Cut(strings.TrimLeft(word, "-"), "=")
+	return fs.Lookup(name)
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// flagValue is the value given to flag name in words, or "".
+func flagValue(words []string, name string) string {
+	for i, w := range words {
+		switch {
+		case w == "-"+name || w == "--"+name:
+			if i+1 < len(words) {
+				return words[i+1]
+			}
+		case strings.HasPrefix(w, "-"+name+"="), strings.HasPrefix(w, "--"+name+"="):
+			_, v, _ := strings.Cut(w, "=")
+			return v
+		}
+	}
+	return ""
+}
+
+// matching keeps the candidates that start with prefix.
+func matching(candidates []string, prefix string) []string {
+	var out []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// targetsCachePath is where the server's last target list is kept for
+// completion, under the user's cache directory.
+func targetsCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "billder", "targets.json")
+}
+
+// cacheTargets remembers a target list the server sent.
+func cacheTargets(targets []string) {
+	path := targetsCachePath()
+	if path == "" || len(targets) == 0 {
+		return
+	}
+	data, _ := json.Marshal(targets)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err == nil {
+		os.WriteFile(path, data, 0o644)
+	}
+}
+
+func cachedTargets() []string {
+	var targets []string
+	if data, err := os.ReadFile(targetsCachePath()); err == nil {
+		json.Unmarshal(data, &targets)
+	}
+	return targets
+}
+
+// runCompletion implements `client completion bash|zsh|fish`, printing a
+// script that asks `client __complete` for candidates.
+func runCompletion(args []string) {
+	if len(args) != 1 || !slices.Contains(completionShells, args[0]) {
+		printLine("❌ Error: usage: client completion bash|zsh|fish")
+		exit(exitUsage)
+	}
+	name := filepath.Base(os.Args[0])
+	script := map[string]string{"bash": bashCompletion, "zsh": zshCompletion, "fish": fishCompletion}[args[0]]
+	fmt.Print(strings.NewReplacer("{{name}}", name, "{{func}}", "_"+strings.NewReplacer("-", "_", ".", "_").Replace(name)).Replace(script))
+}
+
+// runComplete implements the hidden `client __complete <words...>` the
+// scripts call, printing one candidate per line.
+func runComplete(words []string) {
+	for _, c := range newCompleter().complete(words) {
+		fmt.Println(c)
+	}
+}
+
+// bashCompletion hands the words up to the cursor to __complete. Bash splits
+// words at = and :, so the part of each candidate before the last of those
+// is trimmed off to match what bash replaces.
+const bashCompletion = `# bash completion for {{name}}; load with: source <({{name}} completion bash)
+{{func}}_complete() {
+    local line=${COMP_LINE:0:COMP_POINT} words
+    read -ra words <<< "$line"
+    [[ $line == *[[:space:]] || ${#words[@]} -eq 0 ]] && words+=("")
+    local cur=${words[${#words[@]}-1]}
+    local cut=${cur%"${cur##*[=:]}"}
+    local IFS=$'\n'
+    COMPREPLY=($("${words[0]}" __complete "${words[@]:1}" 2>/dev/null))
+    COMPREPLY=("${COMPREPLY[@]#"$cut"}")
+}
+complete -o default -F {{func}}_complete {{name}}
+`
+
+const zshCompletion = `#compdef {{name}}
+# zsh completion for {{name}}; load with: source <({{name}} completion zsh)
+{{func}}_complete() {
+    local -a candidates
+    candidates=(${(f)"$(${words[1]} __complete "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+    if (( ${#candidates} )); then
+        compadd -Q -- "${candidates[@]}"
+    else
+        _files
+    fi
+}
+compdef {{func}}_complete {{name}}
+`
+
+const fishCompletion = `# fish completion for {{name}}; load with: {{name}} completion fish | source
+function {{func}}_complete
+    set -l words (commandline -opc) (commandline -ct)
+    set -l candidates ($words[1] __complete $words[2..-1] 2>/dev/null)
+    if test (count $candidates) -eq 0
+        __fish_complete_path (commandline -ct)
+    else
+        printf '%s\n' $candidates
+    end
+end
+complete -c {{name}} -f -a '({{func}}_complete)'
+`
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testCompleter is newCompleter over an empty config and cache directory,
+// with the build flags main would define.
+func testCompleter(t *testing.T, last *lastRun, cached []string) completer {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	t.Setenv("HOME", dir)
+	if last != nil {
+		last.save()
+	}
+	cacheTargets(cached)
+
+	build := flag.NewFlagSet("build", flag.ContinueOnError)
+	build.String("repo", "", "")
+	build.String("os", "windows", "")
+	build.String("arch", "amd64", "")
+	build.String("url", "", "")
+	build.String("targets", "", "")
+	build.String("color", "", "")
+	build.String("priority", "", "")
+	build.Bool("verbose", false, "")
+	build.Bool("cgo", true, "")
+	c := newCompleter()
+	c.commands[""], c.commands["build"] = build, build
+	return c
+}
+
+func TestComplete(t *testing.T) {
+	c := testCompleter(t, nil, []string{"linux/amd64", "linux/arm64", "windows/amd64", "darwin/arm64"})
+	for _, tc := range []struct {
+		line string // the cursor is at the end
+		want []string
+	}{
+		// Subcommands
+		{"", []string{"attach", "build", "completion", "lookup", "self-update", "stats", "status", "tail", "targets", "verify", "version", "watch"}},
+		{"s", []string{"self-update", "stats", "status"}},
+		{"ta", []string{"tail", "targets"}},
+		{"nope", nil},
+
+		// Flag names, with the dashes they were typed with
+		{"--v", []string{"--verbose"}},
+		{"-v", []string{"-verbose"}},
+		{"--c", []string{"--color", "--cgo"}},
+		{"build --re", []string{"--repo"}},
+		{"tail --", []string{"--url", "--token", "--key-id", "--google-auth", "--cacert", "--insecure", "--cert", "--key", "--verbose"}},
+		{"attach --last", []string{"--last-event-id"}},
+		{"version --", nil},
+		{"--nope", nil},
+
+		// Flag values
+		{"--os ", []string{"linux", "windows", "darwin"}},
+		{"--os w", []string{"windows"}},
+		{"--os=", []string{"--os=linux", "--os=windows", "--os=darwin"}},
+		{"-os=d", []string{"-os=darwin"}},
+		{"--arch ", []string{"amd64", "arm64"}},
+		{"--os linux --arch ", []string{"amd64", "arm64"}},
+		{"--os windows --arch ", []string{"amd64"}},
+		{"--os=darwin --arch=", []string{"--arch=arm64"}},
+		{"--color ", []string{"keep", "strip"}},
+		{"--priority h", []string{"high"}},
+		{"watch --target lin", []string{"linux/amd64", "linux/arm64"}},
+		{"watch --on-interrupt ", []string{"finish", "cancel"}},
+		{"self-update --source=g", []string{"--source=github"}},
+		{"--targets ", []string{"linux/amd64", "linux/arm64", "windows/amd64", "darwin/arm64"}},
+		{"--targets linux/amd64,", []string{"linux/amd64,linux/arm64", "linux/amd64,windows/amd64", "linux/amd64,darwin/arm64"}},
+		{"--targets linux/amd64,darwin/arm64,w", []string{"linux/amd64,darwin/arm64,windows/amd64"}},
+		{"--targets=linux/arm64,l", []string{"--targets=linux/arm64,linux/amd64"}},
+		{"--repo ", nil}, // no last run to offer
+		{"--verbose=", nil},
+
+		// Bool flags take no value
+		{"--verbose ", []string{"--repo", "--os", "--arch", "--url", "--targets", "--color", "--priority", "--verbose", "--cgo"}},
+
+		// Arguments
+		{"completion ", []string{"bash", "zsh", "fish"}},
+		{"completion z", []string{"zsh"}},
+		{"attach ", nil},
+		{"lookup abc", nil},
+		{"verify ./dist/app.exe --sha", []string{"--sha256"}},
+		{"stats x", nil},
+	} {
+		words := strings.Split(tc.line, " ")
+		got := c.complete(words)
+		// Flags come in the flag package's sorted order
+		if strings.Contains(tc.line, "-") && !strings.Contains(tc.line, "=") {
+			slices.Sort(got)
+			slices.Sort(tc.want)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("complete(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+// The last interactive run's choices come first; without a cached server
+// list the built-in targets are offered.
+func TestCompleteFromLastRun(t *testing.T) {
+	c := testCompleter(t, &lastRun{URL: "https://billder.example.com", Repo: "github.com/acme/app", Target: "android/arm64"}, nil)
+	for _, tc := range []struct {
+		line string
+		want []string
+	}{
+		{"--url ", []string{"https://billder.example.com"}},
+		{"--url=https", []string{"--url=https://billder.example.com"}},
+		{"--url http:", nil},
+		{"stats --repo ", []string{"github.com/acme/app"}},
+		{"--targets ", []string{"android/arm64", "linux/amd64", "windows/amd64", "windows/arm64"}},
+		{"--os ", []string{"android", "linux", "windows"}},
+	} {
+		if got := c.complete(strings.Split(tc.line, " ")); !slices.Equal(got, tc.want) {
+			t.Errorf("complete(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestCacheTargets(t *testing.T) {
+	testCompleter(t, nil, nil)
+	if got := cachedTargets(); got != nil {
+		t.Errorf("empty cache holds %q", got)
+	}
+	cacheTargets([]string{"linux/amd64", "windows/arm64"})
+	cacheTargets(nil) // keeps the last list
+	if got := cachedTargets(); !slices.Equal(got, []string{"linux/amd64", "windows/arm64"}) {
+		t.Errorf("cached %q", got)
+	}
+	os.WriteFile(targetsCachePath(), []byte("{not json"), 0o644)
+	if got := cachedTargets(); got != nil {
+		t.Errorf("corrupt cache read as %q", got)
+	}
+	c := newCompleter()
+	if !slices.Equal(c.targets, builtinTargets) {
+		t.Errorf("targets with a corrupt cache: %q", c.targets)
+	}
+	data, _ := json.Marshal([]string{"linux/amd64"})
+	os.WriteFile(targetsCachePath(), data, 0o644)
+	if c := newCompleter(); !slices.Equal(c.targets, []string{"linux/amd64"}) {
+		t.Errorf("targets %q, want the cached list", c.targets)
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	for _, tc := range []struct {
+		words []string
+		want  string
+	}{
+		{[]string{"--os", "linux"}, "linux"},
+		{[]string{"-os", "linux"}, "linux"},
+		{[]string{"--os=linux"}, "linux"},
+		{[]string{"-os=linux", "--arch", "arm64"}, "linux"},
+		{[]string{"--os"}, ""},
+		{[]string{"--osx", "linux"}, ""},
+		{[]string{"--arch", "arm64"}, ""},
+	} {
+		if got := flagValue(tc.words, "os"); got != tc.want {
+			t.Errorf("flagValue(%q, os) = %q, want %q", tc.words, got, tc.want)
+		}
+	}
+}
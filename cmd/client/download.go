@@ -0,0 +1,118 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// clientConfig holds defaults for build flags, read from config.json in
+// the same directory as last-run.json. Flags given on the command line win.
+type clientConfig struct {
+	DownloadDir string `json:"download_dir"` // default of --download-dir
+}
+
+// clientConfigPath is where clientConfig is kept, under the user's config
+// directory.
+func clientConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "billder", "config.json")
+}
+
+// loadClientConfig reads the client config, warning about one that can't
+// be parsed. A missing file is the zero value.
+func loadClientConfig() clientConfig {
+	var c clientConfig
+	file := clientConfigPath()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		printf("⚠️ Ignoring %s: %v\n", file, err)
+		return clientConfig{}
+	}
+	return c
+}
+
+// origin is the summary that says which repository and commit the stream's
+// artifact came from: the build's own, or a matrix build's first target.
+func (r streamResult) origin() BuildSummary {
+	if r.summary.Repo == "" && r.matrix != nil && len(r.matrix.Targets) > 0 {
+		return r.matrix.Targets[0]
+	}
+	return r.summary
+}
+
+// downloadPath is where the artifact name is saved: as is when dir is
+// empty, otherwise under dir in <repo>/<short sha or ref>/, named from the
+// build's summary rather than the request, so resumed downloads land in
+// the same place. It creates the directories.
+func downloadPath(dir string, s BuildSummary, name string) (string, error) {
+	if dir == "" {
+		return name, nil
+	}
+	repo := pathSegment(path.Base(strings.TrimSuffix(s.Repo, ".git")))
+	version := pathSegment(cmp.Or(s.shortSHA(), s.Ref))
+	dest, err := filepath.Abs(filepath.Join(dir, cmp.Or(repo, "unknown"), cmp.Or(version, "unknown"), name))
+	if err != nil {
+		return "", err
+	}
+	return dest, os.MkdirAll(filepath.Dir(dest), 0o755)
+}
+
+// licensesPath is where the license report of artifact is saved, ext
+// ".txt" for the license texts and ".json" for the inventory.
+func licensesPath(artifact, ext string) string {
+	return artifact + ".licenses" + ext
+}
+
+// fetchSidecar downloads a file the server keeps about a build, like its
+// provenance, to dest.
+func fetchSidecar(rs resumer, url, dest string) error {
+	resp, err := send(rs.httpClient, rs.auth, "GET", rs.base, strings.TrimPrefix(url, apiPrefix), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dest, data, 0o644)
+}
+
+// fetchLicenses saves a license_report build's reports next to artifact.
+func fetchLicenses(rs resumer, url, artifact string) error {
+	if err := fetchSidecar(rs, url+"?format=text", licensesPath(artifact, ".txt")); err != nil {
+		return err
+	}
+	return fetchSidecar(rs, url, licensesPath(artifact, ".json"))
+}
+
+// pathSegment makes s one directory name: refs like feature/x keep their
+// parts joined by dashes, and "." or ".." names nothing.
+func pathSegment(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '-'
+		}
+		return r
+	}, s)
+	if strings.Trim(s, ".") == "" {
+		return ""
+	}
+	return s
+}
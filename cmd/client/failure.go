@@ -0,0 +1,48 @@
+package main
+
+import "fmt"
+
+// serverFaults are the server's failure categories that no change to the
+// request or code will fix.
+var serverFaults = map[string]bool{"toolchain_missing": true, "oom": true, "internal": true}
+
+// failureExit is the exit code for a build that failed with category:
+// exitServerFault and exitTimeout set apart what the caller can't fix.
+func failureExit(category string) int {
+	switch {
+	case category == "timeout":
+		return exitTimeout
+	case serverFaults[category]:
+		return exitServerFault
+	}
+	return exitBuildFailed
+}
+
+// failureHint says in a line whose problem a failure is, or "" for a
+// category this client doesn't know.
+func failureHint(category string) string {
+	switch category {
+	case "compile_failed", "deps_failed":
+		return fmt.Sprintf("💡 This looks like a problem with your code (%s).", category)
+	case "invalid_request", "repo_not_found", "auth_failed":
+		return fmt.Sprintf("💡 This looks like a problem with your request (%s).", category)
+	case "timeout":
+		return "⏱️ The build timed out: it may be too big for this server's limit, or the server may be overloaded."
+	}
+	if serverFaults[category] {
+		return fmt.Sprintf("🛠️ This looks like a server problem (%s) — contact the operator.", category)
+	}
+	return ""
+}
+
+// endHint is failureHint for a build whose stream ended for reason, which
+// tells builds stopped from outside from those that failed.
+func endHint(reason, category string) string {
+	switch reason {
+	case "canceled_by_user":
+		return ""
+	case "shutdown":
+		return "🔁 The server shut down mid-build; run it again once it's back, or pass --resume-policy restart to have it rerun on its own."
+	}
+	return failureHint(category)
+}
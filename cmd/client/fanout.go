@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Capabilities mirrors the server's /v1/capabilities response.
+type Capabilities struct {
+	APIVersion     string   `json:"api_version"`
+	GoVersion      string   `json:"go_version"`
+	Targets        []string `json:"targets"`
+	Matrix         bool     `json:"matrix"`
+	MaxParallelism int      `json:"max_parallelism"`
+}
+
+// serverCapabilities fetches /capabilities, remembering its targets for
+// completion and warning about a protocol mismatch. Servers without it,
+// or unreachable ones, yield the zero value: no matrix builds.
+func serverCapabilities(httpClient *http.Client, auth *authOptions, base string) Capabilities {
+	var caps Capabilities
+	resp, err := send(httpClient, auth, "GET", base, "/capabilities", "", nil)
+	if err != nil {
+		return caps
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&caps) != nil {
+		return Capabilities{}
+	}
+	cacheTargets(caps.Targets)
+	checkProtocol(caps.APIVersion)
+	return caps
+}
+
+// requestBody encodes payload, as a multipart form when a local PGO profile
+// is uploaded with it.
+func requestBody(payload RequestPayload, pgo string) ([]byte, string, error) {
+	body, _ := json.Marshal(payload)
+	if pgo == "" || pgo == "auto" {
+		return body, "application/json", nil
+	}
+	return multipartBody(body, pgo)
+}
+
+// fanOut runs one /build request per target, at most parallel at once,
+// for servers without matrix builds.
+type fanOut struct {
+	httpClient *http.Client
+	auth       *authOptions
+	base       string
+	payload    RequestPayload
+	pgo        string
+	parallel   int
+	template   string // artifact name, see artifactName
+	dir        string // --download-dir; "" saves in the working directory
+	verbose    bool
+	checksums  bool // write <artifact>.sha256 sidecars
+}
+
+// fanOutResult is one target's outcome.
+type fanOutResult struct {
+	target   string
+	file     string
+	size     int64
+	summary  BuildSummary
+	category string // why the build failed, per the server
+	reason   string // why its stream ended, per the server
+	code     int
+	err      error
+}
+
+// Run builds every target, prints a per-target summary and returns the exit code.
+func (f fanOut) Run(allowPartial bool) int {
+	targets := f.payload.Targets
+	// Each stream's renderer prefixes its own lines
+	prefixTargets = false
+	printf("🚀 Building %s for %s (%d requests, %d at a time)...\n\n", f.payload.RepoURL, strings.Join(targets, ","), len(targets), f.parallel)
+
+	results := make([]fanOutResult, len(targets))
+	sem := make(chan struct{}, max(1, f.parallel))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = f.build(t)
+		}()
+	}
+	wg.Wait()
+
+	code, failed := exitOK, 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			if code == exitOK {
+				code = r.code
+			}
+		}
+	}
+	printf("\n📊 %d target(s) succeeded, %d failed:\n", len(results)-failed, failed)
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			printf("  ❌ %s  %v\n", r.target, r.err)
+			if hint := endHint(r.reason, r.category); hint != "" {
+				printf("     %s\n", hint)
+			}
+			if r.summary.LogURL != "" {
+				printf("     📜 %s%s\n", f.base, r.summary.LogURL)
+			}
+		case r.file != "":
+			printf("  ✅ %s  %s (%d bytes)\n", r.target, r.summary.label(r.file), r.size)
+		default:
+			printf("  ✅ %s\n", r.target)
+		}
+	}
+	if failed > 0 && failed < len(results) && allowPartial {
+		return exitOK
+	}
+	return code
+}
+
+// build runs a single-target request and saves its artifact.
+func (f fanOut) build(target string) fanOutResult {
+	res := fanOutResult{target: target, code: exitConnection}
+	p := f.payload
+	p.Targets, p.Parallelism = nil, 0
+	p.TargetOS, p.TargetArch, _ = strings.Cut(target, "/")
+
+	body, contentType, err := requestBody(p, f.pgo)
+	if err != nil {
+		res.code, res.err = exitUsage, err
+		return res
+	}
+	resp, err := send(f.httpClient, f.auth, "POST", f.base, "/build", contentType, body)
+	if err != nil {
+		res.err = fmt.Errorf("connection failed: %w", err)
+		return res
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		res.err = fmt.Errorf("server error: %s", describeStatus(resp))
+		return res
+	}
+
+	out := newRenderer(false, f.verbose, "")
+	out.prefix = "[" + target + "] "
+	reader := bufio.NewReader(resp.Body)
+	stream := readEvents(reader, out, false)
+	out.Close()
+	res.summary = stream.summary
+
+	res.code, res.category, res.reason = stream.exitCode(), stream.category, stream.reason()
+	switch {
+	case stream.summary.Error != "":
+		res.err = errors.New(stream.summary.Error)
+	case stream.end != nil && !stream.end.OK:
+		res.err = errors.New(stream.end.Message)
+	case stream.filename == "" && !stream.uploaded() && !p.DryRun:
+		res.err = errors.New("no artifact received")
+	case stream.filename != "" || stream.uploaded():
+		res.file = artifactName(f.template, cmp.Or(stream.filename, stream.artifactName), p.TargetOS, p.TargetArch)
+		if res.file, err = downloadPath(f.dir, stream.origin(), res.file); err != nil {
+			res.code, res.err = exitDownload, fmt.Errorf("download failed: %w", err)
+			return res
+		}
+		if dir := filepath.Dir(res.file); dir != "." {
+			os.MkdirAll(dir, 0o755)
+		}
+		if stream.uploaded() {
+			rs := resumer{httpClient: f.httpClient, auth: f.auth, base: f.base, retries: 3}
+			res.size, err = rs.Artifact(stream.artifactURL, res.file, 0)
+		} else {
+			res.size, err = saveArtifact(reader, res.file, stream.size)
+		}
+		if err != nil {
+			res.code, res.err = exitDownload, fmt.Errorf("download failed: %w", err)
+			if partial := keepPartial(res.file); partial != "" {
+				res.err = fmt.Errorf("%w; kept as %s", res.err, partial)
+			}
+		} else if _, err := checkArtifact(res.file, stream.sha256, f.checksums); errors.Is(err, errChecksumMismatch) {
+			res.code, res.err = exitChecksum, err
+		} else if err != nil {
+			printf("⚠️ [%s] Could not write %s: %v\n", target, checksumPath(res.file), err)
+		}
+	}
+	return res
+}
+
+// artifactName expands {name}, {ext}, {file}, {os} and {arch} in template
+// for an artifact the server called filename.
+func artifactName(template, filename, goos, goarch string) string {
+	ext := filepath.Ext(filename)
+	return strings.NewReplacer(
+		"{name}", strings.TrimSuffix(filename, ext),
+		"{ext}", ext,
+		"{file}", filename,
+		"{os}", goos,
+		"{arch}", goarch,
+	).Replace(template)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const metadataIdentityURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity"
+
+// googleIDToken gets an ID token for audience from the GCE/Cloud Run
+// metadata server, falling back to the local gcloud credentials.
+func googleIDToken(audience string) (string, error) {
+	token, metaErr := metadataIDToken(audience)
+	if metaErr == nil {
+		return token, nil
+	}
+	token, gcloudErr := gcloudIDToken(audience)
+	if gcloudErr == nil {
+		return token, nil
+	}
+	return "", fmt.Errorf("metadata server: %v; gcloud: %v", metaErr, gcloudErr)
+}
+
+func metadataIDToken(audience string) (string, error) {
+	req, err := http.NewRequest("GET", metadataIdentityURL+"?format=full&audience="+url.QueryEscape(audience), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := (&http.Client{Timeout: 3 * time.Second}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	return strings.TrimSpace(string(data)), err
+}
+
+// gcloudIDToken uses Application Default Credentials via gcloud. User
+// accounts can't pick an audience, so retry without one.
+func gcloudIDToken(audience string) (string, error) {
+	out, err := exec.Command("gcloud", "auth", "print-identity-token", "--audiences="+audience).Output()
+	if err != nil {
+		out, err = exec.Command("gcloud", "auth", "print-identity-token").Output()
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
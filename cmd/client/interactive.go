@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lastRun is what the previous interactive run chose, offered as the
+// defaults of the next one.
+type lastRun struct {
+	URL    string `json:"url"`
+	Repo   string `json:"repo"`
+	Target string `json:"target"`
+	Ref    string `json:"ref,omitempty"`
+}
+
+// builtinTargets is offered when the server's list can't be fetched.
+var builtinTargets = []string{"linux/amd64", "windows/amd64", "windows/arm64", "android/arm64"}
+
+var repoPattern = regexp.MustCompile(`^[A-Za-z0-9.-]+(:[0-9]+)?(/[A-Za-z0-9._~-]+)+$`)
+
+// lastRunPath is where lastRun is kept, under the user's config directory.
+func lastRunPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "billder", "last-run.json")
+}
+
+func loadLastRun() lastRun {
+	var prev lastRun
+	if data, err := os.ReadFile(lastRunPath()); err == nil {
+		json.Unmarshal(data, &prev)
+	}
+	return prev
+}
+
+func (r lastRun) save() {
+	path := lastRunPath()
+	if path == "" {
+		return
+	}
+	data, _ := json.MarshalIndent(r, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err == nil {
+		os.WriteFile(path, append(data, '\n'), 0o644)
+	}
+}
+
+// interactiveArgs asks for the server, repository, target and ref, and
+// returns the flags that build them. It's only used on a terminal; the
+// answers become the defaults of the next run.
+func interactiveArgs() []string {
+	in := bufio.NewReader(os.Stdin)
+	prev := loadLastRun()
+	printLine("🧭 No flags given, so let's set up the build. Enter keeps the [default].")
+	printLine("")
+
+	url := ask(in, "Billder server URL", prev.URL, func(s string) (string, error) {
+		if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+			return "", errors.New("the URL must start with http:// or https://")
+		}
+		return s, nil
+	})
+	repo := ask(in, "Repository (host/owner/name)", prev.Repo, func(s string) (string, error) {
+		repo := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://"), ".git")
+		if !repoPattern.MatchString(repo) {
+			return "", errors.New("expected host/owner/name, e.g. github.com/fyne-io/examples")
+		}
+		return repo, nil
+	})
+
+	targets, err := serverTargets(url)
+	if err != nil {
+		printf("⚠️ Could not get the server's targets (%v); showing the built-in list\n", err)
+		targets = builtinTargets
+	}
+	for i, t := range targets {
+		printf("   %d) %s\n", i+1, t)
+	}
+	def := prev.Target
+	if !slices.Contains(targets, def) {
+		def = targets[0]
+	}
+	target := ask(in, "Target (number or os/arch)", def, func(s string) (string, error) {
+		if n, err := strconv.Atoi(s); err == nil && n >= 1 && n <= len(targets) {
+			return targets[n-1], nil
+		}
+		if slices.Contains(targets, s) {
+			return s, nil
+		}
+		return "", errors.New("pick a number from the list or one of its os/arch names")
+	})
+	ref := ask(in, "Branch, tag or ref (- for the default branch)", prev.Ref, nil)
+	if ref == "-" {
+		ref = ""
+	}
+
+	printf("\n📋 Build %s for %s", repo, target)
+	if ref != "" {
+		printf(" at %s", ref)
+	}
+	printf(" on %s\n", url)
+	if answer := ask(in, "Start the build? (y/n)", "y", nil); !strings.HasPrefix(strings.ToLower(answer), "y") {
+		printLine("Cancelled.")
+		exit(exitOK)
+	}
+	printLine("")
+	lastRun{URL: url, Repo: repo, Target: target, Ref: ref}.save()
+
+	goos, goarch, _ := strings.Cut(target, "/")
+	args := []string{"--url", url, "--repo", repo, "--os", goos, "--arch", goarch}
+	if ref != "" {
+		args = append(args, "--ref", ref)
+	}
+	return args
+}
+
+// ask prompts until check accepts the answer, or an empty answer takes
+// def. A closed stdin ends the program.
+func ask(in *bufio.Reader, question, def string, check func(string) (string, error)) string {
+	for {
+		if def != "" {
+			printf("%s [%s]: ", question, def)
+		} else {
+			printf("%s: ", question)
+		}
+		line, err := in.ReadString('\n')
+		if err != nil {
+			printLine("")
+			exit(exitUsage)
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if check == nil {
+			return answer
+		}
+		v, err := check(answer)
+		if err == nil {
+			return v
+		}
+		printf("   ❌ %v\n", err)
+	}
+}
+
+// serverTargets asks the server what it builds, giving up quickly.
+func serverTargets(url string) ([]string, error) {
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	resp, err := send(httpClient, addAuthFlags(flag.NewFlagSet("", flag.ContinueOnError)), "GET", serviceBase(url), "/capabilities/targets", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(describeStatus(resp))
+	}
+	var targets []string
+	if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil || len(targets) == 0 {
+		return nil, errors.New("invalid response")
+	}
+	cacheTargets(targets)
+	return targets, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// BuildOrigin mirrors the origin the server stamps into binaries.
+type BuildOrigin struct {
+	BuildID string    `json:"build_id"`
+	Server  string    `json:"server"`
+	Commit  string    `json:"commit,omitempty"`
+	BuiltAt time.Time `json:"built_at"`
+}
+
+// Lookup mirrors the server's GET /v1/lookup response.
+type Lookup struct {
+	SHA256 string `json:"sha256"`
+	Origin struct {
+		BuildID string    `json:"build_id"`
+		Name    string    `json:"name"`
+		Target  string    `json:"target,omitempty"`
+		At      time.Time `json:"at"`
+	} `json:"origin"`
+	Build *struct {
+		State     string    `json:"state"`
+		OK        bool      `json:"ok"`
+		Origin    string    `json:"origin"`
+		Caller    string    `json:"caller"`
+		Commit    string    `json:"commit"`
+		Ref       string    `json:"ref"`
+		StartedAt time.Time `json:"started_at"`
+		LogURL    string    `json:"log_url"`
+		Payload   struct {
+			RepoURL string   `json:"repo_url"`
+			Targets []string `json:"targets"`
+		} `json:"payload"`
+	} `json:"build,omitempty"`
+}
+
+// embeddedOrigin finds the origin stamped into a binary: the last
+// {"build_id":... object in it, whether set in main.billderOrigin or
+// appended after the end of the file.
+func embeddedOrigin(path string) (BuildOrigin, bool) {
+	var o BuildOrigin
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return o, false
+	}
+	i := bytes.LastIndex(data, []byte(`{"build_id":"`))
+	if i < 0 {
+		return o, false
+	}
+	return o, json.NewDecoder(bytes.NewReader(data[i:])).Decode(&o) == nil && o.BuildID != ""
+}
+
+// runLookup implements `client lookup <file>`: which build delivered the
+// file, asked of the server by the file's digest, plus the origin stamped
+// into it, if any.
+func runLookup(args []string) {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	url := fs.String("url", "", "Billder Service URL; without it only the origin stamped into the file is shown")
+	auth := addAuthFlags(fs)
+	tlsOpts := addTLSFlags(fs)
+	jsonOut := fs.Bool("json", false, "Print the server's answer as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: client lookup [--url URL] <file>")
+		fs.PrintDefaults()
+	}
+	// Accept the flags after the file too
+	var files []string
+	for len(args) > 0 {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) > 0 {
+			files, args = append(files, args[0]), args[1:]
+		}
+	}
+	if len(files) != 1 {
+		fs.Usage()
+		exit(exitUsage)
+	}
+	file := files[0]
+	sum, err := fileSHA256(file)
+	if err != nil {
+		printf("❌ Could not read %s: %v\n", file, err)
+		exit(exitUsage)
+	}
+
+	embedded, stamped := embeddedOrigin(file)
+	if stamped && !*jsonOut {
+		printf("🏷️ %s was stamped by build %s on %s at %s", file, embedded.BuildID, embedded.Server, embedded.BuiltAt.Local().Format(time.RFC1123))
+		if embedded.Commit != "" {
+			printf(" from commit %s", embedded.Commit)
+		}
+		printLine("")
+	}
+	if *url == "" {
+		if !stamped {
+			printf("❌ %s carries no build origin; pass --url to look its digest up\n", file)
+			exit(exitBuildFailed)
+		}
+		exit(exitOK)
+	}
+
+	resp, err := send(tlsOpts.Client(), auth, "GET", serviceBase(*url), "/lookup?sha256="+sum, "", nil)
+	if err != nil {
+		printf("❌ Connection failed: %v\n", err)
+		exit(exitConnection)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		printf("❓ The server delivered no file with sha256 %s", sum)
+		if stamped {
+			printf("; it was changed after delivery, or came from another server")
+		}
+		printLine("")
+		exit(exitBuildFailed)
+	}
+	if resp.StatusCode != http.StatusOK {
+		serverError(resp)
+	}
+	var found Lookup
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		printf("❌ Invalid response: %v\n", err)
+		exit(exitConnection)
+	}
+	if *jsonOut {
+		json.NewEncoder(os.Stdout).Encode(found)
+		exit(exitOK)
+	}
+	printf("🔎 Delivered as %s by build %s", found.Origin.Name, found.Origin.BuildID)
+	if found.Origin.Target != "" {
+		printf(" (%s)", found.Origin.Target)
+	}
+	printLine("")
+	if b := found.Build; b != nil {
+		printf("   Repository: %s @ %s", b.Payload.RepoURL, b.Commit)
+		if b.Ref != "" {
+			printf(" (%s)", b.Ref)
+		}
+		printf("\n   Started:    %s by %s (%s)\n", b.StartedAt.Local().Format(time.RFC1123), b.Caller, b.Origin)
+		printf("   Outcome:    %s, ok=%t\n", b.State, b.OK)
+		printf("   Log:        %s%s\n", serviceBase(*url), b.LogURL)
+	} else {
+		printLine("   The build's journal entry has expired.")
+	}
+	exit(exitOK)
+}
@@ -3,127 +3,884 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"maps"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
 type RequestPayload struct {
 	RepoURL    string `json:"repo_url"`
+	Ref        string `json:"ref,omitempty"`
 	TargetOS   string `json:"target_os"`
 	TargetArch string `json:"target_arch"`
+	StampVCS   bool   `json:"stamp_vcs,omitempty"` // false is left out, so the server's repos defaults can apply
+	SizeReport bool   `json:"size_report,omitempty"`
+	Debug      bool   `json:"debug,omitempty"`
+	SplitDebug bool   `json:"split_debug,omitempty"`
+	Zip        bool   `json:"zip,omitempty"`
+	PGO        string `json:"pgo,omitempty"`
+	DryRun     bool   `json:"dry_run,omitempty"`
+	Force      bool   `json:"force,omitempty"` // omitted so older servers accept the payload
+
+	ResumePolicy string `json:"resume_policy,omitempty"`
+	Priority     string `json:"priority,omitempty"`
+	Patch        string `json:"patch,omitempty"` // base64
+	Refresh      *bool  `json:"refresh,omitempty"`
+	Cgo          *bool  `json:"cgo,omitempty"`
+	AVCheck      bool   `json:"av_check,omitempty"`
+	AVMode       string `json:"av_mode,omitempty"`
+	Packager     string `json:"packager,omitempty"`
+	ModuleDir    string `json:"module_dir,omitempty"`
+	BuildAllCmds bool   `json:"build_all_cmds,omitempty"`
+	CmdFailure   string `json:"cmd_failure,omitempty"`
+
+	LicenseReport bool `json:"license_report,omitempty"`
+
+	CompareRef string `json:"compare_ref,omitempty"`
+	Deliver    string `json:"deliver,omitempty"`
+
+	Color string `json:"color,omitempty"`
+
+	CompilerOptions *CompilerOptions `json:"compiler_options,omitempty"`
+
+	InitModule bool `json:"init_module,omitempty"`
+
+	CheckoutMode string   `json:"checkout_mode,omitempty"`
+	SparsePaths  []string `json:"sparse_paths,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	Targets     []string `json:"targets,omitempty"`
+	Parallelism int      `json:"parallelism,omitempty"`
+}
+
+// BuildSummary mirrors the server's "summary" event.
+type BuildSummary struct {
+	Target   string  `json:"target"`
+	OK       bool    `json:"ok"`
+	Error    string  `json:"error,omitempty"`
+	Category string  `json:"error_category,omitempty"`
+	Repo     string  `json:"repo"`
+	TargetOS string  `json:"target_os"`
+	Arch     string  `json:"target_arch"`
+	Commit   string  `json:"commit"`
+	Describe string  `json:"describe"`
+	Ref      string  `json:"ref,omitempty"`
+	Dirty    bool    `json:"dirty"`
+	Artifact string  `json:"artifact"`
+	SizeMB   float64 `json:"size_mb"`
+	LDFlags  string  `json:"ldflags"`
+	BuildID  string  `json:"build_id"`
+	LogURL   string  `json:"log_url"`
+
+	ArtifactURL    string `json:"artifact_url,omitempty"`
+	ArtifactSHA256 string `json:"artifact_sha256,omitempty"`
+	Delivery       string `json:"delivery,omitempty"`
+	PatchSHA256    string `json:"patch_sha256,omitempty"`
+	Signing        string `json:"signing,omitempty"`
+	Environment    string `json:"environment,omitempty"`
+
+	ProvenanceURL string `json:"provenance_url,omitempty"`
+	LicensesURL   string `json:"licenses_url,omitempty"`
+
+	AVCheck *AVReport   `json:"av_check,omitempty"`
+	Cmds    []CmdResult `json:"cmds,omitempty"`
+
+	Compare *CompareReport `json:"compare,omitempty"`
+
+	CompilerOptions *CompilerOptions `json:"compiler_options,omitempty"`
+
+	Labels   map[string]string `json:"labels,omitempty"`
+	Checkout string            `json:"checkout,omitempty"` // "archive": built without git history
+}
+
+// CompilerOptions mirrors the server's compiler_options.
+type CompilerOptions struct {
+	DisableOptimizations bool `json:"disable_optimizations,omitempty"`
+	DisableInlining      bool `json:"disable_inlining,omitempty"`
+	Race                 bool `json:"race,omitempty"`
+	MSan                 bool `json:"msan,omitempty"`
+}
+
+// String lists the options chosen, e.g. "race, no inlining".
+func (o CompilerOptions) String() string {
+	var chosen []string
+	for _, c := range []struct {
+		on   bool
+		name string
+	}{{o.DisableOptimizations, "no optimizations"}, {o.DisableInlining, "no inlining"}, {o.Race, "race detector"}, {o.MSan, "memory sanitizer"}} {
+		if c.on {
+			chosen = append(chosen, c.name)
+		}
+	}
+	return strings.Join(chosen, ", ")
+}
+
+// CompareReport mirrors the server's comparison with a compare_ref build,
+// passed through to --json for size budgets in CI.
+type CompareReport struct {
+	CompareRef    string `json:"compare_ref"`
+	CompareCommit string `json:"compare_commit,omitempty"`
+	Bytes         int64  `json:"bytes"`
+	CompareBytes  int64  `json:"compare_bytes"`
+	Delta         int64  `json:"delta_bytes"`
+	Sections      []struct {
+		Name         string `json:"name"`
+		Bytes        int64  `json:"bytes"`
+		CompareBytes int64  `json:"compare_bytes"`
+		Delta        int64  `json:"delta_bytes"`
+	} `json:"sections"`
+	Modules []struct {
+		Path           string `json:"path"`
+		Version        string `json:"version,omitempty"`
+		CompareVersion string `json:"compare_version,omitempty"`
+	} `json:"modules"`
+	Error string `json:"error,omitempty"`
+}
+
+// CmdResult mirrors one command of a build_all_cmds build.
+type CmdResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Binary string `json:"binary,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+// AVReport mirrors the server's antivirus check of a windows binary.
+type AVReport struct {
+	Findings []string `json:"findings,omitempty"`
+	Scanner  string   `json:"scanner,omitempty"`
+	Verdict  string   `json:"verdict,omitempty"`
+	Blocked  bool     `json:"blocked,omitempty"`
+}
+
+// MatrixSummary mirrors the server's "matrix_summary" event.
+type MatrixSummary struct {
+	Targets   []BuildSummary `json:"targets"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Artifact  string         `json:"artifact,omitempty"`
+	SizeMB    float64        `json:"size_mb,omitempty"`
+
+	ArtifactURL    string `json:"artifact_url,omitempty"`
+	ArtifactSHA256 string `json:"artifact_sha256,omitempty"`
+	Delivery       string `json:"delivery,omitempty"`
+	ProvenanceURL  string `json:"provenance_url,omitempty"`
+	LicensesURL    string `json:"licenses_url,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ModuleList mirrors the server's "modules" event.
+type ModuleList struct {
+	Modules []struct {
+		Dir  string   `json:"dir"`
+		Path string   `json:"path"`
+		Main []string `json:"main_packages"`
+	} `json:"modules"`
+	Selected string `json:"selected"`
+}
+
+// Diagnostic mirrors the server's "diagnostic" event.
+type Diagnostic struct {
+	Target  string `json:"target,omitempty"`
+	Package string `json:"package"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// PayloadError mirrors the server's 400, 403 and 422 response body.
+type PayloadError struct {
+	Error          string   `json:"error"`
+	Errors         []string `json:"errors"`
+	Field          string   `json:"field,omitempty"`
+	AcceptedFields []string `json:"accepted_fields,omitempty"`
+	Limit          string   `json:"limit,omitempty"`
+}
+
+// BuildConflict mirrors the server's 409 response for a duplicate build.
+type BuildConflict struct {
+	Error     string    `json:"error"`
+	BuildID   string    `json:"build_id"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// serverError reports a non-200 response, printing the server's request
+// validation errors verbatim, and exits.
+func serverError(resp *http.Response) {
+	var conflict BuildConflict
+	if resp.StatusCode == http.StatusConflict && json.NewDecoder(resp.Body).Decode(&conflict) == nil {
+		printf("⏳ An identical build is already running: %s (started %s)\n", conflict.BuildID, conflict.StartedAt.Local().Format(time.Kitchen))
+		printf("   Follow it with: %s status %s\n", filepath.Base(os.Args[0]), conflict.BuildID)
+		printLine("   Or pass --force to start another build anyway.")
+		exit(exitConnection)
+	}
+	printf("❌ Server Error: %s\n", describeStatus(resp))
+	var perr PayloadError
+	validation := resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnprocessableEntity
+	if validation && json.NewDecoder(resp.Body).Decode(&perr) == nil {
+		for _, e := range perr.Errors {
+			printf("   %s\n", e)
+		}
+		if len(perr.AcceptedFields) > 0 {
+			printf("   Accepted fields: %s\n", strings.Join(perr.AcceptedFields, ", "))
+		}
+		if perr.Limit != "" {
+			printLine("   The server's limits are listed under \"limits\" in /v1/capabilities.")
+		}
+	}
+	exit(exitConnection)
+}
+
+// String formats the diagnostic like the Go compiler does.
+func (d Diagnostic) String() string {
+	s := fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+	if d.Column > 0 {
+		s = fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+	}
+	return targetPrefix(d.Target) + s
+}
+
+// prefixTargets is set for matrix builds, where output from several targets interleaves.
+var prefixTargets bool
+
+// targetPrefix labels output from one target of a matrix build.
+func targetPrefix(target string) string {
+	if !prefixTargets || target == "" {
+		return ""
+	}
+	return "[" + target + "] "
+}
+
+// isTTY reports whether f is an interactive terminal.
+func isTTY(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// shortSHA returns the abbreviated commit, or "" when unknown.
+func (s BuildSummary) shortSHA() string {
+	if len(s.Commit) > 7 {
+		return s.Commit[:7]
+	}
+	return s.Commit
+}
+
+// label describes a saved artifact with the commit it was built from.
+func (s BuildSummary) label(filename string) string {
+	sha := s.shortSHA()
+	if sha == "" {
+		return filename
+	}
+	label := fmt.Sprintf("%s @ %s", filename, sha)
+	if s.PatchSHA256 != "" {
+		label += "+patch " + s.PatchSHA256[:min(len(s.PatchSHA256), 12)]
+	} else if s.Dirty {
+		label += "-dirty"
+	}
+	return label
+}
+
+// reportCIArtifact prints the artifact checksum and publishes it as step
+// outputs when running under GitHub Actions.
+func reportCIArtifact(filename string) {
+	sum, err := fileSHA256(filename)
+	if err != nil {
+		printf("Warning: could not hash artifact: %v\n", err)
+		return
+	}
+	path, _ := filepath.Abs(filename)
+	printf("artifact: %s\nsha256: %s\n", path, sum)
+	if out := os.Getenv("GITHUB_OUTPUT"); out != "" {
+		if err := writeGitHubOutput(out, "artifact", path, "sha256", sum); err != nil {
+			printf("Warning: could not write GITHUB_OUTPUT: %v\n", err)
+		}
+	}
+}
+
+// multipartBody wraps the JSON payload and a profile file into a multipart form.
+func multipartBody(payload []byte, profilePath string) ([]byte, string, error) {
+	profile, err := os.ReadFile(profilePath)
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("payload", string(payload)); err != nil {
+		return nil, "", err
+	}
+	fw, err := mw.CreateFormFile("profile", filepath.Base(profilePath))
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := fw.Write(profile); err != nil {
+		return nil, "", err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mw.FormDataContentType(), nil
 }
 
 func main() {
+	// No arguments on a terminal: ask for what a build needs instead of failing
+	if len(os.Args) == 1 && isTTY(os.Stdin) && isTTY(os.Stdout) {
+		os.Args = append(os.Args, interactiveArgs()...)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "targets" {
+		runTargets(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "attach" || os.Args[1] == "status") {
+		runAttach(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "tail" {
+		runTail(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		runWatch(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lookup" {
+		runLookup(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		runStats(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		runVersion()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "self-update" {
+		runSelfUpdate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		runCompletion(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "build" {
+		// "build" is the default command; accept it explicitly too
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	// 1. Flags
-	repo := flag.String("repo", "", "GitHub repository URL (e.g. github.com/fyne-io/examples/bugs)")
-	targetOS := flag.String("os", "windows", "Target OS (linux, windows)")
-	targetArch := flag.String("arch", "amd64", "Target Arch")
+	repo := flag.String("repo", "", "Repository URL on GitHub, GitLab, Bitbucket or a self-hosted server (e.g. github.com/fyne-io/examples/bugs)")
+	targetOS := flag.String("os", "windows", "Target OS (linux, windows, or android for an APK)")
+	targetArch := flag.String("arch", "amd64", "Target Arch (amd64, or arm64 for windows; android is always arm64)")
 	url := flag.String("url", "", "Billder Service URL")
-	token := flag.String("token", "", "Auth Token (optional)")
+	auth := addAuthFlags(flag.CommandLine)
+	verbose := flag.Bool("verbose", false, "Show all server log lines on a TTY")
+	stampVCS := flag.Bool("stamp-vcs", false, "Stamp commit info into main.commit/main.version")
+	sizeReport := flag.Bool("size-report", false, "Report binary size by section and package")
+	debug := flag.Bool("debug", false, "Keep debug symbols (drop -s -w)")
+	splitDebug := flag.Bool("split-debug", false, "Linux only: ship debug info as a separate .debug file (zip)")
+	avCheck := flag.Bool("av-check", false, "Windows only: warn about patterns that trigger antivirus false positives (and ClamAV-scan if the server can)")
+	avMode := flag.String("av-mode", "", "\"enforce\" fails the build on --av-check findings instead of only warning")
+	packager := flag.String("packager", "", "\"fyne\" packages with fyne package (icon, FyneApp.toml metadata); \"go\" forces plain go build. Fyne apps default to fyne")
+	allCmds := flag.Bool("all-cmds", false, "Build every command under cmd/ and receive them as a zip with a manifest")
+	initModule := flag.Bool("init-module", false, "Build Go code without a go.mod (GOPATH-style) from a go.mod the server synthesizes")
+	licenseReport := flag.Bool("license-report", false, "List the licenses of the modules compiled in, with THIRD_PARTY_LICENSES.txt")
+	noOptimize := flag.Bool("disable-optimizations", false, "Compile without optimizations (-gcflags=all=-N), for debugging with delve")
+	noInline := flag.Bool("disable-inlining", false, "Compile without inlining (-gcflags=all=-l)")
+	race := flag.Bool("race", false, "Build with the race detector; only for the server's own platform, with cgo")
+	msan := flag.Bool("msan", false, "Build with the memory sanitizer; only for a linux/amd64 or linux/arm64 server's own platform, with clang")
+	cmdFailure := flag.String("cmd-failure", "", "With --all-cmds: \"best_effort\" (server default) delivers the commands that built, \"fail_fast\" stops at the first failure")
+	moduleDir := flag.String("module-dir", "", "Directory of the module to build, for repositories with several go.mod files")
+	zipOut := flag.Bool("zip", false, "Receive the artifact(s) as a zip archive")
+	targets := flag.String("targets", "", "Comma-separated os/arch list for a matrix build (overrides --os/--arch)")
+	parallelism := flag.Int("parallelism", 0, "Matrix targets to build at once (server default if 0)")
+	allowPartial := flag.Bool("allow-partial", false, "Exit 0 when some matrix targets fail")
+	force := flag.Bool("force", false, "Build even if an identical build of yours is already running")
+	dryRun := flag.Bool("dry-run", false, "Validate the request and print the build plan without compiling")
+	pgo := flag.String("pgo", "", "PGO profile: \"auto\" for the repo's default.pgo, or a local pprof file to upload")
+	ci := flag.Bool("ci", false, "CI mode: log groups, no emoji or spinners, $GITHUB_OUTPUT, distinct exit codes")
+	annotations := flag.String("annotations", "", "Report compiler errors as \"github\" Actions annotations plus a $GITHUB_STEP_SUMMARY entry, or \"none\" (default: github in --ci mode under Actions)")
+	logPath := flag.String("log-file", "", "Also write the streamed build log to this file")
+	tlsOpts := addTLSFlags(flag.CommandLine)
+	requestFile := flag.String("f", "", "Read the build request from a JSON or YAML file (- for stdin); explicit flags override it")
+	printRequest := flag.Bool("print-request", false, "Print the effective build request as JSON and exit")
+	var targetFlags []string
+	flag.Func("target", "os/arch to build; repeat for several targets", func(s string) error {
+		targetFlags = append(targetFlags, s)
+		return nil
+	})
+	var sparsePaths []string
+	flag.Func("sparse-path", "Directory of a monorepo to check out, sparsely and without other files' history; repeat for several", func(s string) error {
+		sparsePaths = append(sparsePaths, s)
+		return nil
+	})
+	labels := map[string]string{}
+	flag.Func("label", "k=v tag for finding the build later, e.g. pr=1234; repeat for several", func(s string) error {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok || k == "" {
+			return errors.New("want k=v")
+		}
+		labels[k] = v
+		return nil
+	})
+	parallel := flag.Int("parallel", 4, "Concurrent requests when the client fans targets out itself (servers without matrix builds)")
+	nameTemplate := flag.String("name-template", "{name}_{os}_{arch}{ext}", "Artifact file name per target when fanning out; {name} {ext} {file} {os} {arch}")
+	downloadDir := flag.String("download-dir", loadClientConfig().DownloadDir, "Save artifacts under this directory as <repo>/<commit or ref>/<artifact>; download_dir in "+cmp.Or(clientConfigPath(), "the client config")+" sets a default")
+	flat := flag.Bool("flat", false, "Save artifacts in the working directory even when a download directory is set")
+	noChecksum := flag.Bool("no-checksum-file", false, "Don't write <artifact>.sha256 next to the download")
+	record := flag.String("record", "", "Save the raw server response (headers and stream) to this file")
+	replay := flag.String("replay", "", "Play back a session saved with --record instead of contacting the server")
+	retries := flag.Int("retries", 3, "Reconnect attempts when the stream or download breaks off")
+	fake := flag.Bool("fake", false, "Ask the server for a canned build (needs BILLDER_FAKE_BUILDS=1 on the server)")
+	ref := flag.String("ref", "", "Branch, tag, commit or pull request ref (pull/123/head, merge-requests/45/head) to build")
+	compareRef := flag.String("compare-ref", "", "Also build this ref and report the binary size and module version differences (e.g. main, before merging a dependency bump)")
+	colorMode := flag.String("color", "", "\"keep\" or \"strip\" ANSI colors in the build's own output (default: keep on a terminal)")
+	deliver := flag.String("deliver", "", "With --compare-ref: \"primary\" (default) downloads the --ref build, \"both\" a zip with compare-ref's under compare/")
+	patchFile := flag.String("patch", "", "Unified diff to apply on top of the cloned commit before building (- for stdin)")
+	priority := flag.String("priority", "", "low, normal or high (high needs a token granted it) when waiting for compile slots")
+	cgo := flag.Bool("cgo", true, "Build with cgo; --cgo=false builds pure Go and needs no C toolchain on the server")
+	refresh := flag.Bool("refresh", true, "Let the server fetch the repository; --refresh=false builds from its git mirror alone")
+	checkoutMode := flag.String("checkout-mode", "", "\"archive\" fetches a tarball from the host's API instead of cloning, leaving out export-ignore paths; no git history, so the version stamped is just the commit")
+	resumePolicy := flag.String("resume-policy", "", "\"restart\" has the server rerun the build if it restarts mid-build")
+	trace := flag.Bool("trace", false, "Start a new trace, send it as traceparent and print its ID")
+	jsonOut := flag.Bool("json", false, "Print the build summary, including the server's environment fingerprint, as JSON on stdout (progress goes to stderr)")
+	parentTrace := flag.String("traceparent", "", "W3C traceparent to send so the build joins an existing trace")
+	showVersion := flag.Bool("version", false, "Print the client version and exit")
+	if len(os.Args) > 1 && os.Args[1] == "__complete" {
+		// Called by the completion scripts, once the build flags are defined
+		runComplete(os.Args[2:])
+		return
+	}
 	flag.Parse()
+	if *showVersion {
+		runVersion()
+		return
+	}
 
-	if *repo == "" || *url == "" {
-		fmt.Println("❌ Error: --repo and --url are required")
-		os.Exit(1)
+	if *logPath != "" {
+		f, err := os.Create(*logPath)
+		if err != nil {
+			printf("❌ Failed to create log file: %v\n", err)
+			exit(exitUsage)
+		}
+		logFile = f
+	}
+	if *jsonOut {
+		stdout = os.Stderr
+		jsonReport = &buildReport{}
+	}
+	var flavor ciFlavor
+	if *ci {
+		flavor = detectCI(environMap())
+		plainOutput = true
+	}
+	var err error
+	if githubAnnotations, err = annotationsEnabled(*annotations, flavor); err != nil {
+		printf("❌ %v\n", err)
+		exit(exitUsage)
 	}
 
-	// 2. Prepare Request
-	payload := RequestPayload{
-		RepoURL:    *repo,
-		TargetOS:   *targetOS,
-		TargetArch: *targetArch,
+	// 2. Prepare Request: the request file, if any, with explicit flags on top
+	var payload RequestPayload
+	if *requestFile != "" {
+		var err error
+		if payload, err = loadRequest(*requestFile); err != nil {
+			printf("❌ Invalid request file: %v\n", err)
+			exit(exitUsage)
+		}
 	}
-	body, _ := json.Marshal(payload)
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	use := func(name string) bool { return *requestFile == "" || explicit[name] }
 
-	req, err := http.NewRequest("POST", *url, bytes.NewBuffer(body))
-	if err != nil {
-		panic(err)
+	if use("repo") {
+		payload.RepoURL = *repo
+	}
+	if use("os") || (payload.TargetOS == "" && len(payload.Targets) == 0) {
+		payload.TargetOS = *targetOS
+	}
+	if use("arch") || payload.TargetArch == "" {
+		payload.TargetArch = *targetArch
+		if payload.TargetOS == "android" && !explicit["arch"] {
+			payload.TargetArch = "arm64"
+		}
+	}
+	for _, b := range []struct {
+		flag     string
+		dst, src *bool
+	}{
+		{"stamp-vcs", &payload.StampVCS, stampVCS},
+		{"size-report", &payload.SizeReport, sizeReport},
+		{"debug", &payload.Debug, debug},
+		{"split-debug", &payload.SplitDebug, splitDebug},
+		{"av-check", &payload.AVCheck, avCheck},
+		{"zip", &payload.Zip, zipOut},
+		{"dry-run", &payload.DryRun, dryRun},
+		{"force", &payload.Force, force},
+		{"all-cmds", &payload.BuildAllCmds, allCmds},
+		{"license-report", &payload.LicenseReport, licenseReport},
+		{"init-module", &payload.InitModule, initModule},
+	} {
+		if use(b.flag) {
+			*b.dst = *b.src
+		}
+	}
+	opts := CompilerOptions{}
+	if payload.CompilerOptions != nil {
+		opts = *payload.CompilerOptions
+	}
+	for _, b := range []struct {
+		flag     string
+		dst, src *bool
+	}{
+		{"disable-optimizations", &opts.DisableOptimizations, noOptimize},
+		{"disable-inlining", &opts.DisableInlining, noInline},
+		{"race", &opts.Race, race},
+		{"msan", &opts.MSan, msan},
+	} {
+		if use(b.flag) {
+			*b.dst = *b.src
+		}
+	}
+	payload.CompilerOptions = nil
+	if opts != (CompilerOptions{}) {
+		payload.CompilerOptions = &opts
+	}
+	if *patchFile != "" {
+		patch, err := readPatch(*patchFile)
+		if err != nil {
+			printf("❌ Failed to read patch: %v\n", err)
+			exit(exitUsage)
+		}
+		payload.Patch = base64.StdEncoding.EncodeToString(patch)
+	}
+	if use("ref") && *ref != "" {
+		payload.Ref = *ref
+	}
+	if use("compare-ref") && *compareRef != "" {
+		payload.CompareRef = *compareRef
+	}
+	if use("deliver") && *deliver != "" {
+		payload.Deliver = *deliver
+	}
+	if use("color") && *colorMode != "" {
+		payload.Color = *colorMode
+	}
+	if payload.Color == "" {
+		payload.Color = "strip"
+		if isTTY(os.Stdout) && !*ci && !*jsonOut {
+			payload.Color = "keep"
+		}
+	}
+	if use("priority") && *priority != "" {
+		payload.Priority = *priority
+	}
+	if explicit["refresh"] {
+		payload.Refresh = refresh
+	}
+	if explicit["cgo"] {
+		payload.Cgo = cgo
+	}
+	if use("packager") && *packager != "" {
+		payload.Packager = *packager
+	}
+	if use("module-dir") && *moduleDir != "" {
+		payload.ModuleDir = *moduleDir
+	}
+	if use("cmd-failure") && *cmdFailure != "" {
+		payload.CmdFailure = *cmdFailure
 	}
-	req.Header.Set("Content-Type", "application/json")
-	if *token != "" {
-		req.Header.Set("X-Billder-Token", *token)
+	if use("av-mode") && *avMode != "" {
+		payload.AVMode = *avMode
+	}
+	if use("checkout-mode") && *checkoutMode != "" {
+		payload.CheckoutMode = *checkoutMode
+	}
+	if use("resume-policy") && *resumePolicy != "" {
+		payload.ResumePolicy = *resumePolicy
+	}
+	if *pgo == "auto" {
+		payload.PGO = "auto"
+	}
+	if *targets != "" || len(targetFlags) > 0 {
+		payload.Targets = targetFlags
+		if *targets != "" {
+			payload.Targets = append(payload.Targets, strings.Split(*targets, ",")...)
+		}
+	}
+	if len(sparsePaths) > 0 {
+		payload.SparsePaths = sparsePaths
+	}
+	if len(labels) > 0 {
+		if payload.Labels == nil {
+			payload.Labels = map[string]string{}
+		}
+		maps.Copy(payload.Labels, labels)
+	}
+	if explicit["parallelism"] || (*requestFile == "" && len(payload.Targets) > 0) {
+		payload.Parallelism = *parallelism
 	}
 
-	// 3. Connect
-	client := &http.Client{Timeout: 0} // No timeout on client side, let server handle it
+	if *printRequest {
+		out, _ := json.MarshalIndent(payload, "", "  ")
+		printf("%s\n", out)
+		exit(exitOK)
+	}
+	if *replay == "" && (payload.RepoURL == "" || *url == "") {
+		printLine("❌ Error: --repo (or repo_url in -f) and --url are required")
+		exit(exitUsage)
+	}
+	if *trace || *parentTrace != "" {
+		traceparent = *parentTrace
+		if traceparent == "" {
+			traceparent = newTraceparent()
+		}
+		id, err := traceID(traceparent)
+		if err != nil {
+			printf("❌ Invalid --traceparent: %v\n", err)
+			exit(exitUsage)
+		}
+		printf("🔭 Trace ID: %s\n", id)
+	}
+	if *flat {
+		*downloadDir = ""
+	}
+	matrix := len(payload.Targets) > 1
+	prefixTargets = matrix
+	httpClient := tlsOpts.Client()
+
+	var caps Capabilities
+	if *replay == "" {
+		caps = serverCapabilities(httpClient, auth, serviceBase(*url))
+	}
+
+	// Servers without matrix builds get one request per target
+	if matrix && *replay == "" && !caps.Matrix {
+		exit(fanOut{
+			httpClient: httpClient,
+			auth:       auth,
+			base:       serviceBase(*url),
+			payload:    payload,
+			pgo:        *pgo,
+			parallel:   *parallel,
+			template:   *nameTemplate,
+			dir:        *downloadDir,
+			verbose:    *verbose,
+			checksums:  !*noChecksum,
+		}.Run(*allowPartial))
+	}
+
+	// A local profile is uploaded alongside the payload as multipart form data
+	body, contentType, err := requestBody(payload, *pgo)
+	if err != nil {
+		printf("❌ Failed to read profile: %v\n", err)
+		exit(exitUsage)
+	}
+
+	// 3. Connect (or play back a recorded session)
 	start := time.Now()
-	resp, err := client.Do(req)
+	path := "/build"
+	if *fake {
+		path += "?fake=1"
+	}
+	var resp *http.Response
+	if *replay != "" {
+		resp, err = replayResponse(*replay)
+	} else {
+		resp, err = send(httpClient, auth, "POST", serviceBase(*url), path, contentType, body)
+	}
 	if err != nil {
-		fmt.Printf("❌ Connection failed: %v\n", err)
-		os.Exit(1)
+		printf("❌ Connection failed: %v\n", err)
+		exit(exitConnection)
+	}
+	if *record != "" {
+		if err := recordResponse(resp, *record); err != nil {
+			printf("❌ Failed to create recording: %v\n", err)
+			exit(exitUsage)
+		}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		fmt.Printf("❌ Server Error: %s\n", resp.Status)
-		os.Exit(1)
+		serverError(resp)
 	}
 
-	fmt.Printf("🚀 Connected to Billder. Building %s for %s/%s...\n\n", *repo, *targetOS, *targetArch)
+	targetList := payload.TargetOS + "/" + payload.TargetArch
+	if len(payload.Targets) > 0 {
+		targetList = strings.Join(payload.Targets, ",")
+	}
+	if *replay != "" {
+		printf("📼 Replaying %s...\n\n", *replay)
+	} else {
+		printf("🚀 Connected to Billder. Building %s for %s...\n\n", payload.RepoURL, targetList)
+	}
 
 	// 4. Stream Processor (The "Hybrid" Loop)
 	// We use bufio.Reader because it gives us fine-grained control over the buffer.
 	reader := bufio.NewReader(resp.Body)
-	var filename string
+	color := isTTY(os.Stdout) && !*ci && !*jsonOut
+	// Concurrent targets interleave, so matrix builds print plain prefixed lines
+	out := newRenderer(color && !matrix, *verbose, flavor)
+	res := readEvents(reader, out, color)
 
-	for {
-		// Read line by line
-		lineBytes, err := reader.ReadBytes('\n')
-		if err != nil {
-			// EOF or connection closed
-			break
-		}
-		line := string(lineBytes)
-
-		// Check for the "Switch Protocol" event
-		if strings.HasPrefix(line, "event: binary_start") {
-			// The next line contains "data: <filename>"
-			dataLine, _ := reader.ReadString('\n')
-			filename = strings.TrimSpace(strings.TrimPrefix(dataLine, "data:"))
-
-			// Consume the mandatory empty line (\n) that ends the SSE block
-			reader.ReadString('\n')
-
-			// BREAK the loop. The rest of the stream is binary data.
-			break
-		}
+	// A dropped connection resumes the build's event stream instead of rebuilding
+	rs := resumer{httpClient: httpClient, auth: auth, base: serviceBase(*url), retries: *retries}
+	resumed := res.err != nil && res.filename == "" && res.buildID != "" && *replay == ""
+	if resumed {
+		res = rs.Events(res, out, color)
+	}
+	out.Close()
 
-		// Print standard log messages
-		if strings.HasPrefix(line, "data:") {
-			msg := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
-			if msg != "" {
-				fmt.Printf("✅ %s\n", msg)
-			}
-		}
+	if res.diagnostics > 0 {
+		printf("\n❌ %d compiler diagnostic(s) reported.\n", res.diagnostics)
 	}
 
 	// 5. Binary Download
 	// If we exited the loop with a filename, the rest of the 'reader' buffer
 	// plus the rest of 'resp.Body' is our file.
+	exitCode := exitOK
+	filename := res.filename
+	var n int64
 	if filename != "" {
-		fmt.Printf("\n📦 Receiving artifact: %s...\n", filename)
-
-		outFile, err := os.Create(filename)
-		if err != nil {
-			fmt.Printf("❌ Failed to create local file: %v\n", err)
-			os.Exit(1)
+		if filename, err = downloadPath(*downloadDir, res.origin(), filename); err != nil {
+			printf("❌ Failed to create the download directory: %v\n", err)
+			exit(exitDownload)
 		}
-		defer outFile.Close()
-
-		// WriteTo writes the buffer from the Reader first, then reads the rest from underlying Body
-		n, err := reader.WriteTo(outFile)
+		printf("\n📦 Receiving artifact: %s...\n", filename)
+		n, err = saveArtifact(reader, filename, res.size)
+		if err != nil && res.artifactURL != "" && *replay == "" {
+			printf("⚠️ Download interrupted after %d bytes (%v); resuming...\n", n, err)
+			if n, err = rs.Artifact(res.artifactURL, filename, n); err == nil {
+				err = checkSize(n, res.size)
+			}
+		}
+	} else if (resumed || res.uploaded()) && res.err == nil && res.artifactURL != "" {
+		// The stream doesn't carry the artifact: we resumed it, or the
+		// server put the artifact in storage. Fetch it separately
+		if filename, err = downloadPath(*downloadDir, res.origin(), res.artifactName); err != nil {
+			printf("❌ Failed to create the download directory: %v\n", err)
+			exit(exitDownload)
+		}
+		printf("\n📦 Downloading artifact: %s...\n", filename)
+		n, err = rs.Artifact(res.artifactURL, filename, 0)
+	}
+	if filename != "" {
 		if err != nil {
-			fmt.Printf("❌ Download interrupted: %v\n", err)
+			printf("❌ Download failed: %v\n", err)
+			if partial := keepPartial(filename); partial != "" {
+				printf("⚠️ The incomplete artifact was kept as %s\n", partial)
+			}
+			exitCode = exitDownload
+		} else if _, err := checkArtifact(filename, res.sha256, !*noChecksum); errors.Is(err, errChecksumMismatch) {
+			printf("❌ %s: %v\n", filename, err)
+			exitCode = exitChecksum
 		} else {
+			if err != nil {
+				printf("⚠️ Could not write %s: %v\n", checksumPath(filename), err)
+			}
 			duration := time.Since(start).Round(time.Second)
-			fmt.Printf("✨ Success! Saved to %s (%d bytes) in %s.\n", filename, n, duration)
+			if len(res.failed) > 0 {
+				printf("⚠️ Partial result saved to %s (%d bytes) in %s.\n", res.summary.label(filename), n, duration)
+			} else {
+				printf("✨ Success! Saved to %s (%d bytes) in %s.\n", res.summary.label(filename), n, duration)
+			}
+			if jsonReport != nil {
+				jsonReport.Artifact, jsonReport.Bytes = filename, n
+			}
+			if *ci {
+				reportCIArtifact(filename)
+			}
+			if res.provenanceURL != "" && *replay == "" {
+				if err := fetchSidecar(rs, res.provenanceURL, provenancePath(filename)); err != nil {
+					printf("⚠️ Could not download the provenance: %v\n", err)
+				} else {
+					printf("🔏 Signed provenance saved to %s\n", provenancePath(filename))
+				}
+			}
+			// Zips bundle the license reports; other artifacts get them alongside
+			if res.licensesURL != "" && *replay == "" && !strings.HasSuffix(filename, ".zip") {
+				if err := fetchLicenses(rs, res.licensesURL, filename); err != nil {
+					printf("⚠️ Could not download the license report: %v\n", err)
+				} else {
+					printf("📜 License report saved to %s\n", licensesPath(filename, ".txt"))
+				}
+			}
+		}
+	} else if !payload.DryRun {
+		printLine("\n⚠️ Process finished, but no binary was received.")
+		exitCode = res.exitCode()
+	}
+
+	if jsonReport != nil {
+		if res.summary.Target != "" {
+			jsonReport.Summary = &res.summary
+			jsonReport.Environment = res.summary.Environment
+		}
+		if res.matrix != nil {
+			jsonReport.Matrix = res.matrix
+			for _, t := range res.matrix.Targets {
+				jsonReport.Environment = cmp.Or(jsonReport.Environment, t.Environment)
+			}
+		}
+	}
+
+	// Any failed target fails the run unless partial results are acceptable
+	if failed := res.failed; len(failed) > 0 {
+		if failed[0].LogURL != "" {
+			printf("📜 Full build log: %s%s\n", serviceBase(*url), failed[0].LogURL)
+		}
+		for _, f := range failed {
+			if !matrix {
+				break
+			}
+			printf("❌ %sbuild failed: %s\n", targetPrefix(f.Target), f.Error)
+		}
+		if !*allowPartial && exitCode == exitOK {
+			exitCode = res.exitCode()
+		}
+	}
+	if exitCode != exitOK && (res.category != "" || res.reason() != "") {
+		if hint := endHint(res.reason(), res.category); hint != "" {
+			printf("%s\n", hint)
+		}
+		if jsonReport != nil {
+			jsonReport.Category = res.category
+		}
+	}
+	summary := stepSummary{
+		OK:          exitCode == exitOK,
+		Summary:     res.summary,
+		Matrix:      res.matrix,
+		Diagnostics: res.diagnostics,
+		Steps:       out.Timings(),
+		Total:       time.Since(start),
+	}
+	if exitCode != exitOK {
+		summary.Category = res.category
+	}
+	if exitCode == exitOK && filename != "" {
+		summary.Artifact, summary.Bytes, summary.SHA256 = filename, n, res.sha256
+		if summary.SHA256 == "" && githubAnnotations {
+			summary.SHA256, _ = fileSHA256(filename)
 		}
-	} else {
-		fmt.Println("\n⚠️ Process finished, but no binary was received.")
 	}
+	writeStepSummary(summary)
+	exit(exitCode)
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Exit codes, distinct so CI can tell failures apart.
+const (
+	exitOK          = 0
+	exitBuildFailed = 1 // the build ran and failed, or produced no artifact
+	exitUsage       = 2 // bad flags or local input
+	exitConnection  = 3 // server unreachable or rejected the request
+	exitDownload    = 4 // build succeeded but the artifact transfer failed
+	exitChecksum    = 5 // the artifact doesn't match the server's or the recorded sha256
+	exitServerFault = 6 // the build failed for a reason on the server's side
+	exitTimeout     = 7 // the build ran out of time
+	exitCanceled    = 8 // the build was canceled on the server, by its caller or an admin
+	exitShutdown    = 9 // the server shut down during the build; run it again
+)
+
+var (
+	// plainOutput drops emoji and spinner glyphs (set by --ci).
+	plainOutput bool
+	// logFile receives a copy of everything printed (set by --log-file).
+	logFile io.Writer
+	// stdout receives the progress output; --json moves it to stderr.
+	stdout io.Writer = os.Stdout
+	// stderr receives the build's own stderr output.
+	stderr io.Writer = os.Stderr
+	// jsonReport is printed on stdout at exit when set (by --json).
+	jsonReport *buildReport
+)
+
+// buildReport is the --json output.
+type buildReport struct {
+	ExitCode    int            `json:"exit_code"`
+	Category    string         `json:"error_category,omitempty"` // why the build failed, per the server
+	Artifact    string         `json:"artifact,omitempty"`       // saved file
+	Bytes       int64          `json:"bytes,omitempty"`
+	Summary     *BuildSummary  `json:"summary,omitempty"`
+	Matrix      *MatrixSummary `json:"matrix,omitempty"`
+	Environment string         `json:"environment,omitempty"` // the server's build environment, for bug reports
+}
+
+var ansiCodes = regexp.MustCompile("\033\\[[0-9;]*[A-Za-z]")
+
+// outputMu keeps lines from concurrent fan-out builds whole.
+var outputMu sync.Mutex
+
+// printf writes to stdout, honoring --ci and --log-file.
+func printf(format string, a ...any) {
+	fprintf(stdout, format, a...)
+}
+
+// eprintf is printf to stderr.
+func eprintf(format string, a ...any) {
+	fprintf(stderr, format, a...)
+}
+
+func fprintf(w io.Writer, format string, a ...any) {
+	s := fmt.Sprintf(format, a...)
+	if plainOutput {
+		s = stripEmoji(s)
+	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	io.WriteString(w, s)
+	if logFile != nil {
+		io.WriteString(logFile, ansiCodes.ReplaceAllString(strings.ReplaceAll(s, "\r", ""), ""))
+	}
+}
+
+// printLine is printf with a trailing newline.
+func printLine(a ...any) {
+	printf("%s\n", fmt.Sprint(a...))
+}
+
+// exit flushes the log file, prints the --json report and terminates with code.
+func exit(code int) {
+	if jsonReport != nil {
+		jsonReport.ExitCode = code
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(jsonReport)
+	}
+	if c, ok := logFile.(io.Closer); ok {
+		c.Close()
+	}
+	os.Exit(code)
+}
+
+// stripEmoji removes pictographs and the space that follows each one.
+func stripEmoji(s string) string {
+	var b strings.Builder
+	skipSpace := false
+	for _, r := range s {
+		if isEmoji(r) {
+			skipSpace = true
+			continue
+		}
+		if skipSpace && r == ' ' {
+			skipSpace = false
+			continue
+		}
+		skipSpace = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isEmoji(r rune) bool {
+	switch {
+	case r == 0xFE0F: // variation selector
+		return true
+	case r >= 0x2600 && r <= 0x27BF, r >= 0x1F300 && r <= 0x1FAFF, r >= 0x2800 && r <= 0x28FF:
+		return true
+	}
+	return unicode.Is(unicode.So, r) && r > 0x2000 && r != '█' && r != '░'
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"cmp"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// provenancePath is where the signed provenance of artifact is saved.
+func provenancePath(artifact string) string {
+	return artifact + ".provenance.json"
+}
+
+// provenanceEnvelope mirrors the server's DSSE envelope.
+type provenanceEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     []byte `json:"payload"`
+	Signatures  []struct {
+		KeyID string `json:"keyid"`
+		Sig   []byte `json:"sig"`
+	} `json:"signatures"`
+}
+
+// provenanceStatement mirrors the parts of the server's provenance
+// statement that verify reports.
+type provenanceStatement struct {
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	Predicate struct {
+		BuildDefinition struct {
+			ExternalParameters struct {
+				Repository string `json:"repository"`
+				Target     string `json:"target"`
+			} `json:"externalParameters"`
+			ResolvedDependencies []struct {
+				Digest map[string]string `json:"digest"`
+			} `json:"resolvedDependencies"`
+		} `json:"buildDefinition"`
+		RunDetails struct {
+			Metadata struct {
+				InvocationID string `json:"invocationId"`
+				FinishedOn   string `json:"finishedOn"`
+			} `json:"metadata"`
+		} `json:"runDetails"`
+	} `json:"predicate"`
+}
+
+// attestationKey mirrors the server's GET /v1/attestation/publickey.
+type attestationKey struct {
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+var (
+	errBadSignature     = errors.New("the provenance signature doesn't verify")
+	errProvenanceDigest = errors.New("the file isn't a subject of the provenance")
+)
+
+// parsePublicKey reads an ed25519 public key from a PKIX PEM block.
+func parsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the key is a %T, not ed25519", key)
+	}
+	return pub, nil
+}
+
+// keyID names pub the way the server does.
+func keyID(pub ed25519.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
+
+// verifyProvenance checks that doc is signed by pub and names a file with
+// sum among its subjects, returning the statement and that subject's name.
+func verifyProvenance(doc []byte, pub ed25519.PublicKey, sum string) (provenanceStatement, string, error) {
+	var st provenanceStatement
+	var env provenanceEnvelope
+	if err := json.Unmarshal(doc, &env); err != nil {
+		return st, "", fmt.Errorf("not a provenance envelope: %v", err)
+	}
+	// DSSE pre-authentication encoding, as the server signs it
+	signed := fmt.Appendf(nil, "DSSEv1 %d %s %d %s", len(env.PayloadType), env.PayloadType, len(env.Payload), env.Payload)
+	valid := false
+	for _, s := range env.Signatures {
+		valid = valid || ed25519.Verify(pub, signed, s.Sig)
+	}
+	if !valid {
+		var ids []string
+		for _, s := range env.Signatures {
+			ids = append(ids, s.KeyID)
+		}
+		return st, "", fmt.Errorf("%w: signed by key %s, checked against %s", errBadSignature, strings.Join(ids, ", "), keyID(pub))
+	}
+	if err := json.Unmarshal(env.Payload, &st); err != nil {
+		return st, "", fmt.Errorf("not a provenance statement: %v", err)
+	}
+	var names []string
+	for _, s := range st.Subject {
+		if strings.EqualFold(s.Digest["sha256"], sum) {
+			return st, s.Name, nil
+		}
+		names = append(names, s.Name)
+	}
+	return st, "", fmt.Errorf("%w: sha256 %s isn't that of %s", errProvenanceDigest, sum, strings.Join(names, ", "))
+}
+
+// runVerifyProvenance implements `client verify --provenance`: it checks
+// the provenance's signature with the --public-key file or the server's
+// key, and that file is one of its subjects.
+func runVerifyProvenance(file, docPath, keyFile, url string, auth *authOptions, tlsOpts *tlsOptions) {
+	docPath = cmp.Or(docPath, provenancePath(file))
+	doc, err := os.ReadFile(docPath)
+	if err != nil {
+		printf("❌ Could not read %s: %v\n", docPath, err)
+		exit(exitUsage)
+	}
+
+	var pub ed25519.PublicKey
+	switch {
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err == nil {
+			pub, err = parsePublicKey(data)
+		}
+		if err != nil {
+			printf("❌ Could not read the public key %s: %v\n", keyFile, err)
+			exit(exitUsage)
+		}
+	case url != "":
+		var key attestationKey
+		getJSON(tlsOpts.Client(), auth, serviceBase(url), "/attestation/publickey", &key)
+		if pub, err = parsePublicKey([]byte(key.PublicKey)); err != nil {
+			printf("❌ The server's attestation key is unusable: %v\n", err)
+			exit(exitConnection)
+		}
+	default:
+		printLine("❌ Error: verify --provenance needs the signing key: pass --public-key FILE or --url URL")
+		exit(exitUsage)
+	}
+
+	sum, err := fileSHA256(file)
+	if err != nil {
+		printf("❌ Could not read %s: %v\n", file, err)
+		exit(exitUsage)
+	}
+	st, subject, err := verifyProvenance(doc, pub, sum)
+	if err != nil {
+		printf("❌ %s: FAILED\n   %v (%s)\n", file, err, docPath)
+		if errors.Is(err, errBadSignature) || errors.Is(err, errProvenanceDigest) {
+			exit(exitChecksum)
+		}
+		exit(exitUsage)
+	}
+	def, run := st.Predicate.BuildDefinition, st.Predicate.RunDetails
+	printf("✅ %s: provenance OK (signed by key %s)\n", file, keyID(pub))
+	printf("   📦 %s  sha256 %s\n", subject, sum)
+	source := def.ExternalParameters.Repository
+	if len(def.ResolvedDependencies) > 0 && def.ResolvedDependencies[0].Digest["gitCommit"] != "" {
+		source += " @ " + def.ResolvedDependencies[0].Digest["gitCommit"]
+	}
+	printf("   🔗 %s (%s)\n", source, def.ExternalParameters.Target)
+	printf("   🏗️  build %s, finished %s\n", run.Metadata.InvocationID, run.Metadata.FinishedOn)
+	exit(exitOK)
+}
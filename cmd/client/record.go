@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// recordResponse saves the status line and headers of resp to path, then
+// tees the body into the same file as it is read. The result is a raw
+// HTTP/1.1 response that replayResponse can play back.
+func recordResponse(resp *http.Response, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "HTTP/1.1 %s\r\n", resp.Status)
+	if err := resp.Header.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := io.WriteString(f, "\r\n"); err != nil {
+		f.Close()
+		return err
+	}
+	resp.Body = &recordingBody{Reader: io.TeeReader(resp.Body, f), body: resp.Body, file: f}
+	return nil
+}
+
+// recordingBody closes the recording along with the response body.
+type recordingBody struct {
+	io.Reader
+	body io.Closer
+	file *os.File
+}
+
+func (b *recordingBody) Close() error {
+	err := b.body.Close()
+	if ferr := b.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// replayResponse reads a session saved by recordResponse. The body is
+// delimited by the end of the file, as it was by the connection closing.
+func replayResponse(path string) (*http.Response, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(f), nil)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	resp.Body = &replayBody{ReadCloser: resp.Body, file: f}
+	return resp, nil
+}
+
+// replayBody closes the session file along with the response body.
+type replayBody struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (b *replayBody) Close() error {
+	b.ReadCloser.Close()
+	return b.file.Close()
+}
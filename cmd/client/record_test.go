@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Sessions recorded from a server with fake builds enabled replay through
+// the client's parser without a connection.
+func TestReplaySession(t *testing.T) {
+	captureOutput(t)
+	resp, err := replayResponse(filepath.Join("testdata", "sessions", "fake-windows.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("replayed %s, %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+	r := newRenderer(false, false, "")
+	res := readEvents(reader, r, false)
+	r.Close()
+	artifact, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.err != nil || res.filename != "app.exe" || !res.summary.OK || res.summary.Target != "windows/amd64" {
+		t.Fatalf("stream read as %+v", res)
+	}
+	if err := checkSize(int64(len(artifact)), res.size); err != nil {
+		t.Error(err)
+	}
+	if sum := sha256.Sum256(artifact); hex.EncodeToString(sum[:]) != res.sha256 {
+		t.Errorf("artifact %q doesn't match the server's sha256 %s", artifact, res.sha256)
+	}
+}
+
+func TestReplayRejectedSession(t *testing.T) {
+	resp, err := replayResponse(filepath.Join("testdata", "sessions", "invalid.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var perr PayloadError
+	if err := json.NewDecoder(resp.Body).Decode(&perr); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest || perr.Error != "invalid build request" || len(perr.Errors) != 1 {
+		t.Errorf("replayed %s with %+v", resp.Status, perr)
+	}
+}
+
+func TestReplayMissingSession(t *testing.T) {
+	if _, err := replayResponse(filepath.Join(t.TempDir(), "none.bin")); err == nil {
+		t.Error("replaying a missing file succeeded")
+	}
+	bad := filepath.Join(t.TempDir(), "bad.bin")
+	os.WriteFile(bad, []byte("event: session\ndata: {}\n\n"), 0o644)
+	if _, err := replayResponse(bad); err == nil {
+		t.Error("replaying a file without a status line succeeded")
+	}
+}
+
+// A session recorded from a server replays as the response it was.
+func TestRecordRoundTrip(t *testing.T) {
+	for _, name := range []string{"fake-windows.bin", "invalid.bin"} {
+		t.Run(name, func(t *testing.T) {
+			captured, err := replayResponse(filepath.Join("testdata", "sessions", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(captured.Body)
+			captured.Body.Close()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", captured.Header.Get("Content-Type"))
+				w.WriteHeader(captured.StatusCode)
+				w.Write(body)
+			}))
+			defer srv.Close()
+
+			resp, err := http.Post(srv.URL+"/v1/build", "application/json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "session.bin")
+			if err := recordResponse(resp, path); err != nil {
+				t.Fatal(err)
+			}
+			read, _ := io.ReadAll(resp.Body)
+			if err := resp.Body.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if string(read) != string(body) {
+				t.Errorf("recording changed the body the client read:\n%q\nwant\n%q", read, body)
+			}
+
+			replayed, err := replayResponse(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer replayed.Body.Close()
+			again, _ := io.ReadAll(replayed.Body)
+			if replayed.Status != captured.Status || replayed.Header.Get("Content-Type") != captured.Header.Get("Content-Type") {
+				t.Errorf("replayed %s, %s; want %s, %s", replayed.Status, replayed.Header.Get("Content-Type"), captured.Status, captured.Header.Get("Content-Type"))
+			}
+			if string(again) != string(body) {
+				t.Errorf("replayed body\n%q\nwant\n%q", again, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/rexlx/bilder/pkg/client"
+)
+
+// Step mirrors the server's "step" event.
+type Step struct {
+	Target string `json:"target,omitempty"`
+	Index  int    `json:"index"`
+	Total  int    `json:"total"`
+	Name   string `json:"name"`
+}
+
+func (s Step) String() string {
+	return fmt.Sprintf("%sStep %d/%d: %s", targetPrefix(s.Target), s.Index, s.Total, s.Name)
+}
+
+// Session mirrors the server's "session" event, the first of a build
+// stream. Spec is kept raw so verbose output shows fields this client
+// doesn't know.
+type Session struct {
+	BuildID  string          `json:"build_id"`
+	Protocol string          `json:"protocol"`
+	Schema   int             `json:"schema"`
+	Limits   SessionLimits   `json:"limits"`
+	Spec     json.RawMessage `json:"spec"`
+
+	Defaults []AppliedDefault `json:"defaults,omitempty"`
+}
+
+// AppliedDefault mirrors a request field the server's repos config filled in.
+type AppliedDefault struct {
+	Field string          `json:"field"`
+	Value json.RawMessage `json:"value"`
+	Match string          `json:"match"`
+}
+
+// SessionLimits mirrors the limits of a session; 0 means no limit.
+type SessionLimits struct {
+	MaxJSONBody      int64   `json:"max_json_body_bytes"`
+	MaxMultipartBody int64   `json:"max_multipart_body_bytes"`
+	MaxPatch         int64   `json:"max_patch_bytes"`
+	MaxParallelism   int     `json:"max_parallelism"`
+	MaxArtifact      int64   `json:"max_artifact_bytes"`
+	BuildTimeout     float64 `json:"build_timeout_seconds"`
+	BodyTimeout      float64 `json:"body_timeout_seconds"`
+	WriteTimeout     float64 `json:"write_timeout_seconds"`
+}
+
+func (l SessionLimits) String() string {
+	size := func(n int64) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%.2f MB", float64(n)/1024/1024)
+	}
+	timeout := func(s float64) string {
+		if s == 0 {
+			return "none"
+		}
+		return time.Duration(s * float64(time.Second)).String()
+	}
+	return fmt.Sprintf("artifact %s, request %s (%s with a profile, patch %s), build timeout %s, body timeout %s, write timeout %s, %d targets at once",
+		size(l.MaxArtifact), size(l.MaxJSONBody), size(l.MaxMultipartBody), size(l.MaxPatch),
+		timeout(l.BuildTimeout), timeout(l.BodyTimeout), timeout(l.WriteTimeout), l.MaxParallelism)
+}
+
+// OutputLine mirrors the server's "output" event; Line may hold several lines.
+type OutputLine struct {
+	Target string `json:"target,omitempty"`
+	Step   int    `json:"step"`
+	Stream string `json:"stream"`
+	Line   string `json:"line"`
+	Time   int64  `json:"time_ms"`
+}
+
+// Status mirrors the server's "status" event.
+type Status struct {
+	Message string `json:"message"`
+}
+
+// CompileProgress mirrors the server's "progress" event.
+type CompileProgress struct {
+	Target    string `json:"target,omitempty"`
+	Compiled  int    `json:"compiled"`
+	Expected  int    `json:"expected,omitempty"`
+	Percent   int    `json:"percent"`
+	Estimated bool   `json:"estimated"`
+	ETA       int    `json:"eta_seconds,omitempty"`
+}
+
+func (p CompileProgress) String() string {
+	if !p.Estimated {
+		return fmt.Sprintf("%d packages, progress unknown", p.Compiled)
+	}
+	const width = 20
+	filled := p.Percent * width / 100
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+	s := fmt.Sprintf("%s %3d%% %d/%d packages", bar, p.Percent, p.Compiled, p.Expected)
+	if p.ETA > 0 {
+		s += fmt.Sprintf(", ~%ds left", p.ETA)
+	}
+	return s
+}
+
+var stepText = regexp.MustCompile(`^Step (\d+)/(\d+): (.*?)\.*$`)
+
+// parseStepText recognizes the legacy "Step x/y: name..." log convention.
+func parseStepText(msg string) (Step, bool) {
+	m := stepText.FindStringSubmatch(msg)
+	if m == nil {
+		return Step{}, false
+	}
+	index, _ := strconv.Atoi(m[1])
+	total, _ := strconv.Atoi(m[2])
+	return Step{Index: index, Total: total, Name: m[3]}, true
+}
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// renderer prints build progress. On a TTY it draws a spinner for the active
+// step and hides routine log lines unless verbose is set; otherwise it prints
+// every message on its own line.
+type renderer struct {
+	tty     bool
+	verbose bool
+	ci      ciFlavor // non-empty wraps each step in a CI log group
+	prefix  string   // prepended to every line, for client-side fan-out
+
+	mu       sync.Mutex
+	step     *Step
+	started  time.Time
+	progress *CompileProgress
+	failed   bool
+	frame    int
+	stop     chan struct{}
+	timings  []stepTiming
+}
+
+func newRenderer(tty, verbose bool, ci ciFlavor) *renderer {
+	r := &renderer{tty: tty, verbose: verbose, ci: ci, stop: make(chan struct{})}
+	if tty {
+		go r.spin()
+	}
+	return r
+}
+
+func (r *renderer) spin() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			r.frame++
+			r.draw()
+			r.mu.Unlock()
+		}
+	}
+}
+
+// draw repaints the spinner line. Callers must hold r.mu.
+func (r *renderer) draw() {
+	if r.step == nil {
+		return
+	}
+	elapsed := time.Since(r.started).Round(time.Second)
+	line := fmt.Sprintf("%s %s (%s)", spinnerFrames[r.frame%len(spinnerFrames)], r.step, elapsed)
+	if r.progress != nil {
+		line += " " + r.progress.String()
+	}
+	printf("\r\033[K%s", line)
+}
+
+// complete finalizes the active step line. Callers must hold r.mu.
+func (r *renderer) complete() {
+	if r.step == nil {
+		return
+	}
+	elapsed := time.Since(r.started).Round(100 * time.Millisecond)
+	r.timings = append(r.timings, stepTiming{Name: r.step.String(), Elapsed: elapsed, Failed: r.failed})
+	mark := "✔"
+	if r.failed {
+		mark = "✖"
+	}
+	if r.tty {
+		printf("\r\033[K%s %s (%s)\n", mark, r.step, elapsed)
+	}
+	if r.ci != "" {
+		status := "done"
+		if r.failed {
+			status = "failed"
+		}
+		printf("%s %s (%s)\n", r.step, status, elapsed)
+		if end := r.ci.endGroup(); end != "" {
+			printLine(end)
+		}
+	}
+	r.step = nil
+}
+
+// Step starts a new pipeline step, completing the previous one.
+func (r *renderer) Step(s Step) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.complete()
+	r.step = &s
+	r.started = time.Now()
+	r.progress = nil
+	switch {
+	case r.tty:
+		r.draw()
+	case r.ci != "":
+		printLine(r.ci.startGroup(s.String()))
+	default:
+		printf("%s✅ %s\n", r.prefix, s)
+	}
+}
+
+// Session prints the build id and what the server will build; verbose
+// also prints the full request as the server normalized it, and the limits
+// it runs under.
+func (r *renderer) Session(s Session) {
+	var spec RequestPayload
+	json.Unmarshal(s.Spec, &spec)
+	targets := spec.Targets
+	if len(targets) == 0 {
+		targets = []string{spec.TargetOS + "/" + spec.TargetArch}
+	}
+	r.Println(fmt.Sprintf("🆔 Build %s: %s @ %s for %s", s.BuildID, spec.RepoURL, cmp.Or(spec.Ref, "default branch"), strings.Join(targets, ", ")))
+	if s.Schema > client.StreamSchema {
+		r.Println(fmt.Sprintf("⚠️ The server speaks event stream schema %d but this client reads %d; some output may be missing, update with `billder self-update`", s.Schema, client.StreamSchema))
+	}
+	for _, d := range s.Defaults {
+		r.Println(fmt.Sprintf("⚙️ Server default for %s: %s = %s", d.Match, d.Field, d.Value))
+	}
+	if !r.verbose {
+		return
+	}
+	var indented bytes.Buffer
+	json.Indent(&indented, s.Spec, "   ", "  ")
+	r.Println("   Request as the server runs it (API " + s.Protocol + "):\n   " + indented.String())
+	r.Println("   Limits: " + s.Limits.String())
+}
+
+// Progress updates the compile progress shown for the active step.
+func (r *renderer) Progress(p CompileProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress = &p
+	if r.tty {
+		r.draw()
+	} else {
+		printf("%s⏳ %sCompiling: %s\n", r.prefix, targetPrefix(p.Target), p)
+	}
+}
+
+// Message prints a log line from the server.
+func (r *renderer) Message(msg string) {
+	important := strings.HasPrefix(msg, "Error") || strings.HasPrefix(msg, "Warning")
+	if strings.HasPrefix(msg, "Error") {
+		r.mu.Lock()
+		r.failed = true
+		r.mu.Unlock()
+	}
+	if r.tty && !r.verbose && !important {
+		return
+	}
+	r.Println(fmt.Sprintf("✅ %s", msg))
+}
+
+// Diagnostic prints a compiler diagnostic, in red on a terminal, and as
+// an annotation under GitHub Actions.
+func (r *renderer) Diagnostic(d Diagnostic, color bool) {
+	if color {
+		r.Println(fmt.Sprintf("\033[31m%s\033[0m", d))
+	} else {
+		r.Println(d.String())
+	}
+	if githubAnnotations {
+		// Workflow commands must start the line, so no fan-out prefix
+		r.mu.Lock()
+		printLine(githubAnnotation(d))
+		r.mu.Unlock()
+	}
+}
+
+// outputGutter marks lines of build output, which the repository
+// controls, apart from billder's own messages.
+const outputGutter = "│ "
+
+var sgrSequence = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// outputText makes build output safe to print: colors are kept when color
+// is set and dropped otherwise, and any other control character, which
+// could move the cursor over billder's own lines, is removed.
+func outputText(text string, color bool) string {
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\n' && r != '\t' {
+				return -1
+			}
+			return r
+		}, s)
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range sgrSequence.FindAllStringIndex(text, -1) {
+		b.WriteString(clean(text[last:m[0]]))
+		if color {
+			b.WriteString(text[m[0]:m[1]])
+		}
+		last = m[1]
+	}
+	b.WriteString(clean(text[last:]))
+	return b.String()
+}
+
+// Output prints the lines of build output an event carries to the stream
+// they came from, behind outputGutter. On a terminal stderr lines are red.
+func (r *renderer) Output(o OutputLine, color bool) {
+	lines := strings.Split(outputText(o.Line, color), "\n")
+	if o.Stream != "stderr" {
+		for _, line := range lines {
+			r.Println(outputGutter + targetPrefix(o.Target) + line)
+		}
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tty && r.step != nil {
+		printf("\r\033[K")
+	}
+	for _, line := range lines {
+		line = outputGutter + targetPrefix(o.Target) + line
+		if color && isTTY(os.Stderr) {
+			line = "\033[31m" + line + "\033[0m"
+		}
+		eprintf("%s%s\n", r.prefix, line)
+	}
+	if r.tty {
+		r.draw()
+	}
+}
+
+// Timings lists the completed steps and how long each took.
+func (r *renderer) Timings() []stepTiming {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.timings
+}
+
+// Println prints a line without corrupting the spinner.
+func (r *renderer) Println(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tty && r.step != nil {
+		printf("\r\033[K")
+	}
+	printLine(r.prefix + line)
+	if r.tty {
+		r.draw()
+	}
+}
+
+// Close completes the active step and stops the spinner.
+func (r *renderer) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.complete()
+	if r.tty {
+		close(r.stop)
+		r.tty = false
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/rexlx/bilder/internal/docfile"
+)
+
+// loadRequest reads a RequestPayload-shaped JSON or YAML document from path
+// ("-" for stdin). Errors name the file, line and offending key.
+func loadRequest(path string) (RequestPayload, error) {
+	var payload RequestPayload
+	var data []byte
+	var err error
+	if path == "-" {
+		path = "<stdin>"
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return payload, err
+	}
+	err = docfile.Decode(path, data, &payload)
+	return payload, err
+}
+
+// readPatch reads a diff from path, "-" meaning stdin.
+func readPatch(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
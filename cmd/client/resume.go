@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resumer reconnects a build stream that broke off before the artifact,
+// and continues interrupted artifact downloads with Range requests.
+type resumer struct {
+	httpClient *http.Client
+	auth       *authOptions
+	base       string
+	retries    int
+}
+
+// backoff is the wait before reconnect attempt n (1-based).
+func backoff(n int) time.Duration {
+	return time.Duration(1<<min(n-1, 4)) * time.Second
+}
+
+// Events follows /builds/{id}/events with Last-Event-ID until the stream
+// ends cleanly or the retries run out, merging what it reads into res.
+func (rs resumer) Events(res streamResult, out *renderer, color bool) streamResult {
+	for attempt := 1; attempt <= rs.retries && res.err != nil && res.filename == ""; attempt++ {
+		out.Println(fmt.Sprintf("🔌 Connection lost (%v); reconnecting in %s (%d/%d)...", res.err, backoff(attempt), attempt, rs.retries))
+		time.Sleep(backoff(attempt))
+
+		header := http.Header{}
+		if res.lastEventID != "" {
+			header.Set("Last-Event-ID", res.lastEventID)
+		}
+		resp, err := sendHeader(rs.httpClient, rs.auth, "GET", rs.base, "/builds/"+res.buildID+"/events", "", header, nil)
+		if err != nil {
+			res.err = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			res.err = fmt.Errorf("server returned %s", resp.Status)
+			if resp.StatusCode == http.StatusNotFound {
+				break // the build is no longer buffered
+			}
+			continue
+		}
+		next := readEvents(bufio.NewReader(resp.Body), out, color)
+		resp.Body.Close()
+
+		res.err = next.err
+		res.diagnostics += next.diagnostics
+		res.failed = append(res.failed, next.failed...)
+		if next.summary.Target != "" {
+			res.summary = next.summary
+		}
+		if next.lastEventID != "" {
+			res.lastEventID = next.lastEventID
+		}
+		if next.artifactURL != "" {
+			res.artifactName, res.artifactURL = next.artifactName, next.artifactURL
+		}
+	}
+	return res
+}
+
+// Artifact downloads the build's artifact to dest, continuing after the
+// first offset bytes already written there. An absolute url is a presigned
+// storage download and is fetched without the server's credentials.
+func (rs resumer) Artifact(url, dest string, offset int64) (int64, error) {
+	path := strings.TrimPrefix(url, apiPrefix)
+	var err error
+	for attempt := 1; attempt <= rs.retries; attempt++ {
+		header := http.Header{}
+		if offset > 0 {
+			header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		}
+		var resp *http.Response
+		if isAbsoluteURL(url) {
+			resp, err = download(rs.httpClient, url, header)
+		} else {
+			resp, err = sendHeader(rs.httpClient, rs.auth, "GET", rs.base, path, "", header, nil)
+		}
+		if err != nil {
+			time.Sleep(backoff(attempt))
+			continue
+		}
+
+		flags := os.O_CREATE | os.O_WRONLY
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			flags |= os.O_APPEND
+		case http.StatusOK:
+			flags |= os.O_TRUNC // the server ignored Range; start over
+			offset = 0
+		default:
+			resp.Body.Close()
+			return offset, fmt.Errorf("server returned %s", resp.Status)
+		}
+		f, ferr := os.OpenFile(dest, flags, 0o644)
+		if ferr != nil {
+			resp.Body.Close()
+			return offset, ferr
+		}
+		n, cerr := io.Copy(f, resp.Body)
+		resp.Body.Close()
+		if ferr = f.Close(); cerr == nil {
+			cerr = ferr
+		}
+		offset += n
+		if err = cerr; err == nil {
+			return offset, nil
+		}
+		time.Sleep(backoff(attempt))
+	}
+	return offset, err
+}
+
+// download GETs url with header and no credentials.
+func download(httpClient *http.Client, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	return httpClient.Do(req)
+}
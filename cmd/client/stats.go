@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// DurationStats mirrors the server's percentiles of a duration, in seconds.
+type DurationStats struct {
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	Samples int     `json:"samples"`
+}
+
+// RepoBuildStats mirrors the server's GET /v1/stats/repo response.
+type RepoBuildStats struct {
+	Repo        string                   `json:"repo"`
+	Days        int                      `json:"days"`
+	Since       time.Time                `json:"since"`
+	Builds      int                      `json:"builds"`
+	Succeeded   int                      `json:"succeeded"`
+	Failed      int                      `json:"failed"`
+	SuccessRate float64                  `json:"success_rate"`
+	Total       DurationStats            `json:"total_seconds"`
+	Steps       map[string]DurationStats `json:"steps_seconds"`
+	AvgArtifact int64                    `json:"avg_artifact_bytes"`
+	CacheHit    *float64                 `json:"cache_hit_rate,omitempty"`
+}
+
+// statsSteps are the steps the server times, in build order.
+var statsSteps = []string{"clone", "deps", "compile", "deliver"}
+
+// runStats implements `client stats --repo R`: how a repository's builds
+// fared over the last --days days.
+func runStats(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	serviceURL := fs.String("url", "", "Billder Service URL")
+	repo := fs.String("repo", "", "Repository, e.g. github.com/owner/name")
+	days := fs.Int("days", 30, "Only builds started in the last N days")
+	auth := addAuthFlags(fs)
+	tlsOpts := addTLSFlags(fs)
+	jsonOut := fs.Bool("json", false, "Print the server's answer as JSON")
+	fs.Parse(args)
+	if *serviceURL == "" || *repo == "" || *days < 1 {
+		fmt.Fprintln(fs.Output(), "Usage: client stats --url URL --repo REPO [--days N]")
+		fs.PrintDefaults()
+		exit(exitUsage)
+	}
+
+	query := url.Values{"repo": {*repo}, "days": {strconv.Itoa(*days)}}
+	resp, err := send(tlsOpts.Client(), auth, "GET", serviceBase(*serviceURL), "/stats/repo?"+query.Encode(), "", nil)
+	if err != nil {
+		printf("❌ Connection failed: %v\n", err)
+		exit(exitConnection)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		printLine("❌ The server does not keep build statistics; upgrade it")
+		exit(exitBuildFailed)
+	}
+	if resp.StatusCode != http.StatusOK {
+		serverError(resp)
+	}
+	var stats RepoBuildStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		printf("❌ Invalid response: %v\n", err)
+		exit(exitConnection)
+	}
+	if *jsonOut {
+		json.NewEncoder(os.Stdout).Encode(stats)
+		exit(exitOK)
+	}
+
+	printf("📊 %s, builds since %s\n", stats.Repo, stats.Since.Local().Format(time.DateOnly))
+	if stats.Builds == 0 {
+		printLine("   No finished builds.")
+		exit(exitOK)
+	}
+	printf("   Builds:     %d (%d succeeded, %d failed, %.0f%% success)\n", stats.Builds, stats.Succeeded, stats.Failed, stats.SuccessRate*100)
+	if stats.AvgArtifact > 0 {
+		printf("   Artifact:   %.2f MB on average\n", float64(stats.AvgArtifact)/1024/1024)
+	}
+	if stats.CacheHit != nil {
+		printf("   Cache hits: %.0f%% of builds compiled nothing\n", *stats.CacheHit*100)
+	}
+	if stats.Total.Samples == 0 {
+		exit(exitOK) // finished before the server timed builds
+	}
+	printLine("")
+	var table strings.Builder
+	tw := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "   Step\tp50\tp90\tBuilds")
+	for _, step := range statsSteps {
+		if d, ok := stats.Steps[step]; ok {
+			fmt.Fprintf(tw, "   %s\t%s\t%s\t%d\n", step, seconds(d.P50), seconds(d.P90), d.Samples)
+		}
+	}
+	fmt.Fprintf(tw, "   total\t%s\t%s\t%d\n", seconds(stats.Total.P50), seconds(stats.Total.P90), stats.Total.Samples)
+	tw.Flush()
+	printf("%s", table.String())
+	exit(exitOK)
+}
+
+// seconds renders a duration in seconds the way time.Duration does, to
+// a hundredth of a second.
+func seconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(10 * time.Millisecond).String()
+}
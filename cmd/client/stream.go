@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rexlx/bilder/pkg/client"
+)
+
+// streamResult is what a build stream reported before its artifact.
+type streamResult struct {
+	filename    string // set when the artifact follows in the stream
+	sha256      string // the server's digest of that artifact, if it sent one
+	size        int64  // the artifact's length in bytes; -1 if the server didn't say
+	summary     BuildSummary
+	matrix      *MatrixSummary
+	failed      []BuildSummary
+	diagnostics int
+	lastEventID string // resume point for `attach --last-event-id`
+	buildID     string // from the "job" event; servers without it can't resume
+	err         error  // the stream broke off rather than ending
+	category    string // why the build failed, from the summary or end event
+	end         *StreamEnd
+
+	artifactName  string // where the artifact can be fetched again
+	artifactURL   string
+	stored        bool   // the summary said no binary follows: fetch artifactURL
+	provenanceURL string // its signed provenance, when the server attests builds
+	licensesURL   string // license_report: the reports of every target
+}
+
+// uploaded reports whether the server put the artifact in storage rather
+// than streaming it: artifact_url is then a presigned download of its own,
+// or the server's artifact download when the artifact was too big for it
+// to stream. Servers that predate "delivery" only upload.
+func (r streamResult) uploaded() bool {
+	return r.filename == "" && (r.stored || isAbsoluteURL(r.artifactURL))
+}
+
+func isAbsoluteURL(u string) bool {
+	return strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://")
+}
+
+// StreamEnd mirrors the server's "end" event, the last of a stream without
+// an artifact.
+type StreamEnd struct {
+	OK       bool   `json:"ok"`
+	Category string `json:"error_category"`
+	Reason   string `json:"reason"` // completed, canceled_by_user, timeout, shutdown or error
+	Message  string `json:"message"`
+}
+
+// exitCode is the exit code for a stream that ended without an artifact:
+// by the end event's reason when the server sent one, else by category.
+func (r streamResult) exitCode() int {
+	if r.end != nil {
+		switch r.end.Reason {
+		case "canceled_by_user":
+			return exitCanceled
+		case "shutdown":
+			return exitShutdown
+		case "timeout":
+			return exitTimeout
+		}
+	}
+	return failureExit(r.category)
+}
+
+// reason is the end event's reason, or "" when there was none.
+func (r streamResult) reason() string {
+	if r.end == nil {
+		return ""
+	}
+	return r.end.Reason
+}
+
+// readEvents renders SSE events on out until the stream switches to
+// artifact bytes or ends. reader is left positioned at the artifact.
+func readEvents(reader *bufio.Reader, out *renderer, color bool) streamResult {
+	res := streamResult{size: -1}
+	var event, pendingID string
+	for {
+		// Read line by line
+		lineBytes, err := reader.ReadBytes('\n')
+		if err != nil {
+			// EOF or connection closed. Once the end event arrived the
+			// build is over, however the connection went down after it.
+			if err != io.EOF && res.end == nil {
+				res.err = err
+			}
+			break
+		}
+		line := string(lineBytes)
+
+		// Check for the "Switch Protocol" event
+		if strings.HasPrefix(line, "event: binary_start") {
+			// The next line contains "data: <filename>"
+			dataLine, _ := reader.ReadString('\n')
+			res.filename = strings.TrimSpace(strings.TrimPrefix(dataLine, "data:"))
+
+			// Consume the mandatory empty line (\n) that ends the SSE block
+			reader.ReadString('\n')
+
+			// BREAK the loop. The rest of the stream is binary data.
+			break
+		}
+
+		// The server's digest and size of the artifact come just before binary_start
+		if strings.HasPrefix(line, "sha256:") {
+			res.sha256 = strings.TrimSpace(strings.TrimPrefix(line, "sha256:"))
+			continue
+		}
+		if strings.HasPrefix(line, "size:") {
+			if n, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "size:")), 10, 64); err == nil {
+				res.size = n
+			}
+			continue
+		}
+
+		// Remember how far we got, for resuming with Last-Event-ID. The id
+		// only counts once its block is complete.
+		if strings.HasPrefix(line, "id:") {
+			pendingID = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+			continue
+		}
+
+		// Track named events; a blank line ends the block
+		if strings.HasPrefix(line, "event:") {
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			event = ""
+			if pendingID != "" {
+				res.lastEventID, pendingID = pendingID, ""
+			}
+			continue
+		}
+
+		if event == "session" && strings.HasPrefix(line, "data:") {
+			var s Session
+			if err := client.DecodeEvent(event, []byte(strings.TrimPrefix(line, "data:")), &s); err == nil {
+				res.buildID = s.BuildID
+				out.Session(s)
+			}
+			continue
+		}
+
+		if event == "job" && strings.HasPrefix(line, "data:") {
+			var j struct {
+				BuildID string `json:"build_id"`
+			}
+			if err := client.DecodeEvent(event, []byte(strings.TrimPrefix(line, "data:")), &j); err == nil {
+				res.buildID = j.BuildID
+			}
+			continue
+		}
+
+		if event == "summary" && strings.HasPrefix(line, "data:") {
+			var s BuildSummary
+			if err := client.DecodeEvent(event, []byte(strings.TrimPrefix(line, "data:")), &s); err != nil {
+				printf("⚠️ Could not parse build summary: %v\n", err)
+				continue
+			}
+			res.summary = s
+			if s.CompilerOptions != nil {
+				out.Println(fmt.Sprintf("  🔧 %sCompiled with %s", targetPrefix(s.Target), s.CompilerOptions))
+			}
+			for _, c := range s.Cmds {
+				if c.OK {
+					out.Println(fmt.Sprintf("  ✅ %scmd/%s  %s (%.2f MB)", targetPrefix(s.Target), c.Name, c.Binary, float64(c.Size)/1024/1024))
+				} else {
+					out.Println(fmt.Sprintf("  ❌ %scmd/%s  %s", targetPrefix(s.Target), c.Name, c.Error))
+				}
+			}
+			if s.ArtifactURL != "" {
+				res.artifactName, res.artifactURL, res.provenanceURL = s.Artifact, s.ArtifactURL, s.ProvenanceURL
+				res.licensesURL = s.LicensesURL
+				res.sha256 = cmp.Or(s.ArtifactSHA256, res.sha256)
+				res.stored = s.Delivery == "stored"
+			}
+			if s.Error != "" {
+				res.failed = append(res.failed, s)
+				res.category = cmp.Or(res.category, s.Category)
+			}
+			continue
+		}
+
+		if event == "matrix_summary" && strings.HasPrefix(line, "data:") {
+			var m MatrixSummary
+			if err := client.DecodeEvent(event, []byte(strings.TrimPrefix(line, "data:")), &m); err == nil {
+				res.matrix = &m
+				if m.ArtifactURL != "" {
+					res.artifactName, res.artifactURL, res.provenanceURL = m.Artifact, m.ArtifactURL, m.ProvenanceURL
+					res.licensesURL = m.LicensesURL
+					res.sha256 = cmp.Or(m.ArtifactSHA256, res.sha256)
+					res.stored = m.Delivery == "stored"
+				}
+				out.Println(fmt.Sprintf("\n📊 %d target(s) succeeded, %d failed:", m.Succeeded, m.Failed))
+				for _, t := range m.Targets {
+					if t.OK {
+						out.Println(fmt.Sprintf("  ✅ %s  %s (%.2f MB)", t.Target, t.Artifact, t.SizeMB))
+					} else {
+						out.Println(fmt.Sprintf("  ❌ %s  %s", t.Target, t.Error))
+					}
+				}
+			}
+			continue
+		}
+
+		if event == "diagnostic" && strings.HasPrefix(line, "data:") {
+			var d Diagnostic
+			if err := client.DecodeEvent(event, []byte(strings.TrimPrefix(line, "data:")), &d); err == nil {
+				res.diagnostics++
+				out.Diagnostic(d, color)
+			}
+			continue
+		}
+
+		if event == "output" && strings.HasPrefix(line, "data:") {
+			var o OutputLine
+			if err := client.DecodeEvent(event, []byte(strings.TrimPrefix(line, "data:")), &o); err == nil {
+				out.Output(o, color)
+			}
+			continue
+		}
+
+		if event == "modules" && strings.HasPrefix(line, "data:") {
+			var m ModuleList
+			if err := client.DecodeEvent(event, []byte(strings.TrimPrefix(line, "data:")), &m); err == nil {
+				out.Println(fmt.Sprintf("📁 The repository has %d modules:", len(m.Modules)))
+				for _, mod := range m.Modules {
+					mark, mains := " ", "no main package"
+					if mod.Dir == m.Selected {
+						mark = "👉"
+					}
+					if len(mod.Main) > 0 {
+						mains = "main: " + strings.Join(mod.Main, ", ")
+					}
+					out.Println(fmt.Sprintf("  %s %s  %s (%s)", mark, mod.Dir, mod.Path, mains))
+				}
+				if m.Selected == "" {
+					out.Println("   Choose one with --module-dir")
+				}
+			}
+			continue
+		}
+
+		if event == "dry_run" && strings.HasPrefix(line, "data:") {
+			var plan bytes.Buffer
+			json.Indent(&plan, []byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), "", "  ")
+			out.Println("🧪 Dry run plan:\n" + plan.String())
+			continue
+		}
+
+		// The stream's last event when no artifact follows
+		if event == "end" {
+			var end StreamEnd
+			if client.DecodeEvent(event, []byte(strings.TrimPrefix(line, "data:")), &end) == nil {
+				res.end = &end
+				res.category = cmp.Or(end.Category, res.category)
+				// A failed summary usually said so already
+				switch {
+				case len(res.failed) > 0:
+				case end.Reason == "canceled_by_user":
+					out.Println("🛑 " + end.Message)
+				case end.Reason == "shutdown":
+					out.Println("🔌 " + end.Message)
+				}
+			}
+			continue
+		}
+
+		// Report blocks are preformatted text, printed verbatim
+		if event == "report" && strings.HasPrefix(line, "data:") {
+			out.Println(strings.TrimRight(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "), "\r\n"))
+			continue
+		}
+
+		if event == "progress" && strings.HasPrefix(line, "data:") {
+			var p CompileProgress
+			if err := client.DecodeEvent(event, []byte(strings.TrimPrefix(line, "data:")), &p); err == nil {
+				out.Progress(p)
+			}
+			continue
+		}
+
+		if event == "step" && strings.HasPrefix(line, "data:") {
+			var s Step
+			if err := client.DecodeEvent(event, []byte(strings.TrimPrefix(line, "data:")), &s); err == nil {
+				out.Step(s)
+			}
+			continue
+		}
+
+		// billder's own messages: status events, or unnamed data lines from
+		// servers of stream schema 1. Events of a newer schema than ours
+		// are skipped, not printed as messages
+		if event == "status" && strings.HasPrefix(line, "data:") {
+			var st Status
+			if err := client.DecodeEvent(event, []byte(strings.TrimPrefix(line, "data:")), &st); err == nil {
+				message(out, st.Message)
+			}
+			continue
+		}
+		if event == "" && strings.HasPrefix(line, "data:") {
+			message(out, strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		}
+	}
+	return res
+}
+
+// message prints a message of billder's own, as the step it announces
+// when it is one. Only these, never output events, may say the build
+// failed.
+func message(out *renderer, msg string) {
+	if s, ok := parseStepText(msg); ok {
+		out.Step(s)
+	} else if msg != "" {
+		out.Message(msg)
+	}
+}
+
+// errIncomplete means the artifact stream ended before the advertised size.
+var errIncomplete = errors.New("incomplete download")
+
+// checkSize compares the bytes received with the size from binary_start.
+// There's no Content-Length in the hybrid stream, and a connection reset
+// can look like a clean end, so this is what tells a truncated file apart.
+func checkSize(n, size int64) error {
+	if size >= 0 && n != size {
+		return fmt.Errorf("%w: received %d of %d bytes", errIncomplete, n, size)
+	}
+	return nil
+}
+
+// keepPartial moves an incomplete download aside as dest.partial and drops
+// any older checksum sidecar, so nothing at dest looks like a valid artifact.
+func keepPartial(dest string) string {
+	os.Remove(checksumPath(dest))
+	partial := dest + ".partial"
+	if err := os.Rename(dest, partial); err != nil {
+		os.Remove(dest)
+		return ""
+	}
+	return partial
+}
+
+// saveArtifact writes the rest of the stream to dest, failing with
+// errIncomplete if that isn't the size binary_start advertised.
+func saveArtifact(reader *bufio.Reader, dest string, size int64) (int64, error) {
+	outFile, err := os.Create(dest)
+	if err != nil {
+		return 0, err
+	}
+	// WriteTo writes the buffer from the Reader first, then reads the rest from underlying Body
+	n, err := reader.WriteTo(outFile)
+	if cerr := outFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = checkSize(n, size)
+	}
+	return n, err
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files under testdata")
+
+// captureOutput sends what the client prints to a buffer for the length
+// of the test.
+func captureOutput(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	prevOut, prevErr := stdout, stderr
+	stdout, stderr = &out, &out
+	t.Cleanup(func() { stdout, stderr = prevOut, prevErr })
+	return &out
+}
+
+// Captured streams, of schema 1 servers and of servers newer than this
+// client, replay through readEvents to what the .golden file next to each
+// records: the rendered output, then what the stream left for the caller.
+func TestReadEventsGolden(t *testing.T) {
+	streams, _ := filepath.Glob(filepath.Join("testdata", "streams", "*", "*.sse"))
+	if len(streams) == 0 {
+		t.Fatal("no captured streams")
+	}
+	for _, path := range streams {
+		t.Run(strings.TrimPrefix(path, filepath.Join("testdata", "streams")+string(filepath.Separator)), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := captureOutput(t)
+			r := newRenderer(false, true, "")
+			reader := bufio.NewReader(bytes.NewReader(data))
+			res := readEvents(reader, r, false)
+			r.Close()
+			rest, _ := io.ReadAll(reader)
+
+			fmt.Fprintf(out, "--- result\nfilename=%q sha256=%q size=%d build=%q last_event_id=%q\n",
+				res.filename, res.sha256, res.size, res.buildID, res.lastEventID)
+			fmt.Fprintf(out, "diagnostics=%d failed=%d category=%q reason=%q err=%v\n",
+				res.diagnostics, len(res.failed), res.category, res.reason(), res.err)
+			if res.filename == "" && res.reason() != "completed" {
+				fmt.Fprintf(out, "exit=%d\n", res.exitCode())
+			}
+			fmt.Fprintf(out, "artifact_url=%q stored=%v rest=%q\n", res.artifactURL, res.stored, rest)
+
+			golden := strings.TrimSuffix(path, ".sse") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != string(want) {
+				t.Errorf("replaying %s printed\n%s\nwant\n%s", path, got, want)
+			}
+		})
+	}
+}
+
+// serveArtifact answers with a stream whose binary_start advertises size
+// (unless it is negative) and then sends body. end says how the
+// connection goes after that: "reset" drops it with a RST once the client
+// closes the reset channel, "close" ends it cleanly.
+func serveArtifact(t *testing.T, size int64, body []byte, end string, reset <-chan struct{}) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nConnection: close\r\n\r\n")
+		rw.WriteString("data: Step 1/1: Compiling\n\nevent: summary\ndata: {\"ok\":true}\n\n")
+		if size >= 0 {
+			fmt.Fprintf(rw, "size: %d\n", size)
+		}
+		rw.WriteString("event: binary_start\ndata: app.exe\n\n")
+		rw.Write(body)
+		rw.Flush()
+		if end == "reset" {
+			<-reset
+			conn.(*net.TCPConn).SetLinger(0)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// A download cut short, by a reset or a clean close, is kept aside as
+// .partial, and no sidecar claims it is the artifact.
+func TestSaveArtifactInterrupted(t *testing.T) {
+	const size = 1 << 20
+	artifact := bytes.Repeat([]byte("billder!"), size/8)
+	for _, tc := range []struct {
+		name   string
+		size   int64
+		body   []byte
+		end    string
+		failed bool
+	}{
+		{"reset midway", size, artifact[:size/2], "reset", true},
+		{"reset at once", size, nil, "reset", true},
+		{"closed midway", size, artifact[:size/2], "close", true},
+		{"closed one byte short", size, artifact[:size-1], "close", true},
+		{"more than advertised", size - 1, artifact, "close", true},
+		{"complete", size, artifact, "close", false},
+		{"no size from an older server", -1, artifact[:size/2], "close", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			captureOutput(t)
+			reset := make(chan struct{})
+			srv := serveArtifact(t, tc.size, tc.body, tc.end, reset)
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			reader := bufio.NewReader(resp.Body)
+			res := readEvents(reader, newRenderer(false, false, ""), false)
+			if res.filename != "app.exe" || res.size != tc.size {
+				t.Fatalf("binary_start read as %q of %d bytes", res.filename, res.size)
+			}
+			close(reset)
+
+			dest := filepath.Join(t.TempDir(), res.filename)
+			os.WriteFile(checksumPath(dest), []byte("stale  app.exe\n"), 0o644)
+			n, err := saveArtifact(reader, dest, res.size)
+			if !tc.failed {
+				if err != nil || n != int64(len(tc.body)) {
+					t.Errorf("saved %d bytes: %v", n, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("saved %d of %d bytes without an error", n, size)
+			}
+			if tc.end == "close" && !errors.Is(err, errIncomplete) {
+				t.Errorf("a short stream failed with %v, want %v", err, errIncomplete)
+			}
+			partial := keepPartial(dest)
+			if partial != dest+".partial" {
+				t.Errorf("kept as %q", partial)
+			}
+			if _, err := os.Stat(dest); !os.IsNotExist(err) {
+				t.Errorf("incomplete artifact left at %s", dest)
+			}
+			if _, err := os.Stat(checksumPath(dest)); !os.IsNotExist(err) {
+				t.Error("stale checksum sidecar left behind")
+			}
+			if st, err := os.Stat(partial); err != nil || st.Size() != n {
+				t.Errorf("%s: %v, want %d bytes", partial, err, n)
+			}
+		})
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	for _, tc := range []struct {
+		n, size int64
+		ok      bool
+	}{
+		{10, 10, true}, {0, 0, true}, {10, -1, true}, {0, -1, true},
+		{9, 10, false}, {11, 10, false}, {0, 10, false},
+	} {
+		if err := checkSize(tc.n, tc.size); (err == nil) != tc.ok || (err != nil && !errors.Is(err, errIncomplete)) {
+			t.Errorf("checkSize(%d, %d) = %v", tc.n, tc.size, err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+)
+
+// runTail implements `client tail <build-id>`: it watches a build started
+// elsewhere, e.g. asynchronously from another machine, from the start of
+// the server's buffer. Watching can't affect the build; stopping it
+// leaves the build running.
+func runTail(args []string) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	url := fs.String("url", "", "Billder Service URL")
+	auth := addAuthFlags(fs)
+	tlsOpts := addTLSFlags(fs)
+	verbose := fs.Bool("verbose", false, "Show all server log lines on a TTY")
+	fs.Parse(args)
+
+	if *url == "" || fs.NArg() != 1 {
+		printLine("❌ Error: usage: client tail --url URL <build-id>")
+		exit(exitUsage)
+	}
+	id := fs.Arg(0)
+
+	resp, err := send(tlsOpts.Client(), auth, "GET", serviceBase(*url), "/builds/"+id+"/tail", "", nil)
+	if err != nil {
+		printf("❌ Connection failed: %v\n", err)
+		exit(exitConnection)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		serverError(resp)
+	}
+	printf("👀 Watching build %s\n\n", id)
+	exitWith(renderEvents(resp.Body, *verbose))
+}
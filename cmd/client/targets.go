@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CgoProbe mirrors the server's /capabilities/cgo response.
+type CgoProbe struct {
+	Target       string          `json:"target"`
+	CC           string          `json:"cc"`
+	CCAvailable  bool            `json:"cc_available"`
+	PkgConfig    string          `json:"pkg_config"`
+	Packages     []string        `json:"packages"`
+	Headers      map[string]bool `json:"headers"`
+	IncludeRoots []string        `json:"include_roots"`
+}
+
+// runTargets implements `client targets`, listing what the server can build.
+func runTargets(args []string) {
+	fs := flag.NewFlagSet("targets", flag.ExitOnError)
+	url := fs.String("url", "", "Billder Service URL")
+	auth := addAuthFlags(fs)
+	cgo := fs.Bool("cgo", false, "Show C headers and pkg-config packages for --target")
+	target := fs.String("target", "windows/amd64", "Target to probe with --cgo (os/arch)")
+	tlsOpts := addTLSFlags(fs)
+	fs.Parse(args)
+
+	if *url == "" {
+		printLine("❌ Error: --url is required")
+		exit(exitUsage)
+	}
+	base := serviceBase(*url)
+	httpClient := tlsOpts.Client()
+
+	if !*cgo {
+		var targets []string
+		getJSON(httpClient, auth, base, "/capabilities/targets", &targets)
+		cacheTargets(targets)
+		printLine("🎯 Supported targets:")
+		for _, t := range targets {
+			printf("  %s\n", t)
+		}
+		return
+	}
+
+	var probe CgoProbe
+	getJSON(httpClient, auth, base, "/capabilities/cgo?target="+*target, &probe)
+	printf("🔧 %s via %s (available: %t)\n", probe.Target, probe.CC, probe.CCAvailable)
+	printLine("\nInclude roots:")
+	for _, r := range probe.IncludeRoots {
+		printf("  %s\n", r)
+	}
+	printLine("\nHeaders:")
+	headers := make([]string, 0, len(probe.Headers))
+	for h := range probe.Headers {
+		headers = append(headers, h)
+	}
+	sort.Strings(headers)
+	for _, h := range headers {
+		mark := "✅"
+		if !probe.Headers[h] {
+			mark = "❌"
+		}
+		printf("  %s %s\n", mark, h)
+	}
+	printf("\npkg-config packages (%s): %d\n", probe.PkgConfig, len(probe.Packages))
+	for _, p := range probe.Packages {
+		printf("  %s\n", p)
+	}
+}
+
+// serviceBase turns a .../build or .../v1/build URL into the service root.
+func serviceBase(url string) string {
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), "/build")
+	return strings.TrimSuffix(url, apiPrefix)
+}
+
+// getJSON fetches path from the service and decodes the response into v,
+// exiting on failure.
+func getJSON(httpClient *http.Client, auth *authOptions, base, path string, v any) {
+	resp, err := send(httpClient, auth, "GET", base, path, "", nil)
+	if err != nil {
+		printf("❌ Connection failed: %v\n", err)
+		exit(exitConnection)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		serverError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		printf("❌ Invalid response: %v\n", err)
+		exit(exitConnection)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// tlsOptions holds the --cacert, --cert/--key and --insecure flags.
+type tlsOptions struct {
+	caCert   *string
+	cert     *string
+	key      *string
+	insecure *bool
+}
+
+func addTLSFlags(fs *flag.FlagSet) *tlsOptions {
+	return &tlsOptions{
+		caCert:   fs.String("cacert", "", "PEM CA bundle used to verify the server certificate"),
+		cert:     fs.String("cert", "", "Client certificate for mTLS (PEM)"),
+		key:      fs.String("key", "", "Client private key for mTLS (PEM)"),
+		insecure: fs.Bool("insecure", false, "Skip server certificate verification (DANGEROUS)"),
+	}
+}
+
+// Client returns an HTTP client configured from the flags, exiting on bad
+// input. No timeout: builds can run for a long time and the server decides.
+func (o *tlsOptions) Client() *http.Client {
+	cfg, err := o.config()
+	if err != nil {
+		printf("❌ TLS setup failed: %v\n", err)
+		exit(exitUsage)
+	}
+	if *o.insecure {
+		fmt.Fprintln(os.Stderr, "⚠️  WARNING: --insecure disables TLS certificate verification.")
+		fmt.Fprintln(os.Stderr, "⚠️  WARNING: Anyone on the network path can read your token and swap your binary.")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return &http.Client{Transport: transport}
+}
+
+func (o *tlsOptions) config() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: *o.insecure}
+	if *o.caCert != "" {
+		pem, err := os.ReadFile(*o.caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *o.caCert)
+		}
+		cfg.RootCAs = pool
+	}
+	if (*o.cert == "") != (*o.key == "") {
+		return nil, fmt.Errorf("--cert and --key must be used together")
+	}
+	if *o.cert != "" {
+		pair, err := tls.LoadX509KeyPair(*o.cert, *o.key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
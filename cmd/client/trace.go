@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// traceparent, when set, goes out as the W3C traceparent header of every
+// request so the server's build spans join the caller's trace.
+var traceparent string
+
+// newTraceparent starts a fresh sampled trace.
+func newTraceparent() string {
+	var traceID [16]byte
+	var spanID [8]byte
+	rand.Read(traceID[:])
+	rand.Read(spanID[:])
+	return "00-" + hex.EncodeToString(traceID[:]) + "-" + hex.EncodeToString(spanID[:]) + "-01"
+}
+
+// traceID returns the trace ID part of a traceparent, checking its format.
+func traceID(tp string) (string, error) {
+	parts := strings.Split(tp, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", errors.New("want 00-<32 hex trace id>-<16 hex span id>-<2 hex flags>")
+	}
+	for _, p := range parts[1:] {
+		if _, err := hex.DecodeString(p); err != nil {
+			return "", errors.New("traceparent fields must be hex")
+		}
+	}
+	return parts[1], nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rexlx/bilder/internal/version"
+)
+
+// defaultReleaseRepo is the GitHub repository whose releases self-update
+// installs unless told otherwise.
+const defaultReleaseRepo = "rexlx/bilder"
+
+// clientAsset is the file name of the client for this platform, in GitHub
+// releases and in a server's client directory alike.
+func clientAsset() string {
+	name := "billder_" + runtime.GOOS + "_" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// clientRelease is the newest client available for this platform.
+type clientRelease struct {
+	Version  string
+	Name     string
+	SHA256   string // the published checksum the download must match
+	download func() (*http.Response, error)
+}
+
+// runSelfUpdate implements `client self-update`: it finds the newest
+// release, verifies its sha256 and swaps it in for the running binary,
+// restoring the old one if the new one doesn't start.
+func runSelfUpdate(args []string) {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	source := fs.String("source", "", "Release source: \"github\" or \"server\" (default: server with --url, else github)")
+	githubRepo := fs.String("github-repo", defaultReleaseRepo, "GitHub owner/name whose releases hold billder_<os>_<arch> binaries (GITHUB_TOKEN is used if set)")
+	url := fs.String("url", "", "Billder Service URL hosting the client (server source)")
+	auth := addAuthFlags(fs)
+	tlsOpts := addTLSFlags(fs)
+	check := fs.Bool("check", false, "Only report whether an update is available")
+	force := fs.Bool("force", false, "Install the latest release even if it isn't newer, or over a dev build")
+	fs.Parse(args)
+
+	if *source == "" {
+		*source = "github"
+		if *url != "" {
+			*source = "server"
+		}
+	}
+	httpClient := tlsOpts.Client()
+	var rel clientRelease
+	var err error
+	switch *source {
+	case "github":
+		rel, err = githubRelease(httpClient, *githubRepo)
+	case "server":
+		if *url == "" {
+			printLine("❌ Error: --source server needs --url")
+			exit(exitUsage)
+		}
+		rel, err = serverRelease(httpClient, auth, serviceBase(*url))
+	default:
+		printf("❌ Error: --source must be github or server, got %q\n", *source)
+		exit(exitUsage)
+	}
+	if err != nil {
+		printf("❌ No update found: %v\n", err)
+		exit(exitConnection)
+	}
+
+	current := version.Get().Version
+	switch {
+	case current == rel.Version && !*force:
+		printf("✅ billder %s is the latest version\n", current)
+		exit(exitOK)
+	case current == "dev" && !*force:
+		printf("ℹ️ This is a development build; %s is available. Use --force to replace it\n", rel.Version)
+		exit(exitOK)
+	case !newerVersion(rel.Version, current) && !*force:
+		printf("✅ billder %s is newer than the latest release (%s)\n", current, rel.Version)
+		exit(exitOK)
+	}
+	if *check {
+		printf("⬆️ Update available: %s -> %s (%s)\n", current, rel.Version, *source)
+		exit(exitOK)
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		printf("❌ Can't locate the running binary: %v\n", err)
+		exit(exitBuildFailed)
+	}
+	printf("⬇️ Downloading billder %s (%s)...\n", rel.Version, rel.Name)
+	tmp, err := downloadRelease(rel, filepath.Dir(exe))
+	if errors.Is(err, errChecksumMismatch) {
+		printf("❌ %v\n", err)
+		exit(exitChecksum)
+	} else if err != nil {
+		printf("❌ Download failed: %v\n", err)
+		exit(exitDownload)
+	}
+	printf("🔐 sha256 %s verified\n", rel.SHA256)
+	out, err := replaceExecutable(exe, tmp)
+	if err != nil {
+		printf("❌ Update failed: %v\n", err)
+		exit(exitBuildFailed)
+	}
+	printf("✅ Updated %s: %s", exe, out)
+}
+
+// newerVersion reports whether latest is a later vMAJOR.MINOR.PATCH than
+// current; a release is later than its own pre-releases. Versions that
+// don't parse are only told apart by being different.
+func newerVersion(latest, current string) bool {
+	parse := func(v string) ([3]int, bool, bool) {
+		var n [3]int
+		v, pre, _ := strings.Cut(strings.TrimPrefix(v, "v"), "-")
+		v, _, _ = strings.Cut(v, "+")
+		parts := strings.Split(v, ".")
+		if len(parts) != 3 {
+			return n, false, false
+		}
+		for i, p := range parts {
+			x, err := strconv.Atoi(p)
+			if err != nil {
+				return n, false, false
+			}
+			n[i] = x
+		}
+		return n, pre != "", true
+	}
+	l, lpre, ok1 := parse(latest)
+	c, cpre, ok2 := parse(current)
+	if !ok1 || !ok2 {
+		return latest != current
+	}
+	for i := range l {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return cpre && !lpre
+}
+
+// githubRelease finds this platform's binary and its checksum in the latest
+// release of repo. The checksum comes from <binary>.sha256 or a
+// checksums.txt/SHA256SUMS asset; a release without one is refused.
+func githubRelease(httpClient *http.Client, repo string) (clientRelease, error) {
+	get := func(url, accept string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", accept)
+		req.Header.Set("User-Agent", userAgent)
+		if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := httpClient.Do(req)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: %s", url, resp.Status)
+		}
+		return resp, err
+	}
+
+	resp, err := get("https://api.github.com/repos/"+repo+"/releases/latest", "application/vnd.github+json")
+	if err != nil {
+		return clientRelease{}, err
+	}
+	defer resp.Body.Close()
+	var latest struct {
+		TagName string `json:"tag_name"`
+		Assets  []struct {
+			Name string `json:"name"`
+			URL  string `json:"url"` // the API URL, which also serves private repositories
+		} `json:"assets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&latest); err != nil {
+		return clientRelease{}, fmt.Errorf("invalid release: %w", err)
+	}
+
+	rel := clientRelease{Version: latest.TagName, Name: clientAsset()}
+	assets := map[string]string{}
+	for _, a := range latest.Assets {
+		assets[a.Name] = a.URL
+	}
+	binary, ok := assets[rel.Name]
+	if !ok {
+		return rel, fmt.Errorf("release %s of %s has no %s", latest.TagName, repo, rel.Name)
+	}
+	for _, name := range []string{rel.Name + ".sha256", "checksums.txt", "SHA256SUMS"} {
+		url, ok := assets[name]
+		if !ok {
+			continue
+		}
+		resp, err := get(url, "application/octet-stream")
+		if err != nil {
+			return rel, err
+		}
+		rel.SHA256 = checksumFor(resp.Body, rel.Name)
+		resp.Body.Close()
+		if rel.SHA256 != "" {
+			break
+		}
+	}
+	if rel.SHA256 == "" {
+		return rel, fmt.Errorf("release %s of %s publishes no sha256 for %s", latest.TagName, repo, rel.Name)
+	}
+	rel.download = func() (*http.Response, error) { return get(binary, "application/octet-stream") }
+	return rel, nil
+}
+
+// checksumFor finds name's digest in sha256sum output: "<hex>  <name>"
+// lines, or a lone digest.
+func checksumFor(r io.Reader, name string) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 1 || (len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name) {
+			return strings.ToLower(fields[0])
+		}
+	}
+	return ""
+}
+
+// serverRelease asks a billder server for the client it hosts.
+func serverRelease(httpClient *http.Client, auth *authOptions, base string) (clientRelease, error) {
+	resp, err := send(httpClient, auth, "GET", base, "/client/latest", "", nil)
+	if err != nil {
+		return clientRelease{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return clientRelease{}, errors.New(describeStatus(resp))
+	}
+	var latest struct {
+		Version  string `json:"version"`
+		Binaries []struct {
+			OS     string `json:"os"`
+			Arch   string `json:"arch"`
+			Name   string `json:"name"`
+			SHA256 string `json:"sha256"`
+			URL    string `json:"url"`
+		} `json:"binaries"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&latest); err != nil {
+		return clientRelease{}, fmt.Errorf("invalid release: %w", err)
+	}
+	for _, b := range latest.Binaries {
+		if b.OS != runtime.GOOS || b.Arch != runtime.GOARCH {
+			continue
+		}
+		path := strings.TrimPrefix(b.URL, apiPrefix)
+		return clientRelease{
+			Version: latest.Version,
+			Name:    b.Name,
+			SHA256:  b.SHA256,
+			download: func() (*http.Response, error) {
+				resp, err := send(httpClient, auth, "GET", base, path, "", nil)
+				if err == nil && resp.StatusCode != http.StatusOK {
+					resp.Body.Close()
+					return nil, errors.New(describeStatus(resp))
+				}
+				return resp, err
+			},
+		}, nil
+	}
+	return clientRelease{}, fmt.Errorf("the server hosts billder %s but not for %s/%s", latest.Version, runtime.GOOS, runtime.GOARCH)
+}
+
+// downloadRelease saves rel into dir, next to the binary it replaces so the
+// swap is a rename, and checks it against the published sha256.
+func downloadRelease(rel clientRelease, dir string) (string, error) {
+	resp, err := rel.download()
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	f, err := os.CreateTemp(dir, ".billder-update-*")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, rel.SHA256) {
+			err = fmt.Errorf("%w: %s is published with sha256 %s, the download is %s", errChecksumMismatch, rel.Name, rel.SHA256, sum)
+		}
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o755)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// replaceExecutable moves newBinary over exe, keeping the old binary as
+// exe.old until the new one has run `version`; if it can't, the old one
+// is put back. It returns the new binary's version line.
+func replaceExecutable(exe, newBinary string) (string, error) {
+	old := exe + ".old"
+	os.Remove(old) // left over from an update on windows
+	if err := os.Rename(exe, old); err != nil {
+		os.Remove(newBinary)
+		return "", err
+	}
+	if err := os.Rename(newBinary, exe); err != nil {
+		os.Rename(old, exe)
+		os.Remove(newBinary)
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, exe, "version").CombinedOutput()
+	if err != nil {
+		os.Remove(exe)
+		if rerr := os.Rename(old, exe); rerr != nil {
+			return "", fmt.Errorf("the new binary doesn't run (%v), and restoring %s failed: %v", err, old, rerr)
+		}
+		return "", fmt.Errorf("the new binary doesn't run (%v: %s); the previous version was restored", err, lastOutputLine(out))
+	}
+	// Windows can't delete a running binary; the next update removes it
+	os.Remove(old)
+	return lastOutputLine(out) + "\n", nil
+}
+
+func lastOutputLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestNewerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		latest, current string
+		newer           bool
+	}{
+		{"v1.4.0", "v1.3.9", true},
+		{"v1.10.0", "v1.9.0", true},
+		{"v2.0.0", "v1.99.99", true},
+		{"v1.4.0", "v1.4.0", false},
+		{"v1.3.0", "v1.4.0", false},
+		{"v1.4.0", "v1.4.0-rc.1", true},
+		{"v1.4.0-rc.2", "v1.4.0", false},
+		{"1.4.1", "v1.4.0", true},
+		{"v1.4.0+build.5", "v1.4.0", false},
+		{"nightly", "v1.4.0", true},
+		{"nightly", "nightly", false},
+	} {
+		if got := newerVersion(tc.latest, tc.current); got != tc.newer {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", tc.latest, tc.current, got, tc.newer)
+		}
+	}
+}
+
+func TestChecksumFor(t *testing.T) {
+	const sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	for _, tc := range []struct {
+		name, file, want string
+	}{
+		{"lone digest", sum + "\n", sum},
+		{"sha256sum line", sum + "  billder_linux_amd64\n", sum},
+		{"binary mode", strings.ToUpper(sum) + " *billder_linux_amd64\n", sum},
+		{"among others", "0000  billder_darwin_arm64\n" + sum + "  billder_linux_amd64\n", sum},
+		{"not listed", sum + "  billder_darwin_arm64\n", ""},
+		{"empty", "", ""},
+	} {
+		if got := checksumFor(strings.NewReader(tc.file), "billder_linux_amd64"); got != tc.want {
+			t.Errorf("%s: checksumFor = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// redirectTransport sends every request to srv, whatever its host, so the
+// GitHub source can run against a stub API.
+type redirectTransport struct{ srv *httptest.Server }
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, _ := url.Parse(rt.srv.URL)
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// stubGitHub serves a latest release of acme/billder with the given assets,
+// name -> content.
+func stubGitHub(t *testing.T, assets map[string]string) *http.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer gh-token" {
+			t.Errorf("%s sent Authorization %q", r.URL.Path, got)
+		}
+		if r.URL.Path == "/repos/acme/billder/releases/latest" {
+			type asset struct {
+				Name string `json:"name"`
+				URL  string `json:"url"`
+			}
+			release := struct {
+				TagName string  `json:"tag_name"`
+				Assets  []asset `json:"assets"`
+			}{TagName: "v1.4.0"}
+			for name := range assets {
+				release.Assets = append(release.Assets, asset{name, "https://api.github.com/repos/acme/billder/releases/assets/" + name})
+			}
+			json.NewEncoder(w).Encode(release)
+			return
+		}
+		name, ok := strings.CutPrefix(r.URL.Path, "/repos/acme/billder/releases/assets/")
+		if content, found := assets[name]; ok && found {
+			if r.Header.Get("Accept") != "application/octet-stream" {
+				t.Errorf("asset %s requested as %q", name, r.Header.Get("Accept"))
+			}
+			w.Write([]byte(content))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("GITHUB_TOKEN", "gh-token")
+	return &http.Client{Transport: redirectTransport{srv}}
+}
+
+func hexSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestGithubRelease(t *testing.T) {
+	const binary = "#!/bin/sh\necho new\n"
+	name := clientAsset()
+	for _, tc := range []struct {
+		test   string
+		assets map[string]string
+		err    string // in the lookup error, if it fails
+		sha256 string
+	}{
+		{"sidecar", map[string]string{name: binary, name + ".sha256": hexSHA256(binary) + "\n"}, "", hexSHA256(binary)},
+		{"checksums.txt", map[string]string{
+			name:            binary,
+			"billder_x_y":   "other",
+			"checksums.txt": hexSHA256("other") + "  billder_x_y\n" + hexSHA256(binary) + "  " + name + "\n",
+		}, "", hexSHA256(binary)},
+		{"SHA256SUMS after a list without it", map[string]string{
+			name:            binary,
+			"checksums.txt": hexSHA256("other") + "  billder_x_y\n",
+			"SHA256SUMS":    hexSHA256(binary) + " *" + name + "\n",
+		}, "", hexSHA256(binary)},
+		{"no checksum", map[string]string{name: binary}, "publishes no sha256", ""},
+		{"no binary for this platform", map[string]string{"billder_plan9_mips": binary}, "has no " + name, ""},
+		{"wrong checksum", map[string]string{name: binary, name + ".sha256": hexSHA256("tampered")}, "", hexSHA256("tampered")},
+	} {
+		t.Run(tc.test, func(t *testing.T) {
+			rel, err := githubRelease(stubGitHub(t, tc.assets), "acme/billder")
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("lookup error %v, want one about %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rel.Version != "v1.4.0" || rel.Name != name || rel.SHA256 != tc.sha256 {
+				t.Errorf("release %s %s %s, want v1.4.0 %s %s", rel.Version, rel.Name, rel.SHA256, name, tc.sha256)
+			}
+
+			dir := t.TempDir()
+			path, err := downloadRelease(rel, dir)
+			if tc.sha256 != hexSHA256(binary) {
+				if !errors.Is(err, errChecksumMismatch) {
+					t.Fatalf("download error %v, want a checksum mismatch", err)
+				}
+				if left, _ := os.ReadDir(dir); len(left) != 0 {
+					t.Errorf("a mismatched download was left behind: %v", left)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile(path)
+			if string(got) != binary {
+				t.Errorf("downloaded %q, want %q", got, binary)
+			}
+			if info, _ := os.Stat(path); runtime.GOOS != "windows" && info.Mode().Perm()&0o100 == 0 {
+				t.Errorf("downloaded binary isn't executable: %v", info.Mode())
+			}
+		})
+	}
+}
+
+// The server source reads GET /v1/client/latest and downloads from the URL
+// it lists for this platform.
+func TestServerRelease(t *testing.T) {
+	const binary = "MZ new client"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Billder-Token") != "secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/client/latest":
+			w.Write([]byte(`{"version":"v1.5.0","binaries":[` +
+				`{"os":"plan9","arch":"mips","name":"billder_plan9_mips","sha256":"00","url":"/v1/client/latest/plan9/mips"},` +
+				`{"os":"` + runtime.GOOS + `","arch":"` + runtime.GOARCH + `","name":"` + clientAsset() + `","sha256":"` + hexSHA256(binary) + `","url":"/v1/client/latest/` + runtime.GOOS + `/` + runtime.GOARCH + `"}]}`))
+		case "/v1/client/latest/" + runtime.GOOS + "/" + runtime.GOARCH:
+			w.Write([]byte(binary))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	auth := addAuthFlags(flag.NewFlagSet("self-update", flag.ContinueOnError))
+	*auth.token = "secret"
+	rel, err := serverRelease(srv.Client(), auth, serviceBase(srv.URL+"/v1/build"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Version != "v1.5.0" || rel.Name != clientAsset() || rel.SHA256 != hexSHA256(binary) {
+		t.Errorf("release %+v", rel)
+	}
+	path, err := downloadRelease(rel, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != binary {
+		t.Errorf("downloaded %q, want %q", got, binary)
+	}
+
+	*auth.token = "wrong"
+	if _, err := serverRelease(srv.Client(), auth, srv.URL); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("lookup with a bad token: %v", err)
+	}
+}
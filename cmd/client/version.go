@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/rexlx/bilder/internal/version"
+)
+
+// userAgent identifies the client to the server, e.g. in its logs.
+var userAgent = version.Product("billder-client")
+
+// runVersion implements `client version` and --version.
+func runVersion() {
+	printf("billder %s\n", version.Get())
+}
+
+// checkProtocol warns when the server's API major version, from
+// /capabilities, isn't the one this client speaks. Requests still go out:
+// the server may keep serving older clients.
+func checkProtocol(serverAPI string) {
+	major := func(v string) string {
+		m, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(v, "/"), "v"), ".")
+		return m
+	}
+	if serverAPI != "" && major(serverAPI) != major(apiPrefix) {
+		printf("⚠️ The server speaks API %s but this client speaks %s; if requests fail, update with `billder self-update`\n", serverAPI, strings.TrimPrefix(apiPrefix, "/"))
+	}
+}
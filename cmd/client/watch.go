@@ -0,0 +1,279 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Resolution mirrors the server's /v1/resolve response.
+type Resolution struct {
+	Repo   string `json:"repo"`
+	Ref    string `json:"ref"`
+	Commit string `json:"commit"`
+}
+
+// watchDirPattern names the directories watch saves builds in,
+// <UTC time>_<short commit>, so they sort oldest first.
+var watchDirPattern = regexp.MustCompile(`^\d{8}-\d{6}_[0-9a-f]{7}$`)
+
+// runWatch implements `client watch`: it polls the commit a ref points at
+// and, whenever it moves, builds it and saves the artifact in a dated
+// directory, keeping the newest few.
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	serverURL := fs.String("url", "", "Billder Service URL")
+	auth := addAuthFlags(fs)
+	tlsOpts := addTLSFlags(fs)
+	repo := fs.String("repo", "", "Repository to watch (e.g. github.com/acme/app)")
+	ref := fs.String("ref", "", "Branch, tag or pull request ref to follow (default: the default branch)")
+	target := fs.String("target", "windows/amd64", "os/arch to build")
+	interval := fs.Duration("interval", 5*time.Minute, "How often to check the ref")
+	keep := fs.Int("keep", 5, "Builds to keep; older ones are removed")
+	dir := fs.String("dir", "builds", "Directory the dated build directories go in")
+	onInterrupt := fs.String("on-interrupt", "finish", "Ctrl-C during a build: \"finish\" waits for it and its download, \"cancel\" stops waiting at once")
+	verbose := fs.Bool("verbose", false, "Show all server log lines")
+	fs.Parse(args)
+
+	if *serverURL == "" || *repo == "" || fs.NArg() != 0 {
+		printLine("❌ Error: usage: client watch --url URL --repo REPO [--ref REF] [--interval 5m]")
+		exit(exitUsage)
+	}
+	if *onInterrupt != "finish" && *onInterrupt != "cancel" {
+		printLine("❌ Error: --on-interrupt must be finish or cancel")
+		exit(exitUsage)
+	}
+	if *interval < 30*time.Second || *keep < 1 || !strings.Contains(*target, "/") {
+		printLine("❌ Error: --interval must be at least 30s, --keep at least 1 and --target os/arch")
+		exit(exitUsage)
+	}
+
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Requests go through ctx so "cancel" can drop a build's stream
+	httpClient := tlsOpts.Client()
+	httpClient.Transport = contextTransport{ctx: ctx, base: cmp.Or[http.RoundTripper](httpClient.Transport, http.DefaultTransport)}
+
+	w := watcher{
+		httpClient: httpClient,
+		auth:       auth,
+		base:       serviceBase(*serverURL),
+		repo:       *repo,
+		ref:        *ref,
+		dir:        *dir,
+		build: fanOut{
+			httpClient: httpClient,
+			auth:       auth,
+			base:       serviceBase(*serverURL),
+			payload:    RequestPayload{RepoURL: *repo, Color: "strip"},
+			verbose:    *verbose,
+			checksums:  true,
+		},
+	}
+	last := w.newest()
+	printf("👀 Watching %s@%s every %s for %s builds in %s\n", *repo, cmp.Or(*ref, "HEAD"), *interval, *target, *dir)
+	if last != "" {
+		printf("📁 Newest kept build: %s\n", last)
+	}
+
+	for {
+		commit, wait, err := w.resolve()
+		switch {
+		case err != nil:
+			printf("⚠️ %v\n", err)
+		case !strings.HasPrefix(commit, lastCommit(last)) || last == "":
+			done := make(chan watchBuild, 1)
+			go func() { done <- w.run(commit, *target) }()
+			var b watchBuild
+			select {
+			case b = <-done:
+			case <-interrupts:
+				if *onInterrupt == "cancel" {
+					cancel()
+					printLine("\n🛑 Stopped waiting; the server finishes the build on its own.")
+					exit(exitOK)
+				}
+				printLine("\n⏳ Finishing the build in progress; Ctrl-C again to stop waiting.")
+				select {
+				case b = <-done:
+					w.report(b, *keep)
+				case <-interrupts:
+				}
+				exit(exitOK)
+			}
+			if w.report(b, *keep) {
+				last = b.name
+			}
+		}
+
+		select {
+		case <-time.After(max(wait, *interval)):
+		case <-interrupts:
+			printLine("\n👋 Stopped watching.")
+			exit(exitOK)
+		}
+	}
+}
+
+// watcher polls a ref and builds each new commit of it.
+type watcher struct {
+	httpClient *http.Client
+	auth       *authOptions
+	base       string
+	repo, ref  string
+	dir        string
+	build      fanOut // its single-target build and download
+
+	etag string // of the last resolve answer, for a cheap 304
+	seen string // the commit it named
+}
+
+// watchBuild is one build of a new commit.
+type watchBuild struct {
+	name   string // its dated directory
+	commit string
+	result fanOutResult
+}
+
+// resolve asks the server which commit the ref points at. wait is how long
+// the server asked it to back off.
+func (w *watcher) resolve() (commit string, wait time.Duration, err error) {
+	q := url.Values{"repo": {w.repo}}
+	if w.ref != "" {
+		q.Set("ref", w.ref)
+	}
+	header := http.Header{}
+	if w.etag != "" {
+		header.Set("If-None-Match", w.etag)
+	}
+	resp, err := sendHeader(w.httpClient, w.auth, "GET", w.base, "/resolve?"+q.Encode(), "", header, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("checking %s failed: %w", w.repo, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return w.seen, 0, nil
+	case http.StatusTooManyRequests:
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return "", time.Duration(seconds) * time.Second, fmt.Errorf("checking %s: %s", w.repo, describeStatus(resp))
+	case http.StatusNotFound:
+		return "", 0, fmt.Errorf("%s has no ref %s, or the server has no /resolve", w.repo, cmp.Or(w.ref, "HEAD"))
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", 0, fmt.Errorf("checking %s: %s %s", w.repo, describeStatus(resp), strings.TrimSpace(string(msg)))
+	}
+	var r Resolution
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || r.Commit == "" {
+		return "", 0, fmt.Errorf("checking %s: unexpected answer from the server", w.repo)
+	}
+	w.etag, w.seen = resp.Header.Get("ETag"), r.Commit
+	return r.Commit, 0, nil
+}
+
+// run builds commit for target into a new dated directory.
+func (w *watcher) run(commit, target string) watchBuild {
+	b := watchBuild{name: time.Now().UTC().Format("20060102-150405") + "_" + commit[:7], commit: commit}
+	printf("\n🔄 %s is at %s; building...\n", cmp.Or(w.ref, "HEAD"), commit[:7])
+	f := w.build
+	f.payload.Ref = commit // exactly the commit seen, even if the ref moves again
+	f.template = filepath.Join(w.dir, b.name, "{file}")
+	b.result = f.build(target)
+	return b
+}
+
+// report prints a build's outcome and, once one succeeds, removes all but
+// the newest keep builds. It reports whether the commit is done with: a
+// build that failed is only retried once the ref moves again, but one the
+// server never got is retried at the next check.
+func (w *watcher) report(b watchBuild, keep int) bool {
+	r := b.result
+	switch {
+	case r.err == nil:
+		printf("✨ Saved %s (%d bytes)\n", r.summary.label(r.file), r.size)
+		w.prune(keep)
+		return true
+	case r.code == exitConnection:
+		printf("⚠️ %s: %v; retrying at the next check\n", b.commit[:7], r.err)
+		os.RemoveAll(filepath.Join(w.dir, b.name))
+		return false
+	default:
+		printf("❌ %s: build failed: %v\n", b.commit[:7], r.err)
+		if hint := endHint(r.reason, r.category); hint != "" {
+			printf("%s\n", hint)
+		}
+		if r.summary.LogURL != "" {
+			printf("📜 Full build log: %s%s\n", w.base, r.summary.LogURL)
+		}
+		os.RemoveAll(filepath.Join(w.dir, b.name))
+		return true
+	}
+}
+
+// builds lists the dated build directories, oldest first.
+func (w *watcher) builds() []string {
+	entries, _ := os.ReadDir(w.dir)
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && watchDirPattern.MatchString(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// newest is the newest kept build's directory name, or "".
+func (w *watcher) newest() string {
+	names := w.builds()
+	if len(names) == 0 {
+		return ""
+	}
+	return names[len(names)-1]
+}
+
+// prune removes all but the newest keep builds.
+func (w *watcher) prune(keep int) {
+	names := w.builds()
+	for _, name := range names[:max(0, len(names)-keep)] {
+		if err := os.RemoveAll(filepath.Join(w.dir, name)); err != nil {
+			printf("⚠️ Could not remove %s: %v\n", name, err)
+			continue
+		}
+		printf("🧹 Removed %s\n", name)
+	}
+}
+
+// lastCommit is the short commit a build directory is named after.
+func lastCommit(name string) string {
+	_, commit, _ := strings.Cut(name, "_")
+	return commit
+}
+
+// contextTransport ties every request to ctx, so cancelling it drops
+// whatever is in flight.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
@@ -0,0 +1,170 @@
+// Package docfile decodes the small JSON or YAML documents billder reads
+// from disk (build requests, server config) into structs, rejecting unknown
+// keys and naming the file, line and key of any problem.
+package docfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Decode reads data, a JSON object or flat YAML document named path, into v.
+// YAML is assumed unless the document is a JSON object and path doesn't end
+// in .yaml or .yml.
+func Decode(path string, data []byte, v any) error {
+	lines, data, err := toJSON(path, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		key := ""
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			key = typeErr.Field
+			err = fmt.Errorf("%q must be a %s, got %s", key, typeErr.Type, typeErr.Value)
+		} else if quoted, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			key, _ = strconv.Unquote(quoted)
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if line, ok := lines[key]; ok {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Line returns the line key is defined on in a document, or 0, so callers
+// validating decoded values can point at the offending line.
+func Line(path string, data []byte, key string) int {
+	lines, _, _ := toJSON(path, data)
+	return lines[key]
+}
+
+// toJSON converts a YAML document to JSON, leaving JSON as is, and records
+// the line of each top-level key.
+func toJSON(path string, data []byte) (map[string]int, []byte, error) {
+	lines := map[string]int{}
+	trimmed := bytes.TrimSpace(data)
+	if !strings.HasSuffix(path, ".yaml") && !strings.HasSuffix(path, ".yml") && bytes.HasPrefix(trimmed, []byte("{")) {
+		for i, line := range strings.Split(string(data), "\n") {
+			if key, _, ok := strings.Cut(strings.TrimSpace(line), `":`); ok && strings.HasPrefix(key, `"`) {
+				if _, seen := lines[key[1:]]; !seen {
+					lines[key[1:]] = i + 1
+				}
+			}
+		}
+		return lines, data, nil
+	}
+	doc, err := parseYAML(data, lines)
+	if err != nil {
+		return lines, nil, err
+	}
+	data, err = json.Marshal(doc)
+	return lines, data, err
+}
+
+// parseYAML handles the flat subset of YAML these documents need: scalar
+// keys, [flow] lists and "- item" block lists, and # comments. lines
+// records where each key was defined.
+func parseYAML(data []byte, lines map[string]int) (map[string]any, error) {
+	doc := map[string]any{}
+	var listKey string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := stripComment(scanner.Text())
+		if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "---" {
+			continue
+		}
+
+		if item, ok := strings.CutPrefix(strings.TrimSpace(line), "- "); ok {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item outside a list", n)
+			}
+			doc[listKey] = append(doc[listKey].([]any), yamlScalar(item))
+			continue
+		}
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			return nil, fmt.Errorf("line %d: nested mappings are not supported", n)
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", n)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if _, dup := lines[key]; dup {
+			return nil, fmt.Errorf("line %d: %q defined twice", n, key)
+		}
+		lines[key] = n
+		listKey = ""
+		switch {
+		case value == "":
+			// A block list follows
+			listKey = key
+			doc[key] = []any{}
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			items := []any{}
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, yamlScalar(item))
+				}
+			}
+			doc[key] = items
+		default:
+			doc[key] = yamlScalar(value)
+		}
+	}
+	return doc, scanner.Err()
+}
+
+// stripComment drops a trailing # comment outside of quotes.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func yamlScalar(s string) any {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		if s[0] == '"' {
+			if unq, err := strconv.Unquote(s); err == nil {
+				return unq
+			}
+		}
+		return s[1 : len(s)-1]
+	}
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null", "~":
+		return nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+	return s
+}
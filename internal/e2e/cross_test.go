@@ -0,0 +1,10 @@
+//go:build cross
+
+package e2e
+
+import "testing"
+
+// The cross tag adds builds that need the mingw toolchain.
+func TestBuildWindowsCgo(t *testing.T) {
+	checkPE(t, build(t, serve(t), "windows/amd64", true))
+}
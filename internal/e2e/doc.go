@@ -0,0 +1,10 @@
+// Package e2e tests the full /v1/build pipeline against a throwaway git
+// repository on disk, so the server can be exercised without network
+// access or a GitHub repo:
+//
+//	go test ./internal/e2e
+//	go test -tags cross ./internal/e2e   # also cgo cross-compiles (needs mingw)
+//
+// The tests check the SSE event sequence and that the returned artifact is
+// a binary for the requested target, running it when it's native.
+package e2e
@@ -0,0 +1,259 @@
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rexlx/bilder/pkg/server"
+)
+
+const fixtureOutput = "billder fixture ok"
+
+var (
+	setupOnce sync.Once
+	setupErr  error
+	baseURL   string
+	tmpDir    string
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if tmpDir != "" {
+		os.RemoveAll(tmpDir)
+	}
+	os.Exit(code)
+}
+
+// serve starts the server against the fixture repository the first time a
+// test needs it, and returns its URL. The server is shared: a process
+// serves one handler.
+func serve(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("end-to-end builds are slow")
+	}
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("the harness runs on linux/amd64 hosts only")
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	setupOnce.Do(func() {
+		if tmpDir, setupErr = os.MkdirTemp("", "billder-e2e-*"); setupErr != nil {
+			return
+		}
+		if setupErr = setup(tmpDir); setupErr != nil {
+			return
+		}
+		var handler *server.Server
+		handler, setupErr = server.New(
+			server.WithDataDir(filepath.Join(tmpDir, "data")),
+			server.WithHistoryFile(filepath.Join(tmpDir, "history.json")),
+		)
+		if setupErr != nil {
+			return
+		}
+		srv := httptest.NewServer(handler)
+		baseURL = srv.URL
+	})
+	if setupErr != nil {
+		t.Fatalf("setup: %v", setupErr)
+	}
+	return baseURL
+}
+
+// setup creates the fixture repository and points https://fixture.test/ at
+// it through a private git config.
+func setup(tmp string) error {
+	repo := filepath.Join(tmp, "repos", "hello")
+	if err := os.MkdirAll(repo, 0o755); err != nil {
+		return err
+	}
+	files := map[string]string{
+		"go.mod":  "module fixture.test/hello\n\ngo 1.21\n",
+		"main.go": "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(\"" + fixtureOutput + "\") }\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(content), 0o644); err != nil {
+			return err
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=e2e", "-c", "user.email=e2e@example.invalid", "commit", "-q", "-m", "fixture"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s: %v: %s", args[0], err, out)
+		}
+	}
+
+	gitconfig := filepath.Join(tmp, "gitconfig")
+	conf := fmt.Sprintf("[url \"file://%s/\"]\n\tinsteadOf = https://fixture.test/\n", filepath.Join(tmp, "repos"))
+	if err := os.WriteFile(gitconfig, []byte(conf), 0o644); err != nil {
+		return err
+	}
+	os.Setenv("GIT_CONFIG_GLOBAL", gitconfig)
+	os.Setenv("GOPROXY", "off")
+	os.Setenv("GOFLAGS", "-mod=mod")
+	return nil
+}
+
+func TestBuildNative(t *testing.T) {
+	artifact := build(t, serve(t), "linux/amd64", false)
+	out, err := exec.Command(artifact).Output()
+	if err != nil {
+		t.Fatalf("running artifact: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != fixtureOutput {
+		t.Errorf("artifact printed %q, want %q", got, fixtureOutput)
+	}
+}
+
+// Without cgo a windows binary needs no C toolchain.
+func TestBuildWindowsWithoutCgo(t *testing.T) {
+	checkPE(t, build(t, serve(t), "windows/amd64", false))
+}
+
+// checkPE fails unless the file at path is a windows executable.
+func checkPE(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("MZ")) {
+		t.Errorf("%s is not a PE executable", path)
+	}
+}
+
+// build requests one target, checks the stream and returns the path the
+// artifact was saved to.
+func build(t *testing.T, base, target string, cgo bool) string {
+	t.Helper()
+	goos, goarch, _ := strings.Cut(target, "/")
+	body, _ := json.Marshal(map[string]any{"repo_url": "fixture.test/hello", "target_os": goos, "target_arch": goarch, "cgo": cgo})
+	resp, err := http.Post(base+"/v1/build", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s: %s", resp.Status, msg)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	events, filename, err := readEvents(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSequence(t, events)
+	if filename == "" {
+		t.Fatalf("no artifact; events: %v", events)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading artifact: %v", err)
+	}
+	artifact := filepath.Join(t.TempDir(), filename)
+	if err := os.WriteFile(artifact, data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return artifact
+}
+
+type event struct {
+	name string
+	data string
+}
+
+func (e event) String() string { return e.name }
+
+// readEvents consumes SSE blocks until binary_start, returning the artifact name.
+func readEvents(reader *bufio.Reader) ([]event, string, error) {
+	var events []event
+	name := "message"
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return events, "", nil
+		} else if err != nil {
+			return events, "", err
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			name = "message"
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := strings.TrimPrefix(line, "data: ")
+			if name == "binary_start" {
+				reader.ReadString('\n') // blank line before the raw bytes
+				return events, data, nil
+			}
+			events = append(events, event{name, data})
+		}
+	}
+}
+
+// checkSequence verifies the stream opens with the session, steps 1..3
+// arrive in order and the build succeeded.
+func checkSequence(t *testing.T, events []event) {
+	t.Helper()
+	if len(events) == 0 || events[0].name != "session" {
+		t.Fatalf("stream doesn't open with a session event: %v", events)
+	}
+	next := 1
+	var summary struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	sawSummary := false
+	for _, e := range events {
+		switch e.name {
+		case "step":
+			var s server.Step
+			if err := json.Unmarshal([]byte(e.data), &s); err != nil {
+				t.Fatalf("bad step event %q: %v", e.data, err)
+			}
+			if s.Index != next {
+				t.Fatalf("step %d arrived, want %d", s.Index, next)
+			}
+			next++
+		case "summary":
+			sawSummary = true
+			if err := json.Unmarshal([]byte(e.data), &summary); err != nil {
+				t.Fatalf("bad summary %q: %v", e.data, err)
+			}
+		case "status":
+			var s server.Status
+			if json.Unmarshal([]byte(e.data), &s) == nil && strings.HasPrefix(s.Message, "Error") {
+				t.Fatalf("server reported %q", s.Message)
+			}
+		}
+	}
+	switch {
+	case next != 4:
+		t.Fatalf("saw %d of 3 steps; events: %v", next-1, events)
+	case !sawSummary:
+		t.Fatalf("no summary event; events: %v", events)
+	case !summary.OK:
+		t.Fatalf("summary reports failure: %s", summary.Error)
+	}
+}
@@ -0,0 +1,76 @@
+// Package version identifies a billder binary, server or client. The values
+// are stamped at build time:
+//
+//	go build -ldflags "-X github.com/rexlx/bilder/internal/version.version=v1.4.0
+//	  -X github.com/rexlx/bilder/internal/version.commit=$(git rev-parse HEAD)
+//	  -X github.com/rexlx/bilder/internal/version.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/...
+//
+// Unstamped builds fall back to what the Go toolchain recorded: the module
+// version of `go install ...@v1.4.0`, and the VCS revision and commit time.
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+var version, commit, date string
+
+// Info is a binary's version, served by the server as GET /version.
+type Info struct {
+	Version  string `json:"version"` // "dev" when unknown
+	Commit   string `json:"commit,omitempty"`
+	Date     string `json:"date,omitempty"` // build or commit time, RFC 3339
+	Go       string `json:"go"`
+	Platform string `json:"platform"` // os/arch
+}
+
+// Get returns the version of the running binary.
+var Get = sync.OnceValue(func() Info {
+	info := Info{Version: version, Commit: commit, Date: date, Go: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Date == "":
+				info.Date = s.Value
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+})
+
+// ShortCommit is the first 12 characters of the commit.
+func (i Info) ShortCommit() string {
+	if len(i.Commit) > 12 {
+		return i.Commit[:12]
+	}
+	return i.Commit
+}
+
+// String reads like "v1.4.0 (commit 0123456789ab, 2026-10-16T09:00:00Z,
+// go1.25.0, linux/amd64)".
+func (i Info) String() string {
+	s := i.Version + " ("
+	if i.Commit != "" {
+		s += "commit " + i.ShortCommit() + ", "
+	}
+	if i.Date != "" {
+		s += i.Date + ", "
+	}
+	return s + i.Go + ", " + i.Platform + ")"
+}
+
+// Product is the version as an HTTP product token, for the client's
+// User-Agent and the server's Server header: "billder-client/v1.4.0".
+func Product(name string) string {
+	return name + "/" + Get().Version
+}
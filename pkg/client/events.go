@@ -0,0 +1,84 @@
+package client
+
+import (
+	"encoding/json"
+	"slices"
+)
+
+// StreamSchema is the version of the build event stream this package reads:
+// the named events, their data fields and what those mean. Servers announce
+// theirs as "schema" in the session event and "stream_schema" in
+// /v1/capabilities; those that don't speak schema 1.
+//
+// Adding an event or a field doesn't change it, since readers skip events
+// they don't know and ignore fields they don't expect. Removing or renaming
+// either, or changing what a field means, must bump it, along with the
+// defaults below for the fields older servers leave out.
+//
+// Schema 2 sends billder's own messages as "status" events, leaving
+// unnamed data lines to servers of schema 1.
+const StreamSchema = 2
+
+// Events are the named events of StreamSchema. Unnamed events are the
+// messages of schema 1 servers.
+var Events = []string{
+	"session", "job", "status", "step", "progress", "diagnostic", "output", "summary",
+	"matrix_summary", "dry_run", "end", "modules", "report", "binary_start",
+}
+
+// KnownEvent reports whether event is one of Events, or unnamed. Others come
+// from newer servers and are best skipped, data and all.
+func KnownEvent(event string) bool {
+	return event == "" || slices.Contains(Events, event)
+}
+
+// defaults fill in the data fields of an event that older servers leave
+// out, given the fields that are there.
+var defaults = map[string]func(fields map[string]any){
+	"session": func(f map[string]any) {
+		setDefault(f, "schema", 1)
+		setDefault(f, "protocol", "v1")
+	},
+	"output": func(f map[string]any) {
+		setDefault(f, "stream", "stdout")
+	},
+	"summary": func(f map[string]any) {
+		if ok, _ := f["ok"].(bool); !ok {
+			setDefault(f, "error_category", "internal")
+		}
+	},
+	"end": func(f map[string]any) {
+		if ok, _ := f["ok"].(bool); ok {
+			setDefault(f, "reason", "completed")
+		} else {
+			setDefault(f, "reason", "error")
+			setDefault(f, "error_category", "internal")
+		}
+	},
+}
+
+func setDefault(fields map[string]any, key string, value any) {
+	if v, ok := fields[key]; !ok || v == nil || v == "" {
+		fields[key] = value
+	}
+}
+
+// DecodeEvent unmarshals the data of a named event into v, filling in the
+// fields an older server left out with their defaults. Fields v has no
+// place for are ignored.
+func DecodeEvent(event string, data []byte, v any) error {
+	fill, ok := defaults[event]
+	if !ok {
+		return json.Unmarshal(data, v)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return json.Unmarshal(data, v) // not an object; let v say what's wrong
+	}
+	fill(fields)
+	filled, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(filled, v)
+}
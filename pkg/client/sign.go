@@ -0,0 +1,37 @@
+// Package client contains the pieces of the billder client protocol that
+// programmatic users need, starting with HMAC request signing.
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers carrying a signed request.
+const (
+	HeaderKeyID     = "X-Billder-Key-Id"
+	HeaderTimestamp = "X-Billder-Timestamp"
+	HeaderSignature = "X-Billder-Signature"
+)
+
+// Signature is the hex HMAC-SHA256 of timestamp, method, path and body,
+// newline separated, keyed with the shared secret.
+func Signature(secret string, timestamp int64, method, path string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "\n" + method + "\n" + path + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign adds signing headers to req for the given key. body must be exactly
+// what will be sent as the request body.
+func Sign(req *http.Request, keyID, secret string, body []byte) {
+	ts := time.Now().Unix()
+	req.Header.Set(HeaderKeyID, keyID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderSignature, Signature(secret, ts, req.Method, req.URL.Path, body))
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// androidAPI is the minimum API level APKs are built for.
+const androidAPI = "21"
+
+// AndroidToolchain is what this server found for android builds at
+// startup, served in /v1/capabilities.
+type AndroidToolchain struct {
+	Installed  bool     `json:"installed"`
+	SDK        string   `json:"sdk,omitempty"` // ANDROID_HOME
+	NDK        string   `json:"ndk,omitempty"`
+	BuildTools string   `json:"build_tools,omitempty"` // holds zipalign and apksigner
+	Packagers  []string `json:"packagers,omitempty"`   // fyne and/or gomobile
+	Signing    string   `json:"signing"`               // "release" with a configured keystore, else "debug"
+	Missing    []string `json:"missing,omitempty"`
+}
+
+// android is set by New.
+var android AndroidToolchain
+
+// detectAndroid looks for the SDK, the NDK and a packager, so requests for
+// android targets can be turned away up front when something is missing.
+func detectAndroid() AndroidToolchain {
+	a := AndroidToolchain{SDK: os.Getenv("ANDROID_HOME"), NDK: os.Getenv("ANDROID_NDK_HOME"), Signing: "debug"}
+	if a.SDK == "" {
+		a.SDK = os.Getenv("ANDROID_SDK_ROOT")
+	}
+	if !isDir(a.SDK) {
+		a.SDK = ""
+		a.Missing = append(a.Missing, "Android SDK (ANDROID_HOME)")
+	}
+	if a.NDK == "" && a.SDK != "" {
+		a.NDK = newestDir(filepath.Join(a.SDK, "ndk"))
+	}
+	if !isDir(a.NDK) {
+		a.NDK = ""
+		a.Missing = append(a.Missing, "Android NDK (ANDROID_NDK_HOME)")
+	}
+	if fyneCLI() != "" {
+		a.Packagers = append(a.Packagers, "fyne")
+	}
+	if _, err := exec.LookPath("gomobile"); err == nil {
+		a.Packagers = append(a.Packagers, "gomobile")
+	}
+	if len(a.Packagers) == 0 {
+		a.Missing = append(a.Missing, "fyne or gomobile")
+	}
+	if cfg.AndroidKeystore != "" {
+		a.Signing = "release"
+		if a.SDK != "" {
+			a.BuildTools = newestDir(filepath.Join(a.SDK, "build-tools"))
+		}
+		if a.BuildTools == "" {
+			a.Missing = append(a.Missing, "SDK build-tools for release signing")
+		}
+	}
+	a.Installed = len(a.Missing) == 0
+	return a
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return path != "" && err == nil && info.IsDir()
+}
+
+// newestDir returns the last versioned subdirectory of dir, or "".
+func newestDir(dir string) string {
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	slices.SortFunc(names, compareVersions)
+	return filepath.Join(dir, names[len(names)-1])
+}
+
+// compareVersions orders dotted version numbers like 26.3.11579264.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := len(as[i]) - len(bs[i]); c != 0 {
+			return c
+		}
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// ndkClang is the NDK's C compiler for arm64 at androidAPI.
+func ndkClang() string {
+	cc := "aarch64-linux-android" + androidAPI + "-clang"
+	if android.NDK == "" {
+		return cc
+	}
+	return filepath.Join(android.NDK, "toolchains", "llvm", "prebuilt", "linux-x86_64", "bin", cc)
+}
+
+// packagerFor is the packager of one target. Android targets are always
+// packaged: with fyne for Fyne apps, gomobile otherwise.
+func (j *buildJob) packagerFor(tc Toolchain) string {
+	if tc.GOOS != "android" || j.packager == "fyne" {
+		return j.packager
+	}
+	return "gomobile"
+}
+
+// gomobileArgs are the arguments to gomobile for an APK at output.
+func gomobileArgs(tc Toolchain, output string, p RequestPayload) []string {
+	args := []string{"build", "-target", tc.GOOS + "/" + tc.GOARCH, "-androidapi", androidAPI, "-o", output}
+	if !p.Debug {
+		args = append(args, "-ldflags", "-s -w")
+	}
+	return append(args, ".")
+}
+
+// signAPK replaces the packager's debug signature with the configured
+// release keystore's. The password reaches apksigner through the
+// environment, never the command line.
+func (j *buildJob) signAPK(apk string) error {
+	aligned := apk + ".aligned"
+	align := exec.CommandContext(j.ctx, filepath.Join(android.BuildTools, "zipalign"), "-f", "-p", "4", apk, aligned)
+	out, err := align.CombinedOutput()
+	j.log.Command("", align, out, err)
+	if err != nil {
+		return errors.New("zipalign failed: " + lastLine(string(out)))
+	}
+	sign := exec.CommandContext(j.ctx, filepath.Join(android.BuildTools, "apksigner"), "sign",
+		"--ks", cfg.AndroidKeystore, "--ks-pass", "env:BILLDER_KEYSTORE_PASS", "--ks-key-alias", cfg.AndroidKeyAlias,
+		"--out", apk, aligned)
+	sign.Env = append(os.Environ(), "BILLDER_KEYSTORE_PASS="+cfg.AndroidKeystorePass)
+	out, err = sign.CombinedOutput()
+	j.log.Command("", sign, out, err)
+	os.Remove(aligned)
+	if err != nil {
+		return errors.New("apksigner failed: " + lastLine(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/rexlx/bilder/internal/version"
+	"github.com/rexlx/bilder/pkg/client"
+)
+
+// apiVersion prefixes every endpoint; routes that predate versioning stay
+// reachable at their bare path as deprecated aliases.
+const apiVersion = "v1"
+
+// streamSchema is the version of the build event stream, announced in the
+// session event and capabilities. It moves with the client package's, which
+// says when it must change. The unversioned route keeps sending schema 1,
+// whose messages are unnamed data lines rather than "status" events.
+const (
+	streamSchema       = client.StreamSchema
+	legacyStreamSchema = 1
+)
+
+// handle registers h at /v1<pattern>, plus the unversioned legacy pattern
+// when legacy is set.
+func handle(mux *http.ServeMux, pattern string, h http.HandlerFunc, legacy bool) {
+	mux.HandleFunc("/"+apiVersion+pattern, h)
+	if legacy {
+		mux.HandleFunc(pattern, deprecated(h))
+	}
+}
+
+// deprecated marks responses from a legacy route with the Deprecation
+// header and a Link to the versioned successor.
+func deprecated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		successor := "/" + apiVersion + r.URL.Path
+		log.Printf("Deprecated route %s %s used by %s (%s); use %s", r.Method, r.URL.Path, r.UserAgent(), clientIP(r), successor)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		h(w, r)
+	}
+}
+
+// Capabilities is the GET /v1/capabilities response.
+type Capabilities struct {
+	APIVersion     string            `json:"api_version"`
+	StreamSchema   int               `json:"stream_schema"` // version of the build event stream
+	GoVersion      string            `json:"go_version"`
+	Targets        []string          `json:"targets"`
+	CgoToolchains  map[string]bool   `json:"cgo_toolchains"` // target -> its C compiler is installed; without it only "cgo": false builds work
+	Matrix         bool              `json:"matrix"`         // accepts "targets" in one request
+	MaxParallelism int               `json:"max_parallelism"`
+	Limits         PayloadLimits     `json:"limits"`    // requests over these are refused with 422
+	Hosts          []HostInfo        `json:"hosts"`     // git servers with known quirks or credentials
+	AVScan         bool              `json:"av_scan"`   // av_check builds are also scanned with ClamAV
+	Packagers      map[string]string `json:"packagers"` // installed packager -> its version
+	Environment    Fingerprint       `json:"environment"`
+	Android        AndroidToolchain  `json:"android"` // android/arm64 builds need Installed
+
+	Attestation string `json:"attestation_key_id,omitempty"` // builds come with provenance signed by this key
+
+	GitLFS string `json:"git_lfs,omitempty"` // version of the installed git-lfs; repositories keeping files in it need one
+
+	Unavailable map[string]string `json:"unavailable,omitempty"` // allowed target -> why the self-test says it can't build; left out of targets
+	SelfTest    *SelfTestReport   `json:"self_test,omitempty"`
+}
+
+// capabilitiesHandler serves GET /v1/capabilities.
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	// A token limited to some targets or repositories sees only those
+	caller := callerID(r)
+	toolchains := map[string]bool{}
+	unavailable := map[string]string{}
+	for _, t := range callerTargets(caller, currentPolicy().targets) {
+		goos, goarch, _ := strings.Cut(t, "/")
+		tc, _ := toolchainFor(goos, goarch)
+		toolchains[t] = tc.installed() && selfTestFailure(t, true) == ""
+		if reason := selfTestFailure(t, false); reason != "" {
+			unavailable[t] = reason
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Capabilities{
+		APIVersion:     apiVersion,
+		StreamSchema:   streamSchema,
+		GoVersion:      toolchainVersion(),
+		Targets:        callerTargets(caller, availableTargets()),
+		CgoToolchains:  toolchains,
+		Matrix:         true,
+		MaxParallelism: maxParallelism,
+		Limits:         payloadLimits(),
+		Hosts:          callerHosts(caller, knownHosts()),
+		AVScan:         cfg.ClamdSocket != "",
+		Packagers:      installedPackagers(),
+		Environment:    environment(),
+		Android:        android,
+		Attestation:    attestationKeyIDOf(cfg.AttestationKey),
+		GitLFS:         gitLFS(),
+		Unavailable:    unavailable,
+		SelfTest:       lastSelfTest(),
+	})
+}
+
+// versionHandler serves GET /version, the server's version. Like the Server
+// header on every response, it needs no token.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version.Get())
+}
+
+// withServerHeader names the billder version in the Server header of every
+// response.
+func withServerHeader(h http.Handler) http.Handler {
+	server := version.Product("billder")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		markServed(r)
+		w.Header().Set("Server", server)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// checkout_mode "archive" fetches the ref as a tarball from the host's API
+// instead of cloning. Hosts build it with git archive, so export-ignore
+// paths are left out, and there is no .git: the commit comes from the
+// archive's header, and describe and dirty are unknown.
+const (
+	maxArchiveBytes = 512 << 20 // downloaded, compressed
+	maxArchiveTree  = 2 << 30   // extracted
+	maxArchiveFiles = 200000
+)
+
+// archiveUnavailable is an archive the host wouldn't or couldn't serve;
+// the build clones instead.
+type archiveUnavailable struct{ reason string }
+
+func (e *archiveUnavailable) Error() string { return e.reason }
+
+// fetchArchive downloads the requested ref's archive and extracts it into
+// j.repoPath, returning the commit it holds, or "" if the archive doesn't
+// say.
+func (j *buildJob) fetchArchive(host *gitHost, sse *sseWriter) (string, error) {
+	ref := j.payload.Ref
+	if ref != "" {
+		ref = host.resolveRef(ref)
+	}
+	_, repoPath, _ := strings.Cut(j.payload.RepoURL, "/")
+	url := host.impl.archiveURL(host.api, repoPath, ref)
+	if url == "" {
+		return "", &archiveUnavailable{fmt.Sprintf("%s serves no archives billder can fetch for this ref", host.provider)}
+	}
+	req, err := http.NewRequestWithContext(j.ctx, "GET", url, nil)
+	if err != nil {
+		return "", &archiveUnavailable{err.Error()}
+	}
+	if host.token != "" {
+		name, value, _ := strings.Cut(host.impl.apiAuthHeader(host.token), ": ")
+		req.Header.Set(name, value)
+	}
+	j.log.Printf("GET %s", url)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", &archiveUnavailable{secrets.Redact(err.Error())}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &archiveUnavailable{"the host answered " + resp.Status}
+	}
+
+	// Downloaded whole first, so a dropped connection falls back to cloning
+	// rather than failing halfway through extraction
+	file := filepath.Join(j.tmpDir, "source.tar.gz")
+	defer os.Remove(file)
+	f, err := os.Create(file)
+	if err != nil {
+		return "", failedWith(FailInternal, err)
+	}
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxArchiveBytes+1))
+	f.Close()
+	if err != nil {
+		return "", &archiveUnavailable{"download failed: " + err.Error()}
+	}
+	if n > maxArchiveBytes {
+		return "", failedWith(FailInvalidRequest, fmt.Errorf("archive exceeds %d MB", maxArchiveBytes>>20))
+	}
+	sse.Message(fmt.Sprintf("Downloaded archive (%.1f MB)", float64(n)/1024/1024))
+
+	if err := os.MkdirAll(j.repoPath, 0o755); err != nil {
+		return "", failedWith(FailInternal, err)
+	}
+	f, err = os.Open(file)
+	if err != nil {
+		return "", failedWith(FailInternal, err)
+	}
+	defer f.Close()
+	commit, err := extractArchive(f, j.repoPath)
+	if err != nil {
+		return "", failedWith(FailInvalidRequest, fmt.Errorf("bad archive: %w", err))
+	}
+	return commit, nil
+}
+
+// extractArchive unpacks a gzipped tarball whose entries share one top
+// directory, as host archives do, into dest, without it. Writes can't
+// leave dest: entries with unsafe names and symlinks pointing out of the
+// tree are refused, and everything is created through an os.Root. Hard
+// links and special files are skipped. The commit is read from the pax
+// header git archive writes.
+func extractArchive(r io.Reader, dest string) (commit string, err error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", err
+	}
+	root, err := os.OpenRoot(dest)
+	if err != nil {
+		return "", err
+	}
+	defer root.Close()
+	tr := tar.NewReader(zr)
+	var files int
+	var size int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return commit, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			if c := hdr.PAXRecords["comment"]; commitPattern.MatchString(c) {
+				commit = c
+			}
+			continue
+		}
+		_, name, _ := strings.Cut(strings.TrimSuffix(hdr.Name, "/"), "/")
+		if name == "" {
+			continue // the top directory
+		}
+		if !filepath.IsLocal(name) {
+			return "", fmt.Errorf("unsafe path %q", hdr.Name)
+		}
+		if files++; files > maxArchiveFiles {
+			return "", fmt.Errorf("more than %d files", maxArchiveFiles)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = root.MkdirAll(name, 0o755)
+		case tar.TypeReg:
+			if size += hdr.Size; size > maxArchiveTree {
+				return "", fmt.Errorf("extracts to more than %d MB", maxArchiveTree>>20)
+			}
+			err = extractFile(root, name, hdr, tr)
+		case tar.TypeSymlink:
+			if path.IsAbs(hdr.Linkname) || !filepath.IsLocal(path.Join(path.Dir(name), hdr.Linkname)) {
+				return "", fmt.Errorf("symlink %q points outside the tree", hdr.Name)
+			}
+			if err = root.MkdirAll(path.Dir(name), 0o755); err == nil {
+				err = root.Symlink(hdr.Linkname, name)
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// extractFile writes the regular file hdr describes, keeping whether it is
+// executable.
+func extractFile(root *os.Root, name string, hdr *tar.Header, r io.Reader) error {
+	if err := root.MkdirAll(path.Dir(name), 0o755); err != nil {
+		return err
+	}
+	mode := os.FileMode(0o644)
+	if hdr.Mode&0o111 != 0 {
+		mode = 0o755
+	}
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.LimitReader(r, hdr.Size))
+	return errors.Join(err, f.Close())
+}
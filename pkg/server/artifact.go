@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// buildArtifactHandler serves GET /v1/builds/{id}/artifact, the artifact a
+// build delivered. Range requests let an interrupted download continue.
+func buildArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	if !buildIDPattern.MatchString(id) {
+		http.Error(w, "Invalid build id", http.StatusBadRequest)
+		return
+	}
+	rec, _ := loadJob(id) // the artifact's name and type, once the build has finished
+	entries, err := os.ReadDir(artifactDir(id))
+	if err != nil || len(entries) != 1 {
+		if rec.Evicted != nil {
+			http.Error(w, "Artifact evicted by retention ("+rec.Evicted.Reason+")", http.StatusGone)
+			return
+		}
+		http.Error(w, "Artifact not found", http.StatusNotFound)
+		return
+	}
+	serveArtifact(w, r, filepath.Join(artifactDir(id), entries[0].Name()), rec.Artifact, time.Time{})
+}
+
+// serveArtifact serves the stored artifact at path as a download under the
+// name and media type the build recorded in meta. Artifacts stored without
+// that record are described from the file itself.
+func serveArtifact(w http.ResponseWriter, r *http.Request, path string, meta *StoredArtifact, modtime time.Time) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Artifact not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	if meta == nil {
+		digest, err := artifactDigest(path, f)
+		if err != nil {
+			http.Error(w, "Failed to read artifact", http.StatusInternalServerError)
+			return
+		}
+		meta = &StoredArtifact{Name: filepath.Base(path), MediaType: artifactMediaType(path, f), SHA256: digest}
+	}
+
+	// ServeContent adds Content-Length, answers Range and conditional
+	// requests, and leaves the body out of HEAD responses
+	w.Header().Set("Content-Type", meta.MediaType)
+	w.Header().Set("Content-Disposition", contentDisposition(meta.Name))
+	w.Header().Set("ETag", `"sha256:`+meta.SHA256+`"`)
+	w.Header().Set("X-Checksum-Sha256", meta.SHA256)
+	http.ServeContent(w, r, meta.Name, modtime, f)
+}
+
+// artifactTypes are the media types of artifacts by extension.
+var artifactTypes = map[string]string{
+	".exe": "application/vnd.microsoft.portable-executable",
+	".zip": "application/zip",
+	".gz":  "application/gzip",
+	".tgz": "application/gzip",
+	".xz":  "application/x-xz",
+	".apk": "application/vnd.android.package-archive",
+	".dmg": "application/x-apple-diskimage",
+}
+
+// artifactMagic tells apart artifacts without a telling extension, like
+// the bare executables of linux and darwin builds, by their first bytes.
+var artifactMagic = []struct{ magic, mediaType string }{
+	{"MZ", "application/vnd.microsoft.portable-executable"},
+	{"\x7fELF", "application/x-executable"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xca\xfe\xba\xbe", "application/x-mach-binary"}, // universal
+	{"PK\x03\x04", "application/zip"},
+	{"\x1f\x8b", "application/gzip"},
+}
+
+// artifactMediaType is the media type of the artifact name, whose
+// contents f holds.
+func artifactMediaType(name string, f io.ReaderAt) string {
+	if t, ok := artifactTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return t
+	}
+	head := make([]byte, 4)
+	n, _ := f.ReadAt(head, 0)
+	for _, m := range artifactMagic {
+		if bytes.HasPrefix(head[:n], []byte(m.magic)) {
+			return m.mediaType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// contentDisposition makes name an attachment header that can't smuggle a
+// path, a hidden file name or header syntax to the browser. Names that
+// aren't ASCII are sent in the RFC 2231 form.
+func contentDisposition(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\"`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" {
+		name = "artifact"
+	}
+	if v := mime.FormatMediaType("attachment", map[string]string{"filename": name}); v != "" {
+		return v
+	}
+	return "attachment"
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	for _, tc := range []struct{ name, want string }{
+		{"app.exe", `attachment; filename=app.exe`},
+		{"my app.exe", `attachment; filename="my app.exe"`},
+		{"../../etc/passwd", `attachment; filename=_.._etc_passwd`},
+		{`..\..\boot.ini`, `attachment; filename=_.._boot.ini`},
+		{".bashrc", `attachment; filename=bashrc`},
+		{`app".exe`, `attachment; filename=app_.exe`},
+		{"app\r\nSet-Cookie: x=1", `attachment; filename="app__Set-Cookie: x=1"`},
+		{"...", `attachment; filename=artifact`},
+		{"", `attachment; filename=artifact`},
+		{"приложение.exe", `attachment; filename*=utf-8''%D0%BF%D1%80%D0%B8%D0%BB%D0%BE%D0%B6%D0%B5%D0%BD%D0%B8%D0%B5.exe`},
+	} {
+		if got := contentDisposition(tc.name); got != tc.want {
+			t.Errorf("contentDisposition(%q) = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestArtifactMediaType(t *testing.T) {
+	for _, tc := range []struct{ name, head, want string }{
+		{"app.exe", "", "application/vnd.microsoft.portable-executable"},
+		{"APP.EXE", "", "application/vnd.microsoft.portable-executable"},
+		{"app.zip", "", "application/zip"},
+		{"app.tar.gz", "", "application/gzip"},
+		{"app.tgz", "", "application/gzip"},
+		{"app.tar.xz", "", "application/x-xz"},
+		{"app.apk", "PK\x03\x04", "application/vnd.android.package-archive"},
+		{"app.dmg", "", "application/x-apple-diskimage"},
+		{"app", "\x7fELF\x02\x01\x01", "application/x-executable"},
+		{"app", "\xcf\xfa\xed\xfe\x0c", "application/x-mach-binary"},
+		{"app", "\xca\xfe\xba\xbe", "application/x-mach-binary"},
+		{"app", "MZ\x90\x00", "application/vnd.microsoft.portable-executable"},
+		{"bundle", "PK\x03\x04", "application/zip"},
+		{"app", "#!/bin/sh\n", "application/octet-stream"},
+		{"app", "", "application/octet-stream"},
+	} {
+		if got := artifactMediaType(tc.name, strings.NewReader(tc.head)); got != tc.want {
+			t.Errorf("artifactMediaType(%q, %q) = %s, want %s", tc.name, tc.head, got, tc.want)
+		}
+	}
+}
+
+// storeArtifact puts content in the store as build id's artifact, under
+// the name the store gives it, and returns its sha256.
+func storeArtifact(t *testing.T, id, name, content string) string {
+	t.Helper()
+	path := storePath(dataDir(), "artifacts", id, name)
+	os.MkdirAll(filepath.Dir(path), 0o755)
+	if err := os.WriteFile(path, []byte(content), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// The artifact is served under the build's own name and media type, with
+// its digest, for HEAD, GET and Range requests alike.
+func TestBuildArtifactHandler(t *testing.T) {
+	useDataDir(t, t.TempDir())
+	usePolicy(t)
+	request := func(method, id string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/v1/builds/"+id+"/artifact", nil)
+		r.SetPathValue("id", id)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		buildArtifactHandler(w, r)
+		return w
+	}
+
+	const content = "\x7fELF a linux build of acme/app"
+	// A name the store hashes, so the download name must come from the record
+	name := strings.Repeat("very-long-name-", 20) + "app"
+	rec := &JobRecord{ID: newBuildID()}
+	startJob(rec)
+	digest := storeArtifact(t, rec.ID, name, content)
+	rec.Artifact = &StoredArtifact{Name: name, MediaType: "application/x-executable", Size: int64(len(content)), SHA256: digest}
+	finishJob(rec, true)
+
+	head := request("HEAD", rec.ID)
+	for header, want := range map[string]string{
+		"Content-Type":        "application/x-executable",
+		"Content-Disposition": "attachment; filename=" + name,
+		"Content-Length":      "30",
+		"ETag":                `"sha256:` + digest + `"`,
+		"X-Checksum-Sha256":   digest,
+		"Accept-Ranges":       "bytes",
+	} {
+		if got := head.Header().Get(header); got != want {
+			t.Errorf("HEAD %s: %q, want %q", header, got, want)
+		}
+	}
+	if head.Code != http.StatusOK || head.Body.Len() != 0 {
+		t.Errorf("HEAD: %d with %d body bytes", head.Code, head.Body.Len())
+	}
+
+	if get := request("GET", rec.ID); get.Code != http.StatusOK || get.Body.String() != content {
+		t.Errorf("GET: %d %q", get.Code, get.Body)
+	}
+	partial := request("GET", rec.ID, "Range", "bytes=5-")
+	if partial.Code != http.StatusPartialContent || partial.Body.String() != content[5:] ||
+		partial.Header().Get("Content-Range") != "bytes 5-29/30" {
+		t.Errorf("Range: %d %q %s", partial.Code, partial.Body, partial.Header().Get("Content-Range"))
+	}
+	if cached := request("GET", rec.ID, "If-None-Match", `"sha256:`+digest+`"`); cached.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: %d, want 304", cached.Code)
+	}
+
+	// Artifacts stored before builds recorded them are described from the file
+	old := newBuildID()
+	digest = storeArtifact(t, old, "app.exe", "MZ a windows build")
+	get := request("GET", old)
+	if get.Header().Get("Content-Type") != "application/vnd.microsoft.portable-executable" ||
+		get.Header().Get("Content-Disposition") != "attachment; filename=app.exe" ||
+		get.Header().Get("X-Checksum-Sha256") != digest {
+		t.Errorf("unrecorded artifact served with %v", get.Header())
+	}
+
+	if w := request("GET", newBuildID()); w.Code != http.StatusNotFound {
+		t.Errorf("unknown build: %d, want 404", w.Code)
+	}
+	if w := request("GET", "../../etc"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid id: %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rexlx/bilder/pkg/client"
+)
+
+// Token is an accepted credential, as listed in the TOKENS_FILE JSON array. Mode "header" (the
+// default) accepts the secret in X-Billder-Token; "hmac" requires signed
+// requests so the secret never crosses the wire.
+type Token struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	Mode   string `json:"mode"`
+
+	RatePerMinute int  `json:"rate_per_min"`    // build requests per minute; 0 is unlimited
+	HighPriority  bool `json:"high_priority"`   // may request priority "high"
+	MaxArtifactMB int  `json:"max_artifact_mb"` // overrides the server's artifact size limit; 0 keeps it
+
+	// Retention of the token's stored builds, overriding the server's; 0 keeps it
+	StoreTTLHours int `json:"store_ttl_hours"`    // how long they're kept
+	StoreMaxMB    int `json:"store_max_mb"`       // the most they may take together
+	StorePerRepo  int `json:"store_max_per_repo"` // how many artifacts of one repository are kept
+
+	// What the token may build; left out, anything the server allows
+	AllowedTargets  []string `json:"allowed_targets,omitempty"`  // os/arch targets
+	AllowedRepos    []string `json:"allowed_repos,omitempty"`    // repository patterns, e.g. github.com/acme/*
+	AllowedFeatures []string `json:"allowed_features,omitempty"` // optional request fields; [] allows none
+}
+
+// Reason codes returned with a 401.
+const (
+	authMissing           = "missing_credentials"
+	authInvalidToken      = "invalid_token"
+	authSignatureRequired = "signature_required"
+	authUnknownKey        = "unknown_key"
+	authNotHMAC           = "key_not_hmac"
+	authBadTimestamp      = "bad_timestamp"
+	authSkew              = "timestamp_skew"
+	authBadSignature      = "bad_signature"
+	authBodyTooLarge      = "body_too_large"
+	authTooManyFailures   = "too_many_failures"
+)
+
+// Failed authentications are limited per client IP. Past the burst, an
+// IP's credentials aren't looked at, let alone hashed, until its failures
+// drain at the rate.
+const (
+	authFailuresPerMinute = 10
+	authFailureBurst      = 20
+)
+
+var failedAuths = newRateLimiter()
+
+// authenticate works out who sent r, unless r's IP has failed too often.
+// Every failure but missing credentials counts against the IP.
+func authenticate(r *http.Request) (caller, reason string) {
+	ip := clientIP(r).String()
+	if ok, _ := failedAuths.peek(ip, authFailuresPerMinute, authFailureBurst); !ok {
+		return "", authTooManyFailures
+	}
+	caller, reason = checkCredentials(r)
+	if reason != "" && reason != authMissing && reason != authBodyTooLarge {
+		failedAuths.allow(ip, authFailuresPerMinute, authFailureBurst)
+	}
+	return caller, reason
+}
+
+// checkCredentials works out who sent r: the token whose secret it
+// carries, the HMAC key whose signature checked out, or the OIDC email, as
+// a callerID. reason is "" when the request is allowed, otherwise a reason
+// code. An open server's callers are all "anonymous".
+func checkCredentials(r *http.Request) (caller, reason string) {
+	p := currentPolicy()
+	tokens, oidc := p.tokens, p.oidc
+	if oidc != nil {
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			email, reason := oidc.verify(bearer)
+			if reason != "" {
+				return "", reason
+			}
+			return "oidc:" + email, ""
+		}
+	}
+	if len(tokens) == 0 {
+		if oidc != nil {
+			return "", authMissing
+		}
+		return "anonymous", ""
+	}
+	if r.Header.Get(client.HeaderSignature) != "" {
+		return verifySignature(r, tokens)
+	}
+
+	presented := r.Header.Get("X-Billder-Token")
+	if presented == "" {
+		return "", authMissing
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(t.Secret)) == 1 {
+			if t.Mode == "hmac" {
+				return "", authSignatureRequired
+			}
+			return "token:" + t.ID, ""
+		}
+	}
+	return "", authInvalidToken
+}
+
+// verifySignature checks a signed request. The body is read and rewound so
+// handlers can still consume it; one larger than a handler would accept
+// isn't hashed. The caller is the key that signed it.
+func verifySignature(r *http.Request, tokens []Token) (caller, reason string) {
+	var token *Token
+	for i := range tokens {
+		if tokens[i].ID == r.Header.Get(client.HeaderKeyID) {
+			token = &tokens[i]
+		}
+	}
+	if token == nil {
+		return "", authUnknownKey
+	}
+	if token.Mode != "hmac" {
+		return "", authNotHMAC
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(client.HeaderTimestamp), 10, 64)
+	if err != nil {
+		return "", authBadTimestamp
+	}
+	if drift := time.Since(time.Unix(ts, 0)).Abs(); drift > cfg.AuthMaxSkew {
+		return "", authSkew
+	}
+
+	limit := payloadLimits().BodyBytes
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		limit = maxMultipartBody
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return "", authBadSignature
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if int64(len(body)) > limit {
+		return "", authBodyTooLarge
+	}
+
+	want := client.Signature(token.Secret, ts, r.Method, r.URL.Path, body)
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get(client.HeaderSignature))) {
+		return "", authBadSignature
+	}
+	return "key:" + token.ID, ""
+}
+
+// authState is a request's authentication, worked out once on first use.
+type authState struct {
+	once           sync.Once
+	caller, reason string
+}
+
+type authKey struct{}
+
+// withAuth gives every request a place to keep its authentication, so
+// authorized and callerID agree on who sent it and signatures are checked
+// once.
+func withAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKey{}, new(authState))))
+	})
+}
+
+// authOf authenticates r, or returns what an earlier call found.
+func authOf(r *http.Request) (caller, reason string) {
+	st, ok := r.Context().Value(authKey{}).(*authState)
+	if !ok {
+		return authenticate(r)
+	}
+	st.once.Do(func() { st.caller, st.reason = authenticate(r) })
+	return st.caller, st.reason
+}
+
+// authorized writes a 401 with the reason code, or a 429 to an IP that
+// failed too often, and reports false when the request is not allowed.
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	_, reason := authOf(r)
+	if reason == "" {
+		return true
+	}
+	w.Header().Set("X-Billder-Auth-Error", reason)
+	if reason == authTooManyFailures {
+		_, wait := failedAuths.peek(clientIP(r).String(), authFailuresPerMinute, authFailureBurst)
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+		http.Error(w, "Too Many Requests: too many failed authentications", http.StatusTooManyRequests)
+		return false
+	}
+	http.Error(w, "Unauthorized: "+reason, http.StatusUnauthorized)
+	return false
+}
+
+// callerID names the credential behind a request, so requests from the
+// same client can be told apart from others. Only credentials that were
+// verified count: anything else, including a request that failed
+// authentication, is "anonymous".
+func callerID(r *http.Request) string {
+	caller, reason := authOf(r)
+	if reason != "" {
+		return "anonymous"
+	}
+	return caller
+}
+
+// callerToken returns the token or key a callerID names.
+func callerToken(caller string) (Token, bool) {
+	kind, id, _ := strings.Cut(caller, ":")
+	if kind != "token" && kind != "key" {
+		return Token{}, false
+	}
+	for _, t := range currentPolicy().tokens {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return Token{}, false
+}
+
+// artifactLimit is the largest artifact, in bytes, delivered to caller;
+// 0 means no limit.
+func artifactLimit(caller string) int64 {
+	if t, ok := callerToken(caller); ok && t.MaxArtifactMB > 0 {
+		return int64(t.MaxArtifactMB) << 20
+	}
+	return cfg.MaxArtifactBytes
+}
+
+// adminAuthorized guards the /admin and /debug endpoints. They only exist
+// when an admin token is configured, and only that token opens them.
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.AdminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	if !isAdmin(r) {
+		w.Header().Set("X-Billder-Auth-Error", authInvalidToken)
+		http.Error(w, "Unauthorized: admin token required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// isAdmin reports whether r carries the admin token.
+func isAdmin(r *http.Request) bool {
+	presented := r.Header.Get("X-Billder-Admin-Token")
+	return cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(cfg.AdminToken)) == 1
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// AVReport is the outcome of the antivirus check of a windows binary.
+type AVReport struct {
+	Findings []string `json:"findings,omitempty"` // patterns known to cause false positives, with the fix
+	Scanner  string   `json:"scanner,omitempty"`  // "clamav" when a scan ran
+	Verdict  string   `json:"verdict,omitempty"`  // "clean", "found <signature>" or why the scan failed
+	Blocked  bool     `json:"blocked,omitempty"`  // av_mode "enforce" withheld the artifact
+}
+
+// Resource types from winuser.h.
+const (
+	rtVersion  = 16
+	rtManifest = 24
+)
+
+// clamdTimeout bounds one scan, connection included.
+const clamdTimeout = 2 * time.Minute
+
+// avCheck inspects a windows binary for what sets off Defender and
+// SmartScreen, and has clamd scan it when one is configured. Each finding is
+// streamed as a warning; only av_mode "enforce" turns them into a failure.
+func (j *buildJob) avCheck(path string, ts *targetStream) *AVReport {
+	report := &AVReport{}
+	findings, err := avHeuristics(path)
+	if err != nil {
+		findings = []string{"could not read the binary's PE headers: " + err.Error()}
+	}
+	report.Findings = findings
+	for _, f := range findings {
+		ts.Message("Warning: " + f)
+	}
+
+	if cfg.ClamdSocket != "" {
+		report.Scanner = "clamav"
+		signature, err := clamdScan(j.ctx, cfg.ClamdSocket, path)
+		switch {
+		case err != nil:
+			report.Verdict = "scan failed: " + err.Error()
+			ts.Message("Warning: ClamAV " + report.Verdict)
+		case signature != "":
+			report.Verdict = "found " + signature
+			ts.Message("Warning: ClamAV flagged the binary as " + signature)
+		default:
+			report.Verdict = "clean"
+			ts.Message("ClamAV: clean")
+		}
+	}
+	j.log.Printf("[%s] av check: %d finding(s), verdict %q", ts.target, len(findings), report.Verdict)
+	// A binary clamd couldn't scan doesn't pass enforce either
+	flagged := report.Verdict != "" && report.Verdict != "clean"
+	report.Blocked = j.payload.AVMode == "enforce" && (len(findings) > 0 || flagged)
+	return report
+}
+
+// avHeuristics lists the known false positive triggers in a PE file.
+func avHeuristics(path string) ([]string, error) {
+	f, err := pe.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var findings []string
+	for _, s := range f.Sections {
+		if strings.Contains(strings.ToUpper(s.Name), "UPX") {
+			findings = append(findings, "UPX compression commonly triggers SmartScreen and Defender heuristics; ship the binary unpacked")
+			break
+		}
+	}
+
+	var subsystem uint16
+	var dirs [16]pe.DataDirectory
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		subsystem, dirs = oh.Subsystem, oh.DataDirectory
+	case *pe.OptionalHeader64:
+		subsystem, dirs = oh.Subsystem, oh.DataDirectory
+	}
+	types := resourceTypes(f, dirs[pe.IMAGE_DIRECTORY_ENTRY_RESOURCE])
+	if !types[rtVersion] {
+		findings = append(findings, "no version resource; consider adding version info metadata (company, product, file version), e.g. a .syso made with goversioninfo")
+	}
+	if subsystem == pe.IMAGE_SUBSYSTEM_WINDOWS_GUI && !types[rtManifest] {
+		findings = append(findings, "GUI binary (-H=windowsgui) without an application manifest; consider embedding one with goversioninfo or rsrc")
+	}
+	return findings, nil
+}
+
+// resourceTypes reads the type IDs at the root of the resource directory.
+func resourceTypes(f *pe.File, rsrc pe.DataDirectory) map[uint32]bool {
+	types := map[uint32]bool{}
+	if rsrc.Size == 0 {
+		return types
+	}
+	for _, s := range f.Sections {
+		if rsrc.VirtualAddress < s.VirtualAddress || rsrc.VirtualAddress >= s.VirtualAddress+s.VirtualSize {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil || int(rsrc.VirtualAddress-s.VirtualAddress)+16 > len(data) {
+			return types
+		}
+		// IMAGE_RESOURCE_DIRECTORY: named entries, then ID entries, 8 bytes each
+		root := data[rsrc.VirtualAddress-s.VirtualAddress:]
+		named := int(binary.LittleEndian.Uint16(root[12:]))
+		ids := int(binary.LittleEndian.Uint16(root[14:]))
+		for i := named; i < named+ids && 16+8*i+8 <= len(root); i++ {
+			types[binary.LittleEndian.Uint32(root[16+8*i:])] = true
+		}
+		break
+	}
+	return types
+}
+
+// clamdScan streams the file to clamd with INSTREAM and returns the
+// signature it matched, or "" when the file is clean. addr is a unix socket
+// path or tcp://host:port.
+func clamdScan(ctx context.Context, addr, path string) (string, error) {
+	network := "unix"
+	if rest, ok := strings.CutPrefix(addr, "tcp://"); ok {
+		network, addr = "tcp", rest
+	}
+	ctx, cancel := context.WithTimeout(ctx, clamdTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	// Chunks are prefixed with their length; a zero length ends the stream
+	chunk := make([]byte, 4+64<<10)
+	for {
+		n, err := f.Read(chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	// The z prefix makes clamd end its reply with a NUL
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+
+	// "stream: OK", "stream: <signature> FOUND" or "... ERROR"
+	verdict := strings.TrimPrefix(strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), "stream: ")
+	switch {
+	case verdict == "OK":
+		return "", nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return strings.TrimSuffix(verdict, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd replied %q", verdict)
+	}
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"debug/pe"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// peSection is a section of a PE file put together by writePE.
+type peSection struct {
+	name string
+	data []byte
+}
+
+// writePE writes a minimal amd64 PE file with the given sections, laid out
+// one per 4 KiB page from 0x1000. rsrc names the resource section, if any.
+func writePE(t *testing.T, subsystem uint16, rsrc string, sections ...peSection) string {
+	t.Helper()
+	const fileAlign, sectionAlign = 0x200, 0x1000
+	oh := pe.OptionalHeader64{
+		Magic:               0x20b,
+		ImageBase:           0x400000,
+		SectionAlignment:    sectionAlign,
+		FileAlignment:       fileAlign,
+		Subsystem:           subsystem,
+		NumberOfRvaAndSizes: 16,
+	}
+	fh := pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_AMD64,
+		NumberOfSections:     uint16(len(sections)),
+		SizeOfOptionalHeader: uint16(binary.Size(oh)),
+		Characteristics:      pe.IMAGE_FILE_EXECUTABLE_IMAGE,
+	}
+	headers := 64 + 4 + binary.Size(fh) + binary.Size(oh) + 40*len(sections)
+	raw := (headers + fileAlign - 1) / fileAlign * fileAlign
+
+	var shdrs []pe.SectionHeader32
+	for i, s := range sections {
+		size := (len(s.data) + fileAlign - 1) / fileAlign * fileAlign
+		h := pe.SectionHeader32{
+			VirtualSize:      uint32(len(s.data)),
+			VirtualAddress:   uint32(sectionAlign * (i + 1)),
+			SizeOfRawData:    uint32(size),
+			PointerToRawData: uint32(raw),
+		}
+		copy(h.Name[:], s.name)
+		if s.name == rsrc {
+			oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_RESOURCE] = pe.DataDirectory{VirtualAddress: h.VirtualAddress, Size: h.VirtualSize}
+		}
+		shdrs = append(shdrs, h)
+		raw += size
+	}
+	oh.SizeOfImage = uint32(sectionAlign * (len(sections) + 1))
+
+	var b bytes.Buffer
+	dos := make([]byte, 64)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 64)
+	b.Write(dos)
+	b.WriteString("PE\x00\x00")
+	binary.Write(&b, binary.LittleEndian, fh)
+	binary.Write(&b, binary.LittleEndian, oh)
+	binary.Write(&b, binary.LittleEndian, shdrs)
+	for i, s := range sections {
+		b.Write(make([]byte, int(shdrs[i].PointerToRawData)-b.Len()))
+		b.Write(s.data)
+	}
+	b.Write(make([]byte, raw-b.Len()))
+
+	path := filepath.Join(t.TempDir(), "app.exe")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// resourceDir encodes the root of a resource directory with named entries
+// followed by the given type IDs.
+func resourceDir(named int, ids ...uint32) []byte {
+	dir := make([]byte, 16+8*(named+len(ids)))
+	binary.LittleEndian.PutUint16(dir[12:], uint16(named))
+	binary.LittleEndian.PutUint16(dir[14:], uint16(len(ids)))
+	for i := 0; i < named; i++ {
+		// Named entries point at a string; the high bit says so
+		binary.LittleEndian.PutUint32(dir[16+8*i:], 0x80000000|uint32(0x100+i))
+	}
+	for i, id := range ids {
+		binary.LittleEndian.PutUint32(dir[16+8*(named+i):], id)
+	}
+	return dir
+}
+
+func TestAVHeuristics(t *testing.T) {
+	text := peSection{".text", bytes.Repeat([]byte{0xc3}, 64)}
+	for _, tc := range []struct {
+		name      string
+		subsystem uint16
+		sections  []peSection
+		want      []string // a word of each finding, in order
+	}{
+		{"console with version info", pe.IMAGE_SUBSYSTEM_WINDOWS_CUI,
+			[]peSection{text, {".rsrc", resourceDir(0, rtVersion)}}, nil},
+		{"gui with version info and manifest", pe.IMAGE_SUBSYSTEM_WINDOWS_GUI,
+			[]peSection{text, {".rsrc", resourceDir(1, rtVersion, rtManifest)}}, nil},
+		{"no resources", pe.IMAGE_SUBSYSTEM_WINDOWS_CUI,
+			[]peSection{text}, []string{"version resource"}},
+		{"gui without a manifest", pe.IMAGE_SUBSYSTEM_WINDOWS_GUI,
+			[]peSection{text, {".rsrc", resourceDir(0, rtVersion)}}, []string{"manifest"}},
+		{"upx packed gui", pe.IMAGE_SUBSYSTEM_WINDOWS_GUI,
+			[]peSection{{"UPX0", nil}, {"UPX1", text.data}, {".rsrc", resourceDir(0, 3)}},
+			[]string{"UPX", "version resource", "manifest"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			findings, err := avHeuristics(writePE(t, tc.subsystem, ".rsrc", tc.sections...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(findings) != len(tc.want) {
+				t.Fatalf("findings %q, want one per %q", findings, tc.want)
+			}
+			for i, want := range tc.want {
+				if !strings.Contains(findings[i], want) {
+					t.Errorf("finding %d is %q, want it to mention %q", i, findings[i], want)
+				}
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "notpe.exe")
+	os.WriteFile(path, []byte("#!/bin/sh\n"), 0o644)
+	if _, err := avHeuristics(path); err == nil {
+		t.Error("a file without PE headers passed")
+	}
+}
+
+// Only the IDs at the root of the resource directory count, past the named
+// entries.
+func TestResourceTypes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want []uint32
+	}{
+		{"ids", resourceDir(0, 3, rtVersion, rtManifest), []uint32{3, rtVersion, rtManifest}},
+		{"named entries first", resourceDir(2, rtVersion), []uint32{rtVersion}},
+		{"empty", resourceDir(0), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := pe.Open(writePE(t, pe.IMAGE_SUBSYSTEM_WINDOWS_CUI, ".rsrc", peSection{".rsrc", tc.data}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			dirs := f.OptionalHeader.(*pe.OptionalHeader64).DataDirectory
+			var got []uint32
+			for id := range resourceTypes(f, dirs[pe.IMAGE_DIRECTORY_ENTRY_RESOURCE]) {
+				got = append(got, id)
+			}
+			slices.Sort(got)
+			want := slices.Sorted(slices.Values(tc.want))
+			if !slices.Equal(got, want) {
+				t.Errorf("resource types %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// fakeClamd accepts one INSTREAM scan on l, checks the streamed bytes are
+// want, and sends reply.
+func fakeClamd(t *testing.T, l net.Listener, want []byte, reply string) {
+	t.Helper()
+	done := make(chan struct{})
+	t.Cleanup(func() { l.Close(); <-done })
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+			t.Errorf("clamd command %q, %v", cmd, err)
+			return
+		}
+		var got []byte
+		for {
+			var n uint32
+			if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+				t.Errorf("reading a chunk length: %v", err)
+				return
+			}
+			if n == 0 {
+				break
+			}
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				t.Errorf("reading a chunk: %v", err)
+				return
+			}
+			got = append(got, chunk...)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("clamd got %d bytes, want %d", len(got), len(want))
+		}
+		io.WriteString(conn, reply+"\x00")
+	}()
+}
+
+func TestClamdScan(t *testing.T) {
+	// Larger than one chunk, so the stream is split
+	data := bytes.Repeat([]byte("billder"), 20000)
+	path := filepath.Join(t.TempDir(), "app.exe")
+	os.WriteFile(path, data, 0o644)
+
+	for _, tc := range []struct {
+		name, reply, signature, err string
+	}{
+		{"clean", "stream: OK", "", ""},
+		{"found", "stream: Win.Trojan.Agent-123 FOUND", "Win.Trojan.Agent-123", ""},
+		{"error", "INSTREAM size limit exceeded. ERROR", "", "size limit"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fakeClamd(t, l, data, tc.reply)
+			signature, err := clamdScan(context.Background(), "tcp://"+l.Addr().String(), path)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one about %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil || signature != tc.signature {
+				t.Errorf("signature %q, %v; want %q", signature, err, tc.signature)
+			}
+		})
+	}
+
+	t.Run("unix socket", func(t *testing.T) {
+		sock := filepath.Join(t.TempDir(), "clamd.sock")
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Skip("no unix sockets:", err)
+		}
+		fakeClamd(t, l, data, "stream: OK")
+		if signature, err := clamdScan(context.Background(), sock, path); err != nil || signature != "" {
+			t.Errorf("signature %q, %v; want clean", signature, err)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		if _, err := clamdScan(context.Background(), filepath.Join(t.TempDir(), "none.sock"), path); err == nil {
+			t.Error("scanning with no clamd listening succeeded")
+		}
+	})
+}
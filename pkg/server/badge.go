@@ -0,0 +1,176 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	badgeMaxAge    = 5 * time.Minute // Cache-Control max-age for image proxies such as GitHub's
+	badgeMaxLabel  = 40              // runes of a ?label= kept
+	badgeCharWidth = 7               // px per character of 11px Verdana, near enough for sizing
+	badgePerMinute = 120             // per client IP
+	badgeBurst     = 30
+)
+
+// Badge outcomes and their colors.
+var badgeColors = map[string]string{
+	"passing": "#4c1",
+	"failing": "#e05d44",
+	"unknown": "#9f9f9f",
+}
+
+var badgeLimiter = newRateLimiter()
+
+// badgeIndex holds the latest finished build of each repository, overall
+// and for each target, so a badge view reads neither the journal nor
+// anything about repositories that have no builds. It is loaded from the
+// journal once per store and kept current by finishJob.
+var badgeIndex = struct {
+	sync.Mutex
+	store  string                // data dir it was loaded from
+	latest map[string]badgeEntry // repo@target; target "" for any
+}{}
+
+type badgeEntry struct {
+	ok bool
+	at time.Time // when the build started
+}
+
+// badgeHandler serves GET /badge?repo=&os=&arch=&label=, an SVG badge of
+// the outcome of the repository's latest finished build, for that target
+// when one is given. It shows passing, failing or unknown and nothing else
+// about the build. With public_badges it needs no token, so READMEs can
+// embed it.
+func badgeHandler(w http.ResponseWriter, r *http.Request) {
+	if !cfg.PublicBadges && !authorized(w, r) {
+		return
+	}
+	if ok, wait := badgeLimiter.allow(clientIP(r).String(), badgePerMinute, badgeBurst); !ok {
+		metrics.rateLimited("badge")
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+		http.Error(w, "Too Many Requests: badge rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	q := r.URL.Query()
+	repo := canonicalRepo(q.Get("repo"))
+	if !repoPattern.MatchString(repo) {
+		http.Error(w, "repo must be host/owner/name", http.StatusBadRequest)
+		return
+	}
+	if !cfg.PublicBadges {
+		if t, ok := callerToken(callerID(r)); ok && !t.permitsRepo(repo) {
+			http.Error(w, "Forbidden: this token may not build "+repo, http.StatusForbidden)
+			return
+		}
+	}
+	target := ""
+	if goos := q.Get("os"); goos != "" {
+		target = goos + "/" + cmp.Or(q.Get("arch"), defaultArch(goos))
+	} else if q.Get("arch") != "" {
+		http.Error(w, "arch needs os", http.StatusBadRequest)
+		return
+	}
+	label := cmp.Or(strings.TrimSpace(q.Get("label")), "billder")
+	if utf8.RuneCountInString(label) > badgeMaxLabel {
+		label = string([]rune(label)[:badgeMaxLabel])
+	}
+
+	outcome := badgeOutcome(repo, target)
+	etag := fmt.Sprintf(`"%s-%x"`, outcome, label)
+	visibility := "private"
+	if cfg.PublicBadges {
+		visibility = "public"
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, stale-while-revalidate=%d", visibility, int(badgeMaxAge.Seconds()), int(badgeMaxAge.Seconds())))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write([]byte(badgeSVG(label, outcome)))
+}
+
+// badgeOutcome is "passing" or "failing" for the latest finished build of
+// repo, of target when it isn't "", or "unknown" when there is none. A
+// matrix build counts for each of its targets with its overall outcome.
+func badgeOutcome(repo, target string) string {
+	badgeIndex.Lock()
+	defer badgeIndex.Unlock()
+	if store := dataDir(); badgeIndex.store != store {
+		loadBadgeIndex(store)
+	}
+	e, ok := badgeIndex.latest[repo+"@"+target]
+	switch {
+	case !ok:
+		return "unknown"
+	case e.ok:
+		return "passing"
+	default:
+		return "failing"
+	}
+}
+
+// loadBadgeIndex indexes the finished builds in the journal of store.
+// Callers must hold badgeIndex.
+func loadBadgeIndex(store string) {
+	badgeIndex.store, badgeIndex.latest = store, map[string]badgeEntry{}
+	entries, _ := os.ReadDir(storePath(store, "jobs"))
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !buildIDPattern.MatchString(id) {
+			continue
+		}
+		if rec, err := loadJob(id); err == nil && rec.State == jobFinished {
+			indexOutcome(&rec)
+		}
+	}
+}
+
+// indexOutcome records rec, a finished build, in badgeIndex if it is the
+// latest of its repository or of any of its targets. Callers must hold
+// badgeIndex.
+func indexOutcome(rec *JobRecord) {
+	for _, target := range append([]string{""}, rec.Payload.Targets...) {
+		key := rec.Payload.RepoURL + "@" + target
+		if e, ok := badgeIndex.latest[key]; !ok || rec.StartedAt.After(e.at) {
+			badgeIndex.latest[key] = badgeEntry{ok: rec.OK, at: rec.StartedAt}
+		}
+	}
+}
+
+// badgeFinished updates badgeIndex with rec, once it has loaded.
+func badgeFinished(rec *JobRecord) {
+	badgeIndex.Lock()
+	defer badgeIndex.Unlock()
+	if badgeIndex.store == dataDir() {
+		indexOutcome(rec)
+	}
+}
+
+// badgeSVG draws a flat two-part badge, label on the left and outcome on
+// the right.
+func badgeSVG(label, outcome string) string {
+	lw := 10 + badgeCharWidth*utf8.RuneCountInString(label)
+	rw := 10 + badgeCharWidth*len(outcome)
+	label = html.EscapeString(label)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">`+
+		`<title>%[4]s: %[5]s</title>`+
+		`<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`+
+		`<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>`+
+		`<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>`+
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`+
+		`<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[4]s</text><text x="%[7]d" y="14">%[4]s</text>`+
+		`<text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[5]s</text><text x="%[8]d" y="14">%[5]s</text></g></svg>`,
+		lw+rw, lw, rw, label, outcome, badgeColors[outcome], lw/2, lw+rw/2)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// finishBuild journals a build of repo for targets, started at started,
+// as finished.
+func finishBuild(repo string, targets []string, ok bool, started time.Time) {
+	rec := &JobRecord{ID: newBuildID(), Payload: RequestPayload{RepoURL: repo, Targets: targets}}
+	startJob(rec)
+	rec.StartedAt = started
+	finishJob(rec, ok)
+}
+
+// Finishing builds keeps the index current; a fresh process loads the
+// same outcomes from the journal.
+func TestBadgeOutcome(t *testing.T) {
+	useDataDir(t, t.TempDir())
+	const repo = "github.com/acme/app"
+	want := map[string]string{"": "unknown", "linux/amd64": "unknown", "windows/amd64": "unknown"}
+	check := func(when string) {
+		t.Helper()
+		for target, outcome := range want {
+			if got := badgeOutcome(repo, target); got != outcome {
+				t.Errorf("%s: %q badge %s, want %s", when, target, got, outcome)
+			}
+		}
+	}
+	check("no builds")
+
+	start := time.Now()
+	finishBuild(repo, []string{"linux/amd64"}, true, start)
+	want[""], want["linux/amd64"] = "passing", "passing"
+	check("after a passing build")
+
+	finishBuild(repo, []string{"linux/amd64", "windows/amd64"}, false, start.Add(time.Second))
+	want[""], want["linux/amd64"], want["windows/amd64"] = "failing", "failing", "failing"
+	check("after a failing matrix build")
+
+	finishBuild(repo, []string{"linux/amd64"}, true, start.Add(-time.Second)) // started before the others
+	check("after an older build finishes")
+
+	finishBuild(repo, []string{"windows/amd64"}, true, start.Add(2*time.Second))
+	want[""], want["windows/amd64"] = "passing", "passing"
+	check("after a passing windows build")
+
+	badgeIndex.Lock()
+	badgeIndex.store = ""
+	badgeIndex.Unlock()
+	check("loaded from the journal")
+	if badgeOutcome("github.com/acme/other", "") != "unknown" {
+		t.Error("a repository without builds has an outcome")
+	}
+}
+
+func TestBadgeRateLimit(t *testing.T) {
+	usePolicy(t)
+	useDataDir(t, t.TempDir())
+	prev := badgeLimiter
+	badgeLimiter = newRateLimiter()
+	t.Cleanup(func() { badgeLimiter = prev })
+
+	view := func(addr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/badge?repo=github.com/acme/app", nil)
+		r.RemoteAddr = addr
+		badgeHandler(w, r)
+		return w
+	}
+	for i := range badgeBurst {
+		if w := view("192.0.2.1:1234"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "unknown") {
+			t.Fatalf("view %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+	if w := view("192.0.2.1:1234"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("view past the burst: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := view("192.0.2.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("another client's view: %d", w.Code)
+	}
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlobStore holds delivered artifacts where clients download them
+// directly, so a build stream carries no binary.
+type BlobStore interface {
+	// Put uploads the file at path under key.
+	Put(ctx context.Context, key, path, mediaType string) error
+	// URL is a download URL for key that works without credentials until
+	// ttl has passed. The download is offered as filename.
+	URL(key, filename string, ttl time.Duration) (string, error)
+}
+
+const (
+	blobPartSize   = 8 << 20 // bytes per uploaded part; S3 requires at least 5 MiB for all but the last
+	blobURLTTL     = time.Hour
+	blobMaxURLTTL  = 7 * 24 * time.Hour // the longest a SigV4 presigned URL may live
+	gcsXMLEndpoint = "https://storage.googleapis.com"
+)
+
+// S3Config locates a bucket of an S3-compatible service.
+type S3Config struct {
+	Endpoint        string // e.g. https://s3.us-east-1.amazonaws.com or http://minio:9000
+	Bucket          string
+	Region          string // "" is us-east-1
+	AccessKeyID     string
+	SecretAccessKey string
+	PathStyle       bool // address the bucket as endpoint/bucket rather than bucket.endpoint; MinIO needs it
+}
+
+// newBlobStore reads an artifact_backend setting: "stream" (or "") keeps
+// artifacts on the build stream and returns nil; "s3" uploads to c; "gcs"
+// uploads to Google Cloud Storage through its S3-compatible XML API,
+// authenticated with an HMAC key, with c's endpoint and region defaulted.
+func newBlobStore(backend string, c S3Config) (BlobStore, error) {
+	switch backend {
+	case "", "stream":
+		return nil, nil
+	case "gcs":
+		c.Endpoint = cmp.Or(c.Endpoint, gcsXMLEndpoint)
+		c.Region = cmp.Or(c.Region, "auto")
+	case "s3":
+		if c.Endpoint == "" {
+			return nil, errors.New("s3_endpoint is required for the s3 backend")
+		}
+	default:
+		return nil, fmt.Errorf("must be stream, s3 or gcs, got %q", backend)
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return nil, fmt.Errorf("s3_endpoint must be an http(s) URL without a path, got %q", c.Endpoint)
+	}
+	if c.Bucket == "" || c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, fmt.Errorf("the %s backend needs s3_bucket, s3_access_key_id and s3_secret_access_key", backend)
+	}
+	c.Region = cmp.Or(c.Region, "us-east-1")
+	return &s3Store{S3Config: c, endpoint: u}, nil
+}
+
+// s3Store speaks the S3 REST API, signing requests with AWS Signature
+// Version 4. Large files go up in blobPartSize parts, each retried on
+// its own.
+type s3Store struct {
+	S3Config
+	endpoint *url.URL
+}
+
+// objectURL addresses key in the bucket, with query q.
+func (s *s3Store) objectURL(key string, q url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = "/" + key
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + key
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.RawPath = awsEscape(u.Path, true)
+	u.RawQuery = canonicalQuery(q)
+	return &u
+}
+
+func (s *s3Store) Put(ctx context.Context, key, path, mediaType string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	if size <= blobPartSize {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		_, err = s.retrying(ctx, "upload", func() (*http.Response, error) {
+			return s.do(ctx, "PUT", key, nil, http.Header{"Content-Type": {mediaType}}, data)
+		})
+		return err
+	}
+
+	resp, err := s.retrying(ctx, "start upload", func() (*http.Response, error) {
+		return s.do(ctx, "POST", key, url.Values{"uploads": {""}}, http.Header{"Content-Type": {mediaType}}, nil)
+	})
+	if err != nil {
+		return err
+	}
+	var started struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&started)
+	resp.Body.Close()
+	if err != nil || started.UploadID == "" {
+		return fmt.Errorf("start upload: no upload id in the response")
+	}
+	upload := url.Values{"uploadId": {started.UploadID}}
+	abort := func(err error) error {
+		// Parts of an abandoned upload are billed until aborted
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if resp, abortErr := s.do(ctx, "DELETE", key, upload, nil, nil); abortErr == nil {
+			resp.Body.Close()
+		} else {
+			log.Printf("Abort upload of %s: %v", key, abortErr)
+		}
+		return err
+	}
+
+	type part struct {
+		Number int    `xml:"PartNumber"`
+		ETag   string `xml:"ETag"`
+	}
+	var parts []part
+	buf := make([]byte, blobPartSize)
+	for offset, n := int64(0), 1; offset < size; offset, n = offset+blobPartSize, n+1 {
+		read, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return abort(err)
+		}
+		q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {started.UploadID}}
+		resp, err := s.retrying(ctx, fmt.Sprintf("upload part %d", n), func() (*http.Response, error) {
+			return s.do(ctx, "PUT", key, q, nil, buf[:read])
+		})
+		if err != nil {
+			return abort(err)
+		}
+		resp.Body.Close()
+		parts = append(parts, part{Number: n, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	resp, err = s.retrying(ctx, "complete upload", func() (*http.Response, error) {
+		return s.do(ctx, "POST", key, upload, http.Header{"Content-Type": {"application/xml"}}, body)
+	})
+	if err != nil {
+		return abort(err)
+	}
+	defer resp.Body.Close()
+	// Completing can fail after the 200 has been sent, reported in the body
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if bytes.Contains(reply, []byte("<Error>")) {
+		return abort(fmt.Errorf("complete upload: %s", s3ErrorMessage(reply)))
+	}
+	return nil
+}
+
+// retrying calls send until it succeeds, up to cfg.StepRetries more times
+// with exponential backoff after a network error, a 5xx or a 429. The
+// response of a success is returned with its body open.
+func (s *s3Store) retrying(ctx context.Context, what string, send func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := send()
+		if err == nil && resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+		if err == nil {
+			reply, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			err = fmt.Errorf("%s: %s: %s", what, resp.Status, s3ErrorMessage(reply))
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				return nil, err
+			}
+		} else {
+			err = fmt.Errorf("%s: %w", what, err)
+		}
+		if attempt >= cfg.StepRetries || ctx.Err() != nil {
+			return nil, err
+		}
+		wait := cfg.RetryBackoff << attempt
+		log.Printf("Artifact storage: %v; retrying in %s", err, wait)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// s3ErrorMessage pulls the message out of an S3 error document.
+func s3ErrorMessage(reply []byte) string {
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(reply, &e) != nil || e.Code == "" {
+		return strings.TrimSpace(string(reply))
+	}
+	return e.Code + ": " + e.Message
+}
+
+// do sends a signed request for key.
+func (s *s3Store) do(ctx context.Context, method, key string, q url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, q).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now().UTC())
+	return http.DefaultClient.Do(req)
+}
+
+// sign adds SigV4 headers to req, whose body hashes to payloadHash.
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	names := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			names = append(names, lower)
+		}
+	}
+	slices.Sort(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		value := req.Host
+		if value == "" {
+			value = req.URL.Host
+		}
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonical.WriteString(name + ":" + value + "\n")
+	}
+	signed := strings.Join(names, ";")
+	scope := s.scope(now)
+	request := strings.Join([]string{req.Method, awsEscape(req.URL.Path, true), req.URL.RawQuery, canonical.String(), signed, payloadHash}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signed, s.signature(now, scope, request)))
+}
+
+// URL presigns a GET of key.
+func (s *s3Store) URL(key, filename string, ttl time.Duration) (string, error) {
+	if ttl <= 0 || ttl > blobMaxURLTTL {
+		return "", fmt.Errorf("a presigned URL lives between 1s and %s, not %s", blobMaxURLTTL, ttl)
+	}
+	now := time.Now().UTC()
+	scope := s.scope(now)
+	q := url.Values{
+		"X-Amz-Algorithm":              {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":             {s.AccessKeyID + "/" + scope},
+		"X-Amz-Date":                   {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":                {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders":          {"host"},
+		"response-content-disposition": {fmt.Sprintf("attachment; filename=%q", filename)},
+	}
+	u := s.objectURL(key, q)
+	request := strings.Join([]string{"GET", awsEscape(u.Path, true), u.RawQuery, "host:" + u.Host + "\n", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	q.Set("X-Amz-Signature", s.signature(now, scope, request))
+	u.RawQuery = canonicalQuery(q)
+	return u.String(), nil
+}
+
+func (s *s3Store) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request with the key derived for scope.
+func (s *s3Store) signature(now time.Time, scope, request string) string {
+	sum := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// canonicalQuery encodes q sorted by key, escaped the way SigV4 signs it.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and
+// slashes when keepSlash is set.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
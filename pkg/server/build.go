@@ -0,0 +1,625 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildJob is the state shared by every target of one /build request.
+type buildJob struct {
+	ctx       context.Context // ends at the build timeout, or when the client stalls
+	payload   RequestPayload
+	id        string
+	started   time.Time
+	log       *buildLog
+	tmpDir    string
+	repoPath  string
+	moduleDir string // where go commands run: repoPath, or the requested module_dir in it
+	vcs       VCSInfo
+	pgoPath   string
+	patchSHA  string // sha256 of the applied request patch
+	maxBytes  int64  // artifact size limit for the caller; 0 means none
+	trace     *span  // nil unless tracing is configured
+
+	packager  string     // "go" or "fyne", settled after cloning
+	packageMu sync.Mutex // fyne package works in the source directory, one target at a time
+
+	partial  *PartialTransfer // set when streaming the artifact broke off
+	stored   *StoredArtifact  // set once the artifact is in the store
+	uploaded bool             // the artifact went to cfg.ArtifactStore and isn't streamed
+	keptOnly bool             // the artifact is only kept in the store, being too big to stream
+	failure  FailureCategory  // set when a built artifact couldn't be delivered
+
+	cmds []string // build_all_cmds: the commands under cmd/ each target builds
+
+	licensesMu sync.Mutex
+	licenses   []*LicenseReport // license_report: each target's, as they finish
+
+	comparing bool // this builds compare_ref, whose compile times aren't recorded
+
+	cacheMu       sync.Mutex
+	cacheHit      *bool // every go build so far compiled nothing; nil before the first
+	artifactBytes int64 // size of the delivered artifact
+
+	syntheticModule bool // init_module wrote the go.mod
+
+	archived bool // checked out from a host archive: no .git, so describe and dirty are unknown
+
+	rec *JobRecord // the build's journal entry, for published messages; nil for the compare_ref build
+}
+
+// errClientStalled cancels a build whose client stopped reading its stream.
+var errClientStalled = errors.New("the client stopped reading the stream")
+
+// stopReason says why the build's context ended.
+func (j *buildJob) stopReason() string {
+	return stopMessage(context.Cause(j.ctx))
+}
+
+// stopMessage says why a build whose context ended with cause stopped.
+func stopMessage(cause error) string {
+	switch {
+	case errors.Is(cause, errClientStalled):
+		return "Build cancelled: " + errClientStalled.Error()
+	case errors.Is(cause, errBuildCanceled), errors.Is(cause, errShutdown):
+		return "Build " + cause.Error()
+	}
+	return fmt.Sprintf("Build timed out after %s", cfg.BuildTimeout)
+}
+
+// targetResult is the outcome of building one target.
+type targetResult struct {
+	summary BuildSummary
+	files   []zipEntry // binary plus any companion files, named for delivery
+	partial bool       // not OK, but files holds what built and is delivered anyway
+}
+
+// logURL is where the full build log can be fetched once the build ends.
+func (j *buildJob) logURL() string {
+	return "/" + apiVersion + "/builds/" + j.id + "/log"
+}
+
+// artifactURL is where the delivered artifact can be fetched again, with
+// Range support, until the store expires it.
+func (j *buildJob) artifactURL() string {
+	return "/" + apiVersion + "/builds/" + j.id + "/artifact"
+}
+
+// resolvePGO locates the PGO profile: an uploaded profile wins over the
+// repo's default.pgo.
+func (j *buildJob) resolvePGO(profile []byte, sse *sseWriter) error {
+	if j.payload.PGO != "auto" && profile == nil {
+		return nil
+	}
+	data := profile
+	j.pgoPath = filepath.Join(j.tmpDir, "upload.pgo")
+	if data == nil {
+		j.pgoPath = filepath.Join(j.moduleDir, "default.pgo")
+		var err error
+		if data, err = os.ReadFile(j.pgoPath); err != nil {
+			return errors.New("pgo is \"auto\" but the repository has no default.pgo")
+		}
+	} else if err := os.WriteFile(j.pgoPath, data, 0o644); err != nil {
+		return failedWith(FailInternal, errors.New("failed to store uploaded profile"))
+	}
+	samples, err := profileSamples(data)
+	if err != nil {
+		return fmt.Errorf("PGO profile is not a valid pprof profile: %v", err)
+	}
+	sse.Message(fmt.Sprintf("PGO enabled with %s (%d samples)", filepath.Base(j.pgoPath), samples))
+	return nil
+}
+
+// buildTarget compiles and packages one target, streaming tagged events.
+func (j *buildJob) buildTarget(tc Toolchain, ts *targetStream) targetResult {
+	p := j.payload
+	res := targetResult{summary: BuildSummary{
+		Target:   ts.target,
+		Repo:     p.RepoURL,
+		TargetOS: tc.GOOS,
+		Arch:     tc.GOARCH,
+		Commit:   j.vcs.Commit,
+		Describe: j.vcs.Describe,
+		Ref:      j.vcs.Branch,
+		Dirty:    j.vcs.Dirty,
+		BuildID:  j.id,
+		LogURL:   j.logURL(),
+
+		PatchSHA256: j.patchSHA,
+		Environment: environment().Condensed,
+
+		Labels: p.Labels,
+	}}
+	if j.archived {
+		res.summary.Checkout = "archive"
+	}
+	if p.CompilerOptions.set() {
+		res.summary.CompilerOptions = p.CompilerOptions
+	}
+	compileSpan := j.trace.child("compile")
+	compileSpan.set("billder.target", ts.target)
+	defer compileSpan.end()
+	fail := func(category FailureCategory, msg string) targetResult {
+		compileSpan.fail(msg)
+		ts.Message("Error: " + msg)
+		j.log.Printf("[%s] error (%s): %s", ts.target, category, msg)
+		res.summary.Error, res.summary.Category = msg, category
+		return res
+	}
+
+	// Catch missing C libraries before gcc buries them in errors
+	if !tc.NoCgo {
+		if problems := checkCgoDeps(j.moduleDir, tc); len(problems) > 0 {
+			for _, problem := range problems[1:] {
+				ts.Message("Error: " + problem)
+			}
+			return fail(FailToolchain, problems[0])
+		}
+	}
+
+	step := Step{Target: ts.target, Index: 3, Total: totalSteps, Name: "Compiling"}
+	ts.Event("step", step)
+	if j.rec != nil {
+		publishStep(j.rec, step)
+	}
+	outDir := filepath.Join(j.tmpDir, "out", tc.GOOS+"_"+tc.GOARCH)
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return fail(FailInternal, "Failed to create output directory")
+	}
+	outputBinary := filepath.Join(outDir, "app")
+	if p.CompilerOptions.race() {
+		outputBinary += "-race" // so it isn't mistaken for a release binary
+	}
+	if tc.GOOS == "windows" {
+		outputBinary += ".exe"
+	}
+
+	packager := j.packagerFor(tc)
+	ldflags := strings.TrimSpace(p.ldflags(tc.GOOS, j.vcs) + " " + j.origin().ldflags())
+	buildCmd := exec.CommandContext(j.ctx, "go", goBuildArgs(outputBinary, ldflags, j.pgoPath, p.CompilerOptions, ".")...)
+	var packaged map[string]bool // source directory contents before fyne package
+	switch packager {
+	case "fyne":
+		j.packageMu.Lock()
+		defer j.packageMu.Unlock()
+		ldflags, packaged = "", dirNames(j.moduleDir)
+		buildCmd = exec.CommandContext(j.ctx, "fyne", fynePackageArgs(tc, p)...)
+	case "gomobile":
+		ldflags, outputBinary = "", filepath.Join(outDir, "app.apk")
+		buildCmd = exec.CommandContext(j.ctx, "gomobile", gomobileArgs(tc, outputBinary, p)...)
+	}
+	buildCmd.Dir = j.moduleDir
+	buildCmd.Env = tc.Env()
+	log.Println("Running build command:", buildCmd.Args)
+
+	// Count packages from -v output and estimate progress from earlier builds
+	histKey := historyKey(path.Join(p.RepoURL, p.ModuleDir), tc.GOOS, tc.GOARCH)
+	past, known := history.Get(histKey)
+	if !known && packager == "go" {
+		ts.Message("Compile progress unknown (first build of this repo)")
+	}
+	// Waiters are told their expected wait; the summary records the first
+	// estimate and the actual wait, so estimates can be checked
+	queued := time.Now()
+	var estimate *queueWait
+	release := acquireCompileSlot(p.Priority, expectedCompile(histKey), func(qw queueWait) {
+		if estimate == nil {
+			estimate = &qw
+		}
+		ts.Message(qw.String())
+	})
+	defer release()
+	if estimate != nil {
+		waited := time.Since(queued)
+		res.summary.QueueWait = waited.Seconds()
+		res.summary.QueueETA = estimate.eta.Seconds()
+		metrics.queueEstimated(estimate.eta, waited, estimate.rough)
+	}
+	if p.BuildAllCmds {
+		res = j.buildCmds(tc, ts, outDir, ldflags, res)
+		if res.summary.Error != "" {
+			compileSpan.fail(res.summary.Error)
+		}
+		j.stampOrigins(ts.target, res.files)
+		if p.LicenseReport && len(res.files) > 0 {
+			j.addLicenseReport(tc, ts, &res)
+		}
+		return res
+	}
+	compileStart := time.Now()
+	lastProgress := compileStart
+	compiled := 0
+	out, err := j.runCompile(tc, ts, buildCmd, func(stream, line string) {
+		if !isPackageLine(line) {
+			ts.Output(3, stream, line)
+			return
+		}
+		compiled++
+		if time.Since(lastProgress) >= progressInterval {
+			lastProgress = time.Now()
+			progress := newProgress(compiled, time.Since(compileStart), past, known)
+			progress.Target = ts.target
+			ts.Event("progress", progress)
+		}
+	})
+	diags, text := parseBuildOutput(out)
+	j.log.Command("["+ts.target+"] ", buildCmd, []byte(text), err)
+	if err != nil {
+		log.Printf("Build Output: %s", text)
+		for _, d := range diags {
+			d.Target = ts.target
+			ts.Event("diagnostic", d)
+		}
+		if j.ctx.Err() != nil {
+			return fail(FailTimeout, j.stopReason())
+		}
+		category := compileFailure(text, err)
+		if hint := j.sparseHint(text); hint != "" {
+			ts.Message(hint)
+		}
+		if packager != "go" && len(diags) == 0 {
+			return fail(category, strings.Join(buildCmd.Args[:2], " ")+" failed: "+lastLine(text))
+		}
+		return fail(category, fmt.Sprintf("Compilation failed with %d diagnostic(s).", len(diags)))
+	}
+	switch packager {
+	case "go":
+		if !j.comparing {
+			history.Record(histKey, RepoStats{Packages: compiled, Seconds: time.Since(compileStart).Seconds()})
+			j.noteCacheHit(compiled == 0)
+		}
+		// go build -v only names packages it had to compile; the rest came from GOCACHE
+		compileSpan.set("billder.packages_compiled", compiled)
+		compileSpan.set("billder.cache_hit", compiled == 0)
+	case "fyne":
+		// Keep the package's own name, e.g. "My App.exe" or "My App.tar.xz"
+		built, err := fynePackaged(j.moduleDir, tc.GOOS, packaged)
+		if err != nil {
+			return fail(FailCompile, err.Error())
+		}
+		outputBinary = filepath.Join(outDir, filepath.Base(built))
+		if err := os.Rename(built, outputBinary); err != nil {
+			return fail(FailInternal, "Failed to collect the fyne package")
+		}
+	}
+	compileSpan.set("billder.packager", packager)
+
+	if tc.GOOS == "android" {
+		res.summary.Signing = android.Signing
+		if android.Signing == "release" {
+			if err := j.signAPK(outputBinary); err != nil {
+				return fail(FailInternal, err.Error())
+			}
+			ts.Message("Signed APK with the release keystore")
+		} else {
+			ts.Message("APK is signed with a debug key; install it on test devices only")
+		}
+	}
+
+	res.files = []zipEntry{{Name: filepath.Base(outputBinary), Path: outputBinary}}
+	if p.SplitDebug {
+		debugFile, err := splitDebug(outputBinary)
+		if err != nil {
+			log.Printf("Split debug error: %v", err)
+			return fail(FailInternal, "Failed to split debug info.")
+		}
+		res.files = append(res.files, zipEntry{Name: filepath.Base(debugFile), Path: debugFile})
+	}
+	j.stampOrigins(ts.target, res.files)
+
+	if p.AVCheck && tc.GOOS == "windows" {
+		res.summary.AVCheck = j.avCheck(outputBinary, ts)
+		if res.summary.AVCheck.Blocked {
+			// The scanner flagged what the code built, not the server
+			return fail(FailCompile, "Antivirus check failed and av_mode is \"enforce\"; the artifact was withheld.")
+		}
+	}
+
+	if p.SizeReport {
+		report, err := buildSizeReport(outputBinary)
+		if err != nil {
+			ts.Message("Warning: size report failed: " + err.Error())
+		} else {
+			ts.Text("report", report.Lines())
+			res.summary.SizeReport = report
+			res.files = append(res.files, zipEntry{Name: "size_report.txt", Data: []byte(strings.Join(report.Lines(), "\n") + "\n")})
+		}
+	}
+
+	if p.LicenseReport {
+		j.addLicenseReport(tc, ts, &res)
+	}
+
+	stat, err := os.Stat(outputBinary)
+	if err != nil {
+		return fail(FailInternal, "Could not open built artifact")
+	}
+	res.summary.OK = true
+	res.summary.Artifact = filepath.Base(outputBinary)
+	res.summary.SizeMB = float64(stat.Size()) / 1024 / 1024
+	res.summary.ArtifactURL = j.artifactURL()
+	res.summary.LDFlags = ldflags
+	compileSpan.set("billder.binary_bytes", stat.Size())
+	return res
+}
+
+// oversize checks an artifact against the caller's size limit before
+// anything is streamed, returning the error to report if it's too big.
+func (j *buildJob) oversize(size int64) string {
+	if j.maxBytes <= 0 || size <= j.maxBytes {
+		return ""
+	}
+	metrics.artifactOversize()
+	j.trace.set("billder.oversize_bytes", size)
+	msg := fmt.Sprintf("Artifact is %.2f MB, over the %.2f MB limit; it was not delivered.", float64(size)/1024/1024, float64(j.maxBytes)/1024/1024)
+	j.log.Printf("error: %s", msg)
+	log.Printf("Build %s: %s", j.id, msg)
+	return msg
+}
+
+// deliverSingle streams a single target's artifact, zipping it together
+// with companion files when there are any or zip delivery was requested.
+// It reports whether the artifact was handed over.
+func (j *buildJob) deliverSingle(res targetResult, sse *sseWriter) bool {
+	if !res.summary.OK && !res.partial {
+		sse.Event("summary", res.summary)
+		return false
+	}
+
+	artifact := res.files[0].Path
+	if j.payload.Zip || j.payload.BuildAllCmds || len(binariesOnly(res.files)) > 1 {
+		files, err := j.withProvenance(res.summary.Target, res.files)
+		if err != nil {
+			log.Printf("Provenance error: %v", err)
+			sse.Message("Error: Failed to sign the provenance.")
+			j.failure = FailInternal
+			return false
+		}
+		artifact = filepath.Join(j.tmpDir, "app.zip")
+		if err := writeZip(artifact, files); err != nil {
+			log.Printf("Zip error: %v", err)
+			sse.Message("Error: Failed to package artifacts.")
+			j.failure = FailInternal
+			return false
+		}
+	}
+
+	stat, err := os.Stat(artifact)
+	if err != nil {
+		sse.Message("Error: Could not open built artifact")
+		j.failure = FailInternal
+		return false
+	}
+	if msg := j.oversize(stat.Size()); msg != "" {
+		res.summary.OK, res.summary.Error, res.summary.ArtifactURL = false, msg, ""
+		res.partial = false
+		res.summary.Category, j.failure = FailInvalidRequest, FailInvalidRequest
+		sse.Message("Error: " + msg)
+		sse.Event("summary", res.summary)
+		return false
+	}
+	res.summary.Artifact = filepath.Base(artifact)
+	res.summary.SizeMB = float64(stat.Size()) / 1024 / 1024
+	url, digest, problem := j.place(artifact, stat.Size(), sse)
+	if problem != "" {
+		res.summary.OK, res.summary.Error, res.summary.ArtifactURL = false, problem, ""
+		res.partial = false
+		res.summary.Category, j.failure = FailInternal, FailInternal
+		sse.Message("Error: " + problem)
+		sse.Event("summary", res.summary)
+		return false
+	}
+	j.artifactBytes = stat.Size()
+	res.summary.ArtifactURL, res.summary.ArtifactSHA256, res.summary.Delivery = url, digest, j.delivery()
+	res.summary.ProvenanceURL = j.provenanceURL()
+	res.summary.LicensesURL = j.licensesURL()
+	log.Printf("Binary built successfully: %s (%.2f MB)", artifact, res.summary.SizeMB)
+	if res.partial {
+		sse.Message(fmt.Sprintf("Delivering the commands that built. Artifact size: %.2f MB", res.summary.SizeMB))
+	} else {
+		sse.Message(fmt.Sprintf("Build Successful! Artifact size: %.2f MB", res.summary.SizeMB))
+	}
+	sse.Event("summary", res.summary)
+	j.stream(artifact, sse)
+	return true
+}
+
+// deliverMatrix bundles every successful target under "<os>_<arch>/" in one
+// zip, sends the overall summary, and streams the archive. It reports
+// whether the archive was handed over.
+func (j *buildJob) deliverMatrix(results []targetResult, sse *sseWriter) bool {
+	overall := MatrixSummary{BuildID: j.id, LogURL: j.logURL(), Labels: j.payload.Labels}
+	var entries []zipEntry
+	for _, res := range results {
+		overall.Targets = append(overall.Targets, res.summary)
+		if !res.summary.OK {
+			overall.Failed++
+			if !res.partial {
+				continue
+			}
+		} else {
+			overall.Succeeded++
+		}
+		files, err := j.withProvenance(res.summary.Target, res.files)
+		if err != nil {
+			log.Printf("Provenance error: %v", err)
+			sse.Message("Error: Failed to sign the provenance.")
+			j.failure = FailInternal
+			return false
+		}
+		dir := strings.ReplaceAll(res.summary.Target, "/", "_") + "/"
+		for _, f := range files {
+			f.Name = dir + f.Name
+			entries = append(entries, f)
+		}
+	}
+
+	if len(entries) == 0 {
+		sse.Event("matrix_summary", overall)
+		sse.Message("Error: All targets failed.")
+		return false
+	}
+
+	artifact := filepath.Join(j.tmpDir, "app.zip")
+	if err := writeZip(artifact, entries); err != nil {
+		log.Printf("Zip error: %v", err)
+		sse.Message("Error: Failed to package artifacts.")
+		j.failure = FailInternal
+		return false
+	}
+	stat, err := os.Stat(artifact)
+	if err != nil {
+		sse.Message("Error: Could not open built artifact")
+		j.failure = FailInternal
+		return false
+	}
+	if msg := j.oversize(stat.Size()); msg != "" {
+		sse.Event("matrix_summary", overall)
+		sse.Message("Error: " + msg)
+		j.failure = FailInvalidRequest
+		return false
+	}
+	overall.Artifact = filepath.Base(artifact)
+	overall.SizeMB = float64(stat.Size()) / 1024 / 1024
+	url, digest, problem := j.place(artifact, stat.Size(), sse)
+	if problem != "" {
+		sse.Event("matrix_summary", overall)
+		sse.Message("Error: " + problem)
+		j.failure = FailInternal
+		return false
+	}
+	j.artifactBytes = stat.Size()
+	overall.ArtifactURL, overall.ArtifactSHA256, overall.Delivery = url, digest, j.delivery()
+	overall.ProvenanceURL = j.provenanceURL()
+	overall.LicensesURL = j.licensesURL()
+	sse.Message(fmt.Sprintf("Build finished: %d succeeded, %d failed. Artifact size: %.2f MB", overall.Succeeded, overall.Failed, overall.SizeMB))
+	sse.Event("matrix_summary", overall)
+	j.stream(artifact, sse)
+	return true
+}
+
+// upload puts the artifact in cfg.ArtifactStore, when there is one, and
+// returns the presigned URL the client downloads it from and its SHA-256.
+// Otherwise, or when the upload fails, the artifact is delivered by this
+// server and its own artifactURL is returned, with no digest: binary_start
+// carries it then.
+func (j *buildJob) upload(artifact string, sse *sseWriter) (url, digest string) {
+	if cfg.ArtifactStore == nil {
+		return j.artifactURL(), ""
+	}
+	name := filepath.Base(artifact)
+	key := j.id + "/" + name
+	uploadSpan := j.trace.child("upload")
+	defer uploadSpan.end()
+	sse.Message("Uploading artifact...")
+
+	f, err := os.Open(artifact)
+	if err == nil {
+		defer f.Close()
+		h := sha256.New()
+		if _, err = io.Copy(h, f); err == nil {
+			digest = hex.EncodeToString(h.Sum(nil))
+			err = cfg.ArtifactStore.Put(j.ctx, key, artifact, artifactMediaType(name, f))
+		}
+	}
+	if err == nil {
+		url, err = cfg.ArtifactStore.URL(key, name, cfg.ArtifactURLTTL)
+	}
+	if err != nil {
+		log.Printf("Upload artifact of build %s: %v", j.id, err)
+		j.log.Printf("warning: artifact upload failed: %v", err)
+		uploadSpan.fail(err.Error())
+		sse.Message("Warning: Could not upload the artifact; delivering it from this server instead.")
+		return j.artifactURL(), ""
+	}
+	uploadSpan.set("billder.artifact", name)
+	j.uploaded = true
+	return url, digest
+}
+
+// stream hands the artifact over to the client. It is moved into the store
+// first so a client that lost the stream can download it again. The stored
+// copy is named by storePath; the stream keeps the build's own name.
+func (j *buildJob) stream(artifact string, sse *sseWriter) {
+	name := filepath.Base(artifact)
+	stored := storePath(dataDir(), "artifacts", j.id, name)
+	persisted := persistFile(artifact, stored)
+	if persisted != nil {
+		log.Printf("Persist artifact %s: %v", j.id, persisted)
+	} else {
+		artifact = stored
+	}
+	f, err := os.Open(artifact)
+	if err != nil {
+		sse.Message("Error: Could not open built artifact")
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	total, err := io.Copy(h, f)
+	if err != nil {
+		sse.Message("Error: Could not read built artifact")
+		return
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if _, known := history.Artifact(digest); !known {
+		history.RecordArtifact(digest, ArtifactOrigin{BuildID: j.id, Name: name, At: time.Now()})
+	}
+	j.storeProvenance(name, digest)
+	j.storeLicenses()
+	// Downloads from the store serve the name and type the build gave it
+	if persisted == nil {
+		j.stored = &StoredArtifact{Name: name, MediaType: artifactMediaType(name, f), Size: total, SHA256: digest}
+	}
+	if j.uploaded {
+		return // the client downloads it from the summary's artifact_url
+	}
+	if j.keptOnly {
+		if persisted != nil {
+			sse.Message("Error: Could not keep the artifact for download")
+			j.failure = FailInternal
+		}
+		return
+	}
+	if sse.Gone() {
+		log.Printf("Client of build %s is gone; artifact kept for %s", j.id, j.artifactURL())
+		return
+	}
+	f.Seek(0, io.SeekStart)
+
+	transferSpan := j.trace.child("transfer")
+	defer transferSpan.end()
+	// Tell client to switch to binary mode, then copy raw bytes to the response body
+	n, err := sse.Binary(name, digest, total, f)
+	transferSpan.set("billder.artifact", name)
+	transferSpan.set("billder.artifact_bytes", n)
+	if err != nil {
+		log.Printf("Streaming error for build %s: sent %d of %d bytes: %v", j.id, n, total, err)
+		transferSpan.fail(err.Error())
+		j.partial = &PartialTransfer{Artifact: name, Sent: n, Total: total, Error: err.Error()}
+		metrics.partialTransfer(total - n)
+	}
+}
+
+// binariesOnly drops in-memory report files from a delivery list.
+func binariesOnly(files []zipEntry) []zipEntry {
+	var out []zipEntry
+	for _, f := range files {
+		if f.Path != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildLog collects all subprocess output of a build in the workspace.
+// It is safe for concurrent use by parallel targets.
+type buildLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	f    *redactWriter // scrubs secrets on the way to file
+}
+
+func createBuildLog(path string) (*buildLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &buildLog{path: path, file: f, f: newRedactWriter(f)}, nil
+}
+
+// Printf writes a timestamped note.
+func (l *buildLog) Printf(format string, a ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.f, "%s "+format+"\n", append([]any{time.Now().Format(time.TimeOnly)}, a...)...)
+}
+
+// Command records a command line and its output, prefixing each line with
+// prefix so interleaved targets stay readable.
+func (l *buildLog) Command(prefix string, cmd *exec.Cmd, out []byte, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.f, "%s %s$ %s\n", time.Now().Format(time.TimeOnly), prefix, strings.Join(cmd.Args, " "))
+	for _, line := range strings.SplitAfter(string(out), "\n") {
+		if line != "" {
+			fmt.Fprintf(l.f, "%s%s", prefix, strings.TrimSuffix(line, "\n")+"\n")
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(l.f, "%s(exit: %v)\n", prefix, err)
+	}
+}
+
+// Persist closes the log and moves it into the store under the build ID.
+func (l *buildLog) Persist(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.f.Flush()
+	l.file.Close()
+	return persistFile(l.path, logPath(id))
+}
+
+// maxLogTail caps ?tail=, so a request can't have the server hold more
+// than this many lines.
+const maxLogTail = 10000
+
+// buildLogHandler serves GET /v1/builds/{id}/log, optionally only the last
+// ?tail=N lines, at most maxLogTail.
+func buildLogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	if !buildIDPattern.MatchString(id) {
+		http.Error(w, "Invalid build id", http.StatusBadRequest)
+		return
+	}
+	tail := 0
+	if v := r.URL.Query().Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "tail must be a positive number", http.StatusBadRequest)
+			return
+		}
+		tail = min(n, maxLogTail)
+	}
+	f, err := os.Open(logPath(id))
+	if err != nil {
+		http.Error(w, "Log not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if tail == 0 {
+		http.ServeContent(w, r, id+".log", time.Time{}, f)
+		return
+	}
+
+	// Keep the last N lines in a ring, overwriting the oldest
+	ring := make([]string, tail)
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		ring[n%tail] = scanner.Text()
+		n++
+	}
+	for i := max(n-tail, 0); i < n; i++ {
+		fmt.Fprintln(w, ring[i%tail])
+	}
+}
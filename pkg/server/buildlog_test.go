@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The log serves whole, or its last ?tail= lines up to maxLogTail; a
+// tail that isn't a positive number is refused.
+func TestBuildLogTail(t *testing.T) {
+	useDataDir(t, t.TempDir())
+	usePolicy(t)
+	id := newBuildID()
+	var log strings.Builder
+	for i := 1; i <= maxLogTail+5; i++ {
+		fmt.Fprintf(&log, "line %d\n", i)
+	}
+	path := logPath(id)
+	os.MkdirAll(filepath.Dir(path), 0o755)
+	if err := os.WriteFile(path, []byte(log.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lines := func(from, to int) string {
+		var b strings.Builder
+		for i := from; i <= to; i++ {
+			fmt.Fprintf(&b, "line %d\n", i)
+		}
+		return b.String()
+	}
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"", http.StatusOK, log.String()},
+		{"?tail=1", http.StatusOK, lines(maxLogTail+5, maxLogTail+5)},
+		{"?tail=3", http.StatusOK, lines(maxLogTail+3, maxLogTail+5)},
+		{fmt.Sprintf("?tail=%d", maxLogTail), http.StatusOK, lines(6, maxLogTail+5)},
+		{"?tail=999999999", http.StatusOK, lines(6, maxLogTail+5)},
+		{"?tail=0", http.StatusBadRequest, ""},
+		{"?tail=-5", http.StatusBadRequest, ""},
+		{"?tail=lots", http.StatusBadRequest, ""},
+	} {
+		r := httptest.NewRequest("GET", "/v1/builds/"+id+"/log"+tc.query, nil)
+		r.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		buildLogHandler(w, r)
+		if w.Code != tc.code || (tc.code == http.StatusOK && w.Body.String() != tc.body) {
+			t.Errorf("%s: %d, %d bytes; want %d, %d bytes", tc.query, w.Code, w.Body.Len(), tc.code, len(tc.body))
+		}
+	}
+
+	// A log shorter than the tail comes back whole
+	short := newBuildID()
+	os.WriteFile(logPath(short), []byte("one\ntwo\n"), 0o644)
+	r := httptest.NewRequest("GET", "/v1/builds/"+short+"/log?tail=10", nil)
+	r.SetPathValue("id", short)
+	w := httptest.NewRecorder()
+	buildLogHandler(w, r)
+	if w.Body.String() != "one\ntwo\n" {
+		t.Errorf("tail of a short log: %q", w.Body)
+	}
+}
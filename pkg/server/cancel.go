@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Causes a build's context is cancelled with, besides errClientStalled.
+var (
+	errBuildCanceled = errors.New("canceled on request")
+	errShutdown      = errors.New("stopped because the server is shutting down")
+)
+
+// buildStops holds how to stop each build this process runs.
+var buildStops = struct {
+	sync.Mutex
+	stops map[string]context.CancelCauseFunc
+}{stops: map[string]context.CancelCauseFunc{}}
+
+// shuttingDown is set once Shutdown was called; no builds start after it.
+var shuttingDown atomic.Bool
+
+// trackBuild makes build id stoppable by stop until untrack is called.
+func trackBuild(id string, stop context.CancelCauseFunc) (untrack func()) {
+	buildStops.Lock()
+	buildStops.stops[id] = stop
+	buildStops.Unlock()
+	return func() {
+		buildStops.Lock()
+		delete(buildStops.stops, id)
+		buildStops.Unlock()
+	}
+}
+
+// cancelBuild stops build id with cause, reporting whether it was running.
+func cancelBuild(id string, cause error) bool {
+	buildStops.Lock()
+	defer buildStops.Unlock()
+	stop, ok := buildStops.stops[id]
+	if ok {
+		stop(cause)
+	}
+	return ok
+}
+
+// Shutdown stops the server taking builds and cancels the running ones,
+// whose streams end with reason "shutdown". Their journal entries stay
+// running, so the next start reports them interrupted or restarts them per
+// their resume_policy. It returns once they have ended, or ctx is done.
+func Shutdown(ctx context.Context) error {
+	shuttingDown.Store(true)
+	buildStops.Lock()
+	for _, stop := range buildStops.stops {
+		stop(errShutdown)
+	}
+	buildStops.Unlock()
+	for activeBuilds.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// cancelHandler serves POST /v1/builds/{id}/cancel. The admin token or the
+// credential that started the build may cancel it; its stream ends with
+// reason "canceled_by_user".
+func cancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	admin := isAdmin(r)
+	if !admin && !authorized(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	if !buildIDPattern.MatchString(id) {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	rec, err := loadJob(id)
+	if err != nil {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	by := callerID(r)
+	if admin {
+		by = "admin"
+	} else if by != rec.Caller {
+		http.Error(w, "Forbidden: only the admin token or the build's own credential may cancel it", http.StatusForbidden)
+		return
+	}
+	if !cancelBuild(id, fmt.Errorf("%w by %s", errBuildCanceled, by)) {
+		http.Error(w, "The build isn't running on this server", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(rec)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// commonHeaders are always probed in addition to those named by cgoRequirements.
+var commonHeaders = []string{"stdio.h", "stdlib.h", "pthread.h", "windows.h", "GL/gl.h", "X11/Xlib.h"}
+
+// CgoProbe is what the target C toolchain can compile and link against.
+type CgoProbe struct {
+	Target       string          `json:"target"`
+	CC           string          `json:"cc"`
+	CCAvailable  bool            `json:"cc_available"`
+	PkgConfig    string          `json:"pkg_config"`
+	Packages     []string        `json:"packages"`
+	Headers      map[string]bool `json:"headers"`
+	IncludeRoots []string        `json:"include_roots"`
+
+	mu sync.Mutex
+}
+
+var probes sync.Map // target -> *CgoProbe
+
+// probeToolchain inspects a toolchain once and caches the result; the
+// installed headers and packages don't change while the server runs.
+func probeToolchain(tc Toolchain) *CgoProbe {
+	target := tc.GOOS + "/" + tc.GOARCH
+	if p, ok := probes.Load(target); ok {
+		return p.(*CgoProbe)
+	}
+
+	p := &CgoProbe{
+		Target:    target,
+		CC:        tc.CC,
+		PkgConfig: tc.PkgConfig,
+		Packages:  []string{},
+		Headers:   make(map[string]bool),
+	}
+	_, err := exec.LookPath(tc.CC)
+	p.CCAvailable = err == nil
+	p.IncludeRoots = includeRoots(tc)
+
+	if out, err := exec.Command(tc.PkgConfig, "--list-all").Output(); err == nil {
+		scanner := bufio.NewScanner(strings.NewReader(string(out)))
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+				p.Packages = append(p.Packages, fields[0])
+			}
+		}
+		sort.Strings(p.Packages)
+	}
+
+	headers := append([]string{}, commonHeaders...)
+	for _, req := range cgoRequirements {
+		if req.OS == "" || req.OS == tc.GOOS {
+			headers = append(headers, req.Headers...)
+		}
+	}
+	for _, h := range headers {
+		p.hasHeader(tc, h)
+	}
+
+	actual, _ := probes.LoadOrStore(target, p)
+	return actual.(*CgoProbe)
+}
+
+// hasHeader reports whether header is usable, probing and recording it if
+// it hasn't been checked before.
+func (p *CgoProbe) hasHeader(tc Toolchain, header string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok, seen := p.Headers[header]; seen {
+		return ok
+	}
+	ok := p.CCAvailable && tc.hasHeader(header)
+	p.Headers[header] = ok
+	return ok
+}
+
+// hasPackage reports whether pkg-config lists pkg.
+func (p *CgoProbe) hasPackage(pkg string) bool {
+	i := sort.SearchStrings(p.Packages, pkg)
+	return i < len(p.Packages) && p.Packages[i] == pkg
+}
+
+// includeRoots parses the compiler's "#include <...> search starts here" list.
+func includeRoots(tc Toolchain) []string {
+	cmd := exec.Command(tc.CC, "-E", "-x", "c", "-", "-v")
+	cmd.Stdin = strings.NewReader("")
+	out, _ := cmd.CombinedOutput()
+
+	roots := []string{}
+	inList := false
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "#include <...>"):
+			inList = true
+		case strings.HasPrefix(line, "End of search list"):
+			inList = false
+		case inList:
+			roots = append(roots, strings.TrimSpace(line))
+		}
+	}
+	return roots
+}
+
+// cgoCapabilitiesHandler serves GET /v1/capabilities/cgo?target=os/arch.
+func cgoCapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+
+	goos, goarch, _ := strings.Cut(r.URL.Query().Get("target"), "/")
+	if goarch == "" {
+		goarch = "amd64"
+	}
+	tc, err := toolchainFor(goos, goarch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p := probeToolchain(tc)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// targetsHandler serves GET /v1/capabilities/targets.
+func targetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(callerTargets(callerID(r), availableTargets()))
+}
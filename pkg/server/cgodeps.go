@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// CgoRequirement lists the C headers and pkg-config packages a module needs
+// when built for a target OS. An empty OS applies to every target.
+type CgoRequirement struct {
+	Module      string   `json:"module"`
+	OS          string   `json:"os,omitempty"`
+	Headers     []string `json:"headers,omitempty"`
+	PkgConfig   []string `json:"pkg_config,omitempty"`
+	Description string   `json:"description"`
+}
+
+var x11Headers = []string{
+	"GL/gl.h",
+	"X11/Xlib.h",
+	"X11/Xcursor/Xcursor.h",
+	"X11/extensions/Xrandr.h",
+	"X11/extensions/Xinerama.h",
+	"X11/extensions/XInput2.h",
+	"X11/extensions/xf86vmode.h",
+}
+
+// cgoRequirements is the built-in table plus any WithCgoRequirements entries.
+var cgoRequirements = builtinCgoRequirements
+
+var builtinCgoRequirements = []CgoRequirement{
+	{Module: "fyne.io/fyne", OS: "linux", Headers: x11Headers, Description: "OpenGL and X11 development headers"},
+	{Module: "fyne.io/fyne", OS: "windows", Headers: []string{"GL/gl.h", "windows.h"}, Description: "mingw OpenGL headers"},
+	{Module: "github.com/go-gl/glfw", OS: "linux", Headers: x11Headers, Description: "OpenGL and X11 development headers"},
+	{Module: "github.com/go-gl/glfw", OS: "windows", Headers: []string{"GL/gl.h", "windows.h"}, Description: "mingw OpenGL headers"},
+	{Module: "github.com/mattn/go-sqlite3", Description: "nothing beyond a C compiler (sqlite is bundled)"},
+	{Module: "github.com/gotk3/gotk3", PkgConfig: []string{"gtk+-3.0"}, Description: "GTK 3 development packages"},
+	{Module: "github.com/webview/webview", OS: "linux", PkgConfig: []string{"gtk+-3.0", "webkit2gtk-4.0"}, Description: "GTK 3 and WebKit2GTK development packages"},
+	{Module: "github.com/google/gousb", PkgConfig: []string{"libusb-1.0"}, Description: "libusb development packages"},
+	{Module: "github.com/gordonklaus/portaudio", PkgConfig: []string{"portaudio-2.0"}, Description: "PortAudio development packages"},
+}
+
+// loadCgoRequirements reads extra requirements from a JSON file containing
+// an array of CgoRequirement.
+func loadCgoRequirements(path string) ([]CgoRequirement, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var extra []CgoRequirement
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return extra, nil
+}
+
+// matches reports whether the requirement applies to a module path and target.
+func (c CgoRequirement) matches(module, goos string) bool {
+	if c.OS != "" && c.OS != goos {
+		return false
+	}
+	return module == c.Module || strings.HasPrefix(module, c.Module+"/")
+}
+
+// moduleGraph lists every module path in the build list of the repository.
+func moduleGraph(repoPath string, env []string) ([]string, error) {
+	cmd := exec.Command("go", "list", "-m", "-f", "{{.Path}}", "all")
+	cmd.Dir = repoPath
+	cmd.Env = env
+	defer holdModCache(cmd)()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// checkCgoDeps returns one human-readable problem per unmet requirement.
+func checkCgoDeps(repoPath string, tc Toolchain) []string {
+	modules, err := moduleGraph(repoPath, tc.Env())
+	if err != nil {
+		log.Printf("Cgo dependency check skipped: %v", err)
+		return nil
+	}
+
+	probe := probeToolchain(tc)
+	var problems []string
+	for _, req := range cgoRequirements {
+		for _, mod := range modules {
+			if !req.matches(mod, tc.GOOS) {
+				continue
+			}
+			var missing []string
+			for _, h := range req.Headers {
+				if !probe.hasHeader(tc, h) {
+					missing = append(missing, h)
+				}
+			}
+			for _, p := range req.PkgConfig {
+				if !probe.hasPackage(p) {
+					missing = append(missing, "pkg-config "+p)
+				}
+			}
+			if len(missing) > 0 {
+				problems = append(problems, fmt.Sprintf("building with %s requires %s which are not installed on this server (missing: %s)",
+					req.Module, req.Description, strings.Join(missing, ", ")))
+			}
+			break
+		}
+	}
+	return problems
+}
+
+// hasHeader asks the target C compiler to preprocess an #include of header.
+func (t Toolchain) hasHeader(header string) bool {
+	cmd := exec.Command(t.CC, "-E", "-x", "c", "-")
+	cmd.Stdin = strings.NewReader("#include <" + header + ">\n")
+	return cmd.Run() == nil
+}
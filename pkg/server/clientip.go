@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// isTrustedProxy reports whether addr is inside one of the trusted proxy prefixes.
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, p := range currentPolicy().trustedProxies {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address a request came from. Forwarding headers are only
+// believed when the peer is a trusted proxy; the client is then the
+// rightmost hop that isn't one. A malformed hop stops the walk, since
+// anything to its left may have been written by the client.
+func clientIP(r *http.Request) netip.Addr {
+	peer := parseHost(r.RemoteAddr)
+	if !peer.IsValid() || !isTrustedProxy(peer) {
+		return peer
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr := parseHost(hops[i])
+		if !addr.IsValid() {
+			break
+		}
+		if !isTrustedProxy(addr) {
+			return addr
+		}
+		peer = addr
+	}
+	return peer
+}
+
+// forwardedFor lists the client chain, leftmost first, from X-Forwarded-For
+// or, if that's absent, the for= parameters of Forwarded (RFC 7239).
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, v := range h.Values("Forwarded") {
+		for _, elem := range strings.Split(v, ",") {
+			hop := "" // elements without for= are unusable hops
+			for _, pair := range strings.Split(elem, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(key, "for") {
+					hop = strings.Trim(value, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseHost reads an address with or without a port, including bracketed
+// IPv6. Anything else ("unknown", obfuscated names, garbage) is invalid.
+func parseHost(s string) netip.Addr {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
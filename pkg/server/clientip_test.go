@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	usePolicy(t, WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")))
+	for _, tc := range []struct {
+		name      string
+		peer      string
+		xff       []string
+		forwarded []string
+		want      string
+	}{
+		{name: "direct", peer: "203.0.113.7:5123", want: "203.0.113.7"},
+		{name: "direct ipv6", peer: "[2001:db8::7]:5123", want: "2001:db8::7"},
+		{name: "untrusted peer's headers ignored", peer: "203.0.113.7:5123", xff: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "untrusted peer's forwarded ignored", peer: "203.0.113.7:5123", forwarded: []string{"for=198.51.100.1"}, want: "203.0.113.7"},
+		{name: "one hop", peer: "10.0.0.2:80", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "trusted proxy without headers", peer: "10.0.0.2:80", want: "10.0.0.2"},
+		{name: "multi-hop through trusted proxies", peer: "10.0.0.2:80", xff: []string{"198.51.100.1, 10.0.0.9, 10.1.1.1"}, want: "198.51.100.1"},
+		{name: "spoofed leftmost hop", peer: "10.0.0.2:80", xff: []string{"1.1.1.1, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "spoofed hops behind untrusted", peer: "10.0.0.2:80", xff: []string{"1.1.1.1, 10.0.0.9, 198.51.100.1, 10.0.0.3"}, want: "198.51.100.1"},
+		{name: "headers split over lines", peer: "10.0.0.2:80", xff: []string{"1.1.1.1", "198.51.100.1", "10.0.0.3"}, want: "198.51.100.1"},
+		{name: "all hops trusted", peer: "10.0.0.2:80", xff: []string{"10.0.0.5, 10.0.0.4"}, want: "10.0.0.5"},
+		{name: "hop with port", peer: "10.0.0.2:80", xff: []string{"198.51.100.1:443"}, want: "198.51.100.1"},
+		{name: "bracketed ipv6 hop", peer: "10.0.0.2:80", xff: []string{"[2001:db8::1]"}, want: "2001:db8::1"},
+		{name: "ipv6 hop with port", peer: "10.0.0.2:80", xff: []string{"[2001:db8::1]:443"}, want: "2001:db8::1"},
+		{name: "ipv4-mapped trusted peer", peer: "[::ffff:10.0.0.2]:80", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "ipv4-mapped hop", peer: "10.0.0.2:80", xff: []string{"::ffff:198.51.100.1"}, want: "198.51.100.1"},
+		{name: "ipv6 trusted proxies", peer: "[fd00::2]:80", xff: []string{"198.51.100.1, fd00::9"}, want: "198.51.100.1"},
+
+		// Malformed hops stop the walk at the last address that can be believed
+		{name: "garbage rightmost", peer: "10.0.0.2:80", xff: []string{"198.51.100.1, garbage"}, want: "10.0.0.2"},
+		{name: "unknown rightmost", peer: "10.0.0.2:80", xff: []string{"198.51.100.1, unknown"}, want: "10.0.0.2"},
+		{name: "garbage behind trusted hop", peer: "10.0.0.2:80", xff: []string{"garbage, 10.0.0.9"}, want: "10.0.0.9"},
+		{name: "garbage left of the client", peer: "10.0.0.2:80", xff: []string{"garbage, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "empty hop", peer: "10.0.0.2:80", xff: []string{"198.51.100.1,,10.0.0.9"}, want: "10.0.0.9"},
+		{name: "empty header", peer: "10.0.0.2:80", xff: []string{""}, want: "10.0.0.2"},
+		{name: "trailing comma", peer: "10.0.0.2:80", xff: []string{"198.51.100.1,"}, want: "10.0.0.2"},
+		{name: "hostname hop", peer: "10.0.0.2:80", xff: []string{"evil.example.com"}, want: "10.0.0.2"},
+		{name: "cidr hop", peer: "10.0.0.2:80", xff: []string{"198.51.100.0/24"}, want: "10.0.0.2"},
+		{name: "overlong octet", peer: "10.0.0.2:80", xff: []string{"198.51.100.256"}, want: "10.0.0.2"},
+		{name: "leading zeros", peer: "10.0.0.2:80", xff: []string{"010.0.0.1"}, want: "10.0.0.2"},
+		{name: "ipv6 zone", peer: "10.0.0.2:80", xff: []string{"fe80::1%eth0, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "injected header text", peer: "10.0.0.2:80", xff: []string{"198.51.100.1\r\nX-Admin: 1"}, want: "10.0.0.2"},
+
+		// Forwarded (RFC 7239), used when X-Forwarded-For is absent
+		{name: "forwarded", peer: "10.0.0.2:80", forwarded: []string{"for=198.51.100.1;proto=https"}, want: "198.51.100.1"},
+		{name: "forwarded multi-hop", peer: "10.0.0.2:80", forwarded: []string{"for=1.1.1.1, for=198.51.100.1, for=10.0.0.9"}, want: "198.51.100.1"},
+		{name: "forwarded quoted ipv6 with port", peer: "10.0.0.2:80", forwarded: []string{`for="[2001:db8::1]:4711"`}, want: "2001:db8::1"},
+		{name: "forwarded case-insensitive key", peer: "10.0.0.2:80", forwarded: []string{"For=198.51.100.1"}, want: "198.51.100.1"},
+		{name: "forwarded obfuscated", peer: "10.0.0.2:80", forwarded: []string{"for=198.51.100.1, for=_hidden"}, want: "10.0.0.2"},
+		{name: "forwarded unknown", peer: "10.0.0.2:80", forwarded: []string{"for=unknown"}, want: "10.0.0.2"},
+		{name: "forwarded element without for", peer: "10.0.0.2:80", forwarded: []string{"for=198.51.100.1, proto=https;by=10.0.0.9"}, want: "10.0.0.2"},
+		{name: "forwarded empty", peer: "10.0.0.2:80", forwarded: []string{""}, want: "10.0.0.2"},
+		{name: "forwarded unterminated quote", peer: "10.0.0.2:80", forwarded: []string{`for="198.51.100.1`}, want: "198.51.100.1"},
+		{name: "xff wins over forwarded", peer: "10.0.0.2:80", xff: []string{"198.51.100.1"}, forwarded: []string{"for=198.51.100.2"}, want: "198.51.100.1"},
+
+		// Peers billder can't parse aren't trusted with anything
+		{name: "peer without port", peer: "10.0.0.2", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "unparseable peer", peer: "pipe", xff: []string{"198.51.100.1"}, want: "invalid IP"},
+		{name: "empty peer", peer: "", xff: []string{"198.51.100.1"}, want: "invalid IP"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.peer
+			for _, v := range tc.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			for _, v := range tc.forwarded {
+				r.Header.Add("Forwarded", v)
+			}
+			if got := clientIP(r); got.String() != tc.want {
+				t.Errorf("clientIP = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// Without trusted proxies, forwarding headers are never believed.
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	usePolicy(t)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:80"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	r.Header.Set("Forwarded", "for=198.51.100.2")
+	if got := clientIP(r); got.String() != "10.0.0.2" {
+		t.Errorf("clientIP = %s, want the peer", got)
+	}
+}
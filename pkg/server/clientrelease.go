@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// clientBinaryPattern matches the client binaries of a release directory:
+// billder_<os>_<arch>, with .exe for windows.
+var clientBinaryPattern = regexp.MustCompile(`^billder_([a-z0-9]+)_([a-z0-9]+)(\.exe)?$`)
+
+// ClientRelease is the GET /v1/client/latest response.
+type ClientRelease struct {
+	Version  string         `json:"version"`
+	Binaries []ClientBinary `json:"binaries"`
+}
+
+// ClientBinary is one platform's client in a ClientRelease.
+type ClientBinary struct {
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url"` // path of the download on this server
+
+	path string
+}
+
+// clientRelease reads the release in the configured client directory.
+func clientRelease() (ClientRelease, error) {
+	dir := cfg.ClientDir
+	data, err := os.ReadFile(filepath.Join(dir, "VERSION"))
+	if err != nil {
+		return ClientRelease{}, err
+	}
+	rel := ClientRelease{Version: strings.TrimSpace(string(data)), Binaries: []ClientBinary{}}
+	if rel.Version == "" {
+		return rel, errors.New("VERSION is empty")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return rel, err
+	}
+	for _, e := range entries {
+		m := clientBinaryPattern.FindStringSubmatch(e.Name())
+		info, err := e.Info()
+		if m == nil || err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		b := ClientBinary{OS: m[1], Arch: m[2], Name: e.Name(), Size: info.Size(), path: filepath.Join(dir, e.Name())}
+		f, err := os.Open(b.path)
+		if err != nil {
+			return rel, err
+		}
+		// The directory is updated in place, so the digest is cached by
+		// size and modification time too
+		b.SHA256, err = artifactDigest(fmt.Sprintf("%s %d %d", b.path, info.Size(), info.ModTime().UnixNano()), f)
+		f.Close()
+		if err != nil {
+			return rel, err
+		}
+		b.URL = "/" + apiVersion + "/client/latest/" + b.OS + "/" + b.Arch
+		rel.Binaries = append(rel.Binaries, b)
+	}
+	return rel, nil
+}
+
+// loadClientRelease is clientRelease for the handlers: it writes the error
+// response when this server hosts no release or can't read it.
+func loadClientRelease(w http.ResponseWriter) (ClientRelease, bool) {
+	if cfg.ClientDir == "" {
+		http.Error(w, "This server hosts no client releases", http.StatusNotFound)
+		return ClientRelease{}, false
+	}
+	rel, err := clientRelease()
+	if err != nil {
+		log.Printf("Client release in %s: %v", cfg.ClientDir, err)
+		http.Error(w, "Client release unavailable", http.StatusServiceUnavailable)
+		return rel, false
+	}
+	return rel, true
+}
+
+// clientReleaseHandler serves GET /v1/client/latest: the version of the
+// client this server hosts and the sha256 of each platform's binary.
+func clientReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	rel, ok := loadClientRelease(w)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rel)
+}
+
+// clientBinaryHandler serves GET /v1/client/latest/{os}/{arch}, the hosted
+// client for one platform. The ETag is its sha256.
+func clientBinaryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	rel, ok := loadClientRelease(w)
+	if !ok {
+		return
+	}
+	for _, b := range rel.Binaries {
+		if b.OS != r.PathValue("os") || b.Arch != r.PathValue("arch") {
+			continue
+		}
+		f, err := os.Open(b.path)
+		if err != nil {
+			http.Error(w, "Client binary not found", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, "Failed to read client binary", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"sha256:`+b.SHA256+`"`)
+		w.Header().Set("X-Billder-Version", rel.Version)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+b.Name+`"`)
+		http.ServeContent(w, r, b.Name, info.ModTime(), f)
+		return
+	}
+	http.Error(w, "No client binary for "+r.PathValue("os")+"/"+r.PathValue("arch"), http.StatusNotFound)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useClientDir serves the client release in dir for the length of the test.
+func useClientDir(t *testing.T, dir string) {
+	t.Helper()
+	prev := cfg
+	cfg.ClientDir = dir
+	t.Cleanup(func() { cfg = prev })
+}
+
+func TestClientReleaseEndpoints(t *testing.T) {
+	usePolicy(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/client/latest", clientReleaseHandler)
+	mux.HandleFunc("/v1/client/latest/{os}/{arch}", clientBinaryHandler)
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	useClientDir(t, "")
+	if rec := get("/v1/client/latest"); rec.Code != http.StatusNotFound {
+		t.Errorf("no client dir: %d, want 404", rec.Code)
+	}
+
+	dir := t.TempDir()
+	useClientDir(t, dir)
+	if rec := get("/v1/client/latest"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("no VERSION: %d, want 503", rec.Code)
+	}
+	files := map[string]string{
+		"VERSION":                    "v1.4.0\n",
+		"billder_linux_amd64":        "ELF linux client",
+		"billder_windows_amd64.exe":  "MZ windows client",
+		"billder_linux_amd64.sha256": "not a binary",
+		"README.md":                  "not a binary either",
+	}
+	for name, content := range files {
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	}
+	os.Mkdir(filepath.Join(dir, "billder_darwin_arm64"), 0o755)
+
+	rec := get("/v1/client/latest")
+	var rel ClientRelease
+	if err := json.NewDecoder(rec.Body).Decode(&rel); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("latest: %d, %v", rec.Code, err)
+	}
+	if rel.Version != "v1.4.0" || len(rel.Binaries) != 2 {
+		t.Fatalf("release %+v, want v1.4.0 with 2 binaries", rel)
+	}
+	byPlatform := map[string]ClientBinary{}
+	for _, b := range rel.Binaries {
+		byPlatform[b.OS+"/"+b.Arch] = b
+	}
+	win := byPlatform["windows/amd64"]
+	sum := sha256.Sum256([]byte(files[win.Name]))
+	if win.Name != "billder_windows_amd64.exe" || win.SHA256 != hex.EncodeToString(sum[:]) ||
+		win.Size != int64(len(files[win.Name])) || win.URL != "/v1/client/latest/windows/amd64" {
+		t.Errorf("windows binary %+v", win)
+	}
+
+	rec = get(win.URL)
+	body, _ := io.ReadAll(rec.Body)
+	if rec.Code != http.StatusOK || string(body) != files[win.Name] {
+		t.Fatalf("download: %d %q", rec.Code, body)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag != `"sha256:`+win.SHA256+`"` || rec.Header().Get("X-Billder-Version") != "v1.4.0" {
+		t.Errorf("download headers %v", rec.Header())
+	}
+	if rec := get(win.URL, "If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("repeat download: %d, want 304", rec.Code)
+	}
+	if rec := get(win.URL, "Range", "bytes=3-"); rec.Code != http.StatusPartialContent || rec.Body.String() != files[win.Name][3:] {
+		t.Errorf("range: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/v1/client/latest/darwin/arm64"); rec.Code != http.StatusNotFound {
+		t.Errorf("platform without a binary: %d, want 404", rec.Code)
+	}
+
+	// The directory is updated in place; the digest follows the file
+	os.WriteFile(filepath.Join(dir, win.Name), []byte("MZ windows client, patched"), 0o644)
+	rec = get("/v1/client/latest")
+	json.NewDecoder(rec.Body).Decode(&rel)
+	for _, b := range rel.Binaries {
+		if b.Name == win.Name && b.SHA256 == win.SHA256 {
+			t.Error("the sha256 of a replaced binary was served from the cache")
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rexlx/bilder/pkg/client"
+)
+
+const (
+	heartbeatInterval = 10 * time.Second
+	workerTTL         = 3 * heartbeatInterval // workers silent for longer are ignored
+)
+
+// activeBuilds counts builds running locally; workers report it as busy.
+var activeBuilds atomic.Int64
+
+// WorkerInfo is what a worker reports in its registration heartbeat.
+type WorkerInfo struct {
+	ID      string   `json:"id"`
+	URL     string   `json:"url"`
+	Targets []string `json:"targets"`
+	Busy    bool     `json:"busy"`
+
+	lastSeen   time.Time
+	dispatched bool // a build is in flight from this coordinator
+}
+
+// coordinator tracks registered workers and dispatches builds to them.
+type coordinator struct {
+	token string
+
+	mu      sync.Mutex
+	workers map[string]*WorkerInfo
+	builds  map[string]*workerBuild // by build ID
+}
+
+// workerBuild is a build a worker runs for a client of this coordinator,
+// whose events are proxied from the worker.
+type workerBuild struct {
+	url     string    // the worker's
+	expires time.Time // zero while the build runs
+}
+
+// cluster is non-nil when the server runs with --role coordinator.
+var cluster *coordinator
+
+func newCoordinator(token string) *coordinator {
+	return &coordinator{token: token, workers: make(map[string]*WorkerInfo), builds: make(map[string]*workerBuild)}
+}
+
+// registerHandler serves POST /v1/cluster/register for worker heartbeats.
+func (c *coordinator) registerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Billder-Cluster-Token")), []byte(c.token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var info WorkerInfo
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody)).Decode(&info); err != nil || info.ID == "" || info.URL == "" {
+		http.Error(w, "Invalid registration", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev, ok := c.workers[info.ID]; ok {
+		info.dispatched = prev.dispatched
+	} else {
+		log.Printf("Worker %s registered at %s (%s)", info.ID, info.URL, strings.Join(info.Targets, ", "))
+	}
+	info.lastSeen = time.Now()
+	c.workers[info.ID] = &info
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// claim picks an idle, live worker that can build every target and marks it dispatched.
+func (c *coordinator) claim(targets []string) *WorkerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, wk := range c.workers {
+		if wk.Busy || wk.dispatched || time.Since(wk.lastSeen) > workerTTL {
+			continue
+		}
+		if !slices.ContainsFunc(targets, func(t string) bool { return !slices.Contains(wk.Targets, t) }) {
+			wk.dispatched = true
+			return wk
+		}
+	}
+	return nil
+}
+
+// release returns a worker to the pool, or drops it after a failure.
+func (c *coordinator) release(wk *WorkerInfo, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if failed {
+		delete(c.workers, wk.ID)
+		return
+	}
+	wk.dispatched = false
+}
+
+// track records that the build id runs on wk.
+func (c *coordinator) track(id string, wk *WorkerInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.builds[id] = &workerBuild{url: wk.URL}
+}
+
+// untrack forgets the build id once the worker no longer buffers its
+// events.
+func (c *coordinator) untrack(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.builds[id]; ok {
+		b.expires = time.Now().Add(finishedBuildRetention)
+	}
+}
+
+// owner returns the URL of the worker running the build id, if any.
+func (c *coordinator) owner(id string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for bid, b := range c.builds {
+		if !b.expires.IsZero() && now.After(b.expires) {
+			delete(c.builds, bid)
+		}
+	}
+	b, ok := c.builds[id]
+	if !ok {
+		return "", false
+	}
+	return b.url, true
+}
+
+// proxyEvents serves a request for the events of a build a worker runs
+// from that worker. It reports false if no worker runs the build.
+func (c *coordinator) proxyEvents(w http.ResponseWriter, r *http.Request) bool {
+	owner, ok := c.owner(r.PathValue("id"))
+	if !ok {
+		return false
+	}
+	target, err := url.Parse(owner)
+	if err != nil {
+		return false
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) { pr.SetURL(target) },
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Proxying %s to its worker: %v", r.URL.Path, err)
+			http.Error(w, "Worker unavailable", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	return true
+}
+
+// workerRefusal is a worker's 4xx answer to a build. The request is at
+// fault rather than the worker, so it goes back to the client.
+type workerRefusal struct {
+	status      int
+	contentType string
+	retryAfter  string
+	body        []byte
+}
+
+func (e *workerRefusal) Error() string {
+	return fmt.Sprintf("worker refused the build: %d %s", e.status, bytes.TrimSpace(e.body))
+}
+
+// relay answers the client with the refusal, or ends the stream with it
+// once the stream has begun.
+func (e *workerRefusal) relay(w http.ResponseWriter, sse *sseWriter, streaming bool) {
+	if streaming {
+		sse.Message(fmt.Sprintf("Error: %s", e.Error()))
+		sse.Close(StreamEnd{Category: FailInvalidRequest, Reason: EndError, Message: fmt.Sprintf("Build refused (%d)", e.status)})
+		return
+	}
+	h := w.Header()
+	h.Del("Cache-Control")
+	h.Del("Connection")
+	h.Set("Content-Type", e.contentType)
+	if e.retryAfter != "" {
+		h.Set("Retry-After", e.retryAfter)
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// dispatch tries to run the build on a worker, proxying its stream back to
+// the client. A worker that fails before sending artifact bytes, by not
+// answering or with a 5xx, is dropped and the job requeued; a 4xx is the
+// client's to see. It reports false when no worker took the job; the
+// caller then builds locally with r.Body rewound.
+func (c *coordinator) dispatch(w http.ResponseWriter, r *http.Request) bool {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMultipartBody))
+	if bodyTimedOut(w, r, err) {
+		return true
+	} else if err != nil {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		return true
+	}
+	rewind := func() { r.Body = io.NopCloser(bytes.NewReader(body)) }
+	defer rewind()
+
+	// Peek at the targets; invalid or restricted payloads are left to the local
+	// path to report
+	rewind()
+	payload, raw, profile, err := readPayload(w, r)
+	var defaults []AppliedDefault
+	if err == nil {
+		defaults, err = applyRepoDefaults(&payload, raw, cfg.RepoDefaults)
+	}
+	if err != nil || payload.normalize(profile != nil) != nil || payload.DryRun {
+		return false
+	}
+	if field, _ := restriction(callerID(r), payload, profile != nil, defaults); field != "" {
+		return false
+	}
+
+	var sse *sseWriter
+	streaming := false // a requeue warning went out
+	for {
+		wk := c.claim(payload.Targets)
+		if wk == nil {
+			return false
+		}
+		if sse == nil {
+			var ok bool
+			if sse, ok = newSSEWriter(w); !ok {
+				c.release(wk, false)
+				return false
+			}
+			sse.legacy = requestProtocol(r) == "legacy"
+		}
+		log.Printf("Dispatching %s [%s] to worker %s", payload.RepoURL, strings.Join(payload.Targets, ", "), wk.ID)
+		started, err := c.proxyBuild(sse, r, body, wk)
+		gone := errors.Is(err, errClientGone)
+		var refusal *workerRefusal
+		refused := errors.As(err, &refusal)
+		c.release(wk, err != nil && !gone && !refused)
+		if err == nil {
+			return true
+		}
+		if refused {
+			log.Printf("Worker %s: %v", wk.ID, err)
+			refusal.relay(w, sse, streaming)
+			return true
+		}
+		if gone {
+			log.Printf("Client of the build on worker %s went away", wk.ID)
+			return true
+		}
+		log.Printf("Worker %s failed: %v", wk.ID, err)
+		if started {
+			// Artifact bytes already reached the client; nothing to retry.
+			return true
+		}
+		sse.Message(fmt.Sprintf("Warning: worker %s failed, requeueing build...", wk.ID))
+		streaming = true
+	}
+}
+
+// proxyBuild forwards the build request to a worker and relays its SSE and
+// binary stream onto sse, an event block at a time. started reports whether
+// the artifact was being relayed; errClientGone means the client stopped
+// receiving, which isn't the worker's fault, and a *workerRefusal that the
+// worker answered 4xx. The build's events_url is served from the worker
+// while it buffers them.
+func (c *coordinator) proxyBuild(sse *sseWriter, r *http.Request, body []byte, wk *WorkerInfo) (started bool, err error) {
+	// The worker answers on the caller's route, so the stream is the one it asked for
+	route := "/" + apiVersion + "/build"
+	if requestProtocol(r) == "legacy" {
+		route = "/build"
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "POST", strings.TrimSuffix(wk.URL, "/")+route, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+	for _, h := range []string{"traceparent", "X-Billder-Token", client.HeaderKeyID, client.HeaderTimestamp, client.HeaderSignature} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxJSONBody))
+		return false, &workerRefusal{status: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), retryAfter: resp.Header.Get("Retry-After"), body: body}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("worker returned %s", resp.Status)
+	}
+
+	// Relay events until the switch to binary mode
+	reader := bufio.NewReader(resp.Body)
+	var block []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		block = append(block, line...)
+		if err == io.EOF {
+			if len(block) > 0 {
+				sse.relay(block)
+			}
+			if sse.Gone() {
+				return false, errClientGone
+			}
+			return false, nil // build finished without an artifact
+		} else if err != nil {
+			return false, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) > 0 {
+			continue
+		}
+		if slices.ContainsFunc(bytes.Split(block, []byte("\n")), func(l []byte) bool { return bytes.HasPrefix(l, []byte("event: binary_start")) }) {
+			break
+		}
+		if id := jobID(block); id != "" {
+			c.track(id, wk)
+			defer c.untrack(id)
+		}
+		sse.relay(block)
+		block = nil
+		if sse.Gone() {
+			return false, errClientGone
+		}
+	}
+
+	// Raw artifact bytes follow the binary_start block
+	if _, err := sse.binary(block, reader); err != nil {
+		if sse.Gone() {
+			return true, errClientGone
+		}
+		return true, err
+	}
+	return true, nil
+}
+
+// jobID returns the build ID of a "job" event block, or "".
+func jobID(block []byte) string {
+	var data []byte
+	job := false
+	for _, line := range bytes.Split(block, []byte("\n")) {
+		if bytes.Equal(line, []byte("event: job")) {
+			job = true
+		} else if d, ok := bytes.CutPrefix(line, []byte("data: ")); ok {
+			data = d
+		}
+	}
+	var started JobStarted
+	if !job || json.Unmarshal(data, &started) != nil {
+		return ""
+	}
+	return started.BuildID
+}
+
+// RunWorker registers this instance with the coordinator and keeps the
+// registration alive with periodic heartbeats. It never returns; call it in
+// a goroutine after New.
+func RunWorker(id, coordinatorURL, advertiseURL, token string) {
+	var targets []string
+	for _, t := range currentPolicy().targets {
+		goos, goarch, _ := strings.Cut(t, "/")
+		if tc, err := toolchainFor(goos, goarch); err == nil {
+			if _, err := exec.LookPath(tc.CC); err == nil {
+				targets = append(targets, t)
+			}
+		}
+	}
+
+	url := strings.TrimSuffix(coordinatorURL, "/") + "/" + apiVersion + "/cluster/register"
+	for {
+		info := WorkerInfo{ID: id, URL: advertiseURL, Targets: targets, Busy: activeBuilds.Load() > 0}
+		data, _ := json.Marshal(info)
+		req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Billder-Cluster-Token", token)
+			var resp *http.Response
+			if resp, err = http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusNoContent {
+					err = fmt.Errorf("coordinator returned %s", resp.Status)
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Heartbeat to %s failed: %v", coordinatorURL, err)
+		}
+		time.Sleep(heartbeatInterval)
+	}
+}
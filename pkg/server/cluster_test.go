@@ -0,0 +1,213 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The cluster token is compared whole; only the exact secret registers.
+func TestClusterTokenChecked(t *testing.T) {
+	c := newCoordinator("cluster-secret")
+	for _, token := range []string{"", "cluster-secre", "cluster-secret2", "CLUSTER-SECRET"} {
+		r := httptest.NewRequest("POST", "/v1/cluster/register", strings.NewReader(`{"id":"w1","url":"http://w1"}`))
+		r.Header.Set("X-Billder-Cluster-Token", token)
+		w := httptest.NewRecorder()
+		c.registerHandler(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d, want 401", token, w.Code)
+		}
+	}
+	r := httptest.NewRequest("POST", "/v1/cluster/register", strings.NewReader(`{"id":"w1","url":"http://w1","targets":["linux/amd64"]}`))
+	r.Header.Set("X-Billder-Cluster-Token", "cluster-secret")
+	w := httptest.NewRecorder()
+	c.registerHandler(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want 204", w.Code)
+	}
+	if wk := c.claim([]string{"linux/amd64"}); wk == nil || wk.ID != "w1" {
+		t.Errorf("registered worker not claimable: %+v", wk)
+	}
+}
+
+// workerStream is what a worker answers a build with: events, then the
+// artifact.
+const workerStream = "event: status\ndata: {\"message\":\"Step 1/3: cloning\"}\n\n" +
+	"event: step\ndata: {\"index\":1,\"total\":3,\"name\":\"clone\"}\n\n" +
+	"event: summary\ndata: {\"ok\":true}\n\n" +
+	"sha256: 00ff\nsize: 9\nevent: binary_start\ndata: app\n\n" +
+	"ARTIFACT!"
+
+// fakeWorker serves stream, with status, as a worker's /v1/build, and
+// names the build whose events are asked for.
+func fakeWorker(t *testing.T, status int, stream string) *WorkerInfo {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/builds/"), "/events"); ok {
+			io.WriteString(w, "events of "+id+" from "+r.Header.Get("Last-Event-ID"))
+			return
+		}
+		if r.URL.Path != "/v1/build" {
+			http.NotFound(w, r)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(status)
+		io.WriteString(w, stream)
+	}))
+	t.Cleanup(srv.Close)
+	return &WorkerInfo{ID: "w1", URL: srv.URL}
+}
+
+func TestProxyBuildRelaysStream(t *testing.T) {
+	wk := fakeWorker(t, http.StatusOK, workerStream)
+	w := httptest.NewRecorder()
+	started, err := newCoordinator("").proxyBuild(newTestSSE(t, w), httptest.NewRequest("POST", "/v1/build", nil), []byte("{}"), wk)
+	if err != nil || !started {
+		t.Fatalf("proxyBuild = %v, %v; want started, nil", started, err)
+	}
+	if got := w.Body.String(); got != workerStream {
+		t.Errorf("relayed\n%q\nwant\n%q", got, workerStream)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type %q", ct)
+	}
+}
+
+func TestProxyBuildWithoutArtifact(t *testing.T) {
+	stream := "event: status\ndata: {\"message\":\"failed\"}\n\nevent: end\ndata: {\"ok\":false}\n\n"
+	wk := fakeWorker(t, http.StatusOK, stream)
+	w := httptest.NewRecorder()
+	started, err := newCoordinator("").proxyBuild(newTestSSE(t, w), httptest.NewRequest("POST", "/v1/build", nil), []byte("{}"), wk)
+	if err != nil || started {
+		t.Fatalf("proxyBuild = %v, %v; want not started, nil", started, err)
+	}
+	if w.Body.String() != stream {
+		t.Errorf("relayed %q", w.Body.String())
+	}
+}
+
+func TestProxyBuildWorkerRefuses(t *testing.T) {
+	wk := fakeWorker(t, http.StatusServiceUnavailable, "busy")
+	w := httptest.NewRecorder()
+	started, err := newCoordinator("").proxyBuild(newTestSSE(t, w), httptest.NewRequest("POST", "/v1/build", nil), []byte("{}"), wk)
+	if err == nil || started || errors.Is(err, errClientGone) {
+		t.Fatalf("proxyBuild = %v, %v; want a worker error", started, err)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("wrote %q for a refused build", w.Body)
+	}
+}
+
+// A worker's 4xx is the request's fault: it comes back as is rather than
+// as a worker error.
+func TestProxyBuildWorkerRefusal(t *testing.T) {
+	wk := fakeWorker(t, http.StatusForbidden, `{"error":"target not allowed"}`)
+	w := httptest.NewRecorder()
+	_, err := newCoordinator("").proxyBuild(newTestSSE(t, w), httptest.NewRequest("POST", "/v1/build", nil), []byte("{}"), wk)
+	var refusal *workerRefusal
+	if !errors.As(err, &refusal) || refusal.status != http.StatusForbidden || string(refusal.body) != `{"error":"target not allowed"}` {
+		t.Fatalf("proxyBuild err %v, want the refusal", err)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("wrote %q for a refused build", w.Body)
+	}
+}
+
+// dispatchTo has c dispatch a build to the worker wk, the only one. It
+// reports false if the build was left to run locally.
+func dispatchTo(c *coordinator, wk *WorkerInfo) (*httptest.ResponseRecorder, bool) {
+	wk.Targets, wk.lastSeen = []string{"linux/amd64"}, time.Now()
+	c.workers[wk.ID] = wk
+	r := httptest.NewRequest("POST", "/v1/build", strings.NewReader(`{"repo_url":"github.com/acme/app","targets":["linux/amd64"]}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	return w, c.dispatch(w, r)
+}
+
+// Workers that fail are dropped, leaving the build to run locally; those
+// that refuse a build stay, and the client gets their answer.
+func TestDispatchWorkerErrors(t *testing.T) {
+	usePolicy(t)
+	for _, tc := range []struct {
+		status  int
+		dropped bool
+	}{
+		{http.StatusUnprocessableEntity, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, true},
+		{http.StatusServiceUnavailable, true},
+	} {
+		c := newCoordinator("")
+		w, dispatched := dispatchTo(c, fakeWorker(t, tc.status, `{"error":"no"}`))
+		_, kept := c.workers["w1"]
+		if kept == tc.dropped || dispatched == tc.dropped {
+			t.Errorf("%d: worker kept %v, build dispatched %v; want %v", tc.status, kept, dispatched, !tc.dropped)
+		}
+		if tc.dropped {
+			continue
+		}
+		if w.Code != tc.status || w.Body.String() != `{"error":"no"}` {
+			t.Errorf("%d: client got %d %q", tc.status, w.Code, w.Body)
+		}
+		if c.claim([]string{"linux/amd64"}) == nil {
+			t.Errorf("%d: worker not released", tc.status)
+		}
+	}
+}
+
+// The events_url of a dispatched build is served from the worker running
+// it, until the worker stops buffering its events.
+func TestDispatchedBuildEvents(t *testing.T) {
+	usePolicy(t)
+	prev := cluster
+	t.Cleanup(func() { cluster = prev })
+	cluster = newCoordinator("")
+	job := "event: job\ndata: {\"build_id\":\"b1\",\"events_url\":\"/v1/builds/b1/events\"}\n\n"
+	if _, ok := dispatchTo(cluster, fakeWorker(t, http.StatusOK, job+workerStream)); !ok {
+		t.Fatal("the build wasn't dispatched")
+	}
+
+	events := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/v1/builds/"+id+"/events", nil)
+		r.SetPathValue("id", id)
+		r.Header.Set("Last-Event-ID", "3")
+		w := httptest.NewRecorder()
+		buildEventsHandler(w, r)
+		return w
+	}
+	if w := events("b1"); w.Code != http.StatusOK || w.Body.String() != "events of b1 from 3" {
+		t.Errorf("events of the dispatched build: %d %q", w.Code, w.Body)
+	}
+	if w := events("b2"); w.Code != http.StatusNotFound {
+		t.Errorf("events of an unknown build: %d", w.Code)
+	}
+	cluster.builds["b1"].expires = time.Now().Add(-time.Second)
+	if w := events("b1"); w.Code != http.StatusNotFound {
+		t.Errorf("events past the worker's retention: %d", w.Code)
+	}
+}
+
+// A client that goes away is told apart from a worker that fails, at any
+// point of the stream.
+func TestProxyBuildClientGone(t *testing.T) {
+	binaryAt, artifactAt := strings.Index(workerStream, "sha256:"), strings.Index(workerStream, "ARTIFACT")
+	for _, limit := range []int{0, 10, 60, binaryAt - 1, artifactAt - 1, artifactAt + 3} {
+		wk := fakeWorker(t, http.StatusOK, workerStream)
+		w := newBrokenWriter(limit)
+		started, err := newCoordinator("").proxyBuild(newTestSSE(t, w), httptest.NewRequest("POST", "/v1/build", nil), []byte("{}"), wk)
+		if !errors.Is(err, errClientGone) {
+			t.Errorf("limit %d: err %v, want errClientGone", limit, err)
+		}
+		if wantStarted := limit >= binaryAt; started != wantStarted {
+			t.Errorf("limit %d: started %v, want %v", limit, started, wantStarted)
+		}
+		if w.body.Len() > limit {
+			t.Errorf("limit %d: %d bytes written", limit, w.body.Len())
+		}
+	}
+}
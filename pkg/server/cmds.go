@@ -0,0 +1,162 @@
+package server
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// CmdResult is one command of a build_all_cmds build, in the target's
+// summary and in the manifest.json delivered with the binaries.
+type CmdResult struct {
+	Name     string          `json:"name"` // the cmd/ directory, and the binary's name without .exe
+	OK       bool            `json:"ok"`
+	Error    string          `json:"error,omitempty"`
+	Category FailureCategory `json:"error_category,omitempty"`
+	Binary   string          `json:"binary,omitempty"`
+	Size     int64           `json:"size,omitempty"`
+	SHA256   string          `json:"sha256,omitempty"`
+}
+
+// CmdManifest is manifest.json in the zip of a build_all_cmds build.
+type CmdManifest struct {
+	Target string      `json:"target"`
+	Commit string      `json:"commit,omitempty"`
+	Cmds   []CmdResult `json:"cmds"`
+}
+
+// findCmds lists the directories under cmd/ in dir that hold a main
+// package.
+func findCmds(dir string) []string {
+	entries, _ := os.ReadDir(filepath.Join(dir, "cmd"))
+	var cmds []string
+	for _, e := range entries {
+		if e.IsDir() && !skipDir(e.Name()) && isMainPackage(filepath.Join(dir, "cmd", e.Name())) {
+			cmds = append(cmds, e.Name())
+		}
+	}
+	return cmds
+}
+
+// selectCmds settles the commands a build_all_cmds build compiles, failing
+// the build when there are none or more than the server allows.
+func (j *buildJob) selectCmds(sse *sseWriter) error {
+	cmds := findCmds(j.moduleDir)
+	switch {
+	case len(cmds) == 0:
+		return failedWith(FailInvalidRequest, fmt.Errorf("build_all_cmds is set, but cmd/ holds no main packages"))
+	case len(cmds) > cfg.MaxCmdsPerBuild:
+		return failedWith(FailInvalidRequest, fmt.Errorf("cmd/ holds %d commands, more than the %d this server builds at once", len(cmds), cfg.MaxCmdsPerBuild))
+	}
+	j.cmds = cmds
+	sse.Message(fmt.Sprintf("Building %d command(s): %s", len(cmds), strings.Join(cmds, ", ")))
+	return nil
+}
+
+// buildCmds compiles every command for the target into outDir, one after
+// the other in the target's compile slot, and bundles the binaries with a
+// manifest. A failure stops the rest under cmd_failure "fail_fast" and is
+// reported with the others under "best_effort"; either way a target with
+// any failure isn't OK, and res.partial says whether what built is still
+// delivered.
+func (j *buildJob) buildCmds(tc Toolchain, ts *targetStream, outDir, ldflags string, res targetResult) targetResult {
+	manifest := CmdManifest{Target: ts.target, Commit: j.vcs.Commit}
+	var firstFailure FailureCategory
+	for i, name := range j.cmds {
+		binary := filepath.Join(outDir, name)
+		if tc.GOOS == "windows" {
+			binary += ".exe"
+		}
+		cmd := exec.CommandContext(j.ctx, "go", goBuildArgs(binary, ldflags, j.pgoPath, j.payload.CompilerOptions, "./cmd/"+name)...)
+		cmd.Dir = j.moduleDir
+		cmd.Env = tc.Env()
+		log.Println("Running build command:", cmd.Args)
+		out, err := j.runCompile(tc, ts, cmd, func(stream, line string) {
+			ts.Output(3, stream, line)
+		})
+		diags, text := parseBuildOutput(out)
+		j.log.Command("["+ts.target+"] ", cmd, []byte(text), err)
+
+		result := CmdResult{Name: name}
+		if err == nil {
+			result.Binary = filepath.Base(binary)
+			result.Size, result.SHA256, err = fileDigest(binary)
+			if err != nil {
+				result.Binary, result.Category = "", FailInternal
+			}
+		} else if j.ctx.Err() != nil {
+			res.summary.Error, res.summary.Category = j.stopReason(), FailTimeout
+			ts.Message("Error: " + j.stopReason())
+			return res
+		} else {
+			for _, d := range diags {
+				d.Target = ts.target
+				ts.Event("diagnostic", d)
+			}
+			result.Category = compileFailure(text, err)
+			if hint := j.sparseHint(text); hint != "" {
+				ts.Message(hint)
+			}
+			err = fmt.Errorf("compilation failed with %d diagnostic(s)", len(diags))
+			if len(diags) == 0 {
+				err = fmt.Errorf("go build failed: %s", lastLine(text))
+			}
+		}
+		if err != nil {
+			result.Error = err.Error()
+			firstFailure = cmp.Or(firstFailure, result.Category)
+			ts.Message(fmt.Sprintf("Error: cmd/%s: %s", name, result.Error))
+			j.log.Printf("[%s] cmd/%s error (%s): %s", ts.target, name, result.Category, result.Error)
+			manifest.Cmds = append(manifest.Cmds, result)
+			if j.payload.CmdFailure == "fail_fast" {
+				for _, skipped := range j.cmds[i+1:] {
+					manifest.Cmds = append(manifest.Cmds, CmdResult{Name: skipped, Error: "not built: cmd/" + name + " failed first"})
+				}
+				break
+			}
+			continue
+		}
+		result.OK = true
+		ts.Message(fmt.Sprintf("Built cmd/%s (%.2f MB)", name, float64(result.Size)/1024/1024))
+		manifest.Cmds = append(manifest.Cmds, result)
+		res.files = append(res.files, zipEntry{Name: result.Binary, Path: binary})
+	}
+
+	res.summary.Cmds = manifest.Cmds
+	built := len(res.files)
+	if built < len(j.cmds) {
+		res.summary.Error = fmt.Sprintf("%d of %d command(s) failed to build", len(j.cmds)-built, len(j.cmds))
+		res.summary.Category = firstFailure
+		ts.Message("Error: " + res.summary.Error)
+		res.partial = built > 0 && j.payload.CmdFailure != "fail_fast"
+		if !res.partial {
+			res.files = nil
+			return res
+		}
+	}
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	res.files = append(res.files, zipEntry{Name: "manifest.json", Data: append(data, '\n')})
+	res.summary.OK = res.summary.Error == ""
+	res.summary.LDFlags = ldflags
+	return res
+}
+
+// fileDigest is the size and hex sha256 of the file at path.
+func fileDigest(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	return n, hex.EncodeToString(h.Sum(nil)), err
+}
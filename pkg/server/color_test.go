@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStripANSI(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain line":                                          "plain line",
+		"\x1b[31merror\x1b[0m: bad":                           "error: bad",
+		"\x1b[1;38;5;196mbold red\x1b[m":                      "bold red",
+		"\x1b[38;2;255;0;0mtrue color\x1b[39m":                "true color",
+		"\x1b[2K\x1b[1Gprogress 50%":                          "progress 50%",
+		"\x1b[?25lhidden cursor\x1b[?25h":                     "hidden cursor",
+		"\x1b]0;window title\x07text":                         "text",
+		"\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\": "link",
+		"\x1b(Bcharset \x1b[m\x1b(B":                          "charset ",
+		"\x1bMreverse index":                                  "reverse index",
+
+		// Cut off at the end of the line, as by a killed process
+		"warning: cut \x1b":         "warning: cut ",
+		"warning: cut \x1b[":        "warning: cut ",
+		"warning: cut \x1b[38;5;1":  "warning: cut ",
+		"warning: cut \x1b]8;;http": "warning: cut ",
+		"warning: cut \x1b(":        "warning: cut ",
+
+		// Not escapes
+		"[31m without ESC": "[31m without ESC",
+		"100% done":        "100% done",
+	} {
+		if got := stripANSI(in); got != want {
+			t.Errorf("stripANSI(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// colorOutput is what the helper process prints: lines dense with ANSI
+// sequences, one cut off when the process ends.
+var colorOutput = map[string]string{
+	"stdout": "\x1b[1m\x1b[32mok\x1b[0m  \x1b[36mfixture.test/app\x1b[0m 0.01s\n" +
+		"\x1b]8;;https://example.com/doc\x1b\\see the docs\x1b]8;;\x1b\\ for details\n" +
+		"\x1b[38;2;10;200;30mgenerated 12 files\x1b[39m\n" +
+		"truncated: \x1b[38;5;",
+	"stderr": "\x1b[33mwarning:\x1b(B\x1b[0m deprecated flag \x1b[1m-x\x1b[22m\n" +
+		"\x1b[2K\x1b[1G[3/10] linking\n",
+}
+
+// colorChunk, in the environment of a test binary, has it print
+// colorOutput in chunks of that many bytes.
+const colorChunk = "BILLDER_TEST_COLOR_CHUNK"
+
+func TestColorHelperProcess(t *testing.T) {
+	size, err := strconv.Atoi(os.Getenv(colorChunk))
+	if err != nil {
+		t.Skip("started by TestChunkedColorOutput")
+	}
+	for _, stream := range []string{"stderr", "stdout"} {
+		f := map[string]*os.File{"stdout": os.Stdout, "stderr": os.Stderr}[stream]
+		out := colorOutput[stream]
+		for i := 0; i < len(out); i += size {
+			f.WriteString(out[i:min(i+size, len(out))])
+			time.Sleep(time.Millisecond) // one read each
+		}
+	}
+	os.Exit(0)
+}
+
+// Colored output written in chunks that split its escape sequences
+// anywhere reaches the client whole: stripped by default, unchanged when
+// the request keeps color.
+func TestChunkedColorOutput(t *testing.T) {
+	want := map[bool]map[string][]string{
+		false: {
+			"stdout": {"ok  fixture.test/app 0.01s", "see the docs for details", "generated 12 files", "truncated: "},
+			"stderr": {"warning: deprecated flag -x", "[3/10] linking"},
+		},
+		true: {},
+	}
+	for stream, out := range colorOutput {
+		want[true][stream] = strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	}
+	for _, size := range []int{1, 2, 3, 5, 8, 13, 64, 1 << 10} {
+		for _, keep := range []bool{false, true} {
+			t.Run(fmt.Sprintf("chunks of %d keep %v", size, keep), func(t *testing.T) {
+				w := httptest.NewRecorder()
+				sse := newTestSSE(t, w)
+				ts := &targetStream{sseWriter: sse, target: "linux/amd64", keepColor: keep}
+				cmd := exec.Command(os.Args[0], "-test.run=^TestColorHelperProcess$")
+				cmd.Env = append(os.Environ(), colorChunk+"="+strconv.Itoa(size))
+				if out, err := runStreaming(cmd, func(stream, line string) { ts.Output(2, stream, line) }); err != nil {
+					t.Fatalf("%v: %s", err, out)
+				}
+				sse.Close(streamEnd(true, "", nil))
+
+				got := map[string][]string{}
+				for _, ev := range parseSSE(w.Body.String()) {
+					if ev.name != "output" {
+						continue
+					}
+					var o OutputLine
+					if err := json.Unmarshal([]byte(ev.data), &o); err != nil {
+						t.Fatal(err)
+					}
+					got[o.Stream] = append(got[o.Stream], strings.Split(o.Line, "\n")...)
+				}
+				for stream, lines := range want[keep] {
+					if strings.Join(got[stream], "\n") != strings.Join(lines, "\n") {
+						t.Errorf("%s forwarded as\n%q\nwant\n%q", stream, got[stream], lines)
+					}
+				}
+			})
+		}
+	}
+}
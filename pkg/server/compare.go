@@ -0,0 +1,255 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CompareReport is how the binary built from the requested ref differs
+// from the one built from compare_ref. Deltas are the requested ref's size
+// minus compare_ref's, so growth is positive.
+type CompareReport struct {
+	CompareRef    string         `json:"compare_ref"`
+	CompareCommit string         `json:"compare_commit,omitempty"`
+	Bytes         int64          `json:"bytes"`         // the requested ref's binary
+	CompareBytes  int64          `json:"compare_bytes"` // compare_ref's binary
+	Delta         int64          `json:"delta_bytes"`
+	Sections      []SizeDelta    `json:"sections"`
+	Modules       []ModuleChange `json:"modules"`         // modules added, removed or at another version
+	Error         string         `json:"error,omitempty"` // set when compare_ref didn't build; nothing was compared
+}
+
+// SizeDelta is the size of a section in both binaries.
+type SizeDelta struct {
+	Name         string `json:"name"`
+	Bytes        int64  `json:"bytes"`
+	CompareBytes int64  `json:"compare_bytes"`
+	Delta        int64  `json:"delta_bytes"`
+}
+
+// ModuleChange is a dependency whose version differs between the binaries,
+// per `go version -m`. A replaced module has its replacement's version.
+type ModuleChange struct {
+	Path           string `json:"path"`
+	Version        string `json:"version,omitempty"`         // empty when compare_ref's binary alone has it
+	CompareVersion string `json:"compare_version,omitempty"` // empty when the requested ref's binary alone has it
+}
+
+// prepareCompare sets up the build of compare_ref: a worktree of the clone
+// at that ref, with its dependencies resolved, in a workspace of its own.
+// It is built like the requested ref, without the request's patch.
+func (j *buildJob) prepareCompare(host *gitHost, tc Toolchain, sse *sseWriter) (*buildJob, error) {
+	if j.packager != "go" {
+		return nil, failedWith(FailInvalidRequest, fmt.Errorf("compare_ref compares go build binaries, but this repository is packaged with %s; set packager \"go\"", j.packager))
+	}
+	ref := j.payload.CompareRef
+	commit, err := j.fetchRef(host, ref, sse)
+	if err != nil {
+		return nil, err
+	}
+
+	p := j.payload
+	p.Ref, p.CompareRef, p.Patch = ref, "", ""
+	p.SizeReport, p.LicenseReport, p.AVCheck, p.SplitDebug = false, false, false, false
+	c := &buildJob{ctx: j.ctx, payload: p, id: j.id, started: j.started, log: j.log, trace: j.trace, packager: j.packager, comparing: true}
+	c.tmpDir = filepath.Join(j.tmpDir, "compare")
+	c.repoPath = filepath.Join(c.tmpDir, "src")
+	worktree := exec.CommandContext(j.ctx, "git", "worktree", "add", "--quiet", "--detach", c.repoPath, commit)
+	worktree.Dir = j.repoPath
+	out, err := worktree.CombinedOutput()
+	j.log.Command("", worktree, out, err)
+	if err != nil {
+		return nil, fmt.Errorf("checking out compare_ref %q failed: %s", ref, strings.TrimSpace(string(out)))
+	}
+	c.vcs = resolveVCS(c.repoPath)
+	c.vcs.Branch = ref
+	sse.Message(fmt.Sprintf("Compare ref %s: %s (%s)", ref, c.vcs.Commit, c.vcs.Describe))
+
+	rel, _ := filepath.Rel(j.repoPath, j.moduleDir)
+	c.moduleDir = filepath.Join(c.repoPath, rel)
+	if _, err := os.Stat(filepath.Join(c.moduleDir, "go.mod")); err != nil {
+		return nil, failedWith(FailInvalidRequest, fmt.Errorf("compare_ref %q has no go.mod in %s", ref, filepath.ToSlash(rel)))
+	}
+	c.runRetrying(sse, "Module download", func() *exec.Cmd {
+		tidyCmd := exec.CommandContext(j.ctx, "go", "mod", "tidy")
+		tidyCmd.Dir = c.moduleDir
+		tidyCmd.Env = tc.Env()
+		return tidyCmd
+	}) // best effort, like the requested ref's
+
+	// An uploaded profile applies to both; "auto" uses each ref's own
+	c.pgoPath = j.pgoPath
+	if p.PGO == "auto" {
+		c.pgoPath = filepath.Join(c.moduleDir, "default.pgo")
+		if _, err := os.Stat(c.pgoPath); err != nil {
+			c.pgoPath = ""
+		}
+	}
+	return c, nil
+}
+
+// compare builds compare_ref, prepared as c, for the target res built and
+// adds the comparison to res. A compare_ref that doesn't build is reported
+// without failing the build.
+func (j *buildJob) compare(c *buildJob, tc Toolchain, ts *targetStream, res *targetResult) {
+	ref := c.payload.Ref
+	ts.Message(fmt.Sprintf("Building compare_ref %s (%s) to compare with", ref, shortCommit(c.vcs.Commit)))
+	base := c.buildTarget(tc, &targetStream{sseWriter: ts.sseWriter, target: "compare " + ref, prefix: true, keepColor: ts.keepColor})
+	report := &CompareReport{CompareRef: ref, CompareCommit: c.vcs.Commit}
+	res.summary.Compare = report
+	if !base.summary.OK {
+		report.Error = base.summary.Error
+		ts.Message(fmt.Sprintf("Warning: compare_ref %s didn't build; no comparison: %s", ref, report.Error))
+		return
+	}
+	if err := report.compare(res.files[0].Path, base.files[0].Path); err != nil {
+		report.Error = err.Error()
+		ts.Message("Warning: comparison failed: " + report.Error)
+		return
+	}
+	ts.Text("report", report.Lines())
+	res.files = append(res.files, zipEntry{Name: "compare_report.txt", Data: []byte(strings.Join(report.Lines(), "\n") + "\n")})
+	if j.payload.Deliver == "both" {
+		for _, f := range base.files {
+			f.Name = "compare/" + f.Name
+			res.files = append(res.files, f)
+		}
+	}
+}
+
+// compare fills in the report from the two binaries.
+func (r *CompareReport) compare(binary, base string) error {
+	for _, f := range []struct {
+		path string
+		size *int64
+	}{{binary, &r.Bytes}, {base, &r.CompareBytes}} {
+		stat, err := os.Stat(f.path)
+		if err != nil {
+			return err
+		}
+		*f.size = stat.Size()
+	}
+	r.Delta = r.Bytes - r.CompareBytes
+
+	sections, err := binarySections(binary)
+	if err != nil {
+		return err
+	}
+	baseSections, err := binarySections(base)
+	if err != nil {
+		return err
+	}
+	deltas := map[string]*SizeDelta{}
+	for _, s := range sections {
+		deltas[s.Name] = &SizeDelta{Name: s.Name, Bytes: s.Bytes}
+	}
+	for _, s := range baseSections {
+		if deltas[s.Name] == nil {
+			deltas[s.Name] = &SizeDelta{Name: s.Name}
+		}
+		deltas[s.Name].CompareBytes = s.Bytes
+	}
+	r.Sections = []SizeDelta{}
+	for _, d := range deltas {
+		d.Delta = d.Bytes - d.CompareBytes
+		r.Sections = append(r.Sections, *d)
+	}
+	sort.Slice(r.Sections, func(a, b int) bool {
+		da, db := abs(r.Sections[a].Delta), abs(r.Sections[b].Delta)
+		if da != db {
+			return da > db
+		}
+		return r.Sections[a].Name < r.Sections[b].Name
+	})
+
+	mods, err := binaryModules(binary)
+	if err != nil {
+		return err
+	}
+	baseMods, err := binaryModules(base)
+	if err != nil {
+		return err
+	}
+	r.Modules = []ModuleChange{}
+	for path, version := range mods {
+		if baseMods[path] != version {
+			r.Modules = append(r.Modules, ModuleChange{Path: path, Version: version, CompareVersion: baseMods[path]})
+		}
+	}
+	for path, version := range baseMods {
+		if _, ok := mods[path]; !ok {
+			r.Modules = append(r.Modules, ModuleChange{Path: path, CompareVersion: version})
+		}
+	}
+	sort.Slice(r.Modules, func(a, b int) bool { return r.Modules[a].Path < r.Modules[b].Path })
+	return nil
+}
+
+// binaryModules reads the dependencies recorded in a Go binary, as `go
+// version -m` prints them, mapped to their versions. A replaced module has
+// its replacement's path and version, e.g. "=> ./lib".
+func binaryModules(binary string) (map[string]string, error) {
+	out, err := exec.Command("go", "version", "-m", binary).Output()
+	if err != nil {
+		return nil, fmt.Errorf("go version -m: %v", err)
+	}
+	mods := map[string]string{}
+	last := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		// "\tdep\tpath\tversion\tsum", then "\t=>\tpath\tversion\tsum" if replaced
+		fields := strings.Split(strings.TrimPrefix(line, "\t"), "\t")
+		switch {
+		case len(fields) >= 3 && fields[0] == "dep":
+			last = fields[1]
+			mods[last] = fields[2]
+		case len(fields) >= 2 && fields[0] == "=>" && last != "":
+			mods[last] = strings.TrimSpace("=> " + strings.Join(fields[1:min(len(fields), 3)], " "))
+		}
+	}
+	return mods, nil
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Lines formats the report for streaming as progress messages.
+func (r *CompareReport) Lines() []string {
+	lines := []string{fmt.Sprintf("Compared with %s (%s):", r.CompareRef, shortCommit(r.CompareCommit))}
+	lines = append(lines, fmt.Sprintf("  %-20s %10.2f KB %+10.2f KB (%s)", "binary", float64(r.Bytes)/1024, float64(r.Delta)/1024, percent(r.Delta, r.CompareBytes)))
+	for _, s := range r.Sections {
+		if s.Delta != 0 {
+			lines = append(lines, fmt.Sprintf("  %-20s %10.2f KB %+10.2f KB", s.Name, float64(s.Bytes)/1024, float64(s.Delta)/1024))
+		}
+	}
+	if len(r.Modules) == 0 {
+		return append(lines, "Modules: unchanged")
+	}
+	lines = append(lines, fmt.Sprintf("Modules: %d changed", len(r.Modules)))
+	for _, m := range r.Modules {
+		switch {
+		case m.CompareVersion == "":
+			lines = append(lines, fmt.Sprintf("  + %s %s", m.Path, m.Version))
+		case m.Version == "":
+			lines = append(lines, fmt.Sprintf("  - %s %s", m.Path, m.CompareVersion))
+		default:
+			lines = append(lines, fmt.Sprintf("  ~ %s %s -> %s", m.Path, m.CompareVersion, m.Version))
+		}
+	}
+	return lines
+}
+
+// percent is delta as a signed percentage of base.
+func percent(delta, base int64) string {
+	if base == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.1f%%", float64(delta)*100/float64(base))
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// CompilerOptions are the compiler settings a request may change. They
+// stand in for raw -gcflags, -race and -msan arguments, which aren't
+// accepted.
+type CompilerOptions struct {
+	DisableOptimizations bool `json:"disable_optimizations"` // -gcflags=all=-N, for debuggers such as delve
+	DisableInlining      bool `json:"disable_inlining"`      // -gcflags=all=-l
+	Race                 bool `json:"race"`                  // -race; the server's own platform only, with cgo
+	MSan                 bool `json:"msan"`                  // -msan; linux/amd64 or linux/arm64 as the server's own platform, with cgo and clang
+}
+
+// hostTarget is the platform the server runs on, the only one race and
+// msan builds can target: both link a C runtime built for the target.
+var hostTarget = runtime.GOOS + "/" + runtime.GOARCH
+
+// args are the go build arguments for the options.
+func (o *CompilerOptions) args() []string {
+	if o == nil {
+		return nil
+	}
+	var gcflags, args []string
+	if o.DisableOptimizations {
+		gcflags = append(gcflags, "-N")
+	}
+	if o.DisableInlining {
+		gcflags = append(gcflags, "-l")
+	}
+	if len(gcflags) > 0 {
+		args = append(args, "-gcflags=all="+strings.Join(gcflags, " "))
+	}
+	if o.Race {
+		args = append(args, "-race")
+	}
+	if o.MSan {
+		args = append(args, "-msan")
+	}
+	return args
+}
+
+// set reports whether any option is chosen.
+func (o *CompilerOptions) set() bool {
+	return o != nil && *o != CompilerOptions{}
+}
+
+// race reports whether the build is race-instrumented.
+func (o *CompilerOptions) race() bool {
+	return o != nil && o.Race
+}
+
+// problems lists why the options can't apply to p.
+func (o *CompilerOptions) problems(p *RequestPayload) []string {
+	if !o.set() {
+		return nil
+	}
+	var problems []string
+	if p.Packager == "fyne" {
+		problems = append(problems, "compiler_options apply to go build and can't be combined with packager \"fyne\"")
+	}
+	if o.Race && o.MSan {
+		problems = append(problems, "compiler_options race and msan can't be combined")
+	}
+	for _, t := range []struct {
+		on   bool
+		name string
+	}{{o.Race, "race"}, {o.MSan, "msan"}} {
+		if !t.on {
+			continue
+		}
+		for _, target := range p.Targets {
+			if target != hostTarget {
+				problems = append(problems, fmt.Sprintf("compiler_options %s links a C runtime built for the target, so it only works for this server's own platform, %s; %s is a cross build", t.name, hostTarget, target))
+			}
+		}
+		if !p.cgo() {
+			problems = append(problems, fmt.Sprintf("compiler_options %s needs cgo; it can't be combined with \"cgo\": false", t.name))
+		}
+	}
+	if o.MSan {
+		if hostTarget != "linux/amd64" && hostTarget != "linux/arm64" {
+			problems = append(problems, fmt.Sprintf("compiler_options msan is only supported on linux/amd64 and linux/arm64, not this server's %s", hostTarget))
+		} else if _, err := exec.LookPath("clang"); err != nil {
+			problems = append(problems, "compiler_options msan needs clang, which this server lacks")
+		}
+	}
+	return problems
+}
@@ -0,0 +1,643 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rexlx/bilder/internal/docfile"
+)
+
+// Config is the startup configuration of the billder command, read from the
+// JSON or YAML file named by BILLDER_CONFIG. Each field can be overridden by
+// the environment variable in its env tag. Unset fields keep the defaults.
+type Config struct {
+	AuthToken         string   `json:"auth_token,omitempty" env:"AUTH_TOKEN"`
+	TokensFile        string   `json:"tokens_file,omitempty" env:"TOKENS_FILE"`
+	AuthMaxSkew       string   `json:"auth_max_skew,omitempty" env:"AUTH_MAX_SKEW"`
+	OIDCAudience      string   `json:"oidc_audience,omitempty" env:"OIDC_AUDIENCE"`
+	OIDCAllowedEmails []string `json:"oidc_allowed_emails,omitempty" env:"OIDC_ALLOWED_EMAILS"`
+
+	MaxConcurrentCompiles *int   `json:"max_concurrent_compiles,omitempty" env:"MAX_CONCURRENT_COMPILES"`
+	BuildTimeout          string `json:"build_timeout,omitempty" env:"BUILD_TIMEOUT"`
+	BodyTimeout           string `json:"body_timeout,omitempty" env:"BODY_TIMEOUT"`
+	WriteTimeout          string `json:"write_timeout,omitempty" env:"WRITE_TIMEOUT"`
+	StepRetries           *int   `json:"step_retries,omitempty" env:"STEP_RETRIES"`
+	RetryBackoff          string `json:"retry_backoff,omitempty" env:"RETRY_BACKOFF"`
+
+	CacheDir      string `json:"cache_dir,omitempty" env:"BILLDER_CACHE_DIR"`
+	MirrorDir     string `json:"mirror_dir,omitempty" env:"BILLDER_MIRROR_DIR"`
+	DataDir       string `json:"data_dir,omitempty" env:"BILLDER_DATA_DIR"`
+	HistoryFile   string `json:"history_file,omitempty" env:"BILLDER_HISTORY"`
+	StoreTTL      string `json:"store_ttl,omitempty" env:"STORE_TTL"`
+	StoreMaxMB    *int   `json:"store_max_mb,omitempty" env:"STORE_MAX_MB"`
+	StorePerRepo  *int   `json:"store_max_per_repo,omitempty" env:"STORE_MAX_PER_REPO"`
+	MaxArtifactMB *int   `json:"max_artifact_mb,omitempty" env:"MAX_ARTIFACT_MB"`
+	MaxCmds       *int   `json:"max_cmds_per_build,omitempty" env:"MAX_CMDS_PER_BUILD"`
+	MaxLFSMB      *int   `json:"max_lfs_mb,omitempty" env:"MAX_LFS_MB"`
+	MaxTargets    *int   `json:"max_targets,omitempty" env:"MAX_TARGETS"`
+	MaxBodyKB     *int   `json:"max_body_kb,omitempty" env:"MAX_BODY_KB"`
+	ClamdSocket   string `json:"clamd_socket,omitempty" env:"CLAMD_SOCKET"`
+	ClientDir     string `json:"client_dir,omitempty" env:"BILLDER_CLIENT_DIR"`
+
+	GoProxy       string `json:"go_proxy,omitempty" env:"BILLDER_GOPROXY"`
+	GoSumDB       string `json:"go_sumdb,omitempty" env:"BILLDER_GOSUMDB"`
+	GoFlags       string `json:"go_flags,omitempty" env:"BILLDER_GOFLAGS"`
+	ModProxy      bool   `json:"mod_proxy,omitempty" env:"BILLDER_MOD_PROXY"`
+	ModProxyMaxMB *int   `json:"mod_proxy_max_mb,omitempty" env:"BILLDER_MOD_PROXY_MAX_MB"`
+
+	AndroidKeystore     string `json:"android_keystore,omitempty" env:"ANDROID_KEYSTORE"`
+	AndroidKeyAlias     string `json:"android_key_alias,omitempty" env:"ANDROID_KEY_ALIAS"`
+	AndroidKeystorePass string `json:"android_keystore_pass,omitempty" env:"ANDROID_KEYSTORE_PASS"`
+	AttestationKey      string `json:"attestation_key,omitempty" env:"ATTESTATION_KEY"`
+	AttestationKeyFile  string `json:"attestation_key_file,omitempty" env:"ATTESTATION_KEY_FILE"`
+	EventBufferEvents   *int   `json:"event_buffer_events,omitempty" env:"EVENT_BUFFER_EVENTS"`
+	EventBufferKB       *int   `json:"event_buffer_kb,omitempty" env:"EVENT_BUFFER_KB"`
+	OutputEventsPerSec  *int   `json:"output_events_per_sec,omitempty" env:"OUTPUT_EVENTS_PER_SEC"`
+	OutputKBPerSec      *int   `json:"output_kb_per_sec,omitempty" env:"OUTPUT_KB_PER_SEC"`
+
+	MaxResponseMB      *int `json:"max_response_mb,omitempty" env:"MAX_RESPONSE_MB"` // detected on Cloud Run; 0 means no limit
+	MaxResponseSeconds *int `json:"max_response_seconds,omitempty" env:"MAX_RESPONSE_SECONDS"`
+
+	AllowedTargets []string `json:"allowed_targets,omitempty" env:"ALLOWED_TARGETS"`
+	CgoDepsFile    string   `json:"cgo_deps_file,omitempty" env:"CGO_DEPS_FILE"`
+	RedactSecrets  []string `json:"redact_secrets,omitempty" env:"REDACT_SECRETS"`
+
+	RateLimitPerMin       int      `json:"rate_limit_per_min,omitempty" env:"RATE_LIMIT_PER_MIN"`
+	RateLimitBurst        int      `json:"rate_limit_burst,omitempty" env:"RATE_LIMIT_BURST"`
+	RateLimitGlobalPerMin int      `json:"rate_limit_global_per_min,omitempty" env:"RATE_LIMIT_GLOBAL_PER_MIN"`
+	TrustedProxies        []string `json:"trusted_proxies,omitempty" env:"TRUSTED_PROXIES"`
+
+	AdminToken string `json:"admin_token,omitempty" env:"ADMIN_TOKEN"`
+	FakeBuilds bool   `json:"fake_builds,omitempty" env:"BILLDER_FAKE_BUILDS"`
+	SelfTest   string `json:"self_test,omitempty" env:"SELF_TEST"` // off, on or required
+
+	PublicBadges bool `json:"public_badges,omitempty" env:"PUBLIC_BADGES"`
+
+	ArtifactBackend   string `json:"artifact_backend,omitempty" env:"ARTIFACT_BACKEND"` // stream, s3 or gcs
+	ArtifactURLTTL    string `json:"artifact_url_ttl,omitempty" env:"ARTIFACT_URL_TTL"`
+	S3Endpoint        string `json:"s3_endpoint,omitempty" env:"S3_ENDPOINT"`
+	S3Bucket          string `json:"s3_bucket,omitempty" env:"S3_BUCKET"`
+	S3Region          string `json:"s3_region,omitempty" env:"S3_REGION"`
+	S3AccessKeyID     string `json:"s3_access_key_id,omitempty" env:"S3_ACCESS_KEY_ID"`
+	S3SecretAccessKey string `json:"s3_secret_access_key,omitempty" env:"S3_SECRET_ACCESS_KEY"`
+	S3PathStyle       bool   `json:"s3_path_style,omitempty" env:"S3_PATH_STYLE"`
+
+	OTLPEndpoint string `json:"otlp_endpoint,omitempty" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	EventSink    string `json:"event_sink,omitempty" env:"EVENT_SINK"`
+
+	Schedules []Schedule `json:"schedules,omitempty"` // config file only
+	Hosts     []GitHost  `json:"hosts,omitempty"`     // config file only
+
+	Repos []RepoDefaults `json:"repos,omitempty"` // config file only
+
+	path   string            // config file, for error messages
+	data   []byte            // its contents, to find key lines
+	source map[string]string // json key -> env var that set it
+}
+
+// LoadConfig reads the BILLDER_CONFIG file, if any, applies environment
+// overrides and validates the result. Errors name every bad key.
+func LoadConfig() (Config, error) {
+	var c Config
+	if path := os.Getenv("BILLDER_CONFIG"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		if err := docfile.Decode(path, data, &c); err != nil {
+			return c, err
+		}
+		c.path, c.data = path, data
+	}
+	if err := c.applyEnv(); err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+// applyEnv overrides fields whose env variable is set. Lists are
+// comma-separated.
+func (c *Config) applyEnv() error {
+	c.source = map[string]string{}
+	v := reflect.ValueOf(c).Elem()
+	for i := range v.NumField() {
+		f := v.Type().Field(i)
+		name := f.Tag.Get("env")
+		value, ok := os.LookupEnv(name)
+		if name == "" || !ok || value == "" {
+			continue
+		}
+		key := jsonKey(f)
+		c.source[key] = name
+		field := v.Field(i)
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(value)
+		case []string:
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		case int, *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: must be an integer, got %q", name, value)
+			}
+			if field.Kind() == reflect.Pointer {
+				field.Set(reflect.ValueOf(&n))
+			} else {
+				field.SetInt(int64(n))
+			}
+		case bool:
+			field.SetBool(value == "1" || value == "true")
+		}
+	}
+	return nil
+}
+
+func jsonKey(f reflect.StructField) string {
+	key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return key
+}
+
+// where names a key the way the user set it: its env variable, or its line
+// in the config file.
+func (c Config) where(key string) string {
+	if env, ok := c.source[key]; ok {
+		return env
+	}
+	if line := docfile.Line(c.path, c.data, key); line > 0 {
+		return fmt.Sprintf("%s:%d: %s", c.path, line, key)
+	}
+	return key
+}
+
+// Validate checks ranges and formats, reporting every problem at once.
+func (c Config) Validate() error {
+	var errs []error
+	bad := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", c.where(key), fmt.Sprintf(format, args...)))
+	}
+	for key, d := range map[string]string{
+		"auth_max_skew":    c.AuthMaxSkew,
+		"build_timeout":    c.BuildTimeout,
+		"body_timeout":     c.BodyTimeout,
+		"write_timeout":    c.WriteTimeout,
+		"retry_backoff":    c.RetryBackoff,
+		"store_ttl":        c.StoreTTL,
+		"artifact_url_ttl": c.ArtifactURLTTL,
+	} {
+		if d == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d); err != nil || v <= 0 {
+			bad(key, "must be a positive duration like 15m, got %q", d)
+		}
+	}
+	for key, n := range map[string]*int{
+		"max_concurrent_compiles": c.MaxConcurrentCompiles,
+		"store_max_mb":            c.StoreMaxMB,
+		"store_max_per_repo":      c.StorePerRepo,
+		"max_artifact_mb":         c.MaxArtifactMB,
+		"max_cmds_per_build":      c.MaxCmds,
+		"max_lfs_mb":              c.MaxLFSMB,
+		"event_buffer_events":     c.EventBufferEvents,
+		"event_buffer_kb":         c.EventBufferKB,
+		"output_events_per_sec":   c.OutputEventsPerSec,
+		"output_kb_per_sec":       c.OutputKBPerSec,
+		"mod_proxy_max_mb":        c.ModProxyMaxMB,
+	} {
+		if n != nil && *n < 1 {
+			bad(key, "must be at least 1, got %d", *n)
+		}
+	}
+	if c.MaxTargets != nil && (*c.MaxTargets < 1 || *c.MaxTargets > maxMaxTargets) {
+		bad("max_targets", "must be between 1 and %d, got %d", maxMaxTargets, *c.MaxTargets)
+	}
+	if c.MaxBodyKB != nil && (*c.MaxBodyKB < minMaxBody>>10 || *c.MaxBodyKB > maxMaxBody>>10) {
+		bad("max_body_kb", "must be between %d and %d, got %d", minMaxBody>>10, maxMaxBody>>10, *c.MaxBodyKB)
+	}
+	if c.StepRetries != nil && (*c.StepRetries < 0 || *c.StepRetries > 10) {
+		bad("step_retries", "must be between 0 and 10, got %d", *c.StepRetries)
+	}
+	for key, n := range map[string]int{
+		"rate_limit_per_min":        c.RateLimitPerMin,
+		"rate_limit_burst":          c.RateLimitBurst,
+		"rate_limit_global_per_min": c.RateLimitGlobalPerMin,
+	} {
+		if n < 0 {
+			bad(key, "must not be negative, got %d", n)
+		}
+	}
+	for key, n := range map[string]*int{
+		"max_response_mb":      c.MaxResponseMB,
+		"max_response_seconds": c.MaxResponseSeconds,
+	} {
+		if n != nil && *n < 0 {
+			bad(key, "must not be negative, got %d", *n)
+		}
+	}
+	if c.AndroidKeystore != "" && c.AndroidKeyAlias == "" {
+		bad("android_key_alias", "required when android_keystore is set")
+	}
+	if c.AttestationKey != "" && c.AttestationKeyFile != "" {
+		bad("attestation_key", "set attestation_key or attestation_key_file, not both")
+	} else if c.AttestationKey != "" {
+		if _, err := parseAttestationKey([]byte(c.AttestationKey)); err != nil {
+			bad("attestation_key", "%v", err)
+		}
+	}
+	if c.OIDCAudience != "" && len(c.OIDCAllowedEmails) == 0 {
+		bad("oidc_allowed_emails", "required when oidc_audience is set")
+	}
+	for _, t := range c.AllowedTargets {
+		if !slices.Contains(builtinTargets, t) {
+			bad("allowed_targets", "unknown target %q; built-in targets are %s", t, strings.Join(builtinTargets, ", "))
+		}
+	}
+	for _, p := range c.TrustedProxies {
+		if _, err := netip.ParsePrefix(p); err != nil {
+			bad("trusted_proxies", "%q is not a CIDR", p)
+		}
+	}
+	for _, entry := range strings.FieldsFunc(c.GoProxy, func(r rune) bool { return r == ',' || r == '|' }) {
+		if entry == "direct" || entry == "off" {
+			continue
+		}
+		if u, err := url.Parse(entry); err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file") {
+			bad("go_proxy", "entries must be http(s) or file URLs, direct or off, got %q", entry)
+		}
+	}
+	for _, f := range strings.Fields(c.GoFlags) {
+		if !strings.HasPrefix(f, "-") {
+			bad("go_flags", "must be space-separated flags like -mod=mod, got %q", f)
+		}
+	}
+	if c.OTLPEndpoint != "" {
+		if u, err := url.Parse(c.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			bad("otlp_endpoint", "must be an http(s) URL like http://collector:4318, got %q", c.OTLPEndpoint)
+		}
+	}
+	if c.SelfTest != "" && c.SelfTest != "off" && c.SelfTest != "on" && c.SelfTest != "required" {
+		bad("self_test", "must be off, on or required, got %q", c.SelfTest)
+	}
+	if _, err := newPublisher(c.EventSink); err != nil {
+		bad("event_sink", "%v", err)
+	}
+	if _, err := newBlobStore(c.ArtifactBackend, c.s3()); err != nil {
+		bad("artifact_backend", "%v", err)
+	}
+	if d, err := time.ParseDuration(c.ArtifactURLTTL); err == nil && d > blobMaxURLTTL {
+		bad("artifact_url_ttl", "must be at most %s, the longest a presigned URL lives, got %q", blobMaxURLTTL, c.ArtifactURLTTL)
+	}
+	names := map[string]bool{}
+	for i, s := range c.Schedules {
+		if !scheduleNamePattern.MatchString(s.Name) {
+			bad("schedules", "entry %d: name %q must be letters, digits, '.', '_' or '-'", i+1, s.Name)
+		} else if names[s.Name] {
+			bad("schedules", "name %q is used twice", s.Name)
+		}
+		names[s.Name] = true
+		if _, err := parseCron(s.Cron); err != nil {
+			bad("schedules", "%s: %v", s.Name, err)
+		}
+		if err := s.Build.normalize(false); err != nil {
+			bad("schedules", "%s: build: %v", s.Name, err)
+		}
+	}
+	hosts := map[string]bool{}
+	for i, h := range c.Hosts {
+		name := strings.ToLower(h.Host)
+		if !hostPattern.MatchString(h.Host) {
+			bad("hosts", "entry %d: host %q must be a hostname with an optional port", i+1, h.Host)
+		} else if hosts[name] {
+			bad("hosts", "host %q is listed twice", h.Host)
+		}
+		hosts[name] = true
+		if _, ok := providers[h.Provider]; !ok {
+			bad("hosts", "%s: provider must be github, gitlab, bitbucket, gitea or generic, got %q", h.Host, h.Provider)
+		}
+		if h.Scheme != "" && h.Scheme != "http" && h.Scheme != "https" {
+			bad("hosts", "%s: scheme must be http or https, got %q", h.Host, h.Scheme)
+		}
+		switch {
+		case h.TokenEnv != "" && h.TokenFile != "":
+			bad("hosts", "%s: set token_env or token_file, not both", h.Host)
+		case h.TokenEnv != "" && os.Getenv(h.TokenEnv) == "":
+			bad("hosts", "%s: token_env %s is not set", h.Host, h.TokenEnv)
+		case h.TokenFile != "":
+			if _, err := os.Stat(h.TokenFile); err != nil {
+				bad("hosts", "%s: token_file: %v", h.Host, err)
+			}
+		}
+		if h.APIBase != "" {
+			if u, err := url.Parse(h.APIBase); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				bad("hosts", "%s: api_base must be an http(s) URL, got %q", h.Host, h.APIBase)
+			}
+		}
+	}
+	for i, d := range c.Repos {
+		for _, problem := range d.problems() {
+			bad("repos", "entry %d: %s", i+1, problem)
+		}
+	}
+	for key, dir := range map[string]string{"cache_dir": c.CacheDir, "mirror_dir": c.MirrorDir, "data_dir": c.DataDir} {
+		if abs, err := filepath.Abs(dir); dir != "" && err == nil && len(abs) > maxRootLen {
+			bad(key, "%q is %d characters long; at most %d leaves room for the paths billder keeps under it", dir, len(abs), maxRootLen)
+		}
+	}
+	if c.ClientDir != "" && !isDir(c.ClientDir) {
+		bad("client_dir", "%q is not a directory", c.ClientDir)
+	}
+	for key, path := range map[string]string{"tokens_file": c.TokensFile, "cgo_deps_file": c.CgoDepsFile, "attestation_key_file": c.AttestationKeyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			bad(key, "%v", err)
+		}
+	}
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
+
+// s3 is the bucket the s3 and gcs artifact backends upload to.
+func (c Config) s3() S3Config {
+	return S3Config{
+		Endpoint:        c.S3Endpoint,
+		Bucket:          c.S3Bucket,
+		Region:          c.S3Region,
+		AccessKeyID:     c.S3AccessKeyID,
+		SecretAccessKey: c.S3SecretAccessKey,
+		PathStyle:       c.S3PathStyle,
+	}
+}
+
+// Masked returns the config as JSON with secrets replaced, for logging.
+func (c Config) Masked() string {
+	if c.AuthToken != "" {
+		c.AuthToken = "****"
+	}
+	if c.AdminToken != "" {
+		c.AdminToken = "****"
+	}
+	if c.AndroidKeystorePass != "" {
+		c.AndroidKeystorePass = "****"
+	}
+	if c.AttestationKey != "" {
+		c.AttestationKey = "****"
+	}
+	if c.S3SecretAccessKey != "" {
+		c.S3SecretAccessKey = "****"
+	}
+	if len(c.RedactSecrets) > 0 {
+		c.RedactSecrets = []string{fmt.Sprintf("**** (%d values)", len(c.RedactSecrets))}
+	}
+	data, _ := json.Marshal(c)
+	return string(data)
+}
+
+// Options converts a validated config to handler options. Credential-looking
+// environment variables (*TOKEN, *SECRET, *PASSWORD, *KEY) are always
+// added to the values scrubbed from output.
+func (c Config) Options() ([]Option, error) {
+	var opts []Option
+	duration := func(s string) time.Duration {
+		d, _ := time.ParseDuration(s) // checked by Validate
+		return d
+	}
+
+	var tokens []Token
+	if c.AuthToken != "" {
+		tokens = append(tokens, Token{ID: "default", Secret: c.AuthToken, Mode: "header"})
+	}
+	if c.TokensFile != "" {
+		fromFile, err := loadTokens(c.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, fromFile...)
+	}
+	opts = append(opts, WithTokens(tokens...))
+	if c.AuthMaxSkew != "" {
+		opts = append(opts, WithAuthMaxSkew(duration(c.AuthMaxSkew)))
+	}
+	if c.OIDCAudience != "" {
+		opts = append(opts, WithOIDC(c.OIDCAudience, c.OIDCAllowedEmails...))
+	}
+
+	if c.MaxConcurrentCompiles != nil {
+		opts = append(opts, WithMaxConcurrentCompiles(*c.MaxConcurrentCompiles))
+	}
+	if c.BuildTimeout != "" {
+		opts = append(opts, WithBuildTimeout(duration(c.BuildTimeout)))
+	}
+	if c.BodyTimeout != "" || c.WriteTimeout != "" {
+		defaults := defaultOptions()
+		body, write := defaults.BodyTimeout, defaults.WriteTimeout
+		if c.BodyTimeout != "" {
+			body = duration(c.BodyTimeout)
+		}
+		if c.WriteTimeout != "" {
+			write = duration(c.WriteTimeout)
+		}
+		opts = append(opts, WithClientTimeouts(body, write))
+	}
+	if c.StepRetries != nil || c.RetryBackoff != "" {
+		defaults := defaultOptions()
+		retries, backoff := defaults.StepRetries, defaults.RetryBackoff
+		if c.StepRetries != nil {
+			retries = *c.StepRetries
+		}
+		if c.RetryBackoff != "" {
+			backoff = duration(c.RetryBackoff)
+		}
+		opts = append(opts, WithStepRetries(retries, backoff))
+	}
+
+	if c.CacheDir != "" {
+		opts = append(opts, WithCacheDir(c.CacheDir))
+	}
+	if c.MirrorDir != "" {
+		opts = append(opts, WithGitMirrors(c.MirrorDir))
+	}
+	if c.DataDir != "" {
+		opts = append(opts, WithDataDir(c.DataDir))
+	}
+	if c.HistoryFile != "" {
+		opts = append(opts, WithHistoryFile(c.HistoryFile))
+	}
+	defaults := defaultOptions()
+	ttl, maxBytes := defaults.StoreTTL, defaults.StoreMaxBytes
+	if c.StoreTTL != "" {
+		ttl = duration(c.StoreTTL)
+	}
+	if c.StoreMaxMB != nil {
+		maxBytes = int64(*c.StoreMaxMB) << 20
+	}
+	opts = append(opts, WithRetention(ttl, maxBytes))
+	if c.StorePerRepo != nil {
+		opts = append(opts, WithArtifactsPerRepo(*c.StorePerRepo))
+	}
+	if c.MaxArtifactMB != nil {
+		opts = append(opts, WithMaxArtifactSize(int64(*c.MaxArtifactMB)<<20))
+	}
+	if c.MaxCmds != nil {
+		opts = append(opts, WithMaxCmdsPerBuild(*c.MaxCmds))
+	}
+	if c.MaxLFSMB != nil {
+		opts = append(opts, WithMaxLFSSize(int64(*c.MaxLFSMB)<<20))
+	}
+	var limits PayloadLimits
+	if c.MaxTargets != nil {
+		limits.Targets = *c.MaxTargets
+	}
+	if c.MaxBodyKB != nil {
+		limits.BodyBytes = int64(*c.MaxBodyKB) << 10
+	}
+	opts = append(opts, WithPayloadLimits(limits))
+	if c.ClamdSocket != "" {
+		opts = append(opts, WithClamd(c.ClamdSocket))
+	}
+	if c.ClientDir != "" {
+		opts = append(opts, WithClientReleases(c.ClientDir))
+	}
+	if c.GoProxy != "" || c.GoSumDB != "" || c.GoFlags != "" {
+		opts = append(opts, WithModules(c.GoProxy, c.GoSumDB, c.GoFlags))
+	}
+	if c.ModProxy {
+		maxBytes := defaults.ModProxyMaxBytes
+		if c.ModProxyMaxMB != nil {
+			maxBytes = int64(*c.ModProxyMaxMB) << 20
+		}
+		opts = append(opts, WithModuleProxy(maxBytes))
+	}
+	if c.AndroidKeystore != "" {
+		opts = append(opts, WithAndroidKeystore(c.AndroidKeystore, c.AndroidKeyAlias, c.AndroidKeystorePass))
+	}
+	if c.AttestationKey != "" || c.AttestationKeyFile != "" {
+		source, data := "attestation_key", []byte(c.AttestationKey)
+		if c.AttestationKeyFile != "" {
+			var err error
+			source = "attestation_key_file"
+			if data, err = os.ReadFile(c.AttestationKeyFile); err != nil {
+				return nil, err
+			}
+		}
+		key, err := parseAttestationKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.where(source), err)
+		}
+		opts = append(opts, WithAttestationKey(key))
+	}
+	events, eventBytes := defaults.EventBufferEvents, defaults.EventBufferBytes
+	if c.EventBufferEvents != nil {
+		events = *c.EventBufferEvents
+	}
+	if c.EventBufferKB != nil {
+		eventBytes = int64(*c.EventBufferKB) << 10
+	}
+	opts = append(opts, WithEventBuffer(events, eventBytes))
+	rate := defaults.OutputRate
+	if c.OutputEventsPerSec != nil {
+		rate.EventsPerSec = *c.OutputEventsPerSec
+	}
+	if c.OutputKBPerSec != nil {
+		rate.BytesPerSec = int64(*c.OutputKBPerSec) << 10
+	}
+	opts = append(opts, WithOutputRate(rate))
+	if c.MaxResponseMB != nil || c.MaxResponseSeconds != nil {
+		limits := defaults.ResponseLimits
+		if c.MaxResponseMB != nil {
+			limits.MaxBytes = int64(*c.MaxResponseMB) << 20
+		}
+		if c.MaxResponseSeconds != nil {
+			limits.MaxDuration = time.Duration(*c.MaxResponseSeconds) * time.Second
+		}
+		opts = append(opts, WithResponseLimits(limits))
+	}
+
+	if len(c.AllowedTargets) > 0 {
+		opts = append(opts, WithAllowedTargets(c.AllowedTargets...))
+	}
+	if c.CgoDepsFile != "" {
+		reqs, err := loadCgoRequirements(c.CgoDepsFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithCgoRequirements(reqs...))
+	}
+
+	opts = append(opts, WithRateLimit(RateLimit{
+		PerMinute:       c.RateLimitPerMin,
+		Burst:           c.RateLimitBurst,
+		GlobalPerMinute: c.RateLimitGlobalPerMin,
+	}))
+	var prefixes []netip.Prefix
+	for _, p := range c.TrustedProxies {
+		prefix, _ := netip.ParsePrefix(p) // checked by Validate
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	opts = append(opts, WithTrustedProxies(prefixes...))
+
+	secretValues := slices.Clone(c.RedactSecrets)
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		upper := strings.ToUpper(name)
+		for _, suffix := range []string{"TOKEN", "SECRET", "PASSWORD", "KEY"} {
+			if strings.HasSuffix(upper, suffix) {
+				secretValues = append(secretValues, value)
+			}
+		}
+	}
+	opts = append(opts, WithRedactedSecrets(secretValues...))
+
+	if c.AdminToken != "" {
+		opts = append(opts, WithAdminToken(c.AdminToken))
+	}
+	if c.FakeBuilds {
+		opts = append(opts, WithFakeBuilds())
+	}
+	if c.PublicBadges {
+		opts = append(opts, WithPublicBadges())
+	}
+	if store, err := newBlobStore(c.ArtifactBackend, c.s3()); err != nil {
+		return nil, err
+	} else if store != nil {
+		ttl := blobURLTTL
+		if c.ArtifactURLTTL != "" {
+			ttl, _ = time.ParseDuration(c.ArtifactURLTTL) // checked by Validate
+		}
+		opts = append(opts, WithArtifactStore(store, ttl))
+	}
+	if c.SelfTest == "on" || c.SelfTest == "required" {
+		opts = append(opts, WithSelfTest(c.SelfTest == "required"))
+	}
+	if c.OTLPEndpoint != "" {
+		opts = append(opts, WithTracing(c.OTLPEndpoint))
+	}
+	if c.EventSink != "" {
+		pub, err := newPublisher(c.EventSink)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithPublisher(pub))
+	}
+	opts = append(opts, WithSchedules(c.Schedules...))
+	opts = append(opts, WithHosts(c.Hosts...))
+	opts = append(opts, WithRepoDefaults(c.Repos...))
+	return opts, nil
+}
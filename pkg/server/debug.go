@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var startedAt = time.Now()
+
+// DebugStatus is the GET /debug/status response.
+type DebugStatus struct {
+	Uptime         string `json:"uptime"`
+	Goroutines     int    `json:"goroutines"`
+	HeapAlloc      uint64 `json:"heap_alloc_bytes"`
+	HeapInuse      uint64 `json:"heap_inuse_bytes"`
+	HeapObjects    uint64 `json:"heap_objects"`
+	Sys            uint64 `json:"sys_bytes"`
+	NumGC          uint32 `json:"num_gc"`
+	ActiveBuilds   int64  `json:"active_builds"`
+	Workspaces     int    `json:"workspaces"`
+	WorkspaceBytes int64  `json:"workspace_bytes"`
+	DataBytes      int64  `json:"data_bytes"`
+	MirrorBytes    int64  `json:"mirror_bytes"`
+}
+
+// debugStatusHandler serves GET /debug/status.
+func debugStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	status := DebugStatus{
+		Uptime:       time.Since(startedAt).Round(time.Second).String(),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapInuse:    mem.HeapInuse,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		ActiveBuilds: activeBuilds.Load(),
+		DataBytes:    dirSize(dataDir()),
+	}
+	for _, m := range listMirrors() {
+		status.MirrorBytes += m.size
+	}
+	// Build workspaces are os.MkdirTemp("", "billder-*") directories
+	entries, _ := os.ReadDir(os.TempDir())
+	for _, e := range entries {
+		suffix, ok := strings.CutPrefix(e.Name(), "billder-")
+		if ok && e.IsDir() && strings.Trim(suffix, "0123456789") == "" {
+			status.Workspaces++
+			status.WorkspaceBytes += dirSize(filepath.Join(os.TempDir(), e.Name()))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// dirSize totals the regular files under dir, skipping what it can't read.
+func dirSize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// admin wraps h so it only answers callers with the admin token.
+func admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminAuthorized(w, r) {
+			h(w, r)
+		}
+	}
+}
+
+// handleDebug mounts pprof and the status endpoint behind admin auth.
+func handleDebug(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/status", admin(debugStatusHandler))
+	mux.HandleFunc("/debug/pprof/", admin(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", admin(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", admin(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", admin(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", admin(pprof.Trace))
+}
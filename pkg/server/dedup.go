@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildConflict is the 409 response for a build that duplicates one the
+// same caller already has running.
+type BuildConflict struct {
+	Error     string    `json:"error"`
+	BuildID   string    `json:"build_id"`
+	StartedAt time.Time `json:"started_at"`
+	EventsURL string    `json:"events_url"`
+}
+
+type runningBuild struct {
+	id      string
+	started time.Time
+}
+
+var (
+	runningMu sync.Mutex
+	running   = map[string]runningBuild{}
+)
+
+// buildKey identifies a build by caller, repository, refs, targets and
+// cache_relevant/ labels; other labels don't make a build different.
+func buildKey(caller string, p RequestPayload) string {
+	ref := p.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return strings.Join([]string{caller, p.RepoURL, p.ModuleDir, ref, p.CompareRef, strings.Join(p.Targets, ","), p.cacheLabels()}, "\x00")
+}
+
+// claimBuild registers build id under key, or returns the build already
+// running there.
+func claimBuild(key, id string) (runningBuild, bool) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	if b, ok := running[key]; ok {
+		return b, false
+	}
+	running[key] = runningBuild{id: id, started: time.Now()}
+	return runningBuild{}, true
+}
+
+// releaseBuild forgets the build registered under key.
+func releaseBuild(key string) {
+	runningMu.Lock()
+	delete(running, key)
+	runningMu.Unlock()
+}
+
+// writeConflict sends the 409 naming the running build.
+func writeConflict(w http.ResponseWriter, b runningBuild) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(BuildConflict{
+		Error:     "an identical build is already running; set force to start another",
+		BuildID:   b.id,
+		StartedAt: b.started,
+		EventsURL: "/" + apiVersion + "/builds/" + b.id + "/events",
+	})
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// splitDebug moves DWARF data from a linux binary into binary+".debug" and
+// links the two with a .gnu_debuglink section.
+func splitDebug(binary string) (string, error) {
+	debugFile := binary + ".debug"
+	steps := [][]string{
+		{"--only-keep-debug", binary, debugFile},
+		{"--strip-debug", "--add-gnu-debuglink=" + debugFile, binary},
+	}
+	for _, args := range steps {
+		cmd := exec.Command("objcopy", args...)
+		// debuglink stores the base name, so run next to the files
+		cmd.Dir = filepath.Dir(binary)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("objcopy %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+	return debugFile, nil
+}
+
+// zipEntry is one file in a delivered archive, read from Path or, when
+// Path is empty, taken from Data.
+type zipEntry struct {
+	Name string
+	Path string
+	Data []byte
+}
+
+// writeZip bundles entries into a zip archive at dest.
+func writeZip(dest string, entries []zipEntry) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for _, e := range entries {
+		var err error
+		if e.Path != "" {
+			err = addZipFile(zw, e.Name, e.Path)
+		} else {
+			err = addZipData(zw, e.Name, e.Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func addZipData(zw *zip.Writer, name string, data []byte) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
+
+func addZipFile(zw *zip.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
+	fw, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
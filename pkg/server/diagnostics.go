@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Diagnostic is a single compiler message forwarded as a "diagnostic" event.
+type Diagnostic struct {
+	Target  string `json:"target,omitempty"`
+	Package string `json:"package"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// buildEvent is one line of `go build -json` output.
+type buildEvent struct {
+	ImportPath string
+	Action     string
+	Output     string
+}
+
+var diagLine = regexp.MustCompile(`^(.+?\.go):(\d+)(?::(\d+))?: (.+)$`)
+
+var (
+	buildJSONOnce sync.Once
+	buildJSONOK   bool
+)
+
+// supportsBuildJSON reports whether the installed toolchain accepts `go build -json`.
+func supportsBuildJSON() bool {
+	buildJSONOnce.Do(func() {
+		out, err := exec.Command("go", "help", "build").Output()
+		buildJSONOK = err == nil && bytes.Contains(out, []byte("\t-json"))
+	})
+	return buildJSONOK
+}
+
+// parseBuildOutput extracts diagnostics from build output. JSON lines produced
+// by -json are decoded; anything else is treated as plain compiler text.
+// The returned text is the human-readable output with the JSON framing removed.
+func parseBuildOutput(out []byte) ([]Diagnostic, string) {
+	var diags []Diagnostic
+	var text strings.Builder
+	pkg := ""
+
+	addText := func(chunk string) {
+		text.WriteString(chunk)
+		for _, line := range strings.Split(chunk, "\n") {
+			if strings.HasPrefix(line, "# ") {
+				pkg = strings.TrimPrefix(line, "# ")
+				continue
+			}
+			if d, ok := parseDiagnosticLine(pkg, line); ok {
+				diags = append(diags, d)
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var ev buildEvent
+		if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &ev) == nil {
+			// -v package names aren't diagnostics
+			if ev.Action == "build-output" && ev.Output != ev.ImportPath+"\n" {
+				pkg = ev.ImportPath
+				addText(ev.Output)
+			}
+			continue
+		}
+		addText(line + "\n")
+	}
+	return diags, text.String()
+}
+
+// parseDiagnosticLine parses "file.go:line[:col]: message".
+func parseDiagnosticLine(pkg, line string) (Diagnostic, bool) {
+	m := diagLine.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return Diagnostic{}, false
+	}
+	d := Diagnostic{Package: pkg, File: m[1], Message: m[4]}
+	d.Line, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		d.Column, _ = strconv.Atoi(m[3])
+	}
+	return d, true
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The testdata captures are `go build -v` output of a module whose util
+// package has two type errors, and of the same module once only main is
+// broken, with and without -json.
+func TestParseBuildOutput(t *testing.T) {
+	utilErrors := []Diagnostic{
+		{Package: "example.com/brk/util", File: "util/util.go", Line: 4, Column: 9, Message: "too many return values"},
+		{Package: "example.com/brk/util", File: "util/util.go", Line: 7, Column: 27, Message: `cannot use "s" (untyped string constant) as int value in return statement`},
+	}
+	utilText := "# example.com/brk/util\n" +
+		"util/util.go:4:9: too many return values\n" +
+		"\thave (number)\n" +
+		"\twant ()\n" +
+		"util/util.go:7:27: cannot use \"s\" (untyped string constant) as int value in return statement\n"
+
+	tests := []struct {
+		file  string
+		diags []Diagnostic
+		text  string
+	}{
+		{"json_two_errors.txt", utilErrors, utilText},
+		{"plain_two_errors.txt", utilErrors, "example.com/brk/util\n" + utilText},
+		{
+			"json_main.txt",
+			[]Diagnostic{{Package: "example.com/brk", File: "./main.go", Line: 6, Column: 2, Message: "declared and not used: x"}},
+			"# example.com/brk\n./main.go:6:2: declared and not used: x\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			out, err := os.ReadFile(filepath.Join("testdata", "diagnostics", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			diags, text := parseBuildOutput(out)
+			if !reflect.DeepEqual(diags, tt.diags) {
+				t.Errorf("diagnostics:\n got %+v\nwant %+v", diags, tt.diags)
+			}
+			if text != tt.text {
+				t.Errorf("text:\n got %q\nwant %q", text, tt.text)
+			}
+		})
+	}
+}
+
+func TestParseDiagnosticLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want Diagnostic
+		ok   bool
+	}{
+		{"main.go:3:5: undefined: foo", Diagnostic{File: "main.go", Line: 3, Column: 5, Message: "undefined: foo"}, true},
+		{"  pkg/a.go:12: missing return", Diagnostic{File: "pkg/a.go", Line: 12, Message: "missing return"}, true},
+		{`C:\src\x.go:1:2: bad`, Diagnostic{File: `C:\src\x.go`, Line: 1, Column: 2, Message: "bad"}, true},
+		{"# example.com/brk", Diagnostic{}, false},
+		{"\thave (number)", Diagnostic{}, false},
+		{"go: downloading example.com/x v1.0.0", Diagnostic{}, false},
+		{"main.c:3:5: error: not go", Diagnostic{}, false},
+	}
+	for _, tt := range tests {
+		d, ok := parseDiagnosticLine("", tt.line)
+		if ok != tt.ok || d != tt.want {
+			t.Errorf("parseDiagnosticLine(%q) = %+v, %v; want %+v, %v", tt.line, d, ok, tt.want, tt.ok)
+		}
+	}
+}
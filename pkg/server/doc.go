@@ -0,0 +1,26 @@
+// Package server implements the billder build service: it clones a Go
+// repository, cross-compiles it with cgo toolchains and streams progress
+// events followed by the artifact over a single HTTP response.
+//
+// New returns the API as a Server, an http.Handler, so it can be mounted
+// inside an existing service:
+//
+//	billder, err := server.New(
+//		server.WithTokens(server.Token{ID: "ci", Secret: os.Getenv("BILLDER_SECRET")}),
+//		server.WithMaxConcurrentCompiles(2),
+//		server.WithBuildTimeout(15*time.Minute),
+//		server.WithCacheDir("/var/cache/billder"),
+//		server.WithAllowedTargets("linux/amd64"),
+//	)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer billder.Close()
+//	mux := http.NewServeMux()
+//	mux.Handle("/billder/", http.StripPrefix("/billder", billder))
+//	log.Fatal(http.ListenAndServe(":8080", mux))
+//
+// The billder command builds its options with OptionsFromEnv. Compile slots,
+// auth and the on-disk stores are process-wide, so one Server is open at a
+// time: New fails with ErrServerOpen until the previous one is closed.
+package server
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// lsRemoteTimeout bounds the repository existence check in dry-run mode.
+const lsRemoteTimeout = 10 * time.Second
+
+// DryRunReport describes what a build request would do, without doing it.
+type DryRunReport struct {
+	Repo      string   `json:"repo"`
+	CloneURL  string   `json:"clone_url"`
+	Ref       string   `json:"ref"`
+	Commit    string   `json:"commit,omitempty"`
+	Reachable bool     `json:"reachable"`
+	Target    string   `json:"target"`
+	CC        string   `json:"cc"`
+	CCFound   bool     `json:"cc_found"`
+	Toolchain string   `json:"toolchain"`
+	Env       []string `json:"env"`
+	BuildArgs []string `json:"build_args"`
+	Cache     string   `json:"cache"`
+	Problems  []string `json:"problems,omitempty"`
+}
+
+// planDryRun validates a normalized payload against the server and reports
+// the clone and build it would perform.
+func planDryRun(p RequestPayload, tc Toolchain, hasProfile bool) DryRunReport {
+	report := DryRunReport{
+		Repo:      p.RepoURL,
+		CloneURL:  p.CloneURL(),
+		Ref:       cmp.Or(p.Ref, "HEAD"),
+		Target:    tc.GOOS + "/" + tc.GOARCH,
+		CC:        tc.CC,
+		Toolchain: toolchainVersion(),
+		Env:       tc.Vars(),
+		Cache:     cacheState(tc),
+	}
+
+	if _, err := exec.LookPath(tc.CC); err == nil {
+		report.CCFound = true
+	} else if !tc.NoCgo {
+		report.Problems = append(report.Problems, "C compiler "+tc.CC+" is not installed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lsRemoteTimeout)
+	defer cancel()
+	// Commits aren't advertised; the repository being reachable is all we can check
+	host := hostFor(p.RepoURL)
+	lookup, isCommit := host.resolveRef(report.Ref), commitPattern.MatchString(report.Ref)
+	if isCommit {
+		lookup = "HEAD"
+	}
+	remote := report.CloneURL
+	if !p.refreshes() {
+		remote = mirrorPath(p.RepoURL)
+	}
+	out, err := host.git(ctx, "ls-remote", "--", remote, lookup).Output()
+	if fields := strings.Fields(string(out)); err == nil && len(fields) > 0 {
+		report.Reachable = true
+		report.Commit = fields[0]
+		if isCommit {
+			report.Commit = report.Ref
+		}
+	} else if err == nil {
+		report.Reachable = true
+		report.Problems = append(report.Problems, fmt.Sprintf("ref %s not found on remote", report.Ref))
+	} else {
+		report.Problems = append(report.Problems, "repository is not reachable or has no "+report.Ref)
+	}
+
+	output, pkg := "app", "."
+	if p.BuildAllCmds {
+		output, pkg = "{cmd}", "./cmd/{cmd}" // once per command found under cmd/
+	} else if p.CompilerOptions.race() {
+		output += "-race"
+	}
+	if tc.GOOS == "windows" {
+		output += ".exe"
+	}
+	pgoPath := ""
+	if hasProfile {
+		pgoPath = "upload.pgo"
+	} else if p.PGO == "auto" {
+		pgoPath = "default.pgo"
+	}
+	report.BuildArgs = append([]string{"go"}, goBuildArgs(output, p.ldflags(tc.GOOS, VCSInfo{Commit: report.Commit, Describe: report.Commit}), pgoPath, p.CompilerOptions, pkg)...)
+	switch {
+	case p.Packager == "fyne":
+		report.BuildArgs = append([]string{"fyne"}, fynePackageArgs(tc, p)...)
+	case tc.GOOS == "android":
+		report.BuildArgs = append([]string{"gomobile"}, gomobileArgs(tc, "app.apk", p)...)
+	}
+	return report
+}
+
+// cacheState reports whether the target's build cache has content: "warm" or "cold".
+func cacheState(tc Toolchain) string {
+	entries, err := os.ReadDir(tc.CacheDir())
+	if err != nil || len(entries) <= 1 {
+		return "cold"
+	}
+	return "warm"
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// OptionsFromEnv loads the configuration the billder command uses: the
+// BILLDER_CONFIG file, if set, overridden by the environment variables
+// listed on Config.
+func OptionsFromEnv() ([]Option, error) {
+	c, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return c.Options()
+}
+
+// loadTokens reads a JSON array of tokens.
+func loadTokens(path string) ([]Token, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, t := range tokens {
+		if t.Mode == "" {
+			tokens[i].Mode = "header"
+		}
+		if t.ID == "" || t.Secret == "" || (tokens[i].Mode != "header" && tokens[i].Mode != "hmac") {
+			return nil, fmt.Errorf("%s: token %q needs an id, a secret and mode header or hmac", path, t.ID)
+		}
+		if t.StoreTTLHours < 0 || t.StoreMaxMB < 0 || t.StorePerRepo < 0 {
+			return nil, fmt.Errorf("%s: token %q: store_ttl_hours, store_max_mb and store_max_per_repo must not be negative", path, t.ID)
+		}
+		if problems := t.scopeProblems(); len(problems) > 0 {
+			return nil, fmt.Errorf("%s: token %q: %s", path, t.ID, strings.Join(problems, "; "))
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// finishedBuildRetention is how long a finished build's events stay
+// available to clients that attach late.
+const finishedBuildRetention = 10 * time.Minute
+
+// eventRecord is one SSE block, stored without its id: line.
+type eventRecord struct {
+	id    uint64
+	block []byte
+}
+
+// eventLog keeps the most recent events of one build in a ring bounded by
+// count and bytes, so clients can attach late or resume after a drop.
+type eventLog struct {
+	mu        sync.Mutex
+	events    []eventRecord
+	size      int64
+	maxEvents int
+	maxBytes  int64
+	nextID    uint64
+	done      bool
+	changed   chan struct{} // closed and replaced on every append
+}
+
+func newEventLog(maxEvents int, maxBytes int64) *eventLog {
+	return &eventLog{maxEvents: max(1, maxEvents), maxBytes: maxBytes, nextID: 1, changed: make(chan struct{})}
+}
+
+// append stores block and returns its id. Ids increase by one per event.
+func (l *eventLog) append(block []byte) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := l.nextID
+	l.nextID++
+	l.events = append(l.events, eventRecord{id, block})
+	l.size += int64(len(block))
+	for len(l.events) > 1 && (len(l.events) > l.maxEvents || (l.maxBytes > 0 && l.size > l.maxBytes)) {
+		l.size -= int64(len(l.events[0].block))
+		l.events = l.events[1:]
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return id
+}
+
+// finish marks the build as over; followers stop once they catch up.
+func (l *eventLog) finish() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.done {
+		l.done = true
+		close(l.changed)
+		l.changed = make(chan struct{})
+	}
+}
+
+// since returns the retained events after lastID, how many events in
+// between were dropped from the ring, whether the build is over, and a
+// channel that is closed when more arrive.
+func (l *eventLog) since(lastID uint64) (events []eventRecord, truncated uint64, done bool, wait <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, e := range l.events {
+		if e.id > lastID {
+			events = append(events, l.events[i:]...)
+			if e.id > lastID+1 {
+				truncated = e.id - lastID - 1
+			}
+			break
+		}
+	}
+	return events, truncated, l.done, l.changed
+}
+
+// follow writes the events after lastID to sse and keeps streaming new
+// ones until the build finishes, the client goes away or stop is closed.
+func (l *eventLog) follow(sse *sseWriter, lastID uint64, stop <-chan struct{}) {
+	for {
+		events, truncated, done, wait := l.since(lastID)
+		if truncated > 0 {
+			sse.Message(fmt.Sprintf("…%d earlier events truncated…", truncated))
+		}
+		for _, e := range events {
+			sse.replay(e.id, e.block)
+			lastID = e.id
+		}
+		if done || sse.Gone() {
+			return
+		}
+		select {
+		case <-wait:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// parseEventID reads a Last-Event-ID value; anything invalid replays from the start.
+func parseEventID(s string) uint64 {
+	id, _ := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	return id
+}
+
+var (
+	eventLogsMu sync.Mutex
+	eventLogs   = map[string]*eventLog{}
+)
+
+// startEventLog registers the event log of a new build.
+func startEventLog(id string) *eventLog {
+	l := newEventLog(cfg.EventBufferEvents, cfg.EventBufferBytes)
+	eventLogsMu.Lock()
+	eventLogs[id] = l
+	eventLogsMu.Unlock()
+	return l
+}
+
+// finishEventLog ends a build's log and forgets it after the retention period.
+func finishEventLog(id string, l *eventLog) {
+	l.finish()
+	time.AfterFunc(finishedBuildRetention, func() {
+		eventLogsMu.Lock()
+		delete(eventLogs, id)
+		eventLogsMu.Unlock()
+	})
+}
+
+// lookupEventLog returns the log of a running or recently finished build.
+func lookupEventLog(id string) (*eventLog, bool) {
+	eventLogsMu.Lock()
+	defer eventLogsMu.Unlock()
+	l, ok := eventLogs[id]
+	return l, ok
+}
+
+// buildEventsHandler serves GET /v1/builds/{id}/events: the retained events
+// of a running or recently finished build, then live ones until it ends.
+// Last-Event-ID (header or ?last_event_id=) skips events already seen.
+// A coordinator serves the builds it dispatched from their workers.
+func buildEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	l, ok := lookupEventLog(r.PathValue("id"))
+	if !ok && cluster != nil && cluster.proxyEvents(w, r) {
+		return
+	} else if !ok {
+		http.Error(w, "Build not found or no longer buffered", http.StatusNotFound)
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	l.follow(sse, parseEventID(lastID), r.Context().Done())
+}
+
+// buildTailHandler serves GET /v1/builds/{id}/tail: the build's events
+// for watchers other than the client that started it, always from the
+// start of the buffer and without resuming. Any number may watch; they
+// only read the event log, so leaving or stalling doesn't touch the build.
+func buildTailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	l, ok := lookupEventLog(r.PathValue("id"))
+	if !ok && cluster != nil && cluster.proxyEvents(w, r) {
+		return
+	} else if !ok {
+		http.Error(w, "Build not found or no longer buffered", http.StatusNotFound)
+		return
+	}
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	l.follow(sse, 0, r.Context().Done())
+}
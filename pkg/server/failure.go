@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// FailureCategory says why a build failed, and so whose problem it is: the
+// request, repository and code categories are the caller's to fix, the
+// toolchain, oom and internal ones the operator's, and a timeout can be
+// either. It's assigned where the failure is detected and carried in the
+// summary and end events, the journal and the failure metrics.
+type FailureCategory string
+
+const (
+	FailInvalidRequest FailureCategory = "invalid_request" // rejected request, bad patch or profile, artifact over the limit
+	FailRepoNotFound   FailureCategory = "repo_not_found"  // no such repository or ref, or an empty one
+	FailAuth           FailureCategory = "auth_failed"     // the git host refused the credentials
+	FailDeps           FailureCategory = "deps_failed"     // modules couldn't be resolved
+	FailCompile        FailureCategory = "compile_failed"  // the code didn't build
+	FailToolchain      FailureCategory = "toolchain_missing"
+	FailTimeout        FailureCategory = "timeout"
+	FailOOM            FailureCategory = "oom"
+	FailInternal       FailureCategory = "internal"
+)
+
+// failureCategories lists every category, in the order metrics report them.
+var failureCategories = []FailureCategory{
+	FailInvalidRequest, FailRepoNotFound, FailAuth, FailDeps, FailCompile,
+	FailToolchain, FailTimeout, FailOOM, FailInternal,
+}
+
+// stepError is a failure whose step knows its category better than the
+// caller does.
+type stepError struct {
+	category FailureCategory
+	error
+}
+
+func (e stepError) Unwrap() error { return e.error }
+
+// failedWith tags err with category c.
+func failedWith(c FailureCategory, err error) error {
+	return stepError{c, err}
+}
+
+// categoryOf is the category err was tagged with, or fallback.
+func categoryOf(err error, fallback FailureCategory) FailureCategory {
+	var se stepError
+	if errors.As(err, &se) {
+		return se.category
+	}
+	return fallback
+}
+
+// authFailures mark git output for credentials the host refused. Hosts
+// that hide private repositories answer 404 instead, which reads as
+// repo_not_found.
+var authFailures = []string{
+	"authentication failed",
+	"could not read username",
+	"could not read password",
+	"terminal prompts disabled",
+	"permission denied",
+	"error: 401",
+	"error: 403",
+	"403 forbidden",
+}
+
+// cloneFailure categorizes a clone or fetch that failed even after retries.
+// Network errors are the server's: the caller's repository may be fine.
+func cloneFailure(out []byte) FailureCategory {
+	text := strings.ToLower(string(out))
+	for _, p := range authFailures {
+		if strings.Contains(text, p) {
+			return FailAuth
+		}
+	}
+	if _, ok := transientFailure(out); ok {
+		return FailInternal
+	}
+	return FailRepoNotFound
+}
+
+// compileFailures map go, cgo and packager output to the categories that
+// aren't the code's fault. Anything unrecognized is compile_failed.
+var compileFailures = []struct {
+	match    string
+	category FailureCategory
+}{
+	{"signal: killed", FailOOM},
+	{"out of memory", FailOOM},
+	{"cannot allocate memory", FailOOM},
+	{"missing go.sum entry", FailDeps},
+	{"no required module provides package", FailDeps},
+	{"cannot find module providing package", FailDeps},
+	{"updates to go.mod needed", FailDeps},
+	{"verifying module", FailDeps},
+	{"executable file not found", FailToolchain},
+	{"c compiler", FailToolchain},
+	{"requires go >=", FailToolchain},
+	{"toolchain not available", FailToolchain},
+}
+
+// compileFailure categorizes a failed compile from its output and error.
+func compileFailure(text string, err error) FailureCategory {
+	text = strings.ToLower(text)
+	if err != nil {
+		text += "\n" + strings.ToLower(err.Error())
+	}
+	for _, f := range compileFailures {
+		if strings.Contains(text, f.match) {
+			return f.category
+		}
+	}
+	return FailCompile
+}
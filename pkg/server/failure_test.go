@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Clone and fetch output captured from git 2.39 against GitHub and a
+// server that wasn't there.
+func TestCloneFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name, out string
+		want      FailureCategory
+	}{
+		{"missing repository", "Cloning into '/tmp/billder-1/src'...\nremote: Repository not found.\nfatal: repository 'https://github.com/acme/nope/' not found\n", FailRepoNotFound},
+		{"missing branch", "Cloning into '/tmp/billder-1/src'...\nwarning: Could not find remote branch v9.9.9 to clone.\nfatal: Remote branch v9.9.9 not found in upstream origin\n", FailRepoNotFound},
+		{"not a repository", "fatal: '/srv/nothing' does not appear to be a git repository\nfatal: Could not read from remote repository.\n", FailRepoNotFound},
+		{"no prompt for a private repository", "Cloning into '/tmp/billder-1/src'...\nfatal: could not read Username for 'https://github.com': terminal prompts disabled\n", FailAuth},
+		{"refused token", "Cloning into '/tmp/billder-1/src'...\nremote: Invalid username or password.\nfatal: Authentication failed for 'https://github.com/acme/private/'\n", FailAuth},
+		{"refused key", "Cloning into '/tmp/billder-1/src'...\ngit@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository.\n", FailAuth},
+		{"forbidden", "fatal: unable to access 'https://git.example.com/acme/app/': The requested URL returned error: 403\n", FailAuth},
+		{"no dns", "Cloning into '/tmp/billder-1/src'...\nfatal: unable to access 'https://github.com/acme/app/': Could not resolve host: github.com\n", FailInternal},
+		{"dropped", "Cloning into '/tmp/billder-1/src'...\nerror: RPC failed; curl 56 GnuTLS recv error (-9): Error decoding the received TLS packet.\nfatal: early EOF\nfatal: fetch-pack: invalid index-pack output\n", FailInternal},
+		{"refused", "fatal: unable to access 'http://127.0.0.1:9/acme/app/': Failed to connect to 127.0.0.1 port 9 after 0 ms: Couldn't connect to server\n", FailInternal},
+		{"bad gateway", "fatal: unable to access 'https://git.example.com/acme/app/': The requested URL returned error: 502\n", FailInternal},
+		{"unrecognized", "fatal: something new went wrong\n", FailRepoNotFound},
+	} {
+		if got := cloneFailure([]byte(tc.out)); got != tc.want {
+			t.Errorf("%s: cloneFailure = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Compile output captured from go 1.27 and the packagers; the error is the
+// one exec returned.
+func TestCompileFailure(t *testing.T) {
+	exit1 := errors.New("exit status 1")
+	for _, tc := range []struct {
+		name, out string
+		err       error
+		want      FailureCategory
+	}{
+		{"type error", "# github.com/acme/app/util\nutil/util.go:7:9: cannot use n (variable of type int) as string value in return statement\n", exit1, FailCompile},
+		{"unused variable", "# github.com/acme/app\n./main.go:6:2: declared and not used: x\n", exit1, FailCompile},
+		{"syntax error", "# github.com/acme/app\n./main.go:9:1: syntax error: unexpected }, expected expression\n", exit1, FailCompile},
+		{"missing go.sum entry", "main.go:4:2: missing go.sum entry for module providing package github.com/acme/lib (imported by github.com/acme/app); to add:\n\tgo get github.com/acme/app\n", exit1, FailDeps},
+		{"no module for an import", "main.go:5:2: no required module provides package github.com/acme/gone; to add it:\n\tgo get github.com/acme/gone\n", exit1, FailDeps},
+		{"go.mod out of date", "go: updates to go.mod needed; to update it:\n\tgo mod tidy\n", exit1, FailDeps},
+		{"tampered module", "go: github.com/acme/lib@v1.2.0: verifying module: checksum mismatch\n\tdownloaded: h1:abc=\n\tsum.golang.org: h1:def=\n\nSECURITY ERROR\n", exit1, FailDeps},
+		{"no cross compiler", "# runtime/cgo\ncgo: C compiler \"x86_64-w64-mingw32-gcc\" not found: exec: \"x86_64-w64-mingw32-gcc\": executable file not found in $PATH\n", exit1, FailToolchain},
+		{"newer go required", "go: go.mod requires go >= 1.99 (running go 1.27.1; GOTOOLCHAIN=local)\n", exit1, FailToolchain},
+		{"no fyne", "", fmt.Errorf("exec: \"fyne\": executable file not found in $PATH"), FailToolchain},
+		{"killed", "# github.com/acme/app\n", errors.New("signal: killed"), FailOOM},
+		{"out of memory", "fatal error: runtime: out of memory\n", exit1, FailOOM},
+		{"unrecognized", "something new went wrong\n", exit1, FailCompile},
+	} {
+		if got := compileFailure(tc.out, tc.err); got != tc.want {
+			t.Errorf("%s: compileFailure = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCategoryOf(t *testing.T) {
+	err := failedWith(FailAuth, errors.New("git clone failed"))
+	if got := categoryOf(fmt.Errorf("preparing the source: %w", err), FailInternal); got != FailAuth {
+		t.Errorf("wrapped step error: %s, want %s", got, FailAuth)
+	}
+	if got := categoryOf(errors.New("untagged"), FailCompile); got != FailCompile {
+		t.Errorf("untagged error: %s, want the fallback", got)
+	}
+	if !errors.Is(err, errors.Unwrap(err)) {
+		t.Error("a step error doesn't unwrap to its cause")
+	}
+}
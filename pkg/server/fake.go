@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// fakeArtifact is the body delivered by fake builds.
+const fakeArtifact = "billder fake artifact\n"
+
+// wantsFake reports whether r asks for a canned build (/build?fake=1) on a
+// server started with fake builds enabled.
+func wantsFake(r *http.Request) bool {
+	return cfg.FakeBuilds && r.URL.Query().Get("fake") == "1"
+}
+
+// fakeBuildHandler streams the usual event sequence for the first requested
+// target and a small dummy artifact, without cloning or compiling. It is
+// meant for smoke-testing a deployment and the client end to end.
+func fakeBuildHandler(w http.ResponseWriter, r *http.Request) {
+	payload, _, profile, err := readPayload(w, r)
+	if err == nil {
+		err = payload.normalize(profile != nil)
+	}
+	if err != nil {
+		writePayloadError(w, err)
+		return
+	}
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sse.legacy = requestProtocol(r) == "legacy"
+
+	target := payload.Targets[0]
+	goos, goarch, _ := strings.Cut(target, "/")
+	id := "fake-" + newBuildID()
+	sse.Event("session", newSession(id, requestProtocol(r), callerID(r), payload))
+	sse.Message(fmt.Sprintf("Starting fake job for %s [%s]", payload.RepoURL, target))
+	sse.Message(fmt.Sprintf("Build ID: %s", id))
+	for i, name := range []string{"Cloning repository", "Resolving dependencies", "Building"} {
+		sse.Event("step", Step{Index: i + 1, Total: totalSteps, Name: name})
+	}
+
+	name := "app"
+	if goos == "windows" {
+		name += ".exe"
+	}
+	sse.Message("Build Successful! (fake)")
+	sse.Event("summary", BuildSummary{
+		Target:   target,
+		OK:       true,
+		Repo:     payload.RepoURL,
+		TargetOS: goos,
+		Arch:     goarch,
+		Commit:   "0000000000000000000000000000000000000000",
+		Describe: "fake",
+		Artifact: name,
+		SizeMB:   float64(len(fakeArtifact)) / 1024 / 1024,
+		BuildID:  id,
+
+		Environment: environment().Condensed,
+		Labels:      payload.Labels,
+	})
+	sum := sha256.Sum256([]byte(fakeArtifact))
+	sse.Binary(name, hex.EncodeToString(sum[:]), int64(len(fakeArtifact)), strings.NewReader(fakeArtifact))
+}
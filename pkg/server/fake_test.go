@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// useFakeBuilds enables /build?fake=1 for the length of the test.
+func useFakeBuilds(t *testing.T, on bool) {
+	t.Helper()
+	prev := cfg
+	cfg.FakeBuilds = on
+	t.Cleanup(func() { cfg = prev })
+}
+
+// volatile are the parts of a fake build's stream that differ between
+// servers and runs.
+var volatile = []struct {
+	re   *regexp.Regexp
+	with string
+}{
+	{regexp.MustCompile(`fake-[0-9a-f]+`), "fake-ID"},
+	{regexp.MustCompile(`"limits":\{[^}]*\}`), `"limits":{}`},
+	{regexp.MustCompile(`"environment":"[^"]*"`), `"environment":""`},
+}
+
+func normalizeFake(s string) string {
+	for _, v := range volatile {
+		s = v.re.ReplaceAllString(s, v.with)
+	}
+	return s
+}
+
+// A fake build streams what the sessions captured from a server with fake
+// builds enabled recorded, on either route.
+func TestFakeBuildMatchesCapture(t *testing.T) {
+	useFakeBuilds(t, true)
+	for _, tc := range []struct{ capture, route, body string }{
+		{"v1-linux.bin", "/v1/build?fake=1", `{"repo_url":"https://github.com/acme/app","target_os":"linux","target_arch":"amd64","color":"keep"}`},
+		{"legacy-linux.bin", "/build?fake=1", `{"repo_url":"https://github.com/acme/app","target_os":"linux","target_arch":"amd64"}`},
+	} {
+		t.Run(tc.capture, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", "fake", tc.capture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			want, err := http.ReadResponse(bufio.NewReader(f), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantBody, _ := io.ReadAll(want.Body)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", tc.route, strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", "application/json")
+			buildHandler(w, r)
+
+			if w.Code != want.StatusCode {
+				t.Fatalf("status %d, captured %d: %s", w.Code, want.StatusCode, w.Body)
+			}
+			for _, h := range []string{"Content-Type", "Cache-Control"} {
+				if got := w.Header().Get(h); got != want.Header.Get(h) {
+					t.Errorf("%s: %q, captured %q", h, got, want.Header.Get(h))
+				}
+			}
+			if got, wantS := normalizeFake(w.Body.String()), normalizeFake(string(wantBody)); got != wantS {
+				t.Errorf("streamed\n%s\ncaptured\n%s", got, wantS)
+			}
+		})
+	}
+}
+
+// Without the server's consent, ?fake=1 is an ordinary build request.
+func TestFakeBuildNeedsServerConsent(t *testing.T) {
+	useFakeBuilds(t, false)
+	r := httptest.NewRequest("POST", "/v1/build?fake=1", nil)
+	if wantsFake(r) {
+		t.Error("fake build granted on a server without fake builds")
+	}
+	cfg.FakeBuilds = true
+	if wantsFake(httptest.NewRequest("POST", "/v1/build", nil)) {
+		t.Error("fake build without ?fake=1")
+	}
+}
+
+func TestFakeBuildRejectsInvalidRequest(t *testing.T) {
+	useFakeBuilds(t, true)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/build?fake=1", strings.NewReader(`{"repo_url":"https://github.com/acme/app","target_os":"plan9","target_arch":"mips"}`))
+	r.Header.Set("Content-Type", "application/json")
+	buildHandler(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"invalid_request"`) {
+		t.Errorf("%d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rexlx/bilder/internal/version"
+)
+
+// Fingerprint is the environment this server builds in, for telling why a
+// binary from billder differs from a local build. It's served in full at
+// GET /v1/capabilities and condensed in every build summary.
+type Fingerprint struct {
+	Billder     string            `json:"billder"` // server version and commit
+	GoVersion   string            `json:"go_version"`
+	Host        string            `json:"host"`                   // the server's own os/arch
+	Compilers   map[string]string `json:"compilers"`              // C compiler -> its --version line
+	Libc        string            `json:"libc,omitempty"`         // e.g. "glibc 2.36"
+	ImageDigest string            `json:"image_digest,omitempty"` // from BILLDER_IMAGE_DIGEST
+	Digest      string            `json:"digest"`                 // hash of everything above
+	Condensed   string            `json:"condensed"`              // the one-line form in summaries
+}
+
+var (
+	fingerprintOnce sync.Once
+	fingerprint     Fingerprint
+)
+
+// environment collects the fingerprint once; compilers and the image don't
+// change while the server runs.
+func environment() Fingerprint {
+	fingerprintOnce.Do(func() {
+		fp := Fingerprint{
+			Billder:     serverVersion(),
+			GoVersion:   toolchainVersion(),
+			Host:        runtime.GOOS + "/" + runtime.GOARCH,
+			Compilers:   map[string]string{},
+			ImageDigest: os.Getenv("BILLDER_IMAGE_DIGEST"),
+		}
+		for _, t := range builtinTargets {
+			goos, goarch, _ := strings.Cut(t, "/")
+			tc, _ := toolchainFor(goos, goarch)
+			if _, seen := fp.Compilers[tc.CC]; seen {
+				continue
+			}
+			out, err := exec.Command(tc.CC, "--version").Output()
+			line, _, _ := strings.Cut(string(out), "\n")
+			if err != nil || line == "" {
+				line = "not installed"
+			}
+			fp.Compilers[tc.CC] = strings.TrimSpace(line)
+		}
+		if out, err := exec.Command("getconf", "GNU_LIBC_VERSION").Output(); err == nil {
+			fp.Libc = strings.TrimSpace(string(out))
+		}
+		data, _ := json.Marshal(fp)
+		sum := sha256.Sum256(data)
+		fp.Digest = hex.EncodeToString(sum[:6])
+		fp.Condensed = fp.condense()
+		fingerprint = fp
+	})
+	return fingerprint
+}
+
+// condense joins the fingerprint into one line, compilers by their version
+// number only.
+func (fp Fingerprint) condense() string {
+	parts := []string{"billder " + fp.Billder, fp.GoVersion, fp.Host}
+	ccs := make([]string, 0, len(fp.Compilers))
+	for cc := range fp.Compilers {
+		ccs = append(ccs, cc)
+	}
+	slices.Sort(ccs)
+	for _, cc := range ccs {
+		fields := strings.Fields(fp.Compilers[cc])
+		version := "missing"
+		if len(fields) > 0 && fp.Compilers[cc] != "not installed" {
+			version = fields[len(fields)-1]
+		}
+		parts = append(parts, cc+" "+version)
+	}
+	if fp.Libc != "" {
+		parts = append(parts, fp.Libc)
+	}
+	if fp.ImageDigest != "" {
+		parts = append(parts, "image "+fp.ImageDigest)
+	}
+	return strings.Join(parts, ", ") + " [" + fp.Digest + "]"
+}
+
+// serverVersion is the billder version plus the commit it was built from,
+// when known.
+func serverVersion() string {
+	v := version.Get()
+	return strings.TrimSpace(v.Version + " " + v.ShortCommit())
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// cacheCorruption are go build errors, lowercased, that come from damaged
+// build cache entries rather than from the code being built.
+var cacheCorruption = []string{
+	"invalid checksum",
+	"error obtaining buildid",
+	"reading export data",
+	"is not an object file",
+	"object file is corrupt",
+	"corrupted cache",
+}
+
+// cachePartition guards one target's GOCACHE. Builds share it; a reset
+// waits for them and has it to itself.
+type cachePartition struct {
+	sync.RWMutex
+	resets int // bumped by each reset, so concurrent reports reset once
+}
+
+var cachePartitions sync.Map // CacheDir -> *cachePartition
+
+func (t Toolchain) cachePartition() *cachePartition {
+	p, _ := cachePartitions.LoadOrStore(t.CacheDir(), &cachePartition{})
+	return p.(*cachePartition)
+}
+
+// cacheCorrupted reports whether build output shows the target's cache is
+// damaged: a known corruption error, or a cache file gone missing or cut
+// short.
+func cacheCorrupted(text string, tc Toolchain) bool {
+	lower := strings.ToLower(text)
+	for _, match := range cacheCorruption {
+		if strings.Contains(lower, match) {
+			return true
+		}
+	}
+	for _, line := range strings.Split(text, "\n") {
+		lower := strings.ToLower(line)
+		if strings.Contains(line, tc.CacheDir()) && (strings.Contains(lower, "no such file or directory") || strings.Contains(lower, "unexpected eof")) {
+			return true
+		}
+	}
+	return false
+}
+
+// runCompile runs a build command of the target with its cache partition
+// and the module cache shared. When the build fails on a corrupted cache,
+// the partition is cleared and the command run once more; on module
+// versions left damaged in the module cache, those are downloaded again
+// first.
+func (j *buildJob) runCompile(tc Toolchain, ts *targetStream, cmd *exec.Cmd, onLine func(stream, line string)) ([]byte, error) {
+	partition := tc.cachePartition()
+	partition.RLock()
+	seen := partition.resets
+	release := holdModCache(cmd)
+	out, err := runStreaming(cmd, onLine)
+	release()
+	partition.RUnlock()
+	if err == nil || j.ctx.Err() != nil {
+		return out, err
+	}
+	_, text := parseBuildOutput(out)
+	switch {
+	case cacheCorrupted(text, tc):
+		j.log.Command("["+ts.target+"] ", cmd, []byte(text), err)
+		if err := resetCache(tc, seen); err != nil {
+			log.Printf("Reset cache %s: %v", tc.CacheDir(), err)
+		}
+		ts.Message(fmt.Sprintf("Warning: the %s/%s build cache was corrupted and has been reset; retrying the build once", tc.GOOS, tc.GOARCH))
+	case len(damagedModules(text, goEnv("GOMODCACHE"))) > 0:
+		j.log.Command("["+ts.target+"] ", cmd, []byte(text), err)
+		j.repairModCache("compile", text, cmd.Env, ts.Message)
+	default:
+		return out, err
+	}
+	retry := exec.CommandContext(j.ctx, cmd.Args[0], cmd.Args[1:]...)
+	retry.Dir, retry.Env = cmd.Dir, cmd.Env
+	partition.RLock()
+	defer partition.RUnlock()
+	defer holdModCache(retry)()
+	return runStreaming(retry, onLine)
+}
+
+// resetCache clears the target's cache partition once the builds using it
+// finish, unless it was reset since seen.
+func resetCache(tc Toolchain, seen int) error {
+	partition := tc.cachePartition()
+	partition.Lock()
+	defer partition.Unlock()
+	if partition.resets != seen {
+		return nil // another build found the corruption first
+	}
+	partition.resets++
+	metrics.cacheReset(tc.GOOS + "/" + tc.GOARCH)
+	log.Printf("Clearing the corrupted build cache %s", tc.CacheDir())
+	if err := os.RemoveAll(tc.CacheDir()); err != nil {
+		return err
+	}
+	return os.MkdirAll(tc.CacheDir(), 0o755)
+}
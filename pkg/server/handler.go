@@ -0,0 +1,543 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Step marks the start of a pipeline stage and is sent as the "step" event.
+type Step struct {
+	Target string `json:"target,omitempty"`
+	Index  int    `json:"index"`
+	Total  int    `json:"total"`
+	Name   string `json:"name"`
+}
+
+const totalSteps = 3
+
+// BuildSummary is sent as the "summary" event once a target finishes. For
+// single-target builds it comes right before the artifact.
+type BuildSummary struct {
+	Target   string          `json:"target"`
+	OK       bool            `json:"ok"`
+	Error    string          `json:"error,omitempty"`
+	Category FailureCategory `json:"error_category,omitempty"` // set with Error
+	Repo     string          `json:"repo"`
+	TargetOS string          `json:"target_os"`
+	Arch     string          `json:"target_arch"`
+	Commit   string          `json:"commit"`
+	Describe string          `json:"describe"`
+	Ref      string          `json:"ref,omitempty"` // requested ref, or the default branch
+	Dirty    bool            `json:"dirty"`
+	Artifact string          `json:"artifact,omitempty"`
+	SizeMB   float64         `json:"size_mb,omitempty"`
+	LDFlags  string          `json:"ldflags,omitempty"`
+	BuildID  string          `json:"build_id"`
+	LogURL   string          `json:"log_url"`
+
+	ArtifactURL    string `json:"artifact_url,omitempty"`
+	ArtifactSHA256 string `json:"artifact_sha256,omitempty"` // set when artifact_url is a storage download instead of a streamed binary
+	Delivery       string `json:"delivery,omitempty"`        // "stored" when no binary follows: fetch artifact_url
+	PatchSHA256    string `json:"patch_sha256,omitempty"`    // set when a request patch was applied
+	Signing        string `json:"signing,omitempty"`         // APKs: "debug" or "release"
+	Environment    string `json:"environment,omitempty"`     // condensed Fingerprint of the building server
+
+	ProvenanceURL string `json:"provenance_url,omitempty"` // signed provenance of the artifact, when the server attests builds
+	LicensesURL   string `json:"licenses_url,omitempty"`   // license_report: the reports, also bundled in zips
+
+	QueueWait float64 `json:"queue_wait_seconds,omitempty"` // time spent waiting for a compile slot
+	QueueETA  float64 `json:"queue_eta_seconds,omitempty"`  // the wait estimated when it was queued
+
+	SizeReport *SizeReport `json:"size_report,omitempty"`
+	AVCheck    *AVReport   `json:"av_check,omitempty"`
+	Cmds       []CmdResult `json:"cmds,omitempty"` // build_all_cmds: each command's outcome
+
+	Licenses *LicenseReport `json:"licenses,omitempty"` // license_report: the modules compiled in and their licenses
+	Compare  *CompareReport `json:"compare,omitempty"`  // compare_ref: how the binary differs from compare_ref's
+
+	CompilerOptions *CompilerOptions `json:"compiler_options,omitempty"` // the options the build was compiled with, if any
+
+	Labels map[string]string `json:"labels,omitempty"` // the request's
+
+	Checkout string `json:"checkout,omitempty"` // "archive" when built from a host archive: no .git, so describe is the commit, dirty is unknown and go stamps no VCS info
+}
+
+// MatrixSummary is sent as the "matrix_summary" event at the end of a
+// multi-target build.
+type MatrixSummary struct {
+	Targets   []BuildSummary `json:"targets"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Artifact  string         `json:"artifact,omitempty"`
+	SizeMB    float64        `json:"size_mb,omitempty"`
+	BuildID   string         `json:"build_id"`
+	LogURL    string         `json:"log_url"`
+
+	ArtifactURL    string `json:"artifact_url,omitempty"`
+	ArtifactSHA256 string `json:"artifact_sha256,omitempty"`
+	Delivery       string `json:"delivery,omitempty"`
+	ProvenanceURL  string `json:"provenance_url,omitempty"`
+	LicensesURL    string `json:"licenses_url,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// JobStarted is the first event of a build stream. A client that loses the
+// connection resumes from EventsURL with Last-Event-ID.
+type JobStarted struct {
+	BuildID   string `json:"build_id"`
+	EventsURL string `json:"events_url"`
+}
+
+// goBuildArgs assembles the `go build` command line for the package pkg.
+func goBuildArgs(output, ldflags, pgoPath string, opts *CompilerOptions, pkg string) []string {
+	args := []string{"build", "-v", "-trimpath", "-o", output, "-ldflags", ldflags}
+	args = append(args, opts.args()...)
+	if pgoPath != "" {
+		args = append(args, "-pgo="+pgoPath)
+	}
+	if supportsBuildJSON() {
+		args = append(args, "-json")
+	}
+	return append(args, pkg)
+}
+
+func buildHandler(w http.ResponseWriter, r *http.Request) {
+
+	// 1. Method Check
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The body, which signed requests are checked against, must arrive in time
+	bodyRead := bodyDeadline(w)
+
+	// 2. Auth Check (shared token or signed request)
+	if !authorized(w, r) {
+		return
+	}
+
+	// A server shutting down lets its builds end but starts no more
+	if shuttingDown.Load() {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Service Unavailable: the server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Over-limit callers are turned away before the body is read
+	if rateLimited(w, r) {
+		return
+	}
+
+	// Fake builds skip the pipeline entirely when enabled
+	if wantsFake(r) {
+		fakeBuildHandler(w, r)
+		return
+	}
+
+	// Coordinators hand the build to a worker when one is free
+	if cluster != nil && cluster.dispatch(w, r) {
+		return
+	}
+	activeBuilds.Add(1)
+	defer activeBuilds.Add(-1)
+
+	// 3. Parse and validate Body (size limited to prevent abuse)
+	payload, raw, profile, err := readPayload(w, r)
+	bodyRead()
+	if bodyTimedOut(w, r, err) {
+		return
+	}
+	var defaults []AppliedDefault
+	if err == nil {
+		log.Println("Received build request from", clientIP(r), payload)
+		defaults, err = applyRepoDefaults(&payload, raw, cfg.RepoDefaults)
+	}
+	if err == nil {
+		err = payload.normalize(profile != nil)
+	}
+	if err != nil {
+		log.Printf("Payload error: %v", err)
+		writePayloadError(w, err)
+		return
+	}
+
+	// Tokens may be limited to some targets, repositories and options
+	if field, problem := restriction(callerID(r), payload, profile != nil, defaults); field != "" {
+		log.Printf("Refusing %s from %s: %s", field, callerID(r), problem)
+		writeRestricted(w, field, problem)
+		return
+	}
+
+	// One running copy of a build per caller, unless forced
+	id := newBuildID()
+	if !payload.DryRun && !payload.Force {
+		key := buildKey(callerID(r), payload)
+		if existing, ok := claimBuild(key, id); !ok {
+			log.Printf("Rejecting duplicate of running build %s from %s", existing.id, clientIP(r))
+			writeConflict(w, existing)
+			return
+		}
+		defer releaseBuild(key)
+	}
+
+	// 4. Setup Streaming Headers
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sse.legacy = requestProtocol(r) == "legacy"
+
+	// --- BUILD LOGIC ---
+
+	// 5. Determine Compiler Environment per target
+	toolchains := toolchainsFor(payload)
+
+	if payload.DryRun {
+		for _, tc := range toolchains {
+			if sse.Gone() {
+				return
+			}
+			sse.Event("dry_run", planDryRun(payload, tc, profile != nil))
+		}
+		sse.Close(streamEnd(true, "", nil))
+		return
+	}
+
+	runBuild(sse, JobRecord{ID: id, Origin: "api", Caller: callerID(r), Payload: payload, Traceparent: r.Header.Get("traceparent"), Protocol: requestProtocol(r), Defaults: defaults}, toolchains, profile)
+}
+
+// runBuild runs the pipeline of a validated request, streaming to sse, and
+// reports whether every target built. The build is journaled so a restarted
+// server can report or rerun it.
+func runBuild(sse *sseWriter, rec JobRecord, toolchains []Toolchain, profile []byte) (ok bool) {
+	id, payload := rec.ID, rec.Payload
+
+	// Builds outlive a disconnected client, but not the configured timeout,
+	// a cancel request, shutdown or a client that stays connected without
+	// reading. Whichever stopped it is kept as the context's cause.
+	ctx, stop := context.WithCancelCause(context.Background())
+	defer stop(nil)
+	defer trackBuild(id, stop)()
+	sse.onStall(func() { stop(errClientStalled) })
+	if cfg.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.BuildTimeout)
+		defer cancel()
+	}
+
+	startJob(&rec)
+	publishStarted(&rec)
+	clock := newStepClock()
+	var failure FailureCategory // set where a step fails
+	defer func() {
+		rec.Failure = failure
+		rec.Timing = clock.stop()
+		if !ok {
+			metrics.buildFailed(failure)
+		}
+		if !ok && errors.Is(context.Cause(ctx), errShutdown) {
+			abandonJob(&rec)
+		} else {
+			finishJob(&rec, ok)
+		}
+		publishFinished(&rec)
+	}()
+
+	// Traced as a child of the caller's traceparent when a collector is set
+	trace := startTrace(rec.Traceparent, "build")
+	trace.set("billder.build_id", id)
+	trace.set("billder.repo", payload.RepoURL)
+	trace.set("billder.targets", strings.Join(payload.Targets, ","))
+	defer trace.end()
+
+	// Events are numbered and buffered so late or dropped clients can catch up
+	sse.events = startEventLog(id)
+	defer finishEventLog(id, sse.events)
+	defer func() {
+		if !ok && failure == "" {
+			failure = FailInternal
+		}
+		// Every way out of the pipeline ends the stream here
+		sse.Close(streamEnd(ok, failure, context.Cause(ctx)))
+	}()
+	session := newSession(id, cmp.Or(rec.Protocol, apiVersion), rec.Caller, payload)
+	session.Defaults = rec.Defaults
+	sse.Event("session", session)
+	sse.Event("job", JobStarted{BuildID: id, EventsURL: "/" + apiVersion + "/builds/" + id + "/events"})
+
+	sse.Message(fmt.Sprintf("Starting job for %s [%s]", payload.RepoURL, strings.Join(payload.Targets, ", ")))
+
+	// 6. Create Temp Workspace
+	tmpDir, err := os.MkdirTemp("", "billder-*")
+	if err != nil {
+		sse.Message("Error: Failed to create workspace")
+		failure = FailInternal
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	job := &buildJob{ctx: ctx, payload: payload, id: id, started: rec.StartedAt, tmpDir: tmpDir, repoPath: filepath.Join(tmpDir, "src"), trace: trace, maxBytes: artifactLimit(rec.Caller), rec: &rec}
+
+	// Every subprocess writes to the build log, kept after the workspace is gone
+	job.log, err = createBuildLog(filepath.Join(tmpDir, "build.log"))
+	if err != nil {
+		sse.Message("Error: Failed to create build log")
+		failure = FailInternal
+		return
+	}
+	defer func() {
+		if err := job.log.Persist(job.id); err != nil {
+			log.Printf("Persist log %s: %v", job.id, err)
+		}
+	}()
+	job.log.Printf("build %s: %s [%s]", job.id, payload.RepoURL, strings.Join(payload.Targets, ", "))
+	sse.Message(fmt.Sprintf("Build ID: %s", job.id))
+
+	// 7. Git Clone
+	step := Step{Index: 1, Total: totalSteps, Name: "Cloning repository"}
+	sse.Event("step", step)
+	publishStep(&rec, step)
+	clock.start("clone")
+	cloneSpan := trace.child("clone")
+	cloneStart := time.Now()
+	// failCheckout ends the clone step with err, as a timeout when the
+	// build was stopped meanwhile.
+	failCheckout := func(err error) {
+		cloneSpan.fail(err.Error())
+		cloneSpan.end()
+		trace.fail(err.Error())
+		if job.ctx.Err() != nil {
+			sse.Message("Error: " + job.stopReason())
+			failure = FailTimeout
+			return
+		}
+		sse.Message("Error: " + err.Error())
+		failure = categoryOf(err, FailInternal)
+	}
+	host := hostFor(payload.RepoURL)
+	archiveCommit := ""
+	if payload.CheckoutMode == "archive" {
+		var unavailable *archiveUnavailable
+		archiveCommit, err = job.fetchArchive(host, sse)
+		switch {
+		case err == nil:
+			job.archived = true
+		case errors.As(err, &unavailable) && job.ctx.Err() == nil:
+			sse.Message(fmt.Sprintf("Archive unavailable (%s); cloning with git instead", err))
+			os.RemoveAll(job.repoPath)
+		default:
+			failCheckout(err)
+			return
+		}
+	}
+	cloneSpan.set("billder.archive", job.archived)
+	switch {
+	case job.archived: // fetched above
+	case cfg.MirrorDir != "":
+		state, err := job.cloneFromMirror(host, payload, sse)
+		cloneSpan.set("billder.mirror", state)
+		if err != nil {
+			failCheckout(err)
+			return
+		}
+	default:
+		args := []string{"clone"}
+		if len(payload.SparsePaths) > 0 {
+			args = append(args, sparseCloneArgs...)
+		}
+		out, err := job.runRetrying(sse, "Clone", func() *exec.Cmd {
+			os.RemoveAll(job.repoPath) // what a failed attempt left behind
+			return host.git(job.ctx, append(args, "--", payload.CloneURL(), job.repoPath)...)
+		})
+		if err != nil {
+			log.Printf("Clone Error: %s", out)
+			failCheckout(failedWith(cloneFailure(out), errors.New("Git clone failed. Is the URL correct?")))
+			return
+		}
+	}
+	if payload.Ref != "" && !job.archived {
+		if err := job.checkoutRef(host, payload.Ref, sse); err != nil {
+			failCheckout(err)
+			return
+		}
+	}
+	if len(payload.SparsePaths) > 0 {
+		if err := job.setSparse(host, sse); err != nil {
+			failCheckout(err)
+			return
+		}
+	}
+	if err := job.pullLFS(host, sse); err != nil {
+		failCheckout(err)
+		return
+	}
+	cloneSpan.end()
+	log.Println("Repository cloned to", job.repoPath)
+	checkout := fmt.Sprintf("Checked out in %s, workspace %.1f MB", time.Since(cloneStart).Round(100*time.Millisecond), float64(dirSize(job.repoPath))/1024/1024)
+	if len(payload.SparsePaths) > 0 {
+		checkout += " (sparse)"
+	}
+	sse.Message(checkout)
+
+	if job.archived {
+		job.vcs = VCSInfo{Commit: archiveCommit, Describe: archiveCommit[:min(len(archiveCommit), 12)]}
+		sse.Message("Checked out from an archive without .git: the version stamped is the commit, and go records no VCS info")
+	} else {
+		job.vcs = resolveVCS(job.repoPath)
+	}
+	if payload.Ref != "" {
+		job.vcs.Branch = payload.Ref
+	}
+	rec.Commit, rec.Ref = job.vcs.Commit, job.vcs.Branch
+	if job.vcs.Commit != "" {
+		sse.Message(fmt.Sprintf("Commit: %s (%s)", job.vcs.Commit, job.vcs.Describe))
+	}
+
+	// The request's patch goes on top of the commit, all or nothing
+	if payload.Patch != "" {
+		if job.patchSHA, err = job.applyPatch(sse); err != nil {
+			sse.Message("Error: " + err.Error())
+			trace.fail(err.Error())
+			failure = categoryOf(err, FailInvalidRequest)
+			return
+		}
+		sse.Message(fmt.Sprintf("Applied patch (sha256 %s)", job.patchSHA))
+	}
+
+	// Trees without a module to build stop here, each with its own reason
+	if err := job.checkTree(sse); err != nil {
+		sse.Message("Error: " + err.Error())
+		trace.fail(err.Error())
+		failure = categoryOf(err, FailInternal)
+		return
+	}
+
+	// Repositories with several modules say which one to build
+	if err := job.selectModule(sse); err != nil {
+		sse.Message("Error: " + err.Error())
+		trace.fail(err.Error())
+		failure = categoryOf(err, FailInvalidRequest)
+		return
+	}
+	if payload.BuildAllCmds {
+		if err := job.selectCmds(sse); err != nil {
+			sse.Message("Error: " + err.Error())
+			trace.fail(err.Error())
+			failure = categoryOf(err, FailInvalidRequest)
+			return
+		}
+	}
+
+	// 8. Go Mod Tidy (shared by every target)
+	step = Step{Index: 2, Total: totalSteps, Name: "Resolving dependencies"}
+	sse.Event("step", step)
+	publishStep(&rec, step)
+	clock.start("deps")
+	depsSpan := trace.child("deps")
+	tidy := func() *exec.Cmd {
+		tidyCmd := exec.CommandContext(job.ctx, "go", "mod", "tidy", "-x") // -x logs which proxy served each module
+		tidyCmd.Dir = job.moduleDir
+		tidyCmd.Env = toolchains[0].Env()
+		return tidyCmd
+	}
+	out, err := job.runRetrying(sse, "Module download", tidy) // Errors are ignored, just a best effort cleanup
+	if err != nil && job.ctx.Err() == nil && job.repairModCache("deps", string(out), toolchains[0].Env(), sse.Message) {
+		out, err = job.runRetrying(sse, "Module download", tidy)
+	}
+	if sources := moduleSources(out); len(sources) > 0 {
+		sse.Message("Modules downloaded from " + strings.Join(sources, ", "))
+	}
+	depsSpan.set("billder.tidy_ok", err == nil)
+	depsSpan.end()
+
+	// tidy may rewrite go.mod/go.sum, which makes the tree differ from the commit
+	job.vcs.Dirty = !job.archived && isDirty(job.repoPath)
+	if job.vcs.Dirty && job.patchSHA == "" && !job.syntheticModule {
+		sse.Message("Warning: go mod tidy modified go.mod/go.sum; build differs from commit")
+	}
+
+	if err := job.resolvePGO(profile, sse); err != nil {
+		sse.Message("Error: " + err.Error())
+		failure = categoryOf(err, FailInvalidRequest)
+		return
+	}
+	job.packager = job.choosePackager(sse)
+
+	// compare_ref is built the same way from a worktree of the clone
+	var compare *buildJob
+	if payload.CompareRef != "" {
+		if compare, err = job.prepareCompare(host, toolchains[0], sse); err != nil {
+			sse.Message("Error: " + err.Error())
+			trace.fail(err.Error())
+			failure = categoryOf(err, FailInternal)
+			return
+		}
+	}
+
+	// 9. Go Build, up to payload.Parallelism targets at a time
+	clock.start("compile")
+	parallelism := payload.Parallelism
+	if payload.Matrix() {
+		parallelism = effectiveParallelism(parallelism)
+		if parallelism < payload.Parallelism {
+			sse.Message(fmt.Sprintf("Server busy: building %d target(s) at a time", parallelism))
+		}
+	}
+	results := make([]targetResult, len(toolchains))
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, tc := range toolchains {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			ts := &targetStream{sseWriter: sse, target: payload.Targets[i], prefix: payload.Matrix(), keepColor: payload.Color == "keep"}
+			results[i] = job.buildTarget(tc, ts)
+			if compare != nil && results[i].summary.OK {
+				job.compare(compare, tc, ts, &results[i])
+			}
+			if payload.Matrix() {
+				sse.Event("summary", results[i].summary)
+			}
+		}()
+	}
+	wg.Wait()
+	failed := 0
+	for _, res := range results {
+		if !res.summary.OK {
+			failure = cmp.Or(failure, res.summary.Category) // the first target's, in request order
+			failed++
+		}
+	}
+	if failed > 0 {
+		trace.fail(fmt.Sprintf("%d of %d target(s) failed", failed, len(results)))
+	}
+	ok = failed == 0
+
+	// 10. Handover Strategy (Stream the file)
+	clock.start("deliver")
+	delivered := false
+	if payload.Matrix() {
+		delivered = job.deliverMatrix(results, sse)
+	} else {
+		delivered = job.deliverSingle(results[0], sse)
+	}
+	failure = cmp.Or(failure, job.failure)
+	rec.PartialTransfer, rec.Artifact = job.partial, job.stored
+	rec.CacheHit, rec.ArtifactBytes = job.cacheHit, job.artifactBytes
+	return ok && delivered
+}
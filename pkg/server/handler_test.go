@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fixtureOutput is what testdata/handler/hello prints.
+const fixtureOutput = "billder fixture ok"
+
+// TestHandler builds the fixture repository through the Server New
+// returns, served with httptest.
+func TestHandler(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds for real")
+	}
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("the fixture builds on linux/amd64 hosts only")
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repos", "hello")
+	if err := os.CopyFS(repo, os.DirFS(filepath.Join("testdata", "handler", "hello"))); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=billder", "-c", "user.email=billder@example.invalid", "commit", "-q", "-m", "fixture"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", args[0], err, out)
+		}
+	}
+	gitconfig := filepath.Join(dir, "gitconfig")
+	os.WriteFile(gitconfig, []byte(fmt.Sprintf("[url \"file://%s/\"]\n\tinsteadOf = https://fixture.test/\n", filepath.Join(dir, "repos"))), 0o644)
+
+	t.Setenv("GIT_CONFIG_GLOBAL", gitconfig)
+	t.Setenv("GIT_TERMINAL_PROMPT", "0")
+	t.Setenv("GOPROXY", "off")
+	t.Setenv("GOFLAGS", "-mod=mod")
+	srv := httptest.NewServer(openServer(t, WithDataDir(filepath.Join(dir, "data")), WithHistoryFile(filepath.Join(dir, "history.json"))))
+	defer srv.Close()
+
+	var summary BuildSummary
+	var artifact []byte
+	t.Run("build", func(t *testing.T) {
+		s := postBuild(t, srv.URL, `{"repo_url": "https://fixture.test/hello", "target_os": "linux", "target_arch": "amd64"}`)
+		if s.status != http.StatusOK {
+			t.Fatalf("%d: %v", s.status, s.events)
+		}
+		s.event(t, "summary", &summary)
+		if !summary.OK || summary.Repo != "fixture.test/hello" || len(summary.Commit) < 7 {
+			t.Fatalf("summary %+v", summary)
+		}
+		if s.filename != "app" || len(s.artifact) == 0 {
+			t.Fatalf("artifact %q of %d bytes", s.filename, len(s.artifact))
+		}
+		artifact = s.artifact
+		bin := filepath.Join(t.TempDir(), s.filename)
+		os.WriteFile(bin, s.artifact, 0o755)
+		if out, err := exec.Command(bin).Output(); err != nil || strings.TrimSpace(string(out)) != fixtureOutput {
+			t.Errorf("the artifact printed %q: %v", out, err)
+		}
+	})
+	if summary.BuildID == "" {
+		t.FailNow()
+	}
+
+	t.Run("log", func(t *testing.T) {
+		code, data := get(t, srv.URL+"/v1/builds/"+summary.BuildID+"/log")
+		if code != http.StatusOK || !bytes.Contains(data, []byte("fixture.test/hello")) {
+			t.Errorf("GET /v1/builds/%s/log: %d %s", summary.BuildID, code, data)
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		code, data := get(t, srv.URL+"/v1/builds/"+summary.BuildID)
+		var rec JobRecord
+		json.Unmarshal(data, &rec)
+		if code != http.StatusOK || rec.State != jobFinished || !rec.OK || rec.Payload.RepoURL != "fixture.test/hello" {
+			t.Errorf("GET /v1/builds/%s: %d %s", summary.BuildID, code, data)
+		}
+	})
+
+	t.Run("artifact", func(t *testing.T) {
+		if code, data := get(t, srv.URL+"/v1/builds/"+summary.BuildID+"/artifact"); code != http.StatusOK || !bytes.Equal(data, artifact) {
+			t.Errorf("GET /v1/builds/%s/artifact: %d, %d bytes; streamed %d", summary.BuildID, code, len(data), len(artifact))
+		}
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		s := postBuild(t, srv.URL, `{"repo_url": "https://fixture.test/hello", "targets": ["plan9/amd64"]}`)
+		if s.status != http.StatusBadRequest {
+			t.Errorf("unsupported target: %d", s.status)
+		}
+	})
+
+	t.Run("missing repository", func(t *testing.T) {
+		s := postBuild(t, srv.URL, `{"repo_url": "https://fixture.test/missing", "target_os": "linux"}`)
+		var end StreamEnd
+		s.event(t, "end", &end)
+		if end.OK || end.Category != FailRepoNotFound || s.artifact != nil {
+			t.Errorf("end %+v", end)
+		}
+	})
+}
+
+// buildStream is the response to POST /v1/build: its events, and the
+// artifact that follows binary_start.
+type buildStream struct {
+	status   int
+	events   []sseEvent
+	filename string
+	artifact []byte
+}
+
+func postBuild(t *testing.T, url, body string) buildStream {
+	t.Helper()
+	resp, err := http.Post(url+"/v1/build", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := buildStream{status: resp.StatusCode}
+	head, rest, found := bytes.Cut(data, []byte("event: binary_start\ndata: "))
+	s.events = parseSSE(string(head))
+	if found {
+		name, artifact, _ := bytes.Cut(rest, []byte("\n\n"))
+		s.filename, s.artifact = string(name), artifact
+	}
+	return s
+}
+
+// event decodes the first event of the stream named name into v.
+func (s buildStream) event(t *testing.T, name string, v any) {
+	t.Helper()
+	for _, ev := range s.events {
+		if ev.name == name {
+			if err := json.Unmarshal([]byte(ev.data), v); err != nil {
+				t.Fatalf("%s event %q: %v", name, ev.data, err)
+			}
+			return
+		}
+	}
+	t.Fatalf("no %s event in %v", name, s.events)
+}
+
+func get(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// RepoStats is what we remember about previous builds of a repo and target.
+type RepoStats struct {
+	Packages int     `json:"packages"`
+	Seconds  float64 `json:"seconds"`
+}
+
+// ArtifactOrigin ties a delivered file's digest to the build that made it.
+type ArtifactOrigin struct {
+	BuildID string    `json:"build_id"`
+	Name    string    `json:"name"`
+	Target  string    `json:"target,omitempty"` // "" for bundles of several targets
+	At      time.Time `json:"at"`
+}
+
+// maxArtifactOrigins is how many digests the history remembers; the oldest
+// are forgotten first.
+const maxArtifactOrigins = 10000
+
+// historyStore is a small JSON-file database of past builds.
+type historyStore struct {
+	mu    sync.Mutex
+	path  string
+	Repos map[string]RepoStats `json:"repos"`
+
+	Artifacts map[string]ArtifactOrigin `json:"artifacts"` // sha256 -> where it came from
+}
+
+// history is shared by all handlers.
+var history *historyStore
+
+// openHistory loads the store, starting empty if the file is missing or corrupt.
+func openHistory(path string) *historyStore {
+	h := &historyStore{path: path, Repos: make(map[string]RepoStats), Artifacts: make(map[string]ArtifactOrigin)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return h
+	}
+	if err := json.Unmarshal(data, h); err != nil {
+		log.Printf("History file %s unreadable, starting fresh: %v", path, err)
+	}
+	if h.Repos == nil {
+		h.Repos = make(map[string]RepoStats)
+	}
+	if h.Artifacts == nil {
+		h.Artifacts = make(map[string]ArtifactOrigin)
+	}
+	return h
+}
+
+// historyKey identifies a repo built for one target.
+func historyKey(repo, goos, goarch string) string {
+	return repo + " " + goos + "/" + goarch
+}
+
+// Get returns the stats recorded for key.
+func (h *historyStore) Get(key string) (RepoStats, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.Repos[key]
+	return s, ok
+}
+
+// Average is the mean compile time over every recorded repository and
+// target, for estimating builds without history of their own.
+func (h *historyStore) Average() (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.Repos) == 0 {
+		return 0, false
+	}
+	var total float64
+	for _, s := range h.Repos {
+		total += s.Seconds
+	}
+	return time.Duration(total / float64(len(h.Repos)) * float64(time.Second)), true
+}
+
+// Record stores stats for key and persists the store.
+func (h *historyStore) Record(key string, s RepoStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Repos[key] = s
+	h.saveLocked()
+}
+
+// RecordArtifact remembers that the file with hex digest sum came from
+// origin, and persists the store.
+func (h *historyStore) RecordArtifact(sum string, origin ArtifactOrigin) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.Artifacts[sum]; !ok && len(h.Artifacts) >= maxArtifactOrigins {
+		oldest := ""
+		for k, o := range h.Artifacts {
+			if oldest == "" || o.At.Before(h.Artifacts[oldest].At) {
+				oldest = k
+			}
+		}
+		delete(h.Artifacts, oldest)
+	}
+	h.Artifacts[sum] = origin
+	h.saveLocked()
+}
+
+// Artifact returns where the file with hex digest sum came from.
+func (h *historyStore) Artifact(sum string) (ArtifactOrigin, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	o, ok := h.Artifacts[sum]
+	return o, ok
+}
+
+// saveLocked persists the store; h.mu must be held.
+func (h *historyStore) saveLocked() {
+	data, err := json.Marshal(h)
+	if err != nil {
+		log.Printf("History marshal error: %v", err)
+		return
+	}
+	// Write then rename so a crash never leaves a truncated file
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Printf("History write error: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		log.Printf("History write error: %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// GitHost is a git server from the "hosts" list of the config file: a
+// self-hosted instance, or a well-known host that needs credentials.
+type GitHost struct {
+	Host      string `json:"host"`                 // e.g. git.example.com or git.example.com:3000
+	Provider  string `json:"provider"`             // github, gitlab, bitbucket, gitea or generic
+	Scheme    string `json:"scheme,omitempty"`     // https (default) or http
+	TokenEnv  string `json:"token_env,omitempty"`  // environment variable holding an access token
+	TokenFile string `json:"token_file,omitempty"` // or a file holding one
+	APIBase   string `json:"api_base,omitempty"`   // REST API root; the provider's default if empty
+}
+
+// HostInfo is one entry of Capabilities.Hosts.
+type HostInfo struct {
+	Host        string `json:"host"`
+	Provider    string `json:"provider"`
+	APIBase     string `json:"api_base"`
+	Credentials bool   `json:"credentials"` // clones are authenticated
+}
+
+// provider holds the quirks of a git hosting product.
+type provider interface {
+	// pullRef is the ref pull or merge request n is fetched from.
+	pullRef(n string) string
+	// authHeader is the HTTP header git sends to authenticate with token.
+	authHeader(token string) string
+	// apiBase is the REST API root when the host doesn't configure one.
+	apiBase(scheme, host string) string
+	// archiveURL is where the API at api serves a tarball of ref in repo
+	// (owner/name), of the default branch when ref is "", or "" if it
+	// serves none.
+	archiveURL(api, repo, ref string) string
+	// apiAuthHeader is the HTTP header that authenticates API requests.
+	apiAuthHeader(token string) string
+}
+
+type githubProvider struct{}
+
+func (githubProvider) pullRef(n string) string { return "refs/pull/" + n + "/head" }
+func (githubProvider) authHeader(token string) string {
+	return basicAuth("x-access-token", token)
+}
+func (githubProvider) apiBase(scheme, host string) string {
+	if host == "github.com" {
+		return "https://api.github.com"
+	}
+	return scheme + "://" + host + "/api/v3" // GitHub Enterprise Server
+}
+func (githubProvider) archiveURL(api, repo, ref string) string {
+	if ref != "" {
+		ref = "/" + ref
+	}
+	return api + "/repos/" + repo + "/tarball" + ref // redirects to codeload
+}
+func (githubProvider) apiAuthHeader(token string) string { return "Authorization: Bearer " + token }
+
+type gitlabProvider struct{}
+
+func (gitlabProvider) pullRef(n string) string        { return "refs/merge-requests/" + n + "/head" }
+func (gitlabProvider) authHeader(token string) string { return basicAuth("oauth2", token) }
+func (gitlabProvider) apiBase(scheme, host string) string {
+	return scheme + "://" + host + "/api/v4"
+}
+func (gitlabProvider) archiveURL(api, repo, ref string) string {
+	if ref != "" {
+		ref = "?sha=" + url.QueryEscape(ref)
+	}
+	return api + "/projects/" + url.PathEscape(repo) + "/repository/archive.tar.gz" + ref
+}
+func (gitlabProvider) apiAuthHeader(token string) string { return "Authorization: Bearer " + token }
+
+// bitbucketProvider publishes pull requests under refs/pull-requests/N/from,
+// as Bitbucket Data Center does.
+type bitbucketProvider struct{}
+
+func (bitbucketProvider) pullRef(n string) string        { return "refs/pull-requests/" + n + "/from" }
+func (bitbucketProvider) authHeader(token string) string { return basicAuth("x-token-auth", token) }
+func (bitbucketProvider) apiBase(scheme, host string) string {
+	if host == "bitbucket.org" {
+		return "https://api.bitbucket.org/2.0"
+	}
+	return scheme + "://" + host + "/rest/api/1.0"
+}
+func (bitbucketProvider) archiveURL(api, repo, ref string) string { return "" }
+func (b bitbucketProvider) apiAuthHeader(token string) string     { return b.authHeader(token) }
+
+// giteaProvider also covers Forgejo, which accepts Gitea's "token" scheme.
+type giteaProvider struct{}
+
+func (giteaProvider) pullRef(n string) string        { return "refs/pull/" + n + "/head" }
+func (giteaProvider) authHeader(token string) string { return "Authorization: token " + token }
+func (giteaProvider) apiBase(scheme, host string) string {
+	return scheme + "://" + host + "/api/v1"
+}
+func (giteaProvider) archiveURL(api, repo, ref string) string {
+	if ref == "" {
+		return "" // needs a ref; the default branch isn't known before cloning
+	}
+	return api + "/repos/" + repo + "/archive/" + ref + ".tar.gz"
+}
+func (g giteaProvider) apiAuthHeader(token string) string { return g.authHeader(token) }
+
+// genericProvider is any other git server: GitHub style pull refs and a
+// bearer token.
+type genericProvider struct{}
+
+func (genericProvider) pullRef(n string) string                 { return "refs/pull/" + n + "/head" }
+func (genericProvider) authHeader(token string) string          { return "Authorization: Bearer " + token }
+func (genericProvider) apiBase(scheme, host string) string      { return "" }
+func (genericProvider) archiveURL(api, repo, ref string) string { return "" }
+func (g genericProvider) apiAuthHeader(token string) string     { return g.authHeader(token) }
+
+var providers = map[string]provider{
+	"github":    githubProvider{},
+	"gitlab":    gitlabProvider{},
+	"bitbucket": bitbucketProvider{},
+	"gitea":     giteaProvider{},
+	"generic":   genericProvider{},
+}
+
+// wellKnownHosts are recognized without configuration.
+var wellKnownHosts = map[string]string{
+	"github.com":    "github",
+	"gitlab.com":    "gitlab",
+	"bitbucket.org": "bitbucket",
+}
+
+func basicAuth(user, token string) string {
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+token))
+}
+
+var hostPattern = regexp.MustCompile(`^[A-Za-z0-9.-]+(:[0-9]+)?$`)
+
+// gitHost is a resolved GitHost.
+type gitHost struct {
+	name     string
+	provider string
+	impl     provider
+	scheme   string
+	token    string
+	api      string
+}
+
+var (
+	gitHostsMu sync.RWMutex
+	gitHosts   map[string]*gitHost
+)
+
+// setHosts resolves the configured hosts' tokens, which join the redacted
+// secrets. A host whose token can't be read clones anonymously.
+func setHosts(list []GitHost) {
+	hosts := map[string]*gitHost{}
+	for _, h := range list {
+		gh := &gitHost{name: strings.ToLower(h.Host), provider: h.Provider, impl: providers[h.Provider], scheme: h.Scheme, api: h.APIBase}
+		if gh.impl == nil {
+			gh.provider, gh.impl = "generic", genericProvider{}
+		}
+		if gh.scheme == "" {
+			gh.scheme = "https"
+		}
+		switch {
+		case h.TokenEnv != "":
+			gh.token = strings.TrimSpace(os.Getenv(h.TokenEnv))
+		case h.TokenFile != "":
+			data, err := os.ReadFile(h.TokenFile)
+			if err != nil {
+				log.Printf("Host %s: %v; cloning without credentials", h.Host, err)
+			}
+			gh.token = strings.TrimSpace(string(data))
+		}
+		if gh.api == "" {
+			gh.api = gh.impl.apiBase(gh.scheme, gh.name)
+		}
+		secrets.Add(gh.token)
+		hosts[gh.name] = gh
+	}
+	gitHostsMu.Lock()
+	gitHosts = hosts
+	gitHostsMu.Unlock()
+}
+
+// hostFor returns the host serving a canonical repository.
+func hostFor(repo string) *gitHost {
+	name, _, _ := strings.Cut(strings.ToLower(repo), "/")
+	gitHostsMu.RLock()
+	h := gitHosts[name]
+	gitHostsMu.RUnlock()
+	if h != nil {
+		return h
+	}
+	kind := wellKnownHosts[name]
+	if kind == "" {
+		kind = "generic"
+	}
+	impl := providers[kind]
+	return &gitHost{name: name, provider: kind, impl: impl, scheme: "https", api: impl.apiBase("https", name)}
+}
+
+// knownHosts lists the well-known and configured hosts.
+func knownHosts() []HostInfo {
+	names := map[string]bool{}
+	for name := range wellKnownHosts {
+		names[name] = true
+	}
+	gitHostsMu.RLock()
+	for name := range gitHosts {
+		names[name] = true
+	}
+	gitHostsMu.RUnlock()
+	list := make([]HostInfo, 0, len(names))
+	for name := range names {
+		h := hostFor(name)
+		list = append(list, HostInfo{Host: h.name, Provider: h.provider, APIBase: h.api, Credentials: h.token != ""})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	return list
+}
+
+var pullRefPattern = regexp.MustCompile(`^(?:refs/)?(?:pull|merge-requests|pull-requests)/([0-9]+)/(?:head|from)$`)
+
+// resolveRef translates a pull or merge request ref written in any host's
+// style (pull/N/head, merge-requests/N/head, pull-requests/N/from) to the
+// one this host serves. Other refs are returned unchanged.
+func (h *gitHost) resolveRef(ref string) string {
+	if m := pullRefPattern.FindStringSubmatch(ref); m != nil {
+		return h.impl.pullRef(m[1])
+	}
+	return ref
+}
+
+// git returns a git command talking to the host. The credentials go in the
+// environment, scoped to the host's URL, so they never show up in the
+// process list, the build log or a redirect to another server.
+func (h *gitHost) git(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if h.token != "" {
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http."+h.scheme+"://"+h.name+"/.extraHeader",
+			"GIT_CONFIG_VALUE_0="+h.impl.authHeader(h.token),
+		)
+	}
+	return cmd
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useHosts configures the git hosts for the length of the test.
+func useHosts(t *testing.T, list ...GitHost) {
+	t.Helper()
+	gitHostsMu.RLock()
+	prev := gitHosts
+	gitHostsMu.RUnlock()
+	setHosts(list)
+	t.Cleanup(func() {
+		gitHostsMu.Lock()
+		gitHosts = prev
+		gitHostsMu.Unlock()
+	})
+}
+
+// gitEnv returns the credential environment a git command for repo gets.
+func gitEnv(repo string) map[string]string {
+	env := map[string]string{}
+	for _, kv := range hostFor(repo).git(context.Background(), "ls-remote").Env {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, "GIT_CONFIG_") {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// hostCase is what one provider is expected to do for one host.
+type hostCase struct {
+	repo     string
+	cloneURL string
+	api      string
+	pullRef  string // what every host's style of "pull request 7" becomes
+	header   string // sent by git, "" without a token
+	archive  string // of the tag v1, "" if there is none
+	branch   string // archive of the default branch
+}
+
+func checkHost(t *testing.T, tc hostCase) {
+	t.Helper()
+	h := hostFor(tc.repo)
+	p := RequestPayload{RepoURL: tc.repo}
+	if got := p.CloneURL(); got != tc.cloneURL {
+		t.Errorf("clone URL %s, want %s", got, tc.cloneURL)
+	}
+	if h.api != tc.api {
+		t.Errorf("API base %s, want %s", h.api, tc.api)
+	}
+	for _, ref := range []string{"pull/7/head", "refs/pull/7/head", "merge-requests/7/head", "refs/pull-requests/7/from"} {
+		if got := h.resolveRef(ref); got != tc.pullRef {
+			t.Errorf("resolveRef(%s) = %s, want %s", ref, got, tc.pullRef)
+		}
+	}
+	for _, ref := range []string{"main", "v1.2.3", "refs/heads/pull/7/head", "pull/x/head", "0123abcd"} {
+		if got := h.resolveRef(ref); got != ref {
+			t.Errorf("resolveRef(%s) = %s, want it unchanged", ref, got)
+		}
+	}
+	env := gitEnv(tc.repo)
+	if tc.header == "" {
+		if len(env) != 0 {
+			t.Errorf("git without a token gets %v", env)
+		}
+	} else {
+		key := "http." + strings.TrimSuffix(tc.cloneURL, strings.TrimPrefix(tc.repo, h.name)) + "/.extraHeader"
+		if env["GIT_CONFIG_COUNT"] != "1" || env["GIT_CONFIG_KEY_0"] != key || env["GIT_CONFIG_VALUE_0"] != tc.header {
+			t.Errorf("git gets %v, want %s scoped to %s", env, tc.header, key)
+		}
+	}
+	owner := strings.TrimPrefix(tc.repo, h.name+"/")
+	if got := h.impl.archiveURL(h.api, owner, "v1"); got != tc.archive {
+		t.Errorf("archive of v1 at %s, want %s", got, tc.archive)
+	}
+	if got := h.impl.archiveURL(h.api, owner, ""); got != tc.branch {
+		t.Errorf("archive of the default branch at %s, want %s", got, tc.branch)
+	}
+}
+
+func basic(user, token string) string {
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+token))
+}
+
+func TestGitHubProvider(t *testing.T) {
+	t.Setenv("GHE_TOKEN", " ghe-secret\n")
+	useHosts(t, GitHost{Host: "GHE.Example.com", Provider: "github", TokenEnv: "GHE_TOKEN"})
+	checkHost(t, hostCase{
+		repo: "github.com/acme/app", cloneURL: "https://github.com/acme/app", api: "https://api.github.com",
+		pullRef: "refs/pull/7/head",
+		archive: "https://api.github.com/repos/acme/app/tarball/v1", branch: "https://api.github.com/repos/acme/app/tarball",
+	})
+	checkHost(t, hostCase{
+		repo: "ghe.example.com/acme/app", cloneURL: "https://ghe.example.com/acme/app", api: "https://ghe.example.com/api/v3",
+		pullRef: "refs/pull/7/head", header: basic("x-access-token", "ghe-secret"),
+		archive: "https://ghe.example.com/api/v3/repos/acme/app/tarball/v1", branch: "https://ghe.example.com/api/v3/repos/acme/app/tarball",
+	})
+	if got := hostFor("ghe.example.com/acme/app").impl.apiAuthHeader("t"); got != "Authorization: Bearer t" {
+		t.Errorf("API auth %s", got)
+	}
+}
+
+func TestGitLabProvider(t *testing.T) {
+	t.Setenv("GITLAB_TOKEN", "glpat-secret")
+	useHosts(t,
+		GitHost{Host: "gitlab.com", Provider: "gitlab", TokenEnv: "GITLAB_TOKEN"},
+		GitHost{Host: "git.corp.internal:8443", Provider: "gitlab", APIBase: "https://api.corp.internal/gitlab/v4"},
+	)
+	checkHost(t, hostCase{
+		repo: "gitlab.com/group/sub/app", cloneURL: "https://gitlab.com/group/sub/app", api: "https://gitlab.com/api/v4",
+		pullRef: "refs/merge-requests/7/head", header: basic("oauth2", "glpat-secret"),
+		archive: "https://gitlab.com/api/v4/projects/group%2Fsub%2Fapp/repository/archive.tar.gz?sha=v1",
+		branch:  "https://gitlab.com/api/v4/projects/group%2Fsub%2Fapp/repository/archive.tar.gz",
+	})
+	checkHost(t, hostCase{
+		repo: "git.corp.internal:8443/group/app", cloneURL: "https://git.corp.internal:8443/group/app", api: "https://api.corp.internal/gitlab/v4",
+		pullRef: "refs/merge-requests/7/head",
+		archive: "https://api.corp.internal/gitlab/v4/projects/group%2Fapp/repository/archive.tar.gz?sha=v1",
+		branch:  "https://api.corp.internal/gitlab/v4/projects/group%2Fapp/repository/archive.tar.gz",
+	})
+	if got := hostFor("gitlab.com/group/app").impl.apiAuthHeader("t"); got != "Authorization: Bearer t" {
+		t.Errorf("API auth %s", got)
+	}
+}
+
+func TestBitbucketProvider(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(file, []byte("bb-secret\n"), 0o600)
+	useHosts(t, GitHost{Host: "stash.example.com", Provider: "bitbucket", Scheme: "http", TokenFile: file})
+	checkHost(t, hostCase{
+		repo: "bitbucket.org/team/app", cloneURL: "https://bitbucket.org/team/app", api: "https://api.bitbucket.org/2.0",
+		pullRef: "refs/pull-requests/7/from",
+	})
+	checkHost(t, hostCase{
+		repo: "stash.example.com/proj/app", cloneURL: "http://stash.example.com/proj/app", api: "http://stash.example.com/rest/api/1.0",
+		pullRef: "refs/pull-requests/7/from", header: basic("x-token-auth", "bb-secret"),
+	})
+	if got := hostFor("stash.example.com/proj/app").impl.apiAuthHeader("t"); got != basic("x-token-auth", "t") {
+		t.Errorf("API auth %s", got)
+	}
+}
+
+func TestGiteaProvider(t *testing.T) {
+	t.Setenv("GITEA_TOKEN", "gitea-secret")
+	useHosts(t, GitHost{Host: "gitea.example.com:3000", Provider: "gitea", TokenEnv: "GITEA_TOKEN"})
+	checkHost(t, hostCase{
+		repo: "gitea.example.com:3000/acme/app", cloneURL: "https://gitea.example.com:3000/acme/app", api: "https://gitea.example.com:3000/api/v1",
+		pullRef: "refs/pull/7/head", header: "Authorization: token gitea-secret",
+		archive: "https://gitea.example.com:3000/api/v1/repos/acme/app/archive/v1.tar.gz",
+	})
+	if got := hostFor("gitea.example.com:3000/acme/app").impl.apiAuthHeader("t"); got != "Authorization: token t" {
+		t.Errorf("API auth %s", got)
+	}
+}
+
+func TestGenericProvider(t *testing.T) {
+	t.Setenv("GIT_TOKEN", "generic-secret")
+	useHosts(t,
+		GitHost{Host: "git.example.com", Provider: "generic", TokenEnv: "GIT_TOKEN"},
+		GitHost{Host: "code.example.com", Provider: "sourcehut"}, // unknown providers are generic
+	)
+	checkHost(t, hostCase{
+		repo: "git.example.com/acme/app", cloneURL: "https://git.example.com/acme/app",
+		pullRef: "refs/pull/7/head", header: "Authorization: Bearer generic-secret",
+	})
+	checkHost(t, hostCase{repo: "code.example.com/acme/app", cloneURL: "https://code.example.com/acme/app", pullRef: "refs/pull/7/head"})
+	checkHost(t, hostCase{repo: "unconfigured.example.com/acme/app", cloneURL: "https://unconfigured.example.com/acme/app", pullRef: "refs/pull/7/head"})
+	if h := hostFor("code.example.com/acme/app"); h.provider != "generic" {
+		t.Errorf("provider %s, want generic", h.provider)
+	}
+}
+
+// Tokens that can't be read leave the host anonymous; tokens that can are
+// scrubbed from everything billder prints.
+func TestHostTokens(t *testing.T) {
+	t.Setenv("HOST_TOKEN", "host-token-secret")
+	useHosts(t,
+		GitHost{Host: "a.example.com", Provider: "gitea", TokenEnv: "HOST_TOKEN"},
+		GitHost{Host: "b.example.com", Provider: "gitea", TokenFile: filepath.Join(t.TempDir(), "missing")},
+		GitHost{Host: "c.example.com", Provider: "gitea", TokenEnv: "UNSET_HOST_TOKEN"},
+	)
+	if got := secrets.Redact("token host-token-secret"); strings.Contains(got, "host-token-secret") {
+		t.Errorf("host token not redacted: %s", got)
+	}
+	for _, repo := range []string{"b.example.com/x/y", "c.example.com/x/y"} {
+		if env := gitEnv(repo); len(env) != 0 {
+			t.Errorf("%s clones with %v", repo, env)
+		}
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	t.Setenv("GITEA_TOKEN", "gitea-secret")
+	useHosts(t,
+		GitHost{Host: "gitea.example.com", Provider: "gitea", TokenEnv: "GITEA_TOKEN"},
+		GitHost{Host: "GitLab.com", Provider: "gitlab", APIBase: "https://gitlab.example.com/api/v4"},
+	)
+	want := []HostInfo{
+		{Host: "bitbucket.org", Provider: "bitbucket", APIBase: "https://api.bitbucket.org/2.0"},
+		{Host: "gitea.example.com", Provider: "gitea", APIBase: "https://gitea.example.com/api/v1", Credentials: true},
+		{Host: "github.com", Provider: "github", APIBase: "https://api.github.com"},
+		{Host: "gitlab.com", Provider: "gitlab", APIBase: "https://gitlab.example.com/api/v4"},
+	}
+	got := knownHosts()
+	if len(got) != len(want) {
+		t.Fatalf("knownHosts() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("knownHosts()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestCanonicalRepoHosts(t *testing.T) {
+	for in, want := range map[string]string{
+		"https://GitLab.com/Group/Sub/App.git":          "gitlab.com/Group/Sub/App",
+		"git@bitbucket.org:team/app.git":                "bitbucket.org/team/app",
+		"ssh://git@gitea.example.com:2222/acme/app.git": "gitea.example.com/acme/app",
+		"http://gitea.example.com:3000/acme/app/":       "gitea.example.com:3000/acme/app",
+		"stash.example.com/scm/proj/app":                "stash.example.com/scm/proj/app",
+		"  https://git.example.com/acme/app.git \n":     "git.example.com/acme/app",
+		"ssh://deploy@GIT.EXAMPLE.COM/acme/app":         "git.example.com/acme/app",
+		"https://github.com/acme/app":                   "github.com/acme/app",
+		"git@git.corp.internal:group/sub/project.git":   "git.corp.internal/group/sub/project",
+		"https://git.corp.internal:8443/group/app.git/": "git.corp.internal:8443/group/app",
+	} {
+		if got := canonicalRepo(in); got != want {
+			t.Errorf("canonicalRepo(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
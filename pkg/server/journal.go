@@ -0,0 +1,335 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Build states in the journal.
+const (
+	jobRunning     = "running"
+	jobFinished    = "finished"
+	jobInterrupted = "interrupted" // the server stopped while it ran
+	jobRequeued    = "requeued"    // interrupted, and restarted per its resume_policy
+)
+
+// JobRecord is a build's journal entry, kept under DataDir/jobs and served
+// at GET /v1/builds/{id}. It outlives the process, so clients polling a
+// build across a server restart see it interrupted or requeued, not a 404.
+type JobRecord struct {
+	ID          string          `json:"id"`
+	State       string          `json:"state"`
+	OK          bool            `json:"ok"`                       // every target built; set once finished
+	Failure     FailureCategory `json:"error_category,omitempty"` // why it didn't
+	Attempt     int             `json:"attempt"`
+	Origin      string          `json:"origin"` // "api" or "scheduled"
+	Payload     RequestPayload  `json:"payload"`
+	Caller      string          `json:"caller"`
+	Commit      string          `json:"commit,omitempty"`
+	Ref         string          `json:"ref,omitempty"` // branch the commit was on
+	Traceparent string          `json:"traceparent,omitempty"`
+	Protocol    string          `json:"protocol,omitempty"` // API version of the request; empty for scheduled builds
+	StartedAt   time.Time       `json:"started_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	EventsURL   string          `json:"events_url"`
+	LogURL      string          `json:"log_url"`
+
+	Defaults []AppliedDefault `json:"defaults,omitempty"` // request fields filled in from the server's repos config
+
+	PartialTransfer *PartialTransfer `json:"partial_transfer,omitempty"`
+	Artifact        *StoredArtifact  `json:"artifact,omitempty"` // set once the artifact is in the store
+
+	Timing        *BuildTiming `json:"timing,omitempty"`         // set once finished
+	CacheHit      *bool        `json:"cache_hit,omitempty"`      // every target compiled from GOCACHE alone; set when go build ran
+	ArtifactBytes int64        `json:"artifact_bytes,omitempty"` // size of the delivered artifact
+
+	Pinned   bool      `json:"pinned,omitempty"` // exempt from retention until unpinned
+	PinnedBy string    `json:"pinned_by,omitempty"`
+	Evicted  *Eviction `json:"evicted,omitempty"` // set when retention removed the artifact and log
+}
+
+// Eviction records when and why retention removed a build's artifact and
+// log. The journal entry stays for another retention period.
+type Eviction struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"` // max_age, max_per_repo, token_budget or store_budget
+}
+
+// StoredArtifact describes a build's stored artifact as downloads serve it.
+// The file itself is named by storePath, which may hash the build's name.
+type StoredArtifact struct {
+	Name      string `json:"name"` // the build's own file name
+	MediaType string `json:"media_type"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+}
+
+// PartialTransfer records an artifact stream that broke off before the
+// client had all of it. The artifact stays downloadable from the store.
+type PartialTransfer struct {
+	Artifact string `json:"artifact"`
+	Sent     int64  `json:"sent_bytes"`
+	Total    int64  `json:"total_bytes"`
+	Error    string `json:"error"`
+}
+
+// liveJobs are the builds this process is running; their journal entries
+// are left alone by recoverJobs.
+var (
+	liveJobsMu sync.Mutex
+	liveJobs   = map[string]bool{}
+)
+
+func jobPath(id string) string {
+	return storePath(dataDir(), "jobs", id+".json")
+}
+
+// saveJob writes rec atomically so a crash never leaves half a record.
+func saveJob(rec *JobRecord) {
+	rec.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(jobPath(rec.ID)), 0o755)
+	}
+	if err == nil {
+		tmp := jobPath(rec.ID) + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, jobPath(rec.ID))
+		}
+	}
+	if err != nil {
+		log.Printf("Journal %s: %v", rec.ID, err)
+	}
+}
+
+// journalMu serializes changes to finished builds' entries: pins and
+// evictions. Running builds' entries belong to their build.
+var journalMu sync.Mutex
+
+// updateJob applies change to the journal entry of a finished build.
+func updateJob(id string, change func(*JobRecord)) (JobRecord, error) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	rec, err := loadJob(id)
+	if err != nil {
+		return rec, err
+	}
+	change(&rec)
+	saveJob(&rec)
+	return rec, nil
+}
+
+func loadJob(id string) (JobRecord, error) {
+	var rec JobRecord
+	data, err := os.ReadFile(jobPath(id))
+	if err == nil {
+		err = json.Unmarshal(data, &rec)
+	}
+	return rec, err
+}
+
+// startJob journals rec as running in this process.
+func startJob(rec *JobRecord) {
+	if rec.Attempt == 0 {
+		rec.Attempt = 1
+	}
+	rec.State = jobRunning
+	rec.StartedAt = time.Now()
+	rec.EventsURL = "/" + apiVersion + "/builds/" + rec.ID + "/events"
+	rec.LogURL = "/" + apiVersion + "/builds/" + rec.ID + "/log"
+	liveJobsMu.Lock()
+	liveJobs[rec.ID] = true
+	liveJobsMu.Unlock()
+	saveJob(rec)
+}
+
+// finishJob journals rec as finished with its outcome, which badges show.
+func finishJob(rec *JobRecord, ok bool) {
+	rec.State = jobFinished
+	rec.OK = ok
+	saveJob(rec)
+	badgeFinished(rec)
+	liveJobsMu.Lock()
+	delete(liveJobs, rec.ID)
+	liveJobsMu.Unlock()
+}
+
+// abandonJob leaves rec running in the journal as the server shuts down,
+// so the next start reports it interrupted or restarts it.
+func abandonJob(rec *JobRecord) {
+	saveJob(rec)
+	liveJobsMu.Lock()
+	delete(liveJobs, rec.ID)
+	liveJobsMu.Unlock()
+}
+
+// recoverJobs marks builds a previous process left running as interrupted,
+// and restarts those whose resume_policy is "restart".
+func recoverJobs() {
+	entries, _ := os.ReadDir(storePath(dataDir(), "jobs"))
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !buildIDPattern.MatchString(id) {
+			continue
+		}
+		liveJobsMu.Lock()
+		live := liveJobs[id]
+		liveJobsMu.Unlock()
+		rec, err := loadJob(id)
+		if live || err != nil || (rec.State != jobRunning && rec.State != jobRequeued) {
+			continue
+		}
+		rec.State = jobInterrupted
+		saveJob(&rec)
+		if rec.Payload.ResumePolicy != "restart" {
+			log.Printf("Build %s was interrupted by a restart", id)
+			continue
+		}
+		log.Printf("Build %s was interrupted by a restart; requeuing (attempt %d)", id, rec.Attempt+1)
+		rec.State = jobRequeued
+		rec.Attempt++
+		saveJob(&rec)
+		go restartJob(rec)
+	}
+}
+
+// restartJob reruns an interrupted build with nobody connected. Its events
+// are still buffered for GET /v1/builds/{id}/events and its artifact stored.
+func restartJob(rec JobRecord) {
+	if !rec.Payload.Force {
+		key := buildKey(rec.Caller, rec.Payload)
+		if existing, ok := claimBuild(key, rec.ID); !ok {
+			log.Printf("Not restarting build %s: build %s is already running", rec.ID, existing.id)
+			rec.State = jobInterrupted
+			saveJob(&rec)
+			return
+		}
+		defer releaseBuild(key)
+	}
+	runHeadless(rec)
+}
+
+// runHeadless runs a build nobody is connected to and reports whether it
+// succeeded. Its events are buffered and its artifact stored as usual.
+func runHeadless(rec JobRecord) bool {
+	activeBuilds.Add(1)
+	defer activeBuilds.Add(-1)
+	sse := &sseWriter{w: io.Discard, flusher: discardFlusher{}}
+	return runBuild(sse, rec, toolchainsFor(rec.Payload), nil)
+}
+
+type discardFlusher struct{}
+
+func (discardFlusher) Flush() {}
+
+// buildStatusHandler serves GET /v1/builds/{id}, the build's journal entry.
+func buildStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	if !buildIDPattern.MatchString(id) {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	rec, err := loadJob(id)
+	if err != nil {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// BuildListing is a build in GET /v1/builds: its journal entry, less the
+// payload, and whether its artifact can still be downloaded.
+type BuildListing struct {
+	ID        string          `json:"id"`
+	State     string          `json:"state"`
+	OK        bool            `json:"ok"`
+	Failure   FailureCategory `json:"error_category,omitempty"`
+	Origin    string          `json:"origin"`
+	Caller    string          `json:"caller"`
+	Repo      string          `json:"repo"`
+	Commit    string          `json:"commit,omitempty"`
+	Ref       string          `json:"ref,omitempty"`
+	StartedAt time.Time       `json:"started_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Pinned    bool            `json:"pinned,omitempty"`
+	Artifact  string          `json:"artifact"` // "available", "evicted" or "none"
+	Evicted   *Eviction       `json:"evicted,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// buildsHandler serves GET /v1/builds, the journaled builds newest first.
+// repo narrows them to one repository, each label=k=v (or label=k) to
+// builds labeled so, and limit caps how many are listed.
+func buildsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, 500)
+	}
+	repo := r.URL.Query().Get("repo")
+	if repo != "" {
+		repo = canonicalRepo(repo)
+	}
+
+	labels := r.URL.Query()["label"]
+
+	list := []BuildListing{}
+	entries, _ := os.ReadDir(storePath(dataDir(), "jobs"))
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !buildIDPattern.MatchString(id) {
+			continue
+		}
+		rec, err := loadJob(id)
+		if err != nil || repo != "" && rec.Payload.RepoURL != repo || !matchLabels(rec.Payload.Labels, labels) {
+			continue
+		}
+		b := BuildListing{
+			ID: rec.ID, State: rec.State, OK: rec.OK, Failure: rec.Failure, Origin: rec.Origin,
+			Caller: rec.Caller, Repo: rec.Payload.RepoURL, Commit: rec.Commit, Ref: rec.Ref,
+			StartedAt: rec.StartedAt, UpdatedAt: rec.UpdatedAt, Pinned: rec.Pinned,
+			Artifact: "none", Evicted: rec.Evicted, Labels: rec.Payload.Labels,
+		}
+		if entries, err := os.ReadDir(artifactDir(id)); err == nil && len(entries) > 0 {
+			b.Artifact = "available"
+		} else if rec.Evicted != nil {
+			b.Artifact = "evicted"
+		}
+		list = append(list, b)
+	}
+	slices.SortFunc(list, func(a, b BuildListing) int { return b.StartedAt.Compare(a.StartedAt) })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
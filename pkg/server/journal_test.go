@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useDataDir points the store at dir for the length of the test.
+func useDataDir(t *testing.T, dir string) {
+	t.Helper()
+	prev := cfg
+	cfg.DataDir = dir
+	t.Cleanup(func() { cfg = prev })
+}
+
+// TestRestartRecoversJobs leaves builds in the journal as a server that
+// went down would, then opens a fresh Server over the same store and
+// polls the builds there.
+func TestRestartRecoversJobs(t *testing.T) {
+	dir := t.TempDir()
+	useDataDir(t, filepath.Join(dir, "data"))
+
+	payload := RequestPayload{RepoURL: "https://fixture.test/missing", TargetOS: "linux", TargetArch: "amd64", Targets: []string{"linux/amd64"}}
+	restart := payload
+	restart.ResumePolicy = "restart"
+	records := map[string]*JobRecord{
+		"interrupted": {ID: newBuildID(), Payload: payload, Caller: "anonymous", Origin: "api"},
+		"restarted":   {ID: newBuildID(), Payload: restart, Caller: "anonymous", Origin: "api"},
+		"finished":    {ID: newBuildID(), Payload: payload, Caller: "anonymous", Origin: "api"},
+		"requeued":    {ID: newBuildID(), Payload: payload, Caller: "anonymous", Origin: "api", Attempt: 2},
+	}
+	for name, rec := range records {
+		startJob(rec)
+		switch name {
+		case "finished":
+			finishJob(rec, true)
+		case "requeued":
+			rec.State = jobRequeued
+			saveJob(rec)
+		}
+		// The process going down forgets its builds
+		liveJobsMu.Lock()
+		delete(liveJobs, rec.ID)
+		liveJobsMu.Unlock()
+	}
+
+	// Clones of fixture.test go to a directory without repositories
+	gitconfig := filepath.Join(dir, "gitconfig")
+	os.WriteFile(gitconfig, []byte(fmt.Sprintf("[url \"file://%s/\"]\n\tinsteadOf = https://fixture.test/\n", filepath.Join(dir, "repos"))), 0o644)
+	t.Setenv("GIT_CONFIG_GLOBAL", gitconfig)
+	t.Setenv("GIT_TERMINAL_PROMPT", "0")
+	s := openServer(t, WithDataDir(cfg.DataDir), WithHistoryFile(filepath.Join(dir, "history.json")))
+	get := func(name string) JobRecord {
+		t.Helper()
+		id := records[name].ID
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/v1/builds/"+id, nil))
+		if w.Code != 200 {
+			t.Fatalf("the restarted server doesn't know the %s build: %d %s", name, w.Code, w.Body)
+		}
+		var rec JobRecord
+		json.Unmarshal(w.Body.Bytes(), &rec)
+		return rec
+	}
+
+	if rec := get("interrupted"); rec.State != jobInterrupted || rec.Attempt != 1 {
+		t.Errorf("running build after a restart: %s, attempt %d", rec.State, rec.Attempt)
+	}
+	if rec := get("requeued"); rec.State != jobInterrupted || rec.Attempt != 2 {
+		t.Errorf("requeued build after a restart: %s, attempt %d", rec.State, rec.Attempt)
+	}
+	if rec := get("finished"); rec.State != jobFinished || !rec.OK {
+		t.Errorf("finished build after a restart: %s, ok %v", rec.State, rec.OK)
+	}
+	rec := get("restarted")
+	if rec.Attempt != 2 || rec.State == jobInterrupted {
+		t.Errorf("build with resume_policy restart: %s, attempt %d", rec.State, rec.Attempt)
+	}
+	for deadline := time.Now().Add(30 * time.Second); rec.State != jobFinished && time.Now().Before(deadline); rec = get("restarted") {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if rec.State != jobFinished || rec.OK || rec.Failure == "" {
+		t.Errorf("rerun ended %s, ok %v, %s; want a failed clone", rec.State, rec.OK, rec.Failure)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Labels tag a build for finding it later, e.g. {"pipeline": "8812",
+// "pr": "1234"}. They are kept in the journal, repeated in summaries and
+// build messages and filtered on by GET /v1/builds?label=, but never
+// change the build. Only labels under cacheRelevantPrefix count when
+// telling duplicate builds apart.
+const (
+	maxLabels           = 16 // default max_labels
+	maxLabelValue       = 256
+	cacheRelevantPrefix = "cache_relevant/"
+)
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_./-]{0,62}$`)
+
+// labelProblems checks the request's label keys and sanitizes their values,
+// dropping control characters and surrounding space.
+func (p *RequestPayload) labelProblems() []string {
+	var problems []string
+	for _, k := range slices.Sorted(maps.Keys(p.Labels)) {
+		if !labelKeyPattern.MatchString(k) {
+			problems = append(problems, fmt.Sprintf("label %q: keys are up to 63 letters, digits and _ . / -, starting with a letter or digit", k))
+			continue
+		}
+		v := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) || r == unicode.ReplacementChar {
+				return -1
+			}
+			return r
+		}, p.Labels[k]))
+		if len(v) > maxLabelValue {
+			problems = append(problems, fmt.Sprintf("label %q: value exceeds %d bytes", k, maxLabelValue))
+		}
+		p.Labels[k] = v
+	}
+	if len(p.Labels) == 0 {
+		p.Labels = nil
+	}
+	return problems
+}
+
+// cacheLabels are the labels under cacheRelevantPrefix, as k=v in key
+// order, for buildKey.
+func (p RequestPayload) cacheLabels() string {
+	var kv []string
+	for _, k := range slices.Sorted(maps.Keys(p.Labels)) {
+		if strings.HasPrefix(k, cacheRelevantPrefix) {
+			kv = append(kv, k+"="+p.Labels[k])
+		}
+	}
+	return strings.Join(kv, ",")
+}
+
+// matchLabels reports whether labels satisfy every filter, each k=v for a
+// value or k for any value.
+func matchLabels(labels map[string]string, filters []string) bool {
+	for _, f := range filters {
+		k, v, hasValue := strings.Cut(f, "=")
+		got, ok := labels[k]
+		if !ok || hasValue && got != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latestBuild finds the newest finished, successful single-target build of
+// repo for target whose artifact is still stored. ref, if set, must be the
+// branch the build checked out or a prefix of its commit.
+func latestBuild(repo, target, ref string) (JobRecord, string, bool) {
+	entries, _ := os.ReadDir(storePath(dataDir(), "jobs"))
+	var matches []JobRecord
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !buildIDPattern.MatchString(id) {
+			continue
+		}
+		rec, err := loadJob(id)
+		if err != nil || rec.State != jobFinished || !rec.OK || rec.Payload.RepoURL != repo || !slices.Equal(rec.Payload.Targets, []string{target}) {
+			continue
+		}
+		if ref != "" && rec.Ref != ref && (len(ref) < 7 || !strings.HasPrefix(rec.Commit, ref)) {
+			continue
+		}
+		matches = append(matches, rec)
+	}
+	slices.SortFunc(matches, func(a, b JobRecord) int { return b.UpdatedAt.Compare(a.UpdatedAt) })
+	for _, rec := range matches {
+		if files, err := os.ReadDir(artifactDir(rec.ID)); err == nil && len(files) == 1 {
+			return rec, filepath.Join(artifactDir(rec.ID), files[0].Name()), true
+		}
+	}
+	return JobRecord{}, "", false
+}
+
+// artifactDigests caches the sha256 of stored artifacts, which never change.
+var artifactDigests sync.Map // path -> hex digest
+
+func artifactDigest(path string, f io.Reader) (string, error) {
+	if d, ok := artifactDigests.Load(path); ok {
+		return d.(string), nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	d := hex.EncodeToString(h.Sum(nil))
+	artifactDigests.Store(path, d)
+	return d, nil
+}
+
+// latestHandler serves GET /v1/latest?repo=&os=&arch=[&ref=], the artifact
+// of the newest successful build matching the query. The ETag is the
+// artifact's digest, so fetchers repeating If-None-Match get a 304.
+func latestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	repo := canonicalRepo(q.Get("repo"))
+	if !repoPattern.MatchString(repo) {
+		http.Error(w, "repo must be host/owner/name", http.StatusBadRequest)
+		return
+	}
+	goos, goarch := q.Get("os"), q.Get("arch")
+	if goos == "" {
+		http.Error(w, "os is required", http.StatusBadRequest)
+		return
+	}
+	if goarch == "" {
+		goarch = "amd64"
+	}
+
+	rec, path, ok := latestBuild(repo, goos+"/"+goarch, q.Get("ref"))
+	if !ok {
+		http.Error(w, "No stored successful build matches", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Billder-Build-ID", rec.ID)
+	w.Header().Set("X-Billder-Commit", rec.Commit)
+	w.Header().Set("X-Billder-Build-Time", rec.UpdatedAt.UTC().Format(time.RFC3339))
+	serveArtifact(w, r, path, rec.Artifact, rec.UpdatedAt)
+}
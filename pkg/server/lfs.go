@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Repositories that keep files in git-lfs check out small pointer files in
+// their place. Builds that find pointers after checkout pull the real files
+// with the server's git-lfs, up to cfg.MaxLFSBytes of them.
+const (
+	lfsPointerSpec = "version https://git-lfs.github.com/spec/v1"
+	maxLFSPointer  = 1024 // pointers are smaller than this
+)
+
+var (
+	lfsOnce    sync.Once
+	lfsVersion string
+)
+
+// gitLFS returns the version of the installed git-lfs, or "" if there is
+// none.
+func gitLFS() string {
+	lfsOnce.Do(func() {
+		// "git-lfs/3.4.1 (GitHub; linux amd64; go 1.21.8)"
+		out, err := exec.Command("git", "lfs", "version").Output()
+		if fields := strings.Fields(string(out)); err == nil && len(fields) > 0 {
+			lfsVersion = strings.TrimPrefix(fields[0], "git-lfs/")
+		}
+	})
+	return lfsVersion
+}
+
+// usesLFS reports whether a .gitattributes file in the tree routes any
+// path through the lfs filter.
+func usesLFS(root string) bool {
+	found := false
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil || found:
+			return filepath.SkipAll
+		case d.IsDir() && d.Name() == ".git":
+			return filepath.SkipDir
+		case d.Name() == ".gitattributes":
+			data, _ := os.ReadFile(path)
+			found = bytes.Contains(data, []byte("filter=lfs"))
+		}
+		return nil
+	})
+	return found
+}
+
+// lfsPointers lists the pointer files checked out under root, relative to
+// it, and the total size of the files they stand for.
+func lfsPointers(root string) (paths []string, size int64) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info, err := d.Info(); err != nil || !d.Type().IsRegular() || info.Size() >= maxLFSPointer {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || !bytes.HasPrefix(data, []byte(lfsPointerSpec+"\n")) {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		paths = append(paths, filepath.ToSlash(rel))
+		for line := range strings.Lines(string(data)) {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(line), "size "); ok {
+				s, _ := strconv.ParseInt(v, 10, 64)
+				size += s
+			}
+		}
+		return nil
+	})
+	return paths, size
+}
+
+// pullLFS replaces the checkout's git-lfs pointers with the files they
+// stand for, announcing progress as files arrive. Trees without pointers
+// are left alone.
+func (j *buildJob) pullLFS(host *gitHost, sse *sseWriter) error {
+	if !usesLFS(j.repoPath) {
+		return nil
+	}
+	pointers, size := lfsPointers(j.repoPath)
+	if len(pointers) == 0 {
+		return nil
+	}
+	sse.Message(fmt.Sprintf("The repository keeps %d files (%.1f MB) in git-lfs", len(pointers), float64(size)/1024/1024))
+	switch {
+	case j.archived:
+		return failedWith(FailInvalidRequest, errors.New("the archive holds git-lfs pointers instead of the files; build with checkout_mode \"clone\""))
+	case gitLFS() == "":
+		return failedWith(FailToolchain, errors.New("repository requires git-lfs which this server doesn't support"))
+	case cfg.MaxLFSBytes > 0 && size > cfg.MaxLFSBytes:
+		return failedWith(FailInvalidRequest, fmt.Errorf("git-lfs files total %.1f MB, over the %.1f MB limit", float64(size)/1024/1024, float64(cfg.MaxLFSBytes)/1024/1024))
+	}
+
+	install := exec.CommandContext(j.ctx, "git", "lfs", "install", "--local")
+	install.Dir = j.repoPath
+	out, err := install.CombinedOutput()
+	j.log.Command("", install, out, err)
+	if err != nil {
+		return failedWith(FailInternal, fmt.Errorf("git lfs install failed: %s", lastLine(string(out))))
+	}
+
+	var args []string
+	if cfg.MirrorDir != "" {
+		// origin is the local mirror, which has no LFS objects
+		args = append(args, "-c", "lfs.url="+strings.TrimSuffix(j.payload.CloneURL(), ".git")+".git/info/lfs")
+	}
+	args = append(args, "lfs", "pull")
+	if len(j.payload.SparsePaths) > 0 {
+		// Only what is checked out, not the whole tree's objects
+		args = append(args, "--include", strings.Join(pointers, ","))
+	}
+	progress := filepath.Join(j.tmpDir, "lfs-progress")
+	done := make(chan struct{})
+	go reportLFSProgress(progress, sse, done)
+	out, err = j.runRetrying(sse, "Git LFS pull", func() *exec.Cmd {
+		pull := host.git(j.ctx, args...)
+		pull.Dir = j.repoPath
+		pull.Env = append(pull.Env, "GIT_LFS_PROGRESS="+progress)
+		return pull
+	})
+	close(done)
+	if err != nil {
+		category := cloneFailure(out)
+		if j.ctx.Err() != nil {
+			category = FailTimeout
+		}
+		return failedWith(category, fmt.Errorf("git lfs pull failed: %s", lastLine(string(out))))
+	}
+	if left, _ := lfsPointers(j.repoPath); len(left) > 0 {
+		return failedWith(FailDeps, fmt.Errorf("git lfs pull left %d pointer files, e.g. %s; the LFS server may be missing their objects", len(left), left[0]))
+	}
+	sse.Message(fmt.Sprintf("Pulled %d git-lfs files", len(pointers)))
+	return nil
+}
+
+// reportLFSProgress announces the file git-lfs is on, read from the
+// GIT_LFS_PROGRESS file it appends "download 3/10 512/2048 path" lines to,
+// every couple of seconds until done.
+func reportLFSProgress(file string, sse *sseWriter, done <-chan struct{}) {
+	tick := time.NewTicker(2 * time.Second)
+	defer tick.Stop()
+	last := ""
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		var line string
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			line = scanner.Text()
+		}
+		f.Close()
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] == last {
+			continue
+		}
+		last = fields[1]
+		sse.Message(fmt.Sprintf("Git LFS: downloading file %s: %s", fields[1], strings.Join(fields[3:], " ")))
+	}
+}
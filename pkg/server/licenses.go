@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// LicenseReport lists the modules compiled into a target's binary and the
+// licenses they come with. It's delivered as licenses.json next to
+// THIRD_PARTY_LICENSES.txt, which has the license texts.
+type LicenseReport struct {
+	Target  string          `json:"target"`
+	Modules []ModuleLicense `json:"modules"`
+	Counts  map[string]int  `json:"counts"`  // modules per license; a module under several counts for each
+	Unknown int             `json:"unknown"` // modules with no license file, or one the matcher didn't recognize
+}
+
+// ModuleLicense is one module of a LicenseReport; the standard library is
+// module "std".
+type ModuleLicense struct {
+	Path     string        `json:"path"`
+	Version  string        `json:"version,omitempty"`
+	Licenses []string      `json:"licenses"` // SPDX identifiers, or "unknown"
+	Files    []LicenseFile `json:"files,omitempty"`
+}
+
+// String is the module's path and version.
+func (m ModuleLicense) String() string {
+	return strings.TrimSpace(m.Path + " " + m.Version)
+}
+
+// LicenseFile is a license or notice file at the root of a module.
+type LicenseFile struct {
+	Path    string `json:"path"`    // module@version/name, as in the module cache
+	License string `json:"license"` // SPDX identifier, "notice" or "unknown"
+
+	text string
+}
+
+// maxLicenseFile bounds how much of a license file is read.
+const maxLicenseFile = 256 << 10
+
+// licenseFileNames match, case-insensitively and with any suffix, the files
+// collected from a module's root directory.
+var licenseFileNames = []string{"license", "licence", "copying", "unlicense", "notice", "patents"}
+
+// licensePatterns classify license texts, after normalizeLicense, by
+// phrases that all have to appear. More specific licenses come first.
+var licensePatterns = []struct {
+	id      string
+	phrases []string
+}{
+	{"AGPL-3.0", []string{"gnu affero general public license"}},
+	{"LGPL-3.0", []string{"gnu lesser general public license", "version 3"}},
+	{"LGPL-2.1", []string{"gnu lesser general public license", "version 2 1"}},
+	{"LGPL-2.0", []string{"gnu library general public license"}},
+	{"GPL-3.0", []string{"gnu general public license", "version 3"}},
+	{"GPL-2.0", []string{"gnu general public license", "version 2"}},
+	{"MPL-2.0", []string{"mozilla public license", "2 0"}},
+	{"Apache-2.0", []string{"apache license", "version 2 0"}},
+	{"EPL-2.0", []string{"eclipse public license", "2 0"}},
+	{"EPL-1.0", []string{"eclipse public license"}},
+	{"BSL-1.0", []string{"boost software license"}},
+	{"CC0-1.0", []string{"cc0 1 0"}},
+	{"Unlicense", []string{"this is free and unencumbered software released into the public domain"}},
+	{"ISC", []string{"permission to use copy modify and or distribute this software for any purpose with or without fee is hereby granted"}},
+	{"MIT", []string{"permission is hereby granted free of charge to any person obtaining a copy"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "neither the name"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "may be used to endorse or promote products"}},
+	{"BSD-2-Clause", []string{"redistribution and use in source and binary forms"}},
+	{"Zlib", []string{"provided as is without any express or implied warranty", "altered source versions must be plainly marked"}},
+}
+
+var (
+	spdxPattern    = regexp.MustCompile(`SPDX-License-Identifier:\s*([A-Za-z0-9.+-]+)`)
+	nonWordPattern = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// normalizeLicense lowercases text and turns punctuation and line breaks
+// into single spaces, so wrapped and reformatted copies match alike.
+func normalizeLicense(text string) string {
+	return " " + nonWordPattern.ReplaceAllString(strings.ToLower(text), " ") + " "
+}
+
+// classifyLicense names the license of a file's text, or "unknown".
+func classifyLicense(text string) string {
+	if m := spdxPattern.FindStringSubmatch(text); m != nil {
+		return m[1]
+	}
+	norm := normalizeLicense(text)
+	for _, p := range licensePatterns {
+		matched := true
+		for _, phrase := range p.phrases {
+			matched = matched && strings.Contains(norm, " "+phrase+" ")
+		}
+		if matched {
+			return p.id
+		}
+	}
+	return "unknown"
+}
+
+// isLicenseFile reports whether name is one of licenseFileNames.
+func isLicenseFile(name string) bool {
+	lower := strings.ToLower(name)
+	for _, prefix := range licenseFileNames {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// listedPackage is the part of `go list -json` output a license report
+// needs.
+type listedPackage struct {
+	Standard bool
+	Root     string
+	Module   *struct {
+		Path    string
+		Version string
+		Dir     string
+		Main    bool
+		Replace *struct {
+			Path    string
+			Version string
+			Dir     string
+		}
+	}
+}
+
+// licenseReport lists the modules the packages pkgs depend on for the
+// target, and reads and classifies their license files.
+func (j *buildJob) licenseReport(tc Toolchain, target string, pkgs []string) (*LicenseReport, error) {
+	cmd := exec.CommandContext(j.ctx, "go", append([]string{"list", "-e", "-deps", "-json=Standard,Root,Module"}, pkgs...)...)
+	cmd.Dir = j.moduleDir
+	cmd.Env = tc.Env()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	release := holdModCache(cmd)
+	out, err := cmd.Output()
+	release()
+	j.log.Command("["+target+"] ", cmd, stderr.Bytes(), err)
+	if err != nil {
+		return nil, fmt.Errorf("go list: %s", lastLine(stderr.String()))
+	}
+
+	type source struct{ path, version, dir string }
+	seen := map[string]bool{}
+	var sources []source
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var p listedPackage
+		if err := dec.Decode(&p); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("go list: %v", err)
+		}
+		s := source{path: "std", version: toolchainVersion(), dir: p.Root}
+		switch m := p.Module; {
+		case p.Standard:
+		case m == nil || m.Main:
+			continue // the repository's own code
+		case m.Replace != nil && m.Replace.Version == "":
+			s = source{path: m.Path, dir: m.Replace.Dir} // replaced by a directory
+		case m.Replace != nil:
+			s = source{path: m.Replace.Path, version: m.Replace.Version, dir: m.Replace.Dir}
+		default:
+			s = source{path: m.Path, version: m.Version, dir: m.Dir}
+		}
+		if !seen[s.path] {
+			seen[s.path] = true
+			sources = append(sources, s)
+		}
+	}
+	sort.Slice(sources, func(a, b int) bool { return sources[a].path < sources[b].path })
+
+	report := &LicenseReport{Target: target, Modules: []ModuleLicense{}, Counts: map[string]int{}}
+	for _, s := range sources {
+		mod := ModuleLicense{Path: s.path, Version: s.version}
+		prefix := s.path
+		if s.version != "" && s.path != "std" {
+			prefix += "@" + s.version
+		}
+		entries, _ := os.ReadDir(s.dir)
+		for _, e := range entries {
+			if !e.Type().IsRegular() || !isLicenseFile(e.Name()) {
+				continue
+			}
+			data, err := readLimited(filepath.Join(s.dir, e.Name()), maxLicenseFile)
+			if err != nil {
+				continue
+			}
+			f := LicenseFile{Path: prefix + "/" + e.Name(), License: "notice", text: string(data)}
+			if lower := strings.ToLower(e.Name()); !strings.HasPrefix(lower, "notice") && !strings.HasPrefix(lower, "patents") {
+				f.License = classifyLicense(f.text)
+				if !slices.Contains(mod.Licenses, f.License) {
+					mod.Licenses = append(mod.Licenses, f.License)
+				}
+			}
+			mod.Files = append(mod.Files, f)
+		}
+		if len(mod.Licenses) == 0 {
+			mod.Licenses = []string{"unknown"}
+		}
+		if slices.Contains(mod.Licenses, "unknown") {
+			report.Unknown++
+		}
+		for _, id := range mod.Licenses {
+			report.Counts[id]++
+		}
+		report.Modules = append(report.Modules, mod)
+	}
+	return report, nil
+}
+
+// addLicenseReport runs the license report of a target that built, adding
+// its files to the delivery. A failed report is only a warning.
+func (j *buildJob) addLicenseReport(tc Toolchain, ts *targetStream, res *targetResult) {
+	pkgs := []string{"."}
+	if j.payload.BuildAllCmds {
+		pkgs = nil
+		for _, name := range j.cmds {
+			pkgs = append(pkgs, "./cmd/"+name)
+		}
+	}
+	report, err := j.licenseReport(tc, ts.target, pkgs)
+	if err != nil {
+		ts.Message("Warning: license report failed: " + err.Error())
+		return
+	}
+	ts.Text("report", report.Lines())
+	res.summary.Licenses = report
+	res.files = append(res.files, report.Files()...)
+	j.licensesMu.Lock()
+	j.licenses = append(j.licenses, report)
+	j.licensesMu.Unlock()
+}
+
+func readLimited(path string, limit int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, limit))
+}
+
+// Lines summarizes the report for the build stream.
+func (r *LicenseReport) Lines() []string {
+	ids := make([]string, 0, len(r.Counts))
+	for id := range r.Counts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		return r.Counts[ids[a]] > r.Counts[ids[b]] || r.Counts[ids[a]] == r.Counts[ids[b]] && ids[a] < ids[b]
+	})
+	lines := []string{fmt.Sprintf("License report - %d module(s):", len(r.Modules))}
+	for _, id := range ids {
+		lines = append(lines, fmt.Sprintf("  %-20s %d", id, r.Counts[id]))
+	}
+	for _, m := range r.Modules {
+		if !slices.Contains(m.Licenses, "unknown") {
+			continue
+		}
+		where := "no license file"
+		if len(m.Files) > 0 {
+			var paths []string
+			for _, f := range m.Files {
+				if f.License == "unknown" {
+					paths = append(paths, f.Path)
+				}
+			}
+			where = strings.Join(paths, ", ")
+		}
+		lines = append(lines, fmt.Sprintf("  unknown: %s (%s)", m, where))
+	}
+	return lines
+}
+
+// Text is THIRD_PARTY_LICENSES.txt: an index of the modules, then every
+// license and notice file in full.
+func (r *LicenseReport) Text() string {
+	var b strings.Builder
+	rule := strings.Repeat("=", 80)
+	fmt.Fprintf(&b, "Third-party licenses of the %s binary\n", r.Target)
+	fmt.Fprintf(&b, "%d module(s) compiled in; %d with an unknown license\n\n", len(r.Modules), r.Unknown)
+	for _, m := range r.Modules {
+		fmt.Fprintf(&b, "  %s: %s\n", m, strings.Join(m.Licenses, ", "))
+	}
+	for _, m := range r.Modules {
+		fmt.Fprintf(&b, "\n%s\n%s\n", rule, m)
+		if len(m.Files) == 0 {
+			fmt.Fprintf(&b, "License: unknown (no license file found)\n%s\n", rule)
+			continue
+		}
+		for i, f := range m.Files {
+			if i > 0 {
+				fmt.Fprintf(&b, "\n%s\n", strings.Repeat("-", 80))
+			}
+			fmt.Fprintf(&b, "%s (%s)\n", f.Path, f.License)
+			if i == 0 {
+				b.WriteString(rule + "\n")
+			}
+			b.WriteString("\n" + strings.TrimRight(f.text, "\n") + "\n")
+		}
+	}
+	return b.String()
+}
+
+// Files are the report's deliverables, for zip bundles.
+func (r *LicenseReport) Files() []zipEntry {
+	data, _ := json.MarshalIndent(r, "", "  ")
+	return []zipEntry{
+		{Name: "THIRD_PARTY_LICENSES.txt", Data: []byte(r.Text())},
+		{Name: "licenses.json", Data: append(data, '\n')},
+	}
+}
+
+func licensesPath(id, ext string) string {
+	return storePath(dataDir(), "jobs", id+".licenses"+ext)
+}
+
+// licensesURL is where a build's license reports can be fetched, once
+// they're stored.
+func (j *buildJob) licensesURL() string {
+	if len(j.licenses) == 0 {
+		return ""
+	}
+	return "/" + apiVersion + "/builds/" + j.id + "/licenses"
+}
+
+// storeLicenses keeps the license reports of every target next to the
+// build's journal entry, which they are expired with: the JSON reports and
+// their texts one after the other.
+func (j *buildJob) storeLicenses() {
+	if len(j.licenses) == 0 {
+		return
+	}
+	slices.SortFunc(j.licenses, func(a, b *LicenseReport) int {
+		return slices.Index(j.payload.Targets, a.Target) - slices.Index(j.payload.Targets, b.Target)
+	})
+	var text strings.Builder
+	for i, r := range j.licenses {
+		if i > 0 {
+			text.WriteString("\n\n")
+		}
+		text.WriteString(r.Text())
+	}
+	data, err := json.MarshalIndent(j.licenses, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(licensesPath(j.id, ".json")), 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(licensesPath(j.id, ".json"), append(data, '\n'), 0o644)
+	}
+	if err == nil {
+		err = os.WriteFile(licensesPath(j.id, ".txt"), []byte(text.String()), 0o644)
+	}
+	if err != nil {
+		log.Printf("License report %s: %v", j.id, err)
+	}
+}
+
+// buildLicensesHandler serves GET /v1/builds/{id}/licenses, the license
+// reports of a license_report build: JSON, one per target, or with
+// ?format=text the THIRD_PARTY_LICENSES.txt of every target.
+func buildLicensesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	if !buildIDPattern.MatchString(id) {
+		http.Error(w, "Invalid build id", http.StatusBadRequest)
+		return
+	}
+	ext, contentType := ".json", "application/json"
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+	case "text":
+		ext, contentType = ".txt", "text/plain; charset=utf-8"
+	default:
+		http.Error(w, "format must be json or text", http.StatusBadRequest)
+		return
+	}
+	data, err := os.ReadFile(licensesPath(id, ext))
+	if err != nil {
+		http.Error(w, "License report not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
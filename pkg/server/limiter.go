@@ -0,0 +1,251 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// compileSlots bounds concurrent compiles across every build on this server.
+// Parallel links are memory hungry; see WithMaxConcurrentCompiles.
+var compileSlots *slotQueue
+
+// priorities are the build priority levels, lowest first.
+var priorities = []string{"low", "normal", "high"}
+
+const (
+	priorityAging  = 2 * time.Minute  // waiting this long promotes a build one level
+	queueReport    = 5 * time.Second  // how often waiters recheck their position
+	defaultCompile = time.Minute      // expected compile time with no history at all
+	etaChange      = 15 * time.Second // ETA shift that's worth telling a waiter about
+)
+
+// priorityLevel is the index of a normalized priority in priorities.
+func priorityLevel(priority string) int {
+	return max(0, slices.Index(priorities, priority))
+}
+
+// compileEstimate is how long a compile is expected to hold its slot.
+type compileEstimate struct {
+	d     time.Duration
+	rough bool // not from the repository's own history
+}
+
+// expectedCompile is the estimate for a compile of the history key: its
+// last duration, or without one the average over every repository.
+func expectedCompile(key string) compileEstimate {
+	if s, ok := history.Get(key); ok {
+		return compileEstimate{time.Duration(s.Seconds * float64(time.Second)), false}
+	}
+	if avg, ok := history.Average(); ok {
+		return compileEstimate{avg, true}
+	}
+	return compileEstimate{defaultCompile, true}
+}
+
+// queueWait is a waiting compile's place in the queue and expected wait.
+type queueWait struct {
+	position int
+	eta      time.Duration
+	rough    bool // some build it waits on has no history of its own
+}
+
+// String is the queue message waiting builds are sent.
+func (q queueWait) String() string {
+	if q.rough {
+		return fmt.Sprintf("Waiting for a free compile slot (position %d in queue, roughly %s; a rough estimate, not every build ahead has history)...", q.position, roundETA(q.eta))
+	}
+	return fmt.Sprintf("Waiting for a free compile slot (position %d in queue, about %s)...", q.position, roundETA(q.eta))
+}
+
+// roundETA rounds an estimate to the precision it deserves.
+func roundETA(d time.Duration) time.Duration {
+	if d < time.Minute {
+		return max(5*time.Second, d.Round(5*time.Second))
+	}
+	return d.Round(15 * time.Second)
+}
+
+type slotWaiter struct {
+	level  int
+	seq    uint64
+	since  time.Time
+	holder *slotHolder // what it becomes once served
+	ready  chan struct{}
+}
+
+// slotHolder is a compile running in a slot.
+type slotHolder struct {
+	start  time.Time
+	expect compileEstimate
+}
+
+// slotQueue hands out compile slots, highest priority first and FIFO within
+// a level. A waiter gains a level for every priorityAging it has waited, so
+// a stream of high priority builds can't starve low priority ones.
+type slotQueue struct {
+	mu      sync.Mutex
+	size    int
+	used    int
+	seq     uint64
+	waiters []*slotWaiter
+	holders map[*slotHolder]bool
+}
+
+func newSlotQueue(size int) *slotQueue {
+	return &slotQueue{size: size, holders: map[*slotHolder]bool{}}
+}
+
+// ahead reports whether a is served before b.
+func ahead(a, b *slotWaiter, now time.Time) bool {
+	ea := min(len(priorities)-1, a.level+int(now.Sub(a.since)/priorityAging))
+	eb := min(len(priorities)-1, b.level+int(now.Sub(b.since)/priorityAging))
+	if ea != eb {
+		return ea > eb
+	}
+	return a.seq < b.seq
+}
+
+// position is w's 1-based place in the queue. q.mu must be held.
+func (q *slotQueue) position(w *slotWaiter) int {
+	now := time.Now()
+	pos := 1
+	for _, o := range q.waiters {
+		if o != w && ahead(o, w, now) {
+			pos++
+		}
+	}
+	return pos
+}
+
+// wait estimates w's wait: each slot frees once its compile's expected
+// time is up, overdue ones any moment, and every waiter ahead of w takes
+// the first slot to free for its own expected time. q.mu must be held.
+func (q *slotQueue) wait(w *slotWaiter) queueWait {
+	now := time.Now()
+	qw := queueWait{position: q.position(w)}
+	free := make([]time.Duration, q.size) // when each slot frees, from now
+	i := 0
+	for h := range q.holders {
+		if i < len(free) {
+			free[i] = max(0, h.expect.d-now.Sub(h.start))
+			qw.rough = qw.rough || h.expect.rough
+			i++
+		}
+	}
+	var before []*slotWaiter
+	for _, o := range q.waiters {
+		if o != w && ahead(o, w, now) {
+			before = append(before, o)
+		}
+	}
+	slices.SortFunc(before, func(a, b *slotWaiter) int {
+		if ahead(a, b, now) {
+			return -1
+		}
+		return 1
+	})
+	for _, o := range before {
+		first := slices.Index(free, slices.Min(free))
+		free[first] += o.holder.expect.d
+		qw.rough = qw.rough || o.holder.expect.rough
+	}
+	qw.eta = slices.Min(free)
+	return qw
+}
+
+// free is the number of idle slots.
+func (q *slotQueue) free() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size - q.used
+}
+
+// depth counts waiters by requested priority level.
+func (q *slotQueue) depth() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	counts := make([]int, len(priorities))
+	for _, w := range q.waiters {
+		counts[w.level]++
+	}
+	return counts
+}
+
+// acquire blocks until a slot is free for a build at level expected to
+// hold it for expect, calling onWait with its queue position and expected
+// wait when it has to wait, and again whenever the position changes or
+// the estimate shifts by etaChange. The returned func releases the slot.
+func (q *slotQueue) acquire(level int, expect compileEstimate, onWait func(queueWait)) func() {
+	h := &slotHolder{expect: expect}
+	q.mu.Lock()
+	if q.used < q.size {
+		q.used++
+		h.start = time.Now()
+		q.holders[h] = true
+		q.mu.Unlock()
+		return func() { q.release(h) }
+	}
+	q.seq++
+	w := &slotWaiter{level: level, seq: q.seq, since: time.Now(), holder: h, ready: make(chan struct{})}
+	q.waiters = append(q.waiters, w)
+	last := q.wait(w)
+	q.mu.Unlock()
+	onWait(last)
+
+	ticker := time.NewTicker(queueReport)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ready:
+			return func() { q.release(h) }
+		case <-ticker.C:
+			q.mu.Lock()
+			qw := q.wait(w)
+			q.mu.Unlock()
+			// The estimate counts down by itself; only news is reported
+			drift := qw.eta - (last.eta - queueReport)
+			if qw.position != last.position || drift.Abs() >= etaChange {
+				onWait(qw)
+			}
+			last = qw
+		}
+	}
+}
+
+// release ends h's compile and hands its slot to the first waiter in line,
+// or frees it.
+func (q *slotQueue) release(h *slotHolder) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.holders, h)
+	if len(q.waiters) == 0 {
+		q.used--
+		return
+	}
+	now := time.Now()
+	best := 0
+	for i, w := range q.waiters {
+		if ahead(w, q.waiters[best], now) {
+			best = i
+		}
+	}
+	next := q.waiters[best]
+	next.holder.start = now
+	q.holders[next.holder] = true
+	close(next.ready)
+	q.waiters = slices.Delete(q.waiters, best, best+1)
+}
+
+// effectiveParallelism shrinks a build's requested parallelism to the
+// compile slots currently free, falling back to sequential when none are.
+func effectiveParallelism(requested int) int {
+	return max(1, min(requested, compileSlots.free()))
+}
+
+// acquireCompileSlot blocks until a compile slot is free for a build of the
+// given priority. The returned func releases the slot.
+func acquireCompileSlot(priority string, expect compileEstimate, onWait func(queueWait)) func() {
+	return compileSlots.acquire(priorityLevel(priority), expect, onWait)
+}
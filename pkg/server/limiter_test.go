@@ -0,0 +1,136 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// minute is the estimate of a compile with a minute of history.
+var minute = compileEstimate{d: time.Minute}
+
+// Waiters are served highest priority first and in arrival order within a
+// level, and each is told where it stands when it starts waiting.
+func TestSlotQueueOrder(t *testing.T) {
+	q := newSlotQueue(1)
+	release := q.acquire(priorityLevel("normal"), minute, func(queueWait) { t.Error("the first build waited for a free slot") })
+
+	served := make(chan string)
+	var done sync.WaitGroup
+	for _, w := range []struct {
+		name, priority string
+		position       int
+	}{
+		{"low", "low", 1},
+		{"normal 1", "normal", 1},
+		{"high 1", "high", 1},
+		{"normal 2", "normal", 3},
+		{"high 2", "high", 2},
+	} {
+		queued := make(chan int, 1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			release := q.acquire(priorityLevel(w.priority), minute, func(qw queueWait) { queued <- qw.position })
+			served <- w.name
+			release()
+		}()
+		if pos := <-queued; pos != w.position {
+			t.Errorf("%s queued at position %d, want %d", w.name, pos, w.position)
+		}
+	}
+	if got := q.depth(); got[0] != 1 || got[1] != 2 || got[2] != 2 {
+		t.Errorf("queue depth by priority %v, want [1 2 2]", got)
+	}
+
+	release()
+	for _, want := range []string{"high 1", "high 2", "normal 1", "normal 2", "low"} {
+		if got := <-served; got != want {
+			t.Fatalf("%s served, want %s", got, want)
+		}
+	}
+	done.Wait()
+	if q.free() != 1 {
+		t.Errorf("%d slots free once every build finished, want 1", q.free())
+	}
+}
+
+// A waiter gains a level for every priorityAging it has waited, up to the
+// highest, and then goes first by having arrived first.
+func TestSlotQueueAging(t *testing.T) {
+	now := time.Now()
+	waiter := func(priority string, seq uint64, waited time.Duration) *slotWaiter {
+		return &slotWaiter{level: priorityLevel(priority), seq: seq, since: now.Add(-waited), holder: &slotHolder{expect: minute}, ready: make(chan struct{})}
+	}
+	for _, tc := range []struct {
+		name  string
+		a, b  *slotWaiter
+		ahead bool
+	}{
+		{"high before low", waiter("high", 2, 0), waiter("low", 1, 0), true},
+		{"arrival order within a level", waiter("normal", 1, 0), waiter("normal", 2, 0), true},
+		{"low not yet aged", waiter("low", 1, priorityAging-time.Second), waiter("normal", 2, 0), false},
+		{"low aged to normal", waiter("low", 1, priorityAging), waiter("normal", 2, 0), true},
+		{"aged low still behind high", waiter("low", 1, priorityAging), waiter("high", 2, 0), false},
+		{"low aged to high", waiter("low", 1, 2*priorityAging), waiter("high", 2, 0), true},
+		{"aging stops at high", waiter("normal", 2, 10*priorityAging), waiter("high", 1, 0), false},
+	} {
+		if got := ahead(tc.a, tc.b, now); got != tc.ahead {
+			t.Errorf("%s: ahead = %v, want %v", tc.name, got, tc.ahead)
+		}
+	}
+
+	// The long-waiting low priority build gets the next slot and is told
+	// it's first in line
+	old := waiter("low", 1, 5*priorityAging)
+	fresh := waiter("high", 2, 0)
+	running := &slotHolder{start: now, expect: minute}
+	q := &slotQueue{size: 1, used: 1, waiters: []*slotWaiter{fresh, old}, holders: map[*slotHolder]bool{running: true}}
+	if pos := q.position(old); pos != 1 {
+		t.Errorf("aged waiter at position %d, want 1", pos)
+	}
+	q.release(running)
+	select {
+	case <-old.ready:
+	case <-fresh.ready:
+		t.Fatal("the slot went to the newer high priority build")
+	}
+	if len(q.waiters) != 1 || q.waiters[0] != fresh || q.used != 1 {
+		t.Errorf("after the hand-off: %d waiting, %d used", len(q.waiters), q.used)
+	}
+	if !q.holders[old.holder] || q.holders[running] {
+		t.Error("the slot's holder wasn't handed over")
+	}
+}
+
+// A waiter's ETA is when the slots free up for it: running compiles end
+// once their expected time is up, and every waiter ahead takes the first
+// slot to free for its own expected time.
+func TestSlotQueueWait(t *testing.T) {
+	now := time.Now()
+	rough := compileEstimate{d: 2 * time.Minute, rough: true}
+	q := newSlotQueue(2)
+	q.used = 2
+	q.holders[&slotHolder{start: now.Add(-30 * time.Second), expect: minute}] = true
+	q.holders[&slotHolder{start: now.Add(-5 * time.Minute), expect: minute}] = true // overdue
+	var waiters []*slotWaiter
+	for i, expect := range []compileEstimate{minute, rough, minute, minute} {
+		w := &slotWaiter{level: 1, seq: uint64(i + 1), since: now, holder: &slotHolder{expect: expect}, ready: make(chan struct{})}
+		waiters = append(waiters, w)
+		q.waiters = append(q.waiters, w)
+	}
+	for i, want := range []struct {
+		eta   time.Duration
+		rough bool
+	}{
+		{0, false},                // the overdue slot
+		{30 * time.Second, false}, // the other slot, half way through
+		{time.Minute, true},       // the overdue slot, after the first waiter
+		{2 * time.Minute, true},   // the same slot again, the other being taken until 2m30s
+	} {
+		qw := q.wait(waiters[i])
+		if qw.position != i+1 || (qw.eta-want.eta).Abs() > time.Second || qw.rough != want.rough {
+			t.Errorf("waiter %d: position %d, eta %s, rough %v; want %d, %s, %v", i+1, qw.position, qw.eta, qw.rough, i+1, want.eta, want.rough)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverMetrics are the counters exposed on /metrics.
+type serverMetrics struct {
+	mu       sync.Mutex
+	limited  map[string]int64 // rejected requests by limit scope
+	oversize int64            // artifacts refused for exceeding the size limit
+	dropped  map[string]int64 // client connections given up on, by reason
+
+	partial       int64 // artifact streams that broke off
+	partialUnsent int64 // bytes those streams didn't deliver
+
+	failures map[FailureCategory]int64 // failed builds and rejected requests, by category
+
+	evictions    map[string]int64 // builds whose artifact and log retention removed, by reason
+	evictedBytes int64
+
+	etaErrors [2]etaError // queue wait estimates checked against the wait, [0] from history, [1] rough
+
+	cacheResets map[string]int64 // corrupted build cache partitions cleared, by target
+
+	modRepairs map[string]int64 // damaged module cache entries downloaded again, by step
+
+	busDropped int64 // build messages dropped because the event sink fell behind
+	busFailed  int64 // build messages the event sink refused or didn't answer
+}
+
+// etaError accumulates how far queue wait estimates were off.
+type etaError struct {
+	count     int64
+	sumError  float64 // actual minus estimated seconds; positive when waits ran long
+	sumAbs    float64
+	sumWaited float64
+}
+
+var metrics = &serverMetrics{limited: map[string]int64{}, dropped: map[string]int64{}, failures: map[FailureCategory]int64{}, evictions: map[string]int64{}, cacheResets: map[string]int64{}, modRepairs: map[string]int64{}}
+
+// evictionReasons are the reasons buildEvicted is called with.
+var evictionReasons = []string{"max_age", "max_per_repo", "token_budget", "store_budget"}
+
+// modRepairSteps are the steps modCacheRepaired is called with.
+var modRepairSteps = []string{"deps", "compile"}
+
+// dropReasons are the reasons connectionDropped is called with.
+var dropReasons = []string{"no_request", "body_timeout", "write_timeout", "disconnected"}
+
+func (m *serverMetrics) rateLimited(scope string) {
+	m.mu.Lock()
+	m.limited[scope]++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) connectionDropped(reason string) {
+	m.mu.Lock()
+	m.dropped[reason]++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) partialTransfer(unsent int64) {
+	m.mu.Lock()
+	m.partial++
+	m.partialUnsent += unsent
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) buildFailed(category FailureCategory) {
+	m.mu.Lock()
+	m.failures[category]++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) buildEvicted(reason string, size int64) {
+	m.mu.Lock()
+	m.evictions[reason]++
+	m.evictedBytes += size
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) queueEstimated(eta, waited time.Duration, rough bool) {
+	m.mu.Lock()
+	e := &m.etaErrors[0]
+	if rough {
+		e = &m.etaErrors[1]
+	}
+	diff := (waited - eta).Seconds()
+	e.count++
+	e.sumError += diff
+	e.sumAbs += math.Abs(diff)
+	e.sumWaited += waited.Seconds()
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) cacheReset(target string) {
+	m.mu.Lock()
+	m.cacheResets[target]++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) modCacheRepaired(step string) {
+	m.mu.Lock()
+	m.modRepairs[step]++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) messageDropped() {
+	m.mu.Lock()
+	m.busDropped++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) messageFailed() {
+	m.mu.Lock()
+	m.busFailed++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) artifactOversize() {
+	m.mu.Lock()
+	m.oversize++
+	m.mu.Unlock()
+}
+
+// served marks, per connection, whether a request reached the handler.
+type served struct{}
+
+// connRequests holds the marks of open connections.
+var connRequests sync.Map // net.Conn -> *atomic.Bool
+
+// TrackConnections has srv count connections closed before a request
+// reached the handler, such as those cut off by ReadHeaderTimeout.
+func TrackConnections(srv *http.Server) {
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		mark := new(atomic.Bool)
+		connRequests.Store(c, mark)
+		return context.WithValue(ctx, served{}, mark)
+	}
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		if state != http.StateClosed && state != http.StateHijacked {
+			return
+		}
+		if mark, ok := connRequests.LoadAndDelete(c); ok && !mark.(*atomic.Bool).Load() {
+			metrics.connectionDropped("no_request")
+		}
+	}
+}
+
+// markServed records that r reached the handler.
+func markServed(r *http.Request) {
+	if mark, ok := r.Context().Value(served{}).(*atomic.Bool); ok {
+		mark.Store(true)
+	}
+}
+
+// metricsHandler serves GET /metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP billder_active_builds Builds running on this instance.")
+	fmt.Fprintln(w, "# TYPE billder_active_builds gauge")
+	fmt.Fprintf(w, "billder_active_builds %d\n", activeBuilds.Load())
+
+	fmt.Fprintln(w, "# HELP billder_queue_depth Targets waiting for a compile slot, by requested priority.")
+	fmt.Fprintln(w, "# TYPE billder_queue_depth gauge")
+	for level, n := range compileSlots.depth() {
+		fmt.Fprintf(w, "billder_queue_depth{priority=%q} %d\n", priorities[level], n)
+	}
+
+	fmt.Fprintln(w, "# HELP billder_rate_limited_total Build requests rejected with 429, by limit; resolve and badge count ref lookups and badge views over their own limits.")
+	fmt.Fprintln(w, "# TYPE billder_rate_limited_total counter")
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	for _, scope := range []string{"ip", "token", "global", "resolve", "badge"} {
+		fmt.Fprintf(w, "billder_rate_limited_total{scope=%q} %d\n", scope, metrics.limited[scope])
+	}
+
+	fmt.Fprintln(w, "# HELP billder_queue_wait_seconds Time builds waited for a compile slot, by whether the estimate they were given came from their own history.")
+	fmt.Fprintln(w, "# TYPE billder_queue_wait_seconds summary")
+	fmt.Fprintln(w, "# HELP billder_queue_eta_error_seconds Actual minus estimated queue wait; positive sums mean waits ran longer than estimated.")
+	fmt.Fprintln(w, "# TYPE billder_queue_eta_error_seconds summary")
+	fmt.Fprintln(w, "# HELP billder_queue_eta_abs_error_seconds How far queue wait estimates were off either way.")
+	fmt.Fprintln(w, "# TYPE billder_queue_eta_abs_error_seconds summary")
+	for i, estimate := range []string{"history", "rough"} {
+		e := metrics.etaErrors[i]
+		fmt.Fprintf(w, "billder_queue_wait_seconds_sum{estimate=%q} %g\n", estimate, e.sumWaited)
+		fmt.Fprintf(w, "billder_queue_wait_seconds_count{estimate=%q} %d\n", estimate, e.count)
+		fmt.Fprintf(w, "billder_queue_eta_error_seconds_sum{estimate=%q} %g\n", estimate, e.sumError)
+		fmt.Fprintf(w, "billder_queue_eta_error_seconds_count{estimate=%q} %d\n", estimate, e.count)
+		fmt.Fprintf(w, "billder_queue_eta_abs_error_seconds_sum{estimate=%q} %g\n", estimate, e.sumAbs)
+		fmt.Fprintf(w, "billder_queue_eta_abs_error_seconds_count{estimate=%q} %d\n", estimate, e.count)
+	}
+
+	fmt.Fprintln(w, "# HELP billder_build_failures_total Failed builds and rejected build requests, by error category. invalid_request, repo_not_found, auth_failed, deps_failed and compile_failed are the caller's to fix; toolchain_missing, oom and internal point at the server.")
+	fmt.Fprintln(w, "# TYPE billder_build_failures_total counter")
+	for _, category := range failureCategories {
+		fmt.Fprintf(w, "billder_build_failures_total{category=%q} %d\n", category, metrics.failures[category])
+	}
+
+	fmt.Fprintln(w, "# HELP billder_store_evictions_total Stored builds whose artifact and log retention removed, by the limit that removed them.")
+	fmt.Fprintln(w, "# TYPE billder_store_evictions_total counter")
+	for _, reason := range evictionReasons {
+		fmt.Fprintf(w, "billder_store_evictions_total{reason=%q} %d\n", reason, metrics.evictions[reason])
+	}
+	fmt.Fprintln(w, "# HELP billder_store_evicted_bytes_total Bytes those evictions freed.")
+	fmt.Fprintln(w, "# TYPE billder_store_evicted_bytes_total counter")
+	fmt.Fprintf(w, "billder_store_evicted_bytes_total %d\n", metrics.evictedBytes)
+
+	fmt.Fprintln(w, "# HELP billder_cache_resets_total Build cache partitions cleared after a build failed on corrupted entries, by target. A steady rise points at the disk or filesystem under the cache.")
+	fmt.Fprintln(w, "# TYPE billder_cache_resets_total counter")
+	for _, target := range currentPolicy().targets {
+		fmt.Fprintf(w, "billder_cache_resets_total{target=%q} %d\n", target, metrics.cacheResets[target])
+	}
+
+	fmt.Fprintln(w, "# HELP billder_modcache_repairs_total Module versions removed from the module cache and downloaded again after a build step failed on partial state in them, by step. A steady rise points at a badly damaged cache; clear it with go clean -modcache.")
+	fmt.Fprintln(w, "# TYPE billder_modcache_repairs_total counter")
+	for _, step := range modRepairSteps {
+		fmt.Fprintf(w, "billder_modcache_repairs_total{step=%q} %d\n", step, metrics.modRepairs[step])
+	}
+
+	fmt.Fprintln(w, "# HELP billder_event_messages_dropped_total Build messages not published because the event sink fell behind.")
+	fmt.Fprintln(w, "# TYPE billder_event_messages_dropped_total counter")
+	fmt.Fprintf(w, "billder_event_messages_dropped_total %d\n", metrics.busDropped)
+	fmt.Fprintln(w, "# HELP billder_event_messages_failed_total Build messages the event sink refused or didn't answer in time.")
+	fmt.Fprintln(w, "# TYPE billder_event_messages_failed_total counter")
+	fmt.Fprintf(w, "billder_event_messages_failed_total %d\n", metrics.busFailed)
+
+	fmt.Fprintln(w, "# HELP billder_oversize_artifacts_total Built artifacts not delivered for exceeding the size limit.")
+	fmt.Fprintln(w, "# TYPE billder_oversize_artifacts_total counter")
+	fmt.Fprintf(w, "billder_oversize_artifacts_total %d\n", metrics.oversize)
+
+	fmt.Fprintln(w, "# HELP billder_partial_transfers_total Artifact streams that broke off before the client had every byte.")
+	fmt.Fprintln(w, "# TYPE billder_partial_transfers_total counter")
+	fmt.Fprintf(w, "billder_partial_transfers_total %d\n", metrics.partial)
+	fmt.Fprintln(w, "# HELP billder_partial_transfer_unsent_bytes_total Artifact bytes those streams didn't deliver.")
+	fmt.Fprintln(w, "# TYPE billder_partial_transfer_unsent_bytes_total counter")
+	fmt.Fprintf(w, "billder_partial_transfer_unsent_bytes_total %d\n", metrics.partialUnsent)
+
+	fmt.Fprintln(w, "# HELP billder_connections_dropped_total Client connections given up on: closed before a request (slow headers hit ReadHeaderTimeout), a build request body too slow, a stream write timed out, or the client disconnected mid-stream.")
+	fmt.Fprintln(w, "# TYPE billder_connections_dropped_total counter")
+	for _, reason := range dropReasons {
+		fmt.Fprintf(w, "billder_connections_dropped_total{reason=%q} %d\n", reason, metrics.dropped[reason])
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchedMarker is touched in a mirror each time it's fetched from upstream.
+const fetchedMarker = "billder-fetched"
+
+// mirrorLocks serialize the fetch and clone of each mirror; the janitor
+// skips mirrors that are in use.
+var mirrorLocks sync.Map // path -> *sync.Mutex
+
+func mirrorLock(path string) *sync.Mutex {
+	mu, _ := mirrorLocks.LoadOrStore(path, new(sync.Mutex))
+	return mu.(*sync.Mutex)
+}
+
+// mirrorPath is where the bare mirror of a canonical repository lives.
+func mirrorPath(repo string) string {
+	return storePath(cfg.MirrorDir, repo+".git")
+}
+
+// mirrorAge is how long ago the mirror at path was last fetched.
+func mirrorAge(path string) time.Duration {
+	info, err := os.Stat(filepath.Join(path, fetchedMarker))
+	if err != nil {
+		return 0
+	}
+	return time.Since(info.ModTime()).Round(time.Second)
+}
+
+func touch(path string) {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); errors.Is(err, os.ErrNotExist) {
+		os.WriteFile(path, nil, 0o644)
+	}
+}
+
+// cloneFromMirror clones the workspace from the repository's local mirror,
+// creating the mirror on first use and fetching it unless the request set
+// refresh to false. An upstream that can't be reached during the fetch
+// isn't fatal: the build goes on from what the mirror already has. The
+// workspace's origin is the mirror, so later ref fetches stay local. It
+// returns the mirror's state: "created", "refreshed", "stale" or "offline".
+func (j *buildJob) cloneFromMirror(host *gitHost, p RequestPayload, sse *sseWriter) (string, error) {
+	path := mirrorPath(p.RepoURL)
+	mu := mirrorLock(path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	state := "offline"
+	_, err := os.Stat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !p.refreshes():
+		return "", failedWith(FailInvalidRequest, fmt.Errorf("no mirror of %s yet; build it once with refresh enabled", p.RepoURL))
+	case errors.Is(err, os.ErrNotExist):
+		tmp := path + ".tmp"
+		out, err := j.runRetrying(sse, "Clone", func() *exec.Cmd {
+			os.RemoveAll(tmp)
+			return host.git(j.ctx, "clone", "--mirror", "--", p.CloneURL(), tmp)
+		})
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			os.RemoveAll(tmp)
+			return "", failedWith(cloneFailure(out), errors.New("git clone failed. Is the URL correct?"))
+		}
+		state = "created"
+		touch(filepath.Join(path, fetchedMarker))
+		sse.Message("Git mirror: created")
+	case p.refreshes():
+		_, err := j.runRetrying(sse, "Mirror fetch", func() *exec.Cmd {
+			return host.git(j.ctx, "-C", path, "fetch", "--prune", "origin")
+		})
+		if err != nil {
+			if j.ctx.Err() != nil {
+				return "", j.ctx.Err()
+			}
+			state = "stale"
+			sse.Message(fmt.Sprintf("Warning: upstream unreachable, building from the mirror fetched %s ago", mirrorAge(path)))
+			break
+		}
+		state = "refreshed"
+		touch(filepath.Join(path, fetchedMarker))
+		sse.Message("Git mirror: refreshed")
+	default:
+		sse.Message(fmt.Sprintf("Git mirror: offline, using the copy fetched %s ago", mirrorAge(path)))
+	}
+	touch(path)
+
+	args := []string{"clone"}
+	if len(p.SparsePaths) > 0 {
+		args = append(args, "--sparse") // local clones share the mirror's objects, so there is nothing to filter
+	}
+	clone := exec.CommandContext(j.ctx, "git", append(args, "--", path, j.repoPath)...)
+	out, err := clone.CombinedOutput()
+	j.log.Command("", clone, out, err)
+	if err != nil {
+		return state, fmt.Errorf("cloning from the mirror failed: %s", strings.TrimSpace(string(out)))
+	}
+	return state, nil
+}
+
+// storedMirror is a mirror as the janitor sees it: one unit, last used at mod.
+type storedMirror struct {
+	path string
+	size int64
+	mod  time.Time
+}
+
+func listMirrors() []storedMirror {
+	if cfg.MirrorDir == "" {
+		return nil
+	}
+	entries, _ := os.ReadDir(cfg.MirrorDir)
+	var list []storedMirror
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasSuffix(e.Name(), ".git") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(cfg.MirrorDir, e.Name())
+		list = append(list, storedMirror{path, dirSize(path), info.ModTime()})
+	}
+	return list
+}
+
+// removeMirror deletes a mirror unless a build is using it.
+func removeMirror(path string) bool {
+	mu := mirrorLock(path)
+	if !mu.TryLock() {
+		return false
+	}
+	defer mu.Unlock()
+	return os.RemoveAll(path) == nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeMirror lays out a bare mirror of repo with a pack of size bytes,
+// last used age ago.
+func fakeMirror(t *testing.T, repo string, size int, age time.Duration) string {
+	t.Helper()
+	path := mirrorPath(repo)
+	pack := filepath.Join(path, "objects", "pack")
+	if err := os.MkdirAll(pack, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(path, "HEAD"), []byte("ref: refs/heads/main\n"), 0o644)
+	os.WriteFile(filepath.Join(pack, "pack-1.pack"), make([]byte, size), 0o644)
+	used := time.Now().Add(-age)
+	for _, p := range []string{filepath.Join(pack, "pack-1.pack"), filepath.Join(path, "HEAD"), path} {
+		os.Chtimes(p, used, used)
+	}
+	return path
+}
+
+// The janitor evicts idle mirrors as a unit, by TTL and then oldest first
+// over the size budget, and leaves mirrors a build holds alone.
+func TestJanitorEvictsMirrors(t *testing.T) {
+	dir := t.TempDir()
+	useDataDir(t, dir)
+	cfg.MirrorDir = filepath.Join(dir, "mirrors")
+	cfg.StoreTTL = time.Hour
+	cfg.StoreMaxBytes = 1 << 20
+
+	expired := fakeMirror(t, "github.com/acme/expired", 100, 2*time.Hour)
+	held := fakeMirror(t, "github.com/acme/held", 100, 3*time.Hour)
+	fresh := fakeMirror(t, "github.com/acme/fresh", 100, time.Minute)
+	mu := mirrorLock(held)
+	mu.Lock()
+	defer mu.Unlock()
+
+	cleanStore()
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("expired mirror not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(held, "objects", "pack", "pack-1.pack")); err != nil {
+		t.Errorf("the janitor touched a mirror in use: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fresh, "HEAD")); err != nil {
+		t.Errorf("fresh mirror removed: %v", err)
+	}
+
+	// Over budget, the least recently used mirror nobody holds goes
+	cfg.StoreTTL = 24 * time.Hour
+	cfg.StoreMaxBytes = 100 << 10
+	older := fakeMirror(t, "github.com/acme/older", 200<<10, 10*time.Minute)
+	cleanStore()
+	if _, err := os.Stat(older); !os.IsNotExist(err) {
+		t.Errorf("least recently used mirror kept over budget: %v", err)
+	}
+	for _, path := range []string{held, fresh} {
+		if _, err := os.Stat(filepath.Join(path, "HEAD")); err != nil {
+			t.Errorf("%s removed: %v", path, err)
+		}
+	}
+}
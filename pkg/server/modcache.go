@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modCacheDamage are go errors, lowercased, that partial state left in the
+// shared GOMODCACHE by an interrupted download causes. They only count on a
+// line naming a path in the cache, or the line before one, so nothing but
+// a damaged module version ever has the cache touched.
+var modCacheDamage = []string{
+	"file exists",
+	"cannot find package",
+	"no such file or directory",
+	"not a valid zip file",
+	"zip: checksum error",
+	"unexpected eof",
+	"unexpected end of json input",
+}
+
+// modVersion is a module version in the module cache, with the path as
+// the cache escapes it.
+type modVersion struct {
+	Path, Escaped, Version string
+}
+
+func (m modVersion) String() string { return m.Path + "@" + m.Version }
+
+// modRepairs remembers when each module version was last repaired, so
+// builds that hit the same damage at once repair it once.
+var modRepairs sync.Map // module@version -> *modRepair
+
+type modRepair struct {
+	sync.Mutex
+	at time.Time
+}
+
+// modCacheLock guards the shared GOMODCACHE. Builds' go commands hold it
+// for reading while they run; a repair waits for them and has the cache to
+// itself while it removes and downloads a module version.
+var modCacheLock sync.RWMutex
+
+// holdModCache shares the module cache with cmd, if it runs go: the go
+// command, or the fyne and gomobile packagers that call it. The returned
+// func releases it.
+func holdModCache(cmd *exec.Cmd) func() {
+	if !slices.Contains([]string{"go", "fyne", "gomobile"}, filepath.Base(cmd.Args[0])) {
+		return func() {}
+	}
+	modCacheLock.RLock()
+	return modCacheLock.RUnlock
+}
+
+// damagedModules lists the module versions that out, from a failed go
+// command, blames partial module cache state for.
+func damagedModules(out, modcache string) []modVersion {
+	if modcache == "" {
+		return nil
+	}
+	var found []modVersion
+	lines := strings.Split(out, "\n")
+	for i, line := range lines {
+		lower := strings.ToLower(line)
+		if !slices.ContainsFunc(modCacheDamage, func(match string) bool { return strings.Contains(lower, match) }) {
+			continue
+		}
+		// "cannot find package "." in:" names the directory on the next line
+		for _, l := range lines[i:min(i+2, len(lines))] {
+			if m, ok := cachedModule(l, modcache); ok && !slices.Contains(found, m) {
+				found = append(found, m)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// cachedModule finds the module version a path into the module cache on
+// line belongs to, whether extracted, "<cache>/example.com/!foo@v1.2.3/x.go",
+// or downloaded, "<cache>/cache/download/example.com/!foo/@v/v1.2.3.zip".
+func cachedModule(line, modcache string) (modVersion, bool) {
+	_, rel, ok := strings.Cut(line, modcache+string(filepath.Separator))
+	if !ok {
+		return modVersion{}, false
+	}
+	if end := strings.IndexAny(rel, " \t\"':"); end >= 0 {
+		rel = rel[:end]
+	}
+	rel = filepath.ToSlash(rel)
+	var m modVersion
+	if download, ok := strings.CutPrefix(rel, "cache/download/"); ok {
+		file := ""
+		m.Escaped, file, ok = strings.Cut(download, "/@v/")
+		m.Version = file
+		for _, ext := range []string{".partial", ".ziphash", ".zip", ".mod", ".info", ".lock"} {
+			if v, _, cut := strings.Cut(file, ext); cut && len(v) < len(m.Version) {
+				m.Version = v
+			}
+		}
+	} else {
+		var rest string
+		m.Escaped, rest, ok = strings.Cut(rel, "@")
+		m.Version, _, _ = strings.Cut(rest, "/")
+		m.Version, _, _ = strings.Cut(m.Version, ".tmp-") // where go unzips it before renaming
+	}
+	if !ok || m.Escaped == "" || !strings.HasPrefix(m.Version, "v") || strings.Contains(m.Escaped, "..") {
+		return modVersion{}, false
+	}
+	m.Path = unescapeModPath(m.Escaped)
+	return m, true
+}
+
+// unescapeModPath undoes the module cache's case escaping: "!foo" is "Foo".
+func unescapeModPath(escaped string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range escaped {
+		switch {
+		case r == '!':
+			upper = true
+		case upper:
+			b.WriteString(strings.ToUpper(string(r)))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// repairModCache looks in out, from a go command of step that failed, for
+// module versions a previous download left half written in the shared
+// module cache. Once no other go command is reading the cache, it removes
+// each from it and downloads it again with env, announcing what it
+// repaired through say, and reports whether there were any, in which case
+// the step is worth running once more.
+// Failures it doesn't recognize leave the cache alone.
+func (j *buildJob) repairModCache(step, out string, env []string, say func(string)) bool {
+	modcache := goEnv("GOMODCACHE")
+	damaged := damagedModules(out, modcache)
+	for _, m := range damaged {
+		v, _ := modRepairs.LoadOrStore(m.String(), &modRepair{})
+		repair := v.(*modRepair)
+		repair.Lock()
+		if time.Since(repair.at) < time.Minute {
+			repair.Unlock()
+			say(fmt.Sprintf("Module cache: %s was just repaired by another build", m))
+			continue
+		}
+		metrics.modCacheRepaired(step)
+		modCacheLock.Lock()
+		log.Printf("Removing %s from the module cache %s", m, modcache)
+		if err := removeCachedModule(modcache, m); err != nil {
+			log.Printf("Remove %s from the module cache: %v", m, err)
+		}
+		download := exec.CommandContext(j.ctx, "go", "mod", "download", m.String())
+		download.Dir, download.Env = j.moduleDir, env
+		dl, err := download.CombinedOutput()
+		modCacheLock.Unlock()
+		j.log.Command("", download, dl, err)
+		repair.at = time.Now()
+		repair.Unlock()
+		if err != nil {
+			say(fmt.Sprintf("Module cache: %s was left damaged by an interrupted download and has been removed; downloading it again failed: %s", m, lastLine(string(dl))))
+			continue
+		}
+		say(fmt.Sprintf("Module cache: %s was left damaged by an interrupted download and has been downloaded again", m))
+	}
+	if len(damaged) > 0 {
+		say("Retrying once with the repaired module cache")
+	}
+	return len(damaged) > 0
+}
+
+// removeCachedModule deletes a module version's extracted files, which go
+// makes read-only, and its downloads from the module cache.
+func removeCachedModule(modcache string, m modVersion) error {
+	dir := filepath.Join(modcache, filepath.FromSlash(m.Escaped)+"@"+m.Version)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(path, 0o755)
+		}
+		return nil
+	})
+	err := os.RemoveAll(dir)
+	downloads, _ := filepath.Glob(filepath.Join(downloadDir(modcache), filepath.FromSlash(m.Escaped), "@v", m.Version+".*"))
+	for _, file := range downloads {
+		if rmErr := os.Remove(file); rmErr != nil && err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
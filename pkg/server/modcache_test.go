@@ -0,0 +1,56 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useModCache points the module cache goEnv reports at a directory of the
+// test's own.
+func useModCache(t *testing.T) string {
+	t.Helper()
+	goEnv("GOMODCACHE")
+	prev := goEnvVars
+	modcache := t.TempDir()
+	goEnvVars = map[string]string{"GOMODCACHE": modcache, "GOPROXY": "off"}
+	t.Cleanup(func() { goEnvVars = prev })
+	return modcache
+}
+
+// A damaged module version stays in place while another build's go
+// command reads the cache; the repair removes it once that is done.
+func TestModCacheRepairWaitsForBuilds(t *testing.T) {
+	modcache := useModCache(t)
+	damaged := filepath.Join(modcache, "example.com", "!acme", "lib@v1.2.3")
+	os.MkdirAll(damaged, 0o755)
+	os.WriteFile(filepath.Join(damaged, "lib.go"), []byte("package lib\n"), 0o644)
+	j := checkTreeJob(t, "module", false)
+	j.moduleDir = j.repoPath
+	env := append(os.Environ(), "GOMODCACHE="+modcache, "GOPROXY=off", "GOFLAGS=-mod=mod")
+
+	release := holdModCache(exec.Command("go", "build"))
+	repaired := make(chan bool)
+	go func() {
+		out := "open " + filepath.Join(damaged, "lib.go") + ": no such file or directory"
+		repaired <- j.repairModCache("compile", out, env, func(string) {})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(damaged); err != nil {
+		t.Fatalf("removed while a go command reads the cache: %v", err)
+	}
+	release()
+	select {
+	case ok := <-repaired:
+		if !ok {
+			t.Error("damage not recognized")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the repair never ran")
+	}
+	if _, err := os.Stat(damaged); !os.IsNotExist(err) {
+		t.Errorf("damaged module version still cached: %v", err)
+	}
+}
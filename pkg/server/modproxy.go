@@ -0,0 +1,286 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// moduleVars are the module settings every go command of a build runs
+// with: the configured GOPROXY, GOSUMDB and GOFLAGS, and the embedded
+// module proxy ahead of the upstream proxies when it's enabled.
+func moduleVars() []string {
+	var vars []string
+	if proxy := buildProxy(); proxy != "" {
+		vars = append(vars, "GOPROXY="+proxy)
+	}
+	if cfg.GoSumDB != "" {
+		vars = append(vars, "GOSUMDB="+cfg.GoSumDB)
+	}
+	if cfg.GoFlags != "" {
+		vars = append(vars, "GOFLAGS="+cfg.GoFlags)
+	}
+	return vars
+}
+
+// upstreamProxy is the GOPROXY list modules come from when the embedded
+// proxy doesn't have them.
+func upstreamProxy() string {
+	return cmp.Or(cfg.GoProxy, goEnv("GOPROXY"))
+}
+
+// buildProxy is the GOPROXY builds use. The embedded proxy is followed by
+// '|' so builds fall through to upstream on any error from it, not only a
+// 404.
+func buildProxy() string {
+	if modProxyURL == "" {
+		return cfg.GoProxy
+	}
+	return modProxyURL + "/modproxy|" + upstreamProxy()
+}
+
+// modProxyURL is where builds reach the embedded module proxy, or "" when
+// it isn't running.
+var modProxyURL string
+
+// startModProxy serves the embedded module proxy on a loopback port of its
+// own. The public mux never routes to it, so only processes on this host,
+// builds among them, can reach it, whatever proxies the server sits behind.
+// It returns nil if the proxy couldn't listen.
+func startModProxy() *http.Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Printf("Module proxy disabled: %v", err)
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/modproxy/", modProxyHandler)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	modProxyURL = "http://" + ln.Addr().String()
+	log.Printf("Module proxy listening on %s", modProxyURL)
+	return srv
+}
+
+// goEnv is the go command's own setting of a variable.
+func goEnv(name string) string {
+	goEnvOnce.Do(func() {
+		goEnvVars = map[string]string{}
+		out, err := exec.Command("go", "env", "GOPROXY", "GOMODCACHE").Output()
+		if err != nil {
+			return
+		}
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		for i, key := range []string{"GOPROXY", "GOMODCACHE"} {
+			if i < len(lines) {
+				goEnvVars[key] = lines[i]
+			}
+		}
+	})
+	return goEnvVars[name]
+}
+
+var (
+	goEnvOnce sync.Once
+	goEnvVars map[string]string
+)
+
+// proxyGet matches the requests `go -x` logs as it fetches modules:
+// "# get https://proxy.golang.org/...: 200 OK (0.112s)".
+var proxyGet = regexp.MustCompile(`^# get (\S+): (\d{3})`)
+
+// moduleSources counts the successful fetches in go -x output by the
+// GOPROXY entry that served them, like "https://proxy.golang.org (12)".
+func moduleSources(out []byte) []string {
+	counts := map[string]int{}
+	for _, line := range strings.Split(string(out), "\n") {
+		m := proxyGet.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil || m[2] != "200" {
+			continue
+		}
+		source := m[1]
+		for _, entry := range strings.FieldsFunc(buildProxy(), func(r rune) bool { return r == ',' || r == '|' }) {
+			if strings.HasPrefix(m[1], strings.TrimSuffix(entry, "/")+"/") {
+				source = entry
+				break
+			}
+		}
+		counts[redactURL(source)]++
+	}
+	var sources []string
+	for source, n := range counts {
+		sources = append(sources, fmt.Sprintf("%s (%d)", source, n))
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// redactURL keeps a proxy's host and path, dropping any credentials.
+func redactURL(u string) string {
+	scheme, rest, ok := strings.Cut(u, "://")
+	if !ok {
+		return u
+	}
+	if _, host, ok := strings.Cut(rest, "@"); ok {
+		rest = host
+	}
+	return scheme + "://" + rest
+}
+
+// modProxyCache is the module cache the embedded proxy downloads misses
+// into. It can't be the shared one: the build asking for a module holds
+// that module's lock in the shared cache while it waits for the proxy.
+func modProxyCache() string {
+	return filepath.Join(os.TempDir(), "billder-modcache")
+}
+
+// downloadDir is a module cache's download directory, laid out exactly as
+// the GOPROXY protocol expects.
+func downloadDir(modcache string) string {
+	return filepath.Join(modcache, "cache", "download")
+}
+
+// modProxyFile matches the immutable files the embedded proxy serves. Version
+// lists and @latest go upstream: the cache only knows versions someone
+// downloaded, and a short list would pin builds to old releases.
+var modProxyFile = regexp.MustCompile(`^[^@]+/@v/[^/]+\.(info|mod|zip)$`)
+
+// modProxyLocks makes concurrent requests for one version wait for a
+// single download.
+var modProxyLocks sync.Map // module@version -> *sync.Mutex
+
+// modProxyHandler serves GET /modproxy/ from the shared module cache, then
+// from its own, downloading misses from upstream into its own until that
+// reaches its quota. startModProxy serves it on loopback only.
+func modProxyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rel := strings.TrimPrefix(r.URL.Path, "/modproxy/")
+	if rel != path.Clean(rel) || strings.HasPrefix(rel, "/") || strings.Contains(rel, "..") || !modProxyFile.MatchString(rel) {
+		http.NotFound(w, r)
+		return
+	}
+	file := filepath.Join(downloadDir(goEnv("GOMODCACHE")), filepath.FromSlash(rel))
+	if _, err := os.Stat(file); err != nil {
+		file = filepath.Join(downloadDir(modProxyCache()), filepath.FromSlash(rel))
+	}
+	if _, err := os.Stat(file); err != nil {
+		escaped, ver, _ := strings.Cut(rel, "/@v/")
+		ver = strings.TrimSuffix(ver, path.Ext(ver))
+		mod, ok1 := unescapeModule(escaped)
+		version, ok2 := unescapeModule(ver)
+		if !ok1 || !ok2 || !fetchModule(mod, version, file) {
+			http.NotFound(w, r) // the go command moves on to the next proxy
+			return
+		}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+	switch path.Ext(rel) {
+	case ".info":
+		w.Header().Set("Content-Type", "application/json")
+	case ".mod":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	case ".zip":
+		w.Header().Set("Content-Type", "application/zip")
+	}
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// unescapeModule undoes the GOPROXY case encoding, where "!x" stands for
+// "X", reporting false for paths that aren't validly encoded.
+func unescapeModule(s string) (string, bool) {
+	var b strings.Builder
+	bang := false
+	for _, c := range s {
+		switch {
+		case bang && c >= 'a' && c <= 'z':
+			b.WriteRune(unicode.ToUpper(c))
+			bang = false
+		case bang || unicode.IsUpper(c):
+			return "", false
+		case c == '!':
+			bang = true
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String(), !bang && s != ""
+}
+
+// fetchModule downloads mod@version into the proxy's module cache from
+// upstream, unless that is already at its quota. It reports whether file, the
+// one requested, is now cached.
+func fetchModule(mod, version, file string) bool {
+	key := mod + "@" + version
+	mu, _ := modProxyLocks.LoadOrStore(key, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+	if _, err := os.Stat(file); err == nil {
+		return true // fetched while we waited
+	}
+	if size := modCacheSize(); size >= cfg.ModProxyMaxBytes {
+		log.Printf("Module proxy: cache is %d MB, at its %d MB quota; not fetching %s", size>>20, cfg.ModProxyMaxBytes>>20, key)
+		return false
+	}
+
+	dir, err := os.MkdirTemp("", "billder-modproxy-")
+	if err != nil {
+		return false
+	}
+	defer os.RemoveAll(dir)
+	cmd := exec.Command("go", "mod", "download", "-json", "--", key)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOMODCACHE="+modProxyCache(), "GOPROXY="+upstreamProxy(), "GOFLAGS=", "GO111MODULE=on")
+	if cfg.GoSumDB != "" {
+		cmd.Env = append(cmd.Env, "GOSUMDB="+cfg.GoSumDB)
+	}
+	start := time.Now()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Module proxy: fetching %s failed: %v: %s", key, err, strings.TrimSpace(string(out)))
+		return false
+	}
+	modCache.Lock()
+	modCache.measured = time.Time{} // it grew; measure again next time
+	modCache.Unlock()
+	log.Printf("Module proxy: fetched %s in %s", key, time.Since(start).Round(time.Millisecond))
+	_, err = os.Stat(file)
+	return err == nil
+}
+
+// modCache is the proxy's module cache size, measured at most once a minute.
+var modCache struct {
+	sync.Mutex
+	size     int64
+	measured time.Time
+}
+
+// modCacheSize is the disk the proxy's module cache uses, downloads and
+// extracted sources together, for its quota.
+func modCacheSize() int64 {
+	modCache.Lock()
+	defer modCache.Unlock()
+	if time.Since(modCache.measured) > time.Minute {
+		modCache.size, modCache.measured = dirSize(modProxyCache()), time.Now()
+	}
+	return modCache.size
+}
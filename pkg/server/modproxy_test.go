@@ -0,0 +1,61 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The embedded proxy listens on a loopback port of its own, which builds
+// get first in GOPROXY, and serves cached module files there.
+func TestModProxyListener(t *testing.T) {
+	modcache := useModCache(t)
+	prev := cfg
+	cfg.GoProxy, cfg.ModProxyMaxBytes = "https://proxy.example.com", 0 // at quota: misses aren't fetched
+	t.Cleanup(func() { cfg, modProxyURL = prev, "" })
+	dir := filepath.Join(downloadDir(modcache), "example.com", "!acme", "lib", "@v")
+	os.MkdirAll(dir, 0o755)
+	os.WriteFile(filepath.Join(dir, "v1.0.0.mod"), []byte("module example.com/Acme/lib\n"), 0o644)
+
+	startModProxy()
+	u, err := url.Parse(modProxyURL)
+	if err != nil || u.Hostname() != "127.0.0.1" {
+		t.Fatalf("proxy at %q: %v", modProxyURL, err)
+	}
+	if want := modProxyURL + "/modproxy|https://proxy.example.com"; buildProxy() != want {
+		t.Errorf("builds' GOPROXY %q, want %q", buildProxy(), want)
+	}
+	for _, tc := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/modproxy/example.com/!acme/lib/@v/v1.0.0.mod", http.StatusOK, "module example.com/Acme/lib\n"},
+		{"/modproxy/example.com/!acme/lib/@v/v1.0.1.mod", http.StatusNotFound, ""},
+		{"/modproxy/example.com/!acme/lib/@v/list", http.StatusNotFound, ""},
+		{"/modproxy/example.com/!acme/lib/@v/../../../../etc/passwd.mod", http.StatusNotFound, ""},
+		{"/build", http.StatusNotFound, ""},
+	} {
+		resp, err := http.Get(modProxyURL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.code || (tc.body != "" && string(body) != tc.body) {
+			t.Errorf("GET %s: %d %q, want %d", tc.path, resp.StatusCode, body, tc.code)
+		}
+	}
+
+	// go -x names the proxy without the path it fetched
+	out := "# get " + modProxyURL + "/modproxy/example.com/!acme/lib/@v/v1.0.0.mod: 200 OK (0.001s)\n" +
+		"# get https://proxy.example.com/golang.org/x/text/@v/v0.3.0.zip: 200 OK (0.2s)\n" +
+		"# get https://proxy.example.com/golang.org/x/text/@v/v0.3.0.info: 404 Not Found (0.1s)\n"
+	if got := strings.Join(moduleSources([]byte(out)), ", "); got != modProxyURL+"/modproxy (1), https://proxy.example.com (1)" {
+		t.Errorf("module sources %s", got)
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// GoModule is a module found in a cloned repository.
+type GoModule struct {
+	Dir  string   `json:"dir"`                     // relative to the repository root, "." for the root
+	Path string   `json:"path"`                    // the module path its go.mod declares
+	Main []string `json:"main_packages,omitempty"` // directories of its main packages, relative to Dir
+}
+
+// ModuleList is the "modules" event, sent when a repository holds more
+// than one module.
+type ModuleList struct {
+	Modules  []GoModule `json:"modules"`
+	Selected string     `json:"selected,omitempty"` // the module_dir built; empty when the build stops to ask for one
+}
+
+// treeKind classifies a cloned tree by what billder can build from it.
+type treeKind int
+
+const (
+	treeEmpty      treeKind = iota // no files at all
+	treeNonGo                      // files, but no Go source
+	treeGoNoModule                 // Go source without any go.mod: GOPATH-style code
+	treeModule                     // at least one go.mod
+)
+
+// syntheticModule is the module path init_module gives code without a go.mod.
+const syntheticModule = "billder.local/app"
+
+// classifyTree looks at the files under root the go command would see.
+// example is a file found, for naming in errors.
+func classifyTree(root string) (kind treeKind, example string) {
+	var files, goFiles int
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if p != root && skipDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == "go.mod" {
+			kind = treeModule
+			return filepath.SkipAll
+		}
+		if files++; example == "" {
+			example, _ = filepath.Rel(root, p)
+		}
+		if strings.HasSuffix(d.Name(), ".go") {
+			goFiles++
+		}
+		return nil
+	})
+	switch {
+	case kind == treeModule:
+	case goFiles > 0:
+		kind = treeGoNoModule
+	case files > 0:
+		kind = treeNonGo
+	default:
+		kind = treeEmpty
+	}
+	return kind, filepath.ToSlash(example)
+}
+
+// checkTree stops builds of trees with nothing to build, and with
+// init_module gives Go code without a go.mod a synthesized one.
+func (j *buildJob) checkTree(sse *sseWriter) error {
+	kind, example := classifyTree(j.repoPath)
+	switch kind {
+	case treeEmpty:
+		return failedWith(FailRepoNotFound, errors.New("the repository is empty at this commit; push some Go code or choose another ref"))
+	case treeNonGo:
+		return failedWith(FailInvalidRequest, fmt.Errorf("the repository has no Go source files (it has e.g. %s); billder builds Go programs", example))
+	case treeGoNoModule:
+		if !j.payload.InitModule {
+			return failedWith(FailInvalidRequest, errors.New("the repository has Go code but no go.mod (GOPATH-style); add one, or set init_module: true (client --init-module) to build it with a synthesized module"))
+		}
+		initCmd := exec.CommandContext(j.ctx, "go", "mod", "init", syntheticModule)
+		initCmd.Dir = j.repoPath
+		initCmd.Env = append(os.Environ(), moduleVars()...)
+		out, err := initCmd.CombinedOutput()
+		j.log.Command("", initCmd, out, err)
+		if err != nil {
+			return fmt.Errorf("go mod init failed: %s", strings.TrimSpace(string(out)))
+		}
+		j.syntheticModule = true
+		sse.Message("Warning: the repository has no go.mod; building it as module " + syntheticModule + " from a synthesized go.mod. Imports of its own packages by their old GOPATH paths won't resolve")
+	default:
+		if j.payload.InitModule {
+			sse.Message("The repository has a go.mod; init_module is ignored")
+		}
+	}
+	return nil
+}
+
+// skipDir reports whether the go command ignores the directory name, or
+// it's VCS metadata.
+func skipDir(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor"
+}
+
+// findModules lists the modules under root, the root's first.
+func findModules(root string) []GoModule {
+	var mods []GoModule
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if p != root && skipDir(d.Name()) {
+			return filepath.SkipDir
+		}
+		modPath, ok := readModulePath(filepath.Join(p, "go.mod"))
+		if !ok {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		mods = append(mods, GoModule{Dir: filepath.ToSlash(rel), Path: modPath, Main: mainPackages(p)})
+		return nil
+	})
+	return mods
+}
+
+// readModulePath is the module path declared in the go.mod at file.
+func readModulePath(file string) (string, bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "module" {
+			if unquoted, err := strconv.Unquote(fields[1]); err == nil {
+				return unquoted, true
+			}
+			return fields[1], true
+		}
+	}
+	return "", true // a go.mod without a module line is still a module root
+}
+
+// mainPackages lists the directories of the module at dir holding a main
+// package, not descending into nested modules.
+func mainPackages(dir string) []string {
+	var mains []string
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if p != dir {
+			if skipDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(p, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		if isMainPackage(p) {
+			rel, _ := filepath.Rel(dir, p)
+			mains = append(mains, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return mains
+}
+
+// isMainPackage reports whether the directory holds a main package.
+func isMainPackage(dir string) bool {
+	fset := token.NewFileSet()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, parser.PackageClauseOnly)
+		if err == nil && f.Name.Name == "main" {
+			return true
+		}
+	}
+	return false
+}
+
+// selectModule settles the module the build's go commands run in. A
+// requested module_dir must hold a go.mod. Otherwise a lone module is
+// built wherever it is, and a go.work at the root builds the workspace
+// from there, but of several independent modules none is guessed: the
+// client gets the list and an error asking for module_dir.
+func (j *buildJob) selectModule(sse *sseWriter) error {
+	mods := findModules(j.repoPath)
+	dir := j.payload.ModuleDir
+	_, workErr := os.Stat(filepath.Join(j.repoPath, "go.work"))
+	switch {
+	case dir != "":
+		if !slices.ContainsFunc(mods, func(m GoModule) bool { return m.Dir == dir }) {
+			sse.Event("modules", ModuleList{Modules: mods})
+			return failedWith(FailInvalidRequest, fmt.Errorf("module_dir %q has no go.mod", dir))
+		}
+	case len(mods) > 1 && workErr == nil:
+		dir = "."
+	case len(mods) > 1:
+		sse.Event("modules", ModuleList{Modules: mods})
+		return failedWith(FailInvalidRequest, fmt.Errorf("the repository has %d modules; set module_dir to the one to build", len(mods)))
+	case len(mods) == 1:
+		dir = mods[0].Dir
+	default:
+		dir = "."
+	}
+	j.moduleDir = filepath.Join(j.repoPath, filepath.FromSlash(dir))
+	if len(mods) > 1 {
+		sse.Event("modules", ModuleList{Modules: mods, Selected: dir})
+	}
+	if dir != "." {
+		sse.Message("Building the module in " + dir)
+	}
+	return nil
+}
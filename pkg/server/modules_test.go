@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// treeFixture copies testdata/trees/name to a directory of its own, as a
+// clone would leave it. "empty" is a clone without files.
+func treeFixture(t *testing.T, name string) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "repo")
+	os.MkdirAll(filepath.Join(dir, ".git"), 0o755)
+	if name != "empty" {
+		if err := os.CopyFS(dir, os.DirFS(filepath.Join("testdata", "trees", name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFindModules(t *testing.T) {
+	for _, tc := range []struct {
+		fixture string
+		want    []GoModule
+	}{
+		{"empty", nil},
+		{"module", []GoModule{{Dir: ".", Path: "example.com/app", Main: []string{"."}}}},
+		{"nested", []GoModule{{Dir: "app", Path: "example.com/nested/app", Main: []string{"."}}}},
+		// The modules under _example, testdata and .github are where the go
+		// command doesn't look.
+		{"multi", []GoModule{
+			{Dir: ".", Path: "example.com/multi", Main: []string{"."}},
+			{Dir: "lib", Path: "example.com/multi/lib"},
+			{Dir: "tools", Path: "example.com/multi/tools", Main: []string{"gen", "lint"}},
+		}},
+		{"workspace", []GoModule{
+			{Dir: "api", Path: "example.com/workspace/api"},
+			{Dir: "web", Path: "example.com/workspace/web", Main: []string{"."}},
+		}},
+	} {
+		t.Run(tc.fixture, func(t *testing.T) {
+			if got := findModules(treeFixture(t, tc.fixture)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("found %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+// A requested module_dir is built if it holds a module the go command
+// would see; without one, a lone module or a workspace is.
+func TestSelectModule(t *testing.T) {
+	for _, tc := range []struct {
+		fixture, moduleDir string
+		want               string // the directory built, or the error
+		listed             bool   // whether a modules event is sent
+	}{
+		{"module", "", ".", false},
+		{"nested", "", "app", false},
+		{"multi", "", "the repository has 3 modules; set module_dir", true},
+		{"multi", ".", ".", true},
+		{"multi", "tools", "tools", true},
+		{"multi", "lib", "lib", true},
+		{"multi", "tools/gen", `module_dir "tools/gen" has no go.mod`, true},
+		{"multi", "testdata/fixture", `module_dir "testdata/fixture" has no go.mod`, true},
+		{"workspace", "", ".", true},
+		{"workspace", "web", "web", true},
+	} {
+		t.Run(tc.fixture+" "+tc.moduleDir, func(t *testing.T) {
+			j := &buildJob{repoPath: treeFixture(t, tc.fixture), payload: RequestPayload{ModuleDir: tc.moduleDir}}
+			w := httptest.NewRecorder()
+			err := j.selectModule(newTestSSE(t, w))
+			var list *ModuleList
+			for _, ev := range parseSSE(w.Body.String()) {
+				if ev.name == "modules" {
+					list = new(ModuleList)
+					json.Unmarshal([]byte(ev.data), list)
+				}
+			}
+			if (list != nil) != tc.listed {
+				t.Errorf("modules event %+v, want one: %v", list, tc.listed)
+			}
+
+			if strings.Contains(tc.want, " ") {
+				if err == nil || categoryOf(err, "") != FailInvalidRequest || !strings.Contains(err.Error(), tc.want) {
+					t.Errorf("error %v, want invalid_request about %q", err, tc.want)
+				}
+				if list != nil && list.Selected != "" {
+					t.Errorf("%q selected after an error", list.Selected)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(j.repoPath, tc.want); j.moduleDir != want {
+				t.Errorf("module dir %s, want %s", j.moduleDir, want)
+			}
+			if list != nil && list.Selected != tc.want {
+				t.Errorf("modules event selected %q, want %q", list.Selected, tc.want)
+			}
+		})
+	}
+}
+
+// module_dir is cleaned, and "." stays the root module rather than
+// becoming no choice at all.
+func TestModuleDirNormalized(t *testing.T) {
+	usePolicy(t)
+	for dir, want := range map[string]string{".": ".", "./": ".", "tools/": "tools", "./tools/gen/..": "tools"} {
+		p := RequestPayload{RepoURL: "github.com/acme/app", TargetOS: "linux", ModuleDir: dir}
+		if err := p.normalize(false); err != nil || p.ModuleDir != want {
+			t.Errorf("module_dir %q normalized to %q (%v), want %q", dir, p.ModuleDir, err, want)
+		}
+	}
+}
+
+func TestClassifyTree(t *testing.T) {
+	for _, tc := range []struct {
+		fixture string
+		kind    treeKind
+		example string
+	}{
+		{"empty", treeEmpty, ""},
+		{"readme", treeNonGo, "README.md"},
+		{"nongo", treeNonGo, "README.md"},
+		{"ignored", treeNonGo, "README.md"}, // its Go files are where the go command doesn't look
+		{"gopath", treeGoNoModule, "main.go"},
+		{"module", treeModule, ""},
+		{"nested", treeModule, ""},
+	} {
+		t.Run(tc.fixture, func(t *testing.T) {
+			kind, example := classifyTree(treeFixture(t, tc.fixture))
+			if kind != tc.kind || (tc.example != "" && example != tc.example) {
+				t.Errorf("classified as %d, e.g. %q; want %d, e.g. %q", kind, example, tc.kind, tc.example)
+			}
+		})
+	}
+}
+
+// checkTreeJob is a build of the fixture tree, as it is once cloned.
+func checkTreeJob(t *testing.T, fixture string, initModule bool) *buildJob {
+	t.Helper()
+	log, err := createBuildLog(filepath.Join(t.TempDir(), "build.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { log.file.Close() })
+	return &buildJob{ctx: context.Background(), repoPath: treeFixture(t, fixture), payload: RequestPayload{InitModule: initModule}, log: log}
+}
+
+// Each class of tree stops the build with its own error, or lets it go on
+// with its own note.
+func TestCheckTree(t *testing.T) {
+	for _, tc := range []struct {
+		fixture    string
+		initModule bool
+		category   FailureCategory // "" if the build goes on
+		want       string          // in the error, or a message sent
+	}{
+		{"empty", false, FailRepoNotFound, "the repository is empty at this commit"},
+		{"empty", true, FailRepoNotFound, "the repository is empty at this commit"},
+		{"readme", false, FailInvalidRequest, "no Go source files (it has e.g. README.md)"},
+		{"nongo", true, FailInvalidRequest, "no Go source files"},
+		{"ignored", false, FailInvalidRequest, "no Go source files"},
+		{"gopath", false, FailInvalidRequest, "set init_module: true"},
+		{"gopath", true, "", "building it as module billder.local/app from a synthesized go.mod"},
+		{"module", false, "", ""},
+		{"module", true, "", "The repository has a go.mod; init_module is ignored"},
+		{"nested", false, "", ""},
+	} {
+		t.Run(tc.fixture+map[bool]string{true: " init_module"}[tc.initModule], func(t *testing.T) {
+			j := checkTreeJob(t, tc.fixture, tc.initModule)
+			w := httptest.NewRecorder()
+			err := j.checkTree(newTestSSE(t, w))
+			var messages []string
+			for _, ev := range parseSSE(w.Body.String()) {
+				messages = append(messages, ev.data)
+			}
+			sent := strings.Join(messages, "\n")
+
+			if tc.category != "" {
+				if err == nil || categoryOf(err, "") != tc.category || !strings.Contains(err.Error(), tc.want) {
+					t.Errorf("error %v (%s), want %s about %q", err, categoryOf(err, ""), tc.category, tc.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(sent, tc.want) || (tc.want == "" && sent != "") {
+				t.Errorf("sent %q, want %q", sent, tc.want)
+			}
+			modPath, ok := readModulePath(filepath.Join(j.repoPath, "go.mod"))
+			if j.syntheticModule != (tc.fixture == "gopath") || (tc.fixture == "gopath" && (!ok || modPath != syntheticModule)) {
+				t.Errorf("synthetic module %v, go.mod declares %q", j.syntheticModule, modPath)
+			}
+		})
+	}
+}
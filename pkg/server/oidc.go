@@ -0,0 +1,204 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const googleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// Reason codes for Google ID token failures.
+const (
+	authBadIDToken      = "bad_id_token"
+	authIDTokenExpired  = "id_token_expired"
+	authWrongAudience   = "wrong_audience"
+	authWrongIssuer     = "wrong_issuer"
+	authEmailNotAllowed = "email_not_allowed"
+)
+
+// oidcConfig accepts Google ID tokens for audience (the service URL on
+// Cloud Run) from the allowed service account emails.
+type oidcConfig struct {
+	audience string
+	emails   []string
+}
+
+type idTokenClaims struct {
+	Issuer        string `json:"iss"`
+	Audience      string `json:"aud"`
+	Expiry        int64  `json:"exp"`
+	IssuedAt      int64  `json:"iat"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// verify checks a Google-signed RS256 ID token and returns the email it
+// was issued to, with a reason code when the caller isn't allowed.
+func (c *oidcConfig) verify(raw string) (email, reason string) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return "", authBadIDToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims idTokenClaims
+	if decodeSegment(parts[0], &header) != nil || decodeSegment(parts[1], &claims) != nil || header.Alg != "RS256" {
+		return "", authBadIDToken
+	}
+	key, err := googleKeys.get(header.Kid)
+	if err != nil {
+		return "", authBadIDToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", authBadIDToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+		return "", authBadIDToken
+	}
+
+	const leeway = 30 * time.Second
+	switch {
+	case claims.Issuer != "https://accounts.google.com" && claims.Issuer != "accounts.google.com":
+		return "", authWrongIssuer
+	case claims.Audience != c.audience:
+		return "", authWrongAudience
+	case time.Now().After(time.Unix(claims.Expiry, 0).Add(leeway)):
+		return "", authIDTokenExpired
+	case !claims.EmailVerified || !slices.Contains(c.emails, claims.Email):
+		return "", authEmailNotAllowed
+	}
+	return claims.Email, ""
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwksCache holds Google's signing keys, refetched when they expire or an
+// unknown key ID shows up (Google rotates keys regularly). Fetches happen
+// at most once per jwksMinRefresh and outside the lock; meanwhile, and
+// when a fetch fails, the keys already cached keep verifying tokens.
+type jwksCache struct {
+	url string
+	now func() time.Time
+
+	mu       sync.Mutex
+	keys     map[string]*rsa.PublicKey
+	expires  time.Time
+	fetched  time.Time     // when the last fetch started
+	fetching chan struct{} // closed when the fetch in flight ends; nil if none
+}
+
+// jwksMinRefresh is how often tokens with made-up key IDs can make the
+// server fetch the keys.
+const jwksMinRefresh = time.Minute
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{url: url, now: time.Now}
+}
+
+var googleKeys = newJWKSCache(googleCertsURL)
+
+func (j *jwksCache) get(kid string) (*rsa.PublicKey, error) {
+	for {
+		j.mu.Lock()
+		now := j.now()
+		key, known := j.keys[kid]
+		switch {
+		case known && now.Before(j.expires):
+			j.mu.Unlock()
+			return key, nil
+		case j.fetching == nil && now.Sub(j.fetched) >= jwksMinRefresh:
+			done := make(chan struct{})
+			j.fetching, j.fetched = done, now
+			j.mu.Unlock()
+			keys, maxAge, err := fetchJWKS(j.url)
+			j.mu.Lock()
+			if err == nil {
+				j.keys, j.expires = keys, j.now().Add(maxAge)
+			}
+			j.fetching = nil
+			close(done)
+			j.mu.Unlock()
+			if err != nil && !known {
+				return nil, err
+			}
+		case j.fetching != nil && !known:
+			// Someone else is fetching; the key may be in what they get
+			wait := j.fetching
+			j.mu.Unlock()
+			<-wait
+		default:
+			j.mu.Unlock()
+			if known {
+				return key, nil
+			}
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+	}
+}
+
+// fetchJWKS gets the RSA keys of the JWK set at url, and how long they
+// may be cached.
+func fetchJWKS(url string) (map[string]*rsa.PublicKey, time.Duration, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("fetching Google certs: %s", resp.Status)
+	}
+	var doc struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, 0, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, cacheMaxAge(resp.Header.Get("Cache-Control")), nil
+}
+
+// cacheMaxAge reads max-age from a Cache-Control header, defaulting to an hour.
+func cacheMaxAge(header string) time.Duration {
+	for _, directive := range strings.Split(header, ",") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(directive), "max-age="); ok {
+			if d, err := time.ParseDuration(v + "s"); err == nil {
+				return d
+			}
+		}
+	}
+	return time.Hour
+}
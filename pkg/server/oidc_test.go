@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeJWKS serves a JWK set of the keys in *kids, all one RSA key, and
+// counts the fetches. A fetch waits for hold to be closed, if set, and
+// fails while *down is set.
+type fakeJWKS struct {
+	kids    []string
+	down    atomic.Bool
+	hold    chan struct{}
+	fetches atomic.Int32
+	key     *rsa.PrivateKey
+}
+
+func newFakeJWKS(t *testing.T, kids ...string) (*fakeJWKS, *jwksCache, *fakeClock) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeJWKS{kids: kids, key: key}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.fetches.Add(1)
+		if f.hold != nil {
+			<-f.hold
+		}
+		if f.down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		type jwk struct{ Kid, N, E string }
+		var doc struct {
+			Keys []jwk `json:"keys"`
+		}
+		for _, kid := range f.kids {
+			doc.Keys = append(doc.Keys, jwk{kid,
+				base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())})
+		}
+		w.Header().Set("Cache-Control", "public, max-age=600")
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(srv.Close)
+	clock := newFakeClock()
+	keys := newJWKSCache(srv.URL)
+	keys.now = clock.now
+	return f, keys, clock
+}
+
+// Unknown key IDs make the cache refetch at most once a minute, and the
+// keys it has keep working in between.
+func TestJWKSUnknownKid(t *testing.T) {
+	f, keys, clock := newFakeJWKS(t, "a")
+	if k, err := keys.get("a"); err != nil || k.N.Cmp(f.key.N) != 0 {
+		t.Fatalf("get(a): %v", err)
+	}
+	for range 5 {
+		if _, err := keys.get("made-up"); err == nil {
+			t.Error("an unknown key id verified")
+		}
+	}
+	if n := f.fetches.Load(); n != 1 {
+		t.Errorf("%d fetches within a minute, want 1", n)
+	}
+
+	// Google rotates in "b": found once the minute is up
+	f.kids = []string{"a", "b"}
+	if _, err := keys.get("b"); err == nil {
+		t.Error("refetched within the minute")
+	}
+	clock.advance(jwksMinRefresh)
+	if _, err := keys.get("b"); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+	if _, err := keys.get("a"); err != nil || f.fetches.Load() != 2 {
+		t.Errorf("get(a) after the rotation: %v, %d fetches", err, f.fetches.Load())
+	}
+}
+
+// Expired keys are refetched, but while that fails they're still served.
+func TestJWKSServesCachedKeys(t *testing.T) {
+	f, keys, clock := newFakeJWKS(t, "a")
+	keys.get("a")
+	clock.advance(11 * time.Minute)
+	f.down.Store(true)
+	for range 3 {
+		if _, err := keys.get("a"); err != nil {
+			t.Fatalf("cached key refused while Google's down: %v", err)
+		}
+	}
+	if n := f.fetches.Load(); n != 2 {
+		t.Errorf("%d fetches, want 2", n)
+	}
+	f.down.Store(false)
+	clock.advance(jwksMinRefresh)
+	keys.get("a")
+	keys.get("a")
+	if n := f.fetches.Load(); n != 3 {
+		t.Errorf("%d fetches once Google's back, want 3", n)
+	}
+}
+
+// Known keys are served without waiting for a fetch in flight.
+func TestJWKSFetchOutsideLock(t *testing.T) {
+	f, keys, clock := newFakeJWKS(t, "a")
+	keys.get("a")
+	clock.advance(11 * time.Minute)
+	f.hold = make(chan struct{})
+	fetched := make(chan error)
+	go func() {
+		_, err := keys.get("a")
+		fetched <- err
+	}()
+	for f.fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := keys.get("a")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("get blocked on the fetch in flight")
+	}
+	close(f.hold)
+	if err := <-fetched; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// sseEvents maps each named event on the build stream to its JSON data type.
+// nil marks events whose data is plain text lines. The names are
+// client.Events; changing an event's fields may need a new streamSchema.
+var sseEvents = map[string]reflect.Type{
+	"session":        reflect.TypeFor[Session](),
+	"job":            reflect.TypeFor[JobStarted](),
+	"status":         reflect.TypeFor[Status](),
+	"step":           reflect.TypeFor[Step](),
+	"progress":       reflect.TypeFor[CompileProgress](),
+	"diagnostic":     reflect.TypeFor[Diagnostic](),
+	"output":         reflect.TypeFor[OutputLine](),
+	"summary":        reflect.TypeFor[BuildSummary](),
+	"matrix_summary": reflect.TypeFor[MatrixSummary](),
+	"dry_run":        reflect.TypeFor[DryRunReport](),
+	"end":            reflect.TypeFor[StreamEnd](),
+	"modules":        reflect.TypeFor[ModuleList](),
+	"report":         nil,
+	"binary_start":   nil,
+}
+
+// eventDescriptions documents the stream beyond the data schemas.
+var eventDescriptions = map[string]string{
+	"message":      "Unnamed data: lines carry billder's messages on the unversioned route, stream schema 1. Versioned routes send them as status events.",
+	"status":       "A message of billder's own about the build, for people. Only status, step, summary and end events come from billder; output is the repository's tools' and may say anything, so clients shouldn't judge the build by it.",
+	"session":      "The first event of every build stream: the build id, the API version, the event stream schema, the limits the build runs under and the request as the server executes it, after defaults.",
+	"end":          "The last event of a stream without an artifact, sent however the build ended. reason is completed, canceled_by_user, timeout, shutdown or error; message says the same for people. A failed build's error_category, also on its summary, is invalid_request, repo_not_found, auth_failed, deps_failed or compile_failed for problems the caller can fix, toolchain_missing, oom or internal for the server's, or timeout, which can be either.",
+	"modules":      "Sent when the repository holds several modules. Without a module_dir naming one of them, and no go.work, the build fails with invalid_request.",
+	"output":       "Lines of compiler output that are neither package progress nor diagnostics, tagged with the pipe they came from. Lines of one stream keep their order; stdout and stderr interleave by time_ms, best effort. ANSI sequences are removed unless the request's color is \"keep\". Output is coalesced into a few events a second, several lines joined by newlines; lines over the server's byte budget are dropped and counted in a \"…dropped N lines…\" line.",
+	"summary":      "The outcome of one target. artifact_url fetches the artifact again from this server, except on servers with an artifact_backend, which upload the artifact and send a presigned storage URL with artifact_sha256 instead. Artifacts too big or too late for the deployment's response limits are uploaded, or kept on the server. Either way delivery is \"stored\": no binary_start follows, the stream ends with end and the client fetches artifact_url.",
+	"report":       "Multi-line text, one data: line per line of the report.",
+	"binary_start": "Data is the artifact file name; sha256: and size: fields before the event line carry its hex digest and length in bytes. The raw artifact bytes follow the blank line and end the stream; fewer than size: bytes means the transfer broke off.",
+}
+
+// schemaOf builds a JSON Schema for t from its exported fields and json tags,
+// registering named structs in components and returning a $ref to them.
+func schemaOf(t reflect.Type, components map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), components)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), components)}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := components[t.Name()]; ok {
+			return ref
+		}
+		components[t.Name()] = nil // placeholder breaks recursion
+		props := map[string]any{}
+		for _, name := range jsonFields(t) {
+			f, _ := t.FieldByName(name.field)
+			props[name.json] = schemaOf(f.Type, components)
+		}
+		components[t.Name()] = map[string]any{"type": "object", "properties": props}
+		return ref
+	}
+	return map[string]any{}
+}
+
+type fieldName struct{ field, json string }
+
+// jsonFields lists t's exported fields as encoding/json names them.
+func jsonFields(t reflect.Type) []fieldName {
+	var names []fieldName
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch tag {
+		case "-":
+			continue
+		case "":
+			tag = f.Name
+		}
+		names = append(names, fieldName{f.Name, tag})
+	}
+	return names
+}
+
+func jsonBody(t reflect.Type, components map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schemaOf(t, components)}}
+}
+
+func jsonResponse(desc string, t reflect.Type, components map[string]any) map[string]any {
+	return map[string]any{"description": desc, "content": jsonBody(t, components)}
+}
+
+// eventsDocument describes each SSE event and its data schema.
+func eventsDocument(components map[string]any) map[string]any {
+	events := map[string]any{}
+	for name, t := range sseEvents {
+		ev := map[string]any{}
+		if t != nil {
+			ev["data"] = schemaOf(t, components)
+		}
+		if d, ok := eventDescriptions[name]; ok {
+			ev["description"] = d
+		}
+		events[name] = ev
+	}
+	events["message"] = map[string]any{"description": eventDescriptions["message"]}
+	return events
+}
+
+// openAPIDocument builds the OpenAPI 3 description of the /v1 API.
+func openAPIDocument() map[string]any {
+	components := map[string]any{}
+	common := map[string]any{
+		"400": jsonResponse("Invalid build request", reflect.TypeFor[PayloadError](), components),
+		"401": map[string]any{"description": "Unauthorized; X-Billder-Auth-Error holds the reason code"},
+	}
+	get := func(summary string, ok map[string]any, params ...map[string]any) map[string]any {
+		op := map[string]any{"summary": summary, "responses": map[string]any{"200": ok, "401": common["401"]}}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		return map[string]any{"get": op}
+	}
+	query := func(name, desc string) map[string]any {
+		return map[string]any{"name": name, "in": "query", "description": desc, "schema": map[string]any{"type": "string"}}
+	}
+	v := "/" + apiVersion
+
+	paths := map[string]any{
+		v + "/build": map[string]any{"post": map[string]any{
+			"summary": "Build a Go repository and stream progress followed by the artifact",
+			"requestBody": map[string]any{"required": true, "content": map[string]any{
+				"application/json": map[string]any{"schema": schemaOf(reflect.TypeFor[RequestPayload](), components)},
+				"multipart/form-data": map[string]any{"schema": map[string]any{"type": "object", "properties": map[string]any{
+					"payload": map[string]any{"type": "string", "description": "RequestPayload JSON"},
+					"profile": map[string]any{"type": "string", "format": "binary", "description": "pprof CPU profile for PGO"},
+				}}},
+			}},
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description":  "Server-sent events; see x-sse-events or /events.json",
+					"content":      map[string]any{"text/event-stream": map[string]any{"schema": map[string]any{"type": "string"}}},
+					"x-sse-events": eventsDocument(components),
+				},
+				"400": common["400"],
+				"401": common["401"],
+				"403": jsonResponse("Priority \"high\" requested without the token grant", reflect.TypeFor[PayloadError](), components),
+				"409": jsonResponse("An identical build is already running", reflect.TypeFor[BuildConflict](), components),
+				"422": jsonResponse("The request exceeds one of the limits in /v1/capabilities, named by limit", reflect.TypeFor[PayloadError](), components),
+			},
+		}},
+		v + "/capabilities":         get("Server version and build features", jsonResponse("Capabilities", reflect.TypeFor[Capabilities](), components)),
+		v + "/capabilities/targets": get("Supported os/arch targets", jsonResponse("Targets", reflect.TypeFor[[]string](), components)),
+		v + "/capabilities/cgo": get("C toolchain headers and pkg-config packages for a target",
+			jsonResponse("Probe result", reflect.TypeFor[CgoProbe](), components), query("target", "os/arch, default windows/amd64")),
+		v + "/latest": get("Artifact of the newest successful single-target build of a repository; ETag is its sha256",
+			map[string]any{
+				"description": "Artifact bytes, typed and named as the build made them; X-Checksum-Sha256 is their digest, and X-Billder-Build-ID, X-Billder-Commit and X-Billder-Build-Time describe the build. 304 for a matching If-None-Match. HEAD returns the headers alone",
+				"content":     map[string]any{"application/octet-stream": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}},
+			},
+			query("repo", "host/owner/name"), query("os", "Target OS"), query("arch", "Target arch, default amd64"),
+			query("ref", "Branch the build checked out, or a commit prefix of at least 7 characters")),
+		v + "/resolve": get("The commit a branch, tag or pull request ref of a repository points at, by git ls-remote; answers are cached for 30 seconds and rate limited per caller",
+			jsonResponse("Resolution; ETag is the commit, so a matching If-None-Match gets a 304 until the ref moves. 404 when the remote lacks the ref, 502 when it can't be reached, 429 past the limit", reflect.TypeFor[Resolution](), components),
+			query("repo", "host/owner/name"), query("ref", "Branch, tag or pull request ref; default HEAD")),
+		v + "/client/latest": get("Version of the client this server hosts, with the sha256 of each platform's binary; 404 when it hosts none",
+			jsonResponse("Client release", reflect.TypeFor[ClientRelease](), components)),
+		v + "/client/latest/{os}/{arch}": get("The hosted client binary for a platform; ETag is its sha256",
+			map[string]any{
+				"description": "Binary bytes; X-Billder-Version is the release version",
+				"content":     map[string]any{"application/octet-stream": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}},
+			},
+			map[string]any{"name": "os", "in": "path", "required": true, "schema": map[string]any{"type": "string"}},
+			map[string]any{"name": "arch", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}),
+		v + "/schedules": get("Configured build schedules with their last and next runs",
+			jsonResponse("Schedules", reflect.TypeFor[[]ScheduleStatus](), components)),
+		v + "/schedules/{name}/run": map[string]any{"post": map[string]any{
+			"summary":    "Start a scheduled build now",
+			"parameters": []any{map[string]any{"name": "name", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+			"responses": map[string]any{
+				"202": jsonResponse("Build started; follow events_url", reflect.TypeFor[JobStarted](), components),
+				"401": common["401"],
+				"404": map[string]any{"description": "No such schedule"},
+				"409": jsonResponse("The schedule's previous run is still going", reflect.TypeFor[BuildConflict](), components),
+			},
+		}},
+		v + "/builds": get("Journaled builds, newest first, with whether each artifact is still stored or was evicted by retention",
+			jsonResponse("Builds", reflect.TypeFor[[]BuildListing](), components),
+			query("repo", "Only builds of this repository, host/owner/name"),
+			query("label", "Only builds with this label, k=v, or k for any value; repeat to require several"), query("limit", "At most this many builds; default 50, max 500")),
+		v + "/stats/repo": get("Build counts, success rate, p50/p90 total and per-step durations, average artifact size and cache hit rate of a repository's finished builds",
+			jsonResponse("Repository statistics", reflect.TypeFor[RepoBuildStats](), components),
+			query("repo", "Repository, host/owner/name; required"), query("days", "Only builds started in the last N days; default 30")),
+		v + "/lookup": get("The build that delivered a file, by its digest. Binaries also carry their origin as JSON, in main.billderOrigin when declared, else after the end of the file",
+			jsonResponse("Lookup", reflect.TypeFor[Lookup](), components),
+			query("sha256", "Hex SHA-256 digest of the file")),
+		v + "/builds/{id}/pin": map[string]any{
+			"post":   pinOp("Exempt a finished build's artifact and log from retention", components, common),
+			"delete": pinOp("Make a pinned build subject to retention again", components, common),
+		},
+		v + "/builds/{id}/cancel": map[string]any{"post": map[string]any{
+			"summary":    "Cancel a running build; its stream ends with an end event of reason canceled_by_user",
+			"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+			"responses": map[string]any{
+				"202": jsonResponse("Cancelling; the build's journal entry", reflect.TypeFor[JobRecord](), components),
+				"401": common["401"],
+				"403": map[string]any{"description": "Neither the admin token nor the credential that started the build"},
+				"404": map[string]any{"description": "No such build"},
+				"409": map[string]any{"description": "The build isn't running on this server"},
+			},
+		}},
+		v + "/builds/{id}": get("Journal entry of a build: running, finished, or interrupted/requeued by a server restart",
+			jsonResponse("Build state", reflect.TypeFor[JobRecord](), components),
+			map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}),
+		v + "/builds/{id}/log": get("Full log of a finished build",
+			map[string]any{"description": "Plain text log", "content": map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}}},
+			map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}},
+			query("tail", "Only return the last N lines, at most 10000")),
+		v + "/builds/{id}/events": get("Replay the buffered events of a running or recently finished build, then follow it live",
+			map[string]any{"description": "Server-sent events with id: fields; the artifact is not replayed", "content": map[string]any{"text/event-stream": map[string]any{"schema": map[string]any{"type": "string"}}}},
+			map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}},
+			map[string]any{"name": "Last-Event-ID", "in": "header", "description": "Resume after this event id", "schema": map[string]any{"type": "integer"}},
+			query("last_event_id", "Same as the Last-Event-ID header")),
+		v + "/builds/{id}/tail": get("Watch a running or recently finished build from another machine: its buffered events, then live ones. Read-only; also served as /jobs/{id}/tail",
+			map[string]any{"description": "Server-sent events from the start of the buffer; the artifact is not sent", "content": map[string]any{"text/event-stream": map[string]any{"schema": map[string]any{"type": "string"}}}},
+			map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}),
+		v + "/builds/{id}/artifact": get("Download the artifact a build delivered; supports Range. 410 once retention evicted it",
+			map[string]any{"description": "Artifact bytes, with the Content-Type and download name the build gave them; X-Checksum-Sha256 is their digest. HEAD returns the headers alone", "content": map[string]any{"application/octet-stream": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}},
+			map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}),
+		v + "/builds/{id}/provenance": get("Signed in-toto/SLSA provenance of the artifact a build delivered, when the server attests builds; the payload is base64 JSON of a provenance statement",
+			jsonResponse("DSSE envelope", reflect.TypeFor[ProvenanceEnvelope](), components),
+			map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}),
+		v + "/builds/{id}/licenses": get("License reports of a license_report build, one per target: the modules compiled in and their licenses, unrecognized ones as \"unknown\"",
+			jsonResponse("License reports; with format=text, THIRD_PARTY_LICENSES.txt of every target", reflect.TypeFor[[]LicenseReport](), components),
+			map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}},
+			query("format", "json (default) or text")),
+		v + "/attestation/publickey": get("The ed25519 key provenance is signed with; needs no token. 404 when the server doesn't attest builds",
+			jsonResponse("Public key", reflect.TypeFor[AttestationKey](), components)),
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": "Billder", "version": apiVersion},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": components,
+			"securitySchemes": map[string]any{
+				"token":  map[string]any{"type": "apiKey", "in": "header", "name": "X-Billder-Token"},
+				"google": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "Google ID token"},
+			},
+		},
+		"security": []any{map[string]any{"token": []string{}}, map[string]any{"google": []string{}}},
+	}
+}
+
+// pinOp documents a method of /v1/builds/{id}/pin.
+func pinOp(summary string, components, common map[string]any) map[string]any {
+	return map[string]any{
+		"summary":    summary,
+		"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+		"responses": map[string]any{
+			"200": jsonResponse("The build's journal entry", reflect.TypeFor[JobRecord](), components),
+			"401": common["401"],
+			"403": map[string]any{"description": "Neither the admin token nor the credential that started the build"},
+			"404": map[string]any{"description": "No such build"},
+			"409": map[string]any{"description": "The build hasn't finished"},
+			"410": map[string]any{"description": "Pinning a build whose artifact was already evicted"},
+		},
+	}
+}
+
+// openAPIHandler serves GET /openapi.json.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPIDocument())
+}
+
+// eventsHandler serves GET /events.json, the build stream's event schemas.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	components := map[string]any{}
+	events := eventsDocument(components)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"events": events, "components": map[string]any{"schemas": components}})
+}
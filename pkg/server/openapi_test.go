@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fill sets every exported field reachable from v to a non-zero value, so
+// that marshaling it shows every field, omitempty or not.
+func fill(v reflect.Value, depth int) {
+	if depth > 6 || !v.CanSet() {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fill(v.Elem(), depth+1)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(`"x"`)) // valid JSON too, for json.RawMessage
+			return
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fill(v.Index(0), depth+1)
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		key, elem := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		fill(key, depth+1)
+		fill(elem, depth+1)
+		m.SetMapIndex(key, elem)
+		v.Set(m)
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				fill(v.Field(i), depth+1)
+			}
+		}
+	}
+}
+
+// marshaledFields are the top-level keys encoding/json writes for a fully
+// populated t.
+func marshaledFields(t *testing.T, typ reflect.Type) []string {
+	t.Helper()
+	v := reflect.New(typ).Elem()
+	fill(v, 0)
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		t.Fatalf("marshaling %s: %v", typ, err)
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil // marshals as something other than an object
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// structTypes collects the named struct types reachable from t by name.
+func structTypes(t reflect.Type, seen map[string]reflect.Type) {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t.Name()] != nil {
+		return
+	}
+	seen[t.Name()] = t
+	for i := range t.NumField() {
+		if t.Field(i).IsExported() {
+			structTypes(t.Field(i).Type, seen)
+		}
+	}
+}
+
+// servedDocument fetches a JSON document from handler h.
+func servedDocument(t *testing.T, h func(w *httptest.ResponseRecorder)) map[string]any {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w)
+	var doc map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// The schemas served at /openapi.json and /events.json must name exactly
+// the fields encoding/json writes for the Go types they describe.
+func TestOpenAPIMatchesStructs(t *testing.T) {
+	openapi := servedDocument(t, func(w *httptest.ResponseRecorder) {
+		openAPIHandler(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	})
+	events := servedDocument(t, func(w *httptest.ResponseRecorder) {
+		eventsHandler(w, httptest.NewRequest("GET", "/events.json", nil))
+	})
+
+	types := map[string]reflect.Type{}
+	for _, typ := range []reflect.Type{
+		reflect.TypeFor[RequestPayload](), reflect.TypeFor[PayloadError](), reflect.TypeFor[Capabilities](),
+		reflect.TypeFor[CgoProbe](), reflect.TypeFor[DryRunReport](), reflect.TypeFor[BuildConflict](), reflect.TypeFor[JobRecord](), reflect.TypeFor[ScheduleStatus](), reflect.TypeFor[ClientRelease](), reflect.TypeFor[BuildListing](),
+		reflect.TypeFor[ProvenanceEnvelope](), reflect.TypeFor[AttestationKey](), reflect.TypeFor[Resolution](), reflect.TypeFor[Lookup](), reflect.TypeFor[RepoBuildStats](),
+	} {
+		structTypes(typ, types)
+	}
+	for _, typ := range sseEvents {
+		if typ != nil {
+			structTypes(typ, types)
+		}
+	}
+
+	for _, doc := range []struct {
+		served   map[string]any
+		required []string
+	}{
+		{openapi, []string{"RequestPayload", "PayloadError", "Capabilities", "JobRecord"}},
+		{events, []string{"Session", "Step", "BuildSummary", "StreamEnd"}},
+	} {
+		schemas := doc.served["components"].(map[string]any)["schemas"].(map[string]any)
+		for _, name := range doc.required {
+			if schemas[name] == nil {
+				t.Errorf("no schema for %s", name)
+			}
+		}
+		for name, schema := range schemas {
+			typ, ok := types[name]
+			if !ok {
+				t.Errorf("schema %s describes no known type", name)
+				continue
+			}
+			want := marshaledFields(t, typ)
+			if want == nil {
+				if props, _ := schema.(map[string]any)["properties"].(map[string]any); len(props) > 0 {
+					t.Errorf("schema %s has properties, but %s doesn't marshal as an object", name, typ)
+				}
+				continue
+			}
+			props, _ := schema.(map[string]any)["properties"].(map[string]any)
+			var got []string
+			for k := range props {
+				got = append(got, k)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				t.Errorf("schema %s has fields\n  %s\nbut %s marshals\n  %s", name, strings.Join(got, ", "), typ, strings.Join(want, ", "))
+			}
+		}
+	}
+}
+
+// Every event documented has a schema or a description, and every event a
+// build can send is documented.
+func TestEventsDocumented(t *testing.T) {
+	events := servedDocument(t, func(w *httptest.ResponseRecorder) {
+		eventsHandler(w, httptest.NewRequest("GET", "/events.json", nil))
+	})["events"].(map[string]any)
+	for name := range sseEvents {
+		ev, ok := events[name].(map[string]any)
+		if !ok {
+			t.Errorf("event %s missing from /events.json", name)
+			continue
+		}
+		if ev["data"] == nil && ev["description"] == nil {
+			t.Errorf("event %s has neither a data schema nor a description", name)
+		}
+	}
+}
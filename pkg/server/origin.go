@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildOrigin identifies the build a binary came from. Every go-built
+// binary carries it as JSON: in main.billderOrigin when the main package
+// declares that string variable, otherwise appended after the end of the
+// file behind originTrailer.
+type BuildOrigin struct {
+	BuildID string    `json:"build_id"`
+	Server  string    `json:"server"` // host name of the instance that built it
+	Commit  string    `json:"commit,omitempty"`
+	BuiltAt time.Time `json:"built_at"`
+}
+
+// originTrailer precedes the origin JSON appended to binaries; a newline
+// ends it.
+const originTrailer = "\nbillder-origin:"
+
+var serverName = sync.OnceValue(func() string {
+	name, _ := os.Hostname()
+	return cmp.Or(name, "unknown")
+})
+
+func (j *buildJob) origin() BuildOrigin {
+	return BuildOrigin{BuildID: j.id, Server: serverName(), Commit: j.vcs.Commit, BuiltAt: j.started.UTC().Truncate(time.Second)}
+}
+
+// ldflags are -X flags setting main.billderBuildID and main.billderOrigin.
+// The linker skips them for packages that don't declare the variables.
+func (o BuildOrigin) ldflags() string {
+	data, _ := json.Marshal(o)
+	return fmt.Sprintf("-X main.billderBuildID=%s -X main.billderOrigin=%s", o.BuildID, data)
+}
+
+// stampOrigins makes every ELF or PE executable among files carry the
+// build's origin, appending it where the -X flags found no variable to
+// set, and records each file's digest for /v1/lookup. Other files, such
+// as APKs and split .debug files, whose debuglink checksum covers every
+// byte, are recorded but left alone.
+func (j *buildJob) stampOrigins(target string, files []zipEntry) {
+	o := j.origin()
+	stamp, _ := json.Marshal(o)
+	for _, f := range files {
+		if f.Path == "" {
+			continue
+		}
+		data, err := os.ReadFile(f.Path)
+		if err != nil {
+			continue
+		}
+		executable := (bytes.HasPrefix(data, []byte("\x7fELF")) || bytes.HasPrefix(data, []byte("MZ"))) && filepath.Ext(f.Path) != ".debug"
+		if executable && !bytes.Contains(data, stamp) {
+			data = fmt.Appendf(data, "%s%s\n", originTrailer, stamp)
+			if err := os.WriteFile(f.Path, data, 0o755); err != nil {
+				log.Printf("Stamp origin into %s: %v", f.Path, err)
+				continue
+			}
+		}
+		sum := sha256.Sum256(data)
+		history.RecordArtifact(hex.EncodeToString(sum[:]), ArtifactOrigin{BuildID: j.id, Name: f.Name, Target: target, At: time.Now()})
+	}
+}
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Lookup is the GET /v1/lookup response.
+type Lookup struct {
+	SHA256 string         `json:"sha256"`
+	Origin ArtifactOrigin `json:"origin"`
+	Build  *JobRecord     `json:"build,omitempty"` // the build's journal entry, while it is kept
+}
+
+// lookupHandler serves GET /v1/lookup?sha256=, the build that delivered a
+// file with that digest. Builds of repositories the caller's token may not
+// build are reported as unknown.
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	sum := strings.ToLower(r.URL.Query().Get("sha256"))
+	if !sha256Pattern.MatchString(sum) {
+		http.Error(w, "sha256 must be a hex SHA-256 digest", http.StatusBadRequest)
+		return
+	}
+	origin, ok := history.Artifact(sum)
+	if !ok {
+		http.Error(w, "No build delivered a file with this digest", http.StatusNotFound)
+		return
+	}
+	res := Lookup{SHA256: sum, Origin: origin}
+	rec, err := loadJob(origin.BuildID)
+	// Without the journal entry the repository is unknown, so restricted tokens learn nothing
+	if t, ok := callerToken(callerID(r)); ok && t.AllowedRepos != nil && (err != nil || !t.permitsRepo(rec.Payload.RepoURL)) {
+		http.Error(w, "No build delivered a file with this digest", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		res.Build = &rec
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
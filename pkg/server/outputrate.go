@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutputRate bounds the "output" events of one build so a noisy compile
+// can't saturate slow clients or crowd the event log. Lines are coalesced
+// into at most EventsPerSec events a second; lines past BytesPerSec in a
+// second are dropped, leaving a marker counting them. Other events are
+// never held back or dropped.
+type OutputRate struct {
+	EventsPerSec int
+	BytesPerSec  int64
+}
+
+const (
+	defaultOutputEvents = 10
+	defaultOutputBytes  = 256 << 10
+)
+
+// outputBatch is the pending output of one target, step and stream.
+type outputBatch struct {
+	OutputLine
+	lines   []string
+	dropped int // lines dropped since the last one kept
+}
+
+// mark ends the batch with a marker for the lines dropped so far.
+func (b *outputBatch) mark() {
+	if b.dropped > 0 {
+		b.lines = append(b.lines, fmt.Sprintf("…dropped %d lines…", b.dropped))
+		b.dropped = 0
+	}
+}
+
+// outputCoalescer applies an OutputRate to the output of one build,
+// handing the events it lets through to send.
+type outputCoalescer struct {
+	mu      sync.Mutex
+	rate    OutputRate
+	send    func(OutputLine)
+	now     func() time.Time // replaced in tests
+	window  time.Time        // start of the current second
+	spent   int64            // bytes kept in it
+	pending []*outputBatch   // in the order their first lines arrived
+	next    time.Time        // when events may be sent again
+	timer   *time.Timer
+}
+
+func newOutputCoalescer(rate OutputRate, send func(OutputLine)) *outputCoalescer {
+	if rate.EventsPerSec <= 0 {
+		rate.EventsPerSec = defaultOutputEvents
+	}
+	if rate.BytesPerSec <= 0 {
+		rate.BytesPerSec = defaultOutputBytes
+	}
+	return &outputCoalescer{rate: rate, send: send, now: time.Now}
+}
+
+// add queues a line, sending what is pending if the rate allows.
+func (c *outputCoalescer) add(o OutputLine) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.Sub(c.window) >= time.Second {
+		c.window, c.spent = now, 0
+	}
+	b := c.batch(o)
+	if c.spent+int64(len(o.Line)) > c.rate.BytesPerSec {
+		b.dropped++
+	} else {
+		c.spent += int64(len(o.Line))
+		b.mark()
+		b.lines = append(b.lines, o.Line)
+	}
+	if !now.Before(c.next) {
+		c.flushLocked(now)
+	} else if c.timer == nil {
+		c.timer = time.AfterFunc(c.next.Sub(now), c.due)
+	}
+}
+
+// due sends what is pending once the rate allows. A timer stopped too late
+// to keep it from running may find it isn't yet time, and waits again.
+func (c *outputCoalescer) due() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if !now.Before(c.next) {
+		c.flushLocked(now)
+	} else if c.timer != nil {
+		c.timer.Reset(c.next.Sub(now))
+	}
+}
+
+// batch is the pending batch o belongs to, started if there is none.
+func (c *outputCoalescer) batch(o OutputLine) *outputBatch {
+	for _, b := range c.pending {
+		if b.Target == o.Target && b.Step == o.Step && b.Stream == o.Stream {
+			return b
+		}
+	}
+	b := &outputBatch{OutputLine: o}
+	c.pending = append(c.pending, b)
+	return b
+}
+
+// flush sends everything pending. The stream calls it before any other
+// event so output stays ahead of the step or summary that follows it.
+func (c *outputCoalescer) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked(c.now())
+}
+
+// flushLocked sends one event per pending batch, each carrying its lines
+// joined by newlines, and holds off the next ones long enough to keep to
+// EventsPerSec.
+func (c *outputCoalescer) flushLocked(now time.Time) {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.pending) == 0 {
+		return
+	}
+	for _, b := range c.pending {
+		b.mark()
+		o := b.OutputLine
+		o.Line = strings.Join(b.lines, "\n")
+		c.send(o)
+	}
+	c.next = now.Add(time.Duration(len(c.pending)) * time.Second / time.Duration(c.rate.EventsPerSec))
+	c.pending = nil
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sentOutput records what a coalescer sends, and when by its clock.
+type sentOutput struct {
+	mu     sync.Mutex
+	clock  *fakeClock
+	events []OutputLine
+	at     []time.Time
+}
+
+func (s *sentOutput) send(o OutputLine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, o)
+	s.at = append(s.at, s.clock.now())
+}
+
+func newTestCoalescer(rate OutputRate) (*outputCoalescer, *sentOutput, *fakeClock) {
+	clock := newFakeClock()
+	sent := &sentOutput{clock: clock}
+	c := newOutputCoalescer(rate, sent.send)
+	c.now = clock.now
+	return c, sent, clock
+}
+
+var droppedMarker = regexp.MustCompile(`^…dropped (\d+) lines…$`)
+
+// flood adds lines of size bytes at perSec lines a second for seconds, then
+// flushes, as the end of a step does. It returns the lines added.
+func flood(c *outputCoalescer, clock *fakeClock, o OutputLine, perSec, seconds, size int) []string {
+	var lines []string
+	for i := range perSec * seconds {
+		o.Line = fmt.Sprintf("%-*d", size, i)
+		lines = append(lines, o.Line)
+		c.add(o)
+		clock.advance(time.Second / time.Duration(perSec))
+	}
+	c.flush()
+	return lines
+}
+
+// A synthetic flood is sent in at most EventsPerSec events a second, keeps
+// at most BytesPerSec bytes of lines a second, and the markers account for
+// every line left out.
+func TestOutputCoalescerFlood(t *testing.T) {
+	for _, tc := range []struct {
+		rate            OutputRate
+		perSec, seconds int
+		size            int
+	}{
+		{OutputRate{EventsPerSec: 10, BytesPerSec: 1000}, 2000, 5, 20},
+		{OutputRate{EventsPerSec: 4, BytesPerSec: 64 << 10}, 5000, 3, 100},
+		{OutputRate{EventsPerSec: 1, BytesPerSec: 50}, 100, 4, 10},
+		{OutputRate{EventsPerSec: 25, BytesPerSec: 1 << 20}, 1000, 2, 80}, // under the byte budget
+	} {
+		t.Run(fmt.Sprintf("%d/s %dB/s", tc.rate.EventsPerSec, tc.rate.BytesPerSec), func(t *testing.T) {
+			c, sent, clock := newTestCoalescer(tc.rate)
+			start := clock.now()
+			lines := flood(c, clock, OutputLine{Stream: "stdout", Step: 3}, tc.perSec, tc.seconds, tc.size)
+
+			perSecond := map[int]int{}
+			var kept []string
+			dropped := 0
+			for i, ev := range sent.events {
+				// The flush after the flood is a step boundary, not the rate's
+				if i < len(sent.events)-1 {
+					perSecond[int(sent.at[i].Sub(start)/time.Second)]++
+				}
+				for _, line := range strings.Split(ev.Line, "\n") {
+					if m := droppedMarker.FindStringSubmatch(line); m != nil {
+						n, _ := strconv.Atoi(m[1])
+						dropped += n
+					} else {
+						kept = append(kept, line)
+					}
+				}
+			}
+			for sec, n := range perSecond {
+				if n > tc.rate.EventsPerSec {
+					t.Errorf("second %d: %d events, want at most %d", sec, n, tc.rate.EventsPerSec)
+				}
+			}
+			if len(kept)+dropped != len(lines) {
+				t.Errorf("%d lines kept and %d counted dropped, of %d", len(kept), dropped, len(lines))
+			}
+			if budget := int(tc.rate.BytesPerSec) / tc.size * tc.seconds; len(kept) > budget {
+				t.Errorf("%d lines kept, over the budget of %d", len(kept), budget)
+			}
+			if tc.rate.BytesPerSec >= int64(tc.perSec*tc.size) && dropped > 0 {
+				t.Errorf("%d lines dropped under the byte budget", dropped)
+			}
+			// Kept lines are in the order they came
+			j := 0
+			for _, line := range kept {
+				for j < len(lines) && lines[j] != line {
+					j++
+				}
+				if j == len(lines) {
+					t.Fatalf("line %q kept out of order", line)
+				}
+			}
+		})
+	}
+}
+
+// Markers are exact: each counts the lines dropped between the lines kept
+// around it.
+func TestOutputCoalescerMarkerPlacement(t *testing.T) {
+	c, sent, clock := newTestCoalescer(OutputRate{EventsPerSec: 1, BytesPerSec: 10})
+	o := OutputLine{Stream: "stderr"}
+	for _, line := range []string{"aaaaa", "bbbbb", "dropped", "dropped", "dropped"} {
+		o.Line = line
+		c.add(o)
+	}
+	clock.advance(time.Second)
+	for _, line := range []string{"ccccc", "dropped-too-long"} {
+		o.Line = line
+		c.add(o)
+	}
+	c.flush()
+	var got []string
+	for _, ev := range sent.events {
+		got = append(got, ev.Line)
+	}
+	want := []string{"aaaaa", "bbbbb\n…dropped 3 lines…\nccccc", "…dropped 1 lines…"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+// Output of different targets, steps and streams is never merged.
+func TestOutputCoalescerKeepsStreamsApart(t *testing.T) {
+	c, sent, _ := newTestCoalescer(OutputRate{EventsPerSec: 1, BytesPerSec: 1 << 20})
+	c.add(OutputLine{Target: "linux/amd64", Step: 3, Stream: "stdout", Line: "first"}) // sent at once
+	for _, o := range []OutputLine{
+		{Target: "linux/amd64", Step: 3, Stream: "stdout", Line: "a1"},
+		{Target: "linux/amd64", Step: 3, Stream: "stderr", Line: "b1"},
+		{Target: "windows/amd64", Step: 3, Stream: "stdout", Line: "c1"},
+		{Target: "linux/amd64", Step: 3, Stream: "stdout", Line: "a2"},
+		{Target: "linux/amd64", Step: 4, Stream: "stdout", Line: "d1"},
+	} {
+		c.add(o)
+	}
+	c.flush()
+	var got []string
+	for _, ev := range sent.events {
+		got = append(got, fmt.Sprintf("%s/%d/%s:%s", ev.Target, ev.Step, ev.Stream, ev.Line))
+	}
+	want := []string{
+		"linux/amd64/3/stdout:first",
+		"linux/amd64/3/stdout:a1\na2",
+		"linux/amd64/3/stderr:b1",
+		"windows/amd64/3/stdout:c1",
+		"linux/amd64/4/stdout:d1",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("sent\n%q\nwant\n%q", got, want)
+	}
+}
+
+// Quiet output passes as it comes, a line an event.
+func TestOutputCoalescerQuietOutput(t *testing.T) {
+	c, sent, clock := newTestCoalescer(OutputRate{EventsPerSec: 10, BytesPerSec: 1000})
+	for i := range 20 {
+		c.add(OutputLine{Stream: "stdout", Line: fmt.Sprint("line ", i)})
+		clock.advance(200 * time.Millisecond)
+	}
+	if len(sent.events) != 20 {
+		t.Fatalf("%d events for 20 spaced out lines", len(sent.events))
+	}
+	for i, ev := range sent.events {
+		if ev.Line != fmt.Sprint("line ", i) {
+			t.Errorf("event %d: %q", i, ev.Line)
+		}
+	}
+}
+
+// A flood of output doesn't hold back or drop the events around it, and
+// reaches the client ahead of the events that follow it.
+func TestOutputFloodKeepsCriticalEvents(t *testing.T) {
+	prev := cfg
+	cfg.OutputRate = OutputRate{EventsPerSec: 2, BytesPerSec: 100}
+	t.Cleanup(func() { cfg = prev })
+
+	w := httptest.NewRecorder()
+	sse := newTestSSE(t, w)
+	ts := &targetStream{sseWriter: sse, target: "linux/amd64"}
+	sse.Event("step", Step{Index: 3, Total: 3, Name: "compile"})
+	for i := range 5000 {
+		ts.Output(3, "stdout", fmt.Sprintf("noise %d", i))
+	}
+	ts.Message("Error: compile failed")
+	sse.Event("summary", BuildSummary{Target: "linux/amd64", Error: "compile failed"})
+	sse.Close(streamEnd(false, FailCompile, nil))
+
+	out := w.Body.String()
+	last := -1
+	for _, ev := range []string{"event: step", "event: output", "…dropped", "Error: compile failed", "event: summary", "event: end"} {
+		i := strings.Index(out, ev)
+		if i <= last {
+			t.Fatalf("%s missing or out of order in\n%.2000s", ev, out)
+		}
+		last = i
+	}
+	if strings.LastIndex(out, "event: output") > strings.Index(out, "Error: compile failed") {
+		t.Error("output sent after the message that followed it")
+	}
+	if n := strings.Count(out, "event: output"); n > 10 {
+		t.Errorf("%d output events for a flood within one second at 2 a second", n)
+	}
+}
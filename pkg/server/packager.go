@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fyneModule is the module path that marks a repository as a Fyne app.
+const fyneModule = "fyne.io/fyne/v2"
+
+var packagers = []string{"go", "fyne"}
+
+var (
+	fyneOnce    sync.Once
+	fyneVersion string
+)
+
+// fyneCLI returns the version of the installed fyne command, or "" if
+// there is none.
+func fyneCLI() string {
+	fyneOnce.Do(func() {
+		// "fyne cli version: v1.6.1"
+		out, err := exec.Command("fyne", "version").Output()
+		if fields := strings.Fields(string(out)); err == nil && len(fields) > 0 {
+			fyneVersion = fields[len(fields)-1]
+		}
+	})
+	return fyneVersion
+}
+
+// installedPackagers maps each packager this server has to its version.
+func installedPackagers() map[string]string {
+	installed := map[string]string{"go": toolchainVersion()}
+	if v := fyneCLI(); v != "" {
+		installed["fyne"] = v
+	}
+	return installed
+}
+
+// usesFyne reports whether the repository's go.mod requires Fyne.
+func usesFyne(repoPath string) bool {
+	data, err := os.ReadFile(filepath.Join(repoPath, "go.mod"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "require" {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 && fields[0] == fyneModule {
+			return true
+		}
+	}
+	return false
+}
+
+// fyneAppDetails reads the name and version from the [Details] table of the
+// repository's FyneApp.toml; fyne package applies the rest of it itself.
+func fyneAppDetails(repoPath string) (name, version string, ok bool) {
+	f, err := os.Open(filepath.Join(repoPath, "FyneApp.toml"))
+	if err != nil {
+		return "", "", false
+	}
+	defer f.Close()
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found || section != "Details" {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(key) {
+		case "Name":
+			name = value
+		case "Version":
+			version = value
+		}
+	}
+	return name, version, true
+}
+
+// choosePackager settles how the targets are built: with fyne package when
+// requested, or when the repository is a Fyne app and nothing in the
+// request needs plain go build; with go build otherwise.
+func (j *buildJob) choosePackager(sse *sseWriter) string {
+	p := j.payload
+	if p.Packager == "go" || p.BuildAllCmds || (p.Packager == "" && !usesFyne(j.moduleDir)) {
+		return "go"
+	}
+	if p.Packager == "" {
+		switch {
+		case fyneCLI() == "":
+			sse.Message("Fyne app detected, but this server has no fyne CLI; building with go build")
+			return "go"
+		case p.StampVCS || j.pgoPath != "" || p.SplitDebug || p.CompilerOptions.set():
+			sse.Message("Fyne app detected, but stamp_vcs, pgo, split_debug and compiler_options need go build; building with go build")
+			return "go"
+		}
+	}
+	msg := "Packaging with fyne " + fyneCLI()
+	if name, version, ok := fyneAppDetails(j.moduleDir); ok {
+		msg += fmt.Sprintf(" using FyneApp.toml (%s %s)", name, version)
+	}
+	sse.Message(msg)
+	return "fyne"
+}
+
+// fynePackageArgs are the arguments to the fyne command for a target.
+func fynePackageArgs(tc Toolchain, p RequestPayload) []string {
+	target := tc.GOOS
+	if tc.GOOS == "android" {
+		target += "/" + tc.GOARCH // one ABI rather than all four
+	}
+	args := []string{"package", "-os", target}
+	if !p.Debug {
+		args = append(args, "-release")
+	}
+	return args
+}
+
+// fynePackaged returns what fyne package produced for goos: the package
+// files in the source directory that weren't in before.
+func fynePackaged(repoPath, goos string, before map[string]bool) (string, error) {
+	ext := map[string]string{"windows": ".exe", "android": ".apk"}[goos]
+	if ext == "" {
+		ext = ".tar.xz"
+	}
+	entries, err := os.ReadDir(repoPath)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ext) && !before[e.Name()] {
+			return filepath.Join(repoPath, e.Name()), nil
+		}
+	}
+	return "", errors.New("fyne package finished without producing a " + ext + " file")
+}
+
+// lastLine is the last non-blank line of output, which is where fyne
+// package says what went wrong.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// dirNames lists the names in dir.
+func dirNames(dir string) map[string]bool {
+	names := map[string]bool{}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	return names
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// applyPatch applies the request's patch to the clone. `git apply --check`
+// runs first so a patch that doesn't fit leaves the tree untouched, and its
+// verbose output, which shows the hunk it was looking for, is streamed as
+// a report.
+// It returns the patch's sha256.
+func (j *buildJob) applyPatch(sse *sseWriter) (string, error) {
+	patch, _ := j.payload.patchBytes() // validated by normalize
+	sum := sha256.Sum256(patch)
+	digest := hex.EncodeToString(sum[:])
+	path := filepath.Join(j.tmpDir, "request.patch")
+	if err := os.WriteFile(path, patch, 0o644); err != nil {
+		return "", failedWith(FailInternal, errors.New("failed to store patch"))
+	}
+
+	check := exec.CommandContext(j.ctx, "git", "apply", "--check", "--verbose", path)
+	check.Dir = j.repoPath
+	out, err := check.CombinedOutput()
+	j.log.Command("", check, out, err)
+	if err != nil {
+		var report []string
+		for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+			if !strings.HasPrefix(line, "Checking patch ") {
+				report = append(report, line)
+			}
+		}
+		sse.Text("report", report)
+		return "", errors.New("patch does not apply to " + shortCommit(j.vcs.Commit))
+	}
+
+	apply := exec.CommandContext(j.ctx, "git", "apply", path)
+	apply.Dir = j.repoPath
+	out, err = apply.CombinedOutput()
+	j.log.Command("", apply, out, err)
+	if err != nil {
+		return "", errors.New("git apply failed: " + strings.TrimSpace(string(out)))
+	}
+	return digest, nil
+}
+
+// shortCommit abbreviates a commit hash for messages.
+func shortCommit(commit string) string {
+	if commit == "" {
+		return "the checked out commit"
+	}
+	return commit[:min(len(commit), 12)]
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Everything billder keeps outside a build's temp dir (logs, journal
+// entries, stored artifacts, mirrors, build caches) is named by storePath,
+// because the names come from repository URLs, artifact names and other
+// strings a caller controls.
+//
+// A plain identifier, lowercase letters, digits, '.', '_' and '-', is its
+// own file name. Anything else becomes a readable stem, '~' and 128 bits of
+// its sha256, keeping a short extension: "github.com/x/y.git" is stored as
+// "github.com-x-y~<hash>.git". Plain names never contain '~' and hashed
+// ones always do, so distinct identifiers never share a name, not even on
+// case-insensitive filesystems, and no name can climb out of its parent.
+const (
+	maxNameLen = 64  // longest plain or readable name component
+	maxPathLen = 259 // Windows MAX_PATH, less the terminating NUL
+	// maxRootLen leaves room under a configured directory for the deepest
+	// path storePath builds: artifacts/<build id>/<hashed name>.
+	maxRootLen = maxPathLen - 100
+)
+
+var (
+	plainName    = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+	nameExt      = regexp.MustCompile(`^\.[a-z0-9]{1,8}$`)
+	unsafeRunes  = regexp.MustCompile(`[^a-z0-9._-]+`)
+	windowsNames = regexp.MustCompile(`^(con|prn|aux|nul|com[0-9]|lpt[0-9])$`)
+)
+
+// fsName maps an identifier to a file name that is safe on every platform
+// billder runs or is developed on, and unique to the identifier.
+func fsName(id string) string {
+	if len(id) <= maxNameLen && plainName.MatchString(id) && !strings.Contains(id, "..") && !strings.HasSuffix(id, ".") {
+		if stem, _, _ := strings.Cut(id, "."); !windowsNames.MatchString(stem) {
+			return id
+		}
+	}
+	return hashedName(id, maxNameLen)
+}
+
+// hashedName is id's readable stem, cut so the name fits in limit,
+// followed by its digest and extension.
+func hashedName(id string, limit int) string {
+	sum := sha256.Sum256([]byte(id))
+	digest := "~" + hex.EncodeToString(sum[:16])
+	ext := strings.ToLower(filepath.Ext(id))
+	if !nameExt.MatchString(ext) {
+		ext = ""
+	}
+	stem := unsafeRunes.ReplaceAllString(strings.ToLower(strings.TrimSuffix(id, filepath.Ext(id))), "-")
+	stem = strings.Trim(strings.ReplaceAll(stem, "..", "-"), ".-")
+	if room := limit - len(digest) - len(ext); len(stem) > room {
+		stem = strings.TrimRight(stem[:max(room, 0)], ".-")
+	}
+	// Windows reserves its device names before any extension: "prn.tar"
+	if first, _, ok := strings.Cut(stem, "."); ok && windowsNames.MatchString(first) {
+		stem = first + "-" + stem[len(first)+1:]
+	}
+	return stem + digest + ext
+}
+
+// storePath is where the identifiers ids live under root, one directory
+// level each. If the path would exceed maxPathLen the last name is cut
+// down to its digest; directories keep their names so every path under
+// them agrees. Validate keeps roots short enough for that to fit.
+func storePath(root string, ids ...string) string {
+	parts := []string{root}
+	for _, id := range ids {
+		parts = append(parts, fsName(id))
+	}
+	path := filepath.Join(parts...)
+	if len(path) <= maxPathLen || len(ids) == 0 {
+		return path
+	}
+	last := ids[len(ids)-1]
+	if short := hashedName(last, 0); len(short) < len(parts[len(parts)-1]) {
+		parts[len(parts)-1] = short
+	}
+	return filepath.Join(parts...)
+}
@@ -0,0 +1,510 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequestPayload is the JSON body of a build request.
+type RequestPayload struct {
+	RepoURL    string `json:"repo_url"`
+	Ref        string `json:"ref"`         // branch, tag, commit or pull/N/head; default branch if empty
+	TargetOS   string `json:"target_os"`   // "linux" or "windows"
+	TargetArch string `json:"target_arch"` // default "amd64"
+	StampVCS   bool   `json:"stamp_vcs"`   // inject commit info via -X ldflags
+	SizeReport bool   `json:"size_report"` // analyze binary size after building
+	Debug      bool   `json:"debug"`       // keep symbols and DWARF (drop -s -w)
+	SplitDebug bool   `json:"split_debug"` // linux only: extract a separate .debug file
+	Zip        bool   `json:"zip"`         // deliver the artifact(s) as a zip archive
+	PGO        string `json:"pgo"`         // "auto" uses the repo's default.pgo; an uploaded profile overrides
+	DryRun     bool   `json:"dry_run"`     // validate and report the plan without building
+	Force      bool   `json:"force"`       // build even if an identical build is running
+
+	ResumePolicy string `json:"resume_policy"` // "restart" reruns the build if the server restarts mid-build
+	Priority     string `json:"priority"`      // "low", "normal" (default) or "high", for waiting on compile slots
+	Patch        string `json:"patch"`         // base64 unified diff applied after cloning
+	Refresh      *bool  `json:"refresh"`       // false builds from the server's git mirror without contacting the remote
+	Cgo          *bool  `json:"cgo"`           // false builds with CGO_ENABLED=0 and needs no C toolchain
+	AVCheck      bool   `json:"av_check"`      // inspect windows binaries for antivirus false positive triggers
+	AVMode       string `json:"av_mode"`       // "advisory" (default) or "enforce", which fails builds with findings
+	Packager     string `json:"packager"`      // "go" or "fyne"; by default Fyne apps are packaged with fyne
+	ModuleDir    string `json:"module_dir"`    // directory of the module to build, for repositories with several
+
+	BuildAllCmds bool   `json:"build_all_cmds"` // build every main package under cmd/ into a zip with manifest.json
+	CmdFailure   string `json:"cmd_failure"`    // "best_effort" (default) delivers the commands that built; "fail_fast" stops at the first failure
+
+	LicenseReport bool `json:"license_report"` // inventory the licenses of the modules compiled in
+
+	CompareRef string `json:"compare_ref"` // also build this ref and report how the binary and its modules differ
+	Deliver    string `json:"deliver"`     // with compare_ref: "primary" (default) or "both", zipped with compare_ref's under compare/
+
+	Color string `json:"color"` // "strip" (default) removes ANSI sequences from forwarded output; "keep" leaves them
+
+	CompilerOptions *CompilerOptions `json:"compiler_options"` // optimizations, inlining and race or memory sanitizer instrumentation
+	Race            bool             `json:"race"`             // shorthand for compiler_options.race
+
+	InitModule bool `json:"init_module"` // build Go code without a go.mod from a synthesized one
+
+	CheckoutMode string   `json:"checkout_mode"` // "clone" (default) or "archive": a tarball from the host's API, without export-ignore paths or .git
+	SparsePaths  []string `json:"sparse_paths"`  // directories to check out of a monorepo, besides the root's files and local module dependencies
+
+	Labels map[string]string `json:"labels,omitempty"` // tags for finding the build later, e.g. {"pr": "1234"}; they don't change it
+
+	Targets     []string `json:"targets"`     // matrix build, e.g. ["linux/amd64", "windows/amd64"]
+	Parallelism int      `json:"parallelism"` // matrix targets built at once
+}
+
+const (
+	defaultParallelism = 2 // matrix targets built at once unless requested otherwise
+	maxParallelism     = 4 // cap on targets of one build compiling at once
+)
+
+const (
+	maxPatch         = 512 << 10               // decoded patch size
+	maxJSONBody      = 4096 + maxPatch*4/3 + 4 // default max_body_bytes, room for a base64 patch
+	maxMultipartBody = 32 << 20                // payload field plus an uploaded profile
+)
+
+// readPayload decodes the build request. Plain requests are a JSON body;
+// multipart requests carry the JSON in a "payload" field and may attach a
+// pprof "profile" file and a raw "patch" diff, which is stored base64
+// encoded in the payload like one sent in JSON. raw is the JSON as sent.
+func readPayload(w http.ResponseWriter, r *http.Request) (payload RequestPayload, raw, profile []byte, err error) {
+	limit := payloadLimits().BodyBytes
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		if raw, err = io.ReadAll(r.Body); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				err = &limitError{Limit: "max_body_bytes", Max: limit}
+			}
+			return payload, nil, nil, err
+		}
+		return payload, raw, nil, decodeStrict(bytes.NewReader(raw), &payload)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMultipartBody)
+	if err := r.ParseMultipartForm(maxMultipartBody); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			err = &limitError{Limit: "max_body_bytes", Max: maxMultipartBody}
+		}
+		return payload, nil, nil, err
+	}
+	raw = []byte(r.FormValue("payload"))
+	if int64(len(raw)) > limit {
+		return payload, raw, nil, &limitError{Limit: "max_body_bytes", Max: limit}
+	}
+	if err := decodeStrict(bytes.NewReader(raw), &payload); err != nil {
+		return payload, raw, nil, err
+	}
+	if patch, _, err := r.FormFile("patch"); err == nil {
+		data, err := io.ReadAll(io.LimitReader(patch, maxPatch+1))
+		patch.Close()
+		if err != nil {
+			return payload, raw, nil, err
+		}
+		payload.Patch = base64.StdEncoding.EncodeToString(data)
+	}
+	file, _, err := r.FormFile("profile")
+	if err == http.ErrMissingFile {
+		return payload, raw, nil, nil
+	} else if err != nil {
+		return payload, raw, nil, err
+	}
+	defer file.Close()
+	profile, err = io.ReadAll(file)
+	return payload, raw, profile, err
+}
+
+// bodyDeadline limits reading the request body to cfg.BodyTimeout, so a
+// client trickling it in can't hold the handler. The returned func lifts
+// the limit once the body is read.
+func bodyDeadline(w http.ResponseWriter) func() {
+	if cfg.BodyTimeout <= 0 {
+		return func() {}
+	}
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(cfg.BodyTimeout))
+	return func() { rc.SetReadDeadline(time.Time{}) }
+}
+
+// bodyTimedOut responds 408 and counts the dropped client if err is the
+// body deadline expiring.
+func bodyTimedOut(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	metrics.connectionDropped("body_timeout")
+	log.Printf("Request body from %s not received within %s", clientIP(r), cfg.BodyTimeout)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusRequestTimeout)
+	json.NewEncoder(w).Encode(PayloadError{
+		Error:  "request body too slow",
+		Errors: []string{fmt.Sprintf("the request body must arrive within %s", cfg.BodyTimeout)},
+	})
+	return true
+}
+
+// decodeStrict decodes JSON, rejecting fields RequestPayload doesn't know so
+// typos like "target_oss" fail loudly instead of falling back to defaults.
+func decodeStrict(r io.Reader, v any) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// acceptedFields lists the JSON names of RequestPayload's fields.
+func acceptedFields() []string {
+	t := reflect.TypeFor[RequestPayload]()
+	fields := make([]string, 0, t.NumField())
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// validationError collects every problem found in a payload.
+type validationError []string
+
+func (v validationError) Error() string {
+	return strings.Join(v, "; ")
+}
+
+// PayloadError is the JSON body of a 400, 403 or 422 response.
+type PayloadError struct {
+	Error          string          `json:"error"`
+	Category       FailureCategory `json:"error_category,omitempty"`
+	Errors         []string        `json:"errors"`
+	Field          string          `json:"field,omitempty"`           // offending field for decode errors
+	AcceptedFields []string        `json:"accepted_fields,omitempty"` // set for unknown fields
+	Limit          string          `json:"limit,omitempty"`           // 422: the PayloadLimits key exceeded
+}
+
+// writePayloadError responds 400 with a PayloadError describing err, which
+// comes from readPayload or normalize, or 422 when err is a limitError.
+func writePayloadError(w http.ResponseWriter, err error) {
+	body := PayloadError{Error: "invalid build request", Category: FailInvalidRequest}
+	metrics.buildFailed(FailInvalidRequest)
+	status := http.StatusBadRequest
+	var problems validationError
+	var typeErr *json.UnmarshalTypeError
+	var maxErr *http.MaxBytesError
+	var limitErr *limitError
+	switch {
+	case errors.As(err, &limitErr):
+		status = http.StatusUnprocessableEntity
+		body.Error = "request exceeds " + limitErr.Limit
+		body.Errors, body.Field, body.Limit = []string{limitErr.Error()}, limitErr.Field, limitErr.Limit
+	case errors.As(err, &problems):
+		body.Errors = problems
+	case errors.As(err, &typeErr):
+		body.Field = typeErr.Field
+		body.Errors = []string{fmt.Sprintf("field %q must be a %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)}
+	case errors.As(err, &maxErr):
+		body.Errors = []string{fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit)}
+	default:
+		msg := strings.TrimPrefix(err.Error(), "json: ")
+		if quoted, ok := strings.CutPrefix(msg, "unknown field "); ok {
+			body.Field, _ = strconv.Unquote(quoted)
+			body.AcceptedFields = acceptedFields()
+		}
+		body.Errors = []string{msg}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeRestricted responds 403 to a request using field, which the caller's
+// token doesn't permit.
+func writeRestricted(w http.ResponseWriter, field, problem string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(PayloadError{
+		Error:  field + " not permitted",
+		Errors: []string{problem},
+		Field:  field,
+	})
+}
+
+var repoPattern = regexp.MustCompile(`^[A-Za-z0-9.-]+(:[0-9]+)?(/[A-Za-z0-9._~-]+)+$`)
+
+// normalize applies defaults, canonicalizes the repository URL and rejects
+// invalid option combinations. hasProfile reports whether a PGO profile was
+// uploaded. All problems are reported together as a validationError.
+func (p *RequestPayload) normalize(hasProfile bool) error {
+	if err := p.checkLimits(); err != nil {
+		return err
+	}
+	var problems validationError
+	if p.TargetArch == "" {
+		p.TargetArch = defaultArch(p.TargetOS)
+	}
+
+	repo := canonicalRepo(p.RepoURL)
+	if !repoPattern.MatchString(repo) {
+		problems = append(problems, fmt.Sprintf("invalid repository %q, expected host/owner/name", p.RepoURL))
+	}
+	p.RepoURL = repo
+
+	if len(p.Targets) == 0 {
+		p.Targets = []string{p.TargetOS + "/" + p.TargetArch}
+	}
+	seen := make(map[string]bool)
+	for i, t := range p.Targets {
+		goos, goarch, _ := strings.Cut(t, "/")
+		if goarch == "" {
+			goarch = defaultArch(goos)
+		}
+		t = goos + "/" + goarch
+		if _, err := toolchainFor(goos, goarch); err != nil {
+			problems = append(problems, err.Error())
+		} else if supported := currentPolicy().targets; !slices.Contains(supported, t) {
+			problems = append(problems, fmt.Sprintf("unsupported target %s. Supported targets: %s", t, strings.Join(supported, ", ")))
+		} else if tc, _ := toolchainFor(goos, goarch); t == "windows/arm64" && p.cgo() && !tc.installed() {
+			problems = append(problems, fmt.Sprintf("cgo builds for windows/arm64 need the llvm-mingw toolchain (%s), which this server lacks; set \"cgo\": false (client --cgo=false) to build without C code", tc.CC))
+		} else if reason := selfTestFailure(t, false); reason != "" {
+			problems = append(problems, fmt.Sprintf("target %s failed this server's self-test: %s", t, reason))
+		} else if reason := selfTestFailure(t, true); reason != "" && p.cgo() {
+			problems = append(problems, fmt.Sprintf("cgo builds for %s failed this server's self-test: %s; set \"cgo\": false (client --cgo=false) to build without C code", t, reason))
+		} else if goos == "android" && !android.Installed {
+			problems = append(problems, fmt.Sprintf("android toolchain not installed on this server (missing %s)", strings.Join(android.Missing, ", ")))
+		}
+		if goos == "android" && (p.Packager == "go" || p.StampVCS || p.PGO != "" || hasProfile || p.CompilerOptions.set()) {
+			problems = append(problems, "android targets are packaged with fyne or gomobile, which can't be combined with packager \"go\", stamp_vcs, pgo or compiler_options")
+		}
+		if seen[t] {
+			problems = append(problems, fmt.Sprintf("target %s listed twice", t))
+			continue
+		}
+		seen[t] = true
+		p.Targets[i] = t
+		if p.SplitDebug && goos != "linux" {
+			problems = append(problems, fmt.Sprintf("split_debug is only supported for linux targets, not %s", t))
+		}
+	}
+	if !p.Matrix() {
+		p.TargetOS, p.TargetArch, _ = strings.Cut(p.Targets[0], "/")
+	}
+	if p.SplitDebug {
+		p.Debug = true
+	}
+	switch p.AVMode {
+	case "", "advisory":
+	case "enforce":
+		p.AVCheck = true
+	default:
+		problems = append(problems, fmt.Sprintf("av_mode must be \"advisory\" or \"enforce\", got %q", p.AVMode))
+	}
+	if p.AVCheck && !slices.ContainsFunc(p.Targets, func(t string) bool { return strings.HasPrefix(t, "windows/") }) {
+		problems = append(problems, "av_check inspects windows binaries, but no windows target was requested")
+	}
+	if p.Parallelism < 0 {
+		problems = append(problems, "parallelism must not be negative")
+	} else if p.Parallelism == 0 {
+		p.Parallelism = defaultParallelism
+	}
+	p.Parallelism = max(1, min(p.Parallelism, maxParallelism))
+	if p.PGO != "" && p.PGO != "auto" {
+		problems = append(problems, "pgo must be \"auto\" or omitted when uploading a profile")
+	}
+	if (p.PGO == "auto" || hasProfile) && toolchainMinor() < minPGOMinor {
+		problems = append(problems, fmt.Sprintf("PGO requires go1.%d or newer; this server has %s", minPGOMinor, toolchainVersion()))
+	}
+	if p.Priority == "" {
+		p.Priority = "normal"
+	} else if !slices.Contains(priorities, p.Priority) {
+		problems = append(problems, fmt.Sprintf("priority must be one of %s, got %q", strings.Join(priorities, ", "), p.Priority))
+	}
+	if !p.refreshes() && cfg.MirrorDir == "" {
+		problems = append(problems, "refresh: false needs git mirrors, which this server doesn't keep")
+	}
+	if p.Ref != "" && !validRef(p.Ref) {
+		problems = append(problems, fmt.Sprintf("invalid ref %q", p.Ref))
+	}
+	if p.Patch != "" {
+		if patch, err := p.patchBytes(); err != nil {
+			problems = append(problems, "patch must be base64 encoded")
+		} else if len(patch) > maxPatch {
+			problems = append(problems, fmt.Sprintf("patch exceeds %d bytes", maxPatch))
+		}
+	}
+	switch p.Packager {
+	case "", "go":
+	case "fyne":
+		if fyneCLI() == "" {
+			problems = append(problems, "packager \"fyne\" needs the fyne CLI, which this server lacks")
+		}
+		if p.StampVCS || p.PGO != "" || hasProfile || p.SplitDebug {
+			problems = append(problems, "packager \"fyne\" can't be combined with stamp_vcs, pgo or split_debug")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("packager must be one of %s, got %q", strings.Join(packagers, ", "), p.Packager))
+	}
+	if p.ModuleDir != "" {
+		dir := path.Clean(p.ModuleDir)
+		if path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../") || strings.Contains(dir, `\`) {
+			problems = append(problems, fmt.Sprintf("module_dir must be a directory inside the repository, got %q", p.ModuleDir))
+		} else {
+			p.ModuleDir = dir
+		}
+	}
+	switch p.CmdFailure {
+	case "", "best_effort", "fail_fast":
+		if p.CmdFailure != "" && !p.BuildAllCmds {
+			problems = append(problems, "cmd_failure only applies with build_all_cmds")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("cmd_failure must be \"best_effort\" or \"fail_fast\", got %q", p.CmdFailure))
+	}
+	if p.BuildAllCmds {
+		if p.Packager == "fyne" || p.SplitDebug || p.SizeReport || p.AVCheck {
+			problems = append(problems, "build_all_cmds builds plain go binaries and can't be combined with packager \"fyne\", split_debug, size_report or av_check")
+		}
+		if slices.ContainsFunc(p.Targets, func(t string) bool { return strings.HasPrefix(t, "android/") }) {
+			problems = append(problems, "build_all_cmds can't build android targets, which are packaged as one APK")
+		}
+	}
+	if p.CompareRef != "" {
+		if !validRef(p.CompareRef) {
+			problems = append(problems, fmt.Sprintf("invalid compare_ref %q", p.CompareRef))
+		}
+		if p.Matrix() || p.BuildAllCmds || p.Packager == "fyne" || strings.HasPrefix(p.Targets[0], "android/") {
+			problems = append(problems, "compare_ref compares one go build binary and can't be combined with several targets, build_all_cmds, packager \"fyne\" or android targets")
+		}
+	}
+	switch p.Deliver {
+	case "", "primary":
+	case "both":
+		if p.CompareRef == "" {
+			problems = append(problems, "deliver \"both\" needs compare_ref")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("deliver must be \"primary\" or \"both\", got %q", p.Deliver))
+	}
+	if p.Race {
+		opts := CompilerOptions{}
+		if p.CompilerOptions != nil {
+			opts = *p.CompilerOptions
+		}
+		opts.Race, p.CompilerOptions, p.Race = true, &opts, false
+	}
+	problems = append(problems, p.CompilerOptions.problems(p)...)
+	problems = append(problems, p.labelProblems()...)
+	problems = append(problems, p.sparseProblems()...)
+	switch p.Color {
+	case "", "strip", "keep":
+	default:
+		problems = append(problems, fmt.Sprintf("color must be \"strip\" or \"keep\", got %q", p.Color))
+	}
+	switch p.CheckoutMode {
+	case "", "clone":
+	case "archive":
+		if p.CompareRef != "" || !p.refreshes() {
+			problems = append(problems, "checkout_mode \"archive\" has no git history, so it can't be combined with compare_ref or refresh: false")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("checkout_mode must be \"clone\" or \"archive\", got %q", p.CheckoutMode))
+	}
+	switch p.ResumePolicy {
+	case "", "none":
+	case "restart":
+		if hasProfile {
+			problems = append(problems, "resume_policy \"restart\" can't be combined with an uploaded profile, which isn't kept")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("resume_policy must be \"none\" or \"restart\", got %q", p.ResumePolicy))
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// defaultArch is the architecture built when a request names only the OS.
+func defaultArch(goos string) string {
+	if goos == "android" {
+		return "arm64"
+	}
+	return "amd64"
+}
+
+// canonicalRepo reduces a repository URL to host/owner/name. SSH forms
+// (git@host:owner/name, ssh://git@host/owner/name) name the same repository,
+// which is still cloned over HTTP(S).
+func canonicalRepo(url string) string {
+	repo := strings.TrimSpace(url)
+	repo = strings.TrimPrefix(repo, "https://")
+	repo = strings.TrimPrefix(repo, "http://")
+	if rest, ok := strings.CutPrefix(repo, "ssh://"); ok {
+		_, rest, _ = strings.Cut(rest, "@")
+		host, path, _ := strings.Cut(rest, "/")
+		host, _, _ = strings.Cut(host, ":") // the SSH port isn't the web one
+		repo = host + "/" + path
+	} else if rest, ok := strings.CutPrefix(repo, "git@"); ok {
+		repo = strings.Replace(rest, ":", "/", 1)
+	}
+	host, path, _ := strings.Cut(repo, "/")
+	repo = strings.ToLower(host) + "/" + path
+	return strings.TrimSuffix(strings.TrimSuffix(repo, "/"), ".git")
+}
+
+// patchBytes decodes the patch.
+func (p RequestPayload) patchBytes() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(p.Patch)
+}
+
+// cgo reports whether the build links C code; unset means it does.
+func (p RequestPayload) cgo() bool {
+	return p.Cgo == nil || *p.Cgo
+}
+
+// refreshes reports whether the build may fetch from the remote; unset
+// means it does.
+func (p RequestPayload) refreshes() bool {
+	return p.Refresh == nil || *p.Refresh
+}
+
+// Matrix reports whether the request builds more than one target.
+func (p RequestPayload) Matrix() bool {
+	return len(p.Targets) > 1
+}
+
+// CloneURL is the URL handed to git clone.
+func (p RequestPayload) CloneURL() string {
+	return hostFor(p.RepoURL).scheme + "://" + p.RepoURL
+}
+
+// ldflags returns the linker flags for this request.
+func (p RequestPayload) ldflags(goos string, vcs VCSInfo) string {
+	var parts []string
+	// Race reports need symbols for their stack traces
+	if !p.Debug && !p.CompilerOptions.race() {
+		parts = append(parts, "-s", "-w")
+	}
+	if goos == "windows" {
+		// -H=windowsgui hides the console window on Windows
+		parts = append(parts, "-H=windowsgui")
+	}
+	if p.StampVCS && vcs.Commit != "" {
+		parts = append(parts, vcs.ldflags())
+	}
+	return strings.Join(parts, " ")
+}
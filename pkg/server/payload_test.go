@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// checkPayload reads and validates body the way buildHandler does,
+// returning the error response, or nil when the payload is valid.
+func checkPayload(t *testing.T, body string) (int, *PayloadError) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/build", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	payload, _, profile, err := readPayload(w, r)
+	if err == nil {
+		err = payload.normalize(profile != nil)
+	}
+	if err == nil {
+		return http.StatusOK, nil
+	}
+	writePayloadError(w, err)
+	var perr PayloadError
+	if err := json.Unmarshal(w.Body.Bytes(), &perr); err != nil {
+		t.Fatalf("error body %q: %v", w.Body, err)
+	}
+	return w.Code, &perr
+}
+
+func TestMalformedPayloads(t *testing.T) {
+	usePolicy(t)
+	tests := []struct {
+		name     string
+		body     string
+		field    string   // PayloadError.Field
+		problems []string // each must appear in one of the errors, in order
+	}{
+		{"typo in a field name", `{"repo_url": "github.com/acme/app", "target_oss": "linux"}`, "target_oss", []string{`unknown field "target_oss"`}},
+		{"string for a bool", `{"repo_url": "github.com/acme/app", "target_os": "linux", "zip": "yes"}`, "zip", []string{`"zip" must be a bool`}},
+		{"number for a string", `{"repo_url": "github.com/acme/app", "target_os": 5}`, "target_os", []string{`"target_os" must be a string`}},
+		{"string for a list", `{"repo_url": "github.com/acme/app", "targets": "linux/amd64"}`, "targets", []string{`"targets" must be a []string`}},
+		{"truncated JSON", `{"repo_url": "github.com/acme/app"`, "", []string{"unexpected EOF"}},
+		{"empty body", ``, "", []string{"EOF"}},
+		{"not a repository", `{"repo_url": "acme app", "target_os": "linux"}`, "", []string{`invalid repository "acme app"`}},
+		{"unknown target", `{"repo_url": "github.com/acme/app", "targets": ["plan9/amd64"]}`, "", []string{"plan9"}},
+		{"target listed twice", `{"repo_url": "github.com/acme/app", "targets": ["linux/amd64", "linux"]}`, "", []string{"target linux/amd64 listed twice"}},
+		{"split_debug on windows", `{"repo_url": "github.com/acme/app", "target_os": "windows", "split_debug": true}`, "", []string{"split_debug is only supported for linux targets"}},
+		{"ref escaping", `{"repo_url": "github.com/acme/app", "target_os": "linux", "ref": "../../etc"}`, "", []string{`invalid ref "../../etc"`}},
+		{"patch not base64", `{"repo_url": "github.com/acme/app", "target_os": "linux", "patch": "--- a/x"}`, "", []string{"patch must be base64 encoded"}},
+		{"module_dir outside", `{"repo_url": "github.com/acme/app", "target_os": "linux", "module_dir": "../other"}`, "", []string{`module_dir must be a directory inside the repository, got "../other"`}},
+		{
+			"every bad enum at once",
+			`{"repo_url": "github.com/acme/app", "target_os": "linux", "av_mode": "strict", "priority": "urgent", "packager": "make", "color": "rainbow", "checkout_mode": "svn"}`,
+			"",
+			[]string{`av_mode must be "advisory" or "enforce", got "strict"`, `priority must be one of low, normal, high, got "urgent"`, `packager must be one of`, `color must be "strip" or "keep", got "rainbow"`, `checkout_mode must be "clone" or "archive", got "svn"`},
+		},
+		{
+			"options that don't combine",
+			`{"repo_url": "github.com/acme/app", "target_os": "linux", "parallelism": -1, "cmd_failure": "fail_fast", "deliver": "both", "av_check": true}`,
+			"",
+			[]string{"av_check inspects windows binaries", "parallelism must not be negative", "cmd_failure only applies with build_all_cmds", `deliver "both" needs compare_ref`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, perr := checkPayload(t, tt.body)
+			if status != http.StatusBadRequest {
+				t.Fatalf("status %d, want 400", status)
+			}
+			if perr.Error != "invalid build request" || perr.Category != FailInvalidRequest {
+				t.Errorf("error %q (%s), want an invalid build request", perr.Error, perr.Category)
+			}
+			if perr.Field != tt.field {
+				t.Errorf("field %q, want %q", perr.Field, tt.field)
+			}
+			if len(perr.Errors) != len(tt.problems) {
+				t.Fatalf("errors %q, want %d of them", perr.Errors, len(tt.problems))
+			}
+			for i, want := range tt.problems {
+				if !strings.Contains(perr.Errors[i], want) {
+					t.Errorf("error %d is %q, want it to mention %q", i, perr.Errors[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnknownFieldListsAcceptedFields(t *testing.T) {
+	usePolicy(t)
+	_, perr := checkPayload(t, `{"repo_url": "github.com/acme/app", "target_oss": "linux"}`)
+	if perr == nil {
+		t.Fatal("payload with an unknown field was accepted")
+	}
+	if !slices.Equal(perr.AcceptedFields, acceptedFields()) {
+		t.Errorf("accepted fields %q, want %q", perr.AcceptedFields, acceptedFields())
+	}
+	if !slices.Contains(perr.AcceptedFields, "target_os") || slices.Contains(perr.AcceptedFields, "") {
+		t.Errorf("accepted fields %q should name every JSON field", perr.AcceptedFields)
+	}
+}
+
+func TestValidPayloadNormalizes(t *testing.T) {
+	usePolicy(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/build", strings.NewReader(`{"repo_url": "https://GitHub.com/acme/app.git", "target_os": "windows"}`))
+	p, _, _, err := readPayload(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.normalize(false); err != nil {
+		t.Fatal(err)
+	}
+	if p.RepoURL != "github.com/acme/app" || !slices.Equal(p.Targets, []string{"windows/amd64"}) || p.Priority != "normal" || p.Parallelism != defaultParallelism {
+		t.Errorf("normalized to %+v", p)
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import "fmt"
+
+// PayloadLimits cap how much one build request may ask for, so a hostile
+// request can't make validation or the go command lines it leads to
+// arbitrarily large. They are reported in /v1/capabilities; a request over
+// one is refused with 422 naming it.
+type PayloadLimits struct {
+	Targets     int   `json:"max_targets"`      // entries of targets
+	BodyBytes   int64 `json:"max_body_bytes"`   // a JSON request body, or the payload field of a multipart one
+	Labels      int   `json:"max_labels"`       // entries of labels
+	SparsePaths int   `json:"max_sparse_paths"` // entries of sparse_paths
+}
+
+const (
+	defaultMaxTargets = 6
+	maxMaxTargets     = 64       // the most max_targets may be raised to
+	minMaxBody        = 64 << 10 // the least max_body_kb may be lowered to
+	maxMaxBody        = 8 << 20  // and the most it may be raised to; uploaded profiles count separately
+)
+
+// payloadLimits are the configured limits, defaults filled in.
+func payloadLimits() PayloadLimits {
+	l := cfg.PayloadLimits
+	if l.Targets <= 0 {
+		l.Targets = defaultMaxTargets
+	}
+	if l.BodyBytes <= 0 {
+		l.BodyBytes = maxJSONBody
+	}
+	if l.Labels <= 0 {
+		l.Labels = maxLabels
+	}
+	if l.SparsePaths <= 0 {
+		l.SparsePaths = maxSparsePaths
+	}
+	return l
+}
+
+// limitError is a request over one of the PayloadLimits.
+type limitError struct {
+	Limit string // its key in PayloadLimits' JSON, e.g. max_targets
+	Field string // the request field that exceeded it; "" for the body
+	Max   int64
+	Got   int64
+}
+
+func (e *limitError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("request body exceeds %s (%d bytes)", e.Limit, e.Max)
+	}
+	return fmt.Sprintf("%s has %d entries, over %s (%d)", e.Field, e.Got, e.Limit, e.Max)
+}
+
+// checkLimits reports the first of the PayloadLimits p exceeds. It runs
+// before anything else looks at the request's lists.
+func (p *RequestPayload) checkLimits() error {
+	l := payloadLimits()
+	if n := len(p.Targets); n > l.Targets {
+		return &limitError{Limit: "max_targets", Field: "targets", Max: int64(l.Targets), Got: int64(n)}
+	}
+	if n := len(p.Labels); n > l.Labels {
+		return &limitError{Limit: "max_labels", Field: "labels", Max: int64(l.Labels), Got: int64(n)}
+	}
+	if n := len(p.SparsePaths); n > l.SparsePaths {
+		return &limitError{Limit: "max_sparse_paths", Field: "sparse_paths", Max: int64(l.SparsePaths), Got: int64(n)}
+	}
+	return nil
+}
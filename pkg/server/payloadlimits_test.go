@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useLimits configures limits for the length of the test.
+func useLimits(t *testing.T, limits PayloadLimits) {
+	t.Helper()
+	prev := cfg.PayloadLimits
+	cfg.PayloadLimits = limits
+	t.Cleanup(func() { cfg.PayloadLimits = prev })
+}
+
+// request is a JSON build request for the targets and n labels.
+func request(targets []string, labels int) string {
+	l := map[string]string{}
+	for i := range labels {
+		l[fmt.Sprintf("label-%d", i)] = "x"
+	}
+	data, _ := json.Marshal(map[string]any{"repo_url": "github.com/acme/app", "targets": targets, "labels": l, "cgo": false})
+	return string(data)
+}
+
+// padded is body with trailing whitespace to make it size bytes.
+func padded(body string, size int64) string {
+	return body + strings.Repeat(" ", int(size)-len(body))
+}
+
+// checkMultipart is checkPayload for a multipart request with body as
+// its payload field.
+func checkMultipart(t *testing.T, body string) (int, *PayloadError) {
+	t.Helper()
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("payload", body)
+	mw.Close()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/build", &form)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	payload, _, profile, err := readPayload(w, r)
+	if err == nil {
+		err = payload.normalize(profile != nil)
+	}
+	if err == nil {
+		return http.StatusOK, nil
+	}
+	writePayloadError(w, err)
+	var perr PayloadError
+	if err := json.Unmarshal(w.Body.Bytes(), &perr); err != nil {
+		t.Fatalf("error body %q: %v", w.Body, err)
+	}
+	return w.Code, &perr
+}
+
+// Each limit lets a request at it through and refuses one just over it
+// with 422 naming the limit.
+func TestPayloadLimitBoundaries(t *testing.T) {
+	usePolicy(t)
+	useLimits(t, PayloadLimits{Targets: 3, BodyBytes: 64 << 10, Labels: 4, SparsePaths: 2})
+	targets := []string{"linux/amd64", "windows/amd64", "windows/arm64"}
+	base := request(targets[:1], 0)
+	sparse := func(paths string) string {
+		return `{"repo_url": "github.com/acme/app", "targets": ["linux/amd64"], "cgo": false, "sparse_paths": [` + paths + `]}`
+	}
+	for _, tc := range []struct {
+		name  string
+		check func(*testing.T, string) (int, *PayloadError)
+		body  string
+		limit string // "" if the request is valid
+		field string
+	}{
+		{"targets at the limit", checkPayload, request(targets, 0), "", ""},
+		{"targets over the limit", checkPayload, request(append(targets, "linux/amd64"), 0), "max_targets", "targets"},
+		{"labels at the limit", checkPayload, request(targets[:1], 4), "", ""},
+		{"labels over the limit", checkPayload, request(targets[:1], 5), "max_labels", "labels"},
+		{"sparse paths at the limit", checkPayload, sparse(`"a", "b"`), "", ""},
+		{"sparse paths over the limit", checkPayload, sparse(`"a", "b", "c"`), "max_sparse_paths", "sparse_paths"},
+		{"body at the limit", checkPayload, padded(base, 64<<10), "", ""},
+		{"body over the limit", checkPayload, padded(base, 64<<10+1), "max_body_bytes", ""},
+		{"payload field at the limit", checkMultipart, padded(base, 64<<10), "", ""},
+		{"payload field over the limit", checkMultipart, padded(base, 64<<10+1), "max_body_bytes", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, perr := tc.check(t, tc.body)
+			if tc.limit == "" {
+				if code != http.StatusOK {
+					t.Fatalf("refused with %d: %+v", code, perr)
+				}
+				return
+			}
+			if code != http.StatusUnprocessableEntity || perr.Limit != tc.limit || perr.Field != tc.field || perr.Category != FailInvalidRequest {
+				t.Errorf("got %d %+v, want 422 over %s on %q", code, perr, tc.limit, tc.field)
+			}
+		})
+	}
+}
+
+// A multipart request too large as a whole is refused like a JSON body
+// over max_body_bytes, naming the multipart limit.
+func TestMultipartBodyLimit(t *testing.T) {
+	usePolicy(t)
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("payload", request([]string{"linux/amd64"}, 0))
+	profile, _ := mw.CreateFormFile("profile", "default.pgo")
+	profile.Write(make([]byte, maxMultipartBody))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/v1/build", &form)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	_, _, _, err := readPayload(w, r)
+	writePayloadError(w, err)
+	var perr PayloadError
+	json.Unmarshal(w.Body.Bytes(), &perr)
+	if w.Code != http.StatusUnprocessableEntity || perr.Limit != "max_body_bytes" || !strings.Contains(perr.Errors[0], fmt.Sprint(maxMultipartBody)) {
+		t.Errorf("got %d %+v, want 422 over max_body_bytes of %d", w.Code, perr, maxMultipartBody)
+	}
+}
+
+// Unconfigured, the limits are the defaults, enforced the same way. The
+// built-in targets are too few to fill max_targets, so those requests
+// are checked for the limit alone.
+func TestPayloadLimitDefaults(t *testing.T) {
+	usePolicy(t)
+	useLimits(t, PayloadLimits{})
+	if l := payloadLimits(); l != (PayloadLimits{Targets: defaultMaxTargets, BodyBytes: maxJSONBody, Labels: maxLabels, SparsePaths: maxSparsePaths}) {
+		t.Fatalf("default limits %+v", l)
+	}
+	for n, over := range map[int]bool{defaultMaxTargets: false, defaultMaxTargets + 1: true} {
+		p := RequestPayload{Targets: make([]string, n)}
+		if err := p.checkLimits(); (err != nil) != over {
+			t.Errorf("%d targets: %v", n, err)
+		}
+	}
+	for n, over := range map[int]bool{maxLabels: false, maxLabels + 1: true} {
+		code, perr := checkPayload(t, request([]string{"linux/amd64"}, n))
+		if (code == http.StatusUnprocessableEntity && perr.Limit == "max_labels") != over || (!over && code != http.StatusOK) {
+			t.Errorf("%d labels: %d %+v", n, code, perr)
+		}
+	}
+	base := request([]string{"linux/amd64"}, 0)
+	for size, over := range map[int64]bool{maxJSONBody: false, maxJSONBody + 1: true} {
+		code, perr := checkPayload(t, padded(base, size))
+		if (code == http.StatusUnprocessableEntity && perr.Limit == "max_body_bytes") != over || (!over && code != http.StatusOK) {
+			t.Errorf("%d byte body: %d %+v", size, code, perr)
+		}
+	}
+}
+
+// The config file may move each limit within its bounds, and no further.
+func TestPayloadLimitConfig(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		want   PayloadLimits // zero if the config is invalid
+	}{
+		{`{"max_targets": 1}`, PayloadLimits{Targets: 1}},
+		{`{"max_targets": 64}`, PayloadLimits{Targets: 64}},
+		{`{"max_targets": 0}`, PayloadLimits{}},
+		{`{"max_targets": 65}`, PayloadLimits{}},
+		{`{"max_body_kb": 64}`, PayloadLimits{BodyBytes: 64 << 10}},
+		{`{"max_body_kb": 8192}`, PayloadLimits{BodyBytes: 8 << 20}},
+		{`{"max_body_kb": 63}`, PayloadLimits{}},
+		{`{"max_body_kb": 8193}`, PayloadLimits{}},
+	} {
+		var c Config
+		if err := json.Unmarshal([]byte(tc.config), &c); err != nil {
+			t.Fatal(err)
+		}
+		err := c.Validate()
+		if (err == nil) != (tc.want != PayloadLimits{}) {
+			t.Errorf("%s: %v", tc.config, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		opts, err := c.Options()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var o Options
+		for _, opt := range opts {
+			opt(&o)
+		}
+		if o.PayloadLimits != tc.want {
+			t.Errorf("%s: limits %+v, want %+v", tc.config, o.PayloadLimits, tc.want)
+		}
+	}
+}
+
+func TestCapabilitiesReportLimits(t *testing.T) {
+	usePolicy(t)
+	useLimits(t, PayloadLimits{Targets: 3, BodyBytes: 64 << 10})
+	w := httptest.NewRecorder()
+	capabilitiesHandler(w, httptest.NewRequest("GET", "/v1/capabilities", nil))
+	var c Capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatalf("%d %s: %v", w.Code, w.Body, err)
+	}
+	if c.Limits != (PayloadLimits{Targets: 3, BodyBytes: 64 << 10, Labels: maxLabels, SparsePaths: maxSparsePaths}) {
+		t.Errorf("capabilities report limits %+v", c.Limits)
+	}
+}
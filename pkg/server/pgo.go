@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minPGOMinor is the first Go 1.x release that accepts -pgo.
+const minPGOMinor = 21
+
+var (
+	goVersionOnce sync.Once
+	goVersionStr  string
+)
+
+// toolchainVersion returns the installed toolchain version, e.g. "go1.22.3".
+func toolchainVersion() string {
+	goVersionOnce.Do(func() {
+		out, err := exec.Command("go", "env", "GOVERSION").Output()
+		if err == nil {
+			goVersionStr = strings.TrimSpace(string(out))
+		}
+	})
+	return goVersionStr
+}
+
+// toolchainMinor returns the minor version of the Go 1.x toolchain, or 0 if unknown.
+func toolchainMinor() int {
+	v := strings.TrimPrefix(toolchainVersion(), "go1.")
+	if i := strings.IndexAny(v, ".rcbeta "); i >= 0 {
+		v = v[:i]
+	}
+	minor, _ := strconv.Atoi(v)
+	return minor
+}
+
+// profileSamples validates that data is a pprof profile (optionally gzipped
+// protobuf) and returns the number of samples it contains.
+func profileSamples(data []byte) (int, error) {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return 0, err
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return 0, err
+		}
+	}
+
+	// Walk the top-level fields of the Profile message; field 2 is Sample.
+	samples := 0
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errors.New("malformed profile")
+		}
+		data = data[n:]
+		field, wire := key>>3, key&7
+		switch wire {
+		case 0: // varint
+			_, n = binary.Uvarint(data)
+			if n <= 0 {
+				return 0, errors.New("malformed profile")
+			}
+			data = data[n:]
+		case 1: // 64-bit
+			if len(data) < 8 {
+				return 0, errors.New("malformed profile")
+			}
+			data = data[8:]
+		case 2: // length-delimited
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return 0, errors.New("malformed profile")
+			}
+			data = data[n+int(size):]
+		case 5: // 32-bit
+			if len(data) < 4 {
+				return 0, errors.New("malformed profile")
+			}
+			data = data[4:]
+		default:
+			return 0, fmt.Errorf("malformed profile: wire type %d", wire)
+		}
+		if field == 2 {
+			samples++
+		}
+	}
+	if samples == 0 {
+		return 0, errors.New("profile contains no samples")
+	}
+	return samples, nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// policy is the part of the configuration that can change while the server
+// runs: who may build, what, and how often. Requests read one snapshot, so
+// a build keeps the policy it was admitted under.
+type policy struct {
+	tokens         []Token     // accepted credentials; none (and no OIDC) means open
+	oidc           *oidcConfig // nil unless Google ID token auth is configured
+	targets        []string    // subset of builtinTargets this server builds
+	rateLimit      RateLimit
+	trustedProxies []netip.Prefix
+}
+
+func newPolicy(o Options) *policy {
+	p := &policy{tokens: o.Tokens, rateLimit: o.RateLimit, trustedProxies: o.TrustedProxies}
+	for _, t := range o.AllowedTargets {
+		if slices.Contains(builtinTargets, t) {
+			p.targets = append(p.targets, t)
+		}
+	}
+	if o.OIDCAudience != "" {
+		p.oidc = &oidcConfig{audience: o.OIDCAudience, emails: o.OIDCAllowedEmails}
+	}
+	return p
+}
+
+var (
+	policyMu     sync.RWMutex
+	activePolicy = newPolicy(defaultOptions())
+)
+
+// currentPolicy returns the policy new requests are checked against.
+func currentPolicy() *policy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return activePolicy
+}
+
+func setPolicy(p *policy) {
+	for _, t := range p.tokens {
+		secrets.Add(t.Secret)
+	}
+	policyMu.Lock()
+	activePolicy = p
+	policyMu.Unlock()
+}
+
+// Reload re-reads the configuration through the function given to
+// WithReloader and swaps in its tokens, OIDC emails, allowed targets, rate
+// limits and trusted proxies. Other settings need a restart. On error the
+// current policy stays in place.
+func Reload() error {
+	if cfg.Reloader == nil {
+		return errors.New("no configuration source to reload from")
+	}
+	opts, err := cfg.Reloader()
+	if err != nil {
+		return err
+	}
+	next := defaultOptions()
+	for _, opt := range opts {
+		opt(&next)
+	}
+	p := newPolicy(next)
+	setPolicy(p)
+	log.Printf("Policy reloaded: %d token(s), targets %v, rate limit %+v", len(p.tokens), p.targets, p.rateLimit)
+	return nil
+}
+
+// reloadHandler serves POST /admin/reload.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := Reload(); err != nil {
+		log.Printf("Policy reload rejected, keeping the current one: %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"reloaded": true})
+}
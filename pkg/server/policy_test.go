@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useReloader makes Reload read its options from *next for the length of
+// the test.
+func useReloader(t *testing.T, next *[]Option) {
+	t.Helper()
+	prev := cfg
+	cfg.AdminToken = "admin-secret"
+	cfg.Reloader = func() ([]Option, error) {
+		if *next == nil {
+			return nil, errors.New("config: invalid rate_limit")
+		}
+		return *next, nil
+	}
+	t.Cleanup(func() { cfg = prev })
+}
+
+// reloadRequest is POST /admin/reload with the admin token.
+func reloadRequest() *http.Request {
+	r := httptest.NewRequest("POST", "/admin/reload", nil)
+	r.Header.Set("X-Billder-Admin-Token", "admin-secret")
+	return r
+}
+
+// targetAllowed reports whether a request for target gets past validation.
+func targetAllowed(target string) bool {
+	p := RequestPayload{RepoURL: "https://github.com/acme/app", Targets: []string{target}}
+	err := p.normalize(false)
+	return err == nil || !strings.Contains(err.Error(), "unsupported target")
+}
+
+// Flipping the allowlist mid-run changes what new requests may build;
+// requests admitted before keep the policy they started with.
+func TestReloadFlipsAllowlist(t *testing.T) {
+	usePolicy(t, WithAllowedTargets("linux/amd64"))
+	next := []Option{WithAllowedTargets("windows/amd64")}
+	useReloader(t, &next)
+
+	inFlight := currentPolicy()
+	if !targetAllowed("linux/amd64") || targetAllowed("windows/amd64") {
+		t.Fatal("allowlist not in effect before the reload")
+	}
+
+	w := httptest.NewRecorder()
+	reloadHandler(w, reloadRequest())
+	if w.Code != http.StatusOK {
+		t.Fatalf("reload: %d %s", w.Code, w.Body)
+	}
+	if targetAllowed("linux/amd64") || !targetAllowed("windows/amd64") {
+		t.Error("new requests don't see the reloaded allowlist")
+	}
+	if len(inFlight.targets) != 1 || inFlight.targets[0] != "linux/amd64" {
+		t.Errorf("the policy an in-flight build started with changed to %v", inFlight.targets)
+	}
+
+	// And back again
+	next = []Option{WithAllowedTargets("linux/amd64", "windows/amd64")}
+	if err := Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !targetAllowed("linux/amd64") || !targetAllowed("windows/amd64") {
+		t.Error("second reload not in effect")
+	}
+}
+
+// Tokens dropped by a reload stop working at once; new ones work.
+func TestReloadSwapsTokens(t *testing.T) {
+	usePolicy(t, WithTokens(Token{ID: "old", Secret: "old-secret"}))
+	next := []Option{WithTokens(Token{ID: "new", Secret: "new-secret"})}
+	useReloader(t, &next)
+
+	status := func(secret string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/v1/capabilities", nil)
+		r.Header.Set("X-Billder-Token", secret)
+		if authorized(w, r) {
+			return http.StatusOK
+		}
+		return w.Code
+	}
+	if status("old-secret") != http.StatusOK || status("new-secret") != http.StatusUnauthorized {
+		t.Fatal("tokens not in effect before the reload")
+	}
+	if err := Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if status("old-secret") != http.StatusUnauthorized || status("new-secret") != http.StatusOK {
+		t.Error("reloaded tokens not in effect")
+	}
+}
+
+// An invalid configuration is rejected and the running policy kept.
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	usePolicy(t, WithAllowedTargets("linux/amd64"))
+	var next []Option // the reloader fails
+	useReloader(t, &next)
+	before := currentPolicy()
+
+	w := httptest.NewRecorder()
+	reloadHandler(w, reloadRequest())
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "invalid rate_limit") {
+		t.Errorf("reload of an invalid config: %d %s", w.Code, w.Body)
+	}
+	if currentPolicy() != before || !targetAllowed("linux/amd64") {
+		t.Error("policy changed by a rejected reload")
+	}
+
+	cfg.Reloader = nil
+	if err := Reload(); err == nil {
+		t.Error("reload without a configuration source succeeded")
+	}
+}
+
+// Requests checked while reloads swap the policy see one whole policy or
+// the other.
+func TestReloadConcurrentRequests(t *testing.T) {
+	usePolicy(t, WithAllowedTargets("linux/amd64"))
+	next := []Option{WithAllowedTargets("linux/amd64")}
+	useReloader(t, &next)
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for range 200 {
+				if p := currentPolicy(); len(p.targets) != 1 {
+					t.Errorf("torn policy %v", p.targets)
+					return
+				}
+				if !targetAllowed("linux/amd64") {
+					t.Error("allowed target rejected during reloads")
+					return
+				}
+			}
+		})
+	}
+	for range 50 {
+		if err := Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
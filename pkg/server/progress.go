@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval throttles "progress" events during compilation.
+const progressInterval = 2 * time.Second
+
+// CompileProgress is sent as the "progress" event while compiling.
+type CompileProgress struct {
+	Target    string `json:"target,omitempty"`
+	Compiled  int    `json:"compiled"`
+	Expected  int    `json:"expected,omitempty"`
+	Percent   int    `json:"percent"`
+	Estimated bool   `json:"estimated"`
+	ETA       int    `json:"eta_seconds,omitempty"`
+}
+
+// OutputLine is sent as the "output" event with the lines a compile command
+// prints, other than the package names counted as progress and the
+// diagnostics sent on their own. Lines of one stream arrive in order; the
+// two streams interleave by when the server read them. Under
+// cfg.OutputRate one event may carry several lines, newline-separated,
+// and a "…dropped N lines…" line stands in for those over the byte budget.
+type OutputLine struct {
+	Target string `json:"target,omitempty"`
+	Step   int    `json:"step"`   // index of the step that ran the command
+	Stream string `json:"stream"` // "stdout" or "stderr"
+	Line   string `json:"line"`
+	Time   int64  `json:"time_ms"` // Unix milliseconds, of the first line
+}
+
+// newProgress computes the progress for compiled packages given past stats.
+// Without history the percentage is left unestimated.
+func newProgress(compiled int, elapsed time.Duration, past RepoStats, known bool) CompileProgress {
+	p := CompileProgress{Compiled: compiled}
+	if !known || past.Packages == 0 {
+		return p
+	}
+	p.Expected = past.Packages
+	p.Estimated = true
+	p.Percent = min(99, compiled*100/past.Packages)
+	if remaining := past.Seconds - elapsed.Seconds(); remaining > 0 {
+		p.ETA = int(remaining)
+	}
+	return p
+}
+
+// isPackageLine reports whether a line of `go build -v` output names a
+// package being compiled, in either -json or plain form.
+func isPackageLine(line string) bool {
+	if strings.HasPrefix(line, "{") {
+		var ev buildEvent
+		return json.Unmarshal([]byte(line), &ev) == nil &&
+			ev.Action == "build-output" && ev.Output == ev.ImportPath+"\n"
+	}
+	return line != "" && !strings.ContainsAny(line, " :#\t")
+}
+
+// runStreaming runs cmd, calling onLine for each line it prints to stdout
+// or stderr as it is produced, and returns the full output, interleaved in
+// the order lines arrived, once the command exits. Each stream keeps its
+// own order; calls to onLine don't overlap.
+func runStreaming(cmd *exec.Cmd, onLine func(stream, line string)) ([]byte, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var (
+		mu  sync.Mutex
+		out bytes.Buffer
+		wg  sync.WaitGroup
+	)
+	scan := func(stream string, r io.Reader) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			mu.Lock()
+			out.Write(scanner.Bytes())
+			out.WriteByte('\n')
+			onLine(stream, scanner.Text())
+			mu.Unlock()
+		}
+		io.Copy(io.Discard, r)
+	}
+	wg.Add(2)
+	go scan("stdout", stdout)
+	go scan("stderr", stderr)
+
+	// The pipes must be drained before Wait closes them
+	wg.Wait()
+	err = cmd.Wait()
+	return out.Bytes(), err
+}
+
+// ansiSequence matches ANSI escape sequences: CSI (colors, cursor moves),
+// OSC (titles, hyperlinks), charset selections like ESC ( B, which
+// tput sgr0 prints, and two-byte escapes. Lines reach stripANSI
+// whole from runStreaming, so a sequence is never split across reads; one
+// cut off at the end of a line, as by a killed process, is matched too.
+var ansiSequence = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b(?:\[[0-?]*[ -/]*|\][^\x07\x1b]*|[ -/]+)?$|\x1b[ -/]+[0-~]|\x1b[@-Z\\-_]`)
+
+// stripANSI removes ANSI escape sequences from line.
+func stripANSI(line string) string {
+	if !strings.Contains(line, "\x1b") {
+		return line
+	}
+	return ansiSequence.ReplaceAllString(line, "")
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Provenance documents are in-toto statements with a SLSA v1 provenance
+// predicate, wrapped in a DSSE envelope signed with the attestation key.
+const (
+	statementType       = "https://in-toto.io/Statement/v1"
+	provenanceType      = "https://slsa.dev/provenance/v1"
+	provenanceBuildType = "https://github.com/rexlx/bilder/build/v1"
+	provenanceBuilderID = "https://github.com/rexlx/bilder"
+	envelopePayloadType = "application/vnd.in-toto+json"
+)
+
+// ProvenanceEnvelope is a signed provenance document, delivered as
+// <artifact>.provenance.json. Signatures cover the DSSE pre-authentication
+// encoding of PayloadType and Payload.
+type ProvenanceEnvelope struct {
+	PayloadType string              `json:"payloadType"`
+	Payload     []byte              `json:"payload"` // a ProvenanceStatement; base64 in JSON
+	Signatures  []EnvelopeSignature `json:"signatures"`
+}
+
+// EnvelopeSignature is one signature of an envelope.
+type EnvelopeSignature struct {
+	KeyID string `json:"keyid"` // as served at GET /v1/attestation/publickey
+	Sig   []byte `json:"sig"`
+}
+
+// ProvenanceStatement says which files a build produced and how.
+type ProvenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Provenance           `json:"predicate"`
+}
+
+// ResourceDescriptor names a file or a source and its digests.
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Provenance is the SLSA v1 provenance predicate of a build.
+type Provenance struct {
+	BuildDefinition struct {
+		BuildType            string               `json:"buildType"`
+		ExternalParameters   ProvenanceRequest    `json:"externalParameters"`
+		InternalParameters   ProvenanceServer     `json:"internalParameters"`
+		ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string    `json:"invocationId"` // the build id
+			StartedOn    time.Time `json:"startedOn"`
+			FinishedOn   time.Time `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// ProvenanceRequest is what the build was asked for. A request patch is
+// recorded by its digest.
+type ProvenanceRequest struct {
+	Repository string         `json:"repository"`
+	Target     string         `json:"target"` // os/arch, or every target of a matrix build
+	Request    RequestPayload `json:"request"`
+}
+
+// ProvenanceServer is how the server built it.
+type ProvenanceServer struct {
+	Environment Fingerprint `json:"environment"`
+	Packager    string      `json:"packager"`
+	Dirty       bool        `json:"dirty"` // go mod tidy or the patch changed the tree from the commit
+	PatchSHA256 string      `json:"patch_sha256,omitempty"`
+}
+
+// parseAttestationKey reads an ed25519 private key from a PKCS#8 PEM block,
+// as written by `openssl genpkey -algorithm ed25519`, or from the base64
+// of a 32 byte seed or 64 byte private key.
+func parseAttestationKey(data []byte) (ed25519.PrivateKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if k, ok := key.(ed25519.PrivateKey); ok {
+			return k, nil
+		}
+		return nil, fmt.Errorf("the PEM key is a %T, not ed25519", key)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.New("must be a PKCS#8 PEM block or base64")
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("decodes to %d bytes; an ed25519 seed is %d and a private key %d", len(raw), ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+// attestationKeyID names the attestation public key: the start of the
+// sha256 of its PKIX encoding.
+func attestationKeyID(pub ed25519.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
+
+// attestationKeyIDOf is the id of key's public key, or "" without a key.
+func attestationKeyIDOf(key ed25519.PrivateKey) string {
+	if key == nil {
+		return ""
+	}
+	return attestationKeyID(key.Public().(ed25519.PublicKey))
+}
+
+// pae is the DSSE pre-authentication encoding that signatures cover.
+func pae(payloadType string, payload []byte) []byte {
+	return fmt.Appendf(nil, "DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+}
+
+func provenancePath(id string) string {
+	return storePath(dataDir(), "jobs", id+".provenance.json")
+}
+
+// provenanceURL is where the signed provenance of the delivered artifact
+// can be fetched.
+func (j *buildJob) provenanceURL() string {
+	if cfg.AttestationKey == nil {
+		return ""
+	}
+	return "/" + apiVersion + "/builds/" + j.id + "/provenance"
+}
+
+// attest signs a provenance statement for subjects built for target. It
+// returns nil when the server has no attestation key.
+func (j *buildJob) attest(target string, subjects []ResourceDescriptor) ([]byte, error) {
+	if cfg.AttestationKey == nil {
+		return nil, nil
+	}
+	request := j.payload
+	if j.patchSHA != "" {
+		request.Patch = "sha256:" + j.patchSHA
+	}
+	st := ProvenanceStatement{Type: statementType, Subject: subjects, PredicateType: provenanceType}
+	def := &st.Predicate.BuildDefinition
+	def.BuildType = provenanceBuildType
+	def.ExternalParameters = ProvenanceRequest{Repository: j.payload.RepoURL, Target: target, Request: request}
+	def.InternalParameters = ProvenanceServer{Environment: environment(), Packager: j.packager, Dirty: j.vcs.Dirty, PatchSHA256: j.patchSHA}
+	if j.vcs.Commit != "" {
+		source := ResourceDescriptor{URI: "git+" + j.payload.CloneURL(), Digest: map[string]string{"gitCommit": j.vcs.Commit}}
+		if j.vcs.Branch != "" {
+			source.URI += "@" + j.vcs.Branch
+		}
+		def.ResolvedDependencies = []ResourceDescriptor{source}
+	}
+	run := &st.Predicate.RunDetails
+	run.Builder.ID = provenanceBuilderID
+	run.Builder.Version = map[string]string{"billder": serverVersion(), "go": toolchainVersion()}
+	run.Metadata.InvocationID = j.id
+	run.Metadata.StartedOn, run.Metadata.FinishedOn = j.started.UTC(), time.Now().UTC()
+
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	env := ProvenanceEnvelope{PayloadType: envelopePayloadType, Payload: payload}
+	env.Signatures = []EnvelopeSignature{{
+		KeyID: attestationKeyID(cfg.AttestationKey.Public().(ed25519.PublicKey)),
+		Sig:   ed25519.Sign(cfg.AttestationKey, pae(envelopePayloadType, payload)),
+	}}
+	data, err := json.MarshalIndent(env, "", "  ")
+	return append(data, '\n'), err
+}
+
+// withProvenance adds the signed provenance of files, the delivery of one
+// target, to them as <first file>.provenance.json for a zip bundle.
+func (j *buildJob) withProvenance(target string, files []zipEntry) ([]zipEntry, error) {
+	if cfg.AttestationKey == nil || len(files) == 0 {
+		return files, nil
+	}
+	subjects := make([]ResourceDescriptor, 0, len(files))
+	for _, f := range files {
+		h := sha256.New()
+		if f.Path == "" {
+			h.Write(f.Data)
+		} else if err := hashFile(h, f.Path); err != nil {
+			return nil, err
+		}
+		subjects = append(subjects, ResourceDescriptor{Name: f.Name, Digest: map[string]string{"sha256": hex.EncodeToString(h.Sum(nil))}})
+	}
+	doc, err := j.attest(target, subjects)
+	if err != nil {
+		return nil, err
+	}
+	return append(files, zipEntry{Name: files[0].Name + ".provenance.json", Data: doc}), nil
+}
+
+// storeProvenance signs the provenance of the delivered artifact and keeps
+// it next to the build's journal entry, which it is expired with.
+func (j *buildJob) storeProvenance(name, digest string) {
+	doc, err := j.attest(strings.Join(j.payload.Targets, ","), []ResourceDescriptor{{Name: name, Digest: map[string]string{"sha256": digest}}})
+	if err == nil && doc != nil {
+		if err = os.MkdirAll(filepath.Dir(provenancePath(j.id)), 0o755); err == nil {
+			err = os.WriteFile(provenancePath(j.id), doc, 0o644)
+		}
+	}
+	if err != nil {
+		log.Printf("Provenance %s: %v", j.id, err)
+	}
+}
+
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// buildProvenanceHandler serves GET /v1/builds/{id}/provenance, the signed
+// provenance of the artifact a build delivered.
+func buildProvenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	if !buildIDPattern.MatchString(id) {
+		http.Error(w, "Invalid build id", http.StatusBadRequest)
+		return
+	}
+	data, err := os.ReadFile(provenancePath(id))
+	if err != nil {
+		http.Error(w, "Provenance not found", http.StatusNotFound)
+		return
+	}
+	name := "artifact"
+	if rec, err := loadJob(id); err == nil && rec.Artifact != nil {
+		name = rec.Artifact.Name
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", contentDisposition(name+".provenance.json"))
+	w.Write(data)
+}
+
+// AttestationKey is the GET /v1/attestation/publickey response.
+type AttestationKey struct {
+	KeyID     string `json:"key_id"`
+	Algorithm string `json:"algorithm"`  // "ed25519"
+	PublicKey string `json:"public_key"` // PKIX PEM
+}
+
+// attestationKeyHandler serves GET /v1/attestation/publickey. Like the
+// key itself, it needs no token.
+func attestationKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cfg.AttestationKey == nil {
+		http.Error(w, "This server doesn't sign provenance", http.StatusNotFound)
+		return
+	}
+	pub := cfg.AttestationKey.Public().(ed25519.PublicKey)
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AttestationKey{
+		KeyID:     attestationKeyID(pub),
+		Algorithm: "ed25519",
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	})
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildMessage is what the event sink receives as a build starts, at each
+// step and once it finishes, for automation downstream of the server.
+type BuildMessage struct {
+	Type    string         `json:"type"` // build.started, build.step or build.finished
+	BuildID string         `json:"build_id"`
+	Time    time.Time      `json:"time"`
+	Origin  string         `json:"origin"`  // "api" or "scheduled"
+	Attempt int            `json:"attempt"` // above 1 for restarted builds
+	Spec    RequestPayload `json:"spec"`    // a patch is given by its digest, "sha256:<hex>"
+
+	Step *Step `json:"step,omitempty"` // build.step only
+
+	// build.finished only
+	OK       *bool           `json:"ok,omitempty"`
+	Category FailureCategory `json:"error_category,omitempty"`
+	Commit   string          `json:"commit,omitempty"`
+	Ref      string          `json:"ref,omitempty"`
+	Seconds  float64         `json:"duration_seconds,omitempty"`
+	Artifact *StoredArtifact `json:"artifact,omitempty"` // set when the artifact was stored
+}
+
+// Publisher delivers build messages to a message bus. Attributes are short
+// strings a subscriber can filter on without decoding the message: type,
+// build_id, repo and label.<k> for each of the build's labels.
+type Publisher interface {
+	Publish(ctx context.Context, data []byte, attributes map[string]string) error
+}
+
+// nopPublisher drops every message; it is the default.
+type nopPublisher struct{}
+
+func (nopPublisher) Publish(context.Context, []byte, map[string]string) error { return nil }
+
+// newPublisher reads an event_sink setting: an http(s) URL messages are
+// posted to, or pubsub:projects/<project>/topics/<topic>. An empty sink
+// publishes nothing.
+func newPublisher(sink string) (Publisher, error) {
+	if sink == "" {
+		return nopPublisher{}, nil
+	}
+	if topic, ok := strings.CutPrefix(sink, "pubsub:"); ok {
+		if !pubsubTopicPattern.MatchString(topic) {
+			return nil, fmt.Errorf("pubsub topic must be projects/<project>/topics/<topic>, got %q", topic)
+		}
+		return &pubsubPublisher{topic: topic}, nil
+	}
+	if u, err := url.Parse(sink); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("must be an http(s) URL or pubsub:projects/<project>/topics/<topic>, got %q", sink)
+	}
+	return httpPublisher{url: sink}, nil
+}
+
+var pubsubTopicPattern = regexp.MustCompile(`^projects/[a-z][a-z0-9-]{4,28}[a-z0-9]/topics/[A-Za-z][\w.~+%-]{2,254}$`)
+
+// httpPublisher posts each message as JSON, its attributes as headers.
+type httpPublisher struct {
+	url string
+}
+
+func (h httpPublisher) Publish(ctx context.Context, data []byte, attributes map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Billder-Event", attributes["type"])
+	req.Header.Set("X-Billder-Build", attributes["build_id"])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", h.url, resp.Status)
+	}
+	return nil
+}
+
+// pubsubPublisher publishes to a Google Cloud Pub/Sub topic over its REST
+// API, authenticated as the instance's service account through the
+// metadata server. With PUBSUB_EMULATOR_HOST set it talks to the emulator
+// instead, unauthenticated.
+type pubsubPublisher struct {
+	topic string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+const metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+func (p *pubsubPublisher) Publish(ctx context.Context, data []byte, attributes map[string]string) error {
+	endpoint := "https://pubsub.googleapis.com/v1/" + p.topic + ":publish"
+	emulator := os.Getenv("PUBSUB_EMULATOR_HOST")
+	if emulator != "" {
+		endpoint = "http://" + emulator + "/v1/" + p.topic + ":publish"
+	}
+	type message struct {
+		Data       string            `json:"data"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+	}
+	body, _ := json.Marshal(map[string][]message{"messages": {{Data: base64.StdEncoding.EncodeToString(data), Attributes: attributes}}})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if emulator == "" {
+		token, err := p.accessToken(ctx)
+		if err != nil {
+			return fmt.Errorf("pubsub credentials: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pubsub returned %s", resp.Status)
+	}
+	return nil
+}
+
+// accessToken is the service account's token, fetched again a minute
+// before it expires.
+func (p *pubsubPublisher) accessToken(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Until(p.expires) > time.Minute {
+		return p.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	p.token, p.expires = t.AccessToken, time.Now().Add(time.Duration(t.ExpiresIn)*time.Second)
+	return p.token, nil
+}
+
+// eventBus hands messages to the publisher in order, from one goroutine,
+// so a slow or dead sink never holds up a build: once busQueue messages
+// are waiting, new ones are dropped and counted.
+type eventBus struct {
+	pub   Publisher
+	queue chan busMessage
+}
+
+type busMessage struct {
+	data       []byte
+	attributes map[string]string
+}
+
+const (
+	busQueue   = 1024
+	busTimeout = 10 * time.Second // per message
+)
+
+// bus is nil while no event sink is configured.
+var bus *eventBus
+
+// startPublishing sends build messages to pub. A nil or no-op publisher
+// turns publishing off.
+func startPublishing(pub Publisher) {
+	if _, off := pub.(nopPublisher); off || pub == nil {
+		bus = nil
+		return
+	}
+	b := &eventBus{pub: pub, queue: make(chan busMessage, busQueue)}
+	bus = b
+	go func() {
+		for m := range b.queue {
+			ctx, cancel := context.WithTimeout(context.Background(), busTimeout)
+			if err := b.pub.Publish(ctx, m.data, m.attributes); err != nil {
+				metrics.messageFailed()
+				log.Printf("Event publish %s %s: %v", m.attributes["type"], m.attributes["build_id"], err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// publish queues m without waiting.
+func (b *eventBus) publish(m BuildMessage) {
+	m.Time = time.Now()
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("Event marshal error: %v", err)
+		return
+	}
+	attributes := map[string]string{"type": m.Type, "build_id": m.BuildID, "repo": canonicalRepo(m.Spec.RepoURL)}
+	for k, v := range m.Spec.Labels {
+		attributes["label."+k] = v
+	}
+	select {
+	case b.queue <- busMessage{data: []byte(secrets.Redact(string(data))), attributes: attributes}:
+	default:
+		metrics.messageDropped()
+	}
+}
+
+// buildMessage is the part of every message about rec.
+func buildMessage(kind string, rec *JobRecord) BuildMessage {
+	return BuildMessage{Type: kind, BuildID: rec.ID, Origin: rec.Origin, Attempt: rec.Attempt, Spec: rec.Payload.withPatchDigest()}
+}
+
+func publishStarted(rec *JobRecord) {
+	if bus != nil {
+		bus.publish(buildMessage("build.started", rec))
+	}
+}
+
+func publishStep(rec *JobRecord, step Step) {
+	if bus != nil {
+		m := buildMessage("build.step", rec)
+		m.Step = &step
+		bus.publish(m)
+	}
+}
+
+func publishFinished(rec *JobRecord) {
+	if bus != nil {
+		m := buildMessage("build.finished", rec)
+		m.OK, m.Category = &rec.OK, rec.Failure
+		m.Commit, m.Ref, m.Artifact = rec.Commit, rec.Ref, rec.Artifact
+		m.Seconds = time.Since(rec.StartedAt).Seconds()
+		bus.publish(m)
+	}
+}
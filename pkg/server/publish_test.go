@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePublisher records what it is given. While block is open it waits
+// for it to close before each message; err fails every message.
+type fakePublisher struct {
+	mu       sync.Mutex
+	messages []BuildMessage
+	attrs    []map[string]string
+	block    chan struct{}
+	err      error
+	got      chan struct{} // signaled once per message
+}
+
+func newFakePublisher() *fakePublisher {
+	return &fakePublisher{got: make(chan struct{}, busQueue)}
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, data []byte, attributes map[string]string) error {
+	if f.block != nil {
+		<-f.block
+	}
+	var m BuildMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.messages = append(f.messages, m)
+	f.attrs = append(f.attrs, attributes)
+	f.mu.Unlock()
+	select {
+	case f.got <- struct{}{}:
+	default: // nobody is waiting for that many
+	}
+	return f.err
+}
+
+// wait returns the first n messages, failing t if they don't come.
+func (f *fakePublisher) wait(t *testing.T, n int) []BuildMessage {
+	t.Helper()
+	for range n {
+		select {
+		case <-f.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("publisher got %d of %d messages", len(f.messages), n)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.messages[:n]
+}
+
+// usePublisher publishes to pub for the length of the test.
+func usePublisher(t *testing.T, pub Publisher) {
+	t.Helper()
+	prev := bus
+	startPublishing(pub)
+	t.Cleanup(func() { bus = prev })
+}
+
+func busMetrics() (dropped, failed int64) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	return metrics.busDropped, metrics.busFailed
+}
+
+// A build's messages arrive in order, with the spec, its labels as
+// attributes, the patch by its digest and secrets scrubbed.
+func TestPublishLifecycle(t *testing.T) {
+	fake := newFakePublisher()
+	usePublisher(t, fake)
+	secrets.Add("publish-secret-value")
+
+	rec := &JobRecord{ID: newBuildID(), Origin: "api", Attempt: 1, StartedAt: time.Now(), Payload: RequestPayload{
+		RepoURL: "https://github.com/Acme/App.git",
+		Ref:     "publish-secret-value",
+		Patch:   base64.StdEncoding.EncodeToString([]byte("diff")),
+		Labels:  map[string]string{"pr": "7"},
+		Targets: []string{"linux/amd64"},
+	}}
+	publishStarted(rec)
+	publishStep(rec, Step{Index: 1, Total: 3, Name: "Cloning repository"})
+	publishStep(rec, Step{Index: 2, Total: 3, Name: "Compiling"})
+	rec.OK, rec.Commit, rec.Ref = true, "3281ff05", "main"
+	rec.Artifact = &StoredArtifact{Name: "app", Size: 42, SHA256: "00ff"}
+	publishFinished(rec)
+
+	msgs := fake.wait(t, 4)
+	for i, want := range []string{"build.started", "build.step", "build.step", "build.finished"} {
+		m, attrs := msgs[i], fake.attrs[i]
+		if m.Type != want || m.BuildID != rec.ID || m.Origin != "api" || m.Attempt != 1 {
+			t.Errorf("message %d: %+v", i, m)
+		}
+		wantAttrs := map[string]string{"type": want, "build_id": rec.ID, "repo": "github.com/Acme/App", "label.pr": "7"}
+		if len(attrs) != len(wantAttrs) {
+			t.Errorf("message %d attributes %v, want %v", i, attrs, wantAttrs)
+		}
+		for k, v := range wantAttrs {
+			if attrs[k] != v {
+				t.Errorf("message %d attribute %s = %q, want %q", i, k, attrs[k], v)
+			}
+		}
+		if sum := sha256.Sum256([]byte("diff")); m.Spec.Patch != "sha256:"+hex.EncodeToString(sum[:]) {
+			t.Errorf("message %d carries the patch as %q", i, m.Spec.Patch)
+		}
+		if strings.Contains(m.Spec.Ref, "publish-secret-value") {
+			t.Errorf("message %d leaks a secret: %q", i, m.Spec.Ref)
+		}
+	}
+	if s := msgs[1].Step; s == nil || s.Name != "Cloning repository" || msgs[0].Step != nil {
+		t.Errorf("steps %+v, %+v", msgs[0].Step, s)
+	}
+	end := msgs[3]
+	if end.OK == nil || !*end.OK || end.Commit != "3281ff05" || end.Ref != "main" || end.Artifact == nil || end.Artifact.SHA256 != "00ff" {
+		t.Errorf("build.finished %+v", end)
+	}
+	if msgs[0].OK != nil || msgs[0].Artifact != nil {
+		t.Errorf("build.started carries an outcome: %+v", msgs[0])
+	}
+}
+
+// A sink that hangs doesn't hold up builds: messages beyond the queue are
+// dropped and counted.
+func TestPublishNeverBlocks(t *testing.T) {
+	fake := newFakePublisher()
+	fake.block = make(chan struct{})
+	usePublisher(t, fake)
+	t.Cleanup(func() { close(fake.block) })
+	dropped, _ := busMetrics()
+
+	rec := &JobRecord{ID: newBuildID(), Payload: RequestPayload{RepoURL: "github.com/acme/app"}}
+	done := make(chan struct{})
+	go func() {
+		for i := range busQueue + 50 {
+			publishStep(rec, Step{Index: i})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a hung sink")
+	}
+	// One message may be with the publisher, out of the queue
+	if d, _ := busMetrics(); d-dropped < 49 || d-dropped > 50 {
+		t.Errorf("%d messages dropped, want 49 or 50", d-dropped)
+	}
+}
+
+// A failing sink is logged and counted; builds carry on.
+func TestPublishFailures(t *testing.T) {
+	fake := newFakePublisher()
+	fake.err = errors.New("sink unavailable")
+	usePublisher(t, fake)
+	_, failed := busMetrics()
+
+	rec := &JobRecord{ID: newBuildID(), Payload: RequestPayload{RepoURL: "github.com/acme/app"}}
+	publishStarted(rec)
+	publishFinished(rec)
+	fake.wait(t, 2)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, f := busMetrics(); f-failed == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed messages not counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPublishOff(t *testing.T) {
+	usePublisher(t, nopPublisher{})
+	if bus != nil {
+		t.Fatal("the no-op publisher starts a bus")
+	}
+	rec := &JobRecord{ID: newBuildID()}
+	publishStarted(rec)
+	publishStep(rec, Step{})
+	publishFinished(rec)
+}
+
+func TestNewPublisher(t *testing.T) {
+	for sink, want := range map[string]string{
+		"":                                  "server.nopPublisher",
+		"https://hooks.example.com/billder": "server.httpPublisher",
+		"http://10.0.0.5:8080/events":       "server.httpPublisher",
+		"pubsub:projects/my-project/topics/builds": "*server.pubsubPublisher",
+		"pubsub:projects/p/topics/builds":          "", // project ids are 6 to 30 characters
+		"pubsub:projects/my-project/topics/b":      "", // topics at least 3
+		"pubsub:my-project/builds":                 "",
+		"ftp://example.com/events":                 "",
+		"https://":                                 "",
+		"hooks.example.com/billder":                "",
+		"nats://localhost:4222":                    "",
+	} {
+		pub, err := newPublisher(sink)
+		got := ""
+		if err == nil {
+			got = fmt.Sprintf("%T", pub)
+		}
+		if got != want {
+			t.Errorf("newPublisher(%q) = %s, %v; want %s", sink, got, err, want)
+		}
+	}
+}
+
+// receiver records the requests a sink gets.
+type receiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	status   int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	rc.requests, rc.bodies = append(rc.requests, r), append(rc.bodies, body)
+	rc.mu.Unlock()
+	if rc.status != 0 {
+		w.WriteHeader(rc.status)
+	}
+}
+
+func TestHTTPPublisher(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	pub, _ := newPublisher(srv.URL + "/events")
+	attrs := map[string]string{"type": "build.started", "build_id": "0123456789abcdef", "repo": "github.com/acme/app"}
+	if err := pub.Publish(context.Background(), []byte(`{"type":"build.started"}`), attrs); err != nil {
+		t.Fatal(err)
+	}
+	r := rc.requests[0]
+	if r.Method != "POST" || r.URL.Path != "/events" || r.Header.Get("Content-Type") != "application/json" ||
+		r.Header.Get("X-Billder-Event") != "build.started" || r.Header.Get("X-Billder-Build") != "0123456789abcdef" {
+		t.Errorf("request %s %s %v", r.Method, r.URL, r.Header)
+	}
+	if string(rc.bodies[0]) != `{"type":"build.started"}` {
+		t.Errorf("body %s", rc.bodies[0])
+	}
+	rc.status = http.StatusServiceUnavailable
+	if err := pub.Publish(context.Background(), []byte("{}"), attrs); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("a 503 published: %v", err)
+	}
+}
+
+func TestPubsubPublisherEmulator(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	t.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	pub, _ := newPublisher("pubsub:projects/my-project/topics/builds")
+	attrs := map[string]string{"type": "build.finished", "label.pr": "7"}
+	if err := pub.Publish(context.Background(), []byte(`{"ok":true}`), attrs); err != nil {
+		t.Fatal(err)
+	}
+	r := rc.requests[0]
+	if r.URL.Path != "/v1/projects/my-project/topics/builds:publish" || r.Header.Get("Authorization") != "" {
+		t.Errorf("request %s %v", r.URL, r.Header)
+	}
+	var body struct {
+		Messages []struct {
+			Data       string            `json:"data"`
+			Attributes map[string]string `json:"attributes"`
+		} `json:"messages"`
+	}
+	json.Unmarshal(rc.bodies[0], &body)
+	if len(body.Messages) != 1 {
+		t.Fatalf("body %s", rc.bodies[0])
+	}
+	data, _ := base64.StdEncoding.DecodeString(body.Messages[0].Data)
+	if string(data) != `{"ok":true}` || body.Messages[0].Attributes["label.pr"] != "7" {
+		t.Errorf("published %s with %v", data, body.Messages[0].Attributes)
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit configures build request limits. Zero values disable a limit.
+type RateLimit struct {
+	PerMinute       int // per client IP, for callers without a named token
+	Burst           int // requests allowed at once before the rate applies
+	GlobalPerMinute int // ceiling across every caller
+}
+
+// bucket is a token bucket refilled continuously at its limiter's rate.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps one token bucket per key. now is replaceable so the
+// refill arithmetic can be driven by a fake clock.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*bucket{}, now: time.Now}
+}
+
+// maxBuckets bounds memory; past it, full (idle) buckets are dropped.
+const maxBuckets = 10000
+
+// allow takes a token from key's bucket, refilled at perMinute with room
+// for burst. When empty it reports how long until a token is available.
+func (l *rateLimiter) allow(key string, perMinute, burst int) (bool, time.Duration) {
+	return l.take(key, perMinute, burst, 1)
+}
+
+// peek reports what allow would, without taking a token.
+func (l *rateLimiter) peek(key string, perMinute, burst int) (bool, time.Duration) {
+	return l.take(key, perMinute, burst, 0)
+}
+
+// take refills key's bucket and, when it holds a token, takes n of them.
+func (l *rateLimiter) take(key string, perMinute, burst int, n float64) (bool, time.Duration) {
+	rate := float64(perMinute) / 60
+	capacity := float64(max(1, burst))
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if n == 0 {
+			return true, 0
+		}
+		if len(l.buckets) >= maxBuckets {
+			l.evictIdle(now, rate, capacity)
+		}
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens -= n
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// evictIdle drops buckets that have refilled completely. Callers must hold l.mu.
+func (l *rateLimiter) evictIdle(now time.Time, rate, capacity float64) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+var (
+	ipLimiter     = newRateLimiter()
+	tokenLimiter  = newRateLimiter()
+	globalLimiter = newRateLimiter()
+)
+
+// rateLimited writes a 429 with Retry-After and reports true when r is
+// over a limit. Callers authenticated with a named token or key skip the
+// per-IP limit and use their own rate_per_min quota instead; OIDC callers
+// skip it too. Everyone else, whatever headers they send, is limited by IP.
+// The global ceiling applies to everyone.
+func rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	limits := currentPolicy().rateLimit
+	scope := ""
+	var wait time.Duration
+	ok := true
+
+	caller := callerID(r)
+	kind, name, _ := strings.Cut(caller, ":")
+	switch {
+	case kind == "token" || kind == "key":
+		if quota := tokenQuota(name); quota > 0 {
+			scope = "token"
+			ok, wait = tokenLimiter.allow(name, quota, limits.Burst)
+		}
+	case kind == "oidc":
+	case limits.PerMinute > 0:
+		scope = "ip"
+		ok, wait = ipLimiter.allow(clientIP(r).String(), limits.PerMinute, limits.Burst)
+	}
+	// The global ceiling holds up to a minute's worth of requests at once
+	if ok && limits.GlobalPerMinute > 0 {
+		scope = "global"
+		ok, wait = globalLimiter.allow("", limits.GlobalPerMinute, limits.GlobalPerMinute)
+	}
+	if ok {
+		return false
+	}
+
+	metrics.rateLimited(scope)
+	retry := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, retry)))
+	http.Error(w, "Too Many Requests: "+scope+" rate limit exceeded", http.StatusTooManyRequests)
+	return true
+}
+
+// tokenQuota is the requests/minute allowed for a token id; 0 is unlimited.
+func tokenQuota(id string) int {
+	for _, t := range currentPolicy().tokens {
+		if t.ID == id {
+			return t.RatePerMinute
+		}
+	}
+	return 0
+}
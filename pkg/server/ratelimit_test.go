@@ -0,0 +1,204 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rexlx/bilder/pkg/client"
+)
+
+// fakeClock is a time source tests move by hand.
+type fakeClock struct{ t time.Time }
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newFakeLimiter() (*rateLimiter, *fakeClock) {
+	clock := newFakeClock()
+	l := newRateLimiter()
+	l.now = clock.now
+	return l, clock
+}
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	l, clock := newFakeLimiter()
+	for i := range 3 {
+		if ok, _ := l.allow("a", 60, 3); !ok {
+			t.Fatalf("request %d of the burst was refused", i+1)
+		}
+	}
+	ok, wait := l.allow("a", 60, 3)
+	if ok {
+		t.Fatal("request past the burst was allowed")
+	}
+	if wait != time.Second {
+		t.Errorf("wait = %s, want 1s at 60/min", wait)
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if ok, wait := l.allow("a", 60, 3); ok || wait != 500*time.Millisecond {
+		t.Errorf("half a token later: ok %v, wait %s; want refused, 500ms", ok, wait)
+	}
+	clock.advance(500 * time.Millisecond)
+	if ok, _ := l.allow("a", 60, 3); !ok {
+		t.Error("a full token later the request was refused")
+	}
+
+	// Idle time refills to the burst and no further
+	clock.advance(time.Hour)
+	for i := range 3 {
+		if ok, _ := l.allow("a", 60, 3); !ok {
+			t.Fatalf("request %d after idling was refused", i+1)
+		}
+	}
+	if ok, _ := l.allow("a", 60, 3); ok {
+		t.Error("idling banked more than the burst")
+	}
+}
+
+func TestRateLimiterKeysAreIndependent(t *testing.T) {
+	l, _ := newFakeLimiter()
+	if ok, _ := l.allow("a", 1, 1); !ok {
+		t.Fatal("first request refused")
+	}
+	if ok, _ := l.allow("a", 1, 1); ok {
+		t.Fatal("second request for the same key allowed")
+	}
+	if ok, _ := l.allow("b", 1, 1); !ok {
+		t.Error("another key was limited by the first's bucket")
+	}
+}
+
+func TestRateLimiterEvictsIdleBuckets(t *testing.T) {
+	l, clock := newFakeLimiter()
+	for i := range maxBuckets {
+		l.allow(strconv.Itoa(i), 60, 1)
+	}
+	clock.advance(time.Minute)
+	l.allow("new", 60, 1)
+	if n := len(l.buckets); n != 1 {
+		t.Errorf("%d buckets after eviction, want only the new one", n)
+	}
+}
+
+// useFakeLimiters replaces the server's limiters with ones on one fake clock.
+func useFakeLimiters(t *testing.T) *fakeClock {
+	t.Helper()
+	clock := newFakeClock()
+	prevIP, prevToken, prevGlobal := ipLimiter, tokenLimiter, globalLimiter
+	ipLimiter, tokenLimiter, globalLimiter = newRateLimiter(), newRateLimiter(), newRateLimiter()
+	for _, l := range []*rateLimiter{ipLimiter, tokenLimiter, globalLimiter} {
+		l.now = clock.now
+	}
+	t.Cleanup(func() { ipLimiter, tokenLimiter, globalLimiter = prevIP, prevToken, prevGlobal })
+	return clock
+}
+
+func buildRequestFrom(ip string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest("POST", "/v1/build", nil)
+	r.RemoteAddr = ip + ":40000"
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+// limitedAfter is how many of up to 10 requests pass before the first 429,
+// and that response.
+func limitedAfter(next func() *http.Request) (int, *httptest.ResponseRecorder) {
+	for i := range 10 {
+		w := httptest.NewRecorder()
+		if rateLimited(w, next()) {
+			return i, w
+		}
+	}
+	return 10, nil
+}
+
+func TestRateLimitedByIP(t *testing.T) {
+	usePolicy(t, WithRateLimit(RateLimit{PerMinute: 60, Burst: 2}))
+	clock := useFakeLimiters(t)
+	n, w := limitedAfter(func() *http.Request { return buildRequestFrom("192.0.2.1", nil) })
+	if n != 2 {
+		t.Fatalf("%d requests passed, want the burst of 2", n)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+	if rateLimited(httptest.NewRecorder(), buildRequestFrom("192.0.2.2", nil)) {
+		t.Error("another IP was limited")
+	}
+	clock.advance(time.Second)
+	if rateLimited(httptest.NewRecorder(), buildRequestFrom("192.0.2.1", nil)) {
+		t.Error("still limited after the bucket refilled a token")
+	}
+}
+
+// On an open server, naming a key buys nothing: every caller is anonymous.
+func TestRateLimitedOpenServerIgnoresKeyIDs(t *testing.T) {
+	usePolicy(t, WithRateLimit(RateLimit{PerMinute: 60, Burst: 2}))
+	useFakeLimiters(t)
+	i := 0
+	n, _ := limitedAfter(func() *http.Request {
+		i++
+		return buildRequestFrom("192.0.2.1", map[string]string{client.HeaderKeyID: string(rune('a' + i))})
+	})
+	if n != 2 {
+		t.Errorf("%d requests with made-up key ids passed, want the IP's burst of 2", n)
+	}
+}
+
+func TestRateLimitedTokenQuota(t *testing.T) {
+	usePolicy(t,
+		WithTokens(Token{ID: "ci", Secret: "ci-secret", RatePerMinute: 2}, Token{ID: "ops", Secret: "ops-secret"}),
+		WithRateLimit(RateLimit{PerMinute: 1, Burst: 5}))
+	useFakeLimiters(t)
+	n, _ := limitedAfter(func() *http.Request {
+		return buildRequestFrom("192.0.2.1", map[string]string{"X-Billder-Token": "ci-secret"})
+	})
+	if n != 5 {
+		t.Errorf("%d requests passed for a token with a quota, want its burst of 5", n)
+	}
+	n, _ = limitedAfter(func() *http.Request {
+		return buildRequestFrom("192.0.2.1", map[string]string{"X-Billder-Token": "ops-secret"})
+	})
+	if n != 10 {
+		t.Errorf("token without a quota limited after %d requests", n)
+	}
+}
+
+func TestRateLimitedSpoofedKeyIDKeepsIPLimit(t *testing.T) {
+	usePolicy(t, WithTokens(Token{ID: "ops", Secret: "ops-secret"}), WithRateLimit(RateLimit{PerMinute: 60, Burst: 1}))
+	useFakeLimiters(t)
+	n, _ := limitedAfter(func() *http.Request {
+		return buildRequestFrom("192.0.2.1", map[string]string{client.HeaderKeyID: "ops"})
+	})
+	if n != 1 {
+		t.Errorf("%d unauthenticated requests naming an unlimited key passed, want 1", n)
+	}
+}
+
+func TestRateLimitedGlobalCeiling(t *testing.T) {
+	usePolicy(t, WithTokens(Token{ID: "ops", Secret: "ops-secret"}), WithRateLimit(RateLimit{GlobalPerMinute: 3}))
+	clock := useFakeLimiters(t)
+	n, w := limitedAfter(func() *http.Request {
+		return buildRequestFrom("192.0.2.1", map[string]string{"X-Billder-Token": "ops-secret"})
+	})
+	if n != 3 {
+		t.Fatalf("%d requests passed, want the global 3", n)
+	}
+	if got := w.Header().Get("Retry-After"); got != "20" {
+		t.Errorf("Retry-After = %q, want 20 at 3/min", got)
+	}
+	clock.advance(20 * time.Second)
+	if rateLimited(httptest.NewRecorder(), buildRequestFrom("192.0.2.9", nil)) {
+		t.Error("still limited once the global bucket refilled")
+	}
+}
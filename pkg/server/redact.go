@@ -0,0 +1,157 @@
+package server
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// tokenPatterns match well-known credential formats even when they weren't configured.
+var tokenPatterns = regexp.MustCompile(strings.Join([]string{
+	`gh[pousr]_[A-Za-z0-9]{36}`,          // GitHub tokens
+	`github_pat_[A-Za-z0-9_]{82}`,        // GitHub fine-grained tokens
+	`glpat-[A-Za-z0-9_-]{20}`,            // GitLab personal access tokens
+	`(?:AKIA|ASIA)[0-9A-Z]{16}`,          // AWS access key IDs
+	`xox[abpr]-[A-Za-z0-9-]{10,72}`,      // Slack tokens
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----`, // PEM private key headers
+}, "|"))
+
+// maxPatternLen bounds how long a tokenPatterns match can be.
+const maxPatternLen = 94
+
+// minSecretLen avoids redacting short values that would mangle ordinary output.
+const minSecretLen = 8
+
+// redactor replaces secret values and token patterns with [REDACTED].
+type redactor struct {
+	mu       sync.RWMutex
+	secrets  []string
+	replacer *strings.Replacer
+	maxLen   int
+}
+
+// secrets scrubs everything the server streams, stores or logs.
+var secrets = &redactor{maxLen: maxPatternLen}
+
+// Add registers secret values; values shorter than minSecretLen are ignored.
+func (r *redactor) Add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if len(v) >= minSecretLen {
+			r.secrets = append(r.secrets, v)
+			r.maxLen = max(r.maxLen, len(v))
+		}
+	}
+	// Longest first so a secret containing another is replaced whole
+	sort.Slice(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+	pairs := make([]string, 0, 2*len(r.secrets))
+	for _, s := range r.secrets {
+		pairs = append(pairs, s, redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact scrubs a complete string.
+func (r *redactor) Redact(s string) string {
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+	if replacer != nil {
+		s = replacer.Replace(s)
+	}
+	return tokenPatterns.ReplaceAllString(s, redacted)
+}
+
+// holdback is how many trailing bytes a stream must keep back so a secret
+// cut by a buffer boundary is never partially emitted.
+func (r *redactor) holdback() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.maxLen - 1
+}
+
+// redactWriter scrubs a byte stream written in arbitrary chunks. Call Flush
+// when the stream ends to emit the held-back tail.
+type redactWriter struct {
+	r   *redactor
+	w   io.Writer
+	buf string
+}
+
+func newRedactWriter(w io.Writer) *redactWriter {
+	return &redactWriter{r: secrets, w: w}
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	data := rw.buf + string(p)
+	// Anything that could be the start of an incomplete secret stays
+	// buffered, unredacted so that it's matched again once the rest arrives
+	cut := rw.r.safeCut(data, len(data)-rw.r.holdback())
+	if cut <= 0 {
+		rw.buf = data
+		return len(p), nil
+	}
+	if _, err := io.WriteString(rw.w, rw.r.Redact(data[:cut])); err != nil {
+		return 0, err
+	}
+	rw.buf = data[cut:]
+	return len(p), nil
+}
+
+// safeCut moves cut back to the start of any secret or token in s that
+// it would split, so that neither half is left to be redacted alone.
+func (r *redactor) safeCut(s string, cut int) int {
+	if cut <= 0 {
+		return cut
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	// Moving the cut back may split another match, so repeat until none is
+	for prev := -1; cut != prev && cut > 0; {
+		prev = cut
+		for _, secret := range r.secrets {
+			from, to := max(0, cut-len(secret)+1), min(len(s), cut+len(secret)-1)
+			if i := strings.Index(s[from:to], secret); i >= 0 {
+				cut = from + i
+			}
+		}
+		for _, loc := range tokenPatterns.FindAllStringIndex(s, -1) {
+			if loc[0] < cut && cut < loc[1] {
+				cut = loc[0]
+			}
+		}
+	}
+	return cut
+}
+
+// Flush writes out the held-back tail.
+func (rw *redactWriter) Flush() error {
+	_, err := io.WriteString(rw.w, rw.r.Redact(rw.buf))
+	rw.buf = ""
+	return err
+}
+
+// LogWriter wraps w so lines written by the standard logger are scrubbed
+// of secrets.
+func LogWriter(w io.Writer) io.Writer {
+	return lineRedactWriter{w}
+}
+
+// lineRedactWriter scrubs writes that are always whole lines, such as the
+// standard logger's, without holding anything back.
+type lineRedactWriter struct {
+	w io.Writer
+}
+
+func (lw lineRedactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(lw.w, secrets.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var (
+	refPattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+	commitPattern = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+)
+
+// validRef reports whether ref is safe to hand to git fetch: a branch, tag,
+// commit or refs path such as pull/123/head.
+func validRef(ref string) bool {
+	return refPattern.MatchString(ref) && !strings.Contains(ref, "..") && !strings.HasSuffix(ref, "/")
+}
+
+// checkoutRef fetches ref from origin and checks it out detached.
+func (j *buildJob) checkoutRef(host *gitHost, ref string, sse *sseWriter) error {
+	target, err := j.fetchRef(host, ref, sse)
+	if err != nil {
+		return err
+	}
+	checkout := host.git(j.ctx, "checkout", "--quiet", "--detach", target) // partial clones fetch blobs from the host
+	checkout.Dir = j.repoPath
+	out, err := checkout.CombinedOutput()
+	j.log.Command("", checkout, out, err)
+	if err != nil {
+		return fmt.Errorf("checking out %q failed: %s", ref, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// fetchRef fetches ref from origin into the clone and returns its commit.
+// Pull and merge request refs aren't advertised by clone, so every ref is
+// fetched explicitly, translated to the host's style. Commits that can't
+// be fetched by id are looked up in the clone's history.
+func (j *buildJob) fetchRef(host *gitHost, ref string, sse *sseWriter) (string, error) {
+	out, err := j.runRetrying(sse, "Fetching "+ref, func() *exec.Cmd {
+		fetch := host.git(j.ctx, "fetch", "origin", host.resolveRef(ref))
+		fetch.Dir = j.repoPath
+		return fetch
+	})
+	if err == nil {
+		return cmp.Or(gitOutput(j.repoPath, "rev-parse", "FETCH_HEAD"), "FETCH_HEAD"), nil
+	}
+	if !commitPattern.MatchString(ref) || gitOutput(j.repoPath, "rev-parse", "--verify", "--quiet", ref+"^{commit}") == "" {
+		category := cloneFailure(out)
+		if j.ctx.Err() != nil {
+			category = FailTimeout
+		}
+		return "", failedWith(category, fmt.Errorf("ref %q not found on remote", ref))
+	}
+	return ref, nil
+}
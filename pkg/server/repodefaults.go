@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+)
+
+// RepoDefaults are build request fields the server fills in for requests
+// for matching repositories, where the request leaves them out.
+type RepoDefaults struct {
+	Match    string                     `json:"match"`    // host/owner/name, with path.Match wildcards, e.g. github.com/acme/*
+	Defaults map[string]json.RawMessage `json:"defaults"` // request fields and their values
+}
+
+// AppliedDefault is a request field a repos entry filled in.
+type AppliedDefault struct {
+	Field string          `json:"field"`
+	Value json.RawMessage `json:"value"`
+	Match string          `json:"match"` // the entry's pattern
+}
+
+// targetFields choose the targets together: a request naming any of them
+// gets none from defaults.
+var targetFields = []string{"target_os", "target_arch", "targets"}
+
+// problems lists what is wrong with the entry.
+func (d RepoDefaults) problems() []string {
+	var problems []string
+	if _, err := path.Match(d.Match, ""); d.Match == "" || err != nil {
+		problems = append(problems, fmt.Sprintf("match %q must be a repository pattern like github.com/acme/*", d.Match))
+	}
+	for field := range d.Defaults {
+		if field == "repo_url" || field == "patch" {
+			problems = append(problems, fmt.Sprintf("%s can't have a default", field))
+		}
+	}
+	data, _ := json.Marshal(d.Defaults)
+	if err := decodeStrict(bytes.NewReader(data), &RequestPayload{}); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// applyRepoDefaults fills in the fields of p, decoded from raw, that raw
+// leaves out from the repos entries matching p's repository. Entries apply
+// in order, later ones over earlier ones; the request wins over all of
+// them. It returns the fields it filled in.
+func applyRepoDefaults(p *RequestPayload, raw []byte, entries []RepoDefaults) ([]AppliedDefault, error) {
+	repo := canonicalRepo(p.RepoURL)
+	given := map[string]json.RawMessage{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &given); err != nil {
+			return nil, err
+		}
+	}
+	if p.Patch != "" {
+		given["patch"] = nil // uploaded as a file
+	}
+	targetsGiven := slices.ContainsFunc(targetFields, func(f string) bool { _, ok := given[f]; return ok })
+
+	applied := map[string]AppliedDefault{}
+	for _, e := range entries {
+		if ok, _ := path.Match(e.Match, repo); !ok {
+			continue
+		}
+		for field, value := range e.Defaults {
+			if _, ok := given[field]; ok || targetsGiven && slices.Contains(targetFields, field) {
+				continue
+			}
+			applied[field] = AppliedDefault{Field: field, Value: value, Match: e.Match}
+		}
+	}
+	if len(applied) == 0 {
+		return nil, nil
+	}
+	fields := map[string]json.RawMessage{}
+	var list []AppliedDefault
+	for field, a := range applied {
+		fields[field] = a.Value
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Field < list[j].Field })
+	data, _ := json.Marshal(fields)
+	return list, json.Unmarshal(data, p)
+}
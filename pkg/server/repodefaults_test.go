@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// defaults is a repos entry for the tests; fields holds its defaults as
+// a JSON object.
+func defaults(match, fields string) RepoDefaults {
+	d := RepoDefaults{Match: match}
+	if err := json.Unmarshal([]byte(fields), &d.Defaults); err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// applyTo decodes raw as a request and fills in the defaults of entries.
+func applyTo(t *testing.T, raw string, entries ...RepoDefaults) (RequestPayload, []AppliedDefault) {
+	t.Helper()
+	var p RequestPayload
+	if err := json.Unmarshal([]byte(raw), &p); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := applyRepoDefaults(&p, []byte(raw), entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, applied
+}
+
+func appliedFields(applied []AppliedDefault) []string {
+	var fields []string
+	for _, a := range applied {
+		fields = append(fields, a.Field+"<-"+a.Match)
+	}
+	return fields
+}
+
+func TestRepoDefaultsMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		repos   []string
+		others  []string
+	}{
+		{
+			pattern: "github.com/acme/app",
+			repos:   []string{"github.com/acme/app", "https://github.com/acme/app.git", "https://GitHub.com/acme/app/", "git@github.com:acme/app.git", "ssh://git@github.com:22/acme/app"},
+			others:  []string{"github.com/acme/app2", "github.com/acme/App", "github.com/acme/app/sub", "gitlab.com/acme/app", "github.com/acme"},
+		},
+		{
+			pattern: "github.com/acme/*",
+			repos:   []string{"github.com/acme/app", "github.com/acme/tools", "https://github.com/acme/x.git"},
+			others:  []string{"github.com/acme/group/app", "github.com/acmeinc/app", "github.com/other/acme"},
+		},
+		{
+			pattern: "*/acme/app",
+			repos:   []string{"github.com/acme/app", "gitea.example.com:3000/acme/app"},
+			others:  []string{"gitlab.com/group/acme/app"},
+		},
+		{
+			pattern: "gitlab.com/group/*/*",
+			repos:   []string{"gitlab.com/group/sub/app"},
+			others:  []string{"gitlab.com/group/app", "gitlab.com/group/a/b/c"},
+		},
+		{
+			pattern: "github.com/acme/app-?",
+			repos:   []string{"github.com/acme/app-1", "github.com/acme/app-x"},
+			others:  []string{"github.com/acme/app-", "github.com/acme/app-10"},
+		},
+		{
+			pattern: "github.com/acme/[a-c]*",
+			repos:   []string{"github.com/acme/api", "github.com/acme/cli"},
+			others:  []string{"github.com/acme/web"},
+		},
+	} {
+		entry := defaults(tc.pattern, `{"stamp_vcs": true}`)
+		for _, repo := range tc.repos {
+			if p, _ := applyTo(t, `{"repo_url": "`+repo+`"}`, entry); !p.StampVCS {
+				t.Errorf("%s doesn't match %s", tc.pattern, repo)
+			}
+		}
+		for _, repo := range tc.others {
+			if p, applied := applyTo(t, `{"repo_url": "`+repo+`"}`, entry); p.StampVCS || applied != nil {
+				t.Errorf("%s matches %s", tc.pattern, repo)
+			}
+		}
+	}
+}
+
+// Entries apply in order, later over earlier; any field the request
+// gives, even as its zero value, wins over all of them.
+func TestRepoDefaultsPrecedence(t *testing.T) {
+	entries := []RepoDefaults{
+		defaults("github.com/acme/*", `{"stamp_vcs": true, "priority": "low", "module_dir": "cmd", "labels": {"team": "acme"}}`),
+		defaults("github.com/acme/app", `{"priority": "high", "zip": true, "sparse_paths": ["app", "lib"]}`),
+		defaults("gitlab.com/*/*", `{"debug": true}`),
+	}
+	for _, tc := range []struct {
+		name    string
+		raw     string
+		check   func(RequestPayload) bool
+		applied []string
+	}{
+		{
+			"all defaults",
+			`{"repo_url": "github.com/acme/app"}`,
+			func(p RequestPayload) bool {
+				return p.StampVCS && p.Priority == "high" && p.ModuleDir == "cmd" && p.Zip && !p.Debug &&
+					slices.Equal(p.SparsePaths, []string{"app", "lib"}) && p.Labels["team"] == "acme"
+			},
+			[]string{"labels<-github.com/acme/*", "module_dir<-github.com/acme/*", "priority<-github.com/acme/app", "sparse_paths<-github.com/acme/app", "stamp_vcs<-github.com/acme/*", "zip<-github.com/acme/app"},
+		},
+		{
+			"one entry matches",
+			`{"repo_url": "github.com/acme/tools"}`,
+			func(p RequestPayload) bool { return p.Priority == "low" && !p.Zip },
+			[]string{"labels<-github.com/acme/*", "module_dir<-github.com/acme/*", "priority<-github.com/acme/*", "stamp_vcs<-github.com/acme/*"},
+		},
+		{
+			"request values win",
+			`{"repo_url": "github.com/acme/app", "priority": "normal", "module_dir": "tools", "labels": {"pr": "7"}}`,
+			func(p RequestPayload) bool {
+				return p.Priority == "normal" && p.ModuleDir == "tools" && p.Labels["pr"] == "7" && p.Labels["team"] == ""
+			},
+			[]string{"sparse_paths<-github.com/acme/app", "stamp_vcs<-github.com/acme/*", "zip<-github.com/acme/app"},
+		},
+		{
+			"zero values win",
+			`{"repo_url": "github.com/acme/app", "stamp_vcs": false, "zip": false, "priority": "", "module_dir": null, "sparse_paths": [], "labels": {}}`,
+			func(p RequestPayload) bool {
+				return !p.StampVCS && !p.Zip && p.Priority == "" && p.ModuleDir == "" && len(p.SparsePaths) == 0 && len(p.Labels) == 0
+			},
+			nil,
+		},
+		{
+			"no entry matches",
+			`{"repo_url": "bitbucket.org/acme/app"}`,
+			func(p RequestPayload) bool { return !p.StampVCS && p.Priority == "" },
+			nil,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, applied := applyTo(t, tc.raw, entries...)
+			if !tc.check(p) {
+				t.Errorf("request became %+v", p)
+			}
+			if got := appliedFields(applied); !slices.Equal(got, tc.applied) {
+				t.Errorf("applied %q, want %q", got, tc.applied)
+			}
+		})
+	}
+}
+
+// The target fields go together: naming any of them in the request keeps
+// all of them from the defaults.
+func TestRepoDefaultsTargets(t *testing.T) {
+	entry := defaults("github.com/acme/*", `{"target_os": "windows", "target_arch": "arm64", "targets": ["linux/amd64", "windows/arm64"], "cgo": false}`)
+	for _, tc := range []struct {
+		raw     string
+		applied []string
+	}{
+		{`{"repo_url": "github.com/acme/app"}`, []string{"cgo", "target_arch", "target_os", "targets"}},
+		{`{"repo_url": "github.com/acme/app", "target_os": "linux"}`, []string{"cgo"}},
+		{`{"repo_url": "github.com/acme/app", "target_arch": "amd64"}`, []string{"cgo"}},
+		{`{"repo_url": "github.com/acme/app", "targets": ["linux/arm64"]}`, []string{"cgo"}},
+		{`{"repo_url": "github.com/acme/app", "cgo": true}`, []string{"target_arch", "target_os", "targets"}},
+	} {
+		p, applied := applyTo(t, tc.raw, entry)
+		var fields []string
+		for _, a := range applied {
+			fields = append(fields, a.Field)
+		}
+		if !slices.Equal(fields, tc.applied) {
+			t.Errorf("%s: applied %q, want %q", tc.raw, fields, tc.applied)
+		}
+		if slices.Contains(fields, "targets") != slices.Equal(p.Targets, []string{"linux/amd64", "windows/arm64"}) {
+			t.Errorf("%s: targets %q", tc.raw, p.Targets)
+		}
+	}
+}
+
+// An uploaded patch counts as given; the applied defaults are reported
+// with the values the entry had.
+func TestRepoDefaultsReport(t *testing.T) {
+	entry := defaults("github.com/acme/*", `{"ref": "develop", "compiler_options": {"race": true}}`)
+	p, applied := applyTo(t, `{"repo_url": "github.com/acme/app"}`, entry)
+	if p.Ref != "develop" || p.CompilerOptions == nil || !p.CompilerOptions.race() {
+		t.Errorf("request became %+v", p)
+	}
+	data, _ := json.Marshal(applied)
+	want := `[{"field":"compiler_options","value":{"race":true},"match":"github.com/acme/*"},{"field":"ref","value":"develop","match":"github.com/acme/*"}]`
+	if string(data) != want {
+		t.Errorf("applied defaults %s, want %s", data, want)
+	}
+
+	var withPatch RequestPayload
+	withPatch.RepoURL, withPatch.Patch = "github.com/acme/app", "ZGlmZg=="
+	if _, err := applyRepoDefaults(&withPatch, nil, []RepoDefaults{entry}); err != nil || withPatch.Ref != "develop" {
+		t.Errorf("multipart request: %v, %+v", err, withPatch)
+	}
+	if _, err := applyRepoDefaults(&withPatch, []byte("{not json"), []RepoDefaults{entry}); err == nil {
+		t.Error("invalid request body accepted")
+	}
+}
+
+func TestRepoDefaultsProblems(t *testing.T) {
+	for _, tc := range []struct {
+		entry RepoDefaults
+		want  string // in the only problem; "" for none
+	}{
+		{defaults("github.com/acme/*", `{"stamp_vcs": true, "targets": ["linux/amd64"]}`), ""},
+		{defaults("", `{"zip": true}`), "must be a repository pattern"},
+		{defaults("github.com/acme/[", `{"zip": true}`), "must be a repository pattern"},
+		{defaults("github.com/acme/*", `{"repo_url": "github.com/other/x"}`), "repo_url can't have a default"},
+		{defaults("github.com/acme/*", `{"patch": "ZGlmZg=="}`), "patch can't have a default"},
+		{defaults("github.com/acme/*", `{"package_dir": "cmd"}`), "package_dir"},
+		{defaults("github.com/acme/*", `{"zip": "yes"}`), "zip"},
+	} {
+		problems := tc.entry.problems()
+		switch {
+		case tc.want == "" && problems != nil:
+			t.Errorf("%+v: %q", tc.entry, problems)
+		case tc.want != "" && (len(problems) != 1 || !strings.Contains(problems[0], tc.want)):
+			t.Errorf("%+v: %q, want one about %s", tc.entry, problems, tc.want)
+		}
+	}
+}
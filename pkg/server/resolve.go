@@ -0,0 +1,149 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolution is GET /v1/resolve's answer: the commit a ref points at.
+type Resolution struct {
+	Repo   string `json:"repo"`
+	Ref    string `json:"ref"`
+	Commit string `json:"commit"`
+}
+
+const (
+	resolveCacheTTL  = 30 * time.Second // how long an answer is reused, here and by clients
+	resolvePerMinute = 30               // per caller
+	resolveBurst     = 10
+	resolveEntries   = 1000 // cached answers kept before expired ones are dropped
+)
+
+// resolveCache keeps recent answers so pollers share one ls-remote.
+var resolveCache = struct {
+	sync.Mutex
+	entries map[string]cachedResolution
+}{entries: map[string]cachedResolution{}}
+
+type cachedResolution struct {
+	commit string
+	at     time.Time
+}
+
+var resolveLimiter = newRateLimiter()
+
+// resolveHandler serves GET /v1/resolve?repo=&ref=, the commit a branch,
+// tag or pull request ref currently points at, by git ls-remote. Answers
+// are cached for resolveCacheTTL and the ETag is the commit, so pollers
+// repeating If-None-Match get a 304 until the ref moves.
+func resolveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	// ls-remote reaches out to the git host, so polling has its own limit
+	key := callerID(r)
+	if kind, _, _ := strings.Cut(key, ":"); kind == "anonymous" {
+		key = clientIP(r).String()
+	}
+	if ok, wait := resolveLimiter.allow(key, resolvePerMinute, resolveBurst); !ok {
+		metrics.rateLimited("resolve")
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+		http.Error(w, "Too Many Requests: resolve rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	q := r.URL.Query()
+	repo := canonicalRepo(q.Get("repo"))
+	if !repoPattern.MatchString(repo) {
+		http.Error(w, "repo must be host/owner/name", http.StatusBadRequest)
+		return
+	}
+	ref := cmp.Or(q.Get("ref"), "HEAD")
+	if !validRef(ref) {
+		http.Error(w, "invalid ref", http.StatusBadRequest)
+		return
+	}
+
+	commit, status := resolveRef(r.Context(), repo, ref)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status)+": "+map[int]string{
+			http.StatusNotFound:   "ref " + ref + " not found on remote",
+			http.StatusBadGateway: "repository is not reachable",
+		}[status], status)
+		return
+	}
+	etag := `"` + commit + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(resolveCacheTTL.Seconds())))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Resolution{Repo: repo, Ref: ref, Commit: commit})
+}
+
+// resolveRef looks up ref's commit, from the cache when it's recent. The
+// status is 200, 404 for a ref the remote lacks or 502 when it can't be
+// reached. Commits resolve to themselves.
+func resolveRef(ctx context.Context, repo, ref string) (string, int) {
+	if commitPattern.MatchString(ref) {
+		return ref, http.StatusOK
+	}
+	key := repo + "@" + ref
+	resolveCache.Lock()
+	c, ok := resolveCache.entries[key]
+	resolveCache.Unlock()
+	if ok && time.Since(c.at) < resolveCacheTTL {
+		return c.commit, http.StatusOK
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lsRemoteTimeout)
+	defer cancel()
+	host := hostFor(repo)
+	lookup := host.resolveRef(ref)
+	out, err := host.git(ctx, "ls-remote", "--", RequestPayload{RepoURL: repo}.CloneURL(), lookup).Output()
+	if err != nil {
+		return "", http.StatusBadGateway
+	}
+	// A branch name also matches remote-tracking and same-named tags; the
+	// branch wins, then the tag's commit
+	found := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if sha, name, ok := strings.Cut(line, "\t"); ok {
+			found[name] = sha
+		}
+	}
+	commit := ""
+	for _, name := range []string{lookup, "refs/heads/" + lookup, "refs/tags/" + lookup + "^{}", "refs/tags/" + lookup} {
+		if commit = found[name]; commit != "" {
+			break
+		}
+	}
+	if commit == "" {
+		return "", http.StatusNotFound
+	}
+
+	resolveCache.Lock()
+	if len(resolveCache.entries) >= resolveEntries {
+		for k, c := range resolveCache.entries {
+			if time.Since(c.at) >= resolveCacheTTL {
+				delete(resolveCache.entries, k)
+			}
+		}
+	}
+	resolveCache.entries[key] = cachedResolution{commit: commit, at: time.Now()}
+	resolveCache.Unlock()
+	return commit, http.StatusOK
+}
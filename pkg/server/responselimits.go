@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ResponseLimits are what the platform in front of the server lets one
+// response carry and how long it may run, e.g. on Cloud Run. Artifacts
+// that wouldn't fit are stored and fetched from artifact_url instead of
+// streamed inline. 0 means no limit.
+type ResponseLimits struct {
+	MaxBytes    int64
+	MaxDuration time.Duration
+}
+
+// cloudRunLimits are Cloud Run's response size limit and its default
+// request timeout. A service deployed with a longer timeout should say so
+// with max_response_time.
+var cloudRunLimits = ResponseLimits{MaxBytes: 32 << 20, MaxDuration: 5 * time.Minute}
+
+// transferAllowance is the time left for streaming the artifact when
+// deciding whether a response would run past MaxDuration.
+const transferAllowance = 30 * time.Second
+
+// defaultDataDir is where artifacts are kept unless BILLDER_DATA_DIR says
+// otherwise: on platforms with response limits it is an instance's own
+// scratch space, too short-lived to fall back on.
+var defaultDataDir = filepath.Join(os.TempDir(), "billder-data")
+
+// platformResponseLimits detects the platform the server runs on from its
+// environment and returns its response limits.
+func platformResponseLimits() ResponseLimits {
+	if os.Getenv("K_SERVICE") != "" {
+		return cloudRunLimits
+	}
+	return ResponseLimits{}
+}
+
+// inlineProblem says why an artifact of size bytes can't be streamed
+// within cfg.ResponseLimits, or is "" when it can.
+func (j *buildJob) inlineProblem(size int64) string {
+	l := cfg.ResponseLimits
+	if l.MaxBytes > 0 && size > l.MaxBytes {
+		return fmt.Sprintf("the artifact is %.2f MB and responses are limited to %.2f MB", float64(size)/1024/1024, float64(l.MaxBytes)/1024/1024)
+	}
+	if elapsed := time.Since(j.started); l.MaxDuration > 0 && elapsed+transferAllowance > l.MaxDuration {
+		return fmt.Sprintf("the build took %s and responses are cut off after %s", elapsed.Round(time.Second), l.MaxDuration)
+	}
+	return ""
+}
+
+// place decides how the artifact reaches the client: uploaded to
+// cfg.ArtifactStore when there is one, streamed inline when it fits the
+// response limits, or else kept in the server's store for the client to
+// download from artifact_url. It returns the summary's artifact_url and
+// artifact_sha256, or the error to fail with before anything is sent when
+// the artifact has nowhere to go.
+func (j *buildJob) place(artifact string, size int64, sse *sseWriter) (url, digest, problem string) {
+	var err error
+	why := j.inlineProblem(size)
+	if why != "" && cfg.ArtifactStore != nil {
+		sse.Message("Not streaming the artifact: " + why + ".")
+	}
+	url, digest = j.upload(artifact, sse)
+	if why == "" || j.uploaded {
+		return url, digest, ""
+	}
+	if cfg.DataDir == defaultDataDir {
+		msg := fmt.Sprintf("Artifact too large for inline delivery on this deployment: %s. Configure ARTIFACT_BACKEND or a persistent BILLDER_DATA_DIR.", why)
+		j.log.Printf("error: %s", msg)
+		return "", "", msg
+	}
+	if _, digest, err = fileDigest(artifact); err != nil {
+		return "", "", "Could not read built artifact"
+	}
+	sse.Message("Not streaming the artifact: " + why + "; it is kept on the server for download instead.")
+	j.keptOnly = true
+	return j.artifactURL(), digest, ""
+}
+
+// delivery is the summary's delivery: "stored" when no binary_start follows
+// and the client fetches artifact_url.
+func (j *buildJob) delivery() string {
+	if j.uploaded || j.keptOnly {
+		return "stored"
+	}
+	return ""
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// retentionPolicy is how long, how much and how many of a caller's stored
+// builds the janitor keeps.
+type retentionPolicy struct {
+	owner    string        // token whose overrides apply; "" for the server's policy
+	ttl      time.Duration // age past which a build is evicted
+	maxBytes int64         // the owner's builds together; 0 leaves only the store budget
+	perRepo  int           // newest artifacts kept per repository; 0 keeps any number
+}
+
+// retentionFor is the policy for caller's builds: the server's, with the
+// overrides of caller's token.
+func retentionFor(caller string) retentionPolicy {
+	p := retentionPolicy{ttl: cfg.StoreTTL, perRepo: cfg.StorePerRepo}
+	t, ok := callerToken(caller)
+	if !ok || t.StoreTTLHours == 0 && t.StoreMaxMB == 0 && t.StorePerRepo == 0 {
+		return p
+	}
+	p.owner = t.ID
+	if t.StoreTTLHours > 0 {
+		p.ttl = time.Duration(t.StoreTTLHours) * time.Hour
+	}
+	p.maxBytes = int64(t.StoreMaxMB) << 20
+	if t.StorePerRepo > 0 {
+		p.perRepo = t.StorePerRepo
+	}
+	return p
+}
+
+// storedBuild is a build as retention sees it: its artifact and log, kept
+// or evicted together, and the journal entry that outlives them.
+type storedBuild struct {
+	id       string
+	rec      JobRecord
+	known    bool // rec was read from the journal
+	artifact bool
+	size     int64     // artifact and log bytes
+	mod      time.Time // when the newest of them was written
+	policy   retentionPolicy
+	evicted  bool
+}
+
+// storedBuilds lists the finished builds with an artifact or log in the
+// store, oldest first.
+func storedBuilds() []*storedBuild {
+	byID := map[string]*storedBuild{}
+	add := func(id string, info os.FileInfo, size int64, artifact bool) {
+		liveJobsMu.Lock()
+		live := liveJobs[id]
+		liveJobsMu.Unlock()
+		if live || !buildIDPattern.MatchString(id) {
+			return
+		}
+		b := byID[id]
+		if b == nil {
+			b = &storedBuild{id: id}
+			byID[id] = b
+		}
+		b.size += size
+		b.artifact = b.artifact || artifact
+		if info.ModTime().After(b.mod) {
+			b.mod = info.ModTime()
+		}
+	}
+	entries, _ := os.ReadDir(storePath(dataDir(), "artifacts"))
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && e.IsDir() {
+			add(e.Name(), info, dirSize(artifactDir(e.Name())), true)
+		}
+	}
+	entries, _ = os.ReadDir(storePath(dataDir(), "logs"))
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".log")
+		if info, err := e.Info(); ok && err == nil && info.Mode().IsRegular() {
+			add(id, info, info.Size(), false)
+		}
+	}
+
+	var builds []*storedBuild
+	for _, b := range byID {
+		rec, err := loadJob(b.id)
+		b.rec, b.known = rec, err == nil
+		b.policy = retentionFor(rec.Caller)
+		builds = append(builds, b)
+	}
+	slices.SortFunc(builds, func(a, b *storedBuild) int { return a.mod.Compare(b.mod) })
+	return builds
+}
+
+// evict removes b's artifact and log and notes why in its journal entry.
+func (b *storedBuild) evict(reason string) {
+	os.RemoveAll(artifactDir(b.id))
+	os.Remove(logPath(b.id))
+	b.evicted = true
+	log.Printf("Retention: evicted build %s of %s (%d bytes, %s old): %s", b.id, cmp.Or(b.rec.Payload.RepoURL, "an unknown repository"), b.size, time.Since(b.mod).Round(time.Minute), reason)
+	metrics.buildEvicted(reason, b.size)
+	if b.known {
+		updateJob(b.id, func(rec *JobRecord) { rec.Evicted = &Eviction{At: time.Now(), Reason: reason} })
+	}
+}
+
+// applyRetention evicts builds past their policy, oldest first within
+// each constraint: age, then artifacts per repository, then each token's
+// budget. Pinned builds are exempt from all of them. It returns the builds
+// still stored, oldest first, for the store budget.
+func applyRetention() []*storedBuild {
+	builds := storedBuilds()
+	var kept []*storedBuild
+	for _, b := range builds {
+		if !b.rec.Pinned && time.Since(b.mod) > b.policy.ttl {
+			b.evict("max_age")
+			continue
+		}
+		kept = append(kept, b)
+	}
+
+	// Newest first, so the oldest beyond the limit go
+	perRepo := map[string]int{}
+	for i := len(kept) - 1; i >= 0; i-- {
+		b := kept[i]
+		if b.rec.Pinned || !b.artifact || b.policy.perRepo == 0 {
+			continue
+		}
+		key := b.policy.owner + "\x00" + b.rec.Payload.RepoURL
+		if perRepo[key]++; perRepo[key] > b.policy.perRepo {
+			b.evict("max_per_repo")
+		}
+	}
+
+	used := map[string]int64{}
+	for _, b := range kept {
+		if !b.evicted && b.policy.maxBytes > 0 {
+			used[b.policy.owner] += b.size
+		}
+	}
+	for _, b := range kept {
+		if b.evicted || b.rec.Pinned || b.policy.maxBytes == 0 || used[b.policy.owner] <= b.policy.maxBytes {
+			continue
+		}
+		used[b.policy.owner] -= b.size
+		b.evict("token_budget")
+	}
+	return slices.DeleteFunc(kept, func(b *storedBuild) bool { return b.evicted })
+}
+
+// expireJournal removes the journal entries of builds with nothing left in
+// the store once they're a retention period old. Evicting a build rewrote
+// its entry, so its eviction stays visible for that long.
+func expireJournal(stored []*storedBuild) {
+	keep := map[string]bool{}
+	for _, b := range stored {
+		keep[b.id] = true
+	}
+	entries, _ := os.ReadDir(storePath(dataDir(), "jobs"))
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || keep[id] || !buildIDPattern.MatchString(id) {
+			continue
+		}
+		liveJobsMu.Lock()
+		live := liveJobs[id]
+		liveJobsMu.Unlock()
+		info, err := e.Info()
+		if live || err != nil {
+			continue
+		}
+		rec, err := loadJob(id)
+		if err == nil && (rec.Pinned || rec.State == jobRunning || rec.State == jobRequeued) {
+			continue
+		}
+		if time.Since(info.ModTime()) > retentionFor(rec.Caller).ttl {
+			os.Remove(jobPath(id))
+			os.Remove(provenancePath(id))
+			os.Remove(licensesPath(id, ".json"))
+			os.Remove(licensesPath(id, ".txt"))
+		}
+	}
+}
+
+// pinHandler serves POST and DELETE /v1/builds/{id}/pin, which exempt a
+// finished build from retention and lift that again. The admin token and
+// the credential that started the build may do either.
+func pinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	admin := isAdmin(r)
+	if !admin && !authorized(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	if !buildIDPattern.MatchString(id) {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	rec, err := loadJob(id)
+	if err != nil {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	by := callerID(r)
+	if admin {
+		by = "admin"
+	} else if by != rec.Caller {
+		http.Error(w, "Forbidden: only the admin token or the build's own credential may pin it", http.StatusForbidden)
+		return
+	}
+	if rec.State != jobFinished {
+		http.Error(w, "The build hasn't finished; pin it once it has", http.StatusConflict)
+		return
+	}
+	if rec.Evicted != nil && r.Method == "POST" {
+		http.Error(w, "The build's artifact was already evicted ("+rec.Evicted.Reason+")", http.StatusGone)
+		return
+	}
+	pin := r.Method == "POST"
+	rec, err = updateJob(id, func(rec *JobRecord) {
+		rec.Pinned, rec.PinnedBy = pin, ""
+		if pin {
+			rec.PinnedBy = by
+		}
+	})
+	if err != nil {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	if pin {
+		log.Printf("Build %s pinned by %s", id, by)
+	} else {
+		log.Printf("Build %s unpinned by %s", id, by)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
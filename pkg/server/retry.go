@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// permanentFailures mark git and go output that no retry will fix: a
+// missing repository, module or ref, or credentials that were refused.
+// They're checked before transientFailures, since a 404 page can mention
+// anything.
+var permanentFailures = []string{
+	"repository not found",
+	"not found",
+	"error: 404",
+	"404 not found",
+	"410 gone",
+	"authentication failed",
+	"could not read username",
+	"terminal prompts disabled",
+	"permission denied",
+	"error: 401",
+	"error: 403",
+	"403 forbidden",
+	"does not appear to be a git repository",
+	"unknown revision",
+	"invalid version",
+	"checksum mismatch",
+	"security error",
+}
+
+// transientFailures map network errors worth retrying to the short reason
+// announced to the client.
+var transientFailures = []struct{ match, reason string }{
+	{"connection reset", "connection reset"},
+	{"connection refused", "connection refused"},
+	{"couldn't connect to server", "connection refused"},
+	{"connection timed out", "connection timed out"},
+	{"i/o timeout", "timeout"},
+	{"tls handshake timeout", "TLS handshake timeout"},
+	{"operation timed out", "timeout"},
+	{"could not resolve host", "DNS lookup failed"},
+	{"temporary failure in name resolution", "DNS lookup failed"},
+	{"no such host", "DNS lookup failed"},
+	{"network is unreachable", "network unreachable"},
+	{"remote end hung up unexpectedly", "connection dropped"},
+	{"early eof", "connection dropped"},
+	{"unexpected eof", "connection dropped"},
+	{"rpc failed", "connection dropped"},
+	{"502 bad gateway", "502 Bad Gateway"},
+	{"error: 502", "502 Bad Gateway"},
+	{"503 service unavailable", "503 Service Unavailable"},
+	{"error: 503", "503 Service Unavailable"},
+	{"504 gateway timeout", "504 Gateway Timeout"},
+	{"error: 504", "504 Gateway Timeout"},
+	{"429 too many requests", "rate limited"},
+	{"error: 429", "rate limited"},
+}
+
+// transientFailure reports whether out describes a failure a retry may
+// fix, and why. Anything unrecognized counts as permanent.
+func transientFailure(out []byte) (string, bool) {
+	text := strings.ToLower(string(out))
+	for _, p := range permanentFailures {
+		if strings.Contains(text, p) {
+			return "", false
+		}
+	}
+	for _, t := range transientFailures {
+		if strings.Contains(text, t.match) {
+			return t.reason, true
+		}
+	}
+	return "", false
+}
+
+// runRetrying runs the command newCmd makes, making a fresh one after each
+// transient failure, up to cfg.StepRetries more times with exponential
+// backoff. Every attempt is logged, every retry announced as "<what>
+// failed (<reason>), retrying 1/2...". No retry starts that the build's
+// timeout would cut short. Only the clone and dependency steps use it;
+// compiles are never retried.
+func (j *buildJob) runRetrying(sse *sseWriter, what string, newCmd func() *exec.Cmd) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		cmd := newCmd()
+		release := holdModCache(cmd)
+		out, err := cmd.CombinedOutput()
+		release()
+		j.log.Command("", cmd, out, err)
+		if err == nil || attempt >= cfg.StepRetries || j.ctx.Err() != nil {
+			return out, err
+		}
+		reason, ok := transientFailure(out)
+		if !ok {
+			return out, err
+		}
+		wait := cfg.RetryBackoff << attempt
+		if deadline, ok := j.ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return out, err
+		}
+		sse.Message(fmt.Sprintf("%s failed (%s), retrying %d/%d...", what, reason, attempt+1, cfg.StepRetries))
+		j.log.Printf("%s failed (%s), retrying in %s", what, reason, wait)
+		select {
+		case <-j.ctx.Done():
+			return out, err
+		case <-time.After(wait):
+		}
+	}
+}
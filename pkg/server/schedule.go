@@ -0,0 +1,206 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Schedule is a build the server starts on its own, from the "schedules"
+// list of the config file.
+type Schedule struct {
+	Name  string         `json:"name"`
+	Cron  string         `json:"cron"` // minute hour day month weekday, server local time
+	Build RequestPayload `json:"build"`
+}
+
+var scheduleNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ScheduleStatus is one entry of the GET /v1/schedules response.
+type ScheduleStatus struct {
+	Name        string     `json:"name"`
+	Cron        string     `json:"cron"`
+	Repo        string     `json:"repo"`
+	Targets     []string   `json:"targets"`
+	Running     bool       `json:"running"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	LastBuildID string     `json:"last_build_id,omitempty"`
+	LastOK      *bool      `json:"last_ok,omitempty"` // unset until a run finishes
+	NextRun     time.Time  `json:"next_run"`
+}
+
+// scheduledBuild is a Schedule and the state of its runs.
+type scheduledBuild struct {
+	Schedule
+	spec *cronSpec
+
+	mu        sync.Mutex
+	running   bool
+	lastRun   time.Time
+	lastBuild string
+	lastOK    *bool
+}
+
+var (
+	schedulesMu   sync.Mutex
+	schedules     []*scheduledBuild
+	schedulesStop chan struct{} // closed when New replaces the schedules
+)
+
+// startSchedules validates the configured schedules and starts a timer
+// loop for each, stopping those of a previous New.
+func startSchedules(list []Schedule) {
+	schedulesMu.Lock()
+	defer schedulesMu.Unlock()
+	if schedulesStop != nil {
+		close(schedulesStop)
+	}
+	schedulesStop = make(chan struct{})
+	schedules = nil
+	for _, s := range list {
+		spec, err := parseCron(s.Cron)
+		if err == nil {
+			err = s.Build.normalize(false)
+		}
+		if err != nil {
+			log.Printf("Schedule %s disabled: %v", s.Name, err)
+			continue
+		}
+		sb := &scheduledBuild{Schedule: s, spec: spec}
+		schedules = append(schedules, sb)
+		go sb.loop(schedulesStop)
+	}
+}
+
+func (sb *scheduledBuild) loop(stop <-chan struct{}) {
+	for {
+		next := sb.spec.next(time.Now())
+		if next.IsZero() {
+			log.Printf("Schedule %s never fires again", sb.Name)
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			sb.trigger()
+		}
+	}
+}
+
+// trigger starts a run unless the previous one is still going, returning
+// the new build's id, or the running one's and false.
+func (sb *scheduledBuild) trigger() (string, bool) {
+	sb.mu.Lock()
+	if sb.running {
+		id := sb.lastBuild
+		sb.mu.Unlock()
+		log.Printf("Schedule %s: skipping run, build %s is still running", sb.Name, id)
+		return id, false
+	}
+	id := newBuildID()
+	sb.running, sb.lastRun, sb.lastBuild = true, time.Now(), id
+	sb.mu.Unlock()
+
+	log.Printf("Schedule %s: starting build %s", sb.Name, id)
+	go func() {
+		ok := runHeadless(JobRecord{ID: id, Origin: "scheduled", Caller: "schedule:" + sb.Name, Payload: sb.Build})
+		if !ok {
+			log.Printf("Schedule %s: build %s failed; see /%s/builds/%s/log", sb.Name, id, apiVersion, id)
+		}
+		sb.mu.Lock()
+		sb.running, sb.lastOK = false, &ok
+		sb.mu.Unlock()
+	}()
+	return id, true
+}
+
+func (sb *scheduledBuild) status() ScheduleStatus {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	st := ScheduleStatus{
+		Name:        sb.Name,
+		Cron:        sb.Cron,
+		Repo:        sb.Build.RepoURL,
+		Targets:     sb.Build.Targets,
+		Running:     sb.running,
+		LastBuildID: sb.lastBuild,
+		LastOK:      sb.lastOK,
+		NextRun:     sb.spec.next(time.Now()),
+	}
+	if !sb.lastRun.IsZero() {
+		last := sb.lastRun
+		st.LastRun = &last
+	}
+	return st
+}
+
+func lookupSchedule(name string) *scheduledBuild {
+	schedulesMu.Lock()
+	defer schedulesMu.Unlock()
+	for _, sb := range schedules {
+		if sb.Name == name {
+			return sb
+		}
+	}
+	return nil
+}
+
+// schedulesHandler serves GET /v1/schedules.
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	schedulesMu.Lock()
+	list := make([]ScheduleStatus, 0, len(schedules))
+	for _, sb := range schedules {
+		list = append(list, sb.status())
+	}
+	schedulesMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// runScheduleHandler serves POST /v1/schedules/{name}/run, which starts a
+// run now. A run already in progress answers 409 like a duplicate build.
+func runScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	sb := lookupSchedule(r.PathValue("name"))
+	if sb == nil {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	id, started := sb.trigger()
+	if !started {
+		sb.mu.Lock()
+		since := sb.lastRun
+		sb.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(BuildConflict{
+			Error:     "the previous run of this schedule is still going",
+			BuildID:   id,
+			StartedAt: since,
+			EventsURL: "/" + apiVersion + "/builds/" + id + "/events",
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(JobStarted{BuildID: id, EventsURL: "/" + apiVersion + "/builds/" + id + "/events"})
+}
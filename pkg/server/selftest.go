@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The self-test compiles these for every target, needing nothing from the
+// network, so a misbuilt image is caught before a user's build is.
+const (
+	selfTestMain = `package main
+
+import "fmt"
+
+func main() { fmt.Println("hello from billder") }
+`
+	selfTestCgoMain = `package main
+
+// int answer(void) { return 42; }
+import "C"
+
+import "fmt"
+
+func main() { fmt.Println("hello from billder", C.answer()) }
+`
+	selfTestTimeout = 2 * time.Minute // per compile; a cold cache builds the standard library
+	selfTestOutput  = 4096            // bytes of a failing compile's output kept
+)
+
+// SelfTestReport is the outcome of compiling a hello-world for each target,
+// with cgo and without.
+type SelfTestReport struct {
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at"`
+	OK         bool             `json:"ok"`
+	Results    []SelfTestResult `json:"results"`
+}
+
+// SelfTestResult is one target's compile, with cgo or without.
+type SelfTestResult struct {
+	Target  string  `json:"target"`
+	Cgo     bool    `json:"cgo"`
+	OK      bool    `json:"ok"`
+	Seconds float64 `json:"seconds"`
+	Command string  `json:"command,omitempty"` // set when it failed
+	Output  string  `json:"output,omitempty"`  // the end of the failing command's output
+	Hint    string  `json:"hint,omitempty"`    // how to fix the image
+}
+
+// selfTest holds the latest report; running is set while one is underway.
+var selfTest struct {
+	sync.Mutex
+	report  *SelfTestReport
+	running bool
+}
+
+var errSelfTestRunning = errors.New("a self-test is already running")
+
+// runSelfTest compiles the hello-worlds for every allowed target and
+// records the report. Android is left out: its builds go through gomobile,
+// whose presence the android capability already reports.
+func runSelfTest() (SelfTestReport, error) {
+	selfTest.Lock()
+	if selfTest.running {
+		selfTest.Unlock()
+		return SelfTestReport{}, errSelfTestRunning
+	}
+	selfTest.running = true
+	selfTest.Unlock()
+	defer func() {
+		selfTest.Lock()
+		selfTest.running = false
+		selfTest.Unlock()
+	}()
+
+	report := SelfTestReport{StartedAt: time.Now(), OK: true}
+	dir, err := os.MkdirTemp("", "billder-selftest-*")
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(dir)
+	for name, src := range map[string]string{"nocgo": selfTestMain, "cgo": selfTestCgoMain} {
+		os.MkdirAll(filepath.Join(dir, name), 0o755)
+		os.WriteFile(filepath.Join(dir, name, "go.mod"), []byte("module billder.local/selftest\n\ngo 1.21\n"), 0o644)
+		if err := os.WriteFile(filepath.Join(dir, name, "main.go"), []byte(src), 0o644); err != nil {
+			return report, err
+		}
+	}
+
+	for _, target := range currentPolicy().targets {
+		goos, goarch, _ := strings.Cut(target, "/")
+		if goos == "android" {
+			continue
+		}
+		for _, cgo := range []bool{false, true} {
+			r := selfTestCompile(dir, goos, goarch, cgo)
+			report.OK = report.OK && r.OK
+			report.Results = append(report.Results, r)
+			if !r.OK {
+				log.Printf("Self-test: %s cgo=%t failed: %s", r.Target, r.Cgo, r.Hint)
+			}
+		}
+	}
+	report.FinishedAt = time.Now()
+	log.Printf("Self-test %s in %s", map[bool]string{true: "passed", false: "failed"}[report.OK], report.FinishedAt.Sub(report.StartedAt).Round(time.Second))
+
+	selfTest.Lock()
+	selfTest.report = &report
+	selfTest.Unlock()
+	return report, nil
+}
+
+// selfTestCompile builds one hello-world into dir.
+func selfTestCompile(dir, goos, goarch string, cgo bool) SelfTestResult {
+	tc, _ := toolchainFor(goos, goarch)
+	tc.NoCgo = !cgo
+	r := SelfTestResult{Target: goos + "/" + goarch, Cgo: cgo}
+	src := filepath.Join(dir, map[bool]string{true: "cgo", false: "nocgo"}[cgo])
+	out := filepath.Join(dir, "out", fmt.Sprintf("%s_%s_%t", goos, goarch, cgo))
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", out, ".")
+	cmd.Dir = src
+	cmd.Env = tc.Env()
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	r.Seconds = time.Since(start).Seconds()
+	if err == nil {
+		r.OK = true
+		return r
+	}
+	r.Command = strings.Join(append(tc.Vars()[:3], cmd.Args...), " ")
+	text := strings.TrimSpace(string(output))
+	if text == "" {
+		text = err.Error()
+	}
+	if len(text) > selfTestOutput {
+		text = "..." + text[len(text)-selfTestOutput:]
+	}
+	r.Output = secrets.Redact(text)
+	r.Hint = selfTestHint(tc, text, ctx.Err() != nil)
+	return r
+}
+
+// selfTestHint suggests a fix for a failed compile.
+func selfTestHint(tc Toolchain, output string, timedOut bool) string {
+	target := tc.GOOS + "/" + tc.GOARCH
+	switch {
+	case timedOut:
+		return fmt.Sprintf("compiling took longer than %s; check the server's CPU and disk", selfTestTimeout)
+	case strings.Contains(output, `"go": executable file not found`):
+		return "the go toolchain isn't on PATH; install Go in the image"
+	case !tc.NoCgo && !tc.installed():
+		pkg := map[string]string{
+			"gcc":                       "gcc (build-essential)",
+			"x86_64-w64-mingw32-gcc":    "gcc-mingw-w64-x86-64",
+			"aarch64-w64-mingw32-clang": "llvm-mingw (https://github.com/mstorsjo/llvm-mingw)",
+		}[tc.CC]
+		if pkg == "" {
+			pkg = "a C compiler providing it"
+		}
+		return fmt.Sprintf("C compiler %s isn't installed; install %s, or leave %s out of ALLOWED_TARGETS", tc.CC, pkg, target)
+	case strings.Contains(output, "permission denied") || strings.Contains(output, "read-only file system"):
+		return fmt.Sprintf("the build cache %s or the temp directory isn't writable; check the volume mounts", tc.CacheDir())
+	case !tc.NoCgo:
+		return fmt.Sprintf("%s is installed but can't build for %s; check its headers and libraries", tc.CC, target)
+	}
+	return fmt.Sprintf("go build for %s failed; its output is in the self-test report at /readyz", target)
+}
+
+// selfTestFailure is why the last self-test failed for target, with cgo or
+// without, or "" when it passed or hasn't run.
+func selfTestFailure(target string, cgo bool) string {
+	selfTest.Lock()
+	defer selfTest.Unlock()
+	if selfTest.report == nil {
+		return ""
+	}
+	for _, r := range selfTest.report.Results {
+		if r.Target == target && r.Cgo == cgo && !r.OK {
+			return r.Hint
+		}
+	}
+	return ""
+}
+
+// availableTargets are the allowed targets the last self-test didn't fail
+// without cgo.
+func availableTargets() []string {
+	var targets []string
+	for _, t := range currentPolicy().targets {
+		if selfTestFailure(t, false) == "" {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// lastSelfTest is the latest self-test report, or nil.
+func lastSelfTest() *SelfTestReport {
+	selfTest.Lock()
+	defer selfTest.Unlock()
+	return selfTest.report
+}
+
+// ready reports whether the server should take builds, and why not. Only
+// with self_test "required" does the self-test hold readiness back; a
+// server shutting down is never ready.
+func ready() (bool, string) {
+	if shuttingDown.Load() {
+		return false, "the server is shutting down"
+	}
+	if cfg.SelfTest != "required" {
+		return true, ""
+	}
+	selfTest.Lock()
+	defer selfTest.Unlock()
+	switch {
+	case selfTest.report == nil:
+		return false, "the startup self-test hasn't finished"
+	case !selfTest.report.OK:
+		var failed []string
+		for _, r := range selfTest.report.Results {
+			if !r.OK {
+				failed = append(failed, fmt.Sprintf("%s cgo=%t", r.Target, r.Cgo))
+			}
+		}
+		return false, "the self-test failed for " + strings.Join(failed, ", ")
+	}
+	return true, ""
+}
+
+// Readiness is the /readyz response.
+type Readiness struct {
+	Ready    bool            `json:"ready"`
+	Reason   string          `json:"reason,omitempty"`
+	SelfTest *SelfTestReport `json:"self_test,omitempty"`
+}
+
+// readyzHandler serves GET /readyz: 200 once the server can take builds,
+// 503 before. Like /metrics it needs no token.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ok, reason := ready()
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(Readiness{Ready: ok, Reason: reason, SelfTest: lastSelfTest()})
+}
+
+// selfTestHandler serves POST /admin/selftest, running the self-test now
+// and answering with its report.
+func selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := runSelfTest()
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case errors.Is(err, errSelfTestRunning):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
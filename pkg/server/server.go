@@ -0,0 +1,503 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options configures the handler returned by New.
+type Options struct {
+	Tokens            []Token       // accepted credentials; none (and no OIDC) means open
+	AuthMaxSkew       time.Duration // allowed clock drift for signed requests
+	OIDCAudience      string        // enables Google ID token auth
+	OIDCAllowedEmails []string
+
+	MaxConcurrentCompiles int           // compiles running at once across all builds
+	BuildTimeout          time.Duration // 0 means no limit
+	BodyTimeout           time.Duration // to receive a build request's body
+	WriteTimeout          time.Duration // for each write of a build stream; a stalled reader cancels the build
+	StepRetries           int           // extra attempts of the clone and dependency steps after a network error
+	RetryBackoff          time.Duration // wait before the first retry, doubling after each
+
+	CacheDir      string // GOCACHE root, partitioned per target; "" uses `go env GOCACHE`
+	MirrorDir     string // bare git mirrors builds clone from; "" clones from upstream every time
+	DataDir       string // persisted build logs
+	HistoryFile   string // past build stats used for progress estimates
+	StoreTTL      time.Duration
+	StoreMaxBytes int64
+	StorePerRepo  int // stored artifacts kept per repository; 0 keeps any number
+
+	MaxArtifactBytes int64  // larger artifacts aren't delivered; 0 means no limit; tokens may override
+	MaxCmdsPerBuild  int    // commands under cmd/ a build_all_cmds build may compile
+	MaxLFSBytes      int64  // git-lfs files a build may pull; 0 means no limit
+	ClamdSocket      string // clamd that av_check builds are scanned with; "" runs the heuristics alone
+	ClientDir        string // client release served at /v1/client/latest; "" serves none
+
+	PayloadLimits PayloadLimits // the most one build request may ask for
+
+	GoProxy          string // GOPROXY for builds' module operations; "" keeps the environment's
+	GoSumDB          string
+	GoFlags          string
+	ModProxy         bool  // serve a module proxy on loopback from the module cache and put it first in builds' GOPROXY
+	ModProxyMaxBytes int64 // size of the proxy's own module cache past which it stops downloading
+
+	AndroidKeystore     string // release keystore APKs are signed with; "" leaves the packager's debug signature
+	AndroidKeyAlias     string
+	AndroidKeystorePass string
+
+	AttestationKey ed25519.PrivateKey // signs build provenance; nil delivers none
+
+	EventBufferEvents int   // events kept per build for clients that attach late
+	EventBufferBytes  int64 // and their total size
+
+	OutputRate OutputRate // how fast a build's compiler output is forwarded
+
+	ResponseLimits ResponseLimits // the platform's; artifacts past them are stored rather than streamed
+
+	AllowedTargets  []string // subset of the built-in os/arch targets
+	CgoRequirements []CgoRequirement
+	RedactSecrets   []string
+
+	RateLimit      RateLimit
+	TrustedProxies []netip.Prefix // peers whose X-Forwarded-For/Forwarded are believed
+
+	AdminToken string                   // enables /admin and /debug endpoints for X-Billder-Admin-Token
+	Reloader   func() ([]Option, error) // source of the policy for Reload
+
+	ClusterToken string // non-empty makes this instance a coordinator
+	FakeBuilds   bool   // honor /build?fake=1 with a canned stream
+	SelfTest     string // "on" compiles a hello-world per target at startup, "required" also holds /readyz until it passes
+
+	PublicBadges bool // serve /badge without a token
+
+	ArtifactStore  BlobStore     // artifacts are uploaded here and fetched from a presigned artifact_url; nil streams them
+	ArtifactURLTTL time.Duration // how long that URL works
+
+	OTLPEndpoint string    // OTLP/HTTP collector for build traces; "" disables tracing
+	Publisher    Publisher // receives a message as each build starts, steps and finishes; nil publishes nothing
+
+	Schedules []Schedule // builds started on a cron schedule
+	Hosts     []GitHost  // git servers beyond the well-known ones, and their credentials
+
+	RepoDefaults []RepoDefaults // request fields filled in per repository
+}
+
+// Option changes one setting.
+type Option func(*Options)
+
+// WithTokens sets the accepted shared tokens and HMAC keys.
+func WithTokens(tokens ...Token) Option {
+	return func(o *Options) { o.Tokens = append(o.Tokens, tokens...) }
+}
+
+// WithAuthMaxSkew sets how far a signed request's timestamp may drift.
+func WithAuthMaxSkew(d time.Duration) Option {
+	return func(o *Options) { o.AuthMaxSkew = d }
+}
+
+// WithOIDC accepts Google ID tokens for audience from the listed emails.
+func WithOIDC(audience string, emails ...string) Option {
+	return func(o *Options) { o.OIDCAudience, o.OIDCAllowedEmails = audience, emails }
+}
+
+// WithMaxConcurrentCompiles bounds compiles across every build.
+func WithMaxConcurrentCompiles(n int) Option {
+	return func(o *Options) { o.MaxConcurrentCompiles = n }
+}
+
+// WithClientTimeouts bounds how long a client may take to send a build
+// request's body, and to accept each write of the stream back.
+func WithClientTimeouts(body, write time.Duration) Option {
+	return func(o *Options) { o.BodyTimeout, o.WriteTimeout = body, write }
+}
+
+// WithStepRetries retries clones, fetches and module downloads that fail
+// on a network error up to n times, waiting backoff, then twice as long,
+// and so on. Compiles are never retried.
+func WithStepRetries(n int, backoff time.Duration) Option {
+	return func(o *Options) { o.StepRetries, o.RetryBackoff = n, backoff }
+}
+
+// WithBuildTimeout cancels builds that run longer than d.
+func WithBuildTimeout(d time.Duration) Option {
+	return func(o *Options) { o.BuildTimeout = d }
+}
+
+// WithCacheDir sets the GOCACHE root.
+func WithCacheDir(dir string) Option {
+	return func(o *Options) { o.CacheDir = dir }
+}
+
+// WithGitMirrors keeps a bare mirror of every repository built under dir.
+// Builds fetch the mirror and clone from it, so they survive brief upstream
+// outages and can skip the remote entirely with refresh set to false.
+func WithGitMirrors(dir string) Option {
+	return func(o *Options) { o.MirrorDir = dir }
+}
+
+// WithDataDir sets where build logs are persisted.
+func WithDataDir(dir string) Option {
+	return func(o *Options) { o.DataDir = dir }
+}
+
+// WithHistoryFile sets the build history database path.
+func WithHistoryFile(path string) Option {
+	return func(o *Options) { o.HistoryFile = path }
+}
+
+// WithRetention sets how long and how much persisted data is kept.
+func WithRetention(ttl time.Duration, maxBytes int64) Option {
+	return func(o *Options) { o.StoreTTL, o.StoreMaxBytes = ttl, maxBytes }
+}
+
+// WithArtifactsPerRepo keeps only the newest n stored artifacts of each
+// repository.
+func WithArtifactsPerRepo(n int) Option {
+	return func(o *Options) { o.StorePerRepo = n }
+}
+
+// WithMaxArtifactSize refuses to deliver artifacts, or bundles after
+// compression, larger than maxBytes.
+func WithMaxArtifactSize(maxBytes int64) Option {
+	return func(o *Options) { o.MaxArtifactBytes = maxBytes }
+}
+
+// WithMaxCmdsPerBuild fails build_all_cmds builds of repositories with
+// more than n commands under cmd/, before compiling any.
+func WithMaxCmdsPerBuild(n int) Option {
+	return func(o *Options) { o.MaxCmdsPerBuild = n }
+}
+
+// WithPayloadLimits caps how many targets a request may list and how large
+// its body may be. Zero fields keep the defaults.
+func WithPayloadLimits(l PayloadLimits) Option {
+	return func(o *Options) { o.PayloadLimits = l }
+}
+
+// WithClamd has av_check builds scanned by the ClamAV daemon at addr, a
+// unix socket path or tcp://host:port.
+func WithClamd(addr string) Option {
+	return func(o *Options) { o.ClamdSocket = addr }
+}
+
+// WithClientReleases serves the client binaries in dir, with the version in
+// its VERSION file, for `client self-update --source server`.
+func WithClientReleases(dir string) Option {
+	return func(o *Options) { o.ClientDir = dir }
+}
+
+// WithModules sets GOPROXY (a comma or pipe separated fallback list),
+// GOSUMDB and GOFLAGS for builds. Empty values keep the environment's.
+func WithModules(proxy, sumdb, flags string) Option {
+	return func(o *Options) { o.GoProxy, o.GoSumDB, o.GoFlags = proxy, sumdb, flags }
+}
+
+// WithModuleProxy serves the GOPROXY protocol on a loopback port of its own
+// from the shared module cache, downloading misses from upstream while the
+// cache is under maxBytes. Builds try it first.
+func WithModuleProxy(maxBytes int64) Option {
+	return func(o *Options) { o.ModProxy, o.ModProxyMaxBytes = true, maxBytes }
+}
+
+// WithAndroidKeystore signs APKs with the key alias from a release
+// keystore instead of a debug key.
+func WithAndroidKeystore(path, alias, password string) Option {
+	return func(o *Options) { o.AndroidKeystore, o.AndroidKeyAlias, o.AndroidKeystorePass = path, alias, password }
+}
+
+// WithAttestationKey signs a provenance statement for every delivered
+// artifact with key, served at /v1/builds/{id}/provenance and bundled in
+// zips. Verifiers get the public key from /v1/attestation/publickey.
+func WithAttestationKey(key ed25519.PrivateKey) Option {
+	return func(o *Options) { o.AttestationKey = key }
+}
+
+// WithEventBuffer bounds the events kept per build for replay.
+func WithEventBuffer(events int, bytes int64) Option {
+	return func(o *Options) { o.EventBufferEvents, o.EventBufferBytes = events, bytes }
+}
+
+// WithMaxLFSSize bounds the total size of the git-lfs files one build may
+// pull; 0 means no limit.
+func WithMaxLFSSize(n int64) Option {
+	return func(o *Options) { o.MaxLFSBytes = n }
+}
+
+// WithResponseLimits sets what one response may carry and how long it may
+// run, overriding the limits detected for the platform.
+func WithResponseLimits(l ResponseLimits) Option {
+	return func(o *Options) { o.ResponseLimits = l }
+}
+
+// WithOutputRate bounds how many "output" events a build sends a second
+// and how many bytes of output they carry.
+func WithOutputRate(r OutputRate) Option {
+	return func(o *Options) { o.OutputRate = r }
+}
+
+// WithAllowedTargets restricts builds to the listed os/arch targets.
+func WithAllowedTargets(targets ...string) Option {
+	return func(o *Options) { o.AllowedTargets = targets }
+}
+
+// WithCgoRequirements adds C dependency checks to the built-in table.
+func WithCgoRequirements(reqs ...CgoRequirement) Option {
+	return func(o *Options) { o.CgoRequirements = append(o.CgoRequirements, reqs...) }
+}
+
+// WithRedactedSecrets scrubs values from streamed and stored output.
+func WithRedactedSecrets(values ...string) Option {
+	return func(o *Options) { o.RedactSecrets = append(o.RedactSecrets, values...) }
+}
+
+// WithRateLimit limits build requests per client IP and overall.
+func WithRateLimit(limit RateLimit) Option {
+	return func(o *Options) { o.RateLimit = limit }
+}
+
+// WithTrustedProxies believes forwarding headers from peers in prefixes.
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(o *Options) { o.TrustedProxies = append(o.TrustedProxies, prefixes...) }
+}
+
+// WithAdminToken enables the /admin and /debug endpoints (reload, pprof,
+// runtime status) for callers presenting token in X-Billder-Admin-Token.
+// Build tokens are not accepted there.
+func WithAdminToken(token string) Option {
+	return func(o *Options) { o.AdminToken = token }
+}
+
+// WithReloader sets where Reload (SIGHUP in the billder command, or
+// POST /admin/reload) gets the new configuration, e.g. OptionsFromEnv.
+func WithReloader(load func() ([]Option, error)) Option {
+	return func(o *Options) { o.Reloader = load }
+}
+
+// WithCoordinator makes the handler dispatch builds to workers that
+// register with token (see RunWorker).
+func WithCoordinator(token string) Option {
+	return func(o *Options) { o.ClusterToken = token }
+}
+
+// WithFakeBuilds lets clients request a canned build with /build?fake=1.
+func WithFakeBuilds() Option {
+	return func(o *Options) { o.FakeBuilds = true }
+}
+
+// WithPublicBadges serves /badge without a token, so READMEs can embed it.
+// Badges show only whether a repository's latest build passed.
+func WithPublicBadges() Option {
+	return func(o *Options) { o.PublicBadges = true }
+}
+
+// WithArtifactStore uploads delivered artifacts to store instead of
+// streaming them. Builds announce a presigned artifact_url that works for
+// ttl; the server keeps its own copy for /v1/builds/{id}/artifact as
+// before.
+func WithArtifactStore(store BlobStore, ttl time.Duration) Option {
+	return func(o *Options) { o.ArtifactStore, o.ArtifactURLTTL = store, ttl }
+}
+
+// WithSelfTest compiles a hello-world for every target, with cgo and
+// without, at startup. Targets that fail are advertised as unavailable and
+// refused. With required set, /readyz answers 503 until the self-test
+// passes.
+func WithSelfTest(required bool) Option {
+	return func(o *Options) {
+		o.SelfTest = "on"
+		if required {
+			o.SelfTest = "required"
+		}
+	}
+}
+
+// WithTracing exports a span per build, with clone, deps, compile and
+// transfer children, to the OTLP/HTTP collector at endpoint.
+func WithTracing(endpoint string) Option {
+	return func(o *Options) { o.OTLPEndpoint = endpoint }
+}
+
+// WithPublisher publishes a message to pub as each build starts, at each
+// step and once it finishes. Publishing never waits on pub: messages it
+// can't keep up with are dropped.
+func WithPublisher(pub Publisher) Option {
+	return func(o *Options) { o.Publisher = pub }
+}
+
+// WithSchedules runs builds on cron schedules. Each run is skipped while
+// the schedule's previous run is still going.
+func WithSchedules(schedules ...Schedule) Option {
+	return func(o *Options) { o.Schedules = append(o.Schedules, schedules...) }
+}
+
+// WithHosts declares git servers: self-hosted instances, and the
+// credentials used to clone from any host.
+func WithHosts(hosts ...GitHost) Option {
+	return func(o *Options) { o.Hosts = append(o.Hosts, hosts...) }
+}
+
+// WithRepoDefaults fills in request fields the request leaves out for
+// matching repositories.
+func WithRepoDefaults(entries ...RepoDefaults) Option {
+	return func(o *Options) { o.RepoDefaults = append(o.RepoDefaults, entries...) }
+}
+
+func defaultOptions() Options {
+	return Options{
+		AuthMaxSkew:           5 * time.Minute,
+		MaxConcurrentCompiles: max(1, runtime.NumCPU()/2),
+		BodyTimeout:           time.Minute,
+		WriteTimeout:          30 * time.Second,
+		StepRetries:           2,
+		RetryBackoff:          2 * time.Second,
+		DataDir:               defaultDataDir,
+		HistoryFile:           filepath.Join(os.TempDir(), "billder-history.json"),
+		StoreTTL:              24 * time.Hour,
+		StoreMaxBytes:         1024 << 20,
+		MaxCmdsPerBuild:       16,
+		MaxLFSBytes:           2048 << 20,
+		PayloadLimits:         PayloadLimits{Targets: defaultMaxTargets, BodyBytes: maxJSONBody, Labels: maxLabels, SparsePaths: maxSparsePaths},
+		ModProxyMaxBytes:      4096 << 20,
+		EventBufferEvents:     2000,
+		EventBufferBytes:      1 << 20,
+		OutputRate:            OutputRate{EventsPerSec: defaultOutputEvents, BytesPerSec: defaultOutputBytes},
+		ResponseLimits:        platformResponseLimits(),
+		AllowedTargets:        builtinTargets,
+	}
+}
+
+// cfg holds the options of the open Server. Compile slots, the stores and
+// auth are process-wide, so one Server is open at a time.
+var cfg = defaultOptions()
+
+// serverOpen is set by New and cleared by Close.
+var serverOpen atomic.Bool
+
+// ErrServerOpen is returned by New while another Server is open: its
+// builds would have the options, stores and compile slots swapped out
+// from under them.
+var ErrServerOpen = errors.New("server: a billder Server is already open; Close it first")
+
+// Server is the billder API (/v1/build, /v1/capabilities, build logs and
+// the OpenAPI description), a handler that can be mounted on any mux.
+type Server struct {
+	handler  http.Handler
+	stop     chan struct{}   // closed by Close; ends the store janitor
+	janitor  <-chan struct{} // closed once it has
+	modProxy *http.Server    // the loopback module proxy; nil when off
+	close    sync.Once
+}
+
+// New opens the Server with opts. It fails with ErrServerOpen until the
+// previous Server is closed.
+func New(opts ...Option) (*Server, error) {
+	if !serverOpen.CompareAndSwap(false, true) {
+		return nil, ErrServerOpen
+	}
+	s := &Server{stop: make(chan struct{})}
+	cfg = defaultOptions()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	setPolicy(newPolicy(cfg))
+	secrets.Add(cfg.RedactSecrets...)
+	secrets.Add(cfg.AdminToken)
+	secrets.Add(cfg.ClusterToken)
+	secrets.Add(cfg.AndroidKeystorePass)
+	cgoRequirements = append(slices.Clip(builtinCgoRequirements), cfg.CgoRequirements...)
+	compileSlots = newSlotQueue(max(1, cfg.MaxConcurrentCompiles))
+	history = openHistory(cfg.HistoryFile)
+	startTracing(cfg.OTLPEndpoint)
+	startPublishing(cfg.Publisher)
+	go environment() // probe the compilers before the first build needs them
+	android = detectAndroid()
+	if cfg.SelfTest != "" {
+		go runSelfTest()
+	}
+
+	mux := http.NewServeMux()
+	handle(mux, "/build", buildHandler, true)
+	handle(mux, "/capabilities", capabilitiesHandler, false)
+	handle(mux, "/capabilities/cgo", cgoCapabilitiesHandler, true)
+	handle(mux, "/capabilities/targets", targetsHandler, true)
+	handle(mux, "/builds", buildsHandler, false)
+	handle(mux, "/lookup", lookupHandler, false)
+	handle(mux, "/stats/repo", repoStatsHandler, false)
+	handle(mux, "/builds/{id}", buildStatusHandler, false)
+	handle(mux, "/builds/{id}/pin", pinHandler, false)
+	handle(mux, "/builds/{id}/cancel", cancelHandler, false)
+	handle(mux, "/latest", latestHandler, false)
+	handle(mux, "/resolve", resolveHandler, false)
+	handle(mux, "/client/latest", clientReleaseHandler, false)
+	handle(mux, "/client/latest/{os}/{arch}", clientBinaryHandler, false)
+	handle(mux, "/schedules", schedulesHandler, false)
+	handle(mux, "/schedules/{name}/run", runScheduleHandler, false)
+	handle(mux, "/builds/{id}/log", buildLogHandler, true)
+	handle(mux, "/builds/{id}/events", buildEventsHandler, false)
+	handle(mux, "/build/{id}/events", buildEventsHandler, false) // next to POST /v1/build
+	handle(mux, "/builds/{id}/tail", buildTailHandler, false)
+	handle(mux, "/jobs/{id}/tail", buildTailHandler, false) // async builds are jobs to their submitters
+	handle(mux, "/builds/{id}/artifact", buildArtifactHandler, false)
+	handle(mux, "/builds/{id}/provenance", buildProvenanceHandler, false)
+	handle(mux, "/builds/{id}/licenses", buildLicensesHandler, false)
+	handle(mux, "/attestation/publickey", attestationKeyHandler, false)
+	mux.HandleFunc("GET /openapi.json", openAPIHandler)
+	mux.HandleFunc("GET /version", versionHandler)
+	mux.HandleFunc("GET /events.json", eventsHandler)
+	mux.HandleFunc("GET /metrics", metricsHandler)
+	mux.HandleFunc("GET /readyz", readyzHandler)
+	mux.HandleFunc("GET /badge", badgeHandler)
+	mux.HandleFunc("/admin/reload", admin(reloadHandler))
+	mux.HandleFunc("/admin/selftest", admin(selfTestHandler))
+	handleDebug(mux)
+
+	cluster = nil
+	if cfg.ClusterToken != "" {
+		cluster = newCoordinator(cfg.ClusterToken)
+		handle(mux, "/cluster/register", cluster.registerHandler, false)
+	}
+
+	recoverJobs()
+	setHosts(cfg.Hosts)
+	startSchedules(cfg.Schedules)
+	s.janitor = startJanitor(s.stop)
+	if cfg.ModProxy {
+		s.modProxy = startModProxy()
+	}
+	s.handler = withServerHeader(withAuth(mux))
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Close stops the Server's background work: the store janitor, the
+// schedules, tracing and the module proxy, waiting for a janitor pass
+// under way. Builds still running go on; Shutdown ends them. Once it's
+// closed, New may open another Server.
+func (s *Server) Close() error {
+	var err error
+	s.close.Do(func() {
+		close(s.stop)
+		<-s.janitor
+		startSchedules(nil)
+		startTracing("")
+		if s.modProxy != nil {
+			err = s.modProxy.Close()
+			modProxyURL = ""
+		}
+		serverOpen.Store(false)
+	})
+	return err
+}
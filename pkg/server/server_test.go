@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// usePolicy swaps in the policy opts describe for the length of the test.
+func usePolicy(t *testing.T, opts ...Option) {
+	t.Helper()
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	prev := currentPolicy()
+	setPolicy(newPolicy(o))
+	t.Cleanup(func() { setPolicy(prev) })
+}
+
+// openServer opens a Server with opts for the length of the test, then
+// closes it, waits for its builds to end and puts back the package state
+// New replaced.
+func openServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	prevCfg, prevPolicy, prevCgo, prevSlots, prevHistory, prevAndroid, prevCluster, prevBus := cfg, currentPolicy(), cgoRequirements, compileSlots, history, android, cluster, bus
+	gitHostsMu.RLock()
+	prevHosts := gitHosts
+	gitHostsMu.RUnlock()
+	s, err := New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		for deadline := time.Now().Add(30 * time.Second); activeBuilds.Load() > 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("builds still running after 30s")
+			}
+		}
+		cfg, cgoRequirements, compileSlots, history, android, cluster, bus = prevCfg, prevCgo, prevSlots, prevHistory, prevAndroid, prevCluster, prevBus
+		setPolicy(prevPolicy)
+		gitHostsMu.Lock()
+		gitHosts = prevHosts
+		gitHostsMu.Unlock()
+	})
+	return s
+}
+
+// One Server is open at a time; closing it lets the next one open.
+func TestServerReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openServer(t, WithDataDir(dir))
+	if _, err := New(WithDataDir(dir)); !errors.Is(err, ErrServerOpen) {
+		t.Fatalf("New with a Server open: %v, want ErrServerOpen", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close() // closing twice is harmless
+	next := openServer(t, WithDataDir(dir))
+	w := httptest.NewRecorder()
+	next.ServeHTTP(w, httptest.NewRequest("GET", "/v1/capabilities", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /v1/capabilities from the reopened Server: %d", w.Code)
+	}
+}
+
+// The module proxy is served on its own loopback listener only, which
+// closes with the Server.
+func TestModProxyNotPublic(t *testing.T) {
+	useModCache(t)
+	s := openServer(t, WithDataDir(t.TempDir()), WithModules("https://proxy.example.com", "", ""), WithModuleProxy(0))
+	proxyURL := modProxyURL
+	if proxyURL == "" {
+		t.Fatal("no module proxy listening")
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/modproxy/example.com/!acme/lib/@v/v1.0.0.mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("the public handler served /modproxy/: %d", resp.StatusCode)
+	}
+
+	s.Close()
+	if _, err := http.Get(proxyURL + "/modproxy/example.com/!acme/lib/@v/list"); err == nil {
+		t.Error("the module proxy still listens after Close")
+	}
+	if buildProxy() != "https://proxy.example.com" {
+		t.Errorf("builds' GOPROXY %q after Close", buildProxy())
+	}
+}
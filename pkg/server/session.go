@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Session is the "session" event that opens every build stream: the
+// build's id, the API version the request was served under, the limits it
+// runs under and the request as the server will execute it, defaults
+// filled in.
+type Session struct {
+	BuildID  string         `json:"build_id"`
+	Protocol string         `json:"protocol"` // "v1", or "legacy" for the unversioned route
+	Schema   int            `json:"schema"`   // version of the event stream; see pkg/client.StreamSchema
+	Limits   SessionLimits  `json:"limits"`
+	Spec     RequestPayload `json:"spec"` // a patch is given by its digest, "sha256:<hex>"
+
+	Defaults []AppliedDefault `json:"defaults,omitempty"` // fields of spec the server's repos config filled in
+}
+
+// SessionLimits are the limits of a build. Durations are in seconds; 0
+// means no limit.
+type SessionLimits struct {
+	MaxJSONBody      int64   `json:"max_json_body_bytes"`
+	MaxMultipartBody int64   `json:"max_multipart_body_bytes"` // JSON payload plus an uploaded profile
+	MaxPatch         int64   `json:"max_patch_bytes"`
+	MaxParallelism   int     `json:"max_parallelism"`
+	MaxArtifact      int64   `json:"max_artifact_bytes"` // for this caller
+	BuildTimeout     float64 `json:"build_timeout_seconds"`
+	BodyTimeout      float64 `json:"body_timeout_seconds"`
+	WriteTimeout     float64 `json:"write_timeout_seconds"` // for each write of the stream
+}
+
+// newSession describes build id of caller, requested as p under protocol.
+func newSession(id, protocol, caller string, p RequestPayload) Session {
+	schema := streamSchema
+	if protocol == "legacy" {
+		schema = legacyStreamSchema
+	}
+	return Session{
+		BuildID:  id,
+		Protocol: protocol,
+		Schema:   schema,
+		Spec:     p.withPatchDigest(),
+		Limits: SessionLimits{
+			MaxJSONBody:      payloadLimits().BodyBytes,
+			MaxMultipartBody: maxMultipartBody,
+			MaxPatch:         maxPatch,
+			MaxParallelism:   maxParallelism,
+			MaxArtifact:      artifactLimit(caller),
+			BuildTimeout:     cfg.BuildTimeout.Seconds(),
+			BodyTimeout:      cfg.BodyTimeout.Seconds(),
+			WriteTimeout:     cfg.WriteTimeout.Seconds(),
+		},
+	}
+}
+
+// withPatchDigest is p with its patch, if any, replaced by the patch's
+// digest, "sha256:<hex>", for showing the request back.
+func (p RequestPayload) withPatchDigest() RequestPayload {
+	if p.Patch != "" {
+		patch, _ := p.patchBytes()
+		sum := sha256.Sum256(patch)
+		p.Patch = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return p
+}
+
+// requestProtocol is the API version r was served under.
+func requestProtocol(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/"+apiVersion+"/") {
+		return apiVersion
+	}
+	return "legacy"
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const sizeReportTop = 15
+
+// SizeEntry is a named size in bytes.
+type SizeEntry struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// SizeReport breaks a binary down by section and by Go package.
+type SizeReport struct {
+	Sections []SizeEntry `json:"sections"`
+	Packages []SizeEntry `json:"packages,omitempty"`
+	Note     string      `json:"note,omitempty"`
+}
+
+// buildSizeReport inspects the binary's section table and, when symbols are
+// present, aggregates symbol sizes by top-level package.
+func buildSizeReport(binary string) (*SizeReport, error) {
+	sections, err := binarySections(binary)
+	if err != nil {
+		return nil, err
+	}
+	report := &SizeReport{Sections: sections}
+
+	out, err := exec.Command("go", "tool", "nm", "-size", "-sort", "size", binary).CombinedOutput()
+	if err != nil || bytes.Contains(out, []byte("no symbols")) {
+		report.Note = "binary is stripped (-s -w); package breakdown unavailable, rebuild with debug symbols for details"
+		return report, nil
+	}
+
+	totals := make(map[string]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// "  addr  size type name"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		totals[symbolPackage(strings.Join(fields[3:], " "))] += size
+	}
+	report.Packages = topEntries(totals, sizeReportTop)
+	return report, nil
+}
+
+// symbolPackage returns the package portion of a Go symbol name,
+// e.g. "fyne.io/fyne/v2/widget.(*Button).Tapped" -> "fyne.io/fyne/v2/widget".
+func symbolPackage(sym string) string {
+	slash := strings.LastIndex(sym, "/")
+	if dot := strings.Index(sym[slash+1:], "."); dot >= 0 {
+		return sym[:slash+1+dot]
+	}
+	return sym
+}
+
+func topEntries(totals map[string]int64, n int) []SizeEntry {
+	entries := make([]SizeEntry, 0, len(totals))
+	for name, size := range totals {
+		entries = append(entries, SizeEntry{Name: name, Bytes: size})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Bytes > entries[j].Bytes })
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// binarySections reads section sizes from an ELF, PE or Mach-O file.
+func binarySections(binary string) ([]SizeEntry, error) {
+	totals := make(map[string]int64)
+	if f, err := elf.Open(binary); err == nil {
+		defer f.Close()
+		for _, s := range f.Sections {
+			if s.Size > 0 && s.Type != elf.SHT_NOBITS {
+				totals[s.Name] += int64(s.Size)
+			}
+		}
+	} else if f, err := pe.Open(binary); err == nil {
+		defer f.Close()
+		for _, s := range f.Sections {
+			totals[s.Name] += int64(s.Size)
+		}
+	} else if f, err := macho.Open(binary); err == nil {
+		defer f.Close()
+		for _, s := range f.Sections {
+			totals[s.Name] += int64(s.Size)
+		}
+	} else {
+		return nil, fmt.Errorf("unrecognized binary format")
+	}
+	return topEntries(totals, len(totals)), nil
+}
+
+// Lines formats the report for streaming as progress messages.
+func (r *SizeReport) Lines() []string {
+	lines := []string{"Size report - sections:"}
+	for _, s := range r.Sections {
+		lines = append(lines, fmt.Sprintf("  %-20s %10.2f KB", s.Name, float64(s.Bytes)/1024))
+	}
+	if len(r.Packages) > 0 {
+		lines = append(lines, fmt.Sprintf("Size report - top %d packages:", len(r.Packages)))
+		for _, p := range r.Packages {
+			lines = append(lines, fmt.Sprintf("  %-50s %10.2f KB", p.Name, float64(p.Bytes)/1024))
+		}
+	}
+	if r.Note != "" {
+		lines = append(lines, "Note: "+r.Note)
+	}
+	return lines
+}
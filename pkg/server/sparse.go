@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// sparse_paths builds one corner of a monorepo: a blobless partial clone
+// checks out only the listed directories, the root's files (go.mod,
+// go.work) and the local replace and use targets the modules in them
+// point at. Blobs are fetched as the checkout needs them.
+const (
+	maxSparsePaths  = 32 // default max_sparse_paths
+	maxSparseRounds = 8  // of following replace targets that have their own
+)
+
+// sparseCloneArgs are the git clone flags of a sparse build: only the root
+// is checked out until setSparse widens it.
+var sparseCloneArgs = []string{"--filter=blob:none", "--sparse"}
+
+// sparseProblems checks the requested sparse paths, cleaning them.
+func (p *RequestPayload) sparseProblems() []string {
+	if len(p.SparsePaths) == 0 {
+		return nil
+	}
+	var problems []string
+	for i, dir := range p.SparsePaths {
+		clean := path.Clean(strings.TrimSuffix(dir, "/"))
+		if !filepath.IsLocal(clean) || clean == "." || strings.HasPrefix(clean, "-") || strings.Contains(clean, `\`) {
+			problems = append(problems, fmt.Sprintf("sparse_paths must be directories inside the repository, got %q", dir))
+			continue
+		}
+		p.SparsePaths[i] = clean
+	}
+	if p.CheckoutMode == "archive" || p.CompareRef != "" {
+		problems = append(problems, "sparse_paths can't be combined with checkout_mode \"archive\" or compare_ref")
+	}
+	return problems
+}
+
+// setSparse checks out the requested directories, then keeps adding the
+// local replace and use targets of the modules now in the tree until
+// there are no new ones.
+func (j *buildJob) setSparse(host *gitHost, sse *sseWriter) error {
+	want := slices.Clone(j.payload.SparsePaths)
+	if j.payload.ModuleDir != "" && j.payload.ModuleDir != "." && !sparseCovers(want, j.payload.ModuleDir) {
+		want = append(want, j.payload.ModuleDir)
+	}
+	for round := 0; ; round++ {
+		out, err := j.runRetrying(sse, "Sparse checkout", func() *exec.Cmd {
+			set := host.git(j.ctx, append([]string{"sparse-checkout", "set"}, want...)...)
+			set.Dir = j.repoPath
+			return set
+		})
+		if err != nil {
+			category := cloneFailure(out)
+			if j.ctx.Err() != nil {
+				category = FailTimeout
+			}
+			return failedWith(category, fmt.Errorf("sparse checkout failed: %s", lastLine(string(out))))
+		}
+		if round == maxSparseRounds {
+			return nil
+		}
+		var added []string
+		for _, dep := range localModuleDeps(j.repoPath) {
+			if !sparseCovers(want, dep) && !slices.Contains(added, dep) {
+				added = append(added, dep)
+			}
+		}
+		if len(added) == 0 {
+			return nil
+		}
+		sse.Message("Sparse checkout: adding local module dependencies " + strings.Join(added, ", "))
+		want = append(want, added...)
+	}
+}
+
+// sparseCovers reports whether dir is one of dirs or inside one.
+func sparseCovers(dirs []string, dir string) bool {
+	return slices.ContainsFunc(dirs, func(d string) bool { return dir == d || strings.HasPrefix(dir, d+"/") })
+}
+
+// localModuleDeps lists the directories, relative to root, that the
+// modules under root and a root go.work point at with local replace
+// directives and use lines. Targets outside the repository are left out.
+func localModuleDeps(root string) []string {
+	var deps []string
+	files := []string{"go.work"}
+	for _, m := range findModules(root) {
+		files = append(files, path.Join(m.Dir, "go.mod"))
+	}
+	for _, file := range files {
+		for _, target := range localTargets(filepath.Join(root, filepath.FromSlash(file))) {
+			dep := path.Join(path.Dir(file), target)
+			if filepath.IsLocal(dep) && dep != "." && !slices.Contains(deps, dep) {
+				deps = append(deps, dep)
+			}
+		}
+	}
+	return deps
+}
+
+// localTargets reads the relative paths a go.mod or go.work names on the
+// right of replace directives and, in go.work, in use lines.
+func localTargets(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var targets []string
+	block := "" // the directive of the ( ... ) block the line is in
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "//")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		directive := block
+		switch {
+		case fields[0] == ")":
+			block = ""
+			continue
+		case block == "" && len(fields) == 2 && fields[1] == "(":
+			block = fields[0]
+			continue
+		case block == "":
+			directive, fields = fields[0], fields[1:]
+		}
+		var target string
+		switch {
+		case directive == "replace":
+			if i := slices.Index(fields, "=>"); i >= 0 && i+1 < len(fields) {
+				target = fields[i+1]
+			}
+		case directive == "use" && len(fields) > 0:
+			target = fields[0]
+		}
+		target = strings.Trim(target, "\"`")
+		if target == "." || target == ".." || strings.HasPrefix(target, "./") || strings.HasPrefix(target, "../") {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// sparseFailures are go command errors about files that may simply be
+// outside a sparse checkout.
+var sparseFailures = []string{
+	"no such file or directory",
+	"cannot find module providing package",
+	"no required module provides package",
+	"does not contain main module",
+	"replacement directory",
+	"no matching files found",
+	"cannot find package",
+	"is not in std",
+	"directory not found",
+}
+
+// sparseHint suggests widening sparse_paths when a sparse build failed
+// with output that looks like missing files, or is "" otherwise.
+func (j *buildJob) sparseHint(output string) string {
+	if len(j.payload.SparsePaths) == 0 {
+		return ""
+	}
+	text := strings.ToLower(output)
+	if !slices.ContainsFunc(sparseFailures, func(s string) bool { return strings.Contains(text, s) }) {
+		return ""
+	}
+	return fmt.Sprintf("Hint: this is a sparse checkout of %s; the error may be about files outside it. Add the directories it needs to sparse_paths.", strings.Join(j.payload.SparsePaths, ", "))
+}
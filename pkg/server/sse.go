@@ -0,0 +1,395 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseWriter serializes server-sent events onto a streaming response.
+// It is safe for concurrent use by parallel target builds. A failed write
+// (or a panic from writing to a finished response) marks the client gone;
+// later writes are dropped, though events still reach the event log.
+// Each write must finish within cfg.WriteTimeout, so a client that stops
+// reading without disconnecting can't block the build behind it.
+type sseWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+	rc      *http.ResponseController // sets write deadlines; nil when nobody is connected
+	stalled func()                   // called when a write times out
+	events  *eventLog                // when set, events carry ids and are kept for replay
+	gone    bool                     // a write to the client failed
+	closed  bool                     // the terminal event or the artifact was sent
+
+	output *outputCoalescer // rate-limits "output" events; made with the first
+
+	legacy bool // the unversioned route: messages go out as unnamed data lines
+}
+
+// Status is the "status" event, a message of billder's own about the
+// build. Unlike "output", which is whatever the repository's tools print,
+// it can be trusted to say how the build is going.
+type Status struct {
+	Message string `json:"message"`
+}
+
+// StreamEnd is the "end" event, the last one of a stream without an artifact.
+type StreamEnd struct {
+	OK       bool            `json:"ok"`
+	Category FailureCategory `json:"error_category,omitempty"` // why it failed
+
+	Reason  EndReason `json:"reason"`
+	Message string    `json:"message"` // the reason, for people
+}
+
+// EndReason says why a stream ended. Unlike the failure category it tells
+// apart builds stopped from outside from those that failed on their own.
+type EndReason string
+
+const (
+	EndCompleted EndReason = "completed"        // the build ran to the end and succeeded
+	EndCanceled  EndReason = "canceled_by_user" // through POST /v1/builds/{id}/cancel
+	EndTimeout   EndReason = "timeout"
+	EndShutdown  EndReason = "shutdown" // the server is stopping; resume_policy "restart" builds rerun
+	EndError     EndReason = "error"    // the build failed; error_category says why
+)
+
+// streamEnd is the end event of a build that finished ok, or failed with
+// category after its context was cancelled with cause, if it was.
+func streamEnd(ok bool, category FailureCategory, cause error) StreamEnd {
+	end := StreamEnd{OK: ok, Category: category}
+	switch {
+	case ok:
+		end.Reason, end.Message = EndCompleted, "Build completed"
+	case errors.Is(cause, errBuildCanceled):
+		end.Reason, end.Message = EndCanceled, stopMessage(cause)
+	case errors.Is(cause, errShutdown):
+		end.Reason, end.Message = EndShutdown, stopMessage(cause)
+	case errors.Is(cause, context.DeadlineExceeded):
+		end.Reason, end.Message = EndTimeout, stopMessage(cause)
+	case category == FailTimeout && !errors.Is(cause, errClientStalled):
+		end.Reason, end.Message = EndTimeout, "A step of the build timed out"
+	default:
+		end.Reason, end.Message = EndError, fmt.Sprintf("Build failed (%s)", category)
+	}
+	return end
+}
+
+// newSSEWriter sets the streaming headers on w. It reports false if the
+// response can't be flushed incrementally.
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	return &sseWriter{w: w, flusher: flusher, rc: http.NewResponseController(w)}, true
+}
+
+// onStall has stalled called when the client stops accepting writes.
+func (s *sseWriter) onStall(stalled func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stalled = stalled
+}
+
+// deadline gives the next write cfg.WriteTimeout, or lifts the deadline
+// when reset is set so it doesn't outlive the stream.
+func (s *sseWriter) deadline(reset bool) {
+	if s.rc == nil || cfg.WriteTimeout <= 0 {
+		return
+	}
+	t := time.Now().Add(cfg.WriteTimeout)
+	if reset {
+		t = time.Time{}
+	}
+	s.rc.SetWriteDeadline(t)
+}
+
+// drop marks the client gone after a failed write, counting why.
+func (s *sseWriter) drop(err error) {
+	s.gone = true
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		metrics.connectionDropped("disconnected")
+		return
+	}
+	metrics.connectionDropped("write_timeout")
+	log.Printf("Client stopped reading the stream for %s; dropping it", cfg.WriteTimeout)
+	if s.stalled != nil {
+		s.stalled()
+	}
+}
+
+// write sends p to the client and flushes it, marking the client gone on
+// the first error. s.mu must be held.
+func (s *sseWriter) write(p []byte) {
+	if s.gone {
+		return
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("SSE write panicked: %v", v)
+			s.gone = true
+		}
+	}()
+	s.deadline(false)
+	_, err := s.w.Write(p)
+	if err == nil && s.rc != nil {
+		err = s.rc.Flush()
+	} else if err == nil {
+		s.flusher.Flush()
+	}
+	if err != nil {
+		s.drop(err)
+		return
+	}
+	s.deadline(true)
+}
+
+// Gone reports whether the client stopped receiving. Work done only for
+// the client can be skipped; the build itself goes on for reattaching.
+func (s *sseWriter) Gone() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gone
+}
+
+// emit writes one complete event block, recording it first when the
+// stream has an event log.
+func (s *sseWriter) emit(block []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.emitLocked(block)
+}
+
+func (s *sseWriter) emitLocked(block []byte) {
+	if s.closed {
+		return
+	}
+	if s.events != nil {
+		block = append(fmt.Appendf(nil, "id: %d\n", s.events.append(block)), block...)
+	}
+	s.write(block)
+}
+
+// replay resends a block recorded in an event log under its original id.
+func (s *sseWriter) replay(id uint64, block []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.write(append(fmt.Appendf(nil, "id: %d\n", id), block...))
+}
+
+// outputLine sends an "output" event through the build's coalescer, which
+// may hold it back, merge it with others or drop it under cfg.OutputRate.
+func (s *sseWriter) outputLine(o OutputLine) {
+	s.mu.Lock()
+	if s.output == nil {
+		s.output = newOutputCoalescer(cfg.OutputRate, func(o OutputLine) { s.event("output", o) })
+	}
+	c := s.output
+	s.mu.Unlock()
+	c.add(o)
+}
+
+// flushOutput sends held back output ahead of another event, which is
+// never delayed or dropped itself.
+func (s *sseWriter) flushOutput() {
+	s.mu.Lock()
+	c := s.output
+	s.mu.Unlock()
+	if c != nil {
+		c.flush()
+	}
+}
+
+// Message sends a "status" event, or on the legacy route unnamed data
+// lines.
+func (s *sseWriter) Message(msg string) {
+	s.flushOutput()
+	if !s.legacy {
+		s.event("status", Status{Message: msg})
+		return
+	}
+	s.emit(append(dataLines(secrets.Redact(msg)), '\n'))
+}
+
+// dataLines frames text as data: fields, one per line, so that line
+// breaks in it can't end the event or start fields of their own.
+func dataLines(text string) []byte {
+	var b []byte
+	for line := range strings.SplitSeq(lineBreaks.Replace(text), "\n") {
+		b = fmt.Appendf(b, "data: %s\n", line)
+	}
+	return b
+}
+
+// lineBreaks are what SSE counts as line ends, turned into \n.
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// Event sends a named event with a JSON body.
+func (s *sseWriter) Event(event string, v any) {
+	s.flushOutput()
+	s.event(event, v)
+}
+
+func (s *sseWriter) event(event string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Event marshal error: %v", err)
+		return
+	}
+	s.emit(fmt.Appendf(nil, "event: %s\ndata: %s\n\n", event, secrets.Redact(string(data))))
+}
+
+// Text sends a multi-line text block as a single named event.
+func (s *sseWriter) Text(event string, lines []string) {
+	s.flushOutput()
+	var block bytes.Buffer
+	fmt.Fprintf(&block, "event: %s\n", event)
+	for _, line := range lines {
+		block.Write(dataLines(secrets.Redact(line)))
+	}
+	block.WriteString("\n")
+	s.emit(block.Bytes())
+}
+
+// Close ends a stream that carries no artifact with an "end" event. Only
+// the first Close sends it, and none follows Binary.
+func (s *sseWriter) Close(end StreamEnd) {
+	s.flushOutput()
+	data, _ := json.Marshal(end)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.emitLocked(fmt.Appendf(nil, "event: end\ndata: %s\n\n", data))
+	s.closed = true
+}
+
+// Binary signals the switch to binary mode and streams the artifact. No
+// further events may be sent afterwards. The artifact isn't kept in the
+// event log; clients replaying it see the stream end after the summary.
+// size, when not negative, is advertised so clients can tell a complete
+// artifact from one cut short.
+func (s *sseWriter) Binary(name, sha256 string, size int64, r io.Reader) (int64, error) {
+	// We send the filename in the 'data' field. The digest and size go in
+	// fields of their own ahead of it, which clients that don't know them skip.
+	var fields string
+	if sha256 != "" {
+		fields = "sha256: " + sha256 + "\n"
+	}
+	if size >= 0 {
+		fields += fmt.Sprintf("size: %d\n", size)
+	}
+	return s.binary(fmt.Appendf(nil, "%sevent: binary_start\ndata: %s\n\n", fields, strings.NewReplacer("\r", "", "\n", "").Replace(name)), r)
+}
+
+// binary sends the binary_start block start, then the artifact from r.
+func (s *sseWriter) binary(start []byte, r io.Reader) (int64, error) {
+	s.flushOutput()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.events != nil {
+		s.events.finish()
+	}
+	s.write(start)
+	if s.gone {
+		return 0, errClientGone
+	}
+	n, err := io.Copy(deadlineWriter{s}, r)
+	if err == nil && s.rc != nil {
+		err = s.rc.Flush()
+	}
+	if err != nil {
+		s.drop(err)
+		return n, err
+	}
+	s.deadline(true)
+	return n, nil
+}
+
+// relay sends an event block another server encoded, such as a worker's,
+// as it is apart from redaction.
+func (s *sseWriter) relay(block []byte) {
+	s.emit([]byte(secrets.Redact(string(block))))
+}
+
+// deadlineWriter writes the artifact, renewing the deadline for each chunk.
+type deadlineWriter struct{ s *sseWriter }
+
+func (d deadlineWriter) Write(p []byte) (int, error) {
+	d.s.deadline(false)
+	return d.s.w.Write(p)
+}
+
+var errClientGone = errors.New("client disconnected")
+
+// targetStream tags the output of one target of a build. In matrix builds
+// plain messages are prefixed with the target so they can be told apart.
+type targetStream struct {
+	*sseWriter
+	target string
+	prefix bool
+
+	keepColor bool // forward output with its ANSI sequences
+}
+
+// Message sends a log line, prefixed with the target in matrix builds.
+func (t *targetStream) Message(msg string) {
+	if t.prefix {
+		msg = "[" + t.target + "] " + msg
+	}
+	t.sseWriter.Message(msg)
+}
+
+// Output forwards a line a compile command of step printed on stream as
+// an "output" event, without ANSI sequences unless the request keeps color.
+// go build -json wraps what the compiler writes to stderr in JSON on
+// stdout; it is unwrapped and sent as stderr.
+func (t *targetStream) Output(step int, stream, line string) {
+	if isPackageLine(line) {
+		return
+	}
+	lines := []string{line}
+	var ev buildEvent
+	if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &ev) == nil {
+		if ev.Action != "build-output" {
+			return
+		}
+		stream, lines = "stderr", strings.Split(strings.TrimSuffix(ev.Output, "\n"), "\n")
+	}
+	now := time.Now().UnixMilli()
+	for _, l := range lines {
+		plain := stripANSI(l)
+		if _, ok := parseDiagnosticLine("", plain); ok || plain == "" || strings.HasPrefix(plain, "# ") {
+			continue
+		}
+		if !t.keepColor {
+			l = plain
+		}
+		t.outputLine(OutputLine{Target: t.target, Step: step, Stream: stream, Line: l, Time: now})
+	}
+}
+
+// Text sends a text block, prefixing each line in matrix builds.
+func (t *targetStream) Text(event string, lines []string) {
+	if t.prefix {
+		tagged := make([]string, len(lines))
+		for i, line := range lines {
+			tagged[i] = "[" + t.target + "] " + line
+		}
+		lines = tagged
+	}
+	t.sseWriter.Text(event, lines)
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// brokenWriter is a streaming response whose client goes away after limit
+// bytes: the write that crosses it fails, and so does every later one.
+type brokenWriter struct {
+	header  http.Header
+	body    bytes.Buffer
+	limit   int
+	flushes int
+	panics  bool // panic instead of failing, as writing to a finished response can
+}
+
+func newBrokenWriter(limit int) *brokenWriter {
+	return &brokenWriter{header: http.Header{}, limit: limit}
+}
+
+func (b *brokenWriter) Header() http.Header { return b.header }
+func (b *brokenWriter) WriteHeader(int)     {}
+func (b *brokenWriter) Flush()              { b.flushes++ }
+
+func (b *brokenWriter) Write(p []byte) (int, error) {
+	room := max(0, b.limit-b.body.Len())
+	if room >= len(p) {
+		return b.body.Write(p)
+	}
+	if b.panics {
+		panic("write after the handler returned")
+	}
+	b.body.Write(p[:room])
+	return room, errors.New("write: connection reset by peer")
+}
+
+func newTestSSE(t *testing.T, w http.ResponseWriter) *sseWriter {
+	t.Helper()
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		t.Fatal("writer can't stream")
+	}
+	return sse
+}
+
+func TestSSEWriterStopsAtFailedWrite(t *testing.T) {
+	for _, limit := range []int{0, 1, 40, 100, 250} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			w := newBrokenWriter(limit)
+			sse := newTestSSE(t, w)
+			for i := range 10 {
+				sse.Event("step", Step{Index: i + 1, Name: "compile"})
+			}
+			if !sse.Gone() {
+				t.Fatalf("client still there after %d of %d bytes were accepted", w.body.Len(), limit)
+			}
+			written := w.body.Len()
+			sse.Message("after the failure")
+			sse.Close(streamEnd(true, "", nil))
+			if n, err := sse.Binary("app", "", 3, strings.NewReader("abc")); n != 0 || !errors.Is(err, errClientGone) {
+				t.Errorf("Binary = %d, %v; want 0, errClientGone", n, err)
+			}
+			if w.body.Len() != written {
+				t.Errorf("%d more bytes were written once the client was gone", w.body.Len()-written)
+			}
+		})
+	}
+}
+
+func TestSSEWriterSurvivesPanickingWrite(t *testing.T) {
+	w := newBrokenWriter(10)
+	w.panics = true
+	sse := newTestSSE(t, w)
+	sse.Message("this is longer than ten bytes")
+	if !sse.Gone() {
+		t.Error("a panicking write didn't mark the client gone")
+	}
+}
+
+func TestSSEWriterBinaryCutShort(t *testing.T) {
+	artifact := bytes.Repeat([]byte{0x7f}, 4096)
+	w := newBrokenWriter(1000)
+	sse := newTestSSE(t, w)
+	n, err := sse.Binary("app", "", int64(len(artifact)), bytes.NewReader(artifact))
+	if err == nil {
+		t.Fatal("Binary reported success for a connection that broke off")
+	}
+	if n >= int64(len(artifact)) {
+		t.Errorf("Binary reported %d bytes sent of %d", n, len(artifact))
+	}
+	if !sse.Gone() {
+		t.Error("client not marked gone")
+	}
+}
+
+func TestSSEWriterClosesOnce(t *testing.T) {
+	w := httptest.NewRecorder()
+	sse := newTestSSE(t, w)
+	sse.Message("done")
+	sse.Close(streamEnd(true, "", nil))
+	sse.Close(streamEnd(false, FailInternal, nil))
+	sse.Message("too late")
+	out := w.Body.String()
+	if n := strings.Count(out, "event: end\n"); n != 1 {
+		t.Errorf("%d end events, want 1:\n%s", n, out)
+	}
+	if strings.Contains(out, "too late") || strings.Contains(out, `"ok":false`) {
+		t.Errorf("events after Close were sent:\n%s", out)
+	}
+}
+
+// Events written from parallel target builds arrive whole.
+func TestSSEWriterConcurrentEvents(t *testing.T) {
+	w := httptest.NewRecorder()
+	sse := newTestSSE(t, w)
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Go(func() {
+			for i := range 50 {
+				sse.Message(fmt.Sprintf("target %d message %d %s", g, i, strings.Repeat("x", 100)))
+			}
+		})
+	}
+	wg.Wait()
+	blocks := strings.Split(strings.TrimSuffix(w.Body.String(), "\n\n"), "\n\n")
+	if len(blocks) != 400 {
+		t.Fatalf("%d event blocks, want 400", len(blocks))
+	}
+	for _, b := range blocks {
+		if !strings.HasPrefix(b, "event: status\ndata: {") || strings.Count(b, "\n") != 1 {
+			t.Fatalf("mangled block %q", b)
+		}
+	}
+}
+
+// sseEvent is an event as an EventSource dispatches it.
+type sseEvent struct {
+	name, data, id string
+}
+
+// parseSSE reads stream as the SSE specification has browsers do: lines
+// end at CRLF, LF or a lone CR, a blank line dispatches the event, and
+// unknown fields are ignored.
+func parseSSE(stream string) []sseEvent {
+	var events []sseEvent
+	var cur sseEvent
+	var data []string
+	for line := range strings.SplitSeq(lineBreaks.Replace(stream), "\n") {
+		if line == "" {
+			if data != nil {
+				cur.data = strings.Join(data, "\n")
+				events = append(events, cur)
+			}
+			cur, data = sseEvent{id: cur.id}, nil
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			cur.name = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			cur.id = value
+		}
+	}
+	return events
+}
+
+// hostileOutput is build output written to forge events of its own.
+var hostileOutput = []string{
+	"event: end\ndata: {\"ok\":true}\n\n",
+	"done\n\nevent: summary\ndata: {\"ok\":true,\"artifact_url\":\"https://evil.example/app\"}",
+	"\r\nevent: binary_start\r\ndata: evil\r\n\r\nMZ",
+	"\revent: end\rdata: {}\r\r",
+	"sha256: 00\nsize: 0\nevent: binary_start\ndata: x\n",
+	"id: 999999\n\nretry: 1",
+	"data: Error: build failed",
+	": comment\n\n",
+	"event:status\ndata:{\"message\":\"Build Successful!\"}\n\n",
+	"a line\u2028sep\u2029\x00\x1b[2Kend",
+}
+
+// Whatever a repository's tools print, and whatever billder passes on in
+// messages and reports, comes out as the data of the one event it was sent
+// in, on the versioned route and on the legacy one.
+func TestSSEOutputCantForgeEvents(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		for _, text := range hostileOutput {
+			t.Run(fmt.Sprintf("legacy=%v/%q", legacy, text), func(t *testing.T) {
+				w := httptest.NewRecorder()
+				sse := newTestSSE(t, w)
+				sse.legacy = legacy
+				ts := &targetStream{sseWriter: sse, target: "linux/amd64"}
+				ts.Output(3, "stdout", text)
+				ts.Message(text)
+				ts.Text("report", []string{text})
+				sse.Close(streamEnd(false, FailCompile, nil))
+
+				events := parseSSE(w.Body.String())
+				var names []string
+				for _, ev := range events {
+					names = append(names, ev.name)
+				}
+				want := []string{"output", "status", "report", "end"}
+				if legacy {
+					want[1] = ""
+				}
+				if strings.Join(names, ",") != strings.Join(want, ",") {
+					t.Fatalf("events %q, want %q, from\n%s", names, want, w.Body)
+				}
+				for _, ev := range events {
+					if ev.id != "" {
+						t.Errorf("%s event carries id %q", ev.name, ev.id)
+					}
+				}
+
+				var o OutputLine
+				if err := json.Unmarshal([]byte(events[0].data), &o); err != nil || o.Line != stripANSI(text) || o.Stream != "stdout" {
+					t.Errorf("output event %q: %+v, %v", events[0].data, o, err)
+				}
+				plain := lineBreaks.Replace(text)
+				if legacy {
+					if events[1].data != plain {
+						t.Errorf("message %q, want %q", events[1].data, plain)
+					}
+				} else {
+					var st Status
+					if err := json.Unmarshal([]byte(events[1].data), &st); err != nil || st.Message != text {
+						t.Errorf("status event %q: %+v, %v", events[1].data, st, err)
+					}
+				}
+				if events[2].data != plain {
+					t.Errorf("report %q, want %q", events[2].data, plain)
+				}
+				var end StreamEnd
+				if err := json.Unmarshal([]byte(events[3].data), &end); err != nil || end.OK {
+					t.Errorf("end event %q: %+v, %v", events[3].data, end, err)
+				}
+			})
+		}
+	}
+}
+
+// An artifact name can't add fields or events to binary_start.
+func TestSSEBinaryNameCantForgeEvents(t *testing.T) {
+	for _, name := range hostileOutput {
+		w := httptest.NewRecorder()
+		sse := newTestSSE(t, w)
+		sse.Binary(name, "", 3, strings.NewReader("abc"))
+		head, body, ok := strings.Cut(w.Body.String(), "\n\n")
+		if !ok || body != "abc" {
+			t.Errorf("%q: artifact %q", name, body)
+		}
+		events := parseSSE(head + "\n\n")
+		if len(events) != 1 || events[0].name != "binary_start" || strings.ContainsAny(events[0].data, "\r\n") {
+			t.Errorf("%q: events %q", name, events)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BuildTiming is how long a finished build took, in all and in each step it
+// reached, in seconds.
+type BuildTiming struct {
+	Total float64            `json:"total_seconds"`
+	Steps map[string]float64 `json:"steps_seconds,omitempty"` // clone, deps, compile and deliver
+}
+
+// stepClock times the steps of one build as runBuild moves through them.
+type stepClock struct {
+	started time.Time
+	step    string
+	at      time.Time
+	steps   map[string]float64
+}
+
+func newStepClock() *stepClock {
+	return &stepClock{started: time.Now(), steps: map[string]float64{}}
+}
+
+// start ends the current step, if any, and starts timing step.
+func (c *stepClock) start(step string) {
+	now := time.Now()
+	if c.step != "" {
+		c.steps[c.step] += now.Sub(c.at).Seconds()
+	}
+	c.step, c.at = step, now
+}
+
+// stop ends the current step and returns the build's timing.
+func (c *stepClock) stop() *BuildTiming {
+	c.start("")
+	return &BuildTiming{Total: time.Since(c.started).Seconds(), Steps: c.steps}
+}
+
+// noteCacheHit records whether a target's go build compiled nothing, its
+// packages all coming from GOCACHE.
+func (j *buildJob) noteCacheHit(hit bool) {
+	j.cacheMu.Lock()
+	defer j.cacheMu.Unlock()
+	all := hit && (j.cacheHit == nil || *j.cacheHit)
+	j.cacheHit = &all
+}
+
+// DurationStats are percentiles of a duration, in seconds, over Samples
+// builds.
+type DurationStats struct {
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	Samples int     `json:"samples"`
+}
+
+// RepoBuildStats summarizes the finished builds of a repository started in
+// the last Days days.
+type RepoBuildStats struct {
+	Repo        string                   `json:"repo"`
+	Days        int                      `json:"days"`
+	Since       time.Time                `json:"since"`
+	Builds      int                      `json:"builds"`
+	Succeeded   int                      `json:"succeeded"`
+	Failed      int                      `json:"failed"`
+	SuccessRate float64                  `json:"success_rate"` // 0 to 1; 0 without builds
+	Total       DurationStats            `json:"total_seconds"`
+	Steps       map[string]DurationStats `json:"steps_seconds"`            // of the builds that reached each step
+	AvgArtifact int64                    `json:"avg_artifact_bytes"`       // of the builds that delivered one
+	CacheHit    *float64                 `json:"cache_hit_rate,omitempty"` // of the builds that ran go build; unset without any
+}
+
+// repoStatsHandler reports build counts, success rate, step durations,
+// artifact size and cache hit rate for one repository. Journal entries are
+// read one at a time and only their numbers kept, so this costs the same
+// as listing the builds.
+func repoStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	repo := r.URL.Query().Get("repo")
+	if repo == "" {
+		http.Error(w, "repo is required", http.StatusBadRequest)
+		return
+	}
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "days must be a positive number", http.StatusBadRequest)
+			return
+		}
+		days = min(n, 3650)
+	}
+	stats := RepoBuildStats{
+		Repo:  canonicalRepo(repo),
+		Days:  days,
+		Since: time.Now().AddDate(0, 0, -days).UTC().Truncate(time.Second),
+		Steps: map[string]DurationStats{},
+	}
+
+	var totals []float64
+	steps := map[string][]float64{}
+	var artifactBytes, artifacts, goBuilds, cacheHits int64
+	entries, _ := os.ReadDir(storePath(dataDir(), "jobs"))
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !buildIDPattern.MatchString(id) {
+			continue
+		}
+		rec, err := loadJob(id)
+		if err != nil || rec.Payload.RepoURL != stats.Repo || rec.State != jobFinished || rec.StartedAt.Before(stats.Since) {
+			continue
+		}
+		stats.Builds++
+		if rec.OK {
+			stats.Succeeded++
+		}
+		if rec.Timing != nil {
+			totals = append(totals, rec.Timing.Total)
+			for step, secs := range rec.Timing.Steps {
+				steps[step] = append(steps[step], secs)
+			}
+		}
+		if rec.ArtifactBytes > 0 {
+			artifactBytes += rec.ArtifactBytes
+			artifacts++
+		}
+		if rec.CacheHit != nil {
+			goBuilds++
+			if *rec.CacheHit {
+				cacheHits++
+			}
+		}
+	}
+
+	stats.Failed = stats.Builds - stats.Succeeded
+	if stats.Builds > 0 {
+		stats.SuccessRate = round2(float64(stats.Succeeded) / float64(stats.Builds))
+	}
+	stats.Total = durationStats(totals)
+	for step, secs := range steps {
+		stats.Steps[step] = durationStats(secs)
+	}
+	if artifacts > 0 {
+		stats.AvgArtifact = artifactBytes / artifacts
+	}
+	if goBuilds > 0 {
+		rate := round2(float64(cacheHits) / float64(goBuilds))
+		stats.CacheHit = &rate
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// durationStats takes the nearest-rank percentiles of samples.
+func durationStats(samples []float64) DurationStats {
+	if len(samples) == 0 {
+		return DurationStats{}
+	}
+	slices.Sort(samples)
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(samples)))) - 1
+		return round2(samples[max(i, 0)])
+	}
+	return DurationStats{P50: rank(0.5), P90: rank(0.9), Samples: len(samples)}
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
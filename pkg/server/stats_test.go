@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// journalBuild writes a finished build of repo to the journal.
+func journalBuild(repo string, ok bool, started time.Time, timing *BuildTiming, cacheHit *bool, artifact int64) {
+	saveJob(&JobRecord{ID: newBuildID(), Payload: RequestPayload{RepoURL: repo}, State: jobFinished, OK: ok,
+		StartedAt: started, Timing: timing, CacheHit: cacheHit, ArtifactBytes: artifact})
+}
+
+func repoStats(t *testing.T, query string) (int, RepoBuildStats) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	repoStatsHandler(w, httptest.NewRequest("GET", "/v1/stats/repo?"+query, nil))
+	var stats RepoBuildStats
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+			t.Fatalf("%s: %v", w.Body, err)
+		}
+	}
+	return w.Code, stats
+}
+
+func TestRepoStats(t *testing.T) {
+	usePolicy(t)
+	useDataDir(t, t.TempDir())
+	const repo = "github.com/acme/app"
+	now := time.Now()
+	hit, miss := true, false
+	journalBuild(repo, true, now, &BuildTiming{Total: 10, Steps: map[string]float64{"clone": 1, "compile": 5}}, &hit, 1000)
+	journalBuild(repo, true, now, &BuildTiming{Total: 20, Steps: map[string]float64{"clone": 2, "deps": 3, "compile": 10}}, &miss, 3000)
+	journalBuild(repo, false, now, &BuildTiming{Total: 30, Steps: map[string]float64{"clone": 3}}, nil, 0)
+	journalBuild(repo, true, now, nil, nil, 0) // journaled before builds were timed
+	journalBuild(repo, false, now.AddDate(0, 0, -40), &BuildTiming{Total: 90}, &hit, 0)
+	journalBuild("github.com/acme/other", true, now, &BuildTiming{Total: 5}, &hit, 500)
+	saveJob(&JobRecord{ID: newBuildID(), Payload: RequestPayload{RepoURL: repo}, State: jobRunning, StartedAt: now})
+
+	code, stats := repoStats(t, "repo=https://github.com/acme/app")
+	if code != http.StatusOK {
+		t.Fatal(code)
+	}
+	rate := 0.5
+	want := RepoBuildStats{Repo: repo, Days: 30, Since: stats.Since, Builds: 4, Succeeded: 3, Failed: 1, SuccessRate: 0.75,
+		Total: DurationStats{P50: 20, P90: 30, Samples: 3},
+		Steps: map[string]DurationStats{
+			"clone":   {P50: 2, P90: 3, Samples: 3},
+			"deps":    {P50: 3, P90: 3, Samples: 1},
+			"compile": {P50: 5, P90: 10, Samples: 2},
+		},
+		AvgArtifact: 2000, CacheHit: &rate}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+	if since := now.AddDate(0, 0, -30); stats.Since.Sub(since).Abs() > 2*time.Second {
+		t.Errorf("since %s, want %s", stats.Since, since)
+	}
+
+	if _, stats := repoStats(t, "repo="+repo+"&days=60"); stats.Builds != 5 || stats.Total.Samples != 4 || stats.Days != 60 {
+		t.Errorf("over 60 days: %+v", stats)
+	}
+	if _, stats := repoStats(t, "repo=github.com/acme/none"); stats.Builds != 0 || stats.SuccessRate != 0 || stats.CacheHit != nil {
+		t.Errorf("a repository without builds: %+v", stats)
+	}
+	for _, query := range []string{"", "repo=" + repo + "&days=0", "repo=" + repo + "&days=week"} {
+		if code, _ := repoStats(t, query); code != http.StatusBadRequest {
+			t.Errorf("%q: %d, want 400", query, code)
+		}
+	}
+}
+
+func TestDurationStats(t *testing.T) {
+	for _, tc := range []struct {
+		samples []float64
+		want    DurationStats
+	}{
+		{nil, DurationStats{}},
+		{[]float64{4.567}, DurationStats{P50: 4.57, P90: 4.57, Samples: 1}},
+		{[]float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, DurationStats{P50: 5, P90: 9, Samples: 10}},
+		{[]float64{1, 100}, DurationStats{P50: 1, P90: 100, Samples: 2}},
+	} {
+		if got := durationStats(tc.samples); got != tc.want {
+			t.Errorf("%v: %+v, want %+v", tc.samples, got, tc.want)
+		}
+	}
+}
+
+// A step returned to adds to its time; the total covers every step.
+func TestStepClock(t *testing.T) {
+	c := newStepClock()
+	for _, step := range []string{"clone", "compile", "clone", "deliver"} {
+		c.start(step)
+		time.Sleep(5 * time.Millisecond)
+	}
+	timing := c.stop()
+	var sum float64
+	for _, secs := range timing.Steps {
+		sum += secs
+	}
+	if len(timing.Steps) != 3 || timing.Steps["clone"] < 0.01 || timing.Steps["compile"] < 0.005 || timing.Total < sum {
+		t.Errorf("timing %+v", timing)
+	}
+}
+
+// Every target has to compile from the cache for the build to count as a
+// hit.
+func TestNoteCacheHit(t *testing.T) {
+	for _, tc := range []struct {
+		hits []bool
+		want bool
+	}{
+		{[]bool{true}, true},
+		{[]bool{true, true}, true},
+		{[]bool{true, false}, false},
+		{[]bool{false, true}, false},
+	} {
+		var j buildJob
+		for _, hit := range tc.hits {
+			j.noteCacheHit(hit)
+		}
+		if *j.cacheHit != tc.want {
+			t.Errorf("%v: hit %v", tc.hits, *j.cacheHit)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"time"
+)
+
+const janitorInterval = 10 * time.Minute
+
+var buildIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// dataDir holds everything persisted after a build's workspace is removed.
+func dataDir() string {
+	return cfg.DataDir
+}
+
+// newBuildID returns a random identifier for a build.
+func newBuildID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logPath is where the persisted log of a build lives.
+func logPath(id string) string {
+	return storePath(dataDir(), "logs", id+".log")
+}
+
+// artifactDir holds the delivered artifact of a build.
+func artifactDir(id string) string {
+	return storePath(dataDir(), "artifacts", id)
+}
+
+// persistFile moves src to dst, copying when they're on different filesystems.
+func persistFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// startJanitor periodically applies the retention policies to stored
+// builds, removes other stored files and git mirrors past their TTL, then
+// the least recently used until the store fits its size budget.
+// It runs until stop is closed, then closes the channel it returns.
+func startJanitor(stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			cleanStore()
+			select {
+			case <-stop:
+				return
+			case <-time.After(janitorInterval):
+			}
+		}
+	}()
+	return done
+}
+
+// buildDirs are the store's top directories that retention manages per
+// build rather than per file.
+var buildDirs = []string{"artifacts", "logs", "jobs"}
+
+func cleanStore() {
+	builds := applyRetention()
+
+	ttl, maxBytes := cfg.StoreTTL, cfg.StoreMaxBytes
+	type stored struct {
+		path   string
+		size   int64
+		mod    time.Time
+		remove func() bool // false when the entry must stay, like a mirror in use
+	}
+	var files []stored
+	skip := map[string]bool{}
+	for _, d := range buildDirs {
+		skip[storePath(dataDir(), d)] = true
+	}
+	filepath.Walk(dataDir(), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && (skip[path] || cfg.MirrorDir != "" && path == filepath.Clean(cfg.MirrorDir)) {
+			return filepath.SkipDir
+		}
+		if err == nil && info.Mode().IsRegular() {
+			files = append(files, stored{path, info.Size(), info.ModTime(), func() bool { os.Remove(path); return true }})
+		}
+		return nil
+	})
+	for _, m := range listMirrors() {
+		files = append(files, stored{m.path, m.size, m.mod, func() bool { return removeMirror(m.path) }})
+	}
+
+	var total int64
+	kept := files[:0]
+	for _, f := range files {
+		if time.Since(f.mod) > ttl && f.remove() {
+			continue
+		}
+		total += f.size
+		kept = append(kept, f)
+	}
+
+	// Builds past their own policies are gone already; the rest compete for
+	// the store budget with everything else
+	for _, b := range builds {
+		total += b.size
+		kept = append(kept, stored{b.id, b.size, b.mod, func() bool {
+			if b.rec.Pinned {
+				return false
+			}
+			b.evict("store_budget")
+			return true
+		}})
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].mod.Before(kept[j].mod) })
+	for _, f := range kept {
+		if total <= maxBytes {
+			break
+		}
+		if f.remove() {
+			log.Printf("Store over budget, removed %s", f.path)
+			total -= f.size
+		}
+	}
+	expireJournal(slices.DeleteFunc(builds, func(b *storedBuild) bool { return b.evicted }))
+}
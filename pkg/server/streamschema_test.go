@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rexlx/bilder/pkg/client"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files under testdata")
+
+// jsonKind is how encoding/json writes values of t.
+func jsonKind(t reflect.Type) string {
+	if t == reflect.TypeFor[time.Time]() {
+		return "string"
+	}
+	if t == reflect.TypeFor[json.RawMessage]() || t.Implements(reflect.TypeFor[json.Marshaler]()) {
+		return "any"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.String:
+		return "string"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Pointer:
+		return jsonKind(t.Elem())
+	}
+	return "number"
+}
+
+// dataFields appends "path kind" for each field encoding/json writes for
+// t, depth first.
+func dataFields(prefix string, t reflect.Type, out *[]string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if jsonKind(t) == "array" && t.Elem().Kind() != reflect.Uint8 {
+		dataFields(prefix+"[]", t.Elem(), out)
+		return
+	}
+	if t.Kind() == reflect.Map {
+		dataFields(prefix+"{}", t.Elem(), out)
+		return
+	}
+	if t.Kind() != reflect.Struct || jsonKind(t) != "object" {
+		return
+	}
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			dataFields(prefix, f.Type, out)
+			continue
+		}
+		path := prefix + "." + cmp.Or(name, f.Name)
+		*out = append(*out, path+" "+jsonKind(f.Type))
+		dataFields(path, f.Type, out)
+	}
+}
+
+// eventFields describes every event of the stream and the fields of its
+// data, one line each.
+func eventFields() []string {
+	var lines []string
+	for _, name := range slices.Sorted(maps.Keys(sseEvents)) {
+		if sseEvents[name] == nil {
+			lines = append(lines, name+" text")
+			continue
+		}
+		lines = append(lines, name+" "+jsonKind(sseEvents[name]))
+		dataFields(name, sseEvents[name], &lines)
+	}
+	return lines
+}
+
+// The events and fields of each stream schema are recorded under
+// testdata/streamschema. New ones are recorded with -update and keep the
+// schema; removing, renaming or retyping one needs client.StreamSchema
+// bumped, which starts a new record.
+func TestStreamSchemaVersioned(t *testing.T) {
+	golden := filepath.Join("testdata", "streamschema", fmt.Sprintf("schema-%d.txt", client.StreamSchema))
+	current := eventFields()
+	data, err := os.ReadFile(golden)
+	if err != nil && !*update {
+		t.Fatalf("%v: record stream schema %d with go test -run StreamSchemaVersioned -update", err, client.StreamSchema)
+	}
+	var recorded []string
+	for line := range strings.Lines(string(data)) {
+		if line = strings.TrimSpace(line); line != "" {
+			recorded = append(recorded, line)
+		}
+	}
+
+	var changed []string
+	for _, line := range recorded {
+		if !slices.Contains(current, line) {
+			changed = append(changed, line)
+		}
+	}
+	if len(changed) > 0 {
+		t.Fatalf("stream schema %d promised\n  %s\nwhich the events no longer have: bump client.StreamSchema and record the new schema with -update",
+			client.StreamSchema, strings.Join(changed, "\n  "))
+	}
+	if *update {
+		if err := os.WriteFile(golden, []byte(strings.Join(current, "\n")+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	for _, line := range current {
+		if !slices.Contains(recorded, line) {
+			t.Errorf("%s is new to stream schema %d; record it with -update", line, client.StreamSchema)
+		}
+	}
+}
+
+func TestEventsMatchClient(t *testing.T) {
+	if got, want := slices.Sorted(maps.Keys(sseEvents)), slices.Sorted(slices.Values(client.Events)); !slices.Equal(got, want) {
+		t.Errorf("server sends events %v, client.Events are %v", got, want)
+	}
+}
+
+// v1Stream is what a reader of stream schema 1 takes from a stream. Like
+// the v1 structs below it is frozen: it reads streams as clients built
+// against schema 1 do, and must keep doing so.
+type v1Stream struct {
+	Session  v1Session
+	Messages []string
+	Summary  []v1Summary
+	End      *v1End
+	Artifact string
+	Size     int64
+	Data     []byte
+}
+
+type v1Session struct {
+	BuildID  string `json:"build_id"`
+	Protocol string `json:"protocol"`
+}
+
+type v1Summary struct {
+	Target      string `json:"target"`
+	OK          bool   `json:"ok"`
+	Error       string `json:"error"`
+	Artifact    string `json:"artifact"`
+	ArtifactURL string `json:"artifact_url"`
+}
+
+type v1End struct {
+	OK       bool   `json:"ok"`
+	Category string `json:"error_category"`
+}
+
+var v1Events = []string{
+	"session", "job", "step", "progress", "diagnostic", "output", "summary",
+	"matrix_summary", "dry_run", "end", "modules", "report", "binary_start",
+}
+
+// parseV1 reads stream by the rules of schema 1: messages are unnamed data
+// lines, named events carry JSON, sha256: and size: fields precede
+// binary_start, whose blank line the artifact follows.
+func parseV1(stream []byte) (v1Stream, error) {
+	res := v1Stream{Size: -1}
+	r := bufio.NewReader(bytes.NewReader(stream))
+	var event string
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return res, nil
+		} else if err != nil {
+			return res, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if event == "binary_start" {
+				res.Data, err = io.ReadAll(r)
+				return res, err
+			}
+			event = ""
+			continue
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+			continue
+		case strings.HasPrefix(line, "size: "):
+			fmt.Sscan(strings.TrimPrefix(line, "size: "), &res.Size)
+			continue
+		case !strings.HasPrefix(line, "data: "):
+			continue
+		}
+		data := strings.TrimPrefix(line, "data: ")
+		if event != "" && !slices.Contains(v1Events, event) {
+			continue // newer than schema 1
+		}
+		switch event {
+		case "":
+			res.Messages = append(res.Messages, data)
+		case "session":
+			err = json.Unmarshal([]byte(data), &res.Session)
+		case "summary":
+			var s v1Summary
+			err = json.Unmarshal([]byte(data), &s)
+			res.Summary = append(res.Summary, s)
+		case "end":
+			res.End = new(v1End)
+			err = json.Unmarshal([]byte(data), res.End)
+		case "binary_start":
+			res.Artifact = data
+		case "report", "dry_run":
+		default:
+			var fields map[string]any
+			err = json.Unmarshal([]byte(data), &fields)
+		}
+		if err != nil {
+			return res, fmt.Errorf("%s event: %w", event, err)
+		}
+	}
+}
+
+// newestStream is a build's stream as this server sends it on route.
+func newestStream(t *testing.T, route string, artifact bool) []byte {
+	t.Helper()
+	usePolicy(t)
+	w := httptest.NewRecorder()
+	sse := newTestSSE(t, w)
+	sse.legacy = route == "legacy"
+	p := RequestPayload{RepoURL: "https://github.com/acme/app", TargetOS: "linux", TargetArch: "amd64", Targets: []string{"linux/amd64"}}
+	sse.Event("session", newSession("b-1", route, "anonymous", p))
+	sse.Event("job", JobStarted{BuildID: "b-1"})
+	sse.Message("Step 1/3: cloning")
+	sse.Event("step", Step{Index: 1, Total: 3, Name: "clone"})
+	sse.Event("diagnostic", Diagnostic{File: "main.go", Line: 3, Column: 2, Message: "undefined: x"})
+	sse.Message("Error: build failed\nsecond line")
+	summary := BuildSummary{Target: "linux/amd64", Repo: p.RepoURL, TargetOS: "linux", Arch: "amd64"}
+	if artifact {
+		summary.OK, summary.Artifact, summary.ArtifactURL = true, "app", "/v1/artifacts/b-1/app"
+	} else {
+		summary.OK, summary.Error, summary.Category = false, "compile failed", FailCompile
+	}
+	sse.Event("summary", summary)
+	if artifact {
+		if _, err := sse.Binary("app", "00ff", 3, strings.NewReader("abc")); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		sse.Close(streamEnd(false, FailCompile, nil))
+	}
+	return w.Body.Bytes()
+}
+
+// Streams of this server still read right with a schema 1 reader, on the
+// legacy route and, skipping the events schema 1 doesn't know, on the
+// versioned one.
+func TestNewestStreamReadsAsV1(t *testing.T) {
+	for _, route := range []string{"legacy", apiVersion} {
+		for _, artifact := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/artifact=%v", route, artifact), func(t *testing.T) {
+				stream := newestStream(t, route, artifact)
+				got, err := parseV1(stream)
+				if err != nil {
+					t.Fatalf("%v in\n%s", err, stream)
+				}
+				if got.Session.BuildID != "b-1" || got.Session.Protocol != route {
+					t.Errorf("session %+v", got.Session)
+				}
+				if len(got.Summary) != 1 || got.Summary[0].Target != "linux/amd64" || got.Summary[0].OK != artifact {
+					t.Errorf("summaries %+v", got.Summary)
+				}
+				wantMessages := []string{"Step 1/3: cloning", "Error: build failed", "second line"}
+				if route != "legacy" {
+					wantMessages = nil // status events, which schema 1 skips
+				}
+				if !slices.Equal(got.Messages, wantMessages) {
+					t.Errorf("messages %q, want %q", got.Messages, wantMessages)
+				}
+				if artifact {
+					if got.Artifact != "app" || got.Size != 3 || string(got.Data) != "abc" || got.End != nil {
+						t.Errorf("artifact %q of %d bytes: %q, end %+v", got.Artifact, got.Size, got.Data, got.End)
+					}
+				} else if got.End == nil || got.End.OK || got.End.Category != string(FailCompile) {
+					t.Errorf("end %+v", got.End)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package util
+
+// Double doubles n.
+func Double(n int) int { return 2 * n }
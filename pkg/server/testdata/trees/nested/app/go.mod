@@ -0,0 +1,3 @@
+module example.com/nested/app
+
+go 1.21
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// tokenFeatures are the optional request fields a token's allowed_features
+// can grant, each with how to tell a request uses it.
+var tokenFeatures = map[string]func(p RequestPayload, hasProfile bool) bool{
+	"av_check":         func(p RequestPayload, _ bool) bool { return p.AVCheck },
+	"build_all_cmds":   func(p RequestPayload, _ bool) bool { return p.BuildAllCmds },
+	"compare_ref":      func(p RequestPayload, _ bool) bool { return p.CompareRef != "" },
+	"compiler_options": func(p RequestPayload, _ bool) bool { return p.CompilerOptions.set() },
+	"debug":            func(p RequestPayload, _ bool) bool { return p.Debug || p.SplitDebug },
+	"force":            func(p RequestPayload, _ bool) bool { return p.Force },
+	"init_module":      func(p RequestPayload, _ bool) bool { return p.InitModule },
+	"license_report":   func(p RequestPayload, _ bool) bool { return p.LicenseReport },
+	"patch":            func(p RequestPayload, _ bool) bool { return p.Patch != "" },
+	"pgo":              func(p RequestPayload, hasProfile bool) bool { return p.PGO != "" || hasProfile },
+	"resume_policy":    func(p RequestPayload, _ bool) bool { return p.ResumePolicy != "" },
+	"size_report":      func(p RequestPayload, _ bool) bool { return p.SizeReport },
+	"stamp_vcs":        func(p RequestPayload, _ bool) bool { return p.StampVCS },
+}
+
+// featureNames are tokenFeatures' names, sorted.
+func featureNames() []string {
+	names := make([]string, 0, len(tokenFeatures))
+	for name := range tokenFeatures {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// scopeProblems lists what is wrong with t's restrictions.
+func (t Token) scopeProblems() []string {
+	var problems []string
+	for _, target := range t.AllowedTargets {
+		goos, goarch, _ := strings.Cut(target, "/")
+		if _, err := toolchainFor(goos, goarch); err != nil || goarch == "" {
+			problems = append(problems, fmt.Sprintf("allowed_targets: %q is not an os/arch target", target))
+		}
+	}
+	for _, pattern := range t.AllowedRepos {
+		if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+			problems = append(problems, fmt.Sprintf("allowed_repos: %q must be a repository pattern like github.com/acme/*", pattern))
+		}
+	}
+	for _, feature := range t.AllowedFeatures {
+		if tokenFeatures[feature] == nil {
+			problems = append(problems, fmt.Sprintf("allowed_features: unknown feature %q; features are %s", feature, strings.Join(featureNames(), ", ")))
+		}
+	}
+	return problems
+}
+
+func (t Token) permitsTarget(target string) bool {
+	return t.AllowedTargets == nil || slices.Contains(t.AllowedTargets, target)
+}
+
+func (t Token) permitsRepo(repo string) bool {
+	if t.AllowedRepos == nil {
+		return true
+	}
+	return slices.ContainsFunc(t.AllowedRepos, func(pattern string) bool {
+		ok, _ := path.Match(pattern, repo)
+		return ok
+	})
+}
+
+// restriction is the first field of the normalized request p that caller
+// may not use, with why, or "" when the request is permitted. It only
+// names the field, never the rest of the caller's policy. Fields the
+// server's repos config filled in, listed in defaults, count as the
+// operator's choice rather than the caller's and aren't held to
+// allowed_features.
+func restriction(caller string, p RequestPayload, hasProfile bool, defaults []AppliedDefault) (field, problem string) {
+	t, ok := callerToken(caller)
+	if p.Priority == "high" && !(ok && t.HighPriority) {
+		return "priority", "priority \"high\" requires a token with high_priority in the tokens file"
+	}
+	if !ok {
+		return "", ""
+	}
+	if !t.permitsRepo(p.RepoURL) {
+		return "repo_url", fmt.Sprintf("this token may not build %s", p.RepoURL)
+	}
+	for _, target := range p.Targets {
+		if !t.permitsTarget(target) {
+			return "targets", fmt.Sprintf("this token may not build for %s", target)
+		}
+	}
+	if t.AllowedFeatures == nil {
+		return "", ""
+	}
+	for _, name := range featureNames() {
+		defaulted := slices.ContainsFunc(defaults, func(d AppliedDefault) bool {
+			return d.Field == name || name == "debug" && d.Field == "split_debug"
+		})
+		if tokenFeatures[name](p, hasProfile) && !defaulted && !slices.Contains(t.AllowedFeatures, name) {
+			return name, fmt.Sprintf("this token may not use %s", name)
+		}
+	}
+	return "", ""
+}
+
+// callerTargets are the targets of targets that caller may build.
+func callerTargets(caller string, targets []string) []string {
+	t, ok := callerToken(caller)
+	if !ok {
+		return targets
+	}
+	var out []string
+	for _, target := range targets {
+		if t.permitsTarget(target) {
+			out = append(out, target)
+		}
+	}
+	return out
+}
+
+// callerHosts are the hosts of hosts whose repositories caller may build.
+func callerHosts(caller string, hosts []HostInfo) []HostInfo {
+	t, ok := callerToken(caller)
+	if !ok || t.AllowedRepos == nil {
+		return hosts
+	}
+	var out []HostInfo
+	for _, h := range hosts {
+		if slices.ContainsFunc(t.AllowedRepos, func(pattern string) bool {
+			host, _, _ := strings.Cut(pattern, "/")
+			ok, _ := path.Match(host, h.Host)
+			return ok
+		}) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
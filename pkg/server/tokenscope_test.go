@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rexlx/bilder/pkg/client"
+)
+
+var (
+	intern = Token{
+		ID:              "intern",
+		Secret:          "intern-secret",
+		AllowedTargets:  []string{"linux/amd64"},
+		AllowedRepos:    []string{"github.com/acme/*"},
+		AllowedFeatures: []string{"stamp_vcs"},
+	}
+	release = Token{ID: "release", Secret: "release-secret", HighPriority: true}
+	signer  = Token{ID: "signer", Secret: "signer-secret", Mode: "hmac", AllowedTargets: []string{"windows/amd64"}}
+)
+
+func TestRestriction(t *testing.T) {
+	usePolicy(t, WithTokens(intern, release, signer))
+	build := func(edit func(p *RequestPayload)) RequestPayload {
+		p := RequestPayload{RepoURL: "github.com/acme/app", Targets: []string{"linux/amd64"}, Priority: "normal"}
+		if edit != nil {
+			edit(&p)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name       string
+		caller     string
+		payload    RequestPayload
+		hasProfile bool
+		defaults   []AppliedDefault
+		field      string
+	}{
+		{"anonymous plain", "anonymous", build(nil), false, nil, ""},
+		{"anonymous high priority", "anonymous", build(func(p *RequestPayload) { p.Priority = "high" }), false, nil, "priority"},
+		{"unscoped token", "token:release", build(func(p *RequestPayload) { p.RepoURL, p.Targets = "gitlab.com/x/y", []string{"windows/arm64"} }), false, nil, ""},
+		{"high priority token", "token:release", build(func(p *RequestPayload) { p.Priority = "high" }), false, nil, ""},
+		{"scoped high priority", "token:intern", build(func(p *RequestPayload) { p.Priority = "high" }), false, nil, "priority"},
+		{"allowed repo and target", "token:intern", build(nil), false, nil, ""},
+		{"other org", "token:intern", build(func(p *RequestPayload) { p.RepoURL = "github.com/evil/app" }), false, nil, "repo_url"},
+		{"nested path", "token:intern", build(func(p *RequestPayload) { p.RepoURL = "github.com/acme/app/sub" }), false, nil, "repo_url"},
+		{"other target", "token:intern", build(func(p *RequestPayload) { p.Targets = []string{"windows/amd64"} }), false, nil, "targets"},
+		{"one matrix target outside", "token:intern", build(func(p *RequestPayload) { p.Targets = []string{"linux/amd64", "linux/arm64"} }), false, nil, "targets"},
+		{"granted feature", "token:intern", build(func(p *RequestPayload) { p.StampVCS = true }), false, nil, ""},
+		{"withheld feature", "token:intern", build(func(p *RequestPayload) { p.SizeReport = true }), false, nil, "size_report"},
+		{"uploaded profile", "token:intern", build(nil), true, nil, "pgo"},
+		{"defaulted feature", "token:intern", build(func(p *RequestPayload) { p.SizeReport = true }), false, []AppliedDefault{{Field: "size_report"}}, ""},
+		{"defaulted split_debug", "token:intern", build(func(p *RequestPayload) { p.Debug, p.SplitDebug = true, true }), false, []AppliedDefault{{Field: "split_debug"}}, ""},
+		{"requested split_debug", "token:intern", build(func(p *RequestPayload) { p.Debug, p.SplitDebug = true, true }), false, nil, "debug"},
+		{"signing key", "key:signer", build(func(p *RequestPayload) { p.Targets = []string{"linux/amd64"} }), false, nil, "targets"},
+		{"unknown token", "token:gone", build(func(p *RequestPayload) { p.Targets = []string{"windows/amd64"} }), false, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field, problem := restriction(tt.caller, tt.payload, tt.hasProfile, tt.defaults)
+			if field != tt.field {
+				t.Fatalf("restriction = %q (%s), want %q", field, problem, tt.field)
+			}
+			if field != "" && (problem == "" || strings.Contains(problem, "acme/*") || strings.Contains(problem, "stamp_vcs")) {
+				t.Errorf("problem %q should explain the field without revealing the policy", problem)
+			}
+		})
+	}
+}
+
+func TestCallerID(t *testing.T) {
+	usePolicy(t, WithTokens(intern, release, signer))
+	signed := func(id, secret string) func(r *http.Request) {
+		return func(r *http.Request) {
+			ts := time.Now().Unix()
+			r.Header.Set(client.HeaderKeyID, id)
+			r.Header.Set(client.HeaderTimestamp, strconv.FormatInt(ts, 10))
+			r.Header.Set(client.HeaderSignature, client.Signature(secret, ts, r.Method, r.URL.Path, []byte("{}")))
+		}
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		sign    func(r *http.Request)
+		caller  string
+		allowed bool
+	}{
+		{"header token", map[string]string{"X-Billder-Token": "intern-secret"}, nil, "token:intern", true},
+		{"header token with spoofed key id", map[string]string{"X-Billder-Token": "intern-secret", client.HeaderKeyID: "release"}, nil, "token:intern", true},
+		{"key id alone", map[string]string{client.HeaderKeyID: "release"}, nil, "anonymous", false},
+		{"wrong secret", map[string]string{"X-Billder-Token": "guess"}, nil, "anonymous", false},
+		{"hmac key sent as header token", map[string]string{"X-Billder-Token": "signer-secret"}, nil, "anonymous", false},
+		{"signed", nil, signed("signer", "signer-secret"), "key:signer", true},
+		{"signed with the wrong secret", nil, signed("signer", "intern-secret"), "anonymous", false},
+		{"signed by a header token", nil, signed("release", "release-secret"), "anonymous", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/build", strings.NewReader("{}"))
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if tt.sign != nil {
+				tt.sign(r)
+			}
+			w := httptest.NewRecorder()
+			if got := authorized(w, r); got != tt.allowed {
+				t.Errorf("authorized = %v, want %v (%s)", got, tt.allowed, w.Header().Get("X-Billder-Auth-Error"))
+			}
+			if got := callerID(r); got != tt.caller {
+				t.Errorf("callerID = %q, want %q", got, tt.caller)
+			}
+		})
+	}
+}
+
+// A token's scope can't be escaped by naming another token's key.
+func TestSpoofedKeyIDKeepsScope(t *testing.T) {
+	usePolicy(t, WithTokens(intern, release))
+	r := httptest.NewRequest("POST", "/v1/build", strings.NewReader("{}"))
+	r.Header.Set("X-Billder-Token", "intern-secret")
+	r.Header.Set(client.HeaderKeyID, "release")
+	p := RequestPayload{RepoURL: "github.com/acme/app", Targets: []string{"windows/amd64"}, Priority: "high"}
+	if field, _ := restriction(callerID(r), p, false, nil); field == "" {
+		t.Fatal("a spoofed X-Billder-Key-Id lifted the intern token's restrictions")
+	}
+	if limit := artifactLimit(callerID(r)); limit != cfg.MaxArtifactBytes {
+		t.Errorf("artifactLimit = %d, want the server's %d", limit, cfg.MaxArtifactBytes)
+	}
+}
+
+func TestOpenServerCallerIsAnonymous(t *testing.T) {
+	usePolicy(t)
+	r := httptest.NewRequest("POST", "/v1/build", nil)
+	r.Header.Set(client.HeaderKeyID, "x")
+	if got := callerID(r); got != "anonymous" {
+		t.Errorf("callerID = %q, want anonymous", got)
+	}
+}
+
+// useFailedAuths gives the test a failed-authentication limiter of its own
+// on a fake clock.
+func useFailedAuths(t *testing.T) *fakeClock {
+	t.Helper()
+	l, clock := newFakeLimiter()
+	prev := failedAuths
+	failedAuths = l
+	t.Cleanup(func() { failedAuths = prev })
+	return clock
+}
+
+// unreadBody fails the test if anything reads the request body.
+type unreadBody struct{ t *testing.T }
+
+func (b unreadBody) Read([]byte) (int, error) {
+	b.t.Error("the body of a throttled request was read")
+	return 0, io.EOF
+}
+
+// An IP that keeps failing is turned away with a 429 before its
+// credentials, valid or not, are checked. Missing credentials don't count,
+// and other IPs carry on.
+func TestFailedAuthsThrottled(t *testing.T) {
+	usePolicy(t, WithTokens(release, signer))
+	clock := useFailedAuths(t)
+	request := func(ip, token string) (*httptest.ResponseRecorder, bool) {
+		r := httptest.NewRequest("GET", "/v1/builds", nil)
+		r.RemoteAddr = ip + ":40000"
+		if token != "" {
+			r.Header.Set("X-Billder-Token", token)
+		}
+		w := httptest.NewRecorder()
+		return w, authorized(w, r)
+	}
+
+	for range 50 {
+		if w, _ := request("198.51.100.7", ""); w.Header().Get("X-Billder-Auth-Error") != authMissing {
+			t.Fatalf("no credentials: %d %s", w.Code, w.Header().Get("X-Billder-Auth-Error"))
+		}
+	}
+	for i := range authFailureBurst {
+		if w, _ := request("198.51.100.1", "guess"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: %d", i+1, w.Code)
+		}
+	}
+	w, ok := request("198.51.100.1", "release-secret")
+	if ok || w.Code != http.StatusTooManyRequests || w.Header().Get("X-Billder-Auth-Error") != authTooManyFailures || w.Header().Get("Retry-After") != "6" {
+		t.Errorf("after %d failures: %d %v", authFailureBurst, w.Code, w.Header())
+	}
+	r := httptest.NewRequest("POST", "/v1/build", unreadBody{t})
+	r.RemoteAddr = "198.51.100.1:40000"
+	client.Sign(r, "signer", "signer-secret", nil)
+	if caller, reason := authenticate(r); caller != "" || reason != authTooManyFailures {
+		t.Errorf("signed request from a throttled IP: %q %q", caller, reason)
+	}
+	for _, ip := range []string{"198.51.100.2", "198.51.100.7"} {
+		if _, ok := request(ip, "release-secret"); !ok {
+			t.Errorf("%s refused", ip)
+		}
+	}
+
+	// Each failure drains in 60/authFailuresPerMinute seconds
+	clock.advance(6 * time.Second)
+	if _, ok := request("198.51.100.1", "release-secret"); !ok {
+		t.Error("still refused once a failure drained")
+	}
+}
+
+// A signed request's body is hashed only up to what a handler would
+// accept: the JSON limit, or the multipart one for uploads.
+func TestSignedBodyCapped(t *testing.T) {
+	usePolicy(t, WithTokens(signer))
+	useFailedAuths(t)
+	useLimits(t, PayloadLimits{BodyBytes: 64 << 10})
+	for _, tc := range []struct {
+		contentType string
+		size        int
+		reason      string
+	}{
+		{"application/json", 64 << 10, ""},
+		{"application/json", 64<<10 + 1, authBodyTooLarge},
+		{"", 64<<10 + 1, authBodyTooLarge},
+		{"multipart/form-data; boundary=x", 64<<10 + 1, ""},
+	} {
+		body := []byte(strings.Repeat(" ", tc.size))
+		r := httptest.NewRequest("POST", "/v1/build", bytes.NewReader(body))
+		r.Header.Set("Content-Type", tc.contentType)
+		client.Sign(r, "signer", "signer-secret", body)
+		if _, reason := authenticate(r); reason != tc.reason {
+			t.Errorf("%d byte %q body: reason %q, want %q", tc.size, tc.contentType, reason, tc.reason)
+		}
+		if rest, _ := io.ReadAll(r.Body); tc.reason == "" && !bytes.Equal(rest, body) {
+			t.Errorf("%d byte %q body: %d bytes left to the handler", tc.size, tc.contentType, len(rest))
+		}
+	}
+	if _, counted := failedAuths.buckets["192.0.2.1"]; counted {
+		t.Error("oversized bodies counted as failed authentications")
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Toolchain describes the compilers used for a cgo build of one target.
+type Toolchain struct {
+	GOOS      string
+	GOARCH    string
+	CC        string
+	CXX       string
+	PkgConfig string
+	NoCgo     bool // the request set "cgo": false
+}
+
+// builtinTargets lists the GOOS/GOARCH pairs billder has toolchains for.
+var builtinTargets = []string{"linux/amd64", "windows/amd64", "windows/arm64", "android/arm64"}
+
+// toolchainFor returns the toolchain for a GOOS/GOARCH pair.
+func toolchainFor(goos, goarch string) (Toolchain, error) {
+	switch goos {
+	case "windows":
+		if goarch == "arm64" {
+			// llvm-mingw is the only aarch64 MinGW; cgo builds need it installed
+			return Toolchain{
+				GOOS:      goos,
+				GOARCH:    goarch,
+				CC:        "aarch64-w64-mingw32-clang",
+				CXX:       "aarch64-w64-mingw32-clang++",
+				PkgConfig: "aarch64-w64-mingw32-pkg-config",
+			}, nil
+		}
+		// Use MinGW for Windows
+		return Toolchain{
+			GOOS:      goos,
+			GOARCH:    goarch,
+			CC:        "x86_64-w64-mingw32-gcc",
+			CXX:       "x86_64-w64-mingw32-g++",
+			PkgConfig: "x86_64-w64-mingw32-pkg-config",
+		}, nil
+	case "android":
+		if goarch != "arm64" {
+			return Toolchain{}, fmt.Errorf("unsupported target android/%s. Android builds target arm64 devices", goarch)
+		}
+		// The NDK's clang; fyne and gomobile find the rest of the NDK themselves
+		return Toolchain{
+			GOOS:   goos,
+			GOARCH: goarch,
+			CC:     ndkClang(),
+			CXX:    ndkClang() + "++",
+		}, nil
+	case "linux":
+		// Use native GCC
+		return Toolchain{
+			GOOS:      goos,
+			GOARCH:    goarch,
+			CC:        "gcc",
+			PkgConfig: "pkg-config",
+		}, nil
+	}
+	return Toolchain{}, fmt.Errorf("unsupported OS %q. Only 'linux', 'windows' and 'android' supported", goos)
+}
+
+// toolchainsFor returns the toolchain of each target of p, which normalize
+// has already validated.
+func toolchainsFor(p RequestPayload) []Toolchain {
+	toolchains := make([]Toolchain, len(p.Targets))
+	for i, t := range p.Targets {
+		goos, goarch, _ := strings.Cut(t, "/")
+		toolchains[i], _ = toolchainFor(goos, goarch)
+		toolchains[i].NoCgo = !p.cgo()
+		if o := p.CompilerOptions; o != nil && o.MSan {
+			toolchains[i].CC, toolchains[i].CXX = "clang", "clang++" // msan instruments with clang only
+		}
+	}
+	return toolchains
+}
+
+// installed reports whether the toolchain's C compiler is on PATH.
+func (t Toolchain) installed() bool {
+	_, err := exec.LookPath(t.CC)
+	return err == nil
+}
+
+// Vars returns the target-specific environment variables.
+func (t Toolchain) Vars() []string {
+	cgo := "CGO_ENABLED=1"
+	if t.NoCgo {
+		cgo = "CGO_ENABLED=0"
+	}
+	vars := []string{
+		cgo,
+		"GOOS=" + t.GOOS,
+		"GOARCH=" + t.GOARCH,
+		"CC=" + t.CC,
+		"GOCACHE=" + t.CacheDir(),
+	}
+	if t.CXX != "" {
+		vars = append(vars, "CXX="+t.CXX)
+	}
+	if t.GOOS == "android" {
+		vars = append(vars, "ANDROID_HOME="+android.SDK, "ANDROID_NDK_HOME="+android.NDK)
+	}
+	return vars
+}
+
+// Env returns the process environment for running the go tool against this target.
+func (t Toolchain) Env() []string {
+	return append(append(os.Environ(), moduleVars()...), t.Vars()...)
+}
+
+var (
+	cacheRootOnce sync.Once
+	cacheRootDir  string
+)
+
+// cacheRoot is the build cache shared by all targets before partitioning.
+func cacheRoot() string {
+	cacheRootOnce.Do(func() {
+		if cfg.CacheDir != "" {
+			cacheRootDir = cfg.CacheDir
+			return
+		}
+		out, err := exec.Command("go", "env", "GOCACHE").Output()
+		if err == nil {
+			cacheRootDir = strings.TrimSpace(string(out))
+		}
+		if cacheRootDir == "" {
+			cacheRootDir = filepath.Join(os.TempDir(), "billder-gocache")
+		}
+	})
+	return cacheRootDir
+}
+
+// CacheDir is this target's GOCACHE. Each GOOS/GOARCH gets its own
+// subdirectory so parallel targets don't evict each other's entries.
+func (t Toolchain) CacheDir() string {
+	return storePath(cacheRoot(), t.GOOS+"_"+t.GOARCH)
+}
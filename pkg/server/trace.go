@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// span is one timed step of a build, exported to an OTLP/HTTP collector as
+// JSON. Tracing is off unless an endpoint is configured; a nil *span is then
+// passed around and every method returns immediately.
+type span struct {
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	start   time.Time
+	attrs   []otlpAttr
+	errMsg  string
+	root    bool // the request's span; ending it exports the build's spans
+}
+
+// startTrace opens the root span of a build, continuing the caller's trace
+// when it sent a W3C traceparent header.
+func startTrace(traceparent, name string) *span {
+	if exporter == nil {
+		return nil
+	}
+	s := &span{name: name, start: time.Now(), root: true}
+	if traceID, parent, ok := parseTraceparent(traceparent); ok {
+		s.traceID, s.parent = traceID, parent
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.id[:])
+	return s
+}
+
+// child opens a span nested under s.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{traceID: s.traceID, parent: s.id, name: name, start: time.Now()}
+	rand.Read(c.id[:])
+	return c
+}
+
+// set records an attribute. Strings, ints, int64s, float64s and bools are
+// supported.
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	a := otlpAttr{Key: key}
+	switch v := value.(type) {
+	case string:
+		a.Value.String = &v
+	case int:
+		n := strconv.Itoa(v)
+		a.Value.Int = &n
+	case int64:
+		n := strconv.FormatInt(v, 10)
+		a.Value.Int = &n
+	case float64:
+		a.Value.Double = &v
+	case bool:
+		a.Value.Bool = &v
+	}
+	s.attrs = append(s.attrs, a)
+}
+
+// fail marks the span as errored.
+func (s *span) fail(msg string) {
+	if s == nil {
+		return
+	}
+	s.errMsg = msg
+}
+
+// end finishes the span and queues it for export.
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	exporter.add(s.otlp(time.Now()))
+	if s.root {
+		go exporter.flush()
+	}
+}
+
+// traceparent is the W3C header value that makes s the parent of downstream
+// work, or "" when tracing is off.
+func (s *span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.id[:]) + "-01"
+}
+
+// parseTraceparent reads a version 00 W3C traceparent header.
+func parseTraceparent(h string) (traceID [16]byte, parent [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parent, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parent, false
+	}
+	if _, err := hex.Decode(parent[:], []byte(parts[2])); err != nil {
+		return traceID, parent, false
+	}
+	return traceID, parent, traceID != [16]byte{} && parent != [8]byte{}
+}
+
+// OTLP/HTTP JSON encoding, see opentelemetry-proto's trace.proto. IDs are
+// hex strings and 64-bit integers decimal strings.
+type (
+	otlpExport struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttr `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         int        `json:"kind"` // 1 internal, 2 server
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes,omitempty"`
+		Status       otlpStatus `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"` // 1 ok, 2 error
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string `json:"key"`
+		Value struct {
+			String *string  `json:"stringValue,omitempty"`
+			Int    *string  `json:"intValue,omitempty"`
+			Double *float64 `json:"doubleValue,omitempty"`
+			Bool   *bool    `json:"boolValue,omitempty"`
+		} `json:"value"`
+	}
+)
+
+func (s *span) otlp(end time.Time) otlpSpan {
+	out := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.id[:]),
+		Name:       s.name,
+		Kind:       1,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: s.attrs,
+		Status:     otlpStatus{Code: 1},
+	}
+	if s.parent != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.root {
+		out.Kind = 2
+	}
+	if s.errMsg != "" {
+		out.Status = otlpStatus{Code: 2, Message: s.errMsg}
+	}
+	return out
+}
+
+// spanExporter batches finished spans and posts them to the collector.
+type spanExporter struct {
+	url   string
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+const (
+	traceBatch     = 256 // spans per export request
+	traceQueue     = 4096
+	traceFlushTime = 5 * time.Second
+)
+
+// exporter is nil while tracing is off.
+var exporter *spanExporter
+
+// startTracing sends spans to the OTLP/HTTP collector at endpoint (its base
+// URL; /v1/traces is appended). An empty endpoint turns tracing off.
+func startTracing(endpoint string) {
+	if endpoint == "" {
+		exporter = nil
+		return
+	}
+	e := &spanExporter{url: strings.TrimSuffix(endpoint, "/") + "/v1/traces"}
+	exporter = e
+	go func() {
+		for range time.Tick(traceFlushTime) {
+			if exporter != e {
+				return
+			}
+			e.flush()
+		}
+	}()
+}
+
+func (e *spanExporter) add(s otlpSpan) {
+	e.mu.Lock()
+	if len(e.spans) < traceQueue {
+		e.spans = append(e.spans, s)
+	}
+	e.mu.Unlock()
+}
+
+// flush exports the queued spans. Failures are logged and the spans dropped
+// so a dead collector can't grow memory.
+func (e *spanExporter) flush() {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+	for len(spans) > 0 {
+		n := min(len(spans), traceBatch)
+		if err := e.post(spans[:n]); err != nil {
+			log.Printf("Trace export: %v", err)
+		}
+		spans = spans[n:]
+	}
+}
+
+func (e *spanExporter) post(spans []otlpSpan) error {
+	service := "billder"
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{{Spans: spans}}}
+	rs.Resource.Attributes = []otlpAttr{{Key: "service.name"}}
+	rs.Resource.Attributes[0].Value.String = &service
+	rs.ScopeSpans[0].Scope.Name = "github.com/rexlx/bilder/pkg/server"
+	body, err := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{rs}})
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
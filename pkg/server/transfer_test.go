@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useHistory gives the test a build history of its own.
+func useHistory(t *testing.T) {
+	t.Helper()
+	prev := history
+	history = openHistory(filepath.Join(t.TempDir(), "history.json"))
+	t.Cleanup(func() { history = prev })
+}
+
+// streamJob is a build with an artifact of size bytes ready to stream.
+func streamJob(t *testing.T, size int) (*buildJob, string) {
+	t.Helper()
+	useDataDir(t, filepath.Join(t.TempDir(), "data"))
+	useHistory(t)
+	j := &buildJob{id: newBuildID(), tmpDir: t.TempDir()}
+	artifact := filepath.Join(j.tmpDir, "app.exe")
+	if err := os.WriteFile(artifact, bytes.Repeat([]byte("billder!"), size/8), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return j, artifact
+}
+
+func partialMetrics() (int64, int64) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	return metrics.partial, metrics.partialUnsent
+}
+
+// A client that goes away partway through the artifact leaves a partial
+// transfer behind: on the build, in the metrics, and with the artifact
+// still in the store.
+func TestStreamPartialTransfer(t *testing.T) {
+	const size = 64 << 10
+	for _, limit := range []int{200, 4 << 10, size - 1} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			j, artifact := streamJob(t, size)
+			count, unsent := partialMetrics()
+			w := newBrokenWriter(limit)
+			j.stream(artifact, newTestSSE(t, w))
+
+			p := j.partial
+			if p == nil {
+				t.Fatal("no partial transfer recorded")
+			}
+			header := strings.Index(w.body.String(), "\n\n") + 2
+			if p.Artifact != "app.exe" || p.Total != size || p.Sent != int64(w.body.Len()-header) || !strings.Contains(p.Error, "reset") {
+				t.Errorf("partial transfer %+v after %d artifact bytes", p, w.body.Len()-header)
+			}
+			if c, u := partialMetrics(); c != count+1 || u != unsent+p.Total-p.Sent {
+				t.Errorf("metrics counted %d transfers and %d bytes, want %d and %d", c-count, u-unsent, 1, p.Total-p.Sent)
+			}
+			if st, err := os.Stat(storePath(dataDir(), "artifacts", j.id, "app.exe")); err != nil || st.Size() != size {
+				t.Errorf("stored artifact: %v", err)
+			}
+		})
+	}
+}
+
+func TestStreamCompleteTransfer(t *testing.T) {
+	j, artifact := streamJob(t, 64<<10)
+	count, _ := partialMetrics()
+	w := newBrokenWriter(1 << 20)
+	j.stream(artifact, newTestSSE(t, w))
+	if j.partial != nil {
+		t.Errorf("complete transfer recorded as partial: %+v", j.partial)
+	}
+	if c, _ := partialMetrics(); c != count {
+		t.Error("complete transfer counted as partial")
+	}
+	if !strings.Contains(w.body.String(), fmt.Sprintf("size: %d\nevent: binary_start\n", 64<<10)) {
+		t.Errorf("binary_start doesn't advertise the size:\n%.200s", w.body.String())
+	}
+}
+
+// resetAfter reads the response to a GET of url until n bytes past
+// binary_start, then resets the connection.
+func resetAfter(t *testing.T, url string, n int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: billder\r\n\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended before binary_start: %v", err)
+		}
+		if line == "event: binary_start\n" {
+			break
+		}
+	}
+	if _, err := r.Discard(n); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).SetLinger(0) // close with a RST
+	conn.Close()
+}
+
+// A real connection reset midway through a large artifact.
+func TestStreamConnectionReset(t *testing.T) {
+	const size = 32 << 20 // well past what the socket buffers hold
+	j, artifact := streamJob(t, size)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		j.stream(artifact, newTestSSE(t, w))
+	}))
+	defer srv.Close()
+
+	resetAfter(t, srv.URL, 1<<20)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handler still streaming after the reset")
+	}
+	p := j.partial
+	if p == nil {
+		t.Fatal("no partial transfer recorded")
+	}
+	if p.Total != size || p.Sent < 1<<20 || p.Sent >= size {
+		t.Errorf("partial transfer %+v", p)
+	}
+}
+
+// The journal keeps the partial transfer for GET /v1/builds/{id}.
+func TestJournalPartialTransfer(t *testing.T) {
+	useDataDir(t, t.TempDir())
+	rec := &JobRecord{ID: newBuildID()}
+	startJob(rec)
+	rec.PartialTransfer = &PartialTransfer{Artifact: "app.exe", Sent: 10, Total: 20, Error: "write: connection reset by peer"}
+	finishJob(rec, true)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v1/builds/"+rec.ID, nil)
+	r.SetPathValue("id", rec.ID)
+	buildStatusHandler(w, r)
+	want := `"partial_transfer":{"artifact":"app.exe","sent_bytes":10,"total_bytes":20,"error":"write: connection reset by peer"}`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("GET /v1/builds/{id}: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// VCSInfo describes the commit a build was produced from.
+type VCSInfo struct {
+	Commit   string
+	Describe string
+	Branch   string // the requested ref, else the default branch
+	Dirty    bool
+}
+
+// resolveVCS reads commit information from a cloned repository.
+// Missing information is left empty rather than failing the build.
+func resolveVCS(repoPath string) VCSInfo {
+	var info VCSInfo
+	info.Commit = gitOutput(repoPath, "rev-parse", "HEAD")
+	info.Describe = gitOutput(repoPath, "describe", "--tags", "--always")
+	info.Branch = gitOutput(repoPath, "rev-parse", "--abbrev-ref", "HEAD")
+	return info
+}
+
+// isDirty reports whether the working tree differs from HEAD.
+func isDirty(repoPath string) bool {
+	return gitOutput(repoPath, "status", "--porcelain") != ""
+}
+
+// ldflags returns -X flags that stamp the commit into main.commit and main.version.
+func (v VCSInfo) ldflags() string {
+	version := v.Describe
+	if v.Dirty {
+		version += "-dirty"
+	}
+	return fmt.Sprintf("-X main.commit=%s -X main.version=%s", v.Commit, version)
+}
+
+func gitOutput(dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}